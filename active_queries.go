@@ -0,0 +1,131 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ErrQueryCancelled is returned by lookups cancelled with IpfsDHT.CancelQuery.
+var ErrQueryCancelled = errors.New("query cancelled")
+
+// QueryInfo is a snapshot of an in-flight query, see IpfsDHT.ActiveQueries.
+type QueryInfo struct {
+	// ID identifies the query, as in the lookup events of the query.
+	ID uuid.UUID
+	// Operation is the correlation ID of the operation the query belongs to, see CorrelationID.
+	Operation uuid.UUID
+	// Key is the target key of the query.
+	Key string
+	// Started is when the query started.
+	Started time.Time
+	// Rounds is the number of query updates processed so far.
+	Rounds int
+	// RPCs is the number of peers queried so far, including the peers that didn't answer.
+	RPCs int
+	// Heard, Waiting, Queried and Unreachable are the number of peers the query knows in each state: not queried
+	// yet, being queried, that answered, and that failed to answer.
+	Heard, Waiting, Queried, Unreachable int
+}
+
+// activeQuery is the entry of an in-flight query in the queryRegistry.
+type activeQuery struct {
+	cancel context.CancelFunc
+
+	mu        sync.Mutex
+	info      QueryInfo
+	cancelled bool
+}
+
+func (a *activeQuery) isCancelled() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.cancelled
+}
+
+// queryRegistry tracks the in-flight queries of the DHT.
+type queryRegistry struct {
+	mu      sync.Mutex
+	queries map[uuid.UUID]*activeQuery
+}
+
+// register adds q, run with ctx, to the registry, cancel cancelling its context.
+func (r *queryRegistry) register(ctx context.Context, q *query, cancel context.CancelFunc) *activeQuery {
+	a := &activeQuery{
+		cancel: cancel,
+		info:   QueryInfo{ID: q.id, Key: q.key, Started: q.startTime},
+	}
+	a.info.Operation, _ = CorrelationID(ctx)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.queries == nil {
+		r.queries = make(map[uuid.UUID]*activeQuery)
+	}
+	r.queries[q.id] = a
+	return a
+}
+
+func (r *queryRegistry) unregister(id uuid.UUID) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.queries, id)
+}
+
+// updateSnapshot updates the snapshot of q returned by ActiveQueries. It must be called from the goroutine running q.
+func (q *query) updateSnapshot() {
+	if q.active == nil {
+		return
+	}
+	heard, waiting := q.queryPeers.NumHeard(), q.queryPeers.NumWaiting()
+
+	q.active.mu.Lock()
+	defer q.active.mu.Unlock()
+	info := &q.active.info
+	info.Rounds = q.rounds
+	info.RPCs = q.rpcs
+	info.Heard = heard
+	info.Waiting = waiting
+	info.Queried = q.rpcs - q.failedRPCs - waiting
+	info.Unreachable = q.failedRPCs
+}
+
+// ActiveQueries returns a snapshot of the queries currently running their lookup phase, oldest first, for debugging
+// stuck or long-running lookups. Operations may run several queries, e.g. FindProviders enumerating a keyspace
+// region, and the followup phase of a lookup isn't included.
+func (dht *IpfsDHT) ActiveQueries() []QueryInfo {
+	dht.queries.mu.Lock()
+	active := make([]*activeQuery, 0, len(dht.queries.queries))
+	for _, a := range dht.queries.queries {
+		active = append(active, a)
+	}
+	dht.queries.mu.Unlock()
+
+	infos := make([]QueryInfo, len(active))
+	for i, a := range active {
+		a.mu.Lock()
+		infos[i] = a.info
+		a.mu.Unlock()
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Started.Before(infos[j].Started) })
+	return infos
+}
+
+// CancelQuery cancels the in-flight query with the given ID, failing the operation it belongs to with
+// ErrQueryCancelled. It returns false if no such query is running.
+func (dht *IpfsDHT) CancelQuery(id uuid.UUID) bool {
+	dht.queries.mu.Lock()
+	a, ok := dht.queries.queries[id]
+	dht.queries.mu.Unlock()
+	if !ok {
+		return false
+	}
+	a.mu.Lock()
+	a.cancelled = true
+	a.mu.Unlock()
+	a.cancel()
+	return true
+}
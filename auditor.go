@@ -0,0 +1,178 @@
+package dht
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-base32"
+
+	"github.com/libp2p/go-libp2p-kad-dht/internal"
+	dhtcfg "github.com/libp2p/go-libp2p-kad-dht/internal/config"
+	kb "github.com/libp2p/go-libp2p-kbucket"
+	detection "github.com/ssrivatsan97/go-libp2p-kad-dht/eclipse-detection"
+)
+
+// SignalAudit is reported when the closest peers of a key found by a lookup disagree with the ground truth of the
+// trusted auditor.
+const SignalAudit = "audit"
+
+// ErrNoAuditor is returned by NullAuditor.
+var ErrNoAuditor = errors.New("no trusted auditor configured")
+
+// ClosestPeersAuditor provides a ground-truth set of closest peers to a key, e.g. obtained by an external service
+// crawling the whole network, against which the results of local lookups can be checked.
+type ClosestPeersAuditor = dhtcfg.ClosestPeersAuditor
+
+var (
+	_ ClosestPeersAuditor = NullAuditor{}
+	_ ClosestPeersAuditor = (*HTTPAuditor)(nil)
+	_ ClosestPeersAuditor = (*PeerAuditor)(nil)
+)
+
+// NullAuditor has no ground truth to offer. This is the default.
+type NullAuditor struct{}
+
+// ClosestPeers implements ClosestPeersAuditor.
+func (NullAuditor) ClosestPeers(context.Context, interface{}, string) ([]peer.ID, error) {
+	return nil, ErrNoAuditor
+}
+
+// HTTPAuditor fetches the closest peers from an HTTP auditor service. The service is asked with
+//
+//	GET <base URL>/closest-peers/<base32 encoded key>
+//
+// and must answer with a JSON object listing the closest peers: {"Peers": ["12D3KooW...", ...]}.
+type HTTPAuditor struct {
+	baseURL string
+	client  *http.Client
+}
+
+// NewHTTPAuditor returns an HTTPAuditor asking the service at baseURL with client, or http.DefaultClient if nil.
+func NewHTTPAuditor(baseURL string, client *http.Client) (*HTTPAuditor, error) {
+	if _, err := url.Parse(baseURL); err != nil {
+		return nil, fmt.Errorf("invalid auditor URL: %w", err)
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &HTTPAuditor{baseURL: strings.TrimSuffix(baseURL, "/"), client: client}, nil
+}
+
+// ClosestPeers implements ClosestPeersAuditor.
+func (a *HTTPAuditor) ClosestPeers(ctx context.Context, _ interface{}, key string) ([]peer.ID, error) {
+	u := a.baseURL + "/closest-peers/" + base32.RawStdEncoding.EncodeToString([]byte(key))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("auditor returned %s", resp.Status)
+	}
+
+	var body struct {
+		Peers []string
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("decoding auditor response: %w", err)
+	}
+	peers := make([]peer.ID, 0, len(body.Peers))
+	for _, s := range body.Peers {
+		p, err := peer.Decode(s)
+		if err != nil {
+			return nil, fmt.Errorf("auditor returned invalid peer ID %q: %w", s, err)
+		}
+		peers = append(peers, p)
+	}
+	return peers, nil
+}
+
+// PeerAuditor asks a trusted auditor peer for the closest peers with a regular FIND_NODE request over the DHT
+// protocol. The auditor is expected to answer with its crawled view of the network instead of its routing table.
+type PeerAuditor struct {
+	auditor peer.ID
+}
+
+// NewPeerAuditor returns a PeerAuditor asking the given peer, whose addresses must be known to the peerstore.
+func NewPeerAuditor(auditor peer.ID) *PeerAuditor {
+	return &PeerAuditor{auditor: auditor}
+}
+
+// ClosestPeers implements ClosestPeersAuditor.
+func (a *PeerAuditor) ClosestPeers(ctx context.Context, dht interface{}, key string) ([]peer.ID, error) {
+	d, ok := dht.(*IpfsDHT)
+	if !ok {
+		return nil, fmt.Errorf("peer auditor requires an IpfsDHT")
+	}
+	infos, err := d.protoMessenger.GetClosestPeers(ctx, a.auditor, peer.ID(key))
+	if err != nil {
+		return nil, err
+	}
+	peers := make([]peer.ID, 0, len(infos))
+	for _, ai := range infos {
+		peers = append(peers, ai.ID)
+	}
+	return peers, nil
+}
+
+// AuditResult is the outcome of AuditClosestPeers.
+type AuditResult struct {
+	// Lookup is the result of the local lookup.
+	Lookup []peer.ID
+	// Reference is the ground truth of the auditor, narrowed down to the closest bucket size peers.
+	Reference []peer.ID
+	// Difference is the size of the symmetric difference of both sets relative to the size of their union.
+	Difference float64
+	// Suspicious is set if Difference exceeds the configured audit threshold.
+	Suspicious bool
+	// Posterior is the posterior of the key updated with Suspicious, nil without BayesianEclipseDetection. The key is
+	// then only reported as possibly under attack if the posterior is.
+	Posterior *detection.Posterior
+}
+
+// AuditClosestPeers looks up the closest peers to key and compares them with the ground truth of the trusted auditor
+// configured with TrustedAuditor. If they differ by more than the configured threshold, the key is reported to the
+// DetectionAggregator as possibly under attack and, if the provide queue is enabled and this node provides key, a
+// provide of key is queued with ProvidePriorityAttacked. With BayesianEclipseDetection, this only happens once the
+// posterior of the key is an attack.
+func (dht *IpfsDHT) AuditClosestPeers(ctx context.Context, key string) (*AuditResult, error) {
+	reference, err := dht.auditor.ClosestPeers(ctx, dht, key)
+	if err != nil {
+		return nil, err
+	}
+	lookup, err := dht.getClosestPeers(ctx, key, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	reference = kb.SortClosestPeers(reference, kb.ConvertKey(key))
+	if len(reference) > dht.bucketSize {
+		reference = reference[:dht.bucketSize]
+	}
+	res := &AuditResult{
+		Lookup:     lookup,
+		Reference:  reference,
+		Difference: symmetricDifference(lookup, reference),
+	}
+	res.Suspicious = res.Difference > dht.auditThreshold
+	attack := res.Suspicious
+	if res.Posterior = dht.observeAttack(key, res.Suspicious, dht.bayesParams.Auditor); res.Posterior != nil {
+		attack = res.Posterior.Attack
+	}
+	if attack {
+		logger.Warnw("lookup disagrees with trusted auditor", "key", internal.LoggableProviderRecordBytes(key), "difference", res.Difference)
+		dht.detections.Report(AttackSignal{Key: key, Source: SignalAudit, Score: res.Difference})
+		dht.reprovideAttacked(ctx, key)
+	}
+	return res, nil
+}
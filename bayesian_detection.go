@@ -0,0 +1,35 @@
+package dht
+
+import (
+	"github.com/libp2p/go-libp2p/core/routing"
+
+	detection "github.com/ssrivatsan97/go-libp2p-kad-dht/eclipse-detection"
+)
+
+// observeAttack updates the posterior of key with a verdict of a source described by l, see BayesianEclipseDetection.
+// It returns nil if the Bayesian detection is disabled.
+func (dht *IpfsDHT) observeAttack(key string, attack bool, l detection.Likelihood) *detection.Posterior {
+	if dht.bayes == nil {
+		return nil
+	}
+	p := dht.bayes.Observe(key, attack, l, dht.clock.Now())
+	return &p
+}
+
+// AttackPosterior returns the posterior probability that key, e.g. a multihash as a string, is under attack given the
+// detections run and audits made on it, see BayesianEclipseDetection.
+func (dht *IpfsDHT) AttackPosterior(key string) (detection.Posterior, error) {
+	if dht.bayes == nil {
+		return detection.Posterior{}, routing.ErrNotSupported
+	}
+	return dht.bayes.Posterior(key, dht.clock.Now()), nil
+}
+
+// SetAttackPrior sets the prior probability that key is under attack, e.g. higher for keys an attacker is likely to
+// target, see BayesianEclipseDetection.
+func (dht *IpfsDHT) SetAttackPrior(key string, prior float64) error {
+	if dht.bayes == nil {
+		return routing.ErrNotSupported
+	}
+	return dht.bayes.SetPrior(key, prior)
+}
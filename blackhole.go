@@ -0,0 +1,153 @@
+package dht
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/p2p/host/eventbus"
+
+	kb "github.com/libp2p/go-libp2p-kbucket"
+)
+
+// blackholeRegionBits is the length of the key prefixes grouping failed lookups into keyspace regions.
+const blackholeRegionBits = 8
+
+// BlackholeKind classifies the lookups of the DHT failing repeatedly.
+type BlackholeKind int
+
+const (
+	// BlackholeNone means lookups make progress as usual.
+	BlackholeNone BlackholeKind = iota
+	// BlackholeLocal means lookups of all keys fail, typically because the local node lost connectivity.
+	BlackholeLocal
+	// BlackholeTargeted means lookups of some keyspace regions fail while the others succeed, which may be the sign
+	// of an attacker censoring these regions.
+	BlackholeTargeted
+)
+
+func (k BlackholeKind) String() string {
+	switch k {
+	case BlackholeNone:
+		return "none"
+	case BlackholeLocal:
+		return "local"
+	case BlackholeTargeted:
+		return "targeted"
+	}
+	return fmt.Sprintf("BlackholeKind(%d)", int(k))
+}
+
+// EvtBlackholeStatusChanged is emitted when the DHT enters or leaves a blackhole, see IpfsDHT.BlackholeEvents. A lookup
+// fails when it has no peer to start from, none of the peers it queried answered, or none of them returned any peer.
+type EvtBlackholeStatusChanged struct {
+	Kind BlackholeKind
+	// Regions are the hex encoded key prefixes of the keyspace regions whose lookups keep failing, for
+	// BlackholeTargeted.
+	Regions []string
+	// FailedLookups is the number of consecutive failed lookups, of any key for BlackholeLocal and of the regions
+	// for BlackholeTargeted.
+	FailedLookups int
+}
+
+// blackholeDetector tracks the sequences of failed lookups, overall and per keyspace region.
+type blackholeDetector struct {
+	threshold int
+	emitter   event.Emitter
+
+	mu sync.Mutex
+	// consecutive is the number of consecutive failed lookups of any key
+	consecutive int
+	// regions counts the consecutive failed lookups per keyspace region, regions without failures are absent
+	regions map[string]int
+	status  EvtBlackholeStatusChanged
+}
+
+func newBlackholeDetector(bus event.Bus, threshold int) (*blackholeDetector, error) {
+	emitter, err := bus.Emitter(new(EvtBlackholeStatusChanged), eventbus.Stateful)
+	if err != nil {
+		return nil, err
+	}
+	return &blackholeDetector{
+		threshold: threshold,
+		emitter:   emitter,
+		regions:   make(map[string]int),
+	}, nil
+}
+
+// observe records the outcome of a lookup of target and emits the blackhole status if it changed.
+func (b *blackholeDetector) observe(target kb.ID, failed bool) {
+	region := hex.EncodeToString(regionPrefix(target, blackholeRegionBits))
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if failed {
+		b.consecutive++
+		b.regions[region]++
+	} else {
+		b.consecutive = 0
+		delete(b.regions, region)
+	}
+
+	status := EvtBlackholeStatusChanged{Kind: BlackholeNone}
+	if b.consecutive >= b.threshold {
+		status = EvtBlackholeStatusChanged{Kind: BlackholeLocal, FailedLookups: b.consecutive}
+	} else {
+		for r, n := range b.regions {
+			if n >= b.threshold {
+				status.Kind = BlackholeTargeted
+				status.Regions = append(status.Regions, r)
+				status.FailedLookups += n
+			}
+		}
+		sort.Strings(status.Regions)
+	}
+
+	if status.Kind == b.status.Kind && equalStrings(status.Regions, b.status.Regions) {
+		b.status.FailedLookups = status.FailedLookups
+		return
+	}
+	b.status = status
+	if status.Kind != BlackholeNone {
+		logger.Warnw("lookups keep failing", "blackhole", status.Kind, "regions", status.Regions, "failed", status.FailedLookups)
+	}
+	if err := b.emitter.Emit(status); err != nil {
+		logger.Debugw("failed to emit blackhole status", "error", err)
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// BlackholeStatus returns the current blackhole status of the DHT, see BlackholeDetection. It is always BlackholeNone
+// if blackhole detection is disabled.
+func (dht *IpfsDHT) BlackholeStatus() EvtBlackholeStatusChanged {
+	if dht.blackhole == nil {
+		return EvtBlackholeStatusChanged{Kind: BlackholeNone}
+	}
+	dht.blackhole.mu.Lock()
+	defer dht.blackhole.mu.Unlock()
+	s := dht.blackhole.status
+	s.Regions = append([]string(nil), s.Regions...)
+	return s
+}
+
+// BlackholeEvents subscribes to the changes of the blackhole status of the DHT, delivered as EvtBlackholeStatusChanged
+// events, so that applications can tell lookups failing because of a blackhole apart from keys that are simply not
+// found. New subscribers receive the last status emitted, if any.
+//
+// The subscription must be closed when no longer needed.
+func (dht *IpfsDHT) BlackholeEvents(opts ...event.SubscriptionOpt) (event.Subscription, error) {
+	return dht.rtEvents.bus.Subscribe(new(EvtBlackholeStatusChanged), opts...)
+}
@@ -0,0 +1,54 @@
+package dht
+
+import (
+	"context"
+	"math"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"go.opencensus.io/stats"
+
+	"github.com/libp2p/go-libp2p-kad-dht/internal"
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+)
+
+// closerPeerDepth returns the number of leading bits the k closest peers of the network are expected to share with
+// any key, or -1 if the network size is unknown.
+func (dht *IpfsDHT) closerPeerDepth() int {
+	netsize, err := dht.nsEstimator.NetworkSize()
+	if err != nil || netsize <= float64(dht.bucketSize) {
+		return -1
+	}
+	return int(math.Floor(math.Log2(netsize / float64(dht.bucketSize))))
+}
+
+// validateCloserPeers returns the closer peers p returned for the target of q that are relevant to the lookup, see
+// CloserPeerValidation, and whether the response is dominated by irrelevant peers.
+func (q *query) validateCloserPeers(ctx context.Context, p peer.ID, closer []*peer.AddrInfo) ([]*peer.AddrInfo, bool) {
+	if !q.dht.closerPeerValidation || len(closer) == 0 {
+		return closer, false
+	}
+
+	target := internal.KadKey(q.key)
+	responder := internal.KadKey(string(p))
+	ref := internal.CommonPrefixLen(responder[:], target[:])
+	if q.closerPeerDepth >= 0 && q.closerPeerDepth < ref {
+		ref = q.closerPeerDepth
+	}
+	minCPL := ref - q.dht.closerPeerSlack
+
+	relevant := make([]*peer.AddrInfo, 0, len(closer))
+	for _, ai := range closer {
+		// the target itself is always relevant, e.g. to FindPeer
+		if h := internal.KadKey(string(ai.ID)); string(ai.ID) == q.key || internal.CommonPrefixLen(h[:], target[:]) >= minCPL {
+			relevant = append(relevant, ai)
+		}
+	}
+
+	irrelevant := len(closer) - len(relevant)
+	if irrelevant == 0 {
+		return closer, false
+	}
+	logger.Debugw("discarding irrelevant closer peers", "from", p, "irrelevant", irrelevant, "returned", len(closer))
+	stats.Record(ctx, metrics.IrrelevantCloserPeers.M(int64(irrelevant)))
+	return relevant, float64(irrelevant) > behaviorDominance*float64(len(closer))
+}
@@ -0,0 +1,170 @@
+package dht
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+)
+
+// maxClosestPeersCacheEntries bounds the number of keys kept in the closest peers cache.
+const maxClosestPeersCacheEntries = 1024
+
+// Outcomes of the requests to the closest peers cache, see metrics.KeyCacheOutcome.
+const (
+	cacheHit  = "hit"
+	cacheMiss = "miss"
+)
+
+// ClosestPeersCacheStats are the statistics of the closest peers cache, see ClosestPeersCacheTTL.
+type ClosestPeersCacheStats struct {
+	// Entries is the number of keys currently cached.
+	Entries int
+	// Hits and Misses count the lookups served from the cache and run on the network.
+	Hits, Misses uint64
+	// Invalidations counts the entries dropped before they expired.
+	Invalidations uint64
+}
+
+// closestPeersCache caches the closest peers found by GetClosestPeers per key, see ClosestPeersCacheTTL.
+type closestPeersCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*closestPeersEntry
+	stats   ClosestPeersCacheStats
+}
+
+type closestPeersEntry struct {
+	peers   []peer.ID
+	expires time.Time
+}
+
+func newClosestPeersCache(ttl time.Duration) *closestPeersCache {
+	return &closestPeersCache{
+		ttl:     ttl,
+		entries: make(map[string]*closestPeersEntry),
+	}
+}
+
+// get returns the cached closest peers to key, recording the outcome in the statistics if record is set.
+func (c *closestPeersCache) get(key string, record bool) ([]peer.ID, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if ok && time.Now().After(e.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	if record {
+		if ok {
+			c.stats.Hits++
+		} else {
+			c.stats.Misses++
+		}
+	}
+	if !ok {
+		return nil, false
+	}
+	return append([]peer.ID(nil), e.peers...), true
+}
+
+func (c *closestPeersCache) put(key string, peers []peer.ID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if len(c.entries) >= maxClosestPeersCacheEntries {
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= maxClosestPeersCacheEntries {
+			c.entries = make(map[string]*closestPeersEntry)
+		}
+	}
+	c.entries[key] = &closestPeersEntry{peers: append([]peer.ID(nil), peers...), expires: now.Add(c.ttl)}
+}
+
+// invalidate drops the cached closest peers to key, or to all keys if key is empty.
+func (c *closestPeersCache) invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if key == "" {
+		c.stats.Invalidations += uint64(len(c.entries))
+		c.entries = make(map[string]*closestPeersEntry)
+	} else if _, ok := c.entries[key]; ok {
+		c.stats.Invalidations++
+		delete(c.entries, key)
+	}
+}
+
+// invalidatePeer drops the keys p is among the closest peers of, e.g. because p turned out to be unreachable.
+func (c *closestPeersCache) invalidatePeer(p peer.ID) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, e := range c.entries {
+		for _, other := range e.peers {
+			if other == p {
+				c.stats.Invalidations++
+				delete(c.entries, k)
+				break
+			}
+		}
+	}
+}
+
+// getClosestPeersCached is getClosestPeers going through the closest peers cache if enabled. Lookups that can't be
+// shared, see dedupable, always run on the network, and only the lookups that didn't fail are cached.
+func (dht *IpfsDHT) getClosestPeersCached(ctx context.Context, key string) ([]peer.ID, error) {
+	c := dht.closestCache
+	if c == nil || !dedupable(ctx) {
+		return dht.getClosestPeers(ctx, key, nil)
+	}
+	if peers, ok := c.get(key, true); ok {
+		dht.recordClosestPeersCache(ctx, cacheHit)
+		return peers, nil
+	}
+	dht.recordClosestPeersCache(ctx, cacheMiss)
+	peers, err := dht.getClosestPeers(ctx, key, nil)
+	if err == nil {
+		c.put(key, peers)
+	}
+	return peers, err
+}
+
+func (dht *IpfsDHT) recordClosestPeersCache(ctx context.Context, outcome string) {
+	stats.Record(dht.newContextWithLocalTags(ctx, tag.Upsert(metrics.KeyCacheOutcome, outcome)),
+		metrics.ClosestPeersCacheRequests.M(1))
+}
+
+// InvalidateClosestPeers drops the cached closest peers to key, or to all keys if key is empty, forcing the next
+// GetClosestPeers to run the lookup again, see ClosestPeersCacheTTL.
+func (dht *IpfsDHT) InvalidateClosestPeers(key string) {
+	if dht.closestCache != nil {
+		dht.closestCache.invalidate(key)
+	}
+}
+
+// ClosestPeersCacheStats returns the statistics of the closest peers cache, zero if it is disabled, see
+// ClosestPeersCacheTTL.
+func (dht *IpfsDHT) ClosestPeersCacheStats() ClosestPeersCacheStats {
+	c := dht.closestCache
+	if c == nil {
+		return ClosestPeersCacheStats{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.stats
+	s.Entries = len(c.entries)
+	return s
+}
@@ -0,0 +1,249 @@
+package dht
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jbenet/goprocess"
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/routing"
+
+	"github.com/libp2p/go-libp2p-kad-dht/internal"
+	kb "github.com/libp2p/go-libp2p-kbucket"
+)
+
+// ClosestPeersSnapshot is the set of closest peers to a key found by a lookup at a point in time, see
+// WatchClosestPeers.
+type ClosestPeersSnapshot struct {
+	Key   string
+	Time  time.Time
+	Peers []peer.ID
+}
+
+// ClosestPeersDiff describes how the closest peers to a key changed between two snapshots.
+type ClosestPeersDiff struct {
+	Key      string
+	From, To time.Time
+	// Added and Removed are the peers that joined and left the closest peers.
+	Added, Removed []peer.ID
+	// Churn is the size of the symmetric difference of both sets relative to the size of their union.
+	Churn float64
+	// FromMeanCPL and ToMeanCPL are the mean common prefix lengths of the closest peers with the key. Peers sharing
+	// much longer prefixes with the key than before, i.e. moving much closer, are typical of eclipse attacks.
+	FromMeanCPL, ToMeanCPL float64
+}
+
+// DiffClosestPeers computes how the closest peers to the key of from changed in to.
+func DiffClosestPeers(from, to ClosestPeersSnapshot) ClosestPeersDiff {
+	d := ClosestPeersDiff{
+		Key:         from.Key,
+		From:        from.Time,
+		To:          to.Time,
+		Churn:       symmetricDifference(from.Peers, to.Peers),
+		FromMeanCPL: meanCPL(from.Key, from.Peers),
+		ToMeanCPL:   meanCPL(to.Key, to.Peers),
+	}
+	before := make(map[peer.ID]struct{}, len(from.Peers))
+	for _, p := range from.Peers {
+		before[p] = struct{}{}
+	}
+	for _, p := range to.Peers {
+		if _, ok := before[p]; ok {
+			delete(before, p)
+		} else {
+			d.Added = append(d.Added, p)
+		}
+	}
+	for _, p := range from.Peers {
+		if _, ok := before[p]; ok {
+			d.Removed = append(d.Removed, p)
+		}
+	}
+	return d
+}
+
+func meanCPL(key string, peers []peer.ID) float64 {
+	if len(peers) == 0 {
+		return 0
+	}
+	target := kb.ConvertKey(key)
+	var sum int
+	for _, p := range peers {
+		sum += kb.CommonPrefixLen(target, kb.ConvertPeerID(p))
+	}
+	return float64(sum) / float64(len(peers))
+}
+
+// SignalStability is reported when the closest peers of a watched key churn abnormally between two snapshots, see
+// WatchClosestPeers.
+const SignalStability = "stability"
+
+// EvtClosestPeersChurn is emitted when the closest peers of a watched key churn abnormally between two snapshots, see
+// IpfsDHT.ClosestPeersChurnEvents.
+type EvtClosestPeersChurn struct {
+	Diff ClosestPeersDiff
+}
+
+// closestPeersWatch snapshots the closest peers of the watched keys, see WatchClosestPeers.
+type closestPeersWatch struct {
+	interval  time.Duration
+	history   int
+	threshold float64
+	emitter   event.Emitter
+
+	mu sync.Mutex
+	// snapshots are the snapshots of the watched keys, oldest first
+	snapshots map[string][]ClosestPeersSnapshot
+}
+
+func newClosestPeersWatch(bus event.Bus, interval time.Duration, history int, threshold float64) (*closestPeersWatch, error) {
+	emitter, err := bus.Emitter(new(EvtClosestPeersChurn))
+	if err != nil {
+		return nil, err
+	}
+	return &closestPeersWatch{
+		interval:  interval,
+		history:   history,
+		threshold: threshold,
+		emitter:   emitter,
+		snapshots: make(map[string][]ClosestPeersSnapshot),
+	}, nil
+}
+
+// WatchKey adds key to the keys whose closest peers are snapshotted periodically, see WatchClosestPeers. Watching a
+// key that is already watched keeps its snapshots.
+func (dht *IpfsDHT) WatchKey(key string) error {
+	w := dht.closestWatch
+	if w == nil {
+		return routing.ErrNotSupported
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.snapshots[key]; !ok {
+		w.snapshots[key] = nil
+	}
+	return nil
+}
+
+// UnwatchKey stops snapshotting the closest peers of key and drops its snapshots.
+func (dht *IpfsDHT) UnwatchKey(key string) {
+	if w := dht.closestWatch; w != nil {
+		w.mu.Lock()
+		delete(w.snapshots, key)
+		w.mu.Unlock()
+	}
+}
+
+// WatchedKeys returns the keys whose closest peers are snapshotted, sorted.
+func (dht *IpfsDHT) WatchedKeys() []string {
+	w := dht.closestWatch
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	keys := make([]string, 0, len(w.snapshots))
+	for k := range w.snapshots {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ClosestPeersSnapshots returns the snapshots retained for the watched key, oldest first. Diffs between any two of them
+// are computed with DiffClosestPeers.
+func (dht *IpfsDHT) ClosestPeersSnapshots(key string) ([]ClosestPeersSnapshot, error) {
+	w := dht.closestWatch
+	if w == nil {
+		return nil, routing.ErrNotSupported
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]ClosestPeersSnapshot(nil), w.snapshots[key]...), nil
+}
+
+// SnapshotClosestPeers looks up the closest peers to the watched key right away and records them as a new snapshot,
+// returning its diff with the previous snapshot, nil if there is none.
+func (dht *IpfsDHT) SnapshotClosestPeers(ctx context.Context, key string) (*ClosestPeersDiff, error) {
+	w := dht.closestWatch
+	if w == nil {
+		return nil, routing.ErrNotSupported
+	}
+	peers, err := dht.getClosestPeers(ctx, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	return dht.recordClosestPeers(ctx, ClosestPeersSnapshot{Key: key, Time: dht.clock.Now(), Peers: peers}), nil
+}
+
+// recordClosestPeers records snap if its key is still watched and returns its diff with the previous snapshot. Abnormal
+// churn is emitted as EvtClosestPeersChurn and reported to the DetectionAggregator.
+func (dht *IpfsDHT) recordClosestPeers(ctx context.Context, snap ClosestPeersSnapshot) *ClosestPeersDiff {
+	w := dht.closestWatch
+	w.mu.Lock()
+	snaps, ok := w.snapshots[snap.Key]
+	if !ok {
+		w.mu.Unlock()
+		return nil
+	}
+	var diff *ClosestPeersDiff
+	if len(snaps) > 0 {
+		d := DiffClosestPeers(snaps[len(snaps)-1], snap)
+		diff = &d
+	}
+	if snaps = append(snaps, snap); len(snaps) > w.history {
+		snaps = snaps[len(snaps)-w.history:]
+	}
+	w.snapshots[snap.Key] = snaps
+	w.mu.Unlock()
+
+	if diff == nil || diff.Churn <= w.threshold {
+		return diff
+	}
+	logger.Warnw("closest peers churned abnormally", "key", internal.LoggableProviderRecordBytes(snap.Key),
+		"churn", diff.Churn, "added", len(diff.Added), "removed", len(diff.Removed))
+	if err := w.emitter.Emit(EvtClosestPeersChurn{Diff: *diff}); err != nil {
+		logger.Debugw("failed to emit closest peers churn", "error", err)
+	}
+	dht.detections.Report(AttackSignal{Key: snap.Key, Source: SignalStability, Score: diff.Churn})
+	dht.reprovideAttacked(ctx, snap.Key)
+	return diff
+}
+
+// ClosestPeersChurnEvents subscribes to the abnormal churn of the closest peers of the watched keys, delivered as
+// EvtClosestPeersChurn events.
+//
+// The subscription must be closed when no longer needed.
+func (dht *IpfsDHT) ClosestPeersChurnEvents(opts ...event.SubscriptionOpt) (event.Subscription, error) {
+	if dht.closestWatch == nil {
+		return nil, routing.ErrNotSupported
+	}
+	return dht.rtEvents.bus.Subscribe(new(EvtClosestPeersChurn), opts...)
+}
+
+// watchClosestPeers snapshots the watched keys every interval until proc closes.
+func (dht *IpfsDHT) watchClosestPeers(proc goprocess.Process) {
+	ticker := dht.clock.Ticker(dht.closestWatch.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-proc.Closing():
+			return
+		}
+		for _, key := range dht.WatchedKeys() {
+			ctx, cancel := context.WithTimeout(dht.ctx, dht.closestWatch.interval)
+			_, err := dht.SnapshotClosestPeers(ctx, key)
+			cancel()
+			if err != nil {
+				logger.Debugw("failed to snapshot closest peers", "key", internal.LoggableProviderRecordBytes(key), "error", err)
+			}
+			if dht.ctx.Err() != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package dht
+
+import (
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// ConfigSnapshot is the effective configuration of a DHT, see IpfsDHT.Config.
+type ConfigSnapshot struct {
+	// ProtocolPrefix is the prefix of the DHT protocols, Protocols the protocols we query with.
+	ProtocolPrefix protocol.ID
+	Protocols      []protocol.ID
+	// Mode is the configured mode, Server whether we currently run as a server.
+	Mode   ModeOpt
+	Server bool
+
+	BucketSize int
+	// Alpha is the concurrency of lookups, Beta the resiliency, i.e. the number of closest peers that must have
+	// responded for a lookup to terminate.
+	Alpha int
+	Beta  int
+	// RPCTimeoutMin and RPCTimeoutMax bound the adaptive timeout of lookup RPCs.
+	RPCTimeoutMin, RPCTimeoutMax time.Duration
+
+	// SpecialProvide is whether provides send provider records to the whole keyspace region around keys expected to
+	// contain SpecialProvideNumber peers.
+	SpecialProvide       bool
+	SpecialProvideNumber int
+
+	// Detector is the configuration of the eclipse detector.
+	Detector DetectorSnapshot
+}
+
+// DetectorSnapshot is the configuration of the eclipse detector. L and Threshold are derived from the network size
+// estimate, they are the values of the last detection and zero and +Inf respectively before the first detection.
+type DetectorSnapshot struct {
+	K            int
+	KeyspaceBits int
+	L            int
+	Threshold    float64
+}
+
+// Config returns a snapshot of the effective configuration of the DHT, for debugging, and for external systems
+// verifying that deployments are configured consistently.
+func (dht *IpfsDHT) Config() ConfigSnapshot {
+	cs := ConfigSnapshot{
+		ProtocolPrefix:       dht.protocolPrefix,
+		Protocols:            append([]protocol.ID(nil), dht.protocols...),
+		Mode:                 dht.auto,
+		Server:               dht.getMode() == modeServer,
+		BucketSize:           dht.bucketSize,
+		Alpha:                dht.alpha,
+		Beta:                 dht.beta,
+		RPCTimeoutMin:        dht.rpcTimeoutMin,
+		RPCTimeoutMax:        dht.rpcTimeoutMax,
+		SpecialProvide:       enableSpecialProvide,
+		SpecialProvideNumber: dht.getSpecialProvideNumber(),
+	}
+	if dht.detector != nil {
+		cs.Detector = DetectorSnapshot{
+			K:            dht.detector.K(),
+			KeyspaceBits: dht.detector.Keyspace().Bits(),
+			L:            dht.detector.L(),
+			Threshold:    dht.detector.Threshold(),
+		}
+	}
+	return cs
+}
@@ -0,0 +1,120 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multihash"
+)
+
+// ConflictEvent is emitted by SearchValue and GetValue when peers returned divergent values for a key, see
+// RegisterForConflictEvents. Repeated conflicts on a key may be the sign of a split-brain or of forged records.
+type ConflictEvent struct {
+	// Key is the key of the values.
+	Key string
+	// Values are the divergent values returned, in the order they were received.
+	Values []ConflictingValue
+	// Selected is the hash of the value the validator selected as best.
+	Selected multihash.Multihash
+}
+
+// ConflictingValue is one of the divergent values of a ConflictEvent.
+type ConflictingValue struct {
+	// Hash is the SHA2-256 multihash of the value.
+	Hash multihash.Multihash
+	// Peers are the peers that returned the value, the local node included if it stores it.
+	Peers []peer.ID
+}
+
+type conflictEventKey struct{}
+
+// conflictEventChannel delivers the conflict events of the lookups run with a context until it is done.
+type conflictEventChannel struct {
+	mu  sync.Mutex
+	ctx context.Context
+	ch  chan<- *ConflictEvent
+}
+
+func (e *conflictEventChannel) waitThenClose() {
+	<-e.ctx.Done()
+	e.mu.Lock()
+	close(e.ch)
+	e.ch = nil
+	e.mu.Unlock()
+}
+
+func (e *conflictEventChannel) send(ctx context.Context, ev *ConflictEvent) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.ch == nil {
+		return
+	}
+	select {
+	case e.ch <- ev:
+	case <-e.ctx.Done():
+	case <-ctx.Done():
+	}
+}
+
+// RegisterForConflictEvents registers a conflict event channel with the given context. The value lookups run with the
+// returned context send a ConflictEvent on the returned channel whenever peers returned divergent values.
+//
+// The passed context MUST be canceled when the caller is no longer interested in conflict events.
+func RegisterForConflictEvents(ctx context.Context) (context.Context, <-chan *ConflictEvent) {
+	ch := make(chan *ConflictEvent, LookupEventBufferSize)
+	ech := &conflictEventChannel{ch: ch, ctx: ctx}
+	go ech.waitThenClose()
+	return context.WithValue(ctx, conflictEventKey{}, ech), ch
+}
+
+// valueConflicts collects the values returned to a lookup, to build its ConflictEvent.
+type valueConflicts struct {
+	values []ConflictingValue
+	raw    [][]byte
+}
+
+// newValueConflicts returns a collector of the values returned to a lookup run with ctx, nil if nobody registered for
+// the conflict events of ctx.
+func newValueConflicts(ctx context.Context) *valueConflicts {
+	if ctx.Value(conflictEventKey{}) == nil {
+		return nil
+	}
+	return new(valueConflicts)
+}
+
+func (c *valueConflicts) add(v recvdVal) {
+	if c == nil {
+		return
+	}
+	for i, raw := range c.raw {
+		if bytes.Equal(raw, v.Val) {
+			c.values[i].Peers = append(c.values[i].Peers, v.From)
+			return
+		}
+	}
+	h, err := multihash.Sum(v.Val, multihash.SHA2_256, -1)
+	if err != nil {
+		return
+	}
+	c.raw = append(c.raw, v.Val)
+	c.values = append(c.values, ConflictingValue{Hash: h, Peers: []peer.ID{v.From}})
+}
+
+// publish sends the ConflictEvent of the lookup of key if divergent values were returned, best being the selected one.
+func (c *valueConflicts) publish(ctx context.Context, key string, best []byte) {
+	if c == nil || len(c.values) < 2 {
+		return
+	}
+	ev := &ConflictEvent{Key: key, Values: c.values}
+	for i, raw := range c.raw {
+		if bytes.Equal(raw, best) {
+			ev.Selected = c.values[i].Hash
+		}
+		sort.Slice(c.values[i].Peers, func(a, b int) bool { return c.values[i].Peers[a] < c.values[i].Peers[b] })
+	}
+	logger.Infow("peers returned divergent values", "key", key, "values", len(c.values))
+	ctx.Value(conflictEventKey{}).(*conflictEventChannel).send(ctx, ev)
+}
@@ -0,0 +1,41 @@
+package dht
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+type correlationKey struct{}
+
+// WithCorrelationID makes the DHT operations run with the returned context use id as correlation ID, instead of a
+// random one, e.g. to correlate them with the request of the application that started them.
+func WithCorrelationID(ctx context.Context, id uuid.UUID) context.Context {
+	return context.WithValue(ctx, correlationKey{}, id)
+}
+
+// CorrelationID returns the correlation ID of the DHT operation ctx belongs to. The top-level operations of the DHT
+// (Provide, GetValue, SearchValue, FindPeer and FindProviders) tag their log lines, lookup events, lookup traces and
+// queries with it, so that the activity of concurrent operations can be told apart.
+func CorrelationID(ctx context.Context) (uuid.UUID, bool) {
+	id, ok := ctx.Value(correlationKey{}).(uuid.UUID)
+	return id, ok
+}
+
+// withCorrelationID returns ctx with a correlation ID, keeping the one of ctx if it has one already so that the
+// operations run on behalf of another, such as the lookups of a provide, share its correlation ID.
+func withCorrelationID(ctx context.Context) context.Context {
+	if _, ok := CorrelationID(ctx); ok {
+		return ctx
+	}
+	return WithCorrelationID(ctx, uuid.New())
+}
+
+// opLogger returns the logger tagged with the correlation ID of the operation ctx belongs to, if any.
+func opLogger(ctx context.Context) *zap.SugaredLogger {
+	if id, ok := CorrelationID(ctx); ok {
+		return logger.With("op", id)
+	}
+	return &logger.SugaredLogger
+}
@@ -0,0 +1,104 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"github.com/libp2p/go-libp2p-kad-dht/internal"
+	kb "github.com/libp2p/go-libp2p-kbucket"
+)
+
+// CrossCheckResult is the outcome of CrossCheckClosestPeers.
+type CrossCheckResult struct {
+	// Primary is the result of the regular lookup, seeded from the peers closest to the key in the routing table.
+	Primary []peer.ID
+	// Secondary is the result of the lookup seeded from independent peers.
+	Secondary []peer.ID
+	// Difference is the size of the symmetric difference of both results relative to the size of their union,
+	// 0 meaning both lookups agree and 1 meaning they have no peer in common.
+	Difference float64
+	// Suspicious is set if Difference exceeds the configured cross-check threshold.
+	Suspicious bool
+}
+
+// CrossCheckClosestPeers looks up the closest peers to key twice: once as GetClosestPeers does and once starting
+// from an independent set of seeds, either the trusted peers configured with CrossCheckSeeds or a random subset of
+// the routing table disjoint from the peers seeding the first lookup. If the two results differ by more than the
+// configured threshold, the key is reported to the DetectionAggregator as possibly under attack.
+func (dht *IpfsDHT) CrossCheckClosestPeers(ctx context.Context, key string) (*CrossCheckResult, error) {
+	seeds := dht.crossCheckSeeds(key)
+	if len(seeds) == 0 {
+		return nil, fmt.Errorf("no independent seed peers available for cross-check")
+	}
+
+	primary, err := dht.getClosestPeers(ctx, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	secondary, err := dht.GetClosestPeersSeeded(ctx, key, seeds)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &CrossCheckResult{
+		Primary:    primary,
+		Secondary:  secondary,
+		Difference: symmetricDifference(primary, secondary),
+	}
+	res.Suspicious = res.Difference > dht.crossCheckThreshold
+	if res.Suspicious {
+		logger.Warnw("lookups from independent seeds disagree", "key", internal.LoggableProviderRecordBytes(key), "difference", res.Difference)
+		dht.detections.Report(AttackSignal{Key: key, Source: SignalCrossCheck, Score: res.Difference})
+	}
+	return res, nil
+}
+
+// crossCheckSeeds returns the seeds for the independent lookup of key.
+func (dht *IpfsDHT) crossCheckSeeds(key string) []peer.ID {
+	if len(dht.crossCheckTrustedSeeds) > 0 {
+		return dht.crossCheckTrustedSeeds
+	}
+
+	primarySeeds := make(map[peer.ID]struct{})
+	for _, p := range dht.routingTable.NearestPeers(kb.ConvertKey(key), dht.bucketSize) {
+		primarySeeds[p] = struct{}{}
+	}
+
+	var candidates []peer.ID
+	for _, p := range dht.routingTable.ListPeers() {
+		if _, ok := primarySeeds[p]; !ok {
+			candidates = append(candidates, p)
+		}
+	}
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	if len(candidates) > dht.bucketSize {
+		candidates = candidates[:dht.bucketSize]
+	}
+	return candidates
+}
+
+// symmetricDifference returns |a Δ b| / |a ∪ b|.
+func symmetricDifference(a, b []peer.ID) float64 {
+	set := make(map[peer.ID]int, len(a)+len(b))
+	for _, p := range a {
+		set[p] |= 1
+	}
+	for _, p := range b {
+		set[p] |= 2
+	}
+	if len(set) == 0 {
+		return 0
+	}
+	diff := 0
+	for _, v := range set {
+		if v != 3 {
+			diff++
+		}
+	}
+	return float64(diff) / float64(len(set))
+}
@@ -0,0 +1,308 @@
+package dht
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/routing"
+	"github.com/libp2p/go-libp2p/core/test"
+	"github.com/multiformats/go-base32"
+
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSymmetricDifference(t *testing.T) {
+	p := make([]peer.ID, 4)
+	for i := range p {
+		p[i] = test.RandPeerIDFatal(t)
+	}
+
+	require.Zero(t, symmetricDifference(nil, nil))
+	require.Zero(t, symmetricDifference(p[:2], []peer.ID{p[1], p[0]}))
+	require.Equal(t, 1.0, symmetricDifference(p[:2], p[2:]))
+	require.Equal(t, 2.0/3, symmetricDifference(p[:2], p[1:3]))
+}
+
+func TestDetectionAggregator(t *testing.T) {
+	a := newDetectionAggregator(time.Minute)
+
+	a.Report(AttackSignal{Key: "a", Source: SignalCrossCheck, Score: 0.5})
+	a.Report(AttackSignal{Key: "a", Source: SignalEclipseDetection, Score: 0.5})
+	a.Report(AttackSignal{Key: "b", Source: SignalCrossCheck, Score: 2})
+	// expired signals are dropped
+	a.Report(AttackSignal{Key: "c", Source: SignalCrossCheck, Score: 1, Time: time.Now().Add(-time.Hour)})
+
+	require.Len(t, a.Signals("a"), 2)
+	require.InDelta(t, 0.75, a.Score("a"), 1e-9)
+	require.Equal(t, 1.0, a.Score("b"))
+	require.Empty(t, a.Signals("c"))
+	require.Zero(t, a.Score("c"))
+}
+
+func TestCrossCheckClosestPeers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 10)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			defer d.host.Close()
+		}
+	}()
+
+	// a fully connected network: both lookups must find the same closest peers
+	for i, a := range dhts {
+		for _, b := range dhts[i+1:] {
+			connect(t, ctx, a, b)
+		}
+	}
+
+	querier := dhts[0]
+	querier.crossCheckTrustedSeeds = []peer.ID{dhts[5].self}
+	res, err := querier.CrossCheckClosestPeers(ctx, "foo")
+	require.NoError(t, err)
+	require.NotEmpty(t, res.Primary)
+	require.False(t, res.Suspicious)
+	require.Empty(t, querier.DetectionAggregator().Signals("foo"))
+}
+
+func TestAuditClosestPeers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 4)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			defer d.host.Close()
+		}
+	}()
+	for i, a := range dhts {
+		for _, b := range dhts[i+1:] {
+			connect(t, ctx, a, b)
+		}
+	}
+
+	_, err := dhts[0].AuditClosestPeers(ctx, "key")
+	require.ErrorIs(t, err, ErrNoAuditor)
+
+	// an auditor whose ground truth matches the network
+	dhts[0].auditor = NewPeerAuditor(dhts[1].self)
+	res, err := dhts[0].AuditClosestPeers(ctx, "key")
+	require.NoError(t, err)
+	require.False(t, res.Suspicious)
+	require.Empty(t, dhts[0].detections.Signals("key"))
+
+	// an auditor knowing of peers the lookup did not find
+	var requested string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = r.URL.Path
+		_ = json.NewEncoder(w).Encode(map[string][]string{
+			"Peers": {test.RandPeerIDFatal(t).String(), test.RandPeerIDFatal(t).String()},
+		})
+	}))
+	defer srv.Close()
+	dhts[0].auditor, err = NewHTTPAuditor(srv.URL+"/", nil)
+	require.NoError(t, err)
+
+	res, err = dhts[0].AuditClosestPeers(ctx, "key")
+	require.NoError(t, err)
+	require.Equal(t, "/closest-peers/"+base32.RawStdEncoding.EncodeToString([]byte("key")), requested)
+	require.Len(t, res.Reference, 2)
+	require.Equal(t, 1.0, res.Difference)
+	require.True(t, res.Suspicious)
+	require.Len(t, dhts[0].detections.Signals("key"), 1)
+}
+
+func TestWatchClosestPeers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 4, WatchClosestPeers(time.Hour, 2, 0.5))
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			defer d.host.Close()
+		}
+	}()
+	for _, d := range dhts[1:] {
+		connect(t, ctx, dhts[0], d)
+	}
+	d := dhts[0]
+
+	_, err := d.SnapshotClosestPeers(ctx, "key")
+	require.NoError(t, err)
+	_, err = d.ClosestPeersSnapshots("key")
+	require.NoError(t, err)
+
+	require.NoError(t, d.WatchKey("key"))
+	require.Equal(t, []string{"key"}, d.WatchedKeys())
+	sub, err := d.ClosestPeersChurnEvents()
+	require.NoError(t, err)
+	defer sub.Close()
+
+	diff, err := d.SnapshotClosestPeers(ctx, "key")
+	require.NoError(t, err)
+	require.Nil(t, diff)
+	diff, err = d.SnapshotClosestPeers(ctx, "key")
+	require.NoError(t, err)
+	require.Zero(t, diff.Churn)
+	require.Empty(t, d.detections.Signals("key"))
+
+	// the closest peers are replaced
+	snaps, err := d.ClosestPeersSnapshots("key")
+	require.NoError(t, err)
+	require.Len(t, snaps, 2)
+	sybils := []peer.ID{test.RandPeerIDFatal(t), test.RandPeerIDFatal(t)}
+	diff = d.recordClosestPeers(ctx, ClosestPeersSnapshot{Key: "key", Time: time.Now(), Peers: sybils})
+	require.Equal(t, 1.0, diff.Churn)
+	require.ElementsMatch(t, sybils, diff.Added)
+	require.ElementsMatch(t, snaps[1].Peers, diff.Removed)
+
+	select {
+	case e := <-sub.Out():
+		require.Equal(t, *diff, e.(EvtClosestPeersChurn).Diff)
+	case <-time.After(time.Second):
+		t.Fatal("no churn event")
+	}
+	require.Len(t, d.detections.Signals("key"), 1)
+	require.Equal(t, SignalStability, d.detections.Signals("key")[0].Source)
+
+	snaps, err = d.ClosestPeersSnapshots("key")
+	require.NoError(t, err)
+	require.Len(t, snaps, 2)
+	require.Equal(t, sybils, snaps[1].Peers)
+
+	d.UnwatchKey("key")
+	require.Empty(t, d.WatchedKeys())
+	_, err = setupDHT(ctx, t, false).ClosestPeersSnapshots("key")
+	require.ErrorIs(t, err, routing.ErrNotSupported)
+}
+
+func TestVerifyFromVantages(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clk := clock.NewMock()
+	storer := setupDHT(ctx, t, false)
+	probe := setupDHT(ctx, t, false)
+	vantage := setupDHT(ctx, t, true)
+	d := setupDHT(ctx, t, false, WithClock(clk),
+		IndependentVantages(time.Hour, NewDHTVantage(vantage), NewProbePeerVantage(probe.self)))
+	connect(t, ctx, d, storer)
+	connectNoSync(t, ctx, vantage, storer)
+	wait(t, ctx, vantage, storer)
+
+	key := testCaseCids[0]
+	require.NoError(t, d.ProvideWithoutEclipseDetection(ctx, key, true))
+
+	// the second DHT finds the record, the probe doesn't store it
+	connect(t, ctx, d, probe)
+	res, err := d.VerifyFromVantages(ctx, key.Hash())
+	require.NoError(t, err)
+	require.Equal(t, 1, res.Retrievable)
+	require.Equal(t, 1, res.Missing)
+	require.Zero(t, res.Failed)
+	sigs := d.detections.Signals(string(key.Hash()))
+	require.Len(t, sigs, 1)
+	require.Equal(t, SignalVantage, sigs[0].Source)
+	require.Equal(t, 0.5, sigs[0].Score)
+
+	// the provide scheduled a verification
+	clk.Add(time.Hour)
+	require.Eventually(t, func() bool {
+		return len(d.detections.Signals(string(key.Hash()))) == 2
+	}, 10*time.Second, 10*time.Millisecond)
+
+	_, err = storer.VerifyFromVantages(ctx, key.Hash())
+	require.Error(t, err)
+}
+
+func TestShadowDHT(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 4)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			defer d.host.Close()
+		}
+	}()
+	for i, a := range dhts {
+		for _, b := range dhts[i+1:] {
+			connect(t, ctx, a, b)
+		}
+	}
+
+	_, err := NewShadowDHT(ctx, dhts[0], nil)
+	require.Error(t, err)
+
+	shadow, err := NewShadowDHT(ctx, dhts[0], []peer.AddrInfo{{ID: dhts[1].self}}, DisableAutoRefresh())
+	require.NoError(t, err)
+	defer shadow.Close()
+	require.Equal(t, modeClient, shadow.getMode())
+
+	// the shadow only knows its bootstrap peer, although the host is connected to all peers
+	require.Eventually(t, func() bool { return shadow.routingTable.Find(dhts[1].self) != "" }, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, 1, shadow.routingTable.Size())
+	require.Equal(t, modeServer, dhts[0].getMode())
+
+	res, err := shadow.CrossValidateClosest(ctx, "key")
+	require.NoError(t, err)
+	require.Zero(t, res.Difference)
+	require.False(t, res.Suspicious)
+	require.Empty(t, dhts[0].detections.Signals("key"))
+	require.ElementsMatch(t, []peer.ID{dhts[1].self, dhts[2].self, dhts[3].self}, shadow.routingTable.ListPeers())
+}
+
+func TestDetectorHints(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	honest := setupDHT(ctx, t, false, NetsizeEstimator(fixedNetsize(1000)), ServeDetectorHints())
+	liar := setupDHT(ctx, t, false, NetsizeEstimator(fixedNetsize(1e6)), ServeDetectorHints())
+	silent := setupDHT(ctx, t, false, NetsizeEstimator(fixedNetsize(1000)))
+	d := setupDHT(ctx, t, false, NetsizeEstimator(fixedNetsize(800)), RequestDetectorHints(2))
+	for _, s := range []*IpfsDHT{honest, liar, silent} {
+		connect(t, ctx, d, s)
+	}
+
+	key := testCaseCids[0].Hash()
+	hctx, hints := d.withDetectorHints(ctx)
+	require.NotNil(t, hints)
+	for _, s := range []*IpfsDHT{honest, liar, silent} {
+		_, _, err := d.getProviders(hctx, s.self, key, -1)
+		require.NoError(t, err)
+	}
+	// the hint of the liar is too far from our estimate, the silent server doesn't serve hints
+	require.Equal(t, []float64{1000}, hints.netsizes)
+	require.Equal(t, 1, hints.rejected)
+
+	// hints whose distribution doesn't match their network size are rejected
+	forged := &pb.DetectorHint{Netsize: 1000, Expected: make([]float64, 20)}
+	forged.Expected[0] = 20
+	require.False(t, d.detectorHints.verify(d, forged))
+
+	// random peers are far from the closest peers expected among 1000
+	peers := []peer.ID{honest.self, liar.self, silent.self}
+	tvd, ok := d.evaluateDetectorHints(key, peers, hints)
+	require.True(t, ok)
+	require.Greater(t, tvd, hintEvidenceThreshold)
+	sigs := d.detections.Signals(string(key))
+	require.Len(t, sigs, 1)
+	require.Equal(t, SignalDetectorHint, sigs[0].Source)
+
+	// hints are only requested when enabled
+	_, none := honest.withDetectorHints(ctx)
+	require.Nil(t, none)
+}
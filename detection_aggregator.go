@@ -0,0 +1,134 @@
+package dht
+
+import (
+	"sync"
+	"time"
+)
+
+// Sources of attack signals reported to the DetectionAggregator.
+const (
+	// SignalEclipseDetection is reported when the KL-divergence detector flags the closest peers of a key.
+	SignalEclipseDetection = "eclipse-detection"
+	// SignalCrossCheck is reported when lookups from independent seeds disagree on the closest peers of a key.
+	SignalCrossCheck = "cross-check"
+	// SignalShadow is reported when the lookups of a DHT and of its ShadowDHT disagree on the closest peers of a key.
+	SignalShadow = "shadow"
+	// SignalVantage is reported when independent vantage points can't find this node as a provider of a key it
+	// provided.
+	SignalVantage = "vantage"
+	// SignalDetectorHint is reported when the closest peers of a key deviate from the distribution expected from the
+	// network size estimates of the peers we queried, see RequestDetectorHints.
+	SignalDetectorHint = "detector-hint"
+)
+
+// defaultSignalWindow is how long attack signals are retained by the DetectionAggregator.
+const defaultSignalWindow = time.Hour
+
+// AttackSignal is a single piece of evidence that a key may be under attack.
+type AttackSignal struct {
+	// Key is the DHT key the signal refers to.
+	Key string
+	// Source names the mechanism that produced the signal.
+	Source string
+	// Score is the strength of the signal in [0, 1].
+	Score float64
+	// Time is when the signal was reported.
+	Time time.Time
+}
+
+// DetectionAggregator collects attack signals produced by the different detection mechanisms of the DHT so that
+// they can be evaluated together per key. Signals older than the retention window are discarded.
+type DetectionAggregator struct {
+	window time.Duration
+
+	mu      sync.Mutex
+	signals map[string][]AttackSignal
+}
+
+func newDetectionAggregator(window time.Duration) *DetectionAggregator {
+	return &DetectionAggregator{
+		window:  window,
+		signals: make(map[string][]AttackSignal),
+	}
+}
+
+// Report records an attack signal. A zero signal time is replaced with the current time.
+func (a *DetectionAggregator) Report(s AttackSignal) {
+	if s.Time.IsZero() {
+		s.Time = time.Now()
+	}
+	if s.Score < 0 {
+		s.Score = 0
+	} else if s.Score > 1 {
+		s.Score = 1
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.pruneLocked(s.Time)
+	a.signals[s.Key] = append(a.signals[s.Key], s)
+}
+
+// Signals returns the retained signals for the given key, oldest first.
+func (a *DetectionAggregator) Signals(key string) []AttackSignal {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.pruneLocked(time.Now())
+	return append([]AttackSignal(nil), a.signals[key]...)
+}
+
+// Score combines the retained signals for the given key into a single score in [0, 1], treating the signals as
+// independent evidence: 1 - Π(1 - score).
+func (a *DetectionAggregator) Score(key string) float64 {
+	clean := 1.0
+	for _, s := range a.Signals(key) {
+		clean *= 1 - s.Score
+	}
+	return 1 - clean
+}
+
+func (a *DetectionAggregator) pruneLocked(now time.Time) {
+	cutoff := now.Add(-a.window)
+	for k, sigs := range a.signals {
+		i := 0
+		for i < len(sigs) && sigs[i].Time.Before(cutoff) {
+			i++
+		}
+		if i == len(sigs) {
+			delete(a.signals, k)
+		} else if i > 0 {
+			a.signals[k] = sigs[i:]
+		}
+	}
+}
+
+// DetectionSummary summarizes the signals retained by the DetectionAggregator, see DetectionAggregator.Summary.
+type DetectionSummary struct {
+	// Keys is the number of keys with retained signals, and Signals the number of signals.
+	Keys    int
+	Signals int
+	// Sources is the number of retained signals per source.
+	Sources map[string]int
+	// MaxScore is the highest combined score of a key, see Score.
+	MaxScore float64
+}
+
+// Summary summarizes the retained signals of all keys.
+func (a *DetectionAggregator) Summary() DetectionSummary {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.pruneLocked(time.Now())
+	s := DetectionSummary{Keys: len(a.signals), Sources: make(map[string]int)}
+	for _, sigs := range a.signals {
+		clean := 1.0
+		for _, sig := range sigs {
+			s.Signals++
+			s.Sources[sig.Source]++
+			clean *= 1 - sig.Score
+		}
+		if score := 1 - clean; score > s.MaxScore {
+			s.MaxScore = score
+		}
+	}
+	return s
+}
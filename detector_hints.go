@@ -0,0 +1,216 @@
+package dht
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multihash"
+
+	"github.com/libp2p/go-libp2p-kad-dht/internal"
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+)
+
+const (
+	// maxHintNetsize bounds the network size of the detector hints we accept.
+	maxHintNetsize = 1 << 40
+	// maxHintPeers bounds the number of closest peers the distribution of a detector hint we accept is about.
+	maxHintPeers = 100
+	// hintMaxError is how much the distribution of a detector hint may deviate per prefix length from the one we
+	// expect for its network size.
+	hintMaxError = 1e-3
+	// hintMinExpected is the expected number of peers below which the trailing prefix lengths of the hints we serve
+	// are omitted.
+	hintMinExpected = 1e-6
+	// hintEvidenceThreshold is the total variation distance between the prefix lengths of the closest peers of a key
+	// and the distribution expected from the detector hints above which the key is reported as possibly eclipsed.
+	hintEvidenceThreshold = 0.5
+	// maxCachedHintDists bounds the number of expected distributions cached to verify detector hints.
+	maxCachedHintDists = 64
+)
+
+// detectorHints serves detector hints to the clients asking for them and verifies the hints returned to our lookups.
+type detectorHints struct {
+	serve     bool
+	request   bool
+	tolerance float64
+
+	mu sync.Mutex
+	// served is the encoded hint we serve, for the network size servedNetsize
+	served        []byte
+	servedNetsize int
+	// dists caches the expected distributions by network size and number of peers
+	dists map[[2]int][]float64
+}
+
+func newDetectorHints(serve, request bool, tolerance float64) *detectorHints {
+	return &detectorHints{
+		serve:     serve,
+		request:   request,
+		tolerance: tolerance,
+		dists:     make(map[[2]int][]float64),
+	}
+}
+
+// expected returns the expected number of the k closest peers per prefix length among n peers.
+func (h *detectorHints) expected(dht *IpfsDHT, n, k int) []float64 {
+	key := [2]int{n, k}
+	h.mu.Lock()
+	mean, ok := h.dists[key]
+	h.mu.Unlock()
+	if ok {
+		return mean
+	}
+
+	mean, _ = dht.detector.ExpectedPrefixLenCounts(n, k)
+	h.mu.Lock()
+	if len(h.dists) >= maxCachedHintDists {
+		h.dists = make(map[[2]int][]float64)
+	}
+	h.dists[key] = mean
+	h.mu.Unlock()
+	return mean
+}
+
+// hint returns the encoded detector hint we serve, nil if we have no network size estimate.
+func (h *detectorHints) hint(dht *IpfsDHT) []byte {
+	netsize, err := dht.nsEstimator.NetworkSize()
+	if err != nil || netsize < 1 || netsize > maxHintNetsize {
+		return nil
+	}
+	n := int(math.Round(netsize))
+
+	h.mu.Lock()
+	served, cached := h.served, h.served != nil && h.servedNetsize == n
+	h.mu.Unlock()
+	if cached {
+		return served
+	}
+
+	mean := h.expected(dht, n, dht.bucketSize)
+	last := len(mean)
+	for last > 0 && mean[last-1] < hintMinExpected {
+		last--
+	}
+	if last > pb.MaxDetectorHintLen {
+		last = pb.MaxDetectorHintLen
+	}
+	served = (&pb.DetectorHint{Netsize: float64(n), Expected: mean[:last]}).Marshal()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.served, h.servedNetsize = served, n
+	return served
+}
+
+// verify checks that the distribution of hint is the one expected for its network size, and that its network size
+// is within the tolerance of our own estimate.
+func (h *detectorHints) verify(dht *IpfsDHT, hint *pb.DetectorHint) bool {
+	local, err := dht.nsEstimator.NetworkSize()
+	if err != nil || local < 1 {
+		return false
+	}
+	if hint.Netsize > maxHintNetsize || hint.Netsize > local*h.tolerance || hint.Netsize < local/h.tolerance {
+		return false
+	}
+
+	var sum float64
+	for _, e := range hint.Expected {
+		sum += e
+	}
+	k := int(math.Round(sum))
+	if k < 1 || k > maxHintPeers {
+		return false
+	}
+	mean := h.expected(dht, int(math.Round(hint.Netsize)), k)
+	for x := 0; x < len(mean) || x < len(hint.Expected); x++ {
+		var want, got float64
+		if x < len(mean) {
+			want = mean[x]
+		}
+		if x < len(hint.Expected) {
+			got = hint.Expected[x]
+		}
+		if math.Abs(want-got) > hintMaxError {
+			return false
+		}
+	}
+	return true
+}
+
+type lookupHintsKey struct{}
+
+// lookupHints collects the network size estimates of the detector hints returned to a lookup.
+type lookupHints struct {
+	mu       sync.Mutex
+	netsizes []float64
+	rejected int
+}
+
+func (l *lookupHints) add(netsize float64, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if ok {
+		l.netsizes = append(l.netsizes, netsize)
+	} else {
+		l.rejected++
+	}
+}
+
+// median returns the median network size of the accepted hints, false if none was accepted.
+func (l *lookupHints) median() (float64, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.netsizes) == 0 {
+		return 0, false
+	}
+	ns := append([]float64(nil), l.netsizes...)
+	sort.Float64s(ns)
+	return ns[len(ns)/2], true
+}
+
+// withDetectorHints makes the GET_PROVIDERS requests sent with the returned context ask for detector hints, collected
+// in the returned lookupHints. It returns ctx unchanged and nil if we don't request hints.
+func (dht *IpfsDHT) withDetectorHints(ctx context.Context) (context.Context, *lookupHints) {
+	if dht.detectorHints == nil || !dht.detectorHints.request {
+		return ctx, nil
+	}
+	hints := new(lookupHints)
+	return context.WithValue(ctx, lookupHintsKey{}, hints), hints
+}
+
+// evaluateDetectorHints compares the prefix lengths the closest peers to key share with it with the distribution
+// expected from the network size of the hints, and reports key as possibly eclipsed if they deviate. It returns the
+// total variation distance between them, false if no hint was accepted.
+func (dht *IpfsDHT) evaluateDetectorHints(key multihash.Multihash, peers []peer.ID, hints *lookupHints) (float64, bool) {
+	netsize, ok := hints.median()
+	if !ok || len(peers) == 0 {
+		return 0, false
+	}
+	if hints.rejected > 0 {
+		logger.Debugw("rejected detector hints", "key", internal.LoggableProviderRecordBytes(key), "rejected", hints.rejected)
+	}
+
+	ks := dht.detector.Keyspace()
+	ids := make([][]byte, len(peers))
+	for i, p := range peers {
+		ids[i] = ks.Key([]byte(p))
+	}
+	counts := dht.detector.ComputePrefixLenCounts(ks.Key(key), ids)
+	mean := dht.detectorHints.expected(dht, int(math.Round(netsize)), len(peers))
+
+	var tvd float64
+	for x := range counts {
+		tvd += math.Abs(float64(counts[x]) - mean[x])
+	}
+	tvd /= 2 * float64(len(peers))
+
+	if tvd >= hintEvidenceThreshold {
+		logger.Warnw("closest peers deviate from the detector hints", "key", internal.LoggableProviderRecordBytes(key),
+			"distance", tvd, "netsize", netsize)
+		dht.detections.Report(AttackSignal{Key: string(key), Source: SignalDetectorHint, Score: tvd})
+	}
+	return tvd, true
+}
@@ -8,6 +8,8 @@ import (
 	"sync"
 	"time"
 
+	"github.com/libp2p/go-libp2p/core/connmgr"
+	"github.com/libp2p/go-libp2p/core/event"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
@@ -28,6 +30,7 @@ import (
 	record "github.com/libp2p/go-libp2p-record"
 	recpb "github.com/libp2p/go-libp2p-record/pb"
 
+	"github.com/benbjohnson/clock"
 	"github.com/gogo/protobuf/proto"
 	ds "github.com/ipfs/go-datastore"
 	logging "github.com/ipfs/go-log"
@@ -74,6 +77,15 @@ const (
 type addPeerRTReq struct {
 	p         peer.ID
 	queryPeer bool
+	// reason overrides the reason of the routing table event if set
+	reason string
+	// done receives the outcome of the addition if set
+	done chan<- addPeerRTRes
+}
+
+type addPeerRTRes struct {
+	added bool
+	err   error
 }
 
 const defaultEclipseDetectionK = 20
@@ -98,17 +110,24 @@ type IpfsDHT struct {
 	birth time.Time // When this peer started up
 
 	Validator record.Validator
+	// validatorTimeout bounds the time Validator may take per record, 0 if unbounded
+	validatorTimeout time.Duration
+	// validatorCalls holds a slot per validator call running if validatorTimeout is set
+	validatorCalls chan struct{}
 
 	ctx  context.Context
 	proc goprocess.Process
 
 	protoMessenger *pb.ProtocolMessenger
 	msgSender      pb.MessageSender
+	// overlay authenticates all messages if not nil, see AuthenticatedOverlay
+	overlay *overlayAuth
 
 	plk sync.Mutex
 
 	stripedPutLocks [256]sync.Mutex
 
+	protocolPrefix protocol.ID // the prefix of the DHT protocols
 	// DHT protocols we query with. We'll only add peers to our routing
 	// table if they speak these protocols.
 	protocols     []protocol.ID
@@ -125,9 +144,50 @@ type IpfsDHT struct {
 	alpha      int // The concurrency parameter per path
 	beta       int // The number of peers closest to a target that must have responded for a query path to terminate
 
-	queryPeerFilter        QueryFilterFunc
+	// bounds of the adaptive per-RPC timeout used in lookups
+	rpcTimeoutMin, rpcTimeoutMax time.Duration
+
+	// experimental provider subscriptions, providerSubs is nil if disabled
+	providerSubs        *providerSubscriptions
+	providerNotifyProto protocol.ID
+	providerWatchesLk   sync.Mutex
+	providerWatches     map[string][]*providerWatch
+
+	// lookup cross-check configuration
+	crossCheckThreshold    float64
+	crossCheckTrustedSeeds []peer.ID
+	auditor                ClosestPeersAuditor
+	netsizeSampler         NetsizeSampler
+	auditThreshold         float64
+	// netsizeGathering runs the NetsizeSampler, see GatherNetsizeDataContext
+	netsizeGathering *netsizeGathering
+
+	queryPeerFilter QueryFilterFunc
+	candidateFilter CandidateFilterFunc
+	// providerAddrPolicy selects the addresses published in our provider records by reachability, the
+	// network.Reachability last reported by the host
+	providerAddrPolicy     ProviderAddrPolicy
+	reachability           int32
+	providerAcceptPolicy   ProviderAcceptFunc
 	routingTablePeerFilter RouteTableFilterFunc
 	rtPeerDiversityFilter  peerdiversity.PeerIPGroupFilter
+	rtAdmissionPolicy      AdmissionPolicy
+	// behavior tracks suspicious responses of peers, nil if behavior based eviction is disabled
+	behavior *behaviorTracker
+
+	// rtEvents publishes the changes of the routing table
+	rtEvents *rtEvents
+	// readiness tracks whether the DHT is bootstrapping, ready or degraded
+	readiness *readiness
+	// provideDeferral holds the provides made before the DHT is ready, nil if they aren't deferred
+	provideDeferral *provideDeferral
+
+	// allowlist restricts the peers we interact with if not nil
+	allowlist map[peer.ID]struct{}
+
+	// addrGater and addrFilter vet addresses learned from other peers
+	addrGater  connmgr.ConnectionGater
+	addrFilter func(peer.ID, ma.Multiaddr) bool
 
 	autoRefresh bool
 
@@ -136,12 +196,28 @@ type IpfsDHT struct {
 	// connecting to the network).
 	bootstrapPeers func() []peer.AddrInfo
 
-	maxRecordAge time.Duration
+	maxRecordAge       time.Duration
+	maxRecordClockSkew time.Duration
+
+	// provideTargetsRetention is how long the peers a provider record was sent to are remembered, 0 if disabled
+	provideTargetsRetention time.Duration
+	// providerAuditRetention is how long the submitters of the provider records we store are remembered, 0 if
+	// disabled
+	providerAuditRetention time.Duration
+	// minProvideTargetGroups is the number of IP groups the targets of a regular provide must span, 0 if not checked
+	minProvideTargetGroups int
+	// valueCorroboration is the number of IP groups the peers returning a value must span before value lookups emit
+	// it, 0 if not required
+	valueCorroboration int
+	// closerPeersPerGroup is the number of closer peers per IP group sent back with providers, 0 if unlimited
+	closerPeersPerGroup int
 
 	// Allows disabling dht subsystems. These should _only_ be set on
 	// "forked" DHTs (e.g., DHTs with custom protocols and/or private
 	// networks).
 	enableProviders, enableValues bool
+	// valuePolicy and providerPolicy restrict the keys the subsystems are enabled for if not nil
+	valuePolicy, providerPolicy KeyPolicy
 
 	disableFixLowPeers bool
 	fixLowPeersChan    chan struct{}
@@ -152,15 +228,139 @@ type IpfsDHT struct {
 	rtFreezeTimeout time.Duration
 
 	// network size estimator
-	nsEstimator *netsize.Estimator
+	nsEstimator netsize.NetworkSizeEstimator
 
 	// configuration variables for tests
 	testAddressUpdateProcessing bool
 
+	// providerAuths are the authorizations to provide on behalf of other peers, by provider, see ProvideFor
+	providerAuthsLk sync.Mutex
+	providerAuths   map[peer.ID]providerAuth
+
+	// powerState is the device state reported with PowerStateChanged, nil unless in low power mode
+	powerState *powerState
+
+	// keyspaceHeatmap counts the keys stored with us by their distance to our ID
+	keyspaceHeatmap keyspaceHeatmap
+
+	// valueMirror rate limits the values mirrored to every peer, nil if value mirroring is disabled
+	valueMirror *mirrorLimiter
+	// mirrors queues the values put for the workers mirroring them if value mirroring is enabled
+	mirrors chan pendingMirror
+
+	// tenantQuotas limits the operations of tenants, nil if tenant quotas are disabled
+	tenantQuotas *tenantQuotas
+
+	// loadShedder rejects low priority requests under pressure, nil if load shedding is disabled
+	loadShedder *loadShedder
+	// providerAddrBook applies the TTL policy of claimed provider addresses, nil if the TempAddrTTL is used for all
+	providerAddrBook *providerAddrBook
+
+	// requestScheduler handles the inbound requests for the keys closest to us first, nil if requests aren't
+	// prioritized
+	requestScheduler *requestScheduler
+
+	// clock timestamps records and schedules refreshes, queued provides and backoffs
+	clock clock.Clock
+
+	// closerPeerValidation discards closer peers sharing more than closerPeerSlack bits less with the lookup target
+	// than expected
+	closerPeerValidation bool
+	closerPeerSlack      int
+
+	// anomalies counts the anomalies detected in responses to our lookups
+	anomalies responseAnomalies
+
+	// vantages verifies provided records from independent vantage points, nil if disabled
+	vantages *vantageVerifier
+
+	// queriedPeersOnly only adds the bootstrap peers and the peers that answered our queries to the routing table
+	queriedPeersOnly bool
+
+	// providerResolver resolves the addresses of the providers found without addresses, nil if disabled
+	providerResolver *providerResolver
+
+	// blackhole tracks the lookups failing repeatedly, nil if blackhole detection is disabled
+	blackhole *blackholeDetector
+
+	// churnReprovider sends the provider records of the provided keys to the peers joining their closest peers, nil
+	// if disabled
+	churnReprovider *churnReprovider
+
+	// closestWatch snapshots the closest peers of the watched keys, nil if disabled
+	closestWatch *closestPeersWatch
+
+	// detectorHints serves and verifies detector hints, nil if the extension is disabled
+	detectorHints *detectorHints
+
+	// provideDrain tracks the provides in flight, see Shutdown
+	provideDrain provideDrain
+
+	// lookupDedup coalesces concurrent lookups of the same key, nil if disabled
+	lookupDedup *lookupDedup
+
+	// queries are the in-flight queries, see ActiveQueries
+	queries queryRegistry
+
+	// salts are the salts the keys provided with ProvideSalted are currently provided under
+	salts saltRegistry
+
+	// queryBudget bounds the resources of every lookup, see QueryBudget
+	queryBudget queryBudget
+
+	// dialBackoff tracks the peers that recently failed to dial, nil if disabled
+	dialBackoff *dialBackoff
+
+	// response limits, 0 if unlimited, see ResponsePeerLimits and MaxResponseSize
+	maxCloserPeers  int
+	maxProviders    int
+	maxAddrsPerPeer int
+	maxResponseSize int
+
+	// slowRequestThreshold is the handling time above which received requests are logged, 0 if disabled
+	slowRequestThreshold time.Duration
+
 	// Used for eclipse attack detection
-	detector             *detection.EclipseDetector
-	providerLk           sync.Mutex // TODO(Srivatsan): This is just to prevent concurrent provides from annoying me for now. Will be removed later
-	specialProvideNumber int
+	detector          *detection.EclipseDetector
+	detectionKeyspace detection.Keyspace
+	// detectionTest is the test the verdict of the detector is based on, at detectionSignificance for the tests with
+	// p-values
+	detectionTest         detection.Test
+	detectionSignificance float64
+	detections            *DetectionAggregator
+	// bayes accumulates the verdicts on keys into posteriors with the likelihoods of bayesParams, nil if disabled
+	bayes       *detection.BayesianDetector
+	bayesParams dhtcfg.BayesianDetectionParams
+	// detectionEmitter emits the outcomes of the eclipse detection of provides, asynchronously after the provide
+	// returned if asyncProvideDetection is set
+	detectionEmitter      event.Emitter
+	asyncProvideDetection bool
+	// asyncDetections queues the detections for the workers running them if asyncProvideDetection is set
+	asyncDetections chan asyncDetection
+	// strictProvideDetection fails provides whose eclipse detection could not run
+	strictProvideDetection bool
+	// providerLk serializes Provide and ProvideWithReturn, see lockProvides: at most one of them runs its lookups,
+	// eclipse detection and puts at a time, while callers waiting for it give up once their context is canceled.
+	// ProvideWithoutEclipseDetection, ProvideFor and the provides of the provide queue don't take it.
+	// TODO(Srivatsan): This is just to prevent concurrent provides from annoying me for now. Will be removed later
+	providerLk           chan struct{}
+	specialProvideNumber int32
+	// detectionThreshold overrides the threshold the detector derives from the network size if positive, it holds the
+	// bits of a float64
+	detectionThreshold uint64
+
+	// bounds of the keyspace region enumeration of special provides and lookups, zero if unbounded
+	cplMaxLookups int
+	cplMaxPeers   int
+	cplTimeout    time.Duration
+
+	// provideQueue provides the keys queued with EnqueueProvide in the background, nil if disabled
+	provideQueue *provideQueue
+
+	// regionCache shares keyspace region enumerations between special provides, nil if disabled
+	regionCache *regionCache
+	// closestCache caches the closest peers found by lookups, nil if disabled
+	closestCache *closestPeersCache
 }
 
 // Assert that IPFS assumptions about interfaces aren't broken. These aren't a
@@ -171,6 +371,10 @@ var (
 	_ routing.PeerRouting    = (*IpfsDHT)(nil)
 	_ routing.PubKeyFetcher  = (*IpfsDHT)(nil)
 	_ routing.ValueStore     = (*IpfsDHT)(nil)
+
+	_ ContentRouter  = (*IpfsDHT)(nil)
+	_ AttackDetector = (*IpfsDHT)(nil)
+	_ RegionRouter   = (*IpfsDHT)(nil)
 )
 
 // New creates a new DHT with the specified host and options.
@@ -198,18 +402,145 @@ func New(ctx context.Context, h host.Host, options ...Option) (*IpfsDHT, error)
 	dht.autoRefresh = cfg.RoutingTable.AutoRefresh
 
 	dht.maxRecordAge = cfg.MaxRecordAge
+	dht.maxRecordClockSkew = cfg.MaxRecordClockSkew
+	dht.provideTargetsRetention = cfg.ProvideTargetsRetention
+	dht.providerAuditRetention = cfg.ProviderAuditRetention
+	dht.minProvideTargetGroups = cfg.MinProvideTargetGroups
+	dht.valueCorroboration = cfg.ValueCorroboration
+	dht.closerPeersPerGroup = cfg.CloserPeersPerGroup
+	dht.cplMaxLookups = cfg.CPLLookupBudget.MaxLookups
+	dht.cplMaxPeers = cfg.CPLLookupBudget.MaxPeers
+	dht.cplTimeout = cfg.CPLLookupBudget.Timeout
+	if cfg.LowPower {
+		dht.powerState = new(powerState)
+	}
+	if cfg.TenantQuotas.Enabled {
+		dht.tenantQuotas = newTenantQuotas(cfg.TenantQuotas.Quotas, cfg.TenantQuotas.Default)
+	}
+	if cfg.LoadShedding.Enabled {
+		dht.loadShedder = &loadShedder{thresholds: cfg.LoadShedding.Thresholds}
+	}
+	if cfg.BayesianDetection.Enabled {
+		p := cfg.BayesianDetection.Params
+		if dht.bayes, err = detection.NewBayesianDetector(p.Prior, p.Threshold, p.HalfLife); err != nil {
+			return nil, err
+		}
+		dht.bayesParams = p
+	}
+	if cfg.DeferProvides {
+		dht.provideDeferral = newProvideDeferral()
+	}
+	if cfg.ProviderAddrTTL.Unverified > 0 {
+		dht.providerAddrBook = newProviderAddrBook(cfg.ProviderAddrTTL.Unverified, cfg.ProviderAddrTTL.Verified)
+	}
+	if n := cfg.RequestPrioritization.Concurrency; n > 0 {
+		dht.requestScheduler = newRequestScheduler(n)
+	}
+	if len(cfg.Vantages.Vantages) > 0 {
+		dht.vantages = newVantageVerifier(cfg.Vantages.Vantages, cfg.Vantages.Delay)
+	}
+	if cfg.DetectorHints.Serve || cfg.DetectorHints.Request {
+		dht.detectorHints = newDetectorHints(cfg.DetectorHints.Serve, cfg.DetectorHints.Request, cfg.DetectorHints.Tolerance)
+	}
+	if cfg.ValueMirroring.Enabled {
+		dht.valueMirror = newMirrorLimiter(cfg.ValueMirroring.PeerRate, cfg.ValueMirroring.PeerBurst)
+		dht.mirrors = make(chan pendingMirror, mirrorBacklog)
+	}
+	dht.queryBudget = queryBudget{
+		maxRPCs:  cfg.QueryBudget.MaxRPCs,
+		maxDials: cfg.QueryBudget.MaxDials,
+		maxPeers: cfg.QueryBudget.MaxPeers,
+	}
+	if cfg.DialBackoff.Base > 0 {
+		dht.dialBackoff = newDialBackoff(cfg.DialBackoff.Base, cfg.DialBackoff.Max, dht.clock)
+	}
+	if cfg.RegionCacheTTL > 0 {
+		dht.regionCache = newRegionCache(cfg.RegionCacheTTL)
+	}
+	if cfg.ClosestPeersCacheTTL > 0 {
+		dht.closestCache = newClosestPeersCache(cfg.ClosestPeersCacheTTL)
+	}
 	dht.enableProviders = cfg.EnableProviders
 	dht.enableValues = cfg.EnableValues
+	dht.valuePolicy = cfg.ValuePolicy
+	dht.providerPolicy = cfg.ProviderPolicy
 	dht.disableFixLowPeers = cfg.DisableFixLowPeers
+	dht.queriedPeersOnly = cfg.QueriedPeersOnly
+
+	if cfg.ProvideQueue.Enabled {
+		dht.provideQueue = newProvideQueue(dht, cfg.ProvideQueue.Workers, cfg.ProvideQueue.Rate,
+			cfg.ProvideQueue.MaxAttempts, cfg.ProvideQueue.RetryBackoff, cfg.ProvideQueue.PartitionBits)
+		dht.provideQueue.queueProvides = cfg.ProvideQueue.QueueProvides
+	} else if cfg.ProvideQueue.QueueProvides {
+		return nil, fmt.Errorf("queueing provides requires the provide queue to be enabled")
+	}
+
+	if cfg.ProviderSubscriptions.Enabled {
+		dht.providerSubs = newProviderSubscriptions(cfg.ProviderSubscriptions.MaxTotal, cfg.ProviderSubscriptions.MaxPerPeer)
+		dht.providerNotifyProto = cfg.ProtocolPrefix + kadProviderNotify
+		dht.providerWatches = make(map[string][]*providerWatch)
+		dht.host.SetStreamHandler(dht.providerNotifyProto, dht.handleProviderNotify)
+		dht.proc.AddChild(goprocess.WithTeardown(func() error {
+			dht.host.RemoveStreamHandler(dht.providerNotifyProto)
+			return nil
+		}))
+	}
+
+	if cfg.RoutingTable.BehaviorEviction.Enabled {
+		emitter, err := h.EventBus().Emitter(new(EvtRoutingTablePeerEvicted))
+		if err != nil {
+			return nil, err
+		}
+		dht.behavior = &behaviorTracker{
+			denylist:         make(map[peer.ID]struct{}, len(cfg.Denylist)),
+			minEvidence:      cfg.RoutingTable.BehaviorEviction.MinEvidence,
+			evictThreshold:   cfg.RoutingTable.BehaviorEviction.EvictThreshold,
+			recoverThreshold: cfg.RoutingTable.BehaviorEviction.RecoverThreshold,
+			emitter:          emitter,
+			peers:            make(map[peer.ID]*peerBehavior),
+		}
+		for _, p := range cfg.Denylist {
+			dht.behavior.denylist[p] = struct{}{}
+		}
+		dht.proc.AddChild(goprocess.WithTeardown(emitter.Close))
+	}
 
 	dht.Validator = cfg.Validator
+	dht.validatorTimeout = cfg.ValidatorTimeout
+	if cfg.ValidatorTimeout > 0 {
+		dht.validatorCalls = make(chan struct{}, maxValidatorCalls)
+	}
+	if cfg.ProviderResolve.Enabled {
+		dht.providerResolver = &providerResolver{
+			concurrency: cfg.ProviderResolve.Concurrency,
+			timeout:     cfg.ProviderResolve.Timeout,
+		}
+	}
 	dht.msgSender = net.NewMessageSenderImpl(h, dht.protocols)
-	dht.protoMessenger, err = pb.NewProtocolMessenger(dht.msgSender)
+	if cfg.Overlay.Authority != nil {
+		if dht.overlay, err = newOverlayAuth(h.ID(), h.Peerstore(), cfg.Overlay.Authority, cfg.Overlay.Credential); err != nil {
+			return nil, err
+		}
+		dht.msgSender = &overlayMessageSender{MessageSender: dht.msgSender, auth: dht.overlay}
+	}
+	pmOpts := []pb.ProtocolMessengerOption{
+		pb.WithMaxCloserPeers(cfg.ResponseLimits.MaxCloserPeers),
+		pb.WithMaxProviderRecordAddrs(cfg.ProviderRecords.MaxAddrs),
+	}
+	if cfg.ProviderRecords.Compress {
+		pmOpts = append(pmOpts, pb.WithCompressedProviderRecords())
+	}
+	dht.protoMessenger, err = pb.NewProtocolMessenger(dht.msgSender, pmOpts...)
 	if err != nil {
 		return nil, err
 	}
 
 	dht.testAddressUpdateProcessing = cfg.TestAddressUpdateProcessing
+	dht.slowRequestThreshold = cfg.SlowRequestThreshold
+	dht.maxCloserPeers = cfg.ResponseLimits.MaxCloserPeers
+	dht.maxProviders = cfg.ResponseLimits.MaxProviders
+	dht.maxAddrsPerPeer = cfg.ResponseLimits.MaxAddrsPerPeer
+	dht.maxResponseSize = cfg.ResponseLimits.MaxSize
 
 	dht.auto = cfg.Mode
 	switch cfg.Mode {
@@ -243,6 +574,51 @@ func New(ctx context.Context, h host.Host, options ...Option) (*IpfsDHT, error)
 	go dht.persistRTPeersInPeerStore()
 
 	dht.proc.Go(dht.rtPeerLoop)
+	dht.proc.Go(dht.rtEvents.run)
+	dht.proc.Go(dht.watchReadiness)
+	if dht.provideDeferral != nil {
+		dht.proc.Go(dht.flushDeferredProvides)
+	}
+	dht.proc.AddChild(goprocess.WithTeardown(dht.detectionEmitter.Close))
+	if dht.asyncProvideDetection {
+		for i := 0; i < asyncDetectionWorkers; i++ {
+			dht.proc.Go(dht.runAsyncDetections)
+		}
+	}
+	if dht.valueMirror != nil {
+		for i := 0; i < mirrorWorkers; i++ {
+			dht.proc.Go(dht.runMirrors)
+		}
+	}
+	if dht.blackhole != nil {
+		dht.proc.AddChild(goprocess.WithTeardown(dht.blackhole.emitter.Close))
+	}
+	if dht.churnReprovider != nil {
+		dht.proc.Go(dht.reprovideOnChurn)
+	}
+	if dht.closestWatch != nil {
+		dht.proc.AddChild(goprocess.WithTeardown(dht.closestWatch.emitter.Close))
+		dht.proc.Go(dht.watchClosestPeers)
+	}
+
+	if dht.provideTargetsRetention > 0 {
+		dht.proc.Go(dht.provideTargetsGC)
+	}
+	if dht.providerAuditRetention > 0 {
+		dht.proc.Go(dht.providerAuditGC)
+	}
+	if dht.provideQueue != nil {
+		dht.proc.Go(dht.provideQueue.run)
+	}
+	if dht.netsizeGathering.scheduled() {
+		dht.proc.Go(dht.gatherNetsizePeriodically)
+	}
+	if dht.loadShedder != nil {
+		dht.proc.Go(dht.sampleLoad)
+	}
+	if dht.providerAddrBook != nil {
+		dht.proc.Go(dht.providerAddrsGC)
+	}
 
 	// Fill routing table with currently connected peers that are DHT servers
 	dht.plk.Lock()
@@ -296,16 +672,39 @@ func makeDHT(ctx context.Context, h host.Host, cfg dhtcfg.Config) (*IpfsDHT, err
 		selfKey:                kb.ConvertPeerID(h.ID()),
 		peerstore:              h.Peerstore(),
 		host:                   h,
-		birth:                  time.Now(),
+		birth:                  cfg.Clock.Now(),
+		clock:                  cfg.Clock,
+		closerPeerValidation:   cfg.CloserPeerValidation.Enabled,
+		closerPeerSlack:        cfg.CloserPeerValidation.Slack,
+		protocolPrefix:         cfg.ProtocolPrefix,
 		protocols:              protocols,
 		protocolsStrs:          protocol.ConvertToStrings(protocols),
 		serverProtocols:        serverProtocols,
 		bucketSize:             cfg.BucketSize,
 		alpha:                  cfg.Concurrency,
 		beta:                   cfg.Resiliency,
+		rpcTimeoutMin:          cfg.RPCTimeout.Min,
+		rpcTimeoutMax:          cfg.RPCTimeout.Max,
+		crossCheckThreshold:    cfg.CrossCheck.Threshold,
+		crossCheckTrustedSeeds: cfg.CrossCheck.Seeds,
+		auditor:                cfg.Audit.Auditor,
+		netsizeSampler:         cfg.Netsize.Sampler,
+		auditThreshold:         cfg.Audit.Threshold,
+		detectionKeyspace:      cfg.DetectionKeyspace,
+		detectionTest:          cfg.DetectionTest.Test,
+		detectionSignificance:  cfg.DetectionTest.Significance,
+		asyncProvideDetection:  cfg.AsyncProvideDetection,
+		strictProvideDetection: cfg.StrictProvideDetection,
+		providerLk:             make(chan struct{}, 1),
 		queryPeerFilter:        cfg.QueryPeerFilter,
+		candidateFilter:        cfg.CandidateFilter,
+		providerAddrPolicy:     cfg.ProviderAddrPolicy,
+		providerAcceptPolicy:   cfg.ProviderAcceptPolicy,
+		addrGater:              cfg.AddrGater,
+		addrFilter:             cfg.AddrFilter,
 		routingTablePeerFilter: cfg.RoutingTable.PeerFilter,
 		rtPeerDiversityFilter:  cfg.RoutingTable.DiversityFilter,
+		rtAdmissionPolicy:      cfg.RoutingTable.AdmissionPolicy,
 
 		fixLowPeersChan: make(chan struct{}, 1),
 
@@ -313,6 +712,19 @@ func makeDHT(ctx context.Context, h host.Host, cfg dhtcfg.Config) (*IpfsDHT, err
 		refreshFinishedCh: make(chan struct{}),
 	}
 
+	if dht.asyncProvideDetection {
+		dht.asyncDetections = make(chan asyncDetection, asyncDetectionBacklog)
+	}
+	if dht.auditor == nil {
+		dht.auditor = NullAuditor{}
+	}
+	if dht.netsizeSampler == nil {
+		dht.netsizeSampler = DefaultNetsizeSampler
+	}
+	if dht.providerAcceptPolicy == nil {
+		dht.providerAcceptPolicy = OriginatorProviderPolicy
+	}
+
 	var maxLastSuccessfulOutboundThreshold time.Duration
 
 	// The threshold is calculated based on the expected amount of time that should pass before we
@@ -327,6 +739,38 @@ func makeDHT(ctx context.Context, h host.Host, cfg dhtcfg.Config) (*IpfsDHT, err
 		maxLastSuccessfulOutboundThreshold = cfg.RoutingTable.RefreshInterval
 	}
 
+	if cfg.PeerAllowlist != nil {
+		dht.allowlist = make(map[peer.ID]struct{}, len(cfg.PeerAllowlist))
+		for _, p := range cfg.PeerAllowlist {
+			dht.allowlist[p] = struct{}{}
+		}
+	}
+
+	rtEvents, err := newRTEvents()
+	if err != nil {
+		return nil, err
+	}
+	dht.rtEvents = rtEvents
+	if dht.detectionEmitter, err = rtEvents.bus.Emitter(new(EvtEclipseDetection)); err != nil {
+		return nil, err
+	}
+	if dht.readiness, err = newReadiness(rtEvents.bus, cfg.Readiness.MinPeers, cfg.Readiness.RequireNetsize); err != nil {
+		return nil, err
+	}
+	if cfg.BlackholeThreshold > 0 {
+		if dht.blackhole, err = newBlackholeDetector(rtEvents.bus, cfg.BlackholeThreshold); err != nil {
+			return nil, err
+		}
+	}
+	if c := cfg.ChurnReprovide; c.Enabled {
+		dht.churnReprovider = newChurnReprovider(c.Interval, c.Rate)
+	}
+	if w := cfg.ClosestPeersWatch; w.Enabled {
+		if dht.closestWatch, err = newClosestPeersWatch(rtEvents.bus, w.Interval, w.History, w.ChurnThreshold); err != nil {
+			return nil, err
+		}
+	}
+
 	// construct routing table
 	// use twice the theoritical usefulness threhold to keep older peers around longer
 	rt, err := makeRoutingTable(dht, cfg, 2*maxLastSuccessfulOutboundThreshold)
@@ -352,11 +796,15 @@ func makeDHT(ctx context.Context, h host.Host, cfg dhtcfg.Config) (*IpfsDHT, err
 	ctxTags := dht.newContextWithLocalTags(ctx)
 	// the DHT context should be done when the process is closed
 	dht.ctx = goprocessctx.WithProcessClosing(ctxTags, dht.proc)
+	if cfg.DeduplicateLookups {
+		dht.lookupDedup = newLookupDedup(dht.ctx)
+	}
+	dht.netsizeGathering = newNetsizeGathering(dht.ctx, cfg.Netsize.Schedule.Interval, cfg.Netsize.Schedule.Jitter)
 
 	if cfg.ProviderStore != nil {
 		dht.providerStore = cfg.ProviderStore
 	} else {
-		dht.providerStore, err = providers.NewProviderManager(dht.ctx, h.ID(), dht.peerstore, cfg.Datastore)
+		dht.providerStore, err = providers.NewProviderManager(dht.ctx, h.ID(), dht.peerstore, cfg.Datastore, providers.Clock(cfg.Clock))
 		if err != nil {
 			return nil, fmt.Errorf("initializing default provider manager (%v)", err)
 		}
@@ -365,9 +813,22 @@ func makeDHT(ctx context.Context, h host.Host, cfg dhtcfg.Config) (*IpfsDHT, err
 	dht.rtFreezeTimeout = rtFreezeTimeout
 
 	// init network size estimator
-	dht.nsEstimator = netsize.NewEstimator(h.ID(), rt, cfg.BucketSize)
+	switch {
+	case cfg.Netsize.Estimator != nil:
+		dht.nsEstimator = cfg.Netsize.Estimator
+	case cfg.Netsize.Crawl:
+		dht.nsEstimator, err = netsize.NewCrawlCounter(h, dht.protocols, rt.ListPeers,
+			func() bool { return dht.getMode() == modeServer }, cfg.Netsize.CrawlMaxAge, cfg.Netsize.CrawlTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("initializing netsize crawler (%v)", err)
+		}
+	default:
+		dht.nsEstimator = netsize.NewEstimator(h.ID(), rt, cfg.BucketSize)
+	}
 
-	dht.addDetector() // TODO: Later, this may be made optional
+	if err := dht.addDetector(); err != nil { // TODO: Later, this may be made optional
+		return nil, err
+	}
 
 	dht.specialProvideNumber = 20
 
@@ -381,7 +842,15 @@ func makeRtRefreshManager(dht *IpfsDHT, cfg dhtcfg.Config, maxLastSuccessfulOutb
 	}
 
 	queryFnc := func(ctx context.Context, key string) error {
-		_, err := dht.GetClosestPeers(ctx, key)
+		_, err := dht.getClosestPeers(ctx, key, nil)
+		// like the refresh manager, a refresh query running into its timeout isn't a failure
+		failed := err != nil && !(err == context.DeadlineExceeded && ctx.Err() == context.DeadlineExceeded)
+		if key != string(dht.self) {
+			dht.bucketRefreshedEvent(kb.CommonPrefixLen(dht.selfKey, kb.ConvertKey(key)), failed)
+		} else {
+			// every refresh starts with a lookup of ourselves, and fails if it does
+			dht.refreshFinished(!failed)
+		}
 		return err
 	}
 
@@ -392,7 +861,9 @@ func makeRtRefreshManager(dht *IpfsDHT, cfg dhtcfg.Config, maxLastSuccessfulOutb
 		cfg.RoutingTable.RefreshQueryTimeout,
 		cfg.RoutingTable.RefreshInterval,
 		maxLastSuccessfulOutboundThreshold,
-		dht.refreshFinishedCh)
+		dht.refreshFinishedCh,
+		func(p peer.ID) { dht.removeFromRT(p, RTReasonUnresponsive) },
+		cfg.Clock)
 
 	return r, err
 }
@@ -426,10 +897,12 @@ func makeRoutingTable(dht *IpfsDHT, cfg dhtcfg.Config, maxLastSuccessfulOutbound
 		} else {
 			cmgr.TagPeer(p, kbucketTag, baseConnMgrScore)
 		}
+		dht.peerAddedEvent(p)
 	}
 	rt.PeerRemoved = func(p peer.ID) {
 		cmgr.Unprotect(p, kbucketTag)
 		cmgr.UntagPeer(p, kbucketTag)
+		dht.peerRemovedEvent(p)
 
 		// try to fix the RT
 		dht.fixRTIfNeeded()
@@ -471,7 +944,7 @@ func (dht *IpfsDHT) populatePeers(_ goprocess.Process) {
 
 // fixLowPeersRouting manages simultaneous requests to fixLowPeers
 func (dht *IpfsDHT) fixLowPeersRoutine(proc goprocess.Process) {
-	ticker := time.NewTicker(periodicBootstrapInterval)
+	ticker := dht.clock.Ticker(periodicBootstrapInterval)
 	defer ticker.Stop()
 
 	for {
@@ -613,7 +1086,20 @@ func (dht *IpfsDHT) rtPeerLoop(proc goprocess.Process) {
 				bootstrapCount = 0
 				timerCh = nil
 			}
+			reason := RTReasonConnected
+			if addReq.queryPeer {
+				reason = RTReasonQueried
+			}
+			if addReq.reason != "" {
+				reason = addReq.reason
+			}
+			dht.rtEvents.mu.Lock()
+			dht.rtEvents.addReason = reason
+			dht.rtEvents.mu.Unlock()
 			newlyAdded, err := dht.routingTable.TryAddPeer(addReq.p, addReq.queryPeer, isBootsrapping)
+			if addReq.done != nil {
+				addReq.done <- addPeerRTRes{newlyAdded, err}
+			}
 			if err != nil {
 				// peer not added.
 				continue
@@ -621,7 +1107,7 @@ func (dht *IpfsDHT) rtPeerLoop(proc goprocess.Process) {
 			if !newlyAdded && addReq.queryPeer {
 				// the peer is already in our RT, but we just successfully queried it and so let's give it a
 				// bump on the query time so we don't ping it too soon for a liveliness check.
-				dht.routingTable.UpdateLastSuccessfulOutboundQueryAt(addReq.p, time.Now())
+				dht.routingTable.UpdateLastSuccessfulOutboundQueryAt(addReq.p, dht.clock.Now())
 			}
 		case <-dht.refreshFinishedCh:
 			bootstrapCount = bootstrapCount + 1
@@ -665,24 +1151,56 @@ func (dht *IpfsDHT) peerFound(ctx context.Context, p peer.ID, queryPeer bool) {
 	if c := baseLogger.Check(zap.DebugLevel, "peer found"); c != nil {
 		c.Write(zap.String("peer", p.String()))
 	}
+	if dht.queriedPeersOnly && !queryPeer && !dht.isBootstrapPeer(p) {
+		return
+	}
 	b, err := dht.validRTPeer(p)
 	if err != nil {
 		logger.Errorw("failed to validate if peer is a DHT peer", "peer", p, "error", err)
-	} else if b {
+	} else if b && dht.admitRTPeer(p) {
 		select {
-		case dht.addPeerToRTChan <- addPeerRTReq{p, queryPeer}:
+		case dht.addPeerToRTChan <- addPeerRTReq{p: p, queryPeer: queryPeer}:
 		case <-dht.ctx.Done():
 			return
 		}
 	}
 }
 
+// isBootstrapPeer returns true if p is one of the configured bootstrap peers.
+func (dht *IpfsDHT) isBootstrapPeer(p peer.ID) bool {
+	if dht.bootstrapPeers == nil {
+		return false
+	}
+	for _, ai := range dht.bootstrapPeers() {
+		if ai.ID == p {
+			return true
+		}
+	}
+	return false
+}
+
+// admitRTPeer keeps peers flagged for suspicious behavior out of the routing table and consults the admission policy
+// for peers that are not in the routing table yet.
+func (dht *IpfsDHT) admitRTPeer(p peer.ID) bool {
+	if dht.behavior.flagged(p) {
+		return false
+	}
+	if dht.rtAdmissionPolicy == nil || dht.routingTable.Find(p) != "" {
+		return true
+	}
+	if !dht.rtAdmissionPolicy.Admit(dht, p) {
+		logger.Debugw("peer not admitted to the routing table", "peer", p)
+		return false
+	}
+	return true
+}
+
 // peerStoppedDHT signals the routing table that a peer is unable to responsd to DHT queries anymore.
 func (dht *IpfsDHT) peerStoppedDHT(ctx context.Context, p peer.ID) {
 	logger.Debugw("peer stopped dht", "peer", p)
 	// A peer that does not support the DHT protocol is dead for us.
 	// There's no point in talking to anymore till it starts supporting the DHT protocol again.
-	dht.routingTable.RemovePeer(p)
+	dht.removeFromRT(p, RTReasonStoppedDHT)
 }
 
 func (dht *IpfsDHT) fixRTIfNeeded() {
@@ -866,35 +1384,50 @@ func (dht *IpfsDHT) maybeAddAddrs(p peer.ID, addrs []ma.Multiaddr, ttl time.Dura
 	if p == dht.self || dht.host.Network().Connectedness(p) == network.Connected {
 		return
 	}
+	addrs = dht.filterAddrs(p, addrs)
+	if len(addrs) == 0 {
+		return
+	}
 	dht.peerstore.AddAddrs(p, addrs, ttl)
 }
 
-func (dht *IpfsDHT) addDetector() {
-	dht.detector = detection.New(defaultEclipseDetectionK)
-}
+// filterAddrs drops the addresses of p that the address gater or filter refuse.
+func (dht *IpfsDHT) filterAddrs(p peer.ID, addrs []ma.Multiaddr) []ma.Multiaddr {
+	if dht.addrGater == nil && dht.addrFilter == nil {
+		return addrs
+	}
+	if dht.addrGater != nil && !dht.addrGater.InterceptPeerDial(p) {
+		return nil
+	}
 
-func (dht *IpfsDHT) GatherNetsizeData() {
-	fmt.Println("Doing a few queries to initialize the netsize estimator. This may take some time...")
-	const numSamples = 10
-	ctx := dht.Context()
-	for cpl := 0; cpl < numSamples; cpl++ {
-		randId, err := dht.routingTable.GenRandPeerID(uint(cpl))
-		if err != nil {
-			// fmt.Printf("Error in generating random peer id for CPL = %v\n", cpl)
-			fmt.Println(err)
+	filtered := make([]ma.Multiaddr, 0, len(addrs))
+	for _, a := range addrs {
+		if dht.addrGater != nil && !dht.addrGater.InterceptAddrDial(p, a) {
+			continue
 		}
-		closestPeers, err := dht.GetClosestPeers(ctx, string(randId))
-		_ = closestPeers
-		if err != nil {
-			// fmt.Printf("Error in getting closest peers for random id %s\n", randId)
-			fmt.Println(err)
+		if dht.addrFilter != nil && !dht.addrFilter(p, a) {
+			continue
 		}
+		filtered = append(filtered, a)
 	}
-	// fmt.Println("Completed initialization of netsize estimator.")
-	// netsize, err := dht.nsEstimator.NetworkSize()
-	// if err == nil {
-	// 	fmt.Println("Estimated network size:", netsize)
-	// } else {
-	// 	fmt.Println("But, error:", err)
-	// }
+	return filtered
+}
+
+func (dht *IpfsDHT) addDetector() error {
+	if dht.detectionKeyspace == nil {
+		dht.detectionKeyspace = detection.SHA256Keyspace
+	}
+	dht.detector = detection.NewWithKeyspace(defaultEclipseDetectionK, dht.detectionKeyspace)
+	if dht.detectionSignificance > 0 {
+		if err := dht.detector.UpdateSignificance(dht.detectionSignificance); err != nil {
+			return err
+		}
+	}
+	dht.detections = newDetectionAggregator(defaultSignalWindow)
+	return nil
+}
+
+// DetectionAggregator returns the aggregator collecting the attack signals raised by this DHT.
+func (dht *IpfsDHT) DetectionAggregator() *DetectionAggregator {
+	return dht.detections
 }
@@ -5,6 +5,8 @@ import (
 	"testing"
 	"time"
 
+	"github.com/ipfs/go-cid"
+	u "github.com/ipfs/go-ipfs-util"
 	kb "github.com/libp2p/go-libp2p-kbucket"
 	"github.com/libp2p/go-libp2p/core/event"
 	"github.com/libp2p/go-libp2p/core/peer"
@@ -199,3 +201,77 @@ func TestBootstrappersReplacable(t *testing.T) {
 	require.Contains(t, d.routingTable.ListPeers(), d3.self)
 	require.Contains(t, d.routingTable.ListPeers(), d4.self)
 }
+
+func TestReadiness(t *testing.T) {
+	ctx := context.Background()
+	d := setupDHT(ctx, t, false, DisableAutoRefresh(), ReadinessCriteria(2, false))
+	d2 := setupDHT(ctx, t, false)
+	d3 := setupDHT(ctx, t, false)
+
+	require.Equal(t, StateBootstrapping, d.State())
+	sub, err := d.StateEvents()
+	require.NoError(t, err)
+	defer sub.Close()
+
+	connect(t, ctx, d, d2)
+	connect(t, ctx, d, d3)
+	// a routing table of enough peers isn't enough without a successful refresh
+	require.Equal(t, StateBootstrapping, d.State())
+	select {
+	case <-d.Ready():
+		t.Fatal("ready before refreshing the routing table")
+	default:
+	}
+
+	require.NoError(t, <-d.RefreshRoutingTable())
+	select {
+	case <-d.Ready():
+	case <-time.After(5 * time.Second):
+		t.Fatal("not ready after refreshing the routing table")
+	}
+	require.Equal(t, StateReady, d.State())
+
+	d.routingTable.RemovePeer(d3.self)
+	require.Equal(t, StateDegraded, d.State())
+	// Ready stays closed once the DHT was ready
+	<-d.Ready()
+
+	for _, want := range []EvtStateChanged{{From: StateBootstrapping, To: StateReady}, {From: StateReady, To: StateDegraded}} {
+		select {
+		case e := <-sub.Out():
+			require.Equal(t, want, e.(EvtStateChanged))
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no %s event", want.To)
+		}
+	}
+}
+
+func TestDeferProvidesUntilReady(t *testing.T) {
+	ctx := context.Background()
+	d := setupDHT(ctx, t, false, DisableAutoRefresh(), ReadinessCriteria(2, false), DeferProvidesUntilReady())
+	d2 := setupDHT(ctx, t, false)
+	d3 := setupDHT(ctx, t, false)
+	connect(t, ctx, d, d2)
+	connect(t, ctx, d, d3)
+
+	key := cid.NewCidV0(u.Hash([]byte("deferred")))
+	require.NoError(t, d.Provide(ctx, key, true))
+	require.Equal(t, 1, d.DeferredProvides())
+	provs, err := d2.providerStore.GetProviders(ctx, key.Hash())
+	require.NoError(t, err)
+	require.Empty(t, provs)
+
+	require.NoError(t, <-d.RefreshRoutingTable())
+	require.Eventually(t, func() bool {
+		if d.DeferredProvides() != 0 {
+			return false
+		}
+		for _, other := range []*IpfsDHT{d2, d3} {
+			provs, err := other.providerStore.GetProviders(ctx, key.Hash())
+			if err != nil || len(provs) == 0 {
+				return false
+			}
+		}
+		return true
+	}, 10*time.Second, 10*time.Millisecond)
+}
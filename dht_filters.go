@@ -11,10 +11,12 @@ import (
 	"github.com/libp2p/go-libp2p/core/peer"
 
 	"github.com/google/gopacket/routing"
+	record "github.com/libp2p/go-libp2p-record"
 	netroute "github.com/libp2p/go-netroute"
 
 	ma "github.com/multiformats/go-multiaddr"
 	manet "github.com/multiformats/go-multiaddr/net"
+	"github.com/multiformats/go-multihash"
 
 	dhtcfg "github.com/libp2p/go-libp2p-kad-dht/internal/config"
 )
@@ -26,6 +28,16 @@ type QueryFilterFunc = dhtcfg.QueryFilterFunc
 // the local route table.
 type RouteTableFilterFunc = dhtcfg.RouteTableFilterFunc
 
+// CandidateFilterFunc decides whether a peer returned as a closer peer by from during a lookup may enter the lookup.
+type CandidateFilterFunc = dhtcfg.CandidateFilterFunc
+
+// ProviderAcceptFunc decides whether a provider record for key, received from peer from, is stored.
+type ProviderAcceptFunc = dhtcfg.ProviderAcceptFunc
+
+// KeyPolicy decides whether records under key are stored and served. Provider records are keyed by the multihash of
+// the provided content.
+type KeyPolicy = dhtcfg.KeyPolicy
+
 var publicCIDR6 = "2000::/3"
 var public6 *net.IPNet
 
@@ -113,6 +125,57 @@ func PrivateQueryFilter(_ interface{}, ai peer.AddrInfo) bool {
 
 var _ QueryFilterFunc = PrivateQueryFilter
 
+// OriginatorProviderPolicy only accepts provider records from the provider itself. This is the default.
+func OriginatorProviderPolicy(from peer.ID, _ multihash.Multihash, prov peer.AddrInfo) bool {
+	return prov.ID == from
+}
+
+var _ ProviderAcceptFunc = OriginatorProviderPolicy
+
+// ThirdPartyProviderPolicy accepts provider records registered on behalf of a provider by any peer, e.g. by
+// a delegated publishing service. Such records can be planted by anyone, so this should only be used in networks
+// whose peers are trusted.
+func ThirdPartyProviderPolicy(peer.ID, multihash.Multihash, peer.AddrInfo) bool {
+	return true
+}
+
+var _ ProviderAcceptFunc = ThirdPartyProviderPolicy
+
+// NamespacePolicy is a KeyPolicy enabling the keys in the given namespaces only, e.g. "pk" and "ipns".
+func NamespacePolicy(namespaces ...string) KeyPolicy {
+	allowed := make(map[string]struct{}, len(namespaces))
+	for _, ns := range namespaces {
+		allowed[ns] = struct{}{}
+	}
+	return func(key string) bool {
+		ns, _, err := record.SplitKey(key)
+		if err != nil {
+			return false
+		}
+		_, ok := allowed[ns]
+		return ok
+	}
+}
+
+// valuesEnabled returns true if values under key may be stored and retrieved.
+func (dht *IpfsDHT) valuesEnabled(key string) bool {
+	return dht.enableValues && (dht.valuePolicy == nil || dht.valuePolicy(key))
+}
+
+// providersEnabled returns true if provider records for key may be stored and retrieved.
+func (dht *IpfsDHT) providersEnabled(key []byte) bool {
+	return dht.enableProviders && (dht.providerPolicy == nil || dht.providerPolicy(string(key)))
+}
+
+// peerAllowed returns true if we may interact with p, i.e. if no allowlist is configured or p is on it.
+func (dht *IpfsDHT) peerAllowed(p peer.ID) bool {
+	if dht.allowlist == nil {
+		return true
+	}
+	_, ok := dht.allowlist[p]
+	return ok
+}
+
 // We call this very frequently but routes can technically change at runtime.
 // Cache it for two minutes.
 const routerCacheTime = 2 * time.Minute
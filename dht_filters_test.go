@@ -3,13 +3,19 @@ package dht
 import (
 	"context"
 	"net"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/libp2p/go-libp2p/core/connmgr"
 	ic "github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/test"
 	ma "github.com/multiformats/go-multiaddr"
 	manet "github.com/multiformats/go-multiaddr/net"
+
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
 )
 
 func TestIsRelay(t *testing.T) {
@@ -69,3 +75,281 @@ func TestFilterCaching(t *testing.T) {
 		t.Fatal("router should be returned multiple times.")
 	}
 }
+
+type addrGater struct {
+	connmgr.ConnectionGater
+	blockedPeer peer.ID
+}
+
+func (g *addrGater) InterceptPeerDial(p peer.ID) bool { return p != g.blockedPeer }
+
+func (g *addrGater) InterceptAddrDial(_ peer.ID, a ma.Multiaddr) bool { return manet.IsPublicAddr(a) }
+
+func TestAddressGater(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	blocked := test.RandPeerIDFatal(t)
+	d := setupDHT(ctx, t, true,
+		AddressGater(&addrGater{blockedPeer: blocked}),
+		AddressFilter(func(_ peer.ID, a ma.Multiaddr) bool {
+			_, err := a.ValueForProtocol(ma.P_TCP)
+			return err == nil
+		}),
+	)
+
+	public := ma.StringCast("/ip4/8.8.8.8/tcp/4001")
+	addrs := []ma.Multiaddr{
+		public,
+		ma.StringCast("/ip4/10.0.0.1/tcp/4001"), // refused by the gater
+		ma.StringCast("/ip4/8.8.4.4/udp/4001/quic"), // refused by the filter
+	}
+
+	p := test.RandPeerIDFatal(t)
+	d.maybeAddAddrs(p, addrs, time.Hour)
+	if got := d.peerstore.Addrs(p); len(got) != 1 || !got[0].Equal(public) {
+		t.Fatalf("expected only %s to be added, got %v", public, got)
+	}
+
+	d.maybeAddAddrs(blocked, addrs, time.Hour)
+	if got := d.peerstore.Addrs(blocked); len(got) != 0 {
+		t.Fatalf("expected no addresses for a blocked peer, got %v", got)
+	}
+}
+
+func TestFirstSeenPolicy(t *testing.T) {
+	pol := NewFirstSeenPolicy(50*time.Millisecond, 0)
+	p := test.RandPeerIDFatal(t)
+	if pol.Admit(nil, p) {
+		t.Fatal("admitted a peer seen for the first time")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if !pol.Admit(nil, p) {
+		t.Fatal("did not admit a peer seen long enough ago")
+	}
+
+	// a peer solving the puzzle is admitted right away
+	pol = NewFirstSeenPolicy(time.Hour, 4)
+	for {
+		p = test.RandPeerIDFatal(t)
+		if peerIDPuzzleBits(p) >= 4 {
+			break
+		}
+	}
+	if !pol.Admit(nil, p) {
+		t.Fatal("did not admit a peer solving the puzzle")
+	}
+}
+
+func TestIPDiversityPolicy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false, RoutingTableAdmissionPolicy(NewIPDiversityPolicy(1)))
+	// all test peers connect from 127.0.0.1
+	others := setupDHTS(t, ctx, 2)
+	connect(t, ctx, d, others[0])
+	connectNoSync(t, ctx, d, others[1])
+	wait(t, ctx, others[1], d)
+
+	if d.routingTable.Find(others[1].self) != "" {
+		t.Fatal("admitted a second peer from the same IP group")
+	}
+	if d.routingTable.Find(others[0].self) == "" {
+		t.Fatal("peer in the routing table was evicted")
+	}
+}
+
+func TestProvideTargetDiversity(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false, MinProvideTargetGroups(3))
+	other := setupDHT(ctx, t, false)
+	connect(t, ctx, d, other)
+
+	addPeer := func(addr string) peer.ID {
+		p := test.RandPeerIDFatal(t)
+		d.peerstore.AddAddr(p, ma.StringCast(addr), time.Hour)
+		return p
+	}
+	a := addPeer("/ip4/10.1.0.1/tcp/4001")
+	sameGroup := addPeer("/ip4/10.1.200.7/tcp/4001")
+	b := addPeer("/ip4/10.2.0.1/tcp/4001")
+	unknown := test.RandPeerIDFatal(t)
+
+	// the connected peer counts from its connection, on 127.0.0.1
+	peers := []peer.ID{other.self, a, sameGroup, unknown}
+	if n := d.provideTargetGroups(peers); n != 2 {
+		t.Fatalf("expected 2 groups, got %d", n)
+	}
+	if !d.lacksProvideDiversity(peers) {
+		t.Fatal("expected the provide targets to lack diversity")
+	}
+	if d.lacksProvideDiversity(append(peers, b)) {
+		t.Fatal("expected the provide targets to be diverse enough")
+	}
+
+	if other.lacksProvideDiversity(peers) {
+		t.Fatal("diversity checked without MinProvideTargetGroups")
+	}
+	if _, err := New(ctx, other.host, MinProvideTargetGroups(0)); err == nil {
+		t.Fatal("expected an error for a non-positive minimum")
+	}
+}
+
+func TestDiverseProviderCloserPeers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false, DiverseProviderCloserPeers(2))
+	plain := setupDHT(ctx, t, false)
+	from := test.RandPeerIDFatal(t)
+
+	for i, addr := range []string{
+		"/ip4/10.1.0.1/tcp/4001", "/ip4/10.1.0.2/tcp/4001", "/ip4/10.1.0.3/tcp/4001", "/ip4/10.1.0.4/tcp/4001",
+		"/ip4/10.2.0.1/tcp/4001", "/ip4/10.3.0.1/tcp/4001",
+	} {
+		p := test.RandPeerIDFatal(t)
+		for _, dht := range []*IpfsDHT{d, plain} {
+			dht.peerstore.AddAddr(p, ma.StringCast(addr), time.Hour)
+			if ok, err := dht.routingTable.TryAddPeer(p, true, false); err != nil || !ok {
+				t.Fatalf("failed to add peer %d to the routing table: %v", i, err)
+			}
+		}
+	}
+
+	groups := func(dht *IpfsDHT) map[string]int {
+		req := pb.NewMessage(pb.Message_GET_PROVIDERS, testCaseCids[0].Hash(), 0)
+		resp, err := dht.handleGetProviders(ctx, from, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		count := make(map[string]int)
+		for _, pi := range pb.PBPeersToPeerInfos(resp.CloserPeers) {
+			g, _ := dht.peerGroup(pi.ID)
+			count[g]++
+		}
+		return count
+	}
+	if g := groups(d); len(g) != 3 || g["10.1.0.0"] != 2 {
+		t.Fatalf("expected at most 2 closer peers per group, got %v", g)
+	}
+	if g := groups(plain); g["10.1.0.0"] != 4 {
+		t.Fatalf("expected all closer peers without the limit, got %v", g)
+	}
+	if _, err := New(ctx, plain.host, DiverseProviderCloserPeers(0)); err == nil {
+		t.Fatal("expected an error for a non-positive limit")
+	}
+}
+
+func TestBehaviorEviction(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var denied []*peer.AddrInfo
+	var denylist []peer.ID
+	for i := 0; i < 5; i++ {
+		p := test.RandPeerIDFatal(t)
+		denylist = append(denylist, p)
+		denied = append(denied, &peer.AddrInfo{ID: p})
+	}
+
+	nDHTs := 2
+	dhts := setupDHTS(t, ctx, nDHTs, BehaviorEviction(5, 0.6, 0.2), PeerDenylist(denylist...))
+	defer func() {
+		for i := 0; i < nDHTs; i++ {
+			dhts[i].Close()
+			defer dhts[i].host.Close()
+		}
+	}()
+	sub, err := dhts[0].host.EventBus().Subscribe(new(EvtRoutingTablePeerEvicted))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	connect(t, ctx, dhts[0], dhts[1])
+	p := dhts[1].self
+
+	// a single suspicious response is not enough evidence
+	dhts[0].observeBehavior(p, denied)
+	if dhts[0].routingTable.Find(p) == "" {
+		t.Fatal("evicted peer without enough evidence")
+	}
+	for i := 0; i < 4; i++ {
+		dhts[0].observeBehavior(p, denied)
+	}
+	if dhts[0].routingTable.Find(p) != "" {
+		t.Fatal("did not evict peer returning denylisted peers")
+	}
+	select {
+	case e := <-sub.Out():
+		evt := e.(EvtRoutingTablePeerEvicted)
+		if evt.Peer != p || evt.Suspicious != 5 {
+			t.Fatalf("unexpected eviction event %+v", evt)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no eviction event")
+	}
+
+	// the peer stays out until it behaved for long enough
+	dhts[0].peerFound(ctx, p, true)
+	if !dhts[0].behavior.flagged(p) || dhts[0].admitRTPeer(p) {
+		t.Fatal("readmitted flagged peer")
+	}
+	for i := 0; i < 15; i++ {
+		dhts[0].observeBehavior(p, nil)
+		dhts[0].observeBehavior(p, []*peer.AddrInfo{{ID: test.RandPeerIDFatal(t)}})
+	}
+	if !dhts[0].admitRTPeer(p) {
+		t.Fatal("did not readmit recovered peer")
+	}
+}
+
+func TestCandidateFilter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	nDHTs := 4
+	dhts := setupDHTS(t, ctx, nDHTs)
+	defer func() {
+		for i := 0; i < nDHTs; i++ {
+			dhts[i].Close()
+			defer dhts[i].host.Close()
+		}
+	}()
+	// a line, so dhts[3] is only learned from dhts[2] mid-query
+	for i := 0; i < nDHTs-1; i++ {
+		connect(t, ctx, dhts[i], dhts[i+1])
+	}
+
+	vetoed := dhts[3].self
+	var (
+		mu         sync.Mutex
+		vetoedFrom []peer.ID
+	)
+	// called concurrently by the query workers
+	dhts[0].candidateFilter = func(from peer.ID, candidate *peer.AddrInfo) bool {
+		if candidate.ID != vetoed {
+			return true
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		vetoedFrom = append(vetoedFrom, from)
+		return false
+	}
+
+	peers, err := dhts[0].GetClosestPeers(ctx, string(vetoed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range peers {
+		if p == vetoed {
+			t.Fatal("vetoed candidate entered the lookup")
+		}
+	}
+	if len(vetoedFrom) == 0 || vetoedFrom[0] != dhts[2].self {
+		t.Fatalf("expected the candidate to be vetoed when returned by %s, got %v", dhts[2].self, vetoedFrom)
+	}
+}
@@ -1,11 +1,14 @@
 package dht
 
 import (
+	"fmt"
 	"io"
 	"time"
 
 	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
 
+	"github.com/libp2p/go-libp2p-kad-dht/internal"
 	"github.com/libp2p/go-libp2p-kad-dht/internal/net"
 	"github.com/libp2p/go-libp2p-kad-dht/metrics"
 	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
@@ -21,6 +24,9 @@ var dhtStreamIdleTimeout = 1 * time.Minute
 // ErrReadTimeout is an error that occurs when no message is read within the timeout period.
 var ErrReadTimeout = net.ErrReadTimeout
 
+// ErrBusy is returned for requests the peer rejected because it is shedding load, see LoadShedding.
+var ErrBusy = pb.ErrBusy
+
 // handleNewStream implements the network.StreamHandler
 func (dht *IpfsDHT) handleNewStream(s network.Stream) {
 	if dht.handleNewMessage(s) {
@@ -38,6 +44,10 @@ func (dht *IpfsDHT) handleNewMessage(s network.Stream) bool {
 	r := msgio.NewVarintReaderSize(s, network.MessageSizeMax)
 
 	mPeer := s.Conn().RemotePeer()
+	if !dht.peerAllowed(mPeer) {
+		logger.Debugw("refusing dht stream from peer not on the allowlist", "from", mPeer)
+		return false
+	}
 
 	timer := time.AfterFunc(dhtStreamIdleTimeout, func() { _ = s.Reset() })
 	defer timer.Stop()
@@ -88,6 +98,19 @@ func (dht *IpfsDHT) handleNewMessage(s network.Stream) bool {
 			return false
 		}
 
+		if dht.overlay != nil {
+			if err := dht.overlay.verify(mPeer, &req); err != nil {
+				logger.Debugw("rejecting unauthenticated message", "from", mPeer, "error", err)
+				_ = stats.RecordWithTags(ctx,
+					[]tag.Mutator{tag.Upsert(metrics.KeyMessageType, req.GetType().String())},
+					metrics.ReceivedMessages.M(1),
+					metrics.ReceivedMessageErrors.M(1),
+					metrics.ReceivedBytes.M(int64(msgLen)),
+				)
+				return false
+			}
+		}
+
 		timer.Reset(dhtStreamIdleTimeout)
 
 		startTime := time.Now()
@@ -110,6 +133,22 @@ func (dht *IpfsDHT) handleNewMessage(s network.Stream) bool {
 			return false
 		}
 
+		if dht.shedRequest(&req) {
+			stats.Record(dht.newContextWithLocalTags(ctx), metrics.ShedRequests.M(1))
+			logger.Debugw("shedding load, rejecting request", "from", mPeer, "type", req.GetType())
+			busy := pb.NewMessage(req.GetType(), req.GetKey(), 0)
+			busy.Busy = true
+			if dht.overlay != nil {
+				if busy, err = dht.overlay.sign(busy); err != nil {
+					return false
+				}
+			}
+			if err := net.WriteMsg(s, busy); err != nil {
+				return false
+			}
+			continue
+		}
+
 		// a peer has queried us, let's add it to RT
 		dht.peerFound(dht.ctx, mPeer, true)
 
@@ -118,7 +157,20 @@ func (dht *IpfsDHT) handleNewMessage(s network.Stream) bool {
 				zap.Int32("type", int32(req.GetType())),
 				zap.Binary("key", req.GetKey()))
 		}
+		handled := dht.trackHandler()
+		release, err := dht.scheduleRequest(ctx, &req)
+		if err != nil {
+			handled()
+			return false
+		}
 		resp, err := handler(ctx, mPeer, &req)
+		release()
+		handled()
+		handlingTime := time.Since(startTime)
+		stats.Record(ctx, metrics.HandlerLatency.M(float64(handlingTime)/float64(time.Millisecond)))
+		if dht.slowRequestThreshold > 0 && handlingTime > dht.slowRequestThreshold {
+			dht.logSlowRequest(mPeer, &req, resp, msgLen, handlingTime)
+		}
 		if err != nil {
 			stats.Record(ctx, metrics.ReceivedMessageErrors.M(1))
 			if c := baseLogger.Check(zap.DebugLevel, "error handling message"); c != nil {
@@ -141,6 +193,15 @@ func (dht *IpfsDHT) handleNewMessage(s network.Stream) bool {
 			continue
 		}
 
+		dht.limitResponse(&req, resp)
+		if dht.overlay != nil {
+			if resp, err = dht.overlay.sign(resp); err != nil {
+				logger.Debugw("failed to sign response", "error", err)
+				return false
+			}
+		}
+		stats.Record(ctx, metrics.ResponseBytes.M(int64(resp.Size())))
+
 		// send out response msg
 		err = net.WriteMsg(s, resp)
 		if err != nil {
@@ -167,3 +228,32 @@ func (dht *IpfsDHT) handleNewMessage(s network.Stream) bool {
 		stats.Record(ctx, metrics.InboundRequestLatency.M(latencyMillis))
 	}
 }
+
+// logSlowRequest logs a received request whose handling took longer than the slow request threshold.
+func (dht *IpfsDHT) logSlowRequest(from peer.ID, req, resp *pb.Message, reqSize int, took time.Duration) {
+	respSize := 0
+	if resp != nil {
+		respSize = resp.Size()
+	}
+	logger.Warnw("slow dht request",
+		"from", from,
+		"type", req.GetType().String(),
+		"key", loggableMessageKey(req),
+		"time", took,
+		"request_bytes", reqSize,
+		"response_bytes", respSize,
+	)
+}
+
+// loggableMessageKey formats the key of req according to its message type.
+func loggableMessageKey(req *pb.Message) fmt.Stringer {
+	switch req.GetType() {
+	case pb.Message_ADD_PROVIDER, pb.Message_GET_PROVIDERS:
+		return internal.LoggableProviderRecordBytes(req.GetKey())
+	case pb.Message_FIND_NODE:
+		if p, err := peer.IDFromBytes(req.GetKey()); err == nil {
+			return p
+		}
+	}
+	return internal.LoggableRecordKeyBytes(req.GetKey())
+}
@@ -6,14 +6,20 @@ import (
 	"time"
 
 	dhtcfg "github.com/libp2p/go-libp2p-kad-dht/internal/config"
+	"github.com/libp2p/go-libp2p-kad-dht/netsize"
 	"github.com/libp2p/go-libp2p-kad-dht/providers"
+	"github.com/libp2p/go-libp2p/core/connmgr"
+	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/protocol"
 
 	"github.com/libp2p/go-libp2p-kbucket/peerdiversity"
 	record "github.com/libp2p/go-libp2p-record"
 
+	"github.com/benbjohnson/clock"
 	ds "github.com/ipfs/go-datastore"
+	ma "github.com/multiformats/go-multiaddr"
+	detection "github.com/ssrivatsan97/go-libp2p-kad-dht/eclipse-detection"
 )
 
 // ModeOpt describes what mode the dht should operate in
@@ -31,6 +37,13 @@ const (
 	ModeAutoServer
 )
 
+// Settings of the MobileProfile.
+const (
+	mobileConcurrency     = 3
+	mobileRefreshInterval = time.Hour
+	mobileProvideRate     = 0.2
+)
+
 // DefaultPrefix is the application specific prefix attached to all DHT protocols by default.
 const DefaultPrefix protocol.ID = "/ipfs"
 
@@ -131,6 +144,22 @@ func NamespacedValidator(ns string, v record.Validator) Option {
 	}
 }
 
+// ValidatorTimeout bounds the time the Validator may take to validate or select records. Records it takes longer on are
+// treated as invalid, so that a third-party validator hanging on malformed records sent by an attacker can't stall
+// lookups. Timed out calls are left running, and records arriving while too many validator calls run are treated as
+// invalid too. Validator panics are always recovered and treated the same way.
+//
+// Unbounded by default.
+func ValidatorTimeout(timeout time.Duration) Option {
+	return func(c *dhtcfg.Config) error {
+		if timeout <= 0 {
+			return fmt.Errorf("validator timeout must be positive")
+		}
+		c.ValidatorTimeout = timeout
+		return nil
+	}
+}
+
 // ProtocolPrefix sets an application specific prefix to be attached to all DHT protocols. For example,
 // /myapp/kad/1.0.0 instead of /ipfs/kad/1.0.0. Prefix should be of the form /myapp.
 //
@@ -142,6 +171,140 @@ func ProtocolPrefix(prefix protocol.ID) Option {
 	}
 }
 
+// PrivateNetwork configures the DHT to run as a private, permissioned network: it speaks the protocols under prefix,
+// which must differ from DefaultPrefix, and only interacts with the peers in allowlist (see PeerAllowlist).
+func PrivateNetwork(prefix protocol.ID, allowlist ...peer.ID) Option {
+	return func(c *dhtcfg.Config) error {
+		if prefix == DefaultPrefix {
+			return fmt.Errorf("private networks must not use the protocol prefix %s", DefaultPrefix)
+		}
+		if err := ProtocolPrefix(prefix)(c); err != nil {
+			return err
+		}
+		return PeerAllowlist(allowlist...)(c)
+	}
+}
+
+// PeerAllowlist restricts the DHT to the given peers. Peers that are not on the allowlist are never queried, their
+// requests are refused and they are never added to the routing table. Calling PeerAllowlist more than once adds to
+// the allowlist.
+func PeerAllowlist(peers ...peer.ID) Option {
+	return func(c *dhtcfg.Config) error {
+		if len(peers) == 0 {
+			return fmt.Errorf("peer allowlist must not be empty")
+		}
+		c.PeerAllowlist = append(c.PeerAllowlist, peers...)
+		return nil
+	}
+}
+
+// AuthenticatedOverlay runs the DHT as an authenticated private overlay for permissioned deployments: all messages
+// carry the membership credential of their sender, issued by authority with NewMembershipCredential, and are signed
+// with the key of the host. Requests, responses and notifications from peers without a valid credential, or not
+// signed by them, are rejected. Unlike PrivateNetwork, which only separates the protocols, members are authenticated.
+//
+// credential must admit the local peer. The overlay must use a protocol prefix other than DefaultPrefix. Disabled by
+// default.
+func AuthenticatedOverlay(authority crypto.PubKey, credential []byte) Option {
+	return func(c *dhtcfg.Config) error {
+		if authority == nil {
+			return fmt.Errorf("overlay authority must not be nil")
+		}
+		if len(credential) == 0 {
+			return fmt.Errorf("overlay membership credential must not be empty")
+		}
+		c.Overlay.Authority = authority
+		c.Overlay.Credential = credential
+		return nil
+	}
+}
+
+// AddressGater makes the DHT consult gater before adding addresses of peers learned from other peers, e.g. in query
+// responses, to the peerstore. Addresses the gater would refuse to dial are dropped, which keeps remote peers from
+// poisoning the address book. This should usually be the connection gater the host was constructed with.
+func AddressGater(gater connmgr.ConnectionGater) Option {
+	return func(c *dhtcfg.Config) error {
+		c.AddrGater = gater
+		return nil
+	}
+}
+
+// AddressFilter configures a filter for the addresses of peers learned from other peers. Only addresses for which
+// filter returns true are added to the peerstore. It is applied in addition to the gater set with AddressGater.
+func AddressFilter(filter func(peer.ID, ma.Multiaddr) bool) Option {
+	return func(c *dhtcfg.Config) error {
+		c.AddrFilter = filter
+		return nil
+	}
+}
+
+// NetsizeEstimator replaces the network size estimator, which the eclipse detector derives its thresholds from, with
+// estimator. The estimator is fed the results of all lookups that find a full bucket of peers.
+//
+// Defaults to the distance based netsize.Estimator.
+func NetsizeEstimator(estimator netsize.NetworkSizeEstimator) Option {
+	return func(c *dhtcfg.Config) error {
+		c.Netsize.Estimator = estimator
+		c.Netsize.Crawl = false
+		return nil
+	}
+}
+
+// CrawlNetsizeEstimator makes the DHT count the servers of the network exactly by crawling it, starting from the
+// peers in the routing table, instead of estimating the network size from lookup results. A count is reused for
+// maxAge and a crawl is aborted after timeout. This is only viable for small networks, where the distance based
+// estimator is inaccurate.
+func CrawlNetsizeEstimator(maxAge, timeout time.Duration) Option {
+	return func(c *dhtcfg.Config) error {
+		if maxAge <= 0 || timeout <= 0 {
+			return fmt.Errorf("crawl max age and timeout must be positive")
+		}
+		c.Netsize.Estimator = nil
+		c.Netsize.Crawl = true
+		c.Netsize.CrawlMaxAge = maxAge
+		c.Netsize.CrawlTimeout = timeout
+		return nil
+	}
+}
+
+// NetsizeSampling replaces the strategy gathering lookup results for the network size estimator when it has no
+// estimate yet, e.g. on the first provides, see IpfsDHT.GatherNetsizeData. A RegionNetsizeSampler configures the
+// number of sample keys, the concurrency of their lookups and the keyspace regions they are drawn from.
+//
+// Defaults to DefaultNetsizeSampler.
+func NetsizeSampling(sampler NetsizeSampler) Option {
+	return func(c *dhtcfg.Config) error {
+		if sampler == nil {
+			return fmt.Errorf("netsize sampler must not be nil")
+		}
+		if s, ok := sampler.(RegionNetsizeSampler); ok && (s.Keys <= 0 || s.MinCPL < 0 || s.MaxCPL < s.MinCPL) {
+			return fmt.Errorf("invalid netsize sampling region")
+		}
+		c.Netsize.Sampler = sampler
+		return nil
+	}
+}
+
+// NetsizeGatheringSchedule gathers netsize data in the background, every interval give or take the jitter as long as
+// the network size estimator has no estimate, instead of when an estimate is first needed, e.g. by a provide. Operations
+// needing an estimate before the first gathering completes trigger it and proceed without waiting, e.g. provides fall
+// back to the regular strategy, so that the gathering can't stall them.
+//
+// Disabled by default.
+func NetsizeGatheringSchedule(interval, jitter time.Duration) Option {
+	return func(c *dhtcfg.Config) error {
+		if interval <= 0 {
+			return fmt.Errorf("netsize gathering interval must be positive")
+		}
+		if jitter < 0 || jitter > interval {
+			return fmt.Errorf("netsize gathering jitter must be between 0 and the interval")
+		}
+		c.Netsize.Schedule.Interval = interval
+		c.Netsize.Schedule.Jitter = jitter
+		return nil
+	}
+}
+
 // ProtocolExtension adds an application specific protocol to the DHT protocol. For example,
 // /ipfs/lan/kad/1.0.0 instead of /ipfs/kad/1.0.0. extension should be of the form /lan.
 func ProtocolExtension(ext protocol.ID) Option {
@@ -194,6 +357,596 @@ func Resiliency(beta int) Option {
 	}
 }
 
+// CPLLookupBudget bounds the enumeration of all peers in a keyspace region done by special provides and provider
+// lookups, which runs a lookup per sub-region and may run away when the network size is mis-estimated. The enumeration
+// stops once it ran maxLookups lookups, found maxPeers peers or took longer than timeout, and returns the peers found
+// so far along with ErrCPLBudgetExceeded. A zero limit is unbounded.
+//
+// Disabled by default.
+func CPLLookupBudget(maxLookups, maxPeers int, timeout time.Duration) Option {
+	return func(c *dhtcfg.Config) error {
+		if maxLookups < 0 || maxPeers < 0 || timeout < 0 {
+			return fmt.Errorf("CPL lookup budget limits must not be negative")
+		}
+		c.CPLLookupBudget.MaxLookups = maxLookups
+		c.CPLLookupBudget.MaxPeers = maxPeers
+		c.CPLLookupBudget.Timeout = timeout
+		return nil
+	}
+}
+
+// RegionCacheTTL configures how long the peers found by enumerating a keyspace region during a special provide are
+// cached. Provides of keys hashing to the same region within the TTL reuse the enumeration instead of running it
+// again, and concurrent provides of the same region share a single enumeration. Regions containing a peer that could
+// not be sent a provider record are dropped early. A TTL of 0 disables the cache.
+//
+// Disabled by default.
+func RegionCacheTTL(ttl time.Duration) Option {
+	return func(c *dhtcfg.Config) error {
+		if ttl < 0 {
+			return fmt.Errorf("region cache TTL must not be negative")
+		}
+		c.RegionCacheTTL = ttl
+		return nil
+	}
+}
+
+// ClosestPeersCacheTTL caches the closest peers found by GetClosestPeers per key for the given TTL, so that operations
+// right after a lookup, e.g. a provide of a key following the eclipse detection of its closest peers, reuse its result
+// instead of running it again. Lookups reporting their progress to the caller always run on the network, and so do
+// the lookups of the detection mechanisms comparing lookups over time. Keys whose closest peers include a peer that
+// could not be sent a provider record are dropped early, and IpfsDHT.InvalidateClosestPeers drops keys explicitly.
+// A TTL of 0 disables the cache.
+//
+// Disabled by default.
+func ClosestPeersCacheTTL(ttl time.Duration) Option {
+	return func(c *dhtcfg.Config) error {
+		if ttl < 0 {
+			return fmt.Errorf("closest peers cache TTL must not be negative")
+		}
+		c.ClosestPeersCacheTTL = ttl
+		return nil
+	}
+}
+
+// ResponsePeerLimits caps the responses to received requests to the given numbers of closer peers, providers and
+// addresses per peer, 0 being unlimited, protecting against requests being used for amplification. Truncated peer
+// lists keep peers of distinct IP groups first. The cap on closer peers also applies to the closer peers taken from
+// the responses of remote peers, bounding the memory they can make a query spend.
+//
+// Unlimited by default, but see MaxResponseSize.
+func ResponsePeerLimits(closerPeers, providers, addrsPerPeer int) Option {
+	return func(c *dhtcfg.Config) error {
+		if closerPeers < 0 || providers < 0 || addrsPerPeer < 0 {
+			return fmt.Errorf("response peer limits must not be negative")
+		}
+		c.ResponseLimits.MaxCloserPeers = closerPeers
+		c.ResponseLimits.MaxProviders = providers
+		c.ResponseLimits.MaxAddrsPerPeer = addrsPerPeer
+		return nil
+	}
+}
+
+// MaxResponseSize caps the size in bytes of the responses to received requests, dropping the farthest closer peers
+// and then the last providers of responses that are larger. Paged provider responses are truncated such that the
+// dropped providers are returned with the next page. A size of 0 is unlimited.
+//
+// Defaults to the maximum message size of the network, network.MessageSizeMax.
+func MaxResponseSize(size int) Option {
+	return func(c *dhtcfg.Config) error {
+		if size < 0 {
+			return fmt.Errorf("max response size must not be negative")
+		}
+		c.ResponseLimits.MaxSize = size
+		return nil
+	}
+}
+
+// SlowRequestLog logs every received request whose handling takes longer than threshold as a warning, along with the
+// requesting peer, the message type, the key and the request and response sizes, so that server operators can spot
+// expensive keys or abusive clients. A threshold of 0 disables the log.
+//
+// Disabled by default.
+func SlowRequestLog(threshold time.Duration) Option {
+	return func(c *dhtcfg.Config) error {
+		if threshold < 0 {
+			return fmt.Errorf("slow request threshold must not be negative")
+		}
+		c.SlowRequestThreshold = threshold
+		return nil
+	}
+}
+
+// RPCTimeout configures the bounds of the adaptive timeout applied to every RPC sent during a lookup.
+// The timeout for a given peer is derived from its observed latency (as tracked by the peerstore) and
+// clamped to [min, max]. Peers we have no latency observations for get the max timeout.
+//
+// Setting max to zero disables RPC timeouts altogether (queries are only bounded by the query context).
+//
+// The defaults are 2s and 10s.
+func RPCTimeout(min, max time.Duration) Option {
+	return func(c *dhtcfg.Config) error {
+		if min < 0 || max < 0 {
+			return fmt.Errorf("rpc timeouts must not be negative")
+		}
+		if max != 0 && min > max {
+			return fmt.Errorf("minimum rpc timeout %s exceeds maximum %s", min, max)
+		}
+		c.RPCTimeout.Min = min
+		c.RPCTimeout.Max = max
+		return nil
+	}
+}
+
+// ProviderAddrPolicy decides which of our addresses are published in our provider records
+type ProviderAddrPolicy = dhtcfg.ProviderAddrPolicy
+
+const (
+	// ProviderAddrsAll publishes all our addresses.
+	ProviderAddrsAll ProviderAddrPolicy = iota
+	// ProviderAddrsReachability selects addresses by our current reachability: public direct addresses when we are
+	// publicly reachable, and relay addresses along with public direct addresses, which peers can hole punch to, when
+	// we are behind a NAT. Relay addresses are only published otherwise if we have no public direct addresses.
+	ProviderAddrsReachability
+	// ProviderAddrsDirectOnly never publishes relay addresses.
+	ProviderAddrsDirectOnly
+)
+
+// ProviderAddrs configures which of our addresses are published in our provider records. Providers behind a NAT use
+// ProviderAddrsReachability to remain findable through their relay addresses, while publicly reachable providers keep
+// their records free of relay addresses.
+//
+// Defaults to ProviderAddrsAll.
+func ProviderAddrs(policy ProviderAddrPolicy) Option {
+	return func(c *dhtcfg.Config) error {
+		if policy < ProviderAddrsAll || policy > ProviderAddrsDirectOnly {
+			return fmt.Errorf("unknown provider address policy %d", policy)
+		}
+		c.ProviderAddrPolicy = policy
+		return nil
+	}
+}
+
+// ProviderRecordMaxAddrs caps the number of our addresses sent in provider records to n, keeping wide provides to
+// hundreds of peers bandwidth-efficient. The most useful addresses are kept: public direct addresses first, then relay
+// addresses, then private ones. A cap of 0 is unlimited.
+//
+// Unlimited by default.
+func ProviderRecordMaxAddrs(n int) Option {
+	return func(c *dhtcfg.Config) error {
+		if n < 0 {
+			return fmt.Errorf("provider record max addresses must not be negative")
+		}
+		c.ProviderRecords.MaxAddrs = n
+		return nil
+	}
+}
+
+// CompressProviderRecords sends provider records using the compressed encoding extension. All peers of this version
+// accept the extension, but older peers ignore compressed records, so it must only be enabled in networks whose
+// servers all accept it.
+//
+// Disabled by default.
+func CompressProviderRecords() Option {
+	return func(c *dhtcfg.Config) error {
+		c.ProviderRecords.Compress = true
+		return nil
+	}
+}
+
+// ValueMirroring replicates records put with PutValue to all peers in the keyspace region around the key expected to
+// contain the special provide number of peers, as special provides do for provider records, when the eclipse detector
+// finds the closest peers to the key suspicious. Records are mirrored to every single peer at most peerRate times per
+// second on average, in bursts of at most peerBurst records. Mirroring runs in the background after PutValue returns,
+// values put while too many are waiting to be mirrored aren't.
+//
+// Disabled by default.
+func ValueMirroring(peerRate float64, peerBurst int) Option {
+	return func(c *dhtcfg.Config) error {
+		if peerRate <= 0 || peerBurst <= 0 {
+			return fmt.Errorf("value mirroring rate and burst must be positive")
+		}
+		c.ValueMirroring.Enabled = true
+		c.ValueMirroring.PeerRate = peerRate
+		c.ValueMirroring.PeerBurst = peerBurst
+		return nil
+	}
+}
+
+// WithClock sets the clock used to timestamp records and provider records, and to schedule routing table refreshes,
+// queued provides, provider record GC and dial backoffs, so that tests can advance time deterministically, e.g. with
+// clock.NewMock. Latencies and timeouts are always measured with the system clock.
+//
+// Defaults to the system clock.
+func WithClock(clk clock.Clock) Option {
+	return func(c *dhtcfg.Config) error {
+		if clk == nil {
+			return fmt.Errorf("clock must not be nil")
+		}
+		c.Clock = clk
+		return nil
+	}
+}
+
+// ReadinessCriteria sets when the DHT is ready, see IpfsDHT.Ready and IpfsDHT.State: once its routing table holds at
+// least minPeers peers, the last refresh of the routing table succeeded and, if requireNetsize is set, an estimate of
+// the network size is available. Small or private networks can lower minPeers and drop the network size estimate,
+// which needs enough lookups to be computed.
+//
+// Defaults to the bucket size and requiring the network size estimate.
+func ReadinessCriteria(minPeers int, requireNetsize bool) Option {
+	return func(c *dhtcfg.Config) error {
+		if minPeers < 0 {
+			return fmt.Errorf("readiness minimum number of peers must not be negative")
+		}
+		c.Readiness.MinPeers = minPeers
+		c.Readiness.RequireNetsize = requireNetsize
+		return nil
+	}
+}
+
+// DeferProvidesUntilReady defers the provides made before the DHT is ready, see ReadinessCriteria, rather than
+// sending the provider records to the few peers of a barely populated routing table, which a peer connecting early
+// could dominate. Provide stores the record locally and returns right away, and the deferred keys are provided in the
+// background as soon as the DHT becomes ready. Deferred provides are kept in memory, at most 16384 of them, past
+// which Provide fails with ErrTooManyDeferredProvides.
+//
+// Disabled by default.
+func DeferProvidesUntilReady() Option {
+	return func(c *dhtcfg.Config) error {
+		c.DeferProvides = true
+		return nil
+	}
+}
+
+// ProviderAddrTTL sets how long the addresses of providers learned from provider records, i.e. claimed by third
+// parties, are kept in the peerstore: unverified claims are kept for unverified, and the addresses of the providers we
+// were connected to, e.g. once dialed successfully, are kept for verified after disconnecting. The addresses of the
+// providers that were never verified and aren't otherwise used are cleared from the peerstore once their claims
+// expire, so that stale or bogus claims don't pollute it.
+//
+// Disabled by default, all claimed addresses are kept for peerstore.TempAddrTTL.
+func ProviderAddrTTL(unverified, verified time.Duration) Option {
+	return func(c *dhtcfg.Config) error {
+		if unverified <= 0 {
+			return fmt.Errorf("unverified provider address TTL must be positive")
+		}
+		if verified < unverified {
+			return fmt.Errorf("verified provider address TTL must not be shorter than the unverified one")
+		}
+		c.ProviderAddrTTL.Unverified = unverified
+		c.ProviderAddrTTL.Verified = verified
+		return nil
+	}
+}
+
+// LoadSheddingThresholds are the levels of resource usage from which the node is under pressure, see LoadShedding.
+type LoadSheddingThresholds = dhtcfg.LoadSheddingThresholds
+
+// LoadShedding protects servers during request floods: once the requests being handled, the goroutines or the CPU
+// usage exceed their thresholds, inbound requests are rejected with busy responses, lowest priority first. Provider
+// lookups for keys we aren't among the closest peers of are shed first, then other lookups of provider records and
+// values, then stores, and finally FIND_NODE requests as the pressure grows; pings are always answered. Peers
+// rejecting requests with busy responses fail them with ErrBusy, and aren't removed from the routing table for it.
+//
+// Disabled by default.
+func LoadShedding(thresholds LoadSheddingThresholds) Option {
+	return func(c *dhtcfg.Config) error {
+		t := thresholds
+		if t.Inflight < 0 || t.Goroutines < 0 || t.CPU < 0 {
+			return fmt.Errorf("load shedding thresholds must not be negative")
+		}
+		if t.Inflight == 0 && t.Goroutines == 0 && t.CPU == 0 {
+			return fmt.Errorf("load shedding needs at least one threshold")
+		}
+		c.LoadShedding.Enabled = true
+		c.LoadShedding.Thresholds = t
+		return nil
+	}
+}
+
+// RequestPrioritization handles at most concurrency inbound requests at a time, and hands the free slots to the
+// waiting requests for the keys closest to our ID first: we are responsible for the records of those keys, and less
+// authoritative for far keys. Requests without a key, e.g. pings, go first.
+//
+// Disabled by default.
+func RequestPrioritization(concurrency int) Option {
+	return func(c *dhtcfg.Config) error {
+		if concurrency <= 0 {
+			return fmt.Errorf("request concurrency must be positive")
+		}
+		c.RequestPrioritization.Concurrency = concurrency
+		return nil
+	}
+}
+
+// TenantQuota bounds the provides and lookups of a tenant, see TenantQuotas.
+type TenantQuota = dhtcfg.TenantQuota
+
+// TenantQuotas limits the provides and lookups of every tenant of a multi-tenant node, so that the bulk reprovide of
+// one tenant can't starve the others. Callers label operations with their tenant using WithTenant; tenants without a
+// quota of their own get defaultQuota, and unlabeled operations are not limited. Provides include PutValue, lookups
+// all closest peers, peer, provider and value lookups. Operations exceeding their quota fail with a
+// *QuotaExceededError.
+//
+// Disabled by default.
+func TenantQuotas(quotas map[string]TenantQuota, defaultQuota TenantQuota) Option {
+	return func(c *dhtcfg.Config) error {
+		for tenant, q := range quotas {
+			if err := validateTenantQuota(q); err != nil {
+				return fmt.Errorf("quota of tenant %q: %w", tenant, err)
+			}
+		}
+		if err := validateTenantQuota(defaultQuota); err != nil {
+			return fmt.Errorf("default quota: %w", err)
+		}
+		c.TenantQuotas.Enabled = true
+		c.TenantQuotas.Quotas = quotas
+		c.TenantQuotas.Default = defaultQuota
+		return nil
+	}
+}
+
+func validateTenantQuota(q TenantQuota) error {
+	if q.ProvideRate < 0 || q.LookupRate < 0 {
+		return fmt.Errorf("rates must not be negative")
+	}
+	if (q.ProvideRate > 0 && q.ProvideBurst <= 0) || (q.LookupRate > 0 && q.LookupBurst <= 0) {
+		return fmt.Errorf("bursts of limited rates must be positive")
+	}
+	return nil
+}
+
+// LowPowerMode defers expensive background work, such as gathering the netsize data needed by special provides and
+// attack detection, until the device reports being charging and on an unmetered network via
+// IpfsDHT.PowerStateChanged. Until then, the device is assumed to be constrained and the work is skipped.
+//
+// Disabled by default, see also MobileProfile.
+func LowPowerMode() Option {
+	return func(c *dhtcfg.Config) error {
+		c.LowPower = true
+		return nil
+	}
+}
+
+// MobileProfile configures the DHT for mobile and other battery powered devices: it runs as a client only, queries
+// fewer peers concurrently, refreshes its routing table hourly, provides one key every few seconds by routing the
+// provides of Provide through the provide queue (see EnableProvideQueue and QueueProvides), and runs in LowPowerMode. Options passed after it override
+// individual settings of the profile.
+func MobileProfile() Option {
+	return func(c *dhtcfg.Config) error {
+		c.Mode = ModeClient
+		c.Concurrency = mobileConcurrency
+		c.RoutingTable.RefreshInterval = mobileRefreshInterval
+		c.ProvideQueue.Enabled = true
+		c.ProvideQueue.Workers = 1
+		c.ProvideQueue.Rate = mobileProvideRate
+		c.ProvideQueue.QueueProvides = true
+		c.LowPower = true
+		return nil
+	}
+}
+
+// QueryBudget bounds the resources of every single lookup, protecting constrained devices from lookups exploding in
+// pathological networks: maxRPCs bounds the number of peers queried, including the followup queries to the closest
+// peers, maxDials the number of peers dialed, and maxPeers the number of new peers discovered. A lookup running out of
+// any of its budgets returns the best results found so far, with LookupStats.BudgetExhausted set. Region
+// enumerations, see CPLLookupBudget, apply the budget to each of their lookups. Zero values are unlimited.
+//
+// Unlimited by default.
+func QueryBudget(maxRPCs, maxDials, maxPeers int) Option {
+	return func(c *dhtcfg.Config) error {
+		if maxRPCs < 0 || maxDials < 0 || maxPeers < 0 {
+			return fmt.Errorf("query budgets must not be negative")
+		}
+		c.QueryBudget.MaxRPCs = maxRPCs
+		c.QueryBudget.MaxDials = maxDials
+		c.QueryBudget.MaxPeers = maxPeers
+		return nil
+	}
+}
+
+// DialBackoff configures how long lookups skip peers that failed to dial instead of dialing them again. A peer is
+// backed off for base after its first failed dial, and for twice as long after every further consecutive failure, up
+// to max. Failures are forgotten once the peer dialed successfully or hasn't failed for max.
+//
+// The swarm already backs off dialing the addresses that failed, but only for a few seconds to minutes, and a lookup
+// dialing a backed off peer still spends one of its concurrent query slots on the failing dial. The backoff of
+// DialBackoff instead excludes the peer from lookups altogether and, with a large enough max, keeps unreachable peers
+// out of lookups for far longer. Setting base to zero disables the backoff.
+//
+// Disabled by default.
+func DialBackoff(base, max time.Duration) Option {
+	return func(c *dhtcfg.Config) error {
+		if base < 0 || max < 0 {
+			return fmt.Errorf("dial backoffs must not be negative")
+		}
+		if base > max {
+			return fmt.Errorf("base dial backoff %s exceeds maximum %s", base, max)
+		}
+		c.DialBackoff.Base = base
+		c.DialBackoff.Max = max
+		return nil
+	}
+}
+
+// EclipseDetectionKeyspace sets the keyspace, i.e. the hash function and key length, the eclipse detector analyses
+// the common prefix lengths of the closest peers in. This must match the keyspace the DHT places keys and peers in,
+// e.g. when running with double hashing or with test keyspaces with short keys.
+//
+// The default is detection.SHA256Keyspace.
+func EclipseDetectionKeyspace(ks detection.Keyspace) Option {
+	return func(c *dhtcfg.Config) error {
+		if ks == nil || ks.Bits() <= 0 || ks.Bits()%8 != 0 {
+			return fmt.Errorf("invalid detection keyspace, its length must be a positive multiple of 8 bits")
+		}
+		c.DetectionKeyspace = ks
+		return nil
+	}
+}
+
+// EclipseDetectionTest selects the statistical test of the prefix lengths of the closest peers the verdict of the
+// eclipse detector is based on: detection.TestKL compares their KL divergence from the ideal distribution to a
+// threshold derived from the network size, which is noisy on the few peers analysed, while detection.TestChiSquare and
+// detection.TestKS reject the ideal distribution at the given significance level. Every test is run regardless and
+// reported in the EclipseReport, see IpfsDHT.EclipseDetectionReport, for comparison.
+//
+// The default is detection.TestKL, and a significance of detection.DefaultSignificance.
+func EclipseDetectionTest(test detection.Test, significance float64) Option {
+	return func(c *dhtcfg.Config) error {
+		switch test {
+		case detection.TestKL, detection.TestChiSquare, detection.TestKS:
+		default:
+			return fmt.Errorf("unknown detection test %s", test)
+		}
+		if significance <= 0 || significance >= 1 {
+			return fmt.Errorf("detection significance must be in (0, 1)")
+		}
+		c.DetectionTest.Test = test
+		c.DetectionTest.Significance = significance
+		return nil
+	}
+}
+
+// BayesianDetectionParams configure the Bayesian eclipse detector, see BayesianEclipseDetection.
+type BayesianDetectionParams = dhtcfg.BayesianDetectionParams
+
+// DefaultBayesianDetectionParams start keys at a 1% probability of attack, detect attacks from 90%, and halve the
+// weight of observations every day. The verdicts of the detector are taken to catch 80% of attacks with 10% false
+// positives, those of the auditor 90% with 5%.
+var DefaultBayesianDetectionParams = BayesianDetectionParams{
+	Prior:     0.01,
+	Threshold: 0.9,
+	HalfLife:  24 * time.Hour,
+	Detector:  detection.Likelihood{TruePositive: 0.8, FalsePositive: 0.1},
+	Auditor:   detection.Likelihood{TruePositive: 0.9, FalsePositive: 0.05},
+}
+
+// BayesianEclipseDetection replaces the single-shot verdicts of the eclipse detector with per key posterior
+// probabilities of attack, updated with every detection run on a key, e.g. by repeated lookups and provides, and
+// every audit of it, see TrustedAuditor. An attack is only detected and reported to the DetectionAggregator once the
+// posterior of the key reaches the threshold, so that one unlucky sample of an honest key doesn't raise an alarm.
+// Priors of individual keys are set with IpfsDHT.SetAttackPrior.
+//
+// Disabled by default, see DefaultBayesianDetectionParams.
+func BayesianEclipseDetection(params BayesianDetectionParams) Option {
+	return func(c *dhtcfg.Config) error {
+		if _, err := detection.NewBayesianDetector(params.Prior, params.Threshold, params.HalfLife); err != nil {
+			return err
+		}
+		if err := params.Detector.Validate(); err != nil {
+			return fmt.Errorf("detector %w", err)
+		}
+		if err := params.Auditor.Validate(); err != nil {
+			return fmt.Errorf("auditor %w", err)
+		}
+		c.BayesianDetection.Enabled = true
+		c.BayesianDetection.Params = params
+		return nil
+	}
+}
+
+// AsyncEclipseDetection runs the eclipse detection of Provide and ProvideWithReturn in the background once the provider
+// records are sent, instead of before the provide returns, keeping the network size estimation and the sampling
+// lookup of the detection off the critical path of provides. Its outcome is reported as an EvtEclipseDetection event,
+// see IpfsDHT.EclipseDetectionEvents, and to the DetectionAggregator. It has no effect with StrictEclipseDetection.
+// A few detections run at a time, and once a bounded backlog of waiting detections is full, the detection of further
+// provides is skipped with ErrEclipseDetectionBacklog. Close cancels the detections still running and waits for them.
+//
+// Disabled by default.
+func AsyncEclipseDetection() Option {
+	return func(c *dhtcfg.Config) error {
+		c.AsyncProvideDetection = true
+		return nil
+	}
+}
+
+// StrictEclipseDetection makes Provide and ProvideWithReturn fail with the error of their eclipse detection, e.g. when
+// too few peers were found or the network size could not be estimated, although the provider records were sent.
+// Otherwise the error is only reported as an EvtEclipseDetection event, see IpfsDHT.EclipseDetectionEvents.
+//
+// Disabled by default.
+func StrictEclipseDetection() Option {
+	return func(c *dhtcfg.Config) error {
+		c.StrictProvideDetection = true
+		return nil
+	}
+}
+
+// CrossCheckThreshold sets the relative symmetric difference between the results of a regular lookup and a lookup
+// from independent seeds above which CrossCheckClosestPeers flags a key as possibly under attack.
+//
+// The default is 0.5.
+func CrossCheckThreshold(threshold float64) Option {
+	return func(c *dhtcfg.Config) error {
+		if threshold < 0 || threshold > 1 {
+			return fmt.Errorf("cross-check threshold must be in [0, 1], got %f", threshold)
+		}
+		c.CrossCheck.Threshold = threshold
+		return nil
+	}
+}
+
+// CrossCheckSeeds configures trusted peers used to seed the independent lookup of CrossCheckClosestPeers instead of
+// a random subset of the routing table. The addresses of the peers must be known to the peerstore.
+func CrossCheckSeeds(seeds ...peer.ID) Option {
+	return func(c *dhtcfg.Config) error {
+		c.CrossCheck.Seeds = seeds
+		return nil
+	}
+}
+
+// TrustedAuditor configures an external auditor providing ground-truth closest peers, e.g. from crawling the network,
+// that AuditClosestPeers checks lookups against. Keys whose lookup results differ from the ground truth by a relative
+// symmetric difference above threshold are reported as possibly under attack.
+//
+// Defaults to NullAuditor, which disables audits, and a threshold of 0.5.
+func TrustedAuditor(auditor ClosestPeersAuditor, threshold float64) Option {
+	return func(c *dhtcfg.Config) error {
+		if threshold < 0 || threshold > 1 {
+			return fmt.Errorf("audit threshold must be in [0, 1], got %f", threshold)
+		}
+		c.Audit.Auditor = auditor
+		c.Audit.Threshold = threshold
+		return nil
+	}
+}
+
+// IndependentVantages verifies that provided records are retrievable from vantage points that don't depend on our
+// routing table, e.g. remote probe peers (NewProbePeerVantage) or a second local client-only DHT with a routing table
+// of its own (NewDHTVantage). Every key provided is looked up from each vantage point after delay; keys that some
+// vantage points can't find this node as a provider of are reported as possibly under attack, which detects eclipses
+// that local lookups can't see because our own routing table is poisoned.
+//
+// Disabled by default.
+func IndependentVantages(delay time.Duration, vantages ...ProviderVantage) Option {
+	return func(c *dhtcfg.Config) error {
+		if delay < 0 {
+			return fmt.Errorf("vantage verification delay must not be negative")
+		}
+		c.Vantages.Vantages = vantages
+		c.Vantages.Delay = delay
+		return nil
+	}
+}
+
+// EnableProviderSubscriptions enables the experimental provider subscription protocol extension, see
+// IpfsDHT.SubscribeProviders. When acting as a server, the DHT accepts at most maxTotal subscriptions overall and
+// at most maxPerPeer subscriptions from any single peer.
+//
+// Subscriptions are disabled by default.
+func EnableProviderSubscriptions(maxTotal, maxPerPeer int) Option {
+	return func(c *dhtcfg.Config) error {
+		if maxTotal <= 0 || maxPerPeer <= 0 {
+			return fmt.Errorf("provider subscription caps must be positive")
+		}
+		c.ProviderSubscriptions.Enabled = true
+		c.ProviderSubscriptions.MaxTotal = maxTotal
+		c.ProviderSubscriptions.MaxPerPeer = maxPerPeer
+		return nil
+	}
+}
+
 // MaxRecordAge specifies the maximum time that any node will hold onto a record ("PutValue record")
 // from the time its received. This does not apply to any other forms of validity that
 // the record may contain.
@@ -202,11 +955,198 @@ func Resiliency(beta int) Option {
 // it must be rebroadcasted more frequently than once every 'MaxRecordAge'
 func MaxRecordAge(maxAge time.Duration) Option {
 	return func(c *dhtcfg.Config) error {
+		if maxAge <= 0 {
+			return fmt.Errorf("max record age must be positive")
+		}
 		c.MaxRecordAge = maxAge
 		return nil
 	}
 }
 
+// MaxRecordClockSkew configures how far in the future the receive time of a stored record may lie before the record
+// is considered bad and dropped. A small tolerance protects against clock adjustments and records imported from a
+// datastore written by another host, while far-future timestamps, which would otherwise keep a record alive beyond
+// MaxRecordAge, are rejected.
+//
+// Defaults to 5 minutes.
+func MaxRecordClockSkew(skew time.Duration) Option {
+	return func(c *dhtcfg.Config) error {
+		if skew < 0 {
+			return fmt.Errorf("max record clock skew must not be negative")
+		}
+		c.MaxRecordClockSkew = skew
+		return nil
+	}
+}
+
+// RecordProvideTargets persists, for every provided key, the peers the provider record was sent to in the datastore
+// and keeps them for the given retention window. They are returned by IpfsDHT.GetProvideTargets and allow auditing
+// exactly the peers that are supposed to store a provider record.
+//
+// Disabled by default.
+func RecordProvideTargets(retention time.Duration) Option {
+	return func(c *dhtcfg.Config) error {
+		if retention <= 0 {
+			return fmt.Errorf("provide targets retention must be positive")
+		}
+		c.ProvideTargetsRetention = retention
+		return nil
+	}
+}
+
+// RecordProviderAudit persists, for every provider record stored by this node as a server, which peer submitted it and
+// when, and keeps them for the given retention window. They are returned by IpfsDHT.ProviderAudit and
+// IpfsDHT.ProviderAuditFrom, allowing operators to trace where poisoned provider records came from.
+//
+// Disabled by default.
+func RecordProviderAudit(retention time.Duration) Option {
+	return func(c *dhtcfg.Config) error {
+		if retention <= 0 {
+			return fmt.Errorf("provider audit retention must be positive")
+		}
+		c.ProviderAuditRetention = retention
+		return nil
+	}
+}
+
+// MinProvideTargetGroups requires the closest peers a provider record is sent to to span at least n distinct IP
+// groups: /16 prefixes for IPv4 and /32 for IPv6 addresses. Provides whose closest peers are concentrated in fewer
+// groups, hinting at an eclipse by a party controlling a few address ranges, are escalated to the special strategy
+// sending the provider record to the whole keyspace region around the key. This applies to Provide and
+// ProvideWithReturn.
+//
+// Disabled by default.
+func MinProvideTargetGroups(n int) Option {
+	return func(c *dhtcfg.Config) error {
+		if n < 1 {
+			return fmt.Errorf("minimum provide target groups must be positive")
+		}
+		c.MinProvideTargetGroups = n
+		return nil
+	}
+}
+
+// StrictValueCorroboration only lets GetValue and SearchValue emit the best value found once peers spanning at least n
+// distinct IP groups returned it: /16 prefixes for IPv4 and /32 for IPv6 addresses, the local record counting as a
+// group of its own. A value returned by peers concentrated in fewer groups, possibly controlled by a single party, is
+// withheld, GetValue failing with routing.ErrNotFound if no value is corroborated.
+//
+// Disabled by default.
+func StrictValueCorroboration(n int) Option {
+	return func(c *dhtcfg.Config) error {
+		if n < 1 {
+			return fmt.Errorf("value corroboration groups must be positive")
+		}
+		c.ValueCorroboration = n
+		return nil
+	}
+}
+
+// DiverseProviderCloserPeers limits the closer peers this node sends back with the providers of a key to n peers per
+// IP group: /16 prefixes for IPv4 and /32 for IPv6 addresses. The closest peers of the routing table beyond the limit
+// are replaced with the next closest peers of other groups, so that a party controlling a few address ranges can't use
+// this node to steer the lookups of others towards its peers.
+//
+// Disabled by default, as the responses then differ from the closest peers the other nodes expect.
+func DiverseProviderCloserPeers(n int) Option {
+	return func(c *dhtcfg.Config) error {
+		if n < 1 {
+			return fmt.Errorf("closer peers per IP group must be positive")
+		}
+		c.CloserPeersPerGroup = n
+		return nil
+	}
+}
+
+// ResolveProviderAddrs makes FindProviders and its variants resolve the addresses of the providers found without any
+// address we know of, e.g. because their provider records expired from our peerstore or were stored without
+// addresses, with FindPeer lookups before returning them. At most concurrency lookups run at a time per search, each
+// bounded by timeout. Providers whose addresses can't be resolved are returned without addresses.
+//
+// Disabled by default.
+func ResolveProviderAddrs(concurrency int, timeout time.Duration) Option {
+	return func(c *dhtcfg.Config) error {
+		if concurrency < 1 {
+			return fmt.Errorf("provider address resolution concurrency must be positive")
+		}
+		if timeout <= 0 {
+			return fmt.Errorf("provider address resolution timeout must be positive")
+		}
+		c.ProviderResolve.Enabled = true
+		c.ProviderResolve.Concurrency = concurrency
+		c.ProviderResolve.Timeout = timeout
+		return nil
+	}
+}
+
+// EnableProvideQueue enables IpfsDHT.EnqueueProvide. Enqueued keys are persisted in the datastore and provided in the
+// background by the given number of workers, at most rate provides per second overall (0 is unlimited). The workers
+// provide concurrently, queued provides don't wait for those run by Provide. Failed provides are retried, see
+// ProvideQueueRetries, and keys still queued on shutdown are provided after the next start.
+//
+// Disabled by default.
+func EnableProvideQueue(workers int, rate float64) Option {
+	return func(c *dhtcfg.Config) error {
+		if workers <= 0 {
+			return fmt.Errorf("provide queue workers must be positive")
+		}
+		if rate < 0 {
+			return fmt.Errorf("provide queue rate must not be negative")
+		}
+		c.ProvideQueue.Enabled = true
+		c.ProvideQueue.Workers = workers
+		c.ProvideQueue.Rate = rate
+		return nil
+	}
+}
+
+// QueueProvides makes Provide enqueue the keys it is asked to announce, see IpfsDHT.EnqueueProvide, and return once
+// they are persisted, so that bursts of provides are paced by the provide queue instead of running all at once. The
+// outcome of the provides is no longer reported to the caller of Provide. It requires EnableProvideQueue.
+//
+// Disabled by default.
+func QueueProvides() Option {
+	return func(c *dhtcfg.Config) error {
+		c.ProvideQueue.QueueProvides = true
+		return nil
+	}
+}
+
+// ProvideQueueRetries configures how often a queued provide is attempted before it is given up, and the backoff
+// before the first retry, which doubles with every further attempt.
+//
+// Defaults to 10 attempts and a 1 minute backoff.
+func ProvideQueueRetries(maxAttempts int, backoff time.Duration) Option {
+	return func(c *dhtcfg.Config) error {
+		if maxAttempts <= 0 {
+			return fmt.Errorf("provide queue attempts must be positive")
+		}
+		if backoff <= 0 {
+			return fmt.Errorf("provide queue backoff must be positive")
+		}
+		c.ProvideQueue.MaxAttempts = maxAttempts
+		c.ProvideQueue.RetryBackoff = backoff
+		return nil
+	}
+}
+
+// PartitionProvideQueue partitions the keys of the provide queue by the first prefixBits bits (1 to 16) of their
+// Kademlia key. Each worker of the queue provides a batch of keys of a single partition at a time, and the lookups of
+// a partition start from the closest peers found by its previous lookup. Consecutive provides of a region thus reuse
+// warm routing paths and connections, which speeds up the ingestion of large numbers of keys. A partition is provided
+// by at most one worker at a time, so there should be more partitions than workers.
+//
+// Disabled by default.
+func PartitionProvideQueue(prefixBits int) Option {
+	return func(c *dhtcfg.Config) error {
+		if prefixBits < 1 || prefixBits > 16 {
+			return fmt.Errorf("provide queue partition bits must be between 1 and 16")
+		}
+		c.ProvideQueue.PartitionBits = prefixBits
+		return nil
+	}
+}
+
 // DisableAutoRefresh completely disables 'auto-refresh' on the DHT routing
 // table. This means that we will neither refresh the routing table periodically
 // nor when the routing table size goes below the minimum threshold.
@@ -244,6 +1184,34 @@ func DisableValues() Option {
 	}
 }
 
+// ValueKeyPolicy restricts storing and retrieving value records to the keys policy returns true for, both for
+// requests from other peers and for local calls, which fail with routing.ErrNotSupported for other keys. See
+// ValueNamespaces to enable only some namespaces.
+//
+// Defaults to all keys. Has no effect if values are disabled.
+func ValueKeyPolicy(policy KeyPolicy) Option {
+	return func(c *dhtcfg.Config) error {
+		c.ValuePolicy = policy
+		return nil
+	}
+}
+
+// ValueNamespaces restricts storing and retrieving value records to the given namespaces, e.g. "pk" and "ipns".
+func ValueNamespaces(namespaces ...string) Option {
+	return ValueKeyPolicy(NamespacePolicy(namespaces...))
+}
+
+// ProviderKeyPolicy restricts storing and retrieving provider records to the multihashes policy returns true for,
+// both for requests from other peers and for local calls, which fail with routing.ErrNotSupported for other keys.
+//
+// Defaults to all keys. Has no effect if providers are disabled.
+func ProviderKeyPolicy(policy KeyPolicy) Option {
+	return func(c *dhtcfg.Config) error {
+		c.ProviderPolicy = policy
+		return nil
+	}
+}
+
 // QueryFilter sets a function that approves which peers may be dialed in a query
 func QueryFilter(filter QueryFilterFunc) Option {
 	return func(c *dhtcfg.Config) error {
@@ -252,6 +1220,33 @@ func QueryFilter(filter QueryFilterFunc) Option {
 	}
 }
 
+// WithCandidateFilter sets a function vetoing the closer peers returned by remote peers during lookups, before they
+// enter the lookup. It is called with the peer that returned the candidate and the candidate with the addresses it was
+// returned with, and can be used to drop candidates from denylisted keyspace prefixes or with suspicious address
+// patterns mid-query. Unlike QueryFilter, it applies to the target of FindPeer as well.
+func WithCandidateFilter(filter CandidateFilterFunc) Option {
+	return func(c *dhtcfg.Config) error {
+		c.CandidateFilter = filter
+		return nil
+	}
+}
+
+// ProviderAcceptPolicy sets a function that decides which provider records received in ADD_PROVIDER requests are
+// stored. It is called with the peer the request came from, the key and the provider the record is for, and can be
+// used to refuse records registered by third parties on behalf of a provider, which otherwise allow planting records
+// through intermediaries, or to apply a custom policy.
+//
+// Defaults to OriginatorProviderPolicy.
+func ProviderAcceptPolicy(policy ProviderAcceptFunc) Option {
+	return func(c *dhtcfg.Config) error {
+		if policy == nil {
+			return fmt.Errorf("provider accept policy must not be nil")
+		}
+		c.ProviderAcceptPolicy = policy
+		return nil
+	}
+}
+
 // RoutingTableFilter sets a function that approves which peers may be added to the routing table. The host should
 // already have at least one connection to the peer under consideration.
 func RoutingTableFilter(filter RouteTableFilterFunc) Option {
@@ -291,6 +1286,182 @@ func RoutingTablePeerDiversityFilter(pg peerdiversity.PeerIPGroupFilter) Option
 	}
 }
 
+// RoutingTableAdmissionPolicy sets the policy deciding whether a new peer may be added to the routing table, see
+// AdmitAllPolicy, NewIPDiversityPolicy and NewFirstSeenPolicy. Peers already in the routing table are not affected.
+//
+// Defaults to admitting all peers.
+func RoutingTableAdmissionPolicy(policy AdmissionPolicy) Option {
+	return func(c *dhtcfg.Config) error {
+		c.RoutingTable.AdmissionPolicy = policy
+		return nil
+	}
+}
+
+// BehaviorEviction evicts routing table peers that repeatedly return suspicious closer peers, i.e. sets dominated by
+// denylisted peers (see PeerDenylist) or by peers from a single IP group. A peer is evicted once at least
+// evictThreshold of its recent responses, and no less than minEvidence responses, were suspicious. It is kept out of
+// the routing table until the fraction of suspicious responses, which keeps being tracked when the peer is queried in
+// lookups, drops below recoverThreshold. Evictions are announced with an EvtRoutingTablePeerEvicted event on the
+// host's event bus.
+//
+// The evidence is only what the DHT observes in the responses to its own queries, kept per peer over its most recent
+// responses; it doesn't take input from other peer scoring. The resulting per-peer reputation is exposed through
+// IpfsDHT.PeerReputation.
+//
+// Disabled by default.
+func BehaviorEviction(minEvidence int, evictThreshold, recoverThreshold float64) Option {
+	return func(c *dhtcfg.Config) error {
+		if minEvidence <= 0 || minEvidence > behaviorWindow {
+			return fmt.Errorf("minimum evidence must be between 1 and %d", behaviorWindow)
+		}
+		if evictThreshold <= 0 || evictThreshold > 1 || recoverThreshold < 0 || recoverThreshold >= evictThreshold {
+			return fmt.Errorf("thresholds must satisfy 0 <= recover < evict <= 1")
+		}
+		c.RoutingTable.BehaviorEviction.Enabled = true
+		c.RoutingTable.BehaviorEviction.MinEvidence = minEvidence
+		c.RoutingTable.BehaviorEviction.EvictThreshold = evictThreshold
+		c.RoutingTable.BehaviorEviction.RecoverThreshold = recoverThreshold
+		return nil
+	}
+}
+
+// PeerDenylist marks peers as known to be malicious. Routing table peers returning closer peer sets dominated by
+// denylisted peers are evicted if BehaviorEviction is enabled.
+func PeerDenylist(peers ...peer.ID) Option {
+	return func(c *dhtcfg.Config) error {
+		c.Denylist = append(c.Denylist, peers...)
+		return nil
+	}
+}
+
+// CloserPeerValidation checks that the closer peers returned during lookups actually lead towards the target.
+// Kademlia peers return the peers closest to the target they know, which share about as many leading bits with the
+// target as the responder itself, or as the k closest peers of the network if the responder is closer than that. A
+// returned peer sharing more than slack bits less with the target is irrelevant to the lookup and discarded. Responses
+// dominated by irrelevant peers, a common routing-pollution tactic, count as suspicious responses towards
+// BehaviorEviction.
+//
+// Disabled by default.
+func CloserPeerValidation(slack int) Option {
+	return func(c *dhtcfg.Config) error {
+		if slack < 0 {
+			return fmt.Errorf("slack must not be negative")
+		}
+		c.CloserPeerValidation.Enabled = true
+		c.CloserPeerValidation.Slack = slack
+		return nil
+	}
+}
+
+// BlackholeDetection detects the DHT falling into a blackhole: threshold consecutive lookups failing because they had
+// no peer to start from, none of the queried peers answered, or none of them returned any peer. If lookups of all keys
+// fail, the local node has likely lost connectivity; if only lookups of some keyspace regions fail while the others
+// succeed, these regions may be censored. Changes of the status are emitted as EvtBlackholeStatusChanged events, see
+// IpfsDHT.BlackholeEvents.
+//
+// Disabled by default.
+func BlackholeDetection(threshold int) Option {
+	return func(c *dhtcfg.Config) error {
+		if threshold <= 0 {
+			return fmt.Errorf("blackhole threshold must be positive, got %d", threshold)
+		}
+		c.BlackholeThreshold = threshold
+		return nil
+	}
+}
+
+// ReprovideOnChurn watches the closest peers to the keys this node provided: every interval, their closest peers are
+// looked up again and the provider record is sent to the peers that joined them since the provide, e.g. because of
+// churn or an attack, instead of waiting for the next reprovide. At most rate keys per second are checked. Keys stop
+// being watched once their provider records expire.
+//
+// Disabled by default.
+func ReprovideOnChurn(interval time.Duration, rate float64) Option {
+	return func(c *dhtcfg.Config) error {
+		if interval <= 0 {
+			return fmt.Errorf("churn reprovide interval must be positive")
+		}
+		if rate <= 0 {
+			return fmt.Errorf("churn reprovide rate must be positive")
+		}
+		c.ChurnReprovide.Enabled = true
+		c.ChurnReprovide.Interval = interval
+		c.ChurnReprovide.Rate = rate
+		return nil
+	}
+}
+
+// WatchClosestPeers enables IpfsDHT.WatchKey. The closest peers of the watched keys are looked up every interval and
+// the last history snapshots are kept per key, see IpfsDHT.ClosestPeersSnapshots and DiffClosestPeers. When the
+// closest peers of a key churn by more than threshold between two snapshots, relative to their union, an
+// EvtClosestPeersChurn event is emitted, see IpfsDHT.ClosestPeersChurnEvents, and the key is reported to the
+// DetectionAggregator as possibly under attack.
+//
+// Disabled by default.
+func WatchClosestPeers(interval time.Duration, history int, threshold float64) Option {
+	return func(c *dhtcfg.Config) error {
+		if interval <= 0 {
+			return fmt.Errorf("closest peers watch interval must be positive")
+		}
+		if history < 2 {
+			return fmt.Errorf("closest peers watch history must keep at least 2 snapshots, got %d", history)
+		}
+		if threshold < 0 || threshold > 1 {
+			return fmt.Errorf("closest peers churn threshold must be between 0 and 1, got %f", threshold)
+		}
+		c.ClosestPeersWatch.Enabled = true
+		c.ClosestPeersWatch.Interval = interval
+		c.ClosestPeersWatch.History = history
+		c.ClosestPeersWatch.ChurnThreshold = threshold
+		return nil
+	}
+}
+
+// DeduplicateLookups coalesces concurrent FindProviders and GetValue lookups of the same key into a single lookup
+// whose results are fanned out to all callers, e.g. for gateways receiving many requests for the same hot content.
+// The count of providers and the quorum of values are applied per caller, and the shared lookup only stops once no
+// caller needs more results. Lookups whose caller subscribed to query or lookup events are never shared.
+//
+// Disabled by default.
+func DeduplicateLookups() Option {
+	return func(c *dhtcfg.Config) error {
+		c.DeduplicateLookups = true
+		return nil
+	}
+}
+
+// ServeDetectorHints enables the experimental detector hints protocol extension as a server: GET_PROVIDERS responses
+// to clients asking for it include our estimate of the distribution of the prefix lengths of the closest peers to the
+// key, derived from our network size estimate. See RequestDetectorHints.
+//
+// Disabled by default.
+func ServeDetectorHints() Option {
+	return func(c *dhtcfg.Config) error {
+		c.DetectorHints.Serve = true
+		return nil
+	}
+}
+
+// RequestDetectorHints enables the experimental detector hints protocol extension as a client: provider lookups ask
+// the peers they query for detector hints, see ServeDetectorHints, and use the network size estimates of the hints
+// as additional evidence that the closest peers found for the key are eclipsed.
+//
+// A hint is only accepted if its distribution is the one expected for its network size, and that network size is
+// within a factor of tolerance of our own estimate, so that a malicious server can't skew the evidence by more than
+// that factor. Hints are ignored while we have no network size estimate of our own.
+//
+// Disabled by default.
+func RequestDetectorHints(tolerance float64) Option {
+	return func(c *dhtcfg.Config) error {
+		if tolerance <= 1 {
+			return fmt.Errorf("detector hint tolerance must be greater than 1, got %f", tolerance)
+		}
+		c.DetectorHints.Request = true
+		c.DetectorHints.Tolerance = tolerance
+		return nil
+	}
+}
+
 // disableFixLowPeersRoutine disables the "fixLowPeers" routine in the DHT.
 // This is ONLY for tests.
 func disableFixLowPeersRoutine(t *testing.T) Option {
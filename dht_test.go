@@ -3,7 +3,9 @@ package dht
 import (
 	"bytes"
 	"context"
+	crand "crypto/rand"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"math/rand"
@@ -11,9 +13,11 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/event"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
@@ -27,15 +31,25 @@ import (
 	"github.com/stretchr/testify/require"
 
 	test "github.com/libp2p/go-libp2p-kad-dht/internal/testing"
+	"github.com/libp2p/go-libp2p-kad-dht/netsize"
 	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	"github.com/libp2p/go-libp2p-kad-dht/providers"
 
+	"github.com/benbjohnson/clock"
+	"github.com/google/uuid"
 	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
 	detectrace "github.com/ipfs/go-detect-race"
 	u "github.com/ipfs/go-ipfs-util"
 	kb "github.com/libp2p/go-libp2p-kbucket"
 	record "github.com/libp2p/go-libp2p-record"
+	helper "github.com/libp2p/go-libp2p-routing-helpers"
 	bhost "github.com/libp2p/go-libp2p/p2p/host/basic"
 	swarmt "github.com/libp2p/go-libp2p/p2p/net/swarm/testing"
+	ks "github.com/whyrusleeping/go-keyspace"
+
+	detection "github.com/ssrivatsan97/go-libp2p-kad-dht/eclipse-detection"
 )
 
 var testCaseCids []cid.Cid
@@ -155,6 +169,17 @@ func setupDHTS(t *testing.T, ctx context.Context, n int, options ...Option) []*I
 	return dhts
 }
 
+// setupConnectedDHTS sets up n DHTs connected to each other.
+func setupConnectedDHTS(t *testing.T, ctx context.Context, n int, options ...Option) []*IpfsDHT {
+	dhts := setupDHTS(t, ctx, n, options...)
+	for i, a := range dhts {
+		for _, b := range dhts[i+1:] {
+			connect(t, ctx, a, b)
+		}
+	}
+	return dhts
+}
+
 func connectNoSync(t *testing.T, ctx context.Context, a, b *IpfsDHT) {
 	t.Helper()
 
@@ -517,6 +542,164 @@ func TestValueGetInvalid(t *testing.T) {
 	testSetGet("valid", "newer", nil)
 }
 
+// misbehavingValidator panics on "panic" and hangs on "hang" records until release is closed.
+type misbehavingValidator struct {
+	release chan struct{}
+}
+
+func (v misbehavingValidator) Validate(_ string, value []byte) error {
+	switch string(value) {
+	case "panic":
+		panic("malformed record")
+	case "hang":
+		<-v.release
+	}
+	return nil
+}
+
+func (v misbehavingValidator) Select(_ string, values [][]byte) (int, error) {
+	for _, value := range values {
+		if err := v.Validate("", value); err != nil {
+			return 0, err
+		}
+	}
+	return 0, nil
+}
+
+func TestValidatorIsolation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	release := make(chan struct{})
+	defer close(release)
+	d := setupDHT(ctx, t, false, NamespacedValidator("m", misbehavingValidator{release: release}), ValidatorTimeout(50*time.Millisecond))
+
+	require.NoError(t, d.validate("/m/key", []byte("valid")))
+	require.ErrorIs(t, d.validate("/m/key", []byte("panic")), ErrValidatorPanic)
+	require.ErrorIs(t, d.validate("/m/key", []byte("hang")), ErrValidatorTimeout)
+	_, err := d.selectValue("/m/key", [][]byte{[]byte("valid"), []byte("panic")})
+	require.ErrorIs(t, err, ErrValidatorPanic)
+	_, err = d.selectValue("/m/key", [][]byte{[]byte("hang")})
+	require.ErrorIs(t, err, ErrValidatorTimeout)
+
+	// the hanging calls keep their slots, records are refused once all are taken
+	require.Len(t, d.validatorCalls, 2)
+	for len(d.validatorCalls) < cap(d.validatorCalls) {
+		d.validatorCalls <- struct{}{}
+	}
+	require.ErrorIs(t, d.validate("/m/key", []byte("valid")), ErrValidatorBusy)
+	for len(d.validatorCalls) > 2 {
+		<-d.validatorCalls
+	}
+
+	// the offending record is discarded, the lookup goes on
+	vals := make(chan recvdVal, 2)
+	vals <- recvdVal{Val: []byte("valid"), From: "a"}
+	vals <- recvdVal{Val: []byte("panic"), From: "b"}
+	close(vals)
+	best, peers, _ := d.processValues(ctx, "/m/key", vals, func(context.Context, recvdVal, bool) bool { return false })
+	require.Equal(t, []byte("valid"), best)
+	require.Equal(t, map[peer.ID]struct{}{"a": {}}, peers)
+
+	_, err = New(ctx, d.host, ValidatorTimeout(0))
+	require.Error(t, err)
+}
+
+func TestValueReputation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	process := func(d *IpfsDHT, key string, vals ...recvdVal) ([]byte, map[peer.ID]struct{}, []bool) {
+		ch := make(chan recvdVal, len(vals))
+		for _, v := range vals {
+			ch <- v
+		}
+		close(ch)
+		var better []bool
+		best, peers, _ := d.processValues(ctx, key, ch, func(_ context.Context, _ recvdVal, b bool) bool {
+			better = append(better, b)
+			return false
+		})
+		return best, peers, better
+	}
+	a, b := []byte("a"), []byte("b")
+
+	d := setupDHT(ctx, t, false, BehaviorEviction(10, 0.9, 0.5), NamespacedValidator("t", testAtomicPutValidator{}))
+	for i := 0; i < 4; i++ {
+		d.recordBehavior("bad", i%2 == 0)
+	}
+	require.Equal(t, 0.5, d.PeerReputation("bad"))
+	require.Equal(t, 1.0, d.PeerReputation("good"))
+
+	// of equivalent values, the one returned by the peers of highest reputation wins
+	best, peers, _ := process(d, "/v/key", recvdVal{Val: a, From: "bad"}, recvdVal{Val: b, From: "good"})
+	require.Equal(t, b, best)
+	require.Equal(t, map[peer.ID]struct{}{"good": {}}, peers)
+	best, peers, better := process(d, "/v/key", recvdVal{Val: a, From: "bad"}, recvdVal{Val: b, From: "good"},
+		recvdVal{Val: a, From: "other"})
+	require.Equal(t, a, best)
+	require.Equal(t, map[peer.ID]struct{}{"bad": {}, "other": {}}, peers)
+	require.Equal(t, []bool{true, true, true}, better)
+
+	// values the validator prefers aren't outweighed
+	best, _, _ = process(d, "/t/key", recvdVal{Val: b, From: "bad"}, recvdVal{Val: a, From: "good"},
+		recvdVal{Val: a, From: "other"})
+	require.Equal(t, b, best)
+
+	// strict corroboration withholds values until returned from enough IP groups
+	_, err := New(ctx, nil, StrictValueCorroboration(0))
+	require.Error(t, err)
+	d = setupDHT(ctx, t, false, StrictValueCorroboration(2))
+	for p, addr := range map[peer.ID]string{"p1": "/ip4/1.2.3.4/tcp/1", "p2": "/ip4/1.2.9.9/tcp/1", "p3": "/ip4/5.6.7.8/tcp/1"} {
+		d.peerstore.AddAddr(p, ma.StringCast(addr), peerstore.PermanentAddrTTL)
+	}
+	best, _, better = process(d, "/v/key", recvdVal{Val: a, From: "p1"}, recvdVal{Val: a, From: "p2"})
+	require.Nil(t, best)
+	require.Equal(t, []bool{false, false}, better)
+	best, peers, better = process(d, "/v/key", recvdVal{Val: a, From: "p1"}, recvdVal{Val: a, From: "p2"},
+		recvdVal{Val: a, From: "p3"})
+	require.Equal(t, a, best)
+	require.Len(t, peers, 3)
+	require.Equal(t, []bool{false, false, true}, better)
+	best, _, _ = process(d, "/v/key", recvdVal{Val: a, From: d.self}, recvdVal{Val: a, From: "p1"})
+	require.Equal(t, a, best)
+}
+
+func TestProviderAddrTTL(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clk := clock.NewMock()
+	d := setupDHT(ctx, t, false, WithClock(clk), ProviderAddrTTL(time.Minute, time.Hour))
+	prov := setupDHT(ctx, t, false)
+
+	// an unverified claim is cleared once expired, even if the addresses were kept alive meanwhile
+	p := peer.ID("claimed provider")
+	addrs := []ma.Multiaddr{ma.StringCast("/ip4/1.2.3.4/tcp/4001")}
+	d.addProviderAddrs(p, addrs)
+	require.Len(t, d.peerstore.Addrs(p), 1)
+	d.peerstore.AddAddrs(p, addrs, time.Hour)
+
+	// a verified claim survives disconnection
+	d.addProviderAddrs(prov.self, prov.host.Addrs())
+	connectNoSync(t, ctx, d, prov)
+	require.Eventually(t, func() bool {
+		d.providerAddrBook.mu.Lock()
+		defer d.providerAddrBook.mu.Unlock()
+		return d.providerAddrBook.claims[prov.self].verified
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, d.host.Network().ClosePeer(prov.self))
+	d.routingTable.RemovePeer(prov.self)
+
+	clk.Add(2 * time.Minute)
+	d.gcProviderAddrs()
+	require.Empty(t, d.peerstore.Addrs(p))
+	require.NotEmpty(t, d.peerstore.Addrs(prov.self))
+	d.providerAddrBook.mu.Lock()
+	require.Len(t, d.providerAddrBook.claims, 1)
+	d.providerAddrBook.mu.Unlock()
+}
+
 func TestProvides(t *testing.T) {
 	// t.Skip("skipping test to debug another")
 	ctx, cancel := context.WithCancel(context.Background())
@@ -567,6 +750,72 @@ func TestProvides(t *testing.T) {
 	}
 }
 
+func TestAsyncEclipseDetection(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupConnectedDHTS(t, ctx, 3, AsyncEclipseDetection())
+
+	sub, err := dhts[0].EclipseDetectionEvents()
+	require.NoError(t, err)
+	defer sub.Close()
+
+	// the detection can't run with that few peers, but that doesn't fail the provide
+	op := uuid.New()
+	key := testCaseCids[0]
+	require.NoError(t, dhts[0].Provide(WithCorrelationID(ctx, op), key, true))
+
+	select {
+	case e := <-sub.Out():
+		evt := e.(EvtEclipseDetection)
+		require.Equal(t, key.Hash(), evt.Key)
+		require.Equal(t, op, evt.Operation)
+		require.Error(t, evt.Err)
+		require.False(t, evt.Attack)
+	case <-time.After(10 * time.Second):
+		t.Fatal("no eclipse detection event")
+	}
+}
+
+func TestStrictEclipseDetection(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, strict := range []bool{false, true} {
+		var opts []Option
+		if strict {
+			opts = append(opts, StrictEclipseDetection())
+		}
+		dhts := setupConnectedDHTS(t, ctx, 2, opts...)
+
+		sub, err := dhts[0].EclipseDetectionEvents()
+		require.NoError(t, err)
+
+		// the provider record is stored, but there are too few peers to run the detection
+		err = dhts[0].Provide(ctx, testCaseCids[0], true)
+		if strict {
+			require.Error(t, err)
+		} else {
+			require.NoError(t, err)
+		}
+		provs, err := dhts[1].providerStore.GetProviders(ctx, testCaseCids[0].Hash())
+		require.NoError(t, err)
+		require.Len(t, provs, 1)
+
+		select {
+		case e := <-sub.Out():
+			require.Error(t, e.(EvtEclipseDetection).Err)
+		case <-time.After(10 * time.Second):
+			t.Fatal("no eclipse detection event")
+		}
+		sub.Close()
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}
+}
+
 func TestLocalProvides(t *testing.T) {
 	// t.Skip("skipping test to debug another")
 	ctx, cancel := context.WithCancel(context.Background())
@@ -603,6 +852,30 @@ func TestLocalProvides(t *testing.T) {
 	}
 }
 
+func TestMultihashProviders(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	provider := setupDHT(ctx, t, false)
+	client := setupDHT(ctx, t, false)
+	connect(t, ctx, client, provider)
+
+	mh := testCaseCids[0].Hash()
+	require.NoError(t, provider.ProvideMH(ctx, mh, false))
+
+	var provs []peer.AddrInfo
+	for p := range client.FindProvidersAsyncMH(ctx, mh, 1) {
+		provs = append(provs, p)
+	}
+	require.Len(t, provs, 1)
+	require.Equal(t, provider.self, provs[0].ID)
+
+	invalid := multihash.Multihash("not a multihash")
+	require.Error(t, provider.ProvideMH(ctx, invalid, false))
+	_, ok := <-client.FindProvidersAsyncMH(ctx, invalid, 1)
+	require.False(t, ok)
+}
+
 // if minPeers or avgPeers is 0, dont test for it.
 func waitForWellFormedTables(t *testing.T, dhts []*IpfsDHT, minPeers, avgPeers int, timeout time.Duration) {
 	// test "well-formed-ness" (>= minPeers peers in every routing table)
@@ -1120,6 +1393,282 @@ func TestFindPeer(t *testing.T) {
 	}
 }
 
+func TestFindPeerAddressOnly(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 3)
+	connect(t, ctx, dhts[0], dhts[1])
+	connect(t, ctx, dhts[1], dhts[2])
+
+	ctxT, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	target := dhts[2].PeerID()
+	fp, err := dhts[0].FindPeerWithOptions(ctxT, target, AddressOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fp.ID != target {
+		t.Fatal("didn't find expected peer")
+	}
+	if len(fp.Addrs) == 0 {
+		t.Fatal("expected addresses of the peer")
+	}
+	for _, a := range fp.Addrs {
+		srcs := fp.Sources[a.String()]
+		if len(srcs) != 1 || srcs[0] != dhts[1].PeerID() {
+			t.Fatalf("expected %s to be returned by %s, got %v", a, dhts[1].PeerID(), srcs)
+		}
+	}
+	if dhts[0].host.Network().Connectedness(target) == network.Connected {
+		t.Fatal("address-only lookup dialed the peer")
+	}
+}
+
+func TestPeerAddrSources(t *testing.T) {
+	srcs := (&IpfsDHT{clock: clock.NewMock()}).newPeerAddrSources()
+	a1 := ma.StringCast("/ip4/1.2.3.4/tcp/4001")
+	a2 := ma.StringCast("/ip4/1.2.3.4/udp/4001/quic")
+	src, other := peer.ID("src"), peer.ID("other")
+
+	// a source returning an address it already returned must not drop the addresses following it
+	srcs.add(src, []ma.Multiaddr{a1})
+	srcs.add(src, []ma.Multiaddr{a1, a2})
+	srcs.add(other, []ma.Multiaddr{a2})
+
+	res := srcs.result("target")
+	require.Equal(t, []ma.Multiaddr{a2, a1}, res.Addrs)
+	require.Equal(t, []peer.ID{src}, res.Sources[a1.String()])
+	require.Equal(t, []peer.ID{src, other}, res.Sources[a2.String()])
+}
+
+func TestFindPeerProvenance(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 4)
+	connect(t, ctx, dhts[0], dhts[1])
+	connect(t, ctx, dhts[0], dhts[2])
+	connect(t, ctx, dhts[1], dhts[3])
+	connect(t, ctx, dhts[2], dhts[3])
+
+	ctxT, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	target := dhts[3].PeerID()
+	fp, err := dhts[0].FindPeerWithOptions(ctxT, target)
+	require.NoError(t, err)
+	require.Equal(t, target, fp.ID)
+	require.NotEmpty(t, fp.Addrs)
+
+	responders := make(map[peer.ID]bool)
+	for _, a := range fp.Addrs {
+		prov := fp.Provenance[a.String()]
+		require.Len(t, prov, len(fp.Sources[a.String()]))
+		for i, src := range prov {
+			require.False(t, src.Seen.IsZero())
+			if i > 0 {
+				require.False(t, src.Seen.After(prov[i-1].Seen), "provenance not sorted freshest first")
+			}
+			responders[src.Source] = true
+		}
+	}
+	require.True(t, responders[dhts[1].PeerID()] || responders[dhts[2].PeerID()], "no responder recorded as source")
+	require.True(t, responders[dhts[0].PeerID()], "peerstore addresses not recorded")
+
+	// the same source returning an address again only refreshes it
+	srcs := dhts[0].newPeerAddrSources()
+	srcs.add(dhts[1].PeerID(), fp.Addrs[:1])
+	srcs.add(dhts[1].PeerID(), fp.Addrs)
+	res := srcs.result(target)
+	require.Len(t, res.Addrs, len(fp.Addrs))
+	for _, a := range res.Addrs {
+		require.Equal(t, []peer.ID{dhts[1].PeerID()}, res.Sources[a.String()])
+	}
+}
+
+func TestFindProvidersWithOptions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 3)
+	connect(t, ctx, dhts[0], dhts[1])
+
+	// a provider that went offline, and one that is online but not connected to the searcher
+	offline := setupDHT(ctx, t, false)
+	// dials to closed TCP ports fail right away, unlike QUIC handshakes
+	var offlineAddrs []ma.Multiaddr
+	for _, a := range offline.host.Addrs() {
+		if _, err := a.ValueForProtocol(ma.P_TCP); err == nil {
+			offlineAddrs = append(offlineAddrs, a)
+		}
+	}
+	offline.Close()
+	offline.host.Close()
+
+	key := testCaseCids[0]
+	dhts[1].providerStore.AddProvider(ctx, key.Hash(), peer.AddrInfo{ID: offline.self, Addrs: offlineAddrs})
+	dhts[1].providerStore.AddProvider(ctx, key.Hash(), peer.AddrInfo{ID: dhts[2].self, Addrs: dhts[2].host.Addrs()})
+
+	provs, err := dhts[0].FindProvidersWithOptions(ctx, key, 1)
+	require.NoError(t, err)
+	require.Len(t, provs, 1)
+
+	provs, err = dhts[0].FindProvidersWithOptions(ctx, key, 1, KeepSearching())
+	require.NoError(t, err)
+	require.Len(t, provs, 2)
+
+	provs, err = dhts[0].FindProvidersWithOptions(ctx, key, 1, FirstDialableProvider())
+	require.NoError(t, err)
+	require.Len(t, provs, 1)
+	require.Equal(t, dhts[2].self, provs[0].ID)
+
+	// an elapsed search timeout returns the (no) providers found so far instead of an error
+	provs, err = dhts[0].FindProvidersWithOptions(ctx, key, 1, ProviderSearchTimeout(time.Nanosecond))
+	require.NoError(t, err)
+	require.Empty(t, provs)
+
+	// unreachable providers come last, or not at all
+	provs, err = dhts[0].FindProvidersWithOptions(ctx, key, 0, ProviderLivenessCheck(LivenessDial, 2))
+	require.NoError(t, err)
+	require.Len(t, provs, 2)
+	require.Equal(t, dhts[2].self, provs[0].ID)
+	require.Equal(t, offline.self, provs[1].ID)
+
+	provs, err = dhts[0].FindProvidersWithOptions(ctx, key, 0, ProviderLivenessCheck(LivenessDial, 1), DropUnreachableProviders())
+	require.NoError(t, err)
+	require.Len(t, provs, 1)
+	require.Equal(t, dhts[2].self, provs[0].ID)
+
+	// both providers have addresses
+	provs, err = dhts[0].FindProvidersWithOptions(ctx, key, 0, ProviderLivenessCheck(LivenessAddrs, 1), DropUnreachableProviders())
+	require.NoError(t, err)
+	require.Len(t, provs, 2)
+
+	_, err = dhts[0].FindProvidersWithOptions(ctx, key, 0, ProviderLivenessCheck(LivenessDial, 0))
+	require.Error(t, err)
+}
+
+func TestDeduplicateLookups(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// concurrent lookups of the same key share a single lookup
+	dedup := newLookupDedup(ctx)
+	var runs int32
+	release := make(chan struct{})
+	run := func(ctx context.Context, l *sharedLookup) interface{} {
+		atomic.AddInt32(&runs, 1)
+		l.publish(1)
+		select {
+		case <-release:
+		case <-ctx.Done():
+			return "cancelled"
+		}
+		l.publish(2)
+		return "done"
+	}
+	a := dedup.join("a", run)
+	b := dedup.join("a", run)
+	v, ok := a.next(ctx, 0, nil)
+	require.True(t, ok)
+	require.Equal(t, 1, v)
+	close(release)
+	for i, want := range []int{1, 2} {
+		v, ok := b.next(ctx, i, nil)
+		require.True(t, ok)
+		require.Equal(t, want, v)
+	}
+	_, ok = b.next(ctx, 2, nil)
+	require.False(t, ok)
+	require.Equal(t, "done", b.wait(ctx))
+	require.EqualValues(t, 1, atomic.LoadInt32(&runs))
+	a.leave()
+	b.leave()
+
+	// the lookup is cancelled once no caller is left
+	c := dedup.join("c", func(ctx context.Context, l *sharedLookup) interface{} {
+		<-ctx.Done()
+		return "cancelled"
+	})
+	c.leave()
+	require.Equal(t, "cancelled", c.wait(ctx))
+
+	dhts := setupConnectedDHTS(t, ctx, 2, DeduplicateLookups())
+
+	key := testCaseCids[0]
+	require.NoError(t, dhts[1].Provide(ctx, key, false))
+	require.NoError(t, dhts[1].PutValue(ctx, "/v/hello", []byte("world")))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			provs, err := dhts[0].FindProviders(ctx, key)
+			assert.NoError(t, err)
+			assert.Len(t, provs, 1)
+		}()
+		go func() {
+			defer wg.Done()
+			val, err := dhts[0].GetValue(ctx, "/v/hello", Quorum(1))
+			assert.NoError(t, err)
+			assert.Equal(t, []byte("world"), val)
+		}()
+	}
+	wg.Wait()
+
+	// lookups collecting their statistics aren't shared, nor answered from the closest peers cache
+	require.False(t, dedupable(withLookupSize(ctx, 10)))
+	sctx, collector := CollectLookupStats(ctx)
+	require.False(t, dedupable(sctx))
+	_, err := dhts[0].FindProviders(sctx, key)
+	require.NoError(t, err)
+	require.Len(t, collector.Stats(), 1)
+
+	d := setupDHT(ctx, t, false, DeduplicateLookups(), ClosestPeersCacheTTL(time.Minute))
+	connect(t, ctx, d, dhts[0])
+	for i := 0; i < 2; i++ {
+		sctx, collector := CollectLookupStats(ctx)
+		_, err := d.GetClosestPeers(sctx, "foo")
+		require.NoError(t, err)
+		require.Len(t, collector.Stats(), 1)
+		require.Equal(t, ClosestPeersCacheStats{}, d.ClosestPeersCacheStats())
+	}
+}
+
+func TestResolveProviderAddrs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false, ResolveProviderAddrs(2, 5*time.Second))
+	relay := setupDHT(ctx, t, false)
+	provider := setupDHT(ctx, t, false)
+	connect(t, ctx, d, relay)
+	connect(t, ctx, relay, provider)
+
+	// a provider record whose addresses we don't know
+	key := testCaseCids[0]
+	d.providerStore.AddProvider(ctx, key.Hash(), peer.AddrInfo{ID: provider.self})
+	require.Empty(t, d.peerstore.Addrs(provider.self))
+
+	provs, err := d.FindProvidersWithOptions(ctx, key, 1)
+	require.NoError(t, err)
+	require.Len(t, provs, 1)
+	require.Equal(t, provider.self, provs[0].ID)
+	require.ElementsMatch(t, provider.host.Addrs(), provs[0].Addrs)
+
+	_, err = New(ctx, d.host, ResolveProviderAddrs(0, time.Second))
+	require.Error(t, err)
+}
+
 func TestFindPeerWithQueryFilter(t *testing.T) {
 	// t.Skip("skipping test to debug another")
 	if testing.Short() {
@@ -1482,6 +2031,31 @@ func TestFindClosestPeers(t *testing.T) {
 	}
 }
 
+func TestFindClosestPeersSeeded(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	nDHTs := 10
+	dhts := setupDHTS(t, ctx, nDHTs)
+	// the querier has an empty routing table, all other peers are connected in a ring
+	for i := 1; i < nDHTs; i++ {
+		connect(t, ctx, dhts[i], dhts[1+i%(nDHTs-1)])
+	}
+	querier := dhts[0]
+
+	_, err := querier.GetClosestPeers(ctx, "foo")
+	require.ErrorIs(t, err, kb.ErrLookupFailure)
+
+	_, err = querier.GetClosestPeersSeeded(ctx, "foo", nil)
+	require.Error(t, err)
+
+	seed := dhts[1]
+	querier.peerstore.AddAddrs(seed.self, seed.host.Addrs(), peerstore.TempAddrTTL)
+	peers, err := querier.GetClosestPeersSeeded(ctx, "foo", []peer.ID{seed.self, querier.self})
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, len(peers), querier.beta)
+}
+
 func TestFixLowPeers(t *testing.T) {
 	ctx := context.Background()
 
@@ -1919,63 +2493,1126 @@ func TestRoutingFilter(t *testing.T) {
 	}
 }
 
-func TestBootStrapWhenRTIsEmpty(t *testing.T) {
-	if detectrace.WithRace() {
-		t.Skip("skipping timing dependent test when race detector is running")
-	}
+func TestPeerAllowlist(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	// create three boostrap peers each of which is connected to 1 other peer.
-	nBootStraps := 3
-	bootstrappers := setupDHTS(t, ctx, nBootStraps)
-	defer func() {
-		for i := 0; i < nBootStraps; i++ {
-			bootstrappers[i].Close()
-			defer bootstrappers[i].host.Close()
-		}
-	}()
+	nDHTs := 3
+	dhts := setupDHTS(t, ctx, nDHTs)
+	dhts[0].allowlist = map[peer.ID]struct{}{dhts[1].self: {}}
 
-	bootstrapcons := setupDHTS(t, ctx, nBootStraps)
-	defer func() {
-		for i := 0; i < nBootStraps; i++ {
-			bootstrapcons[i].Close()
-			defer bootstrapcons[i].host.Close()
-		}
-	}()
-	for i := 0; i < nBootStraps; i++ {
-		connect(t, ctx, bootstrappers[i], bootstrapcons[i])
-	}
+	connect(t, ctx, dhts[0], dhts[1])
+	connectNoSync(t, ctx, dhts[0], dhts[2])
 
-	// convert the bootstrap addresses to a p2p address
-	bootstrapAddrs := make([]peer.AddrInfo, nBootStraps)
-	for i := 0; i < nBootStraps; i++ {
-		b := peer.AddrInfo{ID: bootstrappers[i].self,
-			Addrs: bootstrappers[i].host.Addrs()}
-		bootstrapAddrs[i] = b
-	}
+	// requests from peers that are not on the allowlist are refused
+	_, err := dhts[2].protoMessenger.GetClosestPeers(ctx, dhts[0].self, dhts[2].self)
+	require.Error(t, err)
+	_, err = dhts[1].protoMessenger.GetClosestPeers(ctx, dhts[0].self, dhts[1].self)
+	require.NoError(t, err)
 
-	{
+	// they are neither added to the routing table nor queried
+	require.Empty(t, dhts[0].routingTable.Find(dhts[2].self))
+	peers, err := dhts[0].GetClosestPeers(ctx, string(dhts[2].self))
+	require.NoError(t, err)
+	require.NotContains(t, peers, dhts[2].self)
 
-		// ----------------
-		// We will initialize a DHT with 1 bootstrapper, connect it to another DHT,
-		// then remove the latter from the Routing Table
-		// This should add the bootstrap peer and the peer that the bootstrap peer is conencted to
-		// to it's Routing Table.
-		// AutoRefresh needs to be enabled for this.
+	_, err = New(ctx, dhts[0].host, PrivateNetwork(DefaultPrefix, dhts[1].self))
+	require.Error(t, err)
+}
 
-		h1, err := bhost.NewHost(swarmt.GenSwarm(t, swarmt.OptDisableReuseport), new(bhost.HostOpts))
+func TestAuthenticatedOverlay(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	authority, _, err := crypto.GenerateEd25519Key(crand.Reader)
+	require.NoError(t, err)
+	newHost := func() *bhost.BasicHost {
+		h, err := bhost.NewHost(swarmt.GenSwarm(t, swarmt.OptDisableReuseport), new(bhost.HostOpts))
 		require.NoError(t, err)
-		dht1, err := New(
-			ctx,
-			h1,
-			testPrefix,
-			NamespacedValidator("v", blankValidator{}),
-			Mode(ModeServer),
-			BootstrapPeers(bootstrapAddrs[0]),
-		)
+		t.Cleanup(func() { h.Close() })
+		return h
+	}
+	newMember := func() *IpfsDHT {
+		h := newHost()
+		cred, err := NewMembershipCredential(authority, h.ID(), time.Now().Add(time.Hour))
 		require.NoError(t, err)
-		dht2 := setupDHT(ctx, t, false)
+		d, err := New(ctx, h, testPrefix, NamespacedValidator("v", blankValidator{}), DisableAutoRefresh(),
+			Mode(ModeServer), AuthenticatedOverlay(authority.GetPublic(), cred))
+		require.NoError(t, err)
+		t.Cleanup(func() { d.Close() })
+		return d
+	}
+
+	// members talk to each other
+	a, b := newMember(), newMember()
+	connect(t, ctx, a, b)
+	_, err = a.protoMessenger.GetClosestPeers(ctx, b.self, a.self)
+	require.NoError(t, err)
+	require.NoError(t, a.PutValue(ctx, "/v/hello", []byte("world")))
+	val, err := b.GetValue(ctx, "/v/hello")
+	require.NoError(t, err)
+	require.Equal(t, []byte("world"), val)
+
+	// requests and responses of non-members are rejected
+	c := setupDHT(ctx, t, false)
+	connectNoSync(t, ctx, c, a)
+	_, err = c.protoMessenger.GetClosestPeers(ctx, a.self, c.self)
+	require.Error(t, err)
+	_, err = a.protoMessenger.GetClosestPeers(ctx, c.self, a.self)
+	require.Error(t, err)
+
+	// credentials must admit the local peer, be signed by the authority and not have expired
+	h := newHost()
+	other, _, err := crypto.GenerateEd25519Key(crand.Reader)
+	require.NoError(t, err)
+	forged, err := NewMembershipCredential(other, h.ID(), time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	expired, err := NewMembershipCredential(authority, h.ID(), time.Now().Add(-time.Hour))
+	require.NoError(t, err)
+	foreign, err := NewMembershipCredential(authority, a.self, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	for _, cred := range [][]byte{forged, expired, foreign} {
+		_, err = New(ctx, h, testPrefix, AuthenticatedOverlay(authority.GetPublic(), cred))
+		require.Error(t, err)
+	}
+	valid, err := NewMembershipCredential(authority, h.ID(), time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	_, err = New(ctx, h, AuthenticatedOverlay(authority.GetPublic(), valid))
+	require.Error(t, err)
+}
+
+func TestRecordProvideTargets(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	nDHTs := 3
+	clk := clock.NewMock()
+	dhts := setupConnectedDHTS(t, ctx, nDHTs, WithClock(clk), RecordProvideTargets(time.Hour))
+
+	key := testCaseCids[0]
+	_, err := dhts[0].GetProvideTargets(ctx, key.Hash())
+	require.ErrorIs(t, err, routing.ErrNotFound)
+
+	require.NoError(t, dhts[0].ProvideWithoutEclipseDetection(ctx, key, true))
+	targets, err := dhts[0].GetProvideTargets(ctx, key.Hash())
+	require.NoError(t, err)
+	require.ElementsMatch(t, []peer.ID{dhts[1].self, dhts[2].self}, targets.Peers)
+	require.Empty(t, targets.Failed)
+	require.Equal(t, key.Hash(), targets.Key)
+	require.Equal(t, ProvideStrategyRegular, targets.Strategy)
+
+	v, err := dhts[0].VerifyProvide(ctx, key.Hash())
+	require.NoError(t, err)
+	require.ElementsMatch(t, []peer.ID{dhts[1].self, dhts[2].self}, v.Retrievable)
+	require.Empty(t, v.Missing)
+	require.Equal(t, 1.0, v.Retrievability())
+
+	// expired targets are dropped
+	clk.Add(2 * time.Hour)
+	_, err = dhts[0].GetProvideTargets(ctx, key.Hash())
+	require.ErrorIs(t, err, routing.ErrNotFound)
+	_, err = dhts[0].datastore.Get(ctx, provideTargetsDsKey(key.Hash()))
+	require.ErrorIs(t, err, ds.ErrNotFound)
+
+	_, err = New(ctx, dhts[0].host, RecordProvideTargets(0))
+	require.Error(t, err)
+}
+
+func TestReprovideOnChurn(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	nDHTs := 3
+	dhts := setupDHTS(t, ctx, nDHTs, ReprovideOnChurn(time.Hour, 10), RecordProvideTargets(time.Hour))
+	connect(t, ctx, dhts[0], dhts[1])
+
+	key := testCaseCids[0]
+	require.NoError(t, dhts[0].ProvideWithoutEclipseDetection(ctx, key, true))
+	require.Empty(t, dhts[0].reprovideJoined(ctx, key.Hash()))
+
+	// a new peer joins the closest peers of the key
+	connect(t, ctx, dhts[0], dhts[2])
+	require.Equal(t, []peer.ID{dhts[2].self}, dhts[0].reprovideJoined(ctx, key.Hash()))
+	require.Eventually(t, func() bool {
+		provs, err := dhts[2].providerStore.GetProviders(ctx, key.Hash())
+		return err == nil && len(provs) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Empty(t, dhts[0].reprovideJoined(ctx, key.Hash()))
+
+	targets, err := dhts[0].GetProvideTargets(ctx, key.Hash())
+	require.NoError(t, err)
+	require.ElementsMatch(t, []peer.ID{dhts[1].self, dhts[2].self}, targets.Peers)
+	require.Equal(t, ProvideStrategyRegular, targets.Strategy)
+
+	// keys whose provider records expired are no longer watched
+	require.Len(t, dhts[0].churnReprovider.watched(time.Now()), 1)
+	require.Empty(t, dhts[0].churnReprovider.watched(time.Now().Add(2*providers.ProvideValidity)))
+	require.Empty(t, dhts[0].reprovideJoined(ctx, key.Hash()))
+}
+
+func TestRecordProviderAudit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := setupDHT(ctx, t, false, RecordProviderAudit(time.Hour))
+	client := setupDHT(ctx, t, false)
+	connect(t, ctx, client, server)
+
+	key := testCaseCids[0]
+	entries, err := server.ProviderAudit(ctx, key.Hash())
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	for i := 0; i < 2; i++ {
+		require.NoError(t, client.sendProviderRecords(ctx, key.Hash(), ProvideStrategyRegular, time.Now(), []peer.ID{server.self})[server.self])
+	}
+	require.Eventually(t, func() bool {
+		entries, err = server.ProviderAudit(ctx, key.Hash())
+		return err == nil && len(entries) == 1 && entries[0].Count == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, key.Hash(), entries[0].Key)
+	require.Equal(t, client.self, entries[0].Provider)
+	require.Equal(t, client.self, entries[0].Submitter)
+	require.False(t, entries[0].LastSeen.Before(entries[0].FirstSeen))
+
+	from, err := server.ProviderAuditFrom(ctx, client.self)
+	require.NoError(t, err)
+	require.Equal(t, entries, from)
+	from, err = server.ProviderAuditFrom(ctx, server.self)
+	require.NoError(t, err)
+	require.Empty(t, from)
+
+	// expired entries are dropped
+	server.providerAuditRetention = time.Nanosecond
+	entries, err = server.ProviderAudit(ctx, key.Hash())
+	require.NoError(t, err)
+	require.Empty(t, entries)
+	server.gcProviderAudit(ctx)
+	_, err = server.datastore.Get(ctx, providerAuditDsKey(key.Hash(), client.self, client.self))
+	require.ErrorIs(t, err, ds.ErrNotFound)
+
+	_, err = client.ProviderAudit(ctx, key.Hash())
+	require.ErrorIs(t, err, routing.ErrNotSupported)
+	_, err = New(ctx, server.host, RecordProviderAudit(0))
+	require.Error(t, err)
+}
+
+func TestPartialProvideError(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false)
+	other := setupDHT(ctx, t, false)
+	connect(t, ctx, d, other)
+
+	key := testCaseCids[0].Hash()
+	require.NoError(t, provideResult(key, []peer.ID{other.self}, d.sendProviderRecords(ctx, key, ProvideStrategyRegular, time.Now(), []peer.ID{other.self})))
+
+	// a peer without known addresses can't be reached
+	unreachable := peer.ID("unreachable")
+	peers := []peer.ID{other.self, unreachable}
+	err := provideResult(key, peers, d.sendProviderRecords(ctx, key, ProvideStrategyRegular, time.Now(), peers))
+	var perr *PartialProvideError
+	require.ErrorAs(t, err, &perr)
+	require.Equal(t, key, perr.Key)
+	require.Equal(t, 1, perr.Succeeded)
+	require.Len(t, perr.Failed, 1)
+	require.Error(t, perr.Failed[unreachable])
+
+	// no peer accepted the record
+	err = provideResult(key, peers[1:], d.sendProviderRecords(ctx, key, ProvideStrategyRegular, time.Now(), peers[1:]))
+	require.ErrorAs(t, err, &perr)
+	require.Zero(t, perr.Succeeded)
+}
+
+func TestProvideQueue(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dstore := dssync.MutexWrap(ds.NewMapDatastore())
+
+	// a key left in the queue by a previous run
+	leftover := testCaseCids[2]
+	b, err := json.Marshal(&queuedProvide{Cid: leftover, Attempts: 1, NextAttempt: time.Now().Add(100 * time.Millisecond)})
+	require.NoError(t, err)
+	require.NoError(t, dstore.Put(ctx, provideQueueDsKey(leftover), b))
+
+	d := setupDHT(ctx, t, false, Datastore(dstore), EnableProvideQueue(2, 0), ProvideQueueRetries(3, 10*time.Millisecond))
+
+	var (
+		mu    sync.Mutex
+		calls = make(map[cid.Cid]int)
+	)
+	failing, partial := testCaseCids[1], testCaseCids[3]
+	d.provideQueue.provide = func(_ context.Context, key cid.Cid, _ bool) error {
+		mu.Lock()
+		defer mu.Unlock()
+		calls[key]++
+		if key == failing && calls[key] == 1 {
+			return errors.New("provide failed")
+		}
+		if key == partial {
+			// stored with some peers, not retried
+			return &PartialProvideError{Failed: map[peer.ID]error{"p": errors.New("unreachable")}, Succeeded: 1}
+		}
+		return nil
+	}
+
+	require.NoError(t, d.EnqueueProvide(ctx, testCaseCids[0], ProvidePriorityRoutine))
+	require.NoError(t, d.EnqueueProvide(ctx, failing, ProvidePriorityRoutine))
+	require.NoError(t, d.EnqueueProvide(ctx, partial, ProvidePriorityRoutine))
+	require.Eventually(t, func() bool {
+		n, err := d.PendingProvides(ctx)
+		return err == nil && n == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	mu.Lock()
+	require.Equal(t, map[cid.Cid]int{testCaseCids[0]: 1, failing: 2, partial: 1, leftover: 1}, calls)
+	mu.Unlock()
+
+	_, err = setupDHT(ctx, t, false).PendingProvides(ctx)
+	require.ErrorIs(t, err, routing.ErrNotSupported)
+}
+
+func TestProvideQueueConcurrency(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false, EnableProvideQueue(2, 0))
+	connect(t, ctx, d, setupDHT(ctx, t, false))
+
+	// both workers provide at once, and don't wait for the provide holding the provider lock
+	var started sync.WaitGroup
+	started.Add(2)
+	d.provideQueue.provide = func(ctx context.Context, key cid.Cid, brdcst bool) error {
+		started.Done()
+		started.Wait()
+		return d.Provide(ctx, key, brdcst)
+	}
+	require.NoError(t, d.lockProvides(ctx))
+	defer d.unlockProvides()
+	for _, key := range testCaseCids[:2] {
+		require.NoError(t, d.EnqueueProvide(ctx, key, ProvidePriorityRoutine))
+	}
+	require.Eventually(t, func() bool {
+		n, err := d.PendingProvides(ctx)
+		return err == nil && n == 0
+	}, 10*time.Second, 10*time.Millisecond)
+}
+
+func TestProvideQueuePriority(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false, EnableProvideQueue(1, 0))
+
+	var (
+		mu      sync.Mutex
+		order   []cid.Cid
+		started = make(chan struct{})
+		release = make(chan struct{})
+	)
+	d.provideQueue.provide = func(_ context.Context, key cid.Cid, _ bool) error {
+		mu.Lock()
+		order = append(order, key)
+		first := len(order) == 1
+		mu.Unlock()
+		if first {
+			close(started)
+			<-release
+		}
+		return nil
+	}
+
+	// the only worker is busy with the first key while the others are queued
+	require.NoError(t, d.EnqueueProvide(ctx, testCaseCids[0], ProvidePriorityRoutine))
+	<-started
+	require.NoError(t, d.EnqueueProvide(ctx, testCaseCids[1], ProvidePriorityRoutine))
+	require.NoError(t, d.EnqueueProvide(ctx, testCaseCids[2], ProvidePriorityRoutine))
+
+	// keys this node provides are queued with priority when an attack is detected on them
+	attacked := cid.NewCidV1(cid.Raw, testCaseCids[3].Hash())
+	require.NoError(t, d.providerStore.AddProvider(ctx, attacked.Hash(), peer.AddrInfo{ID: d.self}))
+	d.reprovideAttacked(ctx, string(testCaseCids[4].Hash()))
+	d.reprovideAttacked(ctx, string(attacked.Hash()))
+	close(release)
+
+	require.Eventually(t, func() bool {
+		n, err := d.PendingProvides(ctx)
+		return err == nil && n == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, order, 4)
+	require.Equal(t, testCaseCids[0], order[0])
+	require.Equal(t, attacked, order[1])
+	require.ElementsMatch(t, []cid.Cid{testCaseCids[1], testCaseCids[2]}, order[2:])
+}
+
+func TestProvideQueuePartitions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false, EnableProvideQueue(4, 0), PartitionProvideQueue(1))
+
+	var (
+		mu       sync.Mutex
+		provided = make(map[cid.Cid]int)
+		running  = make(map[int]int)
+		overlap  bool
+		mismatch bool
+		paths    = make(map[int]*warmPath)
+	)
+	d.provideQueue.provide = func(ctx context.Context, key cid.Cid, _ bool) error {
+		p := d.provideQueue.keyPartition(key)
+		w := warmPathFrom(ctx)
+		mu.Lock()
+		provided[key]++
+		if running[p]++; running[p] > 1 {
+			overlap = true
+		}
+		if paths[p] == nil {
+			paths[p] = w
+		}
+		mismatch = mismatch || paths[p] != w
+		mu.Unlock()
+
+		time.Sleep(5 * time.Millisecond)
+		mu.Lock()
+		running[p]--
+		mu.Unlock()
+		return nil
+	}
+
+	for _, c := range testCaseCids {
+		require.NoError(t, d.EnqueueProvide(ctx, c, ProvidePriorityRoutine))
+	}
+	require.Eventually(t, func() bool {
+		n, err := d.PendingProvides(ctx)
+		return err == nil && n == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, provided, len(testCaseCids))
+	// a partition is provided by a single worker at a time, from its own routing path
+	require.False(t, overlap)
+	require.False(t, mismatch)
+	require.Len(t, paths, 2)
+	for _, w := range paths {
+		require.NotNil(t, w)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dstore := dssync.MutexWrap(ds.NewMapDatastore())
+	d := setupDHT(ctx, t, false, Datastore(dstore), EnableProvideQueue(1, 0))
+	defer d.host.Close()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	d.provideQueue.provide = func(_ context.Context, key cid.Cid, _ bool) error {
+		close(started)
+		<-release
+		return nil
+	}
+	queued, direct := testCaseCids[0], testCaseCids[1]
+	require.NoError(t, d.EnqueueProvide(ctx, queued, ProvidePriorityRoutine))
+	<-started
+	// a direct provide that doesn't finish in time
+	done, err := d.provideDrain.track(direct)
+	require.NoError(t, err)
+	defer done()
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+	}()
+	sctx, scancel := context.WithTimeout(ctx, 500*time.Millisecond)
+	defer scancel()
+	require.NoError(t, d.Shutdown(sctx))
+
+	// the queued provide was drained, the direct one persisted for the next start
+	has, err := dstore.Has(ctx, provideQueueDsKey(queued))
+	require.NoError(t, err)
+	require.False(t, has)
+	has, err = dstore.Has(ctx, provideQueueDsKey(direct))
+	require.NoError(t, err)
+	require.True(t, has)
+
+	_, err = d.provideDrain.track(direct)
+	require.ErrorIs(t, err, ErrShuttingDown)
+}
+
+func TestRotateIdentity(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	nDHTs := 4
+	dhts := setupConnectedDHTS(t, ctx, nDHTs)
+	old := dhts[0]
+	key := "/v/hello"
+	require.NoError(t, old.putLocal(ctx, key, record.MakePutRecord(key, []byte("world"))))
+	c := testCaseCids[0]
+
+	h, err := bhost.NewHost(swarmt.GenSwarm(t, swarmt.OptDisableReuseport), new(bhost.HostOpts))
+	require.NoError(t, err)
+	defer h.Close()
+	d, err := RotateIdentity(ctx, old, h, []cid.Cid{c},
+		testPrefix, NamespacedValidator("v", blankValidator{}), DisableAutoRefresh(), Mode(ModeServer))
+	require.NoError(t, err)
+	defer d.Close()
+
+	// the new identity took over the routing table, the old one left the DHT
+	require.ElementsMatch(t, []peer.ID{dhts[1].self, dhts[2].self, dhts[3].self}, d.routingTable.ListPeers())
+	require.Error(t, old.ctx.Err())
+	for _, other := range dhts[1:] {
+		require.Eventually(t, func() bool { return other.routingTable.Find(old.self) == "" }, 5*time.Second, 10*time.Millisecond)
+	}
+
+	// the value was handed over and the content provided under the new identity
+	for _, other := range dhts[1:] {
+		rec, err := other.getRecordFromDatastore(ctx, mkDsKey(key))
+		require.NoError(t, err)
+		require.NotNil(t, rec)
+		require.Equal(t, []byte("world"), rec.GetValue())
+
+		require.Eventually(t, func() bool {
+			provs, err := other.providerStore.GetProviders(ctx, c.Hash())
+			return err == nil && len(provs) == 1 && provs[0].ID == d.self
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+}
+
+func TestRoutingTableEvents(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false)
+	other := setupDHT(ctx, t, false)
+	sub, err := d.RoutingTableEvents()
+	require.NoError(t, err)
+	defer sub.Close()
+
+	next := func(typ RoutingTableEventType) EvtRoutingTableChanged {
+		t.Helper()
+		for {
+			select {
+			case e := <-sub.Out():
+				if evt := e.(EvtRoutingTableChanged); evt.Type == typ {
+					return evt
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("no %s event", typ)
+			}
+		}
+	}
+
+	connect(t, ctx, d, other)
+	cpl := kb.CommonPrefixLen(d.selfKey, kb.ConvertPeerID(other.self))
+	evt := next(RoutingTablePeerAdded)
+	require.Equal(t, other.self, evt.Peer)
+	require.Equal(t, cpl, evt.CPL)
+	require.Contains(t, []string{RTReasonQueried, RTReasonConnected}, evt.Reason)
+
+	d.peerStoppedDHT(ctx, other.self)
+	require.Equal(t, EvtRoutingTableChanged{Type: RoutingTablePeerRemoved, Peer: other.self, CPL: cpl, Reason: RTReasonStoppedDHT},
+		next(RoutingTablePeerRemoved))
+
+	d.routingTable.TryAddPeer(other.self, true, false)
+	require.NoError(t, <-d.ForceRefresh())
+	evt = next(RoutingTableBucketRefreshed)
+	require.Empty(t, evt.Peer)
+	require.Empty(t, evt.Reason)
+}
+
+func TestAddPeer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := setupDHT(ctx, t, false)
+	filtered := setupDHT(ctx, t, false)
+	client := setupDHT(ctx, t, true)
+	d := setupDHT(ctx, t, false, RoutingTableFilter(func(_ interface{}, p peer.ID) bool {
+		return p != filtered.self
+	}))
+	addrInfo := func(dht *IpfsDHT) peer.AddrInfo {
+		return peer.AddrInfo{ID: dht.self, Addrs: dht.host.Addrs()}
+	}
+
+	_, reason, err := d.AddPeer(ctx, addrInfo(d))
+	require.NoError(t, err)
+	require.Equal(t, AddPeerSelf, reason)
+
+	added, reason, err := d.AddPeer(ctx, addrInfo(server))
+	require.NoError(t, err)
+	require.True(t, added)
+	require.Empty(t, reason)
+	require.NotEmpty(t, d.routingTable.Find(server.self))
+
+	added, reason, err = d.AddPeer(ctx, addrInfo(server))
+	require.NoError(t, err)
+	require.False(t, added)
+	require.Equal(t, AddPeerPresent, reason)
+
+	added, reason, err = d.AddPeer(ctx, addrInfo(client))
+	require.NoError(t, err)
+	require.False(t, added)
+	require.Equal(t, AddPeerNotDHTServer, reason)
+
+	added, reason, err = d.AddPeer(ctx, addrInfo(filtered))
+	require.NoError(t, err)
+	require.False(t, added)
+	require.Equal(t, AddPeerFiltered, reason)
+
+	_, reason, err = d.AddPeer(ctx, peer.AddrInfo{ID: peer.ID("unreachable")})
+	require.Error(t, err)
+	require.Equal(t, AddPeerUnreachable, reason)
+	require.Equal(t, 1, d.routingTable.Size())
+}
+
+func TestProbe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false)
+	server := setupDHT(ctx, t, false)
+	client := setupDHT(ctx, t, true)
+	connect(t, ctx, server, setupDHT(ctx, t, false))
+	d.peerstore.AddAddrs(server.self, server.host.Addrs(), peerstore.TempAddrTTL)
+	d.peerstore.AddAddrs(client.self, client.host.Addrs(), peerstore.TempAddrTTL)
+
+	res, err := d.Probe(ctx, server.self)
+	require.NoError(t, err)
+	require.Equal(t, d.protocols[0], res.Protocol)
+	require.NoError(t, res.PingErr)
+	require.Positive(t, res.RTT)
+	require.NoError(t, res.FindNodeErr)
+	require.True(t, res.FindNode)
+
+	res, err = d.Probe(ctx, client.self)
+	require.NoError(t, err)
+	require.Equal(t, ProbeResult{}, res)
+
+	_, err = d.Probe(ctx, peer.ID("unreachable"))
+	require.Error(t, err)
+}
+
+func TestKeyPolicies(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	refused := testCaseCids[1]
+	d := setupDHT(ctx, t, false,
+		NamespacedValidator("w", blankValidator{}),
+		ValueNamespaces("v"),
+		ProviderKeyPolicy(func(key string) bool { return key != string(refused.Hash()) }),
+	)
+	other := setupDHT(ctx, t, false, NamespacedValidator("w", blankValidator{}))
+	connect(t, ctx, d, other)
+
+	// local calls
+	require.NoError(t, d.PutValue(ctx, "/v/hello", []byte("world")))
+	require.ErrorIs(t, d.PutValue(ctx, "/w/hello", []byte("world")), routing.ErrNotSupported)
+	_, err := d.GetValue(ctx, "/w/hello")
+	require.ErrorIs(t, err, routing.ErrNotSupported)
+	require.ErrorIs(t, d.ProvideWithoutEclipseDetection(ctx, refused, false), routing.ErrNotSupported)
+	require.NoError(t, d.ProvideWithoutEclipseDetection(ctx, testCaseCids[0], false))
+
+	// requests from other peers
+	rec := record.MakePutRecord("/w/hello", []byte("world"))
+	require.Error(t, other.protoMessenger.PutValue(ctx, d.self, rec))
+	local, err := d.getLocal(ctx, "/w/hello")
+	require.NoError(t, err)
+	require.Nil(t, local)
+	_, _, err = other.protoMessenger.GetProviders(ctx, d.self, refused.Hash())
+	require.Error(t, err)
+	provs, _, err := other.protoMessenger.GetProviders(ctx, d.self, testCaseCids[0].Hash())
+	require.NoError(t, err)
+	require.Len(t, provs, 1)
+}
+
+// staticRouter is a fallback router serving canned providers and values.
+type staticRouter struct {
+	helper.Null
+	providers []peer.AddrInfo
+	values    map[string][]byte
+}
+
+func (r *staticRouter) FindProvidersAsync(context.Context, cid.Cid, int) <-chan peer.AddrInfo {
+	out := make(chan peer.AddrInfo, len(r.providers))
+	for _, ai := range r.providers {
+		out <- ai
+	}
+	close(out)
+	return out
+}
+
+func (r *staticRouter) GetValue(_ context.Context, key string, _ ...routing.Option) ([]byte, error) {
+	if v, ok := r.values[key]; ok {
+		return v, nil
+	}
+	return nil, routing.ErrNotFound
+}
+
+func (r *staticRouter) PutValue(_ context.Context, key string, value []byte, _ ...routing.Option) error {
+	r.values[key] = value
+	return nil
+}
+
+func TestFallbackRouter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupConnectedDHTS(t, ctx, 2)
+
+	fallback := &staticRouter{
+		providers: []peer.AddrInfo{{ID: dhts[1].self}},
+		values:    map[string][]byte{"/v/fallback": []byte("fallback")},
+	}
+	_, err := NewFallbackRouter(dhts[0], 0.5, NamedRouter{Name: "dht", Router: fallback})
+	require.Error(t, err)
+	r, err := NewFallbackRouter(dhts[0], 0.5, NamedRouter{Name: "static", Router: fallback})
+	require.NoError(t, err)
+
+	// the DHT knows of no providers
+	var provs []peer.AddrInfo
+	for ai := range r.FindProvidersAsync(ctx, testCaseCids[0], 10) {
+		provs = append(provs, ai)
+	}
+	require.Equal(t, fallback.providers, provs)
+
+	// the DHT doesn't have the value
+	val, err := r.GetValue(ctx, "/v/fallback")
+	require.NoError(t, err)
+	require.Equal(t, []byte("fallback"), val)
+
+	// the value is only stored with the fallback router if the key is suspicious
+	require.NoError(t, r.PutValue(ctx, "/v/hello", []byte("world")))
+	require.NotContains(t, fallback.values, "/v/hello")
+	dhts[0].detections.Report(AttackSignal{Key: "/v/hello", Source: SignalCrossCheck, Score: 1})
+	require.NoError(t, r.PutValue(ctx, "/v/hello", []byte("world")))
+	require.Equal(t, []byte("world"), fallback.values["/v/hello"])
+}
+
+type fixedNetsize float64
+
+func (fixedNetsize) Track(string, []peer.ID) error   { return nil }
+func (n fixedNetsize) NetworkSize() (float64, error) { return float64(n), nil }
+
+func TestNetsizeEstimators(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false, NetsizeEstimator(fixedNetsize(42)))
+	size, err := d.nsEstimator.NetworkSize()
+	require.NoError(t, err)
+	require.Equal(t, 42.0, size)
+
+	nDHTs := 5
+	dhts := setupDHTS(t, ctx, nDHTs, CrawlNetsizeEstimator(time.Minute, 10*time.Second))
+	for i := 0; i < nDHTs-1; i++ {
+		connect(t, ctx, dhts[i], dhts[i+1])
+	}
+
+	size, err = dhts[0].nsEstimator.NetworkSize()
+	require.NoError(t, err)
+	require.Equal(t, float64(nDHTs), size)
+}
+
+func TestNetsizeSampling(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		mu               sync.Mutex
+		cpls             []uint
+		running, maxSeen int
+		lookupErr        = errors.New("lookup failed")
+	)
+	randomKey := func(cpl uint) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		cpls = append(cpls, cpl)
+		return fmt.Sprint(cpl), nil
+	}
+	lookup := func(ctx context.Context, key string) error {
+		mu.Lock()
+		if running++; running > maxSeen {
+			maxSeen = running
+		}
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		if key == "3" {
+			return nil
+		}
+		return lookupErr
+	}
+
+	s := RegionNetsizeSampler{Keys: 6, Concurrency: 2, MinCPL: 2, MaxCPL: 4}
+	require.NoError(t, s.Sample(ctx, lookup, randomKey))
+	require.Equal(t, []uint{2, 3, 4, 2, 3, 4}, cpls)
+	require.Equal(t, 2, maxSeen)
+
+	// fails if no lookup succeeded
+	s = RegionNetsizeSampler{Keys: 2, Concurrency: 1, MinCPL: 5, MaxCPL: 5}
+	require.ErrorIs(t, s.Sample(ctx, lookup, randomKey), lookupErr)
+
+	_, err := New(ctx, nil, NetsizeSampling(RegionNetsizeSampler{Keys: 1, MinCPL: 3, MaxCPL: 2}))
+	require.Error(t, err)
+
+	sampled := make(chan struct{}, 1)
+	d := setupDHT(ctx, t, false, NetsizeSampling(sampleFunc(func() { sampled <- struct{}{} })))
+	d.GatherNetsizeData()
+	require.Len(t, sampled, 1)
+}
+
+type sampleFunc func()
+
+func (f sampleFunc) Sample(context.Context, func(context.Context, string) error, func(uint) (string, error)) error {
+	f()
+	return nil
+}
+
+type blockingSampler chan error
+
+func (s blockingSampler) Sample(ctx context.Context, _ func(context.Context, string) error, _ func(uint) (string, error)) error {
+	<-ctx.Done()
+	s <- ctx.Err()
+	return ctx.Err()
+}
+
+func TestNetsizeGathering(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// progress
+	dhts := setupConnectedDHTS(t, ctx, 3, NetsizeSampling(RegionNetsizeSampler{Keys: 3, Concurrency: 1, MinCPL: 0, MaxCPL: 2}))
+	require.Equal(t, NetsizeGatheringProgress{}, dhts[0].NetsizeGatheringProgress())
+	require.NoError(t, dhts[0].GatherNetsizeDataContext(ctx))
+	progress := dhts[0].NetsizeGatheringProgress()
+	require.False(t, progress.Running)
+	require.False(t, progress.Started.IsZero())
+	require.Equal(t, 3, progress.Completed)
+	require.Equal(t, 3, progress.Planned)
+
+	// cancellation
+	cancelled := make(blockingSampler, 1)
+	d := setupDHT(ctx, t, false, NetsizeSampling(cancelled))
+	tctx, tcancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer tcancel()
+	require.ErrorIs(t, d.GatherNetsizeDataContext(tctx), context.DeadlineExceeded)
+	select {
+	case err := <-cancelled:
+		require.ErrorIs(t, err, context.Canceled)
+	case <-time.After(5 * time.Second):
+		t.Fatal("netsize gathering not cancelled")
+	}
+
+	// background gathering triggered without waiting for it
+	sampled := make(chan struct{}, 1)
+	_, err := New(ctx, nil, NetsizeGatheringSchedule(time.Hour, 2*time.Hour))
+	require.Error(t, err)
+	d = setupDHT(ctx, t, false, NetsizeGatheringSchedule(time.Hour, time.Minute),
+		NetsizeSampling(sampleFunc(func() { sampled <- struct{}{} })))
+	_, err = d.networkSize(ctx)
+	require.Error(t, err)
+	select {
+	case <-sampled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("netsize gathering not triggered")
+	}
+}
+
+func TestNetsizeObservations(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false, NetsizeEstimator(fixedNetsize(42)))
+	_, err := d.NetsizeObservations()
+	require.ErrorIs(t, err, routing.ErrNotSupported)
+
+	d = setupDHT(ctx, t, false)
+	obs, err := d.NetsizeObservations()
+	require.NoError(t, err)
+	require.Empty(t, obs)
+
+	peers := make([]peer.ID, d.bucketSize)
+	for i := range peers {
+		peers[i] = peer.ID(fmt.Sprint("peer", i))
+	}
+	key := string(d.self)
+	require.NoError(t, d.nsEstimator.Track(key, peers))
+	obs, err = d.NetsizeObservations()
+	require.NoError(t, err)
+	require.Len(t, obs, d.bucketSize)
+	for i, o := range obs {
+		require.Equal(t, i, o.Rank)
+		require.Equal(t, key, o.Key)
+		require.Equal(t, 256, o.CPL)
+		require.Equal(t, 0, o.BucketLevel)
+		require.Equal(t, netsize.NormedDistance(peers[i], ks.XORKeySpace.Key([]byte(key))), o.Distance)
+		require.False(t, o.Time.IsZero())
+	}
+}
+
+func TestAnalyzePeerSet(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false, NetsizeEstimator(fixedNetsize(1000)))
+
+	target := []byte("target")
+	peers := make([]peer.ID, 20)
+	for i := range peers {
+		peers[i] = peer.ID(fmt.Sprint("peer", i))
+	}
+	stats := d.AnalyzePeerSet(target, peers)
+
+	total := 0
+	for _, c := range stats.Counts {
+		total += c
+	}
+	require.Equal(t, len(peers), total)
+	require.Equal(t, 1000.0, stats.Netsize)
+	require.Len(t, stats.ZScores, len(stats.Counts))
+	expected := 0.0
+	for _, e := range stats.Expected {
+		expected += e
+	}
+	require.InDelta(t, len(peers), expected, 0.01)
+	// among 1000 peers, the closest 20 share about log2(1000/20) bits with the target, not a single one
+	require.Greater(t, stats.Expected[5], 1.0)
+	require.Less(t, stats.Expected[0], 0.01)
+
+	// peers all sharing no bits with the target are far from what's expected
+	far := make([]peer.ID, 0, len(peers))
+	targetKey := d.detector.Keyspace().Key(target)
+	for i := 0; len(far) < len(peers); i++ {
+		p := peer.ID(fmt.Sprint("far", i))
+		if d.detector.Keyspace().Key([]byte(p))[0]>>7 != targetKey[0]>>7 {
+			far = append(far, p)
+		}
+	}
+	stats = d.AnalyzePeerSet(target, far)
+	require.Equal(t, len(far), stats.Counts[0])
+	require.Greater(t, stats.ZScores[0], 3.0)
+
+	d = setupDHT(ctx, t, false)
+	stats = d.AnalyzePeerSet(target, peers)
+	require.Nil(t, stats.Expected)
+	require.Nil(t, stats.ZScores)
+}
+
+// eclipsingPeers returns defaultEclipseDetectionK peer IDs sharing at least cpl bits with key in the keyspace of the
+// detector of d.
+func eclipsingPeers(d *IpfsDHT, key multihash.Multihash, cpl int) []peer.ID {
+	space := d.detector.Keyspace()
+	target := space.Key(key)
+	peers := make([]peer.ID, 0, defaultEclipseDetectionK)
+	for i := 0; len(peers) < defaultEclipseDetectionK; i++ {
+		p := peer.ID(fmt.Sprint("eclipse", i))
+		if kb.CommonPrefixLen(space.Key([]byte(p)), target) >= cpl {
+			peers = append(peers, p)
+		}
+	}
+	return peers
+}
+
+func TestEclipseDetectionTest(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false, NetsizeEstimator(fixedNetsize(1000)),
+		EclipseDetectionTest(detection.TestChiSquare, 0.01))
+	defer d.Close()
+
+	// peers all sharing at least 12 bits with the key, far more than among 1000 peers
+	key := testCaseCids[0].Hash()
+	peers := eclipsingPeers(d, key, 12)
+
+	report, err := d.EclipseDetectionReport(ctx, key, peers)
+	require.NoError(t, err)
+	require.Equal(t, detection.TestChiSquare, report.Test)
+	require.Len(t, report.Tests, len(detection.Tests))
+	for i, res := range report.Tests {
+		require.Equal(t, detection.Tests[i], res.Test)
+		if res.Test == detection.TestChiSquare {
+			require.True(t, res.Attack)
+			require.Less(t, res.PValue, 0.01)
+		}
+	}
+	require.True(t, report.Attack)
+
+	attack, err := d.EclipseDetection(ctx, key, peers)
+	require.NoError(t, err)
+	require.True(t, attack)
+}
+
+func TestBayesianEclipseDetection(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false, NetsizeEstimator(fixedNetsize(1000)),
+		EclipseDetectionTest(detection.TestChiSquare, 0.01), BayesianEclipseDetection(DefaultBayesianDetectionParams))
+	defer d.Close()
+
+	key := testCaseCids[0].Hash()
+	peers := eclipsingPeers(d, key, 12)
+
+	// a single suspicious sample isn't an attack
+	report, err := d.EclipseDetectionReport(ctx, key, peers)
+	require.NoError(t, err)
+	require.NotNil(t, report.Posterior)
+	require.True(t, report.Tests[detection.TestChiSquare].Attack)
+	require.False(t, report.Attack)
+
+	// repeated ones are
+	for i := 0; i < 4; i++ {
+		report, err = d.EclipseDetectionReport(ctx, key, peers)
+		require.NoError(t, err)
+	}
+	require.True(t, report.Attack)
+	posterior, err := d.AttackPosterior(string(key))
+	require.NoError(t, err)
+	require.Equal(t, 5, posterior.Observations)
+	require.True(t, posterior.Attack)
+
+	// a key with a high prior is an attack from the first suspicious samples
+	other := testCaseCids[1].Hash()
+	require.NoError(t, d.SetAttackPrior(string(other), 0.5))
+	attack, err := d.EclipseDetection(ctx, other, eclipsingPeers(d, other, 12))
+	require.NoError(t, err)
+	require.False(t, attack)
+	attack, err = d.EclipseDetection(ctx, other, eclipsingPeers(d, other, 12))
+	require.NoError(t, err)
+	require.True(t, attack)
+}
+
+func TestScanRegion(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	prefix := []byte{0xa5, 0xc0}
+	keys, err := regionKeys(prefix, 10, 8)
+	require.NoError(t, err)
+	require.Len(t, keys, 8)
+	for _, k := range keys {
+		id := kb.ConvertKey(string(k))
+		require.Equal(t, byte(0xa5), id[0])
+		require.Equal(t, byte(0xc0), id[1]&0xc0)
+	}
+
+	dhts := setupConnectedDHTS(t, ctx, 3, NetsizeEstimator(fixedNetsize(1000)))
+
+	_, err = dhts[0].ScanRegion(ctx, prefix, 17)
+	require.Error(t, err)
+	_, err = dhts[0].ScanRegion(ctx, make([]byte, 4), maxRegionScanCPL+1)
+	require.Error(t, err)
+	// the network is too small for the eclipse detector
+	_, err = dhts[0].ScanRegion(ctx, prefix, 10)
+	require.Error(t, err)
+}
+
+func TestProvideSalted(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 3)
+	connect(t, ctx, dhts[0], dhts[1])
+	connect(t, ctx, dhts[1], dhts[2])
+	publisher, client := dhts[0], dhts[2]
+
+	key := testCaseCids[0]
+	s := SaltSchedule{Active: 2, Max: 3}
+	_, err := publisher.ProvideSalted(ctx, key, SaltSchedule{Active: 2, Max: 1})
+	require.Error(t, err)
+	require.Equal(t, SaltedKey(key.Hash(), 1), SaltedKey(key.Hash(), 1))
+	require.NotEqual(t, SaltedKey(key.Hash(), 0), SaltedKey(key.Hash(), 1))
+
+	salts, err := publisher.ProvideSalted(ctx, key, s)
+	require.NoError(t, err)
+	require.Equal(t, []uint32{0, 1}, salts)
+	require.Eventually(t, func() bool {
+		provs, err := client.FindProvidersSalted(ctx, key, s)
+		return err == nil && len(provs) == 1 && provs[0].ID == publisher.self
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// an attacked salt is rotated, until no salt is left
+	publisher.detections.Report(AttackSignal{Key: string(SaltedKey(key.Hash(), 1)), Source: SignalEclipseDetection, Score: 1})
+	salts, err = publisher.ProvideSalted(ctx, key, s)
+	require.NoError(t, err)
+	require.Equal(t, []uint32{0, 2}, salts)
+	publisher.detections.Report(AttackSignal{Key: string(SaltedKey(key.Hash(), 2)), Source: SignalEclipseDetection, Score: 1})
+	salts, err = publisher.ProvideSalted(ctx, key, s)
+	require.NoError(t, err)
+	require.Equal(t, []uint32{0, 2}, salts)
+}
+
+func TestBootStrapWhenRTIsEmpty(t *testing.T) {
+	if detectrace.WithRace() {
+		t.Skip("skipping timing dependent test when race detector is running")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// create three boostrap peers each of which is connected to 1 other peer.
+	nBootStraps := 3
+	bootstrappers := setupDHTS(t, ctx, nBootStraps)
+	defer func() {
+		for i := 0; i < nBootStraps; i++ {
+			bootstrappers[i].Close()
+			defer bootstrappers[i].host.Close()
+		}
+	}()
+
+	bootstrapcons := setupDHTS(t, ctx, nBootStraps)
+	defer func() {
+		for i := 0; i < nBootStraps; i++ {
+			bootstrapcons[i].Close()
+			defer bootstrapcons[i].host.Close()
+		}
+	}()
+	for i := 0; i < nBootStraps; i++ {
+		connect(t, ctx, bootstrappers[i], bootstrapcons[i])
+	}
+
+	// convert the bootstrap addresses to a p2p address
+	bootstrapAddrs := make([]peer.AddrInfo, nBootStraps)
+	for i := 0; i < nBootStraps; i++ {
+		b := peer.AddrInfo{ID: bootstrappers[i].self,
+			Addrs: bootstrappers[i].host.Addrs()}
+		bootstrapAddrs[i] = b
+	}
+
+	{
+
+		// ----------------
+		// We will initialize a DHT with 1 bootstrapper, connect it to another DHT,
+		// then remove the latter from the Routing Table
+		// This should add the bootstrap peer and the peer that the bootstrap peer is conencted to
+		// to it's Routing Table.
+		// AutoRefresh needs to be enabled for this.
+
+		h1, err := bhost.NewHost(swarmt.GenSwarm(t, swarmt.OptDisableReuseport), new(bhost.HostOpts))
+		require.NoError(t, err)
+		dht1, err := New(
+			ctx,
+			h1,
+			testPrefix,
+			NamespacedValidator("v", blankValidator{}),
+			Mode(ModeServer),
+			BootstrapPeers(bootstrapAddrs[0]),
+		)
+		require.NoError(t, err)
+		dht2 := setupDHT(ctx, t, false)
 		defer func() {
 			dht1.host.Close()
 			dht2.host.Close()
@@ -2117,3 +3754,528 @@ func TestPreconnectedNodes(t *testing.T) {
 	require.Equal(t, len(peers), 1, "why is there more than one peer?")
 	require.Equal(t, h1.ID(), peers[0], "could not find peer")
 }
+
+func TestSelfTest(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	dhts := setupConnectedDHTS(t, ctx, 5)
+
+	report, err := dhts[0].SelfTest(ctx)
+	require.NoError(t, err)
+
+	checks := make(map[string]SelfTestCheck)
+	for _, c := range report.Checks {
+		checks[c.Name] = c
+	}
+	require.Len(t, checks, 5)
+	require.True(t, checks[SelfTestFindPeer].Passed, checks[SelfTestFindPeer].Err)
+	// the network is too small for the eclipse detector
+	require.False(t, checks[SelfTestEclipseDetection].Passed)
+	require.False(t, report.Passed())
+}
+
+func TestProvideFor(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	delegate := setupDHT(ctx, t, false)
+	server := setupDHT(ctx, t, false)
+	connect(t, ctx, delegate, server)
+
+	sk, _, err := crypto.GenerateEd25519Key(crand.Reader)
+	require.NoError(t, err)
+	providerID, err := peer.IDFromPrivateKey(sk)
+	require.NoError(t, err)
+	provider := peer.AddrInfo{ID: providerID, Addrs: []ma.Multiaddr{ma.StringCast("/ip4/1.2.3.4/tcp/4001")}}
+
+	hasProvider := func(key multihash.Multihash) bool {
+		provs, err := server.providerStore.GetProviders(ctx, key)
+		require.NoError(t, err)
+		for _, p := range provs {
+			if p.ID == providerID {
+				return true
+			}
+		}
+		return false
+	}
+
+	// without an authorization, the server refuses the third-party record
+	unauthorized := testCaseCids[0]
+	require.NoError(t, delegate.ProvideFor(ctx, unauthorized, provider))
+	require.Never(t, func() bool { return hasProvider(unauthorized.Hash()) }, 100*time.Millisecond, 10*time.Millisecond)
+
+	authorized := testCaseCids[1]
+	env, err := NewProviderAuthorization(sk, delegate.self, time.Now().Add(time.Hour), authorized.Hash())
+	require.NoError(t, err)
+	require.Error(t, server.AddProviderAuthorization(env), "authorization for another delegate must be refused")
+	require.NoError(t, delegate.AddProviderAuthorization(env))
+
+	require.NoError(t, delegate.ProvideFor(ctx, authorized, provider))
+	require.Eventually(t, func() bool { return hasProvider(authorized.Hash()) }, 5*time.Second, 10*time.Millisecond)
+
+	// the authorization only covers the given keys, the given delegate and its lifetime
+	now := time.Now()
+	require.NoError(t, verifyProviderAuthorization(env, delegate.self, authorized.Hash(), providerID, now))
+	require.Error(t, verifyProviderAuthorization(env, delegate.self, testCaseCids[2].Hash(), providerID, now))
+	require.Error(t, verifyProviderAuthorization(env, server.self, authorized.Hash(), providerID, now))
+	require.Error(t, verifyProviderAuthorization(env, delegate.self, authorized.Hash(), server.self, now))
+	require.Error(t, verifyProviderAuthorization(env, delegate.self, authorized.Hash(), providerID, now.Add(2*time.Hour)))
+	expired, err := NewProviderAuthorization(sk, delegate.self, now.Add(-time.Second))
+	require.NoError(t, err)
+	require.Error(t, verifyProviderAuthorization(expired, delegate.self, authorized.Hash(), providerID, now))
+
+	// expired authorizations are dropped when another one is registered
+	shortSK, _, err := crypto.GenerateEd25519Key(crand.Reader)
+	require.NoError(t, err)
+	shortLived, err := NewProviderAuthorization(shortSK, delegate.self, time.Now().Add(50*time.Millisecond))
+	require.NoError(t, err)
+	require.NoError(t, delegate.AddProviderAuthorization(shortLived))
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, delegate.AddProviderAuthorization(env))
+	delegate.providerAuthsLk.Lock()
+	require.Len(t, delegate.providerAuths, 1)
+	delegate.providerAuthsLk.Unlock()
+}
+
+func TestProvideCancellation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false)
+	key := testCaseCids[0].Hash()
+	fast, stuck := peer.ID("fast"), peer.ID("stuck")
+
+	// the stuck put ignores its context, like a write blocked on a stalled stream
+	release := make(chan struct{})
+	defer close(release)
+	putCtx, cancelPut := context.WithCancel(ctx)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancelPut()
+	}()
+	start := time.Now()
+	failed := d.putProviderRecords(putCtx, key, ProvideStrategyRegular, time.Now(), []peer.ID{fast, stuck}, func(_ context.Context, p peer.ID) error {
+		if p == stuck {
+			<-release
+		}
+		return nil
+	})
+	require.Less(t, time.Since(start), 5*time.Second, "the provide must return promptly once canceled")
+	require.Len(t, failed, 1)
+	require.ErrorIs(t, failed[stuck], context.Canceled)
+
+	// waiting for a concurrent provide is canceled too
+	require.NoError(t, d.lockProvides(ctx))
+	defer d.unlockProvides()
+	lockCtx, cancelLock := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancelLock()
+	require.ErrorIs(t, d.Provide(lockCtx, testCaseCids[0], true), context.DeadlineExceeded)
+}
+
+func TestMobileProfile(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// setupDHT passes the server mode after the profile, create the host directly
+	h, err := bhost.NewHost(swarmt.GenSwarm(t, swarmt.OptDisableReuseport), new(bhost.HostOpts))
+	require.NoError(t, err)
+	defer h.Close()
+	d, err := New(ctx, h, testPrefix, DisableAutoRefresh(), MobileProfile(), Concurrency(2))
+	require.NoError(t, err)
+	defer d.Close()
+
+	require.Equal(t, modeClient, d.getMode())
+	require.Equal(t, 2, d.alpha, "options after the profile must override it")
+	require.NotNil(t, d.provideQueue)
+	require.NotNil(t, d.powerState)
+
+	// provides are paced by the queue
+	d.provideQueue.provide = func(context.Context, cid.Cid, bool) error { return nil }
+	require.NoError(t, d.Provide(ctx, testCaseCids[0], true))
+	n, err := d.PendingProvides(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	require.False(t, d.queuesProvide(context.WithValue(ctx, queuedProvideKey{}, struct{}{})), "queued provides must run")
+
+	// netsize gathering is deferred until the device is charging and on Wi-Fi
+	d.GatherNetsizeData()
+	require.True(t, d.powerState.netsizePending)
+	d.PowerStateChanged(true, false)
+	require.True(t, d.powerState.netsizePending)
+	d.PowerStateChanged(true, true)
+	require.False(t, d.powerState.netsizePending)
+	require.False(t, d.deferNetsizeGathering())
+
+	// without low power mode, power state changes are ignored
+	regular := setupDHT(ctx, t, false)
+	regular.PowerStateChanged(false, false)
+	require.False(t, regular.deferNetsizeGathering())
+}
+
+func TestSelectProviderAddrs(t *testing.T) {
+	public := ma.StringCast("/ip4/1.2.3.4/tcp/4001")
+	private := ma.StringCast("/ip4/192.168.0.10/tcp/4001")
+	relay := ma.StringCast("/ip4/5.6.7.8/tcp/4001/p2p/QmZ7fyyGGaD4ejBaYnSShdKBAs8rmjMB3nKJmTnrLRqyXP/p2p-circuit")
+	all := []ma.Multiaddr{private, relay, public}
+
+	for _, tc := range []struct {
+		name   string
+		policy ProviderAddrPolicy
+		r      network.Reachability
+		addrs  []ma.Multiaddr
+		expect []ma.Multiaddr
+	}{
+		{"all", ProviderAddrsAll, network.ReachabilityPrivate, all, all},
+		{"direct only", ProviderAddrsDirectOnly, network.ReachabilityPrivate, all, []ma.Multiaddr{public, private}},
+		{"public", ProviderAddrsReachability, network.ReachabilityPublic, all, []ma.Multiaddr{public}},
+		{"private", ProviderAddrsReachability, network.ReachabilityPrivate, all, []ma.Multiaddr{relay, public}},
+		{"unknown", ProviderAddrsReachability, network.ReachabilityUnknown, all, []ma.Multiaddr{public}},
+		{"unknown without public addresses", ProviderAddrsReachability, network.ReachabilityUnknown, []ma.Multiaddr{private, relay}, []ma.Multiaddr{relay}},
+		{"private without relays", ProviderAddrsReachability, network.ReachabilityPrivate, []ma.Multiaddr{private}, []ma.Multiaddr{private}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.expect, selectProviderAddrs(tc.policy, tc.r, tc.addrs))
+		})
+	}
+}
+
+func TestProviderBehindNATFindable(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	relay := ma.StringCast("/ip4/5.6.7.8/tcp/4001/p2p/QmZ7fyyGGaD4ejBaYnSShdKBAs8rmjMB3nKJmTnrLRqyXP/p2p-circuit")
+	h, err := bhost.NewHost(swarmt.GenSwarm(t, swarmt.OptDisableReuseport), &bhost.HostOpts{
+		AddrsFactory: func(addrs []ma.Multiaddr) []ma.Multiaddr { return append(addrs, relay) },
+	})
+	require.NoError(t, err)
+	defer h.Close()
+	provider, err := New(ctx, h, testPrefix, DisableAutoRefresh(), Mode(ModeServer), ProviderAddrs(ProviderAddrsReachability))
+	require.NoError(t, err)
+	defer provider.Close()
+
+	dhts := setupDHTS(t, ctx, 2)
+	connect(t, ctx, provider, dhts[0])
+	connect(t, ctx, dhts[0], dhts[1])
+
+	// behind a NAT, the relay address is published instead of the loopback listen addresses
+	provider.setReachability(network.ReachabilityPrivate)
+	failed := provider.sendProviderRecords(ctx, testCaseCids[0].Hash(), ProvideStrategyRegular, time.Now(), []peer.ID{dhts[0].self})
+	require.Empty(t, failed)
+
+	provs, err := dhts[1].FindProviders(ctx, testCaseCids[0])
+	require.NoError(t, err)
+	require.Len(t, provs, 1)
+	require.Equal(t, provider.self, provs[0].ID)
+	// the provider's peers also return the addresses they are connected to it on
+	require.Contains(t, provs[0].Addrs, relay)
+}
+
+func TestCompressedProviderRecords(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	provider := setupDHT(ctx, t, false, CompressProviderRecords(), ProviderRecordMaxAddrs(1))
+	d := setupDHT(ctx, t, false)
+	connect(t, ctx, provider, d)
+
+	mh := testCaseCids[0].Hash()
+	failed := provider.sendProviderRecords(ctx, mh, ProvideStrategyRegular, time.Now(), []peer.ID{d.self})
+	require.Empty(t, failed)
+
+	require.Eventually(t, func() bool {
+		provs, err := d.providerStore.GetProviders(ctx, mh)
+		return err == nil && len(provs) == 1 && provs[0].ID == provider.self
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestSearchValueExtendedDetection(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupConnectedDHTS(t, ctx, 3)
+
+	search := func(key string, opts ...routing.Option) (values [][]byte, detection *ValueDetection) {
+		ctxT, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		results, err := dhts[0].SearchValueExtended(ctxT, key, opts...)
+		require.NoError(t, err)
+		for r := range results {
+			if r.Detection != nil {
+				detection = r.Detection
+				continue
+			}
+			require.NotEmpty(t, r.From)
+			values = append(values, r.Value)
+		}
+		return values, detection
+	}
+	store := func(d *IpfsDHT, key string, value []byte) {
+		rec := record.MakePutRecord(key, value)
+		rec.TimeReceived = u.FormatRFC3339(time.Now())
+		require.NoError(t, d.putLocal(ctx, key, rec))
+	}
+
+	// a single peer holds the value, the quorum can't be met
+	key := "/v/quorum"
+	store(dhts[1], key, []byte("value"))
+	values, detection := search(key, Quorum(5))
+	require.Equal(t, [][]byte{[]byte("value")}, values)
+	require.NotNil(t, detection)
+	require.Equal(t, DetectionReasonQuorumNotMet, detection.Reason)
+	// the network is too small for a verdict
+	require.Error(t, detection.Err)
+
+	// peers return conflicting values
+	key = "/v/conflict"
+	store(dhts[1], key, []byte("a"))
+	store(dhts[2], key, []byte("b"))
+	_, detection = search(key)
+	require.NotNil(t, detection)
+	require.Equal(t, DetectionReasonConflictingValues, detection.Reason)
+
+	// a value found without conflicts needs no detection
+	key = "/v/agreed"
+	store(dhts[1], key, []byte("value"))
+	store(dhts[2], key, []byte("value"))
+	_, detection = search(key)
+	require.Nil(t, detection)
+}
+
+func TestConflictEvents(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupConnectedDHTS(t, ctx, 3)
+
+	store := func(d *IpfsDHT, key string, value []byte) {
+		rec := record.MakePutRecord(key, value)
+		rec.TimeReceived = u.FormatRFC3339(time.Now())
+		require.NoError(t, d.putLocal(ctx, key, rec))
+	}
+	search := func(key string) (best []byte, events []*ConflictEvent) {
+		ctxT, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		ectx, conflicts := RegisterForConflictEvents(ctxT)
+		best, err := dhts[0].GetValue(ectx, key, Quorum(2))
+		require.NoError(t, err)
+		cancel()
+		for ev := range conflicts {
+			events = append(events, ev)
+		}
+		return best, events
+	}
+
+	key := "/v/conflict"
+	store(dhts[1], key, []byte("a"))
+	store(dhts[2], key, []byte("b"))
+	best, events := search(key)
+	require.Len(t, events, 1)
+	ev := events[0]
+	require.Equal(t, key, ev.Key)
+	require.Len(t, ev.Values, 2)
+	var peers []peer.ID
+	for _, v := range ev.Values {
+		require.Len(t, v.Peers, 1)
+		peers = append(peers, v.Peers...)
+	}
+	require.ElementsMatch(t, []peer.ID{dhts[1].self, dhts[2].self}, peers)
+	selected, err := multihash.Sum(best, multihash.SHA2_256, -1)
+	require.NoError(t, err)
+	require.Equal(t, selected, ev.Selected)
+
+	// agreeing peers cause no conflict
+	key = "/v/agreed"
+	store(dhts[1], key, []byte("value"))
+	store(dhts[2], key, []byte("value"))
+	_, events = search(key)
+	require.Empty(t, events)
+}
+
+func TestMirrorLimiter(t *testing.T) {
+	l := newMirrorLimiter(1000, 2)
+	p1, p2 := peer.ID("p1"), peer.ID("p2")
+
+	require.True(t, l.allow(p1))
+	require.True(t, l.allow(p1))
+	require.False(t, l.allow(p1), "expected the burst to be exhausted")
+	// peers are limited independently
+	require.True(t, l.allow(p2))
+
+	require.Eventually(t, func() bool { return l.allow(p1) }, time.Second, time.Millisecond)
+
+	_, err := New(context.Background(), setupDHT(context.Background(), t, false).host, ValueMirroring(0, 1))
+	require.Error(t, err)
+}
+
+func TestTenantQuotas(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false, TenantQuotas(
+		map[string]TenantQuota{"bulk": {LookupRate: 0.001, LookupBurst: 2}},
+		TenantQuota{LookupRate: 1000, LookupBurst: 10},
+	))
+	connect(t, ctx, d, setupDHT(ctx, t, false))
+
+	bulk := WithTenant(ctx, "bulk")
+	for i := 0; i < 2; i++ {
+		_, err := d.GetClosestPeers(bulk, "foo")
+		require.NoError(t, err)
+	}
+	_, err := d.GetClosestPeers(bulk, "foo")
+	var qerr *QuotaExceededError
+	require.ErrorAs(t, err, &qerr)
+	require.Equal(t, "bulk", qerr.Tenant)
+	require.Equal(t, quotaOpLookup, qerr.Operation)
+	_, err = d.FindPeer(bulk, peer.ID("nope"))
+	require.ErrorAs(t, err, &qerr)
+
+	// other tenants and unlabeled lookups are not affected
+	_, err = d.GetClosestPeers(WithTenant(ctx, "other"), "foo")
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err = d.GetClosestPeers(ctx, "foo")
+		require.NoError(t, err)
+	}
+
+	_, err = New(ctx, setupDHT(ctx, t, false).host, TenantQuotas(nil, TenantQuota{ProvideRate: 1}))
+	require.Error(t, err)
+}
+
+func TestLoadShedding(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the lowest priorities are shed first, pings never
+	for _, tc := range []struct {
+		pressure float64
+		shed     int
+	}{{0.9, 0}, {1, 1}, {1.3, 2}, {1.5, 3}, {1.75, 4}, {100, 4}} {
+		for prio := priorityFarProviders; prio <= priorityPing; prio++ {
+			require.Equal(t, prio < tc.shed, shedsPriority(tc.pressure, prio), "pressure %v, priority %d", tc.pressure, prio)
+		}
+	}
+
+	_, err := New(ctx, nil, LoadShedding(LoadSheddingThresholds{}))
+	require.Error(t, err)
+
+	// a single goroutine is always exceeded
+	server := setupDHT(ctx, t, false, LoadShedding(LoadSheddingThresholds{Goroutines: 1}))
+	client := setupDHT(ctx, t, false)
+	connect(t, ctx, client, server)
+
+	_, err = client.protoMessenger.GetClosestPeers(ctx, server.self, client.self)
+	require.ErrorIs(t, err, ErrBusy)
+	require.NoError(t, client.protoMessenger.Ping(ctx, server.self))
+
+	// busy peers are kept in the routing table
+	_, _ = client.GetClosestPeers(ctx, "key")
+	require.Equal(t, server.self, client.routingTable.Find(server.self))
+
+	status, ok := server.LoadSheddingStatus()
+	require.True(t, ok)
+	require.Greater(t, status.Pressure, 1.0)
+	require.Greater(t, status.Goroutines, 1)
+	require.GreaterOrEqual(t, status.Shed, uint64(2))
+	_, ok = client.LoadSheddingStatus()
+	require.False(t, ok)
+}
+
+func TestRequestPrioritization(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := newRequestScheduler(1)
+	require.NoError(t, s.acquire(ctx, 0))
+
+	waiting := func(n int) func() bool {
+		return func() bool {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			return len(s.waiting) == n
+		}
+	}
+	// a cancelled request gives up its place
+	cctx, ccancel := context.WithCancel(ctx)
+	cancelled := make(chan error, 1)
+	go func() { cancelled <- s.acquire(cctx, 100) }()
+	require.Eventually(t, waiting(1), 5*time.Second, 10*time.Millisecond)
+	ccancel()
+	require.ErrorIs(t, <-cancelled, context.Canceled)
+	require.True(t, waiting(0)())
+
+	// slots go to the closest keys first
+	order := make(chan int, 3)
+	for i, cpl := range []int{1, 5, 3} {
+		go func(cpl int) {
+			if s.acquire(ctx, cpl) == nil {
+				order <- cpl
+			}
+		}(cpl)
+		require.Eventually(t, waiting(i+1), 5*time.Second, 10*time.Millisecond)
+	}
+	for _, cpl := range []int{5, 3, 1} {
+		s.release()
+		require.Equal(t, cpl, <-order)
+	}
+	s.release()
+	require.Equal(t, 0, s.running)
+
+	_, err := New(ctx, nil, RequestPrioritization(0))
+	require.Error(t, err)
+
+	server := setupDHT(ctx, t, false, RequestPrioritization(1))
+	client := setupDHT(ctx, t, false)
+	connect(t, ctx, client, server)
+	_, err = client.protoMessenger.GetClosestPeers(ctx, server.self, client.self)
+	require.NoError(t, err)
+	require.Equal(t, keylessRequestCPL, server.requestCPL(pb.NewMessage(pb.Message_PING, nil, 0)))
+	require.Equal(t, 256, server.requestCPL(pb.NewMessage(pb.Message_FIND_NODE, []byte(server.self), 0)))
+}
+
+func TestConfigSnapshot(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false, BucketSize(10), Concurrency(5), Resiliency(2))
+	cs := d.Config()
+	require.EqualValues(t, "/test", cs.ProtocolPrefix)
+	require.Len(t, cs.Protocols, 1)
+	require.Equal(t, cs.ProtocolPrefix+kad1, cs.Protocols[0])
+	require.Equal(t, ModeServer, cs.Mode)
+	require.True(t, cs.Server)
+	require.Equal(t, 10, cs.BucketSize)
+	require.Equal(t, 5, cs.Alpha)
+	require.Equal(t, 2, cs.Beta)
+	require.Equal(t, enableSpecialProvide, cs.SpecialProvide)
+	require.Equal(t, d.getSpecialProvideNumber(), cs.SpecialProvideNumber)
+	require.Equal(t, defaultEclipseDetectionK, cs.Detector.K)
+	require.Equal(t, d.detectionKeyspace.Bits(), cs.Detector.KeyspaceBits)
+}
+
+func TestReconfigure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false, EnableProvideQueue(2, 0))
+	threshold, special, workers, interval := 1.5, 40, 4, time.Minute
+
+	// an invalid change fails the whole call
+	badWorkers := 0
+	require.Error(t, d.Reconfigure(ctx, ConfigChanges{SpecialProvideNumber: &special, ProvideWorkers: &badWorkers}))
+	require.Equal(t, 20, d.getSpecialProvideNumber())
+
+	require.NoError(t, d.Reconfigure(ctx, ConfigChanges{
+		DetectionThreshold:   &threshold,
+		SpecialProvideNumber: &special,
+		ProvideWorkers:       &workers,
+		RefreshInterval:      &interval,
+	}))
+	require.Equal(t, threshold, d.getDetectionThreshold())
+	require.Equal(t, special, d.getSpecialProvideNumber())
+	require.EqualValues(t, workers, atomic.LoadInt32(&d.provideQueue.workers))
+
+	// the provide queue must be enabled to change its workers
+	require.Error(t, setupDHT(ctx, t, false).Reconfigure(ctx, ConfigChanges{ProvideWorkers: &workers}))
+}
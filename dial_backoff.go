@@ -0,0 +1,98 @@
+package dht
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// maxDialBackoffEntries bounds the number of peers the dial backoff registry keeps track of.
+const maxDialBackoffEntries = 10_000
+
+// errDialBackoff is returned when dialing a peer that is backed off after failed dials.
+var errDialBackoff = errors.New("peer is backed off after failed dials")
+
+type dialBackoffEntry struct {
+	failures    int
+	lastFailure time.Time
+	until       time.Time
+}
+
+// dialBackoff keeps track of the peers that recently failed to dial, so that lookups skip them instead of dialing
+// them again on every query. The backoff doubles with every consecutive failure up to max; failures decay, i.e. are
+// forgotten, once a peer hasn't failed for max.
+type dialBackoff struct {
+	base, max time.Duration
+	clock     clock.Clock
+
+	mu    sync.Mutex
+	peers map[peer.ID]*dialBackoffEntry
+}
+
+func newDialBackoff(base, max time.Duration, clk clock.Clock) *dialBackoff {
+	return &dialBackoff{
+		base:  base,
+		max:   max,
+		clock: clk,
+		peers: make(map[peer.ID]*dialBackoffEntry),
+	}
+}
+
+// backedOff returns true if p must not be dialed yet.
+func (b *dialBackoff) backedOff(p peer.ID) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e, ok := b.peers[p]
+	return ok && b.clock.Now().Before(e.until)
+}
+
+// failed records a failed dial of p and backs it off.
+func (b *dialBackoff) failed(p peer.ID) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.clock.Now()
+	e, ok := b.peers[p]
+	if !ok {
+		if len(b.peers) >= maxDialBackoffEntries {
+			b.prune(now)
+		}
+		e = new(dialBackoffEntry)
+		b.peers[p] = e
+	} else if now.Sub(e.lastFailure) > b.max {
+		e.failures = 0
+	}
+
+	e.failures++
+	backoff := b.base
+	for i := 1; i < e.failures && backoff < b.max; i++ {
+		backoff *= 2
+	}
+	if backoff > b.max {
+		backoff = b.max
+	}
+	e.lastFailure = now
+	e.until = now.Add(backoff)
+}
+
+// succeeded forgets the failed dials of p.
+func (b *dialBackoff) succeeded(p peer.ID) {
+	b.mu.Lock()
+	delete(b.peers, p)
+	b.mu.Unlock()
+}
+
+// prune drops the peers whose failures have decayed, or all of them if that isn't enough to make room.
+func (b *dialBackoff) prune(now time.Time) {
+	for p, e := range b.peers {
+		if now.Sub(e.lastFailure) > b.max {
+			delete(b.peers, p)
+		}
+	}
+	if len(b.peers) >= maxDialBackoffEntries {
+		b.peers = make(map[peer.ID]*dialBackoffEntry)
+	}
+}
@@ -0,0 +1,194 @@
+package detection
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// maxLogOdds bounds the log-odds of a posterior, so that no amount of evidence makes it certain and it can always
+	// be revised.
+	maxLogOdds = 20
+	// DefaultMaxBayesianKeys is the number of keys a BayesianDetector keeps posteriors for by default.
+	DefaultMaxBayesianKeys = 16384
+)
+
+// Likelihood describes a source of observations of a key, e.g. a single-shot test of the detector or an auditor, by
+// the probabilities that it reports an attack when the key is under attack and when it isn't.
+type Likelihood struct {
+	TruePositive  float64
+	FalsePositive float64
+}
+
+// Validate checks that both probabilities are in (0, 1) and that the source is informative.
+func (l Likelihood) Validate() error {
+	if l.TruePositive <= 0 || l.TruePositive >= 1 || l.FalsePositive <= 0 || l.FalsePositive >= 1 {
+		return fmt.Errorf("likelihood probabilities must be in (0, 1)")
+	}
+	if l.TruePositive <= l.FalsePositive {
+		return fmt.Errorf("likelihood true positive rate must exceed its false positive rate")
+	}
+	return nil
+}
+
+// logRatio returns the log of the likelihood ratio of an attack given the observation.
+func (l Likelihood) logRatio(positive bool) float64 {
+	if positive {
+		return math.Log(l.TruePositive / l.FalsePositive)
+	}
+	return math.Log((1 - l.TruePositive) / (1 - l.FalsePositive))
+}
+
+// Posterior is the probability that a key is under attack given the observations of it.
+type Posterior struct {
+	Probability float64
+	// Observations is the number of observations of the key.
+	Observations int
+	// Attack is set if Probability reaches the threshold of the detector.
+	Attack bool
+}
+
+// BayesianDetector maintains per key posterior probabilities of attack, updated with every observation of a key
+// rather than deciding on a single sample, so that one unlucky sample of an honest key doesn't raise an alarm while
+// repeated suspicious ones do. Observations age: with a half-life, the posterior of a key drifts back to its prior
+// as its observations get older. BayesianDetector is safe for concurrent use.
+type BayesianDetector struct {
+	prior     float64
+	threshold float64
+	halfLife  time.Duration
+	maxKeys   int
+
+	mu sync.Mutex
+	// priors are the priors of keys differing from the default prior
+	priors     map[string]float64
+	posteriors map[string]*keyPosterior
+}
+
+type keyPosterior struct {
+	logOdds      float64
+	observations int
+	updated      time.Time
+}
+
+// NewBayesianDetector returns a detector starting keys at the prior probability of attack and detecting an attack
+// once the posterior reaches threshold. Observations don't age if halfLife is 0.
+func NewBayesianDetector(prior, threshold float64, halfLife time.Duration) (*BayesianDetector, error) {
+	if prior <= 0 || prior >= 1 {
+		return nil, fmt.Errorf("prior must be in (0, 1)")
+	}
+	if threshold <= prior || threshold >= 1 {
+		return nil, fmt.Errorf("threshold must be in (prior, 1)")
+	}
+	if halfLife < 0 {
+		return nil, fmt.Errorf("half-life must not be negative")
+	}
+	return &BayesianDetector{
+		prior:      prior,
+		threshold:  threshold,
+		halfLife:   halfLife,
+		maxKeys:    DefaultMaxBayesianKeys,
+		priors:     make(map[string]float64),
+		posteriors: make(map[string]*keyPosterior),
+	}, nil
+}
+
+func logOdds(p float64) float64 {
+	return math.Log(p / (1 - p))
+}
+
+func probability(logOdds float64) float64 {
+	return 1 / (1 + math.Exp(-logOdds))
+}
+
+// SetPrior sets the prior probability of attack of key, e.g. higher for valuable keys. It applies to the future
+// observations of the key, and to its past ones if the key has any.
+func (b *BayesianDetector) SetPrior(key string, prior float64) error {
+	if prior <= 0 || prior >= 1 {
+		return fmt.Errorf("prior must be in (0, 1)")
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	old := b.priorLocked(key)
+	b.priors[key] = prior
+	if kp, ok := b.posteriors[key]; ok {
+		kp.logOdds += logOdds(prior) - logOdds(old)
+	}
+	return nil
+}
+
+func (b *BayesianDetector) priorLocked(key string) float64 {
+	if p, ok := b.priors[key]; ok {
+		return p
+	}
+	return b.prior
+}
+
+// decay ages the observations of kp until now.
+func (b *BayesianDetector) decay(kp *keyPosterior, prior float64, now time.Time) {
+	if b.halfLife <= 0 || !now.After(kp.updated) {
+		return
+	}
+	base := logOdds(prior)
+	kp.logOdds = base + (kp.logOdds-base)*math.Pow(0.5, float64(now.Sub(kp.updated))/float64(b.halfLife))
+	kp.updated = now
+}
+
+func (b *BayesianDetector) posterior(kp *keyPosterior) Posterior {
+	p := probability(kp.logOdds)
+	return Posterior{Probability: p, Observations: kp.observations, Attack: p >= b.threshold}
+}
+
+// Observe updates the posterior of key with an observation, positive if it suggests an attack, from a source
+// described by l, and returns the new posterior.
+func (b *BayesianDetector) Observe(key string, positive bool, l Likelihood, now time.Time) Posterior {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	prior := b.priorLocked(key)
+	kp, ok := b.posteriors[key]
+	if !ok {
+		if len(b.posteriors) >= b.maxKeys {
+			b.evictLocked()
+		}
+		kp = &keyPosterior{logOdds: logOdds(prior), updated: now}
+		b.posteriors[key] = kp
+	}
+	b.decay(kp, prior, now)
+	kp.logOdds = math.Max(-maxLogOdds, math.Min(maxLogOdds, kp.logOdds+l.logRatio(positive)))
+	kp.observations++
+	kp.updated = now
+	return b.posterior(kp)
+}
+
+// evictLocked forgets the key observed the longest ago. b.mu must be held.
+func (b *BayesianDetector) evictLocked() {
+	var oldest string
+	var oldestTime time.Time
+	for k, kp := range b.posteriors {
+		if oldest == "" || kp.updated.Before(oldestTime) {
+			oldest, oldestTime = k, kp.updated
+		}
+	}
+	delete(b.posteriors, oldest)
+}
+
+// Posterior returns the posterior of key at now, its prior if it was never observed.
+func (b *BayesianDetector) Posterior(key string, now time.Time) Posterior {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	prior := b.priorLocked(key)
+	kp, ok := b.posteriors[key]
+	if !ok {
+		return b.posterior(&keyPosterior{logOdds: logOdds(prior)})
+	}
+	b.decay(kp, prior, now)
+	return b.posterior(kp)
+}
+
+// Forget drops the observations of key, e.g. once an attack on it was dealt with. Its prior is kept.
+func (b *BayesianDetector) Forget(key string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.posteriors, key)
+}
@@ -1,7 +1,10 @@
 package detection
 
 import (
+	"fmt"
 	"math"
+	"math/bits"
+	"sync"
 
 	"gonum.org/v1/gonum/stat/distuv"
 
@@ -9,26 +12,75 @@ import (
 	kb "github.com/libp2p/go-libp2p-kbucket" // common prefix length of two IDs
 )
 
+// Keyspace maps identifiers (peer IDs and content keys) to the keys the prefix analysis is performed on.
+type Keyspace interface {
+	// Key returns the keyspace representation of id.
+	Key(id []byte) []byte
+	// Bits is the length of the keys returned by Key in bits.
+	Bits() int
+}
+
+// SHA256Keyspace is the keyspace of the DHT: identifiers are hashed with SHA-256 into 256-bit keys.
+var SHA256Keyspace Keyspace = sha256Keyspace{}
+
+type sha256Keyspace struct{}
+
+func (sha256Keyspace) Key(id []byte) []byte { return kb.ConvertKey(string(id)) }
+func (sha256Keyspace) Bits() int            { return 256 }
+
+// TruncatedKeyspace returns a keyspace that keeps only the first bits bits of the keys of base, e.g. to run the
+// detector on test keyspaces with short keys. bits must be a positive multiple of 8 no larger than base.Bits().
+func TruncatedKeyspace(base Keyspace, bits int) (Keyspace, error) {
+	if bits <= 0 || bits%8 != 0 || bits > base.Bits() {
+		return nil, fmt.Errorf("invalid truncated keyspace length %d, must be a positive multiple of 8 up to %d", bits, base.Bits())
+	}
+	return truncatedKeyspace{base: base, bits: bits}, nil
+}
+
+type truncatedKeyspace struct {
+	base Keyspace
+	bits int
+}
+
+func (t truncatedKeyspace) Key(id []byte) []byte { return t.base.Key(id)[:t.bits/8] }
+func (t truncatedKeyspace) Bits() int            { return t.bits }
+
 type EclipseDetector struct {
 	k            int
+	keyspace     Keyspace
+	keySize      int
 	idealDist    []float64
-	l            int
-	threshold    float64
 	thresholdMap map[int]float64
+
+	// mu guards the parameters below, which are updated while the detector is in use
+	mu        sync.RWMutex
+	l         int
+	threshold float64
+	// significance is the significance level of the chi-square and Kolmogorov-Smirnov tests
+	significance float64
 }
 
 const (
-	keySize              = 256
 	eps                  = 0.001
 	thresholdMapInterval = 1000
 )
 
+// New returns a detector for the k closest peers to a key in the SHA-256 keyspace of the DHT.
 func New(k int) *EclipseDetector {
+	return NewWithKeyspace(k, SHA256Keyspace)
+}
+
+// NewWithKeyspace returns a detector for the k closest peers to a key in the given keyspace.
+func NewWithKeyspace(k int, ks Keyspace) *EclipseDetector {
+	keySize := ks.Bits()
 	det := &EclipseDetector{
-		k:         k,
-		idealDist: make([]float64, keySize),
-		l:         0,
-		threshold: math.Inf(1), // by default, say there are no attacks
+		k:            k,
+		keyspace:     ks,
+		keySize:      keySize,
+		idealDist:    make([]float64, keySize),
+		l:            0,
+		threshold:    math.Inf(1), // by default, say there are no attacks
+		significance: DefaultSignificance,
 		thresholdMap: map[int]float64{
 			1000:  1.7657010851723764,
 			2000:  1.7817993072091078,
@@ -87,14 +139,60 @@ func New(k int) *EclipseDetector {
 	return det
 }
 
+// Keyspace returns the keyspace of the detector. Identifiers passed to the detector must be converted with it.
+func (det *EclipseDetector) Keyspace() Keyspace {
+	return det.keyspace
+}
+
+// K returns the number of closest peers to a key the detector analyses.
+func (det *EclipseDetector) K() int {
+	return det.k
+}
+
+// L returns the parameter l, as last updated.
+func (det *EclipseDetector) L() int {
+	det.mu.RLock()
+	defer det.mu.RUnlock()
+	return det.l
+}
+
+// Threshold returns the KL divergence above which an attack is detected, as last updated.
+func (det *EclipseDetector) Threshold() float64 {
+	det.mu.RLock()
+	defer det.mu.RUnlock()
+	return det.threshold
+}
+
+// Params are the parameters of the tests of an eclipse detection.
+type Params struct {
+	// L is the prefix length from which the prefix lengths are tested, see LFromNetsize.
+	L int
+	// Threshold is the KL divergence above which an attack is detected, see ThresholdFromNetsize.
+	Threshold float64
+	// Significance is the significance level of the chi-square and Kolmogorov-Smirnov tests.
+	Significance float64
+}
+
+// Params returns the parameters as last updated, read at once so that they are consistent with each other.
+func (det *EclipseDetector) Params() Params {
+	det.mu.RLock()
+	defer det.mu.RUnlock()
+	return Params{L: det.l, Threshold: det.threshold, Significance: det.significance}
+}
+
 func (det *EclipseDetector) UpdateL(l int) {
+	det.mu.Lock()
+	defer det.mu.Unlock()
 	det.l = l
 }
 
-func (det *EclipseDetector) UpdateLFromNetsize(n int) int {
-	orderPmfs := make([][]float64, det.k)
+// orderPmfs returns, for each of the k closest peers to a key among n uniformly distributed peers, the probability
+// mass function of its prefix length with the key.
+func (det *EclipseDetector) orderPmfs(n, k int) [][]float64 {
+	keySize := det.keySize
+	orderPmfs := make([][]float64, k)
 	s := make([]float64, keySize)
-	for i := 0; i < det.k; i++ {
+	for i := 0; i < k; i++ {
 		orderPmfs[i] = make([]float64, keySize)
 		for x := 0; x < keySize; x++ {
 			b := distuv.Binomial{
@@ -109,6 +207,28 @@ func (det *EclipseDetector) UpdateLFromNetsize(n int) int {
 			}
 		}
 	}
+	return orderPmfs
+}
+
+// ExpectedPrefixLenCounts returns the mean and the variance of the number of the k closest peers to a key among n
+// uniformly distributed peers that have each prefix length with the key. The variance neglects the correlation
+// between the peers.
+func (det *EclipseDetector) ExpectedPrefixLenCounts(n, k int) (mean, variance []float64) {
+	mean = make([]float64, det.keySize)
+	variance = make([]float64, det.keySize)
+	for _, pmf := range det.orderPmfs(n, k) {
+		for x, p := range pmf {
+			mean[x] += p
+			variance[x] += p * (1 - p)
+		}
+	}
+	return mean, variance
+}
+
+// LFromNetsize returns the parameter l for a network of n peers, without updating it.
+func (det *EclipseDetector) LFromNetsize(n int) int {
+	keySize := det.keySize
+	orderPmfs := det.orderPmfs(n, det.k)
 	for x := 0; x < keySize; x++ {
 		var avgPmfX float64
 		for i := 0; i < det.k; i++ {
@@ -116,43 +236,83 @@ func (det *EclipseDetector) UpdateLFromNetsize(n int) int {
 		}
 		avgPmfX /= float64(det.k)
 		if avgPmfX > eps {
-			det.l = x
 			return x
 		}
 	}
 	return keySize
 }
 
+func (det *EclipseDetector) UpdateLFromNetsize(n int) int {
+	l := det.LFromNetsize(n)
+	det.UpdateL(l)
+	return l
+}
+
 func (det *EclipseDetector) UpdateThreshold(threshold float64) {
+	det.mu.Lock()
+	defer det.mu.Unlock()
 	det.threshold = threshold
 }
 
-func (det *EclipseDetector) UpdateThresholdFromNetsize(n int) float64 {
+// ThresholdFromNetsize returns the threshold for a network of n peers, without updating it.
+func (det *EclipseDetector) ThresholdFromNetsize(n int) float64 {
 	key := int(math.Round(float64(n)/float64(thresholdMapInterval))) * thresholdMapInterval
-	t := det.thresholdMap[key]
-	det.threshold = t
+	return det.thresholdMap[key]
+}
+
+func (det *EclipseDetector) UpdateThresholdFromNetsize(n int) float64 {
+	t := det.ThresholdFromNetsize(n)
+	det.UpdateThreshold(t)
 	return t
 }
 
 func (det *EclipseDetector) ComputePrefixLenCounts(id []byte, closestIds [][]byte) []int { // How are peerids represented?
-	counts := make([]int, keySize)
+	counts := make([]int, det.keySize)
 	for _, cid := range closestIds {
-		prefixLen := kb.CommonPrefixLen(id, cid)
+		prefixLen := commonPrefixLen(id, cid)
+		if prefixLen >= det.keySize {
+			// identical keys
+			prefixLen = det.keySize - 1
+		}
 		counts[prefixLen]++
 	}
 	return counts
 }
 
+// commonPrefixLen is kb.CommonPrefixLen without allocating the XOR of a and b.
+func commonPrefixLen(a, b []byte) int {
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+	for i := 0; i < n; i++ {
+		if x := a[i] ^ b[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return n * 8
+}
+
 func (det *EclipseDetector) ComputeKL(id []byte, closestIds [][]byte) float64 {
 	return det.ComputeKLFromCounts(det.ComputePrefixLenCounts(id, closestIds))
 }
 
 func (det *EclipseDetector) ComputeKLFromCounts(prefixLenCounts []int) float64 {
+	return det.klFrom(prefixLenCounts, det.L())
+}
+
+// klFrom returns the KL divergence of prefixLenCounts from the ideal distribution of the prefix lengths of at least l.
+func (det *EclipseDetector) klFrom(prefixLenCounts []int, l int) float64 {
+	// the ideal distribution conditioned on a prefix length of at least l
+	norm := 1.0
+	if l > 0 {
+		norm = det.idealDist[l-1]
+	}
 	var kl float64
-	for p := det.l; p < keySize; p++ {
+	for p := l; p < det.keySize && p < len(prefixLenCounts); p++ {
 		if prefixLenCounts[p] > 0 {
 			prob := float64(prefixLenCounts[p]) / float64(det.k)
-			kl += prob * math.Log(prob/(det.idealDist[p]/det.idealDist[det.l-1]))
+			kl += prob * math.Log(prob/(det.idealDist[p]/norm))
 		}
 	}
 	return kl
@@ -160,13 +320,14 @@ func (det *EclipseDetector) ComputeKLFromCounts(prefixLenCounts []int) float64 {
 
 // Return true if attack detected, false if no attack
 func (det *EclipseDetector) DetectFromKL(kl float64) bool {
-	return kl > det.threshold
+	return kl > det.Threshold()
 }
 
 func (det *EclipseDetector) DetectFromCounts(prefixLenCounts []int) bool {
-	return det.ComputeKLFromCounts(prefixLenCounts) > det.threshold
+	params := det.Params()
+	return det.klFrom(prefixLenCounts, params.L) > params.Threshold
 }
 
 func (det *EclipseDetector) Detect(id []byte, closestIds [][]byte) bool {
-	return det.ComputeKL(id, closestIds) > det.threshold
+	return det.DetectFromCounts(det.ComputePrefixLenCounts(id, closestIds))
 }
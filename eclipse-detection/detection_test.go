@@ -0,0 +1,161 @@
+package detection
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestComputeKLWithoutL(t *testing.T) {
+	det := New(20)
+	counts := make([]int, 256)
+	counts[0] = 10
+	counts[1] = 10
+
+	kl := det.ComputeKLFromCounts(counts)
+	if math.IsNaN(kl) || math.IsInf(kl, 0) {
+		t.Fatalf("unexpected KL divergence %f", kl)
+	}
+}
+
+func TestTruncatedKeyspace(t *testing.T) {
+	for _, bits := range []int{0, 12, 264} {
+		if _, err := TruncatedKeyspace(SHA256Keyspace, bits); err == nil {
+			t.Fatalf("accepted truncated keyspace length %d", bits)
+		}
+	}
+
+	ks, err := TruncatedKeyspace(SHA256Keyspace, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ks.Bits() != 16 || len(ks.Key([]byte("foo"))) != 2 {
+		t.Fatal("truncated keyspace has wrong key length")
+	}
+
+	det := NewWithKeyspace(3, ks)
+	target := ks.Key([]byte("foo"))
+	counts := det.ComputePrefixLenCounts(target, [][]byte{target, ks.Key([]byte("bar")), ks.Key([]byte("baz"))})
+	if len(counts) != 16 {
+		t.Fatalf("expected 16 prefix lengths, got %d", len(counts))
+	}
+	total := 0
+	for _, c := range counts {
+		total += c
+	}
+	if total != 3 {
+		t.Fatalf("expected 3 peers to be counted, got %d", total)
+	}
+
+	if l := det.UpdateLFromNetsize(100); l >= 16 {
+		t.Fatalf("l out of range: %d", l)
+	}
+	det.ComputeKLFromCounts(counts)
+}
+
+func TestAlternativeTests(t *testing.T) {
+	det := New(20)
+	det.UpdateL(10)
+	det.UpdateThreshold(1)
+
+	ideal := make([]int, 256)
+	ideal[10], ideal[11], ideal[12], ideal[13], ideal[14] = 10, 5, 3, 1, 1
+	for _, res := range det.RunTests(ideal) {
+		if res.Attack {
+			t.Fatalf("%s test detected an attack on the ideal distribution: %+v", res.Test, res)
+		}
+	}
+
+	eclipsed := make([]int, 256)
+	eclipsed[24], eclipsed[25] = 12, 8
+	for _, res := range det.RunTests(eclipsed) {
+		if !res.Attack {
+			t.Fatalf("%s test missed an attack: %+v", res.Test, res)
+		}
+		if res.Test != TestKL && (res.PValue < 0 || res.PValue >= det.Significance()) {
+			t.Fatalf("%s test has unexpected p-value %f", res.Test, res.PValue)
+		}
+	}
+
+	// the given parameters are used instead of the detector's
+	params := Params{L: 10, Threshold: math.Inf(1), Significance: 1e-300}
+	for _, res := range det.RunTestsWithParams(eclipsed, params) {
+		if res.Test == TestKL && res.Attack {
+			t.Fatalf("%s test ignored the given threshold: %+v", res.Test, res)
+		}
+	}
+	if det.Threshold() != 1 {
+		t.Fatalf("running tests with parameters changed the threshold to %f", det.Threshold())
+	}
+
+	for _, alpha := range []float64{0, 1, -0.5, 2} {
+		if err := det.UpdateSignificance(alpha); err == nil {
+			t.Fatalf("significance %f accepted", alpha)
+		}
+	}
+	if det.Significance() != DefaultSignificance {
+		t.Fatalf("invalid significance changed it to %f", det.Significance())
+	}
+}
+
+func TestBayesianDetector(t *testing.T) {
+	b, err := NewBayesianDetector(0.01, 0.9, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := Likelihood{TruePositive: 0.8, FalsePositive: 0.1}
+	now := time.Now()
+
+	// a single unlucky sample isn't an attack
+	if p := b.Observe("key", true, l, now); p.Attack || p.Observations != 1 {
+		t.Fatalf("single positive observation detected an attack: %+v", p)
+	}
+	// repeated ones are
+	var p Posterior
+	for i := 0; i < 4; i++ {
+		p = b.Observe("key", true, l, now)
+	}
+	if !p.Attack {
+		t.Fatalf("repeated positive observations missed an attack: %+v", p)
+	}
+	// and are forgotten over time
+	if later := b.Posterior("key", now.Add(24*time.Hour)); later.Attack || later.Probability > 0.02 {
+		t.Fatalf("observations did not age: %+v", later)
+	}
+
+	// a higher prior takes fewer observations
+	if err := b.SetPrior("valuable", 0.5); err != nil {
+		t.Fatal(err)
+	}
+	b.Observe("valuable", true, l, now)
+	if p := b.Observe("valuable", true, l, now); !p.Attack {
+		t.Fatalf("valuable key missed an attack: %+v", p)
+	}
+	if p := b.Posterior("other", now); math.Abs(p.Probability-0.01) > 1e-9 || p.Observations != 0 {
+		t.Fatalf("unobserved key does not have the prior: %+v", p)
+	}
+}
+
+func TestConcurrentParameterUpdates(t *testing.T) {
+	det := New(20)
+	counts := make([]int, 256)
+	counts[0] = 20
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; i <= 20; i++ {
+			det.UpdateLFromNetsize(i * 1000)
+			det.UpdateThresholdFromNetsize(i * 1000)
+			if err := det.UpdateSignificance(0.05); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		det.DetectFromCounts(counts)
+		det.RunTest(TestChiSquare, counts)
+		_, _ = det.L(), det.Threshold()
+	}
+	<-done
+}
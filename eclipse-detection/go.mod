@@ -5,6 +5,7 @@ go 1.19
 require (
 	github.com/ipfs/go-ipfs-util v0.0.2
 	github.com/libp2p/go-libp2p-kbucket v0.4.7
+	gonum.org/v1/gonum v0.12.0
 )
 
 require (
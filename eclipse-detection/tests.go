@@ -0,0 +1,241 @@
+package detection
+
+import (
+	"fmt"
+	"math"
+
+	"gonum.org/v1/gonum/stat/distuv"
+)
+
+// Test is a statistical test of the prefix length distribution of the closest peers to a key.
+type Test int
+
+const (
+	// TestKL compares the KL divergence of the prefix lengths from the ideal distribution to a threshold derived from
+	// the network size, see EclipseDetector.Threshold.
+	TestKL Test = iota
+	// TestChiSquare is Pearson's chi-square goodness of fit test of the prefix lengths, the prefix lengths expected to
+	// hold few peers being pooled.
+	TestChiSquare
+	// TestKS is the one-sample Kolmogorov-Smirnov test of the prefix lengths, which compares cumulative distributions
+	// and therefore needs no pooling.
+	TestKS
+)
+
+// Tests are all the tests, see EclipseDetector.RunTests.
+var Tests = []Test{TestKL, TestChiSquare, TestKS}
+
+func (t Test) String() string {
+	switch t {
+	case TestKL:
+		return "kl"
+	case TestChiSquare:
+		return "chi-square"
+	case TestKS:
+		return "ks"
+	}
+	return fmt.Sprintf("Test(%d)", int(t))
+}
+
+const (
+	// DefaultSignificance is the significance level of the chi-square and Kolmogorov-Smirnov tests.
+	DefaultSignificance = 0.01
+	// minExpectedCount is the expected number of peers the prefix lengths are pooled into bins of for the chi-square
+	// test, below which its approximation of the statistic's distribution breaks down.
+	minExpectedCount = 5
+)
+
+// TestResult is the outcome of a test of the prefix length distribution.
+type TestResult struct {
+	Test Test
+	// Statistic is the KL divergence, the chi-square statistic, or the Kolmogorov-Smirnov distance.
+	Statistic float64
+	// PValue is the probability of a statistic at least as extreme without an attack, NaN for TestKL which has no
+	// null distribution.
+	PValue float64
+	// Attack is set if the test rejects the ideal distribution: the KL divergence exceeds the threshold, or the p-value
+	// is below the significance level.
+	Attack bool
+}
+
+// Significance returns the significance level of the chi-square and Kolmogorov-Smirnov tests.
+func (det *EclipseDetector) Significance() float64 {
+	det.mu.RLock()
+	defer det.mu.RUnlock()
+	return det.significance
+}
+
+// UpdateSignificance sets the significance level of the chi-square and Kolmogorov-Smirnov tests, which must be in
+// (0, 1).
+func (det *EclipseDetector) UpdateSignificance(alpha float64) error {
+	if alpha <= 0 || alpha >= 1 {
+		return fmt.Errorf("significance must be in (0, 1)")
+	}
+	det.mu.Lock()
+	defer det.mu.Unlock()
+	det.significance = alpha
+	return nil
+}
+
+// expectedFrom returns the probability of each prefix length of at least l under the ideal distribution conditioned on
+// a prefix length of at least l, the last one including all longer prefix lengths, and the number of peers counted
+// from l.
+func (det *EclipseDetector) expectedFrom(counts []int, l int) ([]float64, []int) {
+	var probs []float64
+	var observed []int
+	for p := l; p < det.keySize; p++ {
+		probs = append(probs, math.Pow(0.5, float64(p-l+1)))
+		c := 0
+		if p < len(counts) {
+			c = counts[p]
+		}
+		observed = append(observed, c)
+	}
+	if len(probs) > 0 {
+		// the longest prefix length also holds the longer ones, see ComputePrefixLenCounts
+		probs[len(probs)-1] *= 2
+	}
+	return probs, observed
+}
+
+// ChiSquareFromCounts runs Pearson's chi-square test of prefixLenCounts against the ideal distribution of the prefix
+// lengths of at least l. Consecutive prefix lengths are pooled until they are expected to hold minExpectedCount peers.
+func (det *EclipseDetector) ChiSquareFromCounts(prefixLenCounts []int) TestResult {
+	return det.chiSquare(prefixLenCounts, det.Params())
+}
+
+func (det *EclipseDetector) chiSquare(prefixLenCounts []int, params Params) TestResult {
+	res := TestResult{Test: TestChiSquare, PValue: 1}
+	probs, observed := det.expectedFrom(prefixLenCounts, params.L)
+	n := 0
+	for _, c := range observed {
+		n += c
+	}
+	if n == 0 {
+		return res
+	}
+
+	var bins []float64 // expected, observed pairs
+	var expected, obs float64
+	for i := range probs {
+		expected += probs[i] * float64(n)
+		obs += float64(observed[i])
+		if expected >= minExpectedCount {
+			bins = append(bins, expected, obs)
+			expected, obs = 0, 0
+		}
+	}
+	if expected > 0 || obs > 0 {
+		if len(bins) > 0 {
+			// pool the remaining tail into the last bin
+			bins[len(bins)-2] += expected
+			bins[len(bins)-1] += obs
+		} else {
+			bins = append(bins, expected, obs)
+		}
+	}
+	df := len(bins)/2 - 1
+	if df < 1 {
+		return res
+	}
+	for i := 0; i < len(bins); i += 2 {
+		d := bins[i+1] - bins[i]
+		res.Statistic += d * d / bins[i]
+	}
+	res.PValue = distuv.ChiSquared{K: float64(df)}.Survival(res.Statistic)
+	res.Attack = res.PValue < params.Significance
+	return res
+}
+
+// KSFromCounts runs the one-sample Kolmogorov-Smirnov test of prefixLenCounts against the ideal distribution of the
+// prefix lengths of at least l. The p-value uses the asymptotic Kolmogorov distribution, which is conservative for
+// discrete distributions.
+func (det *EclipseDetector) KSFromCounts(prefixLenCounts []int) TestResult {
+	return det.ks(prefixLenCounts, det.Params())
+}
+
+func (det *EclipseDetector) ks(prefixLenCounts []int, params Params) TestResult {
+	res := TestResult{Test: TestKS, PValue: 1}
+	probs, observed := det.expectedFrom(prefixLenCounts, params.L)
+	n := 0
+	for _, c := range observed {
+		n += c
+	}
+	if n == 0 {
+		return res
+	}
+
+	var cdf, ecdf float64
+	for i := range probs {
+		cdf += probs[i]
+		ecdf += float64(observed[i]) / float64(n)
+		if d := math.Abs(ecdf - cdf); d > res.Statistic {
+			res.Statistic = d
+		}
+	}
+	res.PValue = kolmogorovSurvival(math.Sqrt(float64(n)) * res.Statistic)
+	res.Attack = res.PValue < params.Significance
+	return res
+}
+
+// kolmogorovSurvival returns the probability of the Kolmogorov distribution to exceed x.
+func kolmogorovSurvival(x float64) float64 {
+	if x <= 0 {
+		return 1
+	}
+	var p float64
+	for j := 1; j <= 100; j++ {
+		term := math.Exp(-2 * float64(j*j) * x * x)
+		if j%2 == 1 {
+			p += term
+		} else {
+			p -= term
+		}
+		if term < 1e-12 {
+			break
+		}
+	}
+	return math.Max(0, math.Min(1, 2*p))
+}
+
+// KLFromCounts runs the KL divergence test of prefixLenCounts, see ComputeKLFromCounts.
+func (det *EclipseDetector) KLFromCounts(prefixLenCounts []int) TestResult {
+	return det.kl(prefixLenCounts, det.Params())
+}
+
+func (det *EclipseDetector) kl(prefixLenCounts []int, params Params) TestResult {
+	kl := det.klFrom(prefixLenCounts, params.L)
+	return TestResult{Test: TestKL, Statistic: kl, PValue: math.NaN(), Attack: kl > params.Threshold}
+}
+
+// RunTest runs test on prefixLenCounts with the parameters as last updated.
+func (det *EclipseDetector) RunTest(test Test, prefixLenCounts []int) TestResult {
+	return det.RunTestWithParams(test, prefixLenCounts, det.Params())
+}
+
+// RunTestWithParams runs test on prefixLenCounts with the given parameters, e.g. those derived from the network size
+// of a detection, which concurrent detections do not change.
+func (det *EclipseDetector) RunTestWithParams(test Test, prefixLenCounts []int, params Params) TestResult {
+	switch test {
+	case TestChiSquare:
+		return det.chiSquare(prefixLenCounts, params)
+	case TestKS:
+		return det.ks(prefixLenCounts, params)
+	default:
+		return det.kl(prefixLenCounts, params)
+	}
+}
+
+// RunTests runs all the tests on prefixLenCounts, in the order of Tests, with the parameters as last updated.
+func (det *EclipseDetector) RunTests(prefixLenCounts []int) []TestResult {
+	return det.RunTestsWithParams(prefixLenCounts, det.Params())
+}
+
+// RunTestsWithParams runs all the tests on prefixLenCounts, in the order of Tests, with the given parameters.
+func (det *EclipseDetector) RunTestsWithParams(prefixLenCounts []int, params Params) []TestResult {
+	results := make([]TestResult, len(Tests))
+	for i, t := range Tests {
+		results[i] = det.RunTestWithParams(t, prefixLenCounts, params)
+	}
+	return results
+}
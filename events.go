@@ -83,6 +83,9 @@ type LookupEvent struct {
 	Node *PeerKadID
 	// ID is a unique identifier for the lookup instance.
 	ID uuid.UUID
+	// Operation is the correlation ID of the operation the lookup belongs to, see CorrelationID. It is set by
+	// PublishLookupEvent if zero.
+	Operation uuid.UUID
 	// Key is the Kademlia key used as a lookup target.
 	Key *KeyKadID
 	// Request, if not nil, describes a state update event, associated with an outgoing query request.
@@ -158,6 +161,8 @@ func (r LookupTerminationReason) String() string {
 		return "starvation"
 	case LookupCompleted:
 		return "completed"
+	case LookupBudgetExhausted:
+		return "budget-exhausted"
 	}
 	panic("unreachable")
 }
@@ -171,6 +176,8 @@ const (
 	LookupStarvation
 	// LookupCompleted indicates that the lookup terminated successfully, reaching the Kademlia end condition.
 	LookupCompleted
+	// LookupBudgetExhausted indicates that the lookup used up its RPC budget, see QueryBudget.
+	LookupBudgetExhausted
 )
 
 type routingLookupKey struct{}
@@ -233,6 +240,12 @@ func RegisterForLookupEvents(ctx context.Context) (context.Context, <-chan *Look
 // LookupEventBufferSize is the number of events to buffer.
 var LookupEventBufferSize = 16
 
+// lookupEventsEnabled returns true if ctx was registered with RegisterForLookupEvents, i.e. lookup events published
+// with it are received by someone and worth building.
+func lookupEventsEnabled(ctx context.Context) bool {
+	return ctx.Value(routingLookupKey{}) != nil
+}
+
 // PublishLookupEvent publishes a query event to the query event channel
 // associated with the given context, if any.
 func PublishLookupEvent(ctx context.Context, ev *LookupEvent) {
@@ -241,6 +254,10 @@ func PublishLookupEvent(ctx context.Context, ev *LookupEvent) {
 		return
 	}
 
+	if ev.Operation == uuid.Nil {
+		ev.Operation, _ = CorrelationID(ctx)
+	}
+
 	// We *want* to panic here.
 	ech := ich.(*lookupEventChannel)
 	ech.send(ctx, ev)
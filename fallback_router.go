@@ -0,0 +1,353 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/routing"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+)
+
+// fallbackRouterDHT is the name the DHT is reported under in the router metrics of a FallbackRouter.
+const fallbackRouterDHT = "dht"
+
+// Outcomes of a request to a router of a FallbackRouter, as reported in the router metrics.
+const (
+	routerSuccess = "success"
+	routerFailure = "failure"
+	// routerSuspicious means the DHT answered, but an attack was detected on the key.
+	routerSuspicious = "suspicious"
+)
+
+// NamedRouter is a router of a FallbackRouter chain, named for the metrics.
+type NamedRouter struct {
+	Name   string
+	Router routing.Routing
+}
+
+// FallbackRouter routes through the DHT first and falls back to other routers, e.g. delegated HTTP routers, in order
+// when the DHT fails or when an attack is detected on the key. Unlike composing the DHT with other routers
+// externally, it takes the attack verdicts of the DHT into account: a key whose attack score, see
+// DetectionAggregator.Score, exceeds the threshold is looked up with the fallback routers as well.
+type FallbackRouter struct {
+	dht       *IpfsDHT
+	fallbacks []NamedRouter
+	threshold float64
+}
+
+var _ routing.Routing = (*FallbackRouter)(nil)
+
+// NewFallbackRouter returns a FallbackRouter falling back from dht to fallbacks, in order, on failure or when the
+// attack score of a key exceeds threshold.
+func NewFallbackRouter(dht *IpfsDHT, threshold float64, fallbacks ...NamedRouter) (*FallbackRouter, error) {
+	if threshold < 0 || threshold > 1 {
+		return nil, fmt.Errorf("fallback threshold must be in [0, 1], got %f", threshold)
+	}
+	for _, f := range fallbacks {
+		if f.Name == "" || f.Name == fallbackRouterDHT || f.Router == nil {
+			return nil, fmt.Errorf("invalid fallback router %q", f.Name)
+		}
+	}
+	return &FallbackRouter{dht: dht, fallbacks: fallbacks, threshold: threshold}, nil
+}
+
+// suspicious returns true if an attack was detected on key.
+func (r *FallbackRouter) suspicious(key string) bool {
+	return r.dht.detections != nil && r.dht.detections.Score(key) > r.threshold
+}
+
+// record reports a request to the router metrics.
+func (r *FallbackRouter) record(router, op, outcome string, start time.Time) {
+	ctx := r.dht.newContextWithLocalTags(context.Background(),
+		tag.Upsert(metrics.KeyRouter, router),
+		tag.Upsert(metrics.KeyRouterOperation, op),
+		tag.Upsert(metrics.KeyRouterOutcome, outcome),
+	)
+	stats.Record(ctx,
+		metrics.RouterRequests.M(1),
+		metrics.RouterLatency.M(float64(time.Since(start))/float64(time.Millisecond)),
+	)
+}
+
+func outcome(err error) string {
+	return foundOutcome(err == nil)
+}
+
+func foundOutcome(found bool) string {
+	if found {
+		return routerSuccess
+	}
+	return routerFailure
+}
+
+// Provide announces key with the DHT, and with the fallback routers too if the DHT failed or an attack was detected
+// on key. It only fails if all routers it tried failed.
+func (r *FallbackRouter) Provide(ctx context.Context, key cid.Cid, brdcst bool) error {
+	start := time.Now()
+	err := r.dht.Provide(ctx, key, brdcst)
+	if err == nil && !r.suspicious(string(key.Hash())) {
+		r.record(fallbackRouterDHT, "provide", routerSuccess, start)
+		return nil
+	}
+
+	var errs error
+	if err != nil {
+		errs = multierror.Append(errs, err)
+		r.record(fallbackRouterDHT, "provide", routerFailure, start)
+	} else {
+		r.record(fallbackRouterDHT, "provide", routerSuspicious, start)
+	}
+	ok := err == nil
+	for _, f := range r.fallbacks {
+		start := time.Now()
+		ferr := f.Router.Provide(ctx, key, brdcst)
+		r.record(f.Name, "provide", outcome(ferr), start)
+		if ferr != nil {
+			errs = multierror.Append(errs, fmt.Errorf("%s: %w", f.Name, ferr))
+			continue
+		}
+		ok = true
+	}
+	if ok {
+		return nil
+	}
+	return errs
+}
+
+// FindProvidersAsync streams the providers found by the DHT. If it found none, or an attack was detected on key, the
+// fallback routers are asked in order for more until count providers were found.
+func (r *FallbackRouter) FindProvidersAsync(ctx context.Context, key cid.Cid, count int) <-chan peer.AddrInfo {
+	out := make(chan peer.AddrInfo)
+	go func() {
+		defer close(out)
+
+		seen := make(map[peer.ID]struct{})
+		forward := func(ch <-chan peer.AddrInfo) bool {
+			for ai := range ch {
+				if _, ok := seen[ai.ID]; ok {
+					continue
+				}
+				seen[ai.ID] = struct{}{}
+				select {
+				case out <- ai:
+				case <-ctx.Done():
+					return false
+				}
+				if count > 0 && len(seen) >= count {
+					return false
+				}
+			}
+			return ctx.Err() == nil
+		}
+
+		start := time.Now()
+		more := forward(r.dht.FindProvidersAsync(ctx, key, count))
+		suspicious := r.suspicious(string(key.Hash()))
+		if suspicious {
+			r.record(fallbackRouterDHT, "find-providers", routerSuspicious, start)
+		} else {
+			r.record(fallbackRouterDHT, "find-providers", foundOutcome(len(seen) > 0), start)
+		}
+		if !more || (len(seen) > 0 && !suspicious) {
+			return
+		}
+
+		for _, f := range r.fallbacks {
+			found := len(seen)
+			start := time.Now()
+			more = forward(f.Router.FindProvidersAsync(ctx, key, count))
+			r.record(f.Name, "find-providers", foundOutcome(len(seen) > found), start)
+			if !more {
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// FindPeer looks p up with the DHT, falling back to the fallback routers in order if it fails.
+func (r *FallbackRouter) FindPeer(ctx context.Context, p peer.ID) (peer.AddrInfo, error) {
+	start := time.Now()
+	ai, err := r.dht.FindPeer(ctx, p)
+	r.record(fallbackRouterDHT, "find-peer", outcome(err), start)
+	if err == nil {
+		return ai, nil
+	}
+
+	errs := multierror.Append(nil, err)
+	for _, f := range r.fallbacks {
+		start := time.Now()
+		ai, err := f.Router.FindPeer(ctx, p)
+		r.record(f.Name, "find-peer", outcome(err), start)
+		if err == nil {
+			return ai, nil
+		}
+		errs = multierror.Append(errs, fmt.Errorf("%s: %w", f.Name, err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return peer.AddrInfo{}, errs
+}
+
+// PutValue stores the value with the DHT, and with the fallback routers too if the DHT failed or an attack was
+// detected on key. It only fails if all routers it tried failed.
+func (r *FallbackRouter) PutValue(ctx context.Context, key string, value []byte, opts ...routing.Option) error {
+	start := time.Now()
+	err := r.dht.PutValue(ctx, key, value, opts...)
+	if err == nil && !r.suspicious(key) {
+		r.record(fallbackRouterDHT, "put-value", routerSuccess, start)
+		return nil
+	}
+
+	var errs error
+	if err != nil {
+		errs = multierror.Append(errs, err)
+		r.record(fallbackRouterDHT, "put-value", routerFailure, start)
+	} else {
+		r.record(fallbackRouterDHT, "put-value", routerSuspicious, start)
+	}
+	ok := err == nil
+	for _, f := range r.fallbacks {
+		start := time.Now()
+		ferr := f.Router.PutValue(ctx, key, value, opts...)
+		r.record(f.Name, "put-value", outcome(ferr), start)
+		if ferr != nil {
+			errs = multierror.Append(errs, fmt.Errorf("%s: %w", f.Name, ferr))
+			continue
+		}
+		ok = true
+	}
+	if ok {
+		return nil
+	}
+	return errs
+}
+
+// GetValue gets the value with the DHT. If the DHT fails, or an attack was detected on key, the fallback routers are
+// asked in order, and the best of all values found is returned.
+func (r *FallbackRouter) GetValue(ctx context.Context, key string, opts ...routing.Option) ([]byte, error) {
+	start := time.Now()
+	best, err := r.dht.GetValue(ctx, key, opts...)
+	if err == nil && !r.suspicious(key) {
+		r.record(fallbackRouterDHT, "get-value", routerSuccess, start)
+		return best, nil
+	}
+
+	var errs error
+	if err != nil {
+		errs = multierror.Append(errs, err)
+		r.record(fallbackRouterDHT, "get-value", routerFailure, start)
+	} else {
+		r.record(fallbackRouterDHT, "get-value", routerSuspicious, start)
+	}
+	for _, f := range r.fallbacks {
+		start := time.Now()
+		val, ferr := f.Router.GetValue(ctx, key, opts...)
+		if ferr == nil {
+			ferr = r.dht.validate(key, val)
+		}
+		r.record(f.Name, "get-value", outcome(ferr), start)
+		if ferr != nil {
+			errs = multierror.Append(errs, fmt.Errorf("%s: %w", f.Name, ferr))
+			continue
+		}
+		if best == nil {
+			best = val
+			continue
+		}
+		if i, serr := r.dht.selectValue(key, [][]byte{best, val}); serr == nil && i == 1 {
+			best = val
+		}
+	}
+	if best != nil {
+		return best, nil
+	}
+	if errs == nil {
+		return nil, routing.ErrNotFound
+	}
+	return nil, errs
+}
+
+// SearchValue streams the values found by the DHT. If it found none, or an attack was detected on key, the values
+// found by the fallback routers are streamed after them.
+func (r *FallbackRouter) SearchValue(ctx context.Context, key string, opts ...routing.Option) (<-chan []byte, error) {
+	start := time.Now()
+	ch, err := r.dht.SearchValue(ctx, key, opts...)
+	if err != nil {
+		r.record(fallbackRouterDHT, "search-value", routerFailure, start)
+		ch = nil
+	}
+
+	out := make(chan []byte)
+	go func() {
+		defer close(out)
+
+		// forward returns the number of values forwarded from ch, and false if the search was canceled
+		forward := func(ch <-chan []byte) (int, bool) {
+			n := 0
+			for v := range ch {
+				n++
+				select {
+				case out <- v:
+				case <-ctx.Done():
+					return n, false
+				}
+			}
+			return n, ctx.Err() == nil
+		}
+
+		if ch != nil {
+			n, more := forward(ch)
+			if !more {
+				return
+			}
+			switch {
+			case r.suspicious(key):
+				r.record(fallbackRouterDHT, "search-value", routerSuspicious, start)
+			case n > 0:
+				r.record(fallbackRouterDHT, "search-value", routerSuccess, start)
+				return
+			default:
+				r.record(fallbackRouterDHT, "search-value", routerFailure, start)
+			}
+		}
+
+		for _, f := range r.fallbacks {
+			start := time.Now()
+			fch, err := f.Router.SearchValue(ctx, key, opts...)
+			if err != nil {
+				r.record(f.Name, "search-value", routerFailure, start)
+				continue
+			}
+			n, more := forward(fch)
+			r.record(f.Name, "search-value", foundOutcome(n > 0), start)
+			if !more {
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// Bootstrap bootstraps the DHT and all fallback routers.
+func (r *FallbackRouter) Bootstrap(ctx context.Context) error {
+	var errs error
+	if err := r.dht.Bootstrap(ctx); err != nil {
+		errs = multierror.Append(errs, err)
+	}
+	for _, f := range r.fallbacks {
+		if err := f.Router.Bootstrap(ctx); err != nil {
+			logger.Debugw("failed to bootstrap fallback router", "router", f.Name, "error", err)
+			errs = multierror.Append(errs, fmt.Errorf("%s: %w", f.Name, err))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,192 @@
+package dht
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/routing"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// FoundPeer is a peer found by FindPeerWithOptions.
+type FoundPeer struct {
+	peer.AddrInfo
+	// Sources maps the addresses of the peer, as strings, to the peers that returned them, ourselves for addresses we
+	// knew before the lookup.
+	Sources map[string][]peer.ID
+	// Provenance maps the addresses of the peer, as strings, to when each of their sources last returned them,
+	// freshest first.
+	Provenance map[string][]AddrProvenance
+}
+
+// AddrProvenance is a source of an address of a FoundPeer.
+type AddrProvenance struct {
+	// Source is the peer that returned the address, ourselves for addresses we knew.
+	Source peer.ID
+	// Seen is when the source last returned the address.
+	Seen time.Time
+}
+
+// FindPeerWithOptions is FindPeer taking routing options. The addresses of the peer returned by every peer queried
+// during the lookup are collected, deduplicated, and returned along with the peers that returned them and when, so
+// that callers can pick which addresses to dial. Addresses returned by more peers come first.
+//
+// With AddressOnly, the addresses are returned as soon as any peer returned some, without dialing the peer and
+// regardless of whether it is reachable.
+func (dht *IpfsDHT) FindPeerWithOptions(ctx context.Context, id peer.ID, opts ...routing.Option) (FoundPeer, error) {
+	var cfg routing.Options
+	if err := cfg.Apply(opts...); err != nil {
+		return FoundPeer{}, err
+	}
+	ctx, err := dht.chargeQuota(ctx, quotaOpLookup)
+	if err != nil {
+		return FoundPeer{}, err
+	}
+	if isAddressOnly(&cfg) {
+		return dht.findPeerAddrs(ctx, id)
+	}
+
+	srcs := dht.newPeerAddrSources()
+	ai, err := dht.findPeer(ctx, id, srcs)
+	if err != nil {
+		return FoundPeer{}, err
+	}
+	srcs.add(dht.self, ai.Addrs)
+	return srcs.result(id), nil
+}
+
+// peerAddrSources collects the addresses of a peer, the peers that returned them and when.
+type peerAddrSources struct {
+	now func() time.Time
+
+	mu      sync.Mutex
+	addrs   map[string]ma.Multiaddr
+	sources map[string][]AddrProvenance
+}
+
+func (dht *IpfsDHT) newPeerAddrSources() *peerAddrSources {
+	return &peerAddrSources{
+		now:     dht.clock.Now,
+		addrs:   make(map[string]ma.Multiaddr),
+		sources: make(map[string][]AddrProvenance),
+	}
+}
+
+// add records that from returned addrs, or that we knew them if from is ourselves.
+func (s *peerAddrSources) add(from peer.ID, addrs []ma.Multiaddr) {
+	now := s.now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+next:
+	for _, a := range addrs {
+		k := a.String()
+		if _, ok := s.addrs[k]; !ok {
+			s.addrs[k] = a
+		}
+		for i, src := range s.sources[k] {
+			if src.Source == from {
+				s.sources[k][i].Seen = now
+				continue next
+			}
+		}
+		s.sources[k] = append(s.sources[k], AddrProvenance{Source: from, Seen: now})
+	}
+}
+
+func (s *peerAddrSources) found() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.addrs) > 0
+}
+
+// result returns the collected addresses of id, most often returned first.
+func (s *peerAddrSources) result(id peer.ID) FoundPeer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0, len(s.addrs))
+	for k := range s.addrs {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if len(s.sources[keys[i]]) != len(s.sources[keys[j]]) {
+			return len(s.sources[keys[i]]) > len(s.sources[keys[j]])
+		}
+		return keys[i] < keys[j]
+	})
+	fp := FoundPeer{
+		AddrInfo:   peer.AddrInfo{ID: id},
+		Sources:    make(map[string][]peer.ID, len(keys)),
+		Provenance: make(map[string][]AddrProvenance, len(keys)),
+	}
+	for _, k := range keys {
+		fp.Addrs = append(fp.Addrs, s.addrs[k])
+		prov := append([]AddrProvenance(nil), s.sources[k]...)
+		for _, src := range prov {
+			fp.Sources[k] = append(fp.Sources[k], src.Source)
+		}
+		sort.SliceStable(prov, func(i, j int) bool { return prov[i].Seen.After(prov[j].Seen) })
+		fp.Provenance[k] = prov
+	}
+	return fp
+}
+
+// findPeerAddrs looks up the addresses of id without dialing it.
+func (dht *IpfsDHT) findPeerAddrs(ctx context.Context, id peer.ID) (FoundPeer, error) {
+	if err := id.Validate(); err != nil {
+		return FoundPeer{}, err
+	}
+	logger.Debugw("finding peer addresses", "peer", id)
+
+	srcs := dht.newPeerAddrSources()
+	if dht.host.Network().Connectedness(id) == network.Connected {
+		srcs.add(dht.self, dht.peerstore.Addrs(id))
+		return srcs.result(id), nil
+	}
+
+	_, err := dht.runLookupWithFollowup(ctx, string(id),
+		func(ctx context.Context, p peer.ID) ([]*peer.AddrInfo, error) {
+			routing.PublishQueryEvent(ctx, &routing.QueryEvent{
+				Type: routing.SendingQuery,
+				ID:   p,
+			})
+
+			peers, err := dht.protoMessenger.GetClosestPeers(ctx, p, id)
+			if err != nil {
+				logger.Debugf("error getting closer peers: %s", err)
+				return nil, err
+			}
+			for _, pi := range peers {
+				if pi.ID == id {
+					srcs.add(p, pi.Addrs)
+				}
+			}
+
+			routing.PublishQueryEvent(ctx, &routing.QueryEvent{
+				Type:      routing.PeerResponse,
+				ID:        p,
+				Responses: peers,
+			})
+			return peers, nil
+		},
+		// stop before the lookup gets to query, and thereby dial, the peer
+		func(*lookupState) bool {
+			return srcs.found()
+		},
+	)
+	if err != nil {
+		return FoundPeer{}, err
+	}
+
+	if !srcs.found() {
+		// fall back to the addresses we knew
+		srcs.add(dht.self, dht.peerstore.Addrs(id))
+	}
+	if !srcs.found() {
+		return FoundPeer{}, routing.ErrNotFound
+	}
+	return srcs.result(id), nil
+}
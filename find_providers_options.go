@@ -0,0 +1,203 @@
+package dht
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/routing"
+)
+
+// livenessDialTimeout bounds the dial of a provider by the LivenessDial check.
+const livenessDialTimeout = 10 * time.Second
+
+// ProviderLiveness selects how providers are checked for liveness, see ProviderLivenessCheck.
+type ProviderLiveness int
+
+const (
+	// LivenessAddrs considers providers live that we are connected to or know addresses of, without dialing them.
+	LivenessAddrs ProviderLiveness = iota + 1
+	// LivenessDial considers providers live that we are connected to or could dial.
+	LivenessDial
+)
+
+// FindProvidersWithOptions is FindProviders taking routing options, returning up to count providers, or all
+// providers found if count is zero.
+func (dht *IpfsDHT) FindProvidersWithOptions(ctx context.Context, c cid.Cid, count int, opts ...routing.Option) ([]peer.AddrInfo, error) {
+	if !dht.enableProviders {
+		return nil, routing.ErrNotSupported
+	}
+	out, err := dht.FindProvidersAsyncWithOptions(ctx, c, count, opts...)
+	if err != nil {
+		return nil, err
+	}
+	var providers []peer.AddrInfo
+	for p := range out {
+		providers = append(providers, p)
+	}
+	return providers, nil
+}
+
+// FindProvidersAsyncWithOptions is FindProvidersAsync taking routing options that change when the search stops:
+//
+//   - FirstDialableProvider stops as soon as a provider could be dialed and returns only that provider.
+//   - ProviderSearchTimeout stops after a timeout, the providers found so far having been returned.
+//   - KeepSearching doesn't stop once count providers were found, but returns every provider found until the lookup
+//     completes or the context is done.
+//
+// With ProviderLivenessCheck, providers failing the liveness check are returned last, or dropped with
+// DropUnreachableProviders.
+func (dht *IpfsDHT) FindProvidersAsyncWithOptions(ctx context.Context, key cid.Cid, count int, opts ...routing.Option) (<-chan peer.AddrInfo, error) {
+	var cfg routing.Options
+	if err := cfg.Apply(opts...); err != nil {
+		return nil, err
+	}
+
+	var cancel context.CancelFunc
+	if d := searchTimeout(&cfg); d > 0 {
+		ctx, cancel = context.WithTimeout(ctx, d)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	firstDialable := isFirstDialable(&cfg)
+	if firstDialable || isKeepSearching(&cfg) {
+		count = 0
+	}
+	in := dht.FindProvidersAsync(ctx, key, count)
+
+	out := make(chan peer.AddrInfo, 1)
+	go func() {
+		defer close(out)
+		defer cancel()
+		if firstDialable {
+			if p, ok := dht.firstDialableProvider(ctx, in); ok {
+				out <- p
+			}
+			return
+		}
+		if l, ok := getLivenessOption(&cfg); ok {
+			dht.filterLiveProviders(ctx, in, out, l, isDropUnreachable(&cfg))
+			return
+		}
+		for p := range in {
+			select {
+			case out <- p:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// firstDialableProvider dials the providers received from in concurrently and returns the first one that could be
+// dialed, or false if in was closed and all dials failed, or ctx is done. This node counts as dialable.
+func (dht *IpfsDHT) firstDialableProvider(ctx context.Context, in <-chan peer.AddrInfo) (peer.AddrInfo, bool) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	dialed := make(chan peer.AddrInfo, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var wg sync.WaitGroup
+		for p := range in {
+			wg.Add(1)
+			go func(p peer.AddrInfo) {
+				defer wg.Done()
+				if !dht.providerLive(ctx, p, LivenessDial) {
+					return
+				}
+				select {
+				case dialed <- p:
+				default:
+				}
+			}(p)
+		}
+		wg.Wait()
+	}()
+
+	select {
+	case p := <-dialed:
+		return p, true
+	case <-done:
+		select {
+		case p := <-dialed:
+			return p, true
+		default:
+			return peer.AddrInfo{}, false
+		}
+	case <-ctx.Done():
+		return peer.AddrInfo{}, false
+	}
+}
+
+// filterLiveProviders sends the providers received from in to out, the ones passing the liveness check as soon as
+// they pass it, the others once in is closed unless drop is set.
+func (dht *IpfsDHT) filterLiveProviders(ctx context.Context, in <-chan peer.AddrInfo, out chan<- peer.AddrInfo, l livenessOption, drop bool) {
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		dead []peer.AddrInfo
+		sem  = make(chan struct{}, l.concurrency)
+	)
+	for p := range in {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return
+		}
+		wg.Add(1)
+		go func(p peer.AddrInfo) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if !dht.providerLive(ctx, p, l.check) {
+				mu.Lock()
+				dead = append(dead, p)
+				mu.Unlock()
+				return
+			}
+			select {
+			case out <- p:
+			case <-ctx.Done():
+			}
+		}(p)
+	}
+	wg.Wait()
+
+	if drop {
+		return
+	}
+	for _, p := range dead {
+		select {
+		case out <- p:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// providerLive checks whether the provider p is live. This node is always live.
+func (dht *IpfsDHT) providerLive(ctx context.Context, p peer.AddrInfo, check ProviderLiveness) bool {
+	if p.ID == dht.self || dht.host.Network().Connectedness(p.ID) == network.Connected {
+		return true
+	}
+	switch check {
+	case LivenessAddrs:
+		return len(p.Addrs) > 0 || len(dht.host.Peerstore().Addrs(p.ID)) > 0
+	case LivenessDial:
+		ctx, cancel := context.WithTimeout(ctx, livenessDialTimeout)
+		defer cancel()
+		if err := dht.host.Connect(ctx, p); err != nil {
+			logger.Debugw("provider not dialable", "peer", p.ID, "error", err)
+			return false
+		}
+		return true
+	default:
+		return false
+	}
+}
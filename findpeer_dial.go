@@ -0,0 +1,113 @@
+package dht
+
+import (
+	"context"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// findPeerDialCandidates is the maximum number of distinct address sets of the target that FindPeer dials
+// concurrently while the lookup is still running.
+const findPeerDialCandidates = 3
+
+// targetDialer dials the target of a FindPeer lookup as soon as its addresses are learned from query responses,
+// instead of waiting for the lookup to reach the target. Every address set that contains addresses not tried yet
+// is dialed in parallel, up to findPeerDialCandidates dials. The first successful dial cancels all others.
+type targetDialer struct {
+	dht    *IpfsDHT
+	target peer.ID
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	tried    map[string]struct{}
+	dials    int
+	inflight sync.WaitGroup
+
+	connected chan struct{}
+	once      sync.Once
+}
+
+func newTargetDialer(ctx context.Context, dht *IpfsDHT, target peer.ID) *targetDialer {
+	ctx, cancel := context.WithCancel(ctx)
+	return &targetDialer{
+		dht:       dht,
+		target:    target,
+		ctx:       ctx,
+		cancel:    cancel,
+		tried:     make(map[string]struct{}),
+		connected: make(chan struct{}),
+	}
+}
+
+// offer hands the dialer addresses of the target reported by some peer. Addresses that have already been dialed
+// are ignored.
+func (d *targetDialer) offer(addrs []ma.Multiaddr) {
+	if d.target == d.dht.self {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.dials >= findPeerDialCandidates || d.ctx.Err() != nil {
+		return
+	}
+
+	var fresh []ma.Multiaddr
+	for _, a := range addrs {
+		k := string(a.Bytes())
+		if _, ok := d.tried[k]; ok {
+			continue
+		}
+		d.tried[k] = struct{}{}
+		fresh = append(fresh, a)
+	}
+	if len(fresh) == 0 {
+		return
+	}
+
+	d.dials++
+	d.inflight.Add(1)
+	go func() {
+		defer d.inflight.Done()
+		err := d.dht.host.Connect(d.ctx, peer.AddrInfo{ID: d.target, Addrs: fresh})
+		if err != nil {
+			logger.Debugw("failed to dial FindPeer target", "peer", d.target, "error", err)
+			return
+		}
+		d.once.Do(func() {
+			close(d.connected)
+			// we're connected, the remaining dials are pointless
+			d.cancel()
+		})
+	}()
+}
+
+// close waits for either a successful dial or for all pending dials to fail (or for the parent context to be
+// done), then cancels any dials still in flight.
+func (d *targetDialer) close() {
+	done := make(chan struct{})
+	go func() {
+		d.inflight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-d.connected:
+	case <-done:
+	case <-d.ctx.Done():
+	}
+	d.cancel()
+	<-done
+}
+
+// isConnected returns true if we are connected to the target.
+func (d *targetDialer) isConnected() bool {
+	return d.dht.host.Network().Connectedness(d.target) == network.Connected
+}
@@ -0,0 +1,169 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/routing"
+
+	"github.com/libp2p/go-libp2p-kad-dht/qpeerset"
+)
+
+// FollowupMode controls the followup phase of lookups, run once the closest peers to the target are found, see
+// WithFollowup.
+type FollowupMode int
+
+const (
+	// FollowupDefault runs the query function once against the closest peers that the lookup didn't query
+	// successfully, e.g. because the lookup terminated while waiting for them.
+	FollowupDefault FollowupMode = iota
+	// FollowupSkip returns as soon as the closest peers are found, trading the resiliency of the followup for
+	// latency. Some of the closest peers returned may never have been queried.
+	FollowupSkip
+	// FollowupConfirm is FollowupDefault replacing the closest peers the followup fails for with the next closest
+	// ones, which are followed up in turn, so that all closest peers returned answered, as far as the lookup knows
+	// enough peers. This suits provides and puts that must reach the closest peers.
+	FollowupConfirm
+)
+
+func (m FollowupMode) String() string {
+	switch m {
+	case FollowupDefault:
+		return "default"
+	case FollowupSkip:
+		return "skip"
+	case FollowupConfirm:
+		return "confirm"
+	}
+	return fmt.Sprintf("FollowupMode(%d)", int(m))
+}
+
+type followupModeKey struct{}
+
+// WithFollowup makes the lookups run with the returned context use the given followup mode.
+func WithFollowup(ctx context.Context, mode FollowupMode) context.Context {
+	return context.WithValue(ctx, followupModeKey{}, mode)
+}
+
+// followupMode returns the followup mode of the lookups run with ctx.
+func followupMode(ctx context.Context) FollowupMode {
+	mode, _ := ctx.Value(followupModeKey{}).(FollowupMode)
+	return mode
+}
+
+type followupOptionKey struct{}
+
+// Followup is a GetValue, SearchValue and SearchValueExtended option setting the followup mode of the lookup, e.g.
+// FollowupSkip for latency-sensitive gets. See WithFollowup.
+func Followup(mode FollowupMode) routing.Option {
+	return func(opts *routing.Options) error {
+		if opts.Other == nil {
+			opts.Other = make(map[interface{}]interface{}, 1)
+		}
+		opts.Other[followupOptionKey{}] = mode
+		return nil
+	}
+}
+
+// withFollowupOption applies the Followup option of opts, if any, to ctx.
+func withFollowupOption(ctx context.Context, opts *routing.Options) context.Context {
+	if mode, ok := opts.Other[followupOptionKey{}].(FollowupMode); ok {
+		return WithFollowup(ctx, mode)
+	}
+	return ctx
+}
+
+type followupKey struct{}
+
+// isFollowup returns true if ctx belongs to a query sent by the followup phase of a lookup.
+func isFollowup(ctx context.Context) bool {
+	_, ok := ctx.Value(followupKey{}).(bool)
+	return ok
+}
+
+// followup runs queryFn concurrently against peers and returns the peers it failed for. The followup is aborted once
+// ctx is done or stopFn returns true, lookupRes being marked as not completed if queries were left.
+func (dht *IpfsDHT) followup(ctx context.Context, q *query, lookupRes *lookupWithFollowupResult, peers []peer.ID,
+	queryFn queryFn, stopFn stopFn) []peer.ID {
+	type result struct {
+		p   peer.ID
+		err error
+	}
+	doneCh := make(chan result, len(peers))
+	followUpCtx, cancelFollowUp := context.WithCancel(context.WithValue(ctx, followupKey{}, true))
+	defer cancelFollowUp()
+	for _, p := range peers {
+		qp := p
+		go func() {
+			rpcCtx, cancel := dht.withRPCTimeout(followUpCtx, qp)
+			defer cancel()
+			_, err := queryFn(rpcCtx, qp)
+			doneCh <- result{qp, err}
+		}()
+	}
+
+	// wait for all queries to complete before returning, aborting ongoing queries if we've been externally stopped
+	var failed []peer.ID
+	followupsCompleted := 0
+processFollowUp:
+	for i := 0; i < len(peers); i++ {
+		select {
+		case r := <-doneCh:
+			followupsCompleted++
+			if r.err != nil {
+				failed = append(failed, r.p)
+			}
+			if stopFn(q.state()) {
+				cancelFollowUp()
+				if i < len(peers)-1 {
+					lookupRes.completed = false
+				}
+				break processFollowUp
+			}
+		case <-ctx.Done():
+			lookupRes.completed = false
+			cancelFollowUp()
+			break processFollowUp
+		}
+	}
+
+	if !lookupRes.completed {
+		for i := followupsCompleted; i < len(peers); i++ {
+			<-doneCh
+		}
+	}
+	return failed
+}
+
+// replaceFailed removes the failed peers from the closest peers of lookupRes and promotes as many of its backup peers
+// in their place, returning the promoted peers that still need to be followed up.
+func (lookupRes *lookupWithFollowupResult) replaceFailed(failed []peer.ID) []peer.ID {
+	drop := make(map[peer.ID]struct{}, len(failed))
+	for _, p := range failed {
+		drop[p] = struct{}{}
+	}
+	peers, state := lookupRes.peers[:0], lookupRes.state[:0]
+	for i, p := range lookupRes.peers {
+		if _, ok := drop[p]; !ok {
+			peers, state = append(peers, p), append(state, lookupRes.state[i])
+		}
+	}
+
+	var toQuery []peer.ID
+	for len(drop) > 0 && len(lookupRes.backups) > 0 {
+		p, s := lookupRes.backups[0], lookupRes.backupState[0]
+		lookupRes.backups, lookupRes.backupState = lookupRes.backups[1:], lookupRes.backupState[1:]
+		peers, state = append(peers, p), append(state, s)
+		if s != qpeerset.PeerQueried {
+			toQuery = append(toQuery, p)
+		}
+		// one promoted peer per failed one
+		for f := range drop {
+			delete(drop, f)
+			break
+		}
+	}
+	lookupRes.peers, lookupRes.state = peers, state
+	return toQuery
+}
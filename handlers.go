@@ -22,6 +22,9 @@ import (
 // dhthandler specifies the signature of functions that handle DHT messages.
 type dhtHandler func(context.Context, peer.ID, *pb.Message) (*pb.Message, error)
 
+// errKeyNotServed is returned to requests for keys the value or provider policy doesn't enable.
+var errKeyNotServed = errors.New("key not served by this node")
+
 func (dht *IpfsDHT) handlerForMsgType(t pb.Message_MessageType) dhtHandler {
 	switch t {
 	case pb.Message_FIND_NODE:
@@ -46,6 +49,9 @@ func (dht *IpfsDHT) handlerForMsgType(t pb.Message_MessageType) dhtHandler {
 		case pb.Message_GET_PROVIDERS:
 			return dht.handleGetProviders
 		}
+		if dht.providerSubs != nil && t == pb.Message_SUBSCRIBE_PROVIDERS {
+			return dht.handleSubscribeProviders
+		}
 	}
 
 	return nil
@@ -57,6 +63,9 @@ func (dht *IpfsDHT) handleGetValue(ctx context.Context, p peer.ID, pmes *pb.Mess
 	if len(k) == 0 {
 		return nil, errors.New("handleGetValue but no key was provided")
 	}
+	if !dht.valuesEnabled(string(k)) {
+		return nil, errKeyNotServed
+	}
 
 	// setup response
 	resp := pb.NewMessage(pmes.GetType(), pmes.GetKey(), pmes.GetClusterLevel())
@@ -114,17 +123,7 @@ func (dht *IpfsDHT) checkLocalDatastore(ctx context.Context, k []byte) (*recpb.R
 		return nil, err
 	}
 
-	var recordIsBad bool
-	recvtime, err := u.ParseRFC3339(rec.GetTimeReceived())
-	if err != nil {
-		logger.Info("either no receive time set on record, or it was invalid: ", err)
-		recordIsBad = true
-	}
-
-	if time.Since(recvtime) > dht.maxRecordAge {
-		logger.Debug("old record found, tossing.")
-		recordIsBad = true
-	}
+	recordIsBad := !dht.recordTimeValid(rec, dht.clock.Now())
 
 	// NOTE: We do not verify the record here beyond checking these timestamps.
 	// we put the burden of checking the records on the requester as checking a record
@@ -142,6 +141,27 @@ func (dht *IpfsDHT) checkLocalDatastore(ctx context.Context, k []byte) (*recpb.R
 	return rec, nil
 }
 
+// recordTimeValid checks the receive time of a stored record: it must be set, not older than the max record age and
+// not further in the future than the tolerated clock skew.
+func (dht *IpfsDHT) recordTimeValid(rec *recpb.Record, now time.Time) bool {
+	recvtime, err := u.ParseRFC3339(rec.GetTimeReceived())
+	if err != nil {
+		logger.Info("either no receive time set on record, or it was invalid: ", err)
+		return false
+	}
+
+	if recvtime.After(now.Add(dht.maxRecordClockSkew)) {
+		logger.Debugw("record received in the future, tossing.", "received", recvtime)
+		return false
+	}
+
+	if now.Sub(recvtime) > dht.maxRecordAge {
+		logger.Debug("old record found, tossing.")
+		return false
+	}
+	return true
+}
+
 // Cleans the record (to avoid storing arbitrary data).
 func cleanRecord(rec *recpb.Record) {
 	rec.TimeReceived = ""
@@ -152,6 +172,9 @@ func (dht *IpfsDHT) handlePutValue(ctx context.Context, p peer.ID, pmes *pb.Mess
 	if len(pmes.GetKey()) == 0 {
 		return nil, errors.New("handleGetValue but no key was provided")
 	}
+	if !dht.valuesEnabled(string(pmes.GetKey())) {
+		return nil, errKeyNotServed
+	}
 
 	rec := pmes.GetRecord()
 	if rec == nil {
@@ -166,7 +189,7 @@ func (dht *IpfsDHT) handlePutValue(ctx context.Context, p peer.ID, pmes *pb.Mess
 	cleanRecord(rec)
 
 	// Make sure the record is valid (not expired, valid signature etc)
-	if err = dht.Validator.Validate(string(rec.GetKey()), rec.GetValue()); err != nil {
+	if err = dht.validate(string(rec.GetKey()), rec.GetValue()); err != nil {
 		logger.Infow("bad dht record in PUT", "from", p, "key", internal.LoggableRecordKeyBytes(rec.GetKey()), "error", err)
 		return nil, err
 	}
@@ -194,7 +217,7 @@ func (dht *IpfsDHT) handlePutValue(ctx context.Context, p peer.ID, pmes *pb.Mess
 
 	if existing != nil {
 		recs := [][]byte{rec.GetValue(), existing.GetValue()}
-		i, err := dht.Validator.Select(string(rec.GetKey()), recs)
+		i, err := dht.selectValue(string(rec.GetKey()), recs)
 		if err != nil {
 			logger.Warnw("dht record passed validation but failed select", "from", p, "key", internal.LoggableRecordKeyBytes(rec.GetKey()), "error", err)
 			return nil, err
@@ -206,7 +229,7 @@ func (dht *IpfsDHT) handlePutValue(ctx context.Context, p peer.ID, pmes *pb.Mess
 	}
 
 	// record the time we receive every record
-	rec.TimeReceived = u.FormatRFC3339(time.Now())
+	rec.TimeReceived = u.FormatRFC3339(dht.clock.Now())
 
 	data, err := proto.Marshal(rec)
 	if err != nil {
@@ -214,6 +237,9 @@ func (dht *IpfsDHT) handlePutValue(ctx context.Context, p peer.ID, pmes *pb.Mess
 	}
 
 	err = dht.datastore.Put(ctx, dskey, data)
+	if err == nil {
+		dht.keyspaceHeatmap.stored(ctx, &dht.keyspaceHeatmap.records, dht.selfKey, rec.GetKey())
+	}
 	return pmes, err
 }
 
@@ -236,7 +262,7 @@ func (dht *IpfsDHT) getRecordFromDatastore(ctx context.Context, dskey ds.Key) (*
 		return nil, nil
 	}
 
-	err = dht.Validator.Validate(string(rec.GetKey()), rec.GetValue())
+	err = dht.validate(string(rec.GetKey()), rec.GetValue())
 	if err != nil {
 		// Invalid record in datastore, probably expired but don't return an error,
 		// we'll just overwrite it
@@ -313,6 +339,9 @@ func (dht *IpfsDHT) handleGetProviders(ctx context.Context, p peer.ID, pmes *pb.
 	} else if len(key) == 0 {
 		return nil, fmt.Errorf("handleGetProviders key is empty")
 	}
+	if !dht.providersEnabled(key) {
+		return nil, errKeyNotServed
+	}
 
 	resp := pb.NewMessage(pmes.GetType(), pmes.GetKey(), pmes.GetClusterLevel())
 
@@ -321,10 +350,23 @@ func (dht *IpfsDHT) handleGetProviders(ctx context.Context, p peer.ID, pmes *pb.
 	if err != nil {
 		return nil, err
 	}
+	token := pmes.GetContinuationToken()
+	if pageSize := int(pmes.GetProviderPageSize()); pageSize > 0 {
+		providers, resp.ContinuationToken = providersPage(providers, pageSize, token)
+	}
 	resp.ProviderPeers = pb.PeerInfosToPBPeers(dht.host.Network(), providers)
 
+	// closer peers are only needed once when paging
+	if len(token) > 0 {
+		return resp, nil
+	}
+
+	if pmes.GetWantDetectorHint() && dht.detectorHints != nil && dht.detectorHints.serve {
+		resp.DetectorHint = dht.detectorHints.hint(dht)
+	}
+
 	// Also send closer peers.
-	closer := dht.betterPeersToQuery(pmes, p, dht.bucketSize)
+	closer := dht.providerCloserPeers(pmes, p)
 	if closer != nil {
 		// TODO: pstore.PeerInfos should move to core (=> peerstore.AddrInfos).
 		infos := pstore.PeerInfos(dht.peerstore, closer)
@@ -341,16 +383,23 @@ func (dht *IpfsDHT) handleAddProvider(ctx context.Context, p peer.ID, pmes *pb.M
 	} else if len(key) == 0 {
 		return nil, fmt.Errorf("handleAddProvider key is empty")
 	}
+	if !dht.providersEnabled(key) {
+		return nil, errKeyNotServed
+	}
 
 	logger.Debugw("adding provider", "from", p, "key", internal.LoggableProviderRecordBytes(key))
 
 	// add provider should use the address given in the message
-	pinfos := pb.PBPeersToPeerInfos(pmes.GetProviderPeers())
+	pbPeers, err := pmes.DecompressedProviderPeers()
+	if err != nil {
+		return nil, fmt.Errorf("handleAddProvider invalid compressed provider peers: %w", err)
+	}
+	pinfos := pb.PBPeersToPeerInfos(pbPeers)
 	for _, pi := range pinfos {
-		if pi.ID != p {
-			// we should ignore this provider record! not from originator.
-			// (we should sign them and check signature later...)
-			logger.Debugw("received provider from wrong peer", "from", p, "peer", pi.ID)
+		if !dht.providerAcceptPolicy(p, key, *pi) && !dht.providerAuthorized(p, key, pi.ID, pmes.GetProviderAuthorization()) {
+			// by default, we ignore provider records not from the originator, unless the provider authorized the
+			// sender to provide on its behalf.
+			logger.Debugw("refused provider record", "from", p, "peer", pi.ID)
 			continue
 		}
 
@@ -359,7 +408,12 @@ func (dht *IpfsDHT) handleAddProvider(ctx context.Context, p peer.ID, pmes *pb.M
 			continue
 		}
 
-		dht.providerStore.AddProvider(ctx, key, peer.AddrInfo{ID: p})
+		// store the addresses given in the message: they are the only addresses of a third-party provider, and the
+		// relay addresses of a provider behind a NAT aren't learned from the connection either
+		dht.providerStore.AddProvider(ctx, key, peer.AddrInfo{ID: pi.ID, Addrs: dht.filterAddrs(pi.ID, pi.Addrs)})
+		dht.auditProviderRecord(ctx, key, pi.ID, p)
+		dht.keyspaceHeatmap.stored(ctx, &dht.keyspaceHeatmap.providers, dht.selfKey, key)
+		dht.notifyProviderSubscribers(key, *pi)
 	}
 
 	return nil, nil
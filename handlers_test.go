@@ -9,12 +9,17 @@ import (
 	"time"
 
 	proto "github.com/gogo/protobuf/proto"
+	u "github.com/ipfs/go-ipfs-util"
 	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p-kad-dht/internal"
 	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	kb "github.com/libp2p/go-libp2p-kbucket"
 	recpb "github.com/libp2p/go-libp2p-record/pb"
 	crypto "github.com/libp2p/go-libp2p/core/crypto"
 	peer "github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/test"
 	ma "github.com/multiformats/go-multiaddr"
+	"github.com/multiformats/go-multihash"
 )
 
 func TestCleanRecordSigned(t *testing.T) {
@@ -67,6 +72,46 @@ func TestCleanRecord(t *testing.T) {
 	}
 }
 
+func TestRecordTimeValid(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false, MaxRecordAge(time.Hour), MaxRecordClockSkew(time.Minute))
+
+	now := time.Now()
+	for _, tc := range []struct {
+		name     string
+		received string
+		valid    bool
+	}{
+		{"fresh", u.FormatRFC3339(now), true},
+		{"expired", u.FormatRFC3339(now.Add(-2 * time.Hour)), false},
+		{"within skew", u.FormatRFC3339(now.Add(30 * time.Second)), true},
+		{"far future", u.FormatRFC3339(now.Add(24 * time.Hour)), false},
+		{"missing", "", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			key := "/v/" + tc.name
+			rec := &recpb.Record{Key: []byte(key), Value: []byte("value"), TimeReceived: tc.received}
+			if err := d.putLocal(ctx, key, rec); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := d.checkLocalDatastore(ctx, []byte(key))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if valid := got != nil; valid != tc.valid {
+				t.Fatalf("expected valid=%t, got %t", tc.valid, valid)
+			}
+		})
+	}
+
+	if _, err := New(ctx, d.host, MaxRecordAge(0)); err == nil {
+		t.Fatal("expected an error for a zero max record age")
+	}
+}
+
 func TestBadMessage(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -88,6 +133,133 @@ func TestBadMessage(t *testing.T) {
 	}
 }
 
+func TestProviderAcceptPolicy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dht := setupDHT(ctx, t, false)
+	from, prov := test.RandPeerIDFatal(t), test.RandPeerIDFatal(t)
+	addrs := []ma.Multiaddr{ma.StringCast("/ip4/1.2.3.4/tcp/4001")}
+
+	addProvider := func(key []byte, ai peer.AddrInfo) []peer.AddrInfo {
+		msg := pb.NewMessage(pb.Message_ADD_PROVIDER, key, 0)
+		msg.ProviderPeers = pb.RawPeerInfosToPBPeers([]peer.AddrInfo{ai})
+		if _, err := dht.handleAddProvider(ctx, from, msg); err != nil {
+			t.Fatal(err)
+		}
+		provs, err := dht.providerStore.GetProviders(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return provs
+	}
+
+	// third-party records are refused by default
+	if provs := addProvider(u.Hash([]byte("third party")), peer.AddrInfo{ID: prov, Addrs: addrs}); len(provs) != 0 {
+		t.Fatalf("expected third-party provider record to be refused, got %v", provs)
+	}
+	if provs := addProvider(u.Hash([]byte("originator")), peer.AddrInfo{ID: from, Addrs: addrs}); len(provs) != 1 || provs[0].ID != from {
+		t.Fatalf("expected provider record of the originator to be stored, got %v", provs)
+	}
+
+	var policyKey []byte
+	dht.providerAcceptPolicy = func(_ peer.ID, key multihash.Multihash, _ peer.AddrInfo) bool {
+		policyKey = key
+		return true
+	}
+	key := u.Hash([]byte("accepted"))
+	provs := addProvider(key, peer.AddrInfo{ID: prov, Addrs: addrs})
+	if len(provs) != 1 || provs[0].ID != prov {
+		t.Fatalf("expected third-party provider record to be stored, got %v", provs)
+	}
+	if !bytes.Equal(policyKey, key) {
+		t.Fatal("policy was not called with the provided key")
+	}
+	// the addresses of third-party providers are taken from the record
+	if got := dht.peerstore.Addrs(prov); len(got) != 1 || !got[0].Equal(addrs[0]) {
+		t.Fatalf("expected provider addresses to be stored, got %v", got)
+	}
+
+	if _, err := New(ctx, dht.host, ProviderAcceptPolicy(nil)); err == nil {
+		t.Fatal("expected an error for a nil provider accept policy")
+	}
+}
+
+func TestLoggableMessageKey(t *testing.T) {
+	p := test.RandPeerIDFatal(t)
+	if got := loggableMessageKey(pb.NewMessage(pb.Message_FIND_NODE, []byte(p), 0)).String(); got != p.String() {
+		t.Fatalf("expected FIND_NODE key to be logged as peer %s, got %s", p, got)
+	}
+
+	mh := u.Hash([]byte("slow"))
+	want := internal.LoggableProviderRecordBytes(mh).String()
+	if got := loggableMessageKey(pb.NewMessage(pb.Message_GET_PROVIDERS, mh, 0)).String(); got != want {
+		t.Fatalf("expected GET_PROVIDERS key to be logged as %s, got %s", want, got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dht := setupDHT(ctx, t, false)
+	if _, err := New(ctx, dht.host, SlowRequestLog(-time.Second)); err == nil {
+		t.Fatal("expected an error for a negative slow request threshold")
+	}
+}
+
+func TestLimitResponse(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dht := setupDHT(ctx, t, false)
+	dht.maxCloserPeers = 2
+	dht.maxProviders = 2
+	dht.maxAddrsPerPeer = 1
+
+	mkPeers := func(addrs ...string) []peer.AddrInfo {
+		ais := make([]peer.AddrInfo, len(addrs))
+		for i, a := range addrs {
+			ais[i] = peer.AddrInfo{
+				ID:    test.RandPeerIDFatal(t),
+				Addrs: []ma.Multiaddr{ma.StringCast(a), ma.StringCast("/ip4/127.0.0.1/tcp/4001")},
+			}
+		}
+		return ais
+	}
+
+	closer := mkPeers("/ip4/1.2.3.4/tcp/4001", "/ip4/1.2.5.6/tcp/4001", "/ip4/5.6.7.8/tcp/4001")
+	resp := pb.NewMessage(pb.Message_FIND_NODE, nil, 0)
+	resp.CloserPeers = pb.RawPeerInfosToPBPeers(closer)
+	dht.limitResponse(pb.NewMessage(pb.Message_FIND_NODE, nil, 0), resp)
+	got := pb.PBPeersToPeerInfos(resp.CloserPeers)
+	if len(got) != 2 || got[0].ID != closer[0].ID || got[1].ID != closer[2].ID {
+		t.Fatalf("expected the closest peers of distinct IP groups, got %v", got)
+	}
+	if len(got[0].Addrs) != 1 {
+		t.Fatalf("expected addresses to be capped, got %v", got[0].Addrs)
+	}
+
+	// paged providers are truncated from the end and the token is moved back
+	provs := mkPeers("/ip4/1.2.3.4/tcp/4001", "/ip4/1.2.3.5/tcp/4001", "/ip4/1.2.3.6/tcp/4001")
+	req := pb.NewMessage(pb.Message_GET_PROVIDERS, nil, 0)
+	req.ProviderPageSize = 3
+	page, _ := providersPage(provs, 3, nil)
+	resp = pb.NewMessage(pb.Message_GET_PROVIDERS, nil, 0)
+	resp.ProviderPeers = pb.RawPeerInfosToPBPeers(page)
+	dht.limitResponse(req, resp)
+	if len(resp.ProviderPeers) != 2 || !bytes.Equal(resp.ContinuationToken, []byte(page[1].ID)) {
+		t.Fatalf("expected a page of 2 providers continuing after %s, got %d providers and token %q",
+			page[1].ID, len(resp.ProviderPeers), resp.ContinuationToken)
+	}
+
+	// responses exceeding the size limit lose their farthest closer peers
+	dht.maxResponseSize = 1
+	resp = pb.NewMessage(pb.Message_FIND_NODE, nil, 0)
+	resp.CloserPeers = pb.RawPeerInfosToPBPeers(closer)
+	dht.limitResponse(pb.NewMessage(pb.Message_FIND_NODE, nil, 0), resp)
+	if len(resp.CloserPeers) != 0 {
+		t.Fatalf("expected all closer peers to be dropped, got %d", len(resp.CloserPeers))
+	}
+}
+
 func BenchmarkHandleFindPeer(b *testing.B) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -139,3 +311,39 @@ func BenchmarkHandleFindPeer(b *testing.B) {
 	}
 
 }
+
+func TestKeyspaceHeatmap(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dht := setupDHT(ctx, t, false)
+	from := test.RandPeerIDFatal(t)
+	addrs := []ma.Multiaddr{ma.StringCast("/ip4/1.2.3.4/tcp/4001")}
+
+	key := u.Hash([]byte("provided"))
+	msg := pb.NewMessage(pb.Message_ADD_PROVIDER, key, 0)
+	msg.ProviderPeers = pb.RawPeerInfosToPBPeers([]peer.AddrInfo{{ID: from, Addrs: addrs}})
+	if _, err := dht.handleAddProvider(ctx, from, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	recKey := "/v/stored"
+	put := pb.NewMessage(pb.Message_PUT_VALUE, []byte(recKey), 0)
+	put.Record = &recpb.Record{Key: []byte(recKey), Value: []byte("value")}
+	if _, err := dht.handlePutValue(ctx, from, put); err != nil {
+		t.Fatal(err)
+	}
+
+	hm := dht.KeyspaceHeatmap()
+	if len(hm.Records) != KeyspaceHeatmapMaxCPL+1 || len(hm.Providers) != KeyspaceHeatmapMaxCPL+1 {
+		t.Fatal("expected a bucket per CPL")
+	}
+	cpl := kb.CommonPrefixLen(dht.selfKey, kb.ConvertKey(string(key)))
+	if hm.Providers[cpl] != 1 {
+		t.Fatalf("expected the provider record in bucket %d, got %v", cpl, hm.Providers)
+	}
+	cpl = kb.CommonPrefixLen(dht.selfKey, kb.ConvertKey(recKey))
+	if hm.Records[cpl] != 1 {
+		t.Fatalf("expected the record in bucket %d, got %v", cpl, hm.Records)
+	}
+}
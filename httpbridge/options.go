@@ -0,0 +1,76 @@
+package httpbridge
+
+import (
+	"fmt"
+	"time"
+)
+
+// Option HTTP bridge option type.
+type Option func(*options) error
+
+type options struct {
+	providerLimit      int
+	timeout            time.Duration
+	suspicionThreshold float64
+	allowProvide       bool
+	allowPut           bool
+}
+
+// defaults are the default bridge options. This option will be automatically
+// prepended to any options you pass to the bridge constructor.
+var defaults = func(o *options) error {
+	o.providerLimit = 100
+	o.timeout = 30 * time.Second
+	o.suspicionThreshold = 0.5
+	return nil
+}
+
+// WithProviderLimit defines the maximum number of providers returned for a CID
+func WithProviderLimit(limit int) Option {
+	return func(o *options) error {
+		if limit <= 0 {
+			return fmt.Errorf("provider limit must be positive")
+		}
+		o.providerLimit = limit
+		return nil
+	}
+}
+
+// WithTimeout defines how long a single request may take
+func WithTimeout(timeout time.Duration) Option {
+	return func(o *options) error {
+		if timeout <= 0 {
+			return fmt.Errorf("timeout must be positive")
+		}
+		o.timeout = timeout
+		return nil
+	}
+}
+
+// WithSuspicionThreshold defines the attack score of a key above which responses mark the key as suspicious
+func WithSuspicionThreshold(threshold float64) Option {
+	return func(o *options) error {
+		if threshold < 0 || threshold > 1 {
+			return fmt.Errorf("suspicion threshold must be in [0, 1], got %f", threshold)
+		}
+		o.suspicionThreshold = threshold
+		return nil
+	}
+}
+
+// WithProvide allows clients to make the bridge provide CIDs with PUT requests. Disabled by default, as the bridge
+// announces itself as the provider.
+func WithProvide(allow bool) Option {
+	return func(o *options) error {
+		o.allowProvide = allow
+		return nil
+	}
+}
+
+// WithPut allows clients to publish IPNS records with PUT requests. Disabled by default.
+func WithPut(allow bool) Option {
+	return func(o *options) error {
+		o.allowPut = allow
+		return nil
+	}
+}
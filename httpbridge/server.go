@@ -0,0 +1,239 @@
+// Package httpbridge exposes the content and IPNS routing of the DHT over the Routing V1 HTTP API, so that clients
+// that don't speak the DHT protocol can use its eclipse-aware routing.
+//
+// The following endpoints are served:
+//
+//	GET /routing/v1/providers/{cid}
+//	PUT /routing/v1/providers/{cid}  (extension, see WithProvide)
+//	GET /routing/v1/ipns/{name}
+//	PUT /routing/v1/ipns/{name}      (see WithPut)
+//
+// Every response carries the attack detection verdict for the requested key in the Eclipse-Detection-Score and
+// Eclipse-Detection-Suspicious headers. Provider responses additionally carry it in the Detection field of the body.
+package httpbridge
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	logging "github.com/ipfs/go-log"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/routing"
+
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+)
+
+var logger = logging.Logger("dht-httpbridge")
+
+const (
+	providersPath = "/routing/v1/providers/"
+	ipnsPath      = "/routing/v1/ipns/"
+
+	ipnsRecordContentType = "application/vnd.ipfs.ipns-record"
+	// maxIPNSRecordSize is the maximum size of IPNS records accepted by PUT requests, as per the IPNS spec.
+	maxIPNSRecordSize = 10 << 10
+
+	// HeaderDetectionScore carries the attack score of the requested key in [0, 1].
+	HeaderDetectionScore = "Eclipse-Detection-Score"
+	// HeaderDetectionSuspicious is "true" if the attack score of the requested key exceeds the suspicion threshold.
+	HeaderDetectionSuspicious = "Eclipse-Detection-Suspicious"
+)
+
+// Router is the part of the DHT the bridge exposes. It is implemented by dht.IpfsDHT.
+type Router interface {
+	FindProvidersAsync(ctx context.Context, key cid.Cid, count int) <-chan peer.AddrInfo
+	Provide(ctx context.Context, key cid.Cid, brdcst bool) error
+	GetValue(ctx context.Context, key string, opts ...routing.Option) ([]byte, error)
+	PutValue(ctx context.Context, key string, value []byte, opts ...routing.Option) error
+	DetectionAggregator() *dht.DetectionAggregator
+}
+
+var _ Router = (*dht.IpfsDHT)(nil)
+
+// Server is an http.Handler serving the Routing V1 HTTP API from a Router.
+type Server struct {
+	router Router
+	opts   options
+}
+
+// New returns a Server bridging HTTP requests to router.
+func New(router Router, opts ...Option) (*Server, error) {
+	o := new(options)
+	if err := defaults(o); err != nil {
+		return nil, err
+	}
+	for _, opt := range opts {
+		if err := opt(o); err != nil {
+			return nil, err
+		}
+	}
+	return &Server{router: router, opts: *o}, nil
+}
+
+// Provider is a provider record as returned by the Routing V1 HTTP API.
+type Provider struct {
+	Schema    string
+	ID        peer.ID
+	Addrs     []string
+	Protocols []string
+}
+
+// Detection is the attack detection verdict for the requested key, an extension to the Routing V1 HTTP API.
+type Detection struct {
+	// Score combines the attack signals raised for the key, see dht.DetectionAggregator.Score.
+	Score float64
+	// Suspicious is set if Score exceeds the suspicion threshold of the bridge.
+	Suspicious bool
+	// Sources names the detection mechanisms that raised a signal for the key.
+	Sources []string `json:",omitempty"`
+}
+
+// ProvidersResponse is the body of a successful providers request.
+type ProvidersResponse struct {
+	Providers []Provider
+	Detection Detection
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), s.opts.timeout)
+	defer cancel()
+
+	switch {
+	case strings.HasPrefix(r.URL.Path, providersPath):
+		s.serveProviders(ctx, w, r, strings.TrimPrefix(r.URL.Path, providersPath))
+	case strings.HasPrefix(r.URL.Path, ipnsPath):
+		s.serveIPNS(ctx, w, r, strings.TrimPrefix(r.URL.Path, ipnsPath))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) serveProviders(ctx context.Context, w http.ResponseWriter, r *http.Request, name string) {
+	c, err := cid.Decode(name)
+	if err != nil {
+		http.Error(w, "invalid CID: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	key := string(c.Hash())
+
+	switch r.Method {
+	case http.MethodGet:
+		var provs []Provider
+		for ai := range s.router.FindProvidersAsync(ctx, c, s.opts.providerLimit) {
+			p := Provider{Schema: "peer", ID: ai.ID, Addrs: []string{}, Protocols: []string{}}
+			for _, a := range ai.Addrs {
+				p.Addrs = append(p.Addrs, a.String())
+			}
+			provs = append(provs, p)
+		}
+		det := s.detection(w, key)
+		if len(provs) == 0 {
+			http.Error(w, "no providers found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, &ProvidersResponse{Providers: provs, Detection: det})
+	case http.MethodPut:
+		if !s.opts.allowProvide {
+			http.Error(w, "provide is disabled", http.StatusMethodNotAllowed)
+			return
+		}
+		err := s.router.Provide(ctx, c, true)
+		s.detection(w, key)
+		if err != nil {
+			logger.Debugw("bridged provide failed", "cid", c, "error", err)
+			http.Error(w, "provide failed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) serveIPNS(ctx context.Context, w http.ResponseWriter, r *http.Request, name string) {
+	id, err := peer.Decode(name)
+	if err != nil {
+		http.Error(w, "invalid IPNS name: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	key := "/ipns/" + string(id)
+
+	switch r.Method {
+	case http.MethodGet:
+		val, err := s.router.GetValue(ctx, key)
+		s.detection(w, key)
+		if errors.Is(err, routing.ErrNotFound) {
+			http.Error(w, "record not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			logger.Debugw("bridged IPNS lookup failed", "name", id, "error", err)
+			http.Error(w, "lookup failed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", ipnsRecordContentType)
+		if _, err := w.Write(val); err != nil {
+			logger.Debugw("failed to write response", "error", err)
+		}
+	case http.MethodPut:
+		if !s.opts.allowPut {
+			http.Error(w, "publishing is disabled", http.StatusMethodNotAllowed)
+			return
+		}
+		val, err := io.ReadAll(io.LimitReader(r.Body, maxIPNSRecordSize+1))
+		if err != nil {
+			http.Error(w, "reading record: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(val) > maxIPNSRecordSize {
+			http.Error(w, "record too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		err = s.router.PutValue(ctx, key, val)
+		s.detection(w, key)
+		if err != nil {
+			logger.Debugw("bridged IPNS publish failed", "name", id, "error", err)
+			http.Error(w, "publish failed: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// detection returns the detection verdict for key and sets the detection headers of the response.
+func (s *Server) detection(w http.ResponseWriter, key string) Detection {
+	var det Detection
+	if agg := s.router.DetectionAggregator(); agg != nil {
+		sources := make(map[string]struct{})
+		for _, sig := range agg.Signals(key) {
+			sources[sig.Source] = struct{}{}
+		}
+		for src := range sources {
+			det.Sources = append(det.Sources, src)
+		}
+		sort.Strings(det.Sources)
+		det.Score = agg.Score(key)
+		det.Suspicious = det.Score > s.opts.suspicionThreshold
+	}
+	w.Header().Set(HeaderDetectionScore, strconv.FormatFloat(det.Score, 'f', -1, 64))
+	w.Header().Set(HeaderDetectionSuspicious, strconv.FormatBool(det.Suspicious))
+	return det
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Debugw("failed to write response", "error", err)
+	}
+}
@@ -0,0 +1,139 @@
+package httpbridge
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	u "github.com/ipfs/go-ipfs-util"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/routing"
+	"github.com/libp2p/go-libp2p/core/test"
+	bhost "github.com/libp2p/go-libp2p/p2p/host/basic"
+	swarmt "github.com/libp2p/go-libp2p/p2p/net/swarm/testing"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+)
+
+// fakeRouter serves canned providers and values, and the detection aggregator of a real DHT.
+type fakeRouter struct {
+	*dht.IpfsDHT
+	providers []peer.AddrInfo
+	values    map[string][]byte
+}
+
+func (r *fakeRouter) FindProvidersAsync(_ context.Context, _ cid.Cid, count int) <-chan peer.AddrInfo {
+	out := make(chan peer.AddrInfo, len(r.providers))
+	for i, ai := range r.providers {
+		if i == count {
+			break
+		}
+		out <- ai
+	}
+	close(out)
+	return out
+}
+
+func (r *fakeRouter) GetValue(_ context.Context, key string, _ ...routing.Option) ([]byte, error) {
+	v, ok := r.values[key]
+	if !ok {
+		return nil, routing.ErrNotFound
+	}
+	return v, nil
+}
+
+func (r *fakeRouter) PutValue(_ context.Context, key string, value []byte, _ ...routing.Option) error {
+	r.values[key] = value
+	return nil
+}
+
+func setupBridge(t *testing.T, opts ...Option) (*fakeRouter, *httptest.Server) {
+	ctx := context.Background()
+	h, err := bhost.NewHost(swarmt.GenSwarm(t, swarmt.OptDisableReuseport), new(bhost.HostOpts))
+	require.NoError(t, err)
+	t.Cleanup(func() { h.Close() })
+	d, err := dht.New(ctx, h, dht.ProtocolPrefix("/test"), dht.DisableAutoRefresh())
+	require.NoError(t, err)
+	t.Cleanup(func() { d.Close() })
+
+	r := &fakeRouter{IpfsDHT: d, values: make(map[string][]byte)}
+	s, err := New(r, opts...)
+	require.NoError(t, err)
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	return r, srv
+}
+
+func TestProviders(t *testing.T) {
+	r, srv := setupBridge(t, WithProviderLimit(2))
+	c := cid.NewCidV1(cid.Raw, u.Hash([]byte("bridge")))
+
+	resp, err := http.Get(srv.URL + providersPath + c.String())
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	require.Equal(t, "false", resp.Header.Get(HeaderDetectionSuspicious))
+
+	addr := multiaddr.StringCast("/ip4/1.2.3.4/tcp/4001")
+	for i := 0; i < 3; i++ {
+		r.providers = append(r.providers, peer.AddrInfo{ID: test.RandPeerIDFatal(t), Addrs: []multiaddr.Multiaddr{addr}})
+	}
+	r.DetectionAggregator().Report(dht.AttackSignal{Key: string(c.Hash()), Source: dht.SignalEclipseDetection, Score: 1})
+
+	resp, err = http.Get(srv.URL + providersPath + c.String())
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "true", resp.Header.Get(HeaderDetectionSuspicious))
+	require.Equal(t, "1", resp.Header.Get(HeaderDetectionScore))
+
+	var body ProvidersResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	require.Len(t, body.Providers, 2)
+	require.Equal(t, r.providers[0].ID, body.Providers[0].ID)
+	require.Equal(t, []string{addr.String()}, body.Providers[0].Addrs)
+	require.True(t, body.Detection.Suspicious)
+	require.Equal(t, []string{dht.SignalEclipseDetection}, body.Detection.Sources)
+
+	req, err := http.NewRequest(http.MethodPut, srv.URL+providersPath+c.String(), nil)
+	require.NoError(t, err)
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+
+	resp, err = http.Get(srv.URL + providersPath + "not-a-cid")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestIPNS(t *testing.T) {
+	_, srv := setupBridge(t, WithPut(true))
+	name := test.RandPeerIDFatal(t).String()
+
+	resp, err := http.Get(srv.URL + ipnsPath + name)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	req, err := http.NewRequest(http.MethodPut, srv.URL+ipnsPath+name, strings.NewReader("record"))
+	require.NoError(t, err)
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	resp, err = http.Get(srv.URL + ipnsPath + name)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, ipnsRecordContentType, resp.Header.Get("Content-Type"))
+	require.Equal(t, "0", resp.Header.Get(HeaderDetectionScore))
+}
@@ -0,0 +1,136 @@
+package dht
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/multiformats/go-base32"
+
+	"github.com/libp2p/go-libp2p-kad-dht/internal"
+)
+
+// RotateIdentity retires the peer identity of old, moving its duties to a new DHT on h, a host with the new identity,
+// configured with opts. Nodes targeted by attackers for a long time can rotate their identity to move to another
+// region of the keyspace. The rotation:
+//
+//   - seeds the routing table of the new DHT with the peers of the routing table of old, see AddPeer, and refreshes it
+//     around the new identity;
+//   - announces the departure of the old identity by switching old to client mode, so that its peers drop it from
+//     their routing tables;
+//   - hands the values old stores for others over to the peers closest to their keys;
+//   - provides the given keys, the content of the node, under the new identity;
+//   - shuts old down, see Shutdown, giving the provides in flight until ctx is done to finish.
+//
+// The provider records old stores for others aren't handed over, their providers republishing them periodically
+// anyway. Closing the host of old is left to the caller. Failures to hand over values and to provide keys are logged,
+// the rotation only failing if the new DHT can't be created.
+func RotateIdentity(ctx context.Context, old *IpfsDHT, h host.Host, provide []cid.Cid, opts ...Option) (*IpfsDHT, error) {
+	d, err := New(ctx, h, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	d.inheritRoutingTable(ctx, old)
+	if err := <-d.ForceRefresh(); err != nil {
+		logger.Warnw("failed to refresh the routing table of the new identity", "error", err)
+	}
+
+	if err := old.setMode(modeClient); err != nil {
+		logger.Warnw("failed to announce the departure of the old identity", "error", err)
+	}
+	d.handOverValues(ctx, old)
+
+	for _, key := range provide {
+		if err := d.Provide(ctx, key, true); err != nil {
+			logger.Warnw("failed to provide under the new identity", "cid", key, "error", err)
+		}
+	}
+
+	if err := old.Shutdown(ctx); err != nil {
+		logger.Warnw("failed to shut the old identity down", "error", err)
+	}
+	return d, nil
+}
+
+// inheritRoutingTable adds the peers of the routing table of old to the routing table of dht.
+func (dht *IpfsDHT) inheritRoutingTable(ctx context.Context, old *IpfsDHT) {
+	var (
+		wg   sync.WaitGroup
+		sema = make(chan struct{}, dht.alpha)
+	)
+	for _, p := range old.routingTable.ListPeers() {
+		ai := old.peerstore.PeerInfo(p)
+		if len(ai.Addrs) == 0 {
+			continue
+		}
+		dht.peerstore.AddAddrs(p, ai.Addrs, peerstore.TempAddrTTL)
+
+		select {
+		case sema <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sema }()
+			if added, reason, err := dht.AddPeer(ctx, ai); !added {
+				logger.Debugw("peer of the old identity not added", "peer", ai.ID, "reason", reason, "error", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// handOverValues puts the values stored by old to the peers now closest to their keys.
+func (dht *IpfsDHT) handOverValues(ctx context.Context, old *IpfsDHT) {
+	// the datastore may be shared with dht, so the keys are collected before putting any value
+	keys, err := old.storedValueKeys(ctx)
+	if err != nil {
+		logger.Warnw("failed to list the values of the old identity", "error", err)
+		return
+	}
+	for _, dsKey := range keys {
+		rec, err := old.getRecordFromDatastore(ctx, dsKey)
+		if err != nil || rec == nil {
+			continue
+		}
+		key := string(rec.GetKey())
+		if err := dht.PutValue(ctx, key, rec.GetValue()); err != nil {
+			logger.Debugw("failed to hand over value", "key", internal.LoggableRecordKeyString(key), "error", err)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// storedValueKeys returns the datastore keys of the values stored by dht.
+func (dht *IpfsDHT) storedValueKeys(ctx context.Context) ([]ds.Key, error) {
+	res, err := dht.datastore.Query(ctx, dsq.Query{KeysOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	var keys []ds.Key
+	for e := range res.Next() {
+		if e.Error != nil {
+			return nil, e.Error
+		}
+		// values are stored under a single base32 namespace, see mkDsKey
+		name := strings.TrimPrefix(e.Key, "/")
+		if _, err := base32.RawStdEncoding.DecodeString(name); err != nil || strings.Contains(name, "/") {
+			continue
+		}
+		keys = append(keys, ds.RawKey(e.Key))
+	}
+	return keys, nil
+}
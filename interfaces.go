@@ -0,0 +1,54 @@
+package dht
+
+import (
+	"context"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/routing"
+	"github.com/multiformats/go-multihash"
+)
+
+// ContentRouter is the content routing API of the DHT: routing.ContentRouting extended with the provide and find
+// variants specific to this implementation.
+type ContentRouter interface {
+	routing.ContentRouting
+
+	// ProvideWithReturn is like Provide but also returns the peers the provider record was sent to and the number of
+	// lookups it took to find them.
+	ProvideWithReturn(ctx context.Context, key cid.Cid, brdcst bool) (error, []peer.ID, int)
+	// ProvideWithoutEclipseDetection provides key to the closest peers without checking them for an eclipse attack.
+	ProvideWithoutEclipseDetection(ctx context.Context, key cid.Cid, brdcst bool) error
+	// FindProvidersReturnOnPathNodes is like FindProviders but also returns the peers contacted along the way.
+	FindProvidersReturnOnPathNodes(ctx context.Context, c cid.Cid) ([]peer.AddrInfo, []peer.ID, error)
+	// FindProvidersAsyncReturnOnPathNodes is like FindProvidersAsync but also streams the peers contacted along the
+	// way.
+	FindProvidersAsyncReturnOnPathNodes(ctx context.Context, key cid.Cid, count int) (<-chan peer.AddrInfo, <-chan peer.ID)
+}
+
+// AttackDetector is the attack detection API of the DHT.
+type AttackDetector interface {
+	// EclipseDetection checks whether peers, the closest peers to keyMH, show signs of an eclipse attack.
+	EclipseDetection(ctx context.Context, keyMH multihash.Multihash, peers []peer.ID) (bool, error)
+	// CrossCheckClosestPeers compares the closest peers to key found from independent seeds.
+	CrossCheckClosestPeers(ctx context.Context, key string) (*CrossCheckResult, error)
+	// AuditClosestPeers compares the closest peers to key found by a lookup with the ground truth of the trusted
+	// auditor.
+	AuditClosestPeers(ctx context.Context, key string) (*AuditResult, error)
+	// DetectionAggregator returns the aggregator collecting the attack signals.
+	DetectionAggregator() *DetectionAggregator
+}
+
+// RegionRouter is the API of the DHT for finding peers in a region of the keyspace.
+type RegionRouter interface {
+	// GetClosestPeers returns the closest peers to key.
+	GetClosestPeers(ctx context.Context, key string) ([]peer.ID, error)
+	// GetClosestPeersK returns the k closest peers to key.
+	GetClosestPeersK(ctx context.Context, key string, k int) ([]peer.ID, error)
+	// GetClosestPeersSeeded returns the closest peers to key, starting the lookup from seeds.
+	GetClosestPeersSeeded(ctx context.Context, key string, seeds []peer.ID) ([]peer.ID, error)
+	// GetPeersWithCPLGet returns all peers sharing a common prefix of at least minCPL bits with key, along with the
+	// number of lookups it took to find them. If the lookup budget is exceeded, the peers found so far are returned
+	// along with ErrCPLBudgetExceeded.
+	GetPeersWithCPLGet(ctx context.Context, key string, minCPL int) ([]peer.ID, int, error)
+}
@@ -1,18 +1,28 @@
 package config
 
 import (
+	"context"
 	"fmt"
 	"time"
 
+	"github.com/benbjohnson/clock"
 	ds "github.com/ipfs/go-datastore"
 	dssync "github.com/ipfs/go-datastore/sync"
 	"github.com/ipfs/go-ipns"
+	"github.com/libp2p/go-libp2p-kad-dht/netsize"
 	"github.com/libp2p/go-libp2p-kad-dht/providers"
 	"github.com/libp2p/go-libp2p-kbucket/peerdiversity"
 	record "github.com/libp2p/go-libp2p-record"
+	"github.com/libp2p/go-libp2p/core/connmgr"
+	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/protocol"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/multiformats/go-multihash"
+
+	detection "github.com/ssrivatsan97/go-libp2p-kad-dht/eclipse-detection"
 )
 
 // DefaultPrefix is the application specific prefix attached to all DHT protocols by default.
@@ -23,6 +33,37 @@ const defaultBucketSize = 20
 // ModeOpt describes what mode the dht should operate in
 type ModeOpt int
 
+// ProviderAddrPolicy decides which of our addresses are published in our provider records
+type ProviderAddrPolicy int
+
+// TenantQuota bounds the provides and lookups of a tenant to a rate per second, in bursts of at most the burst. A zero
+// rate is unlimited.
+type TenantQuota struct {
+	ProvideRate  float64
+	ProvideBurst int
+	LookupRate   float64
+	LookupBurst  int
+}
+
+// LoadSheddingThresholds are the levels of resource usage from which a server is under pressure: the number of
+// requests being handled, of goroutines, and the fraction of the CPUs used by the process. A zero threshold is unused.
+type LoadSheddingThresholds struct {
+	Inflight   int
+	Goroutines int
+	CPU        float64
+}
+
+// BayesianDetectionParams configure the Bayesian eclipse detector: the prior probability of attack of keys, the
+// posterior from which a key is under attack, the half-life of observations, and how reliable the verdicts of the
+// eclipse detector and of the trusted auditor are.
+type BayesianDetectionParams struct {
+	Prior     float64
+	Threshold float64
+	HalfLife  time.Duration
+	Detector  detection.Likelihood
+	Auditor   detection.Likelihood
+}
+
 // QueryFilterFunc is a filter applied when considering peers to dial when querying
 type QueryFilterFunc func(dht interface{}, ai peer.AddrInfo) bool
 
@@ -30,6 +71,40 @@ type QueryFilterFunc func(dht interface{}, ai peer.AddrInfo) bool
 // the local route table.
 type RouteTableFilterFunc func(dht interface{}, p peer.ID) bool
 
+// CandidateFilterFunc decides whether a peer returned as a closer peer by from during a lookup may enter the lookup.
+type CandidateFilterFunc func(from peer.ID, candidate *peer.AddrInfo) bool
+
+// KeyPolicy decides whether records under key are stored and served.
+type KeyPolicy func(key string) bool
+
+// ProviderAcceptFunc decides whether a provider record for key, received from peer from, is stored.
+type ProviderAcceptFunc func(from peer.ID, key multihash.Multihash, prov peer.AddrInfo) bool
+
+// AdmissionPolicy decides whether a peer that passed the routing table filter may take a routing table slot.
+type AdmissionPolicy interface {
+	// Admit returns true if p may be added to the routing table of dht.
+	Admit(dht interface{}, p peer.ID) bool
+}
+
+// ClosestPeersAuditor provides a ground-truth set of closest peers to a key.
+type ClosestPeersAuditor interface {
+	// ClosestPeers returns the closest peers to key known to the auditor, queried on behalf of dht.
+	ClosestPeers(ctx context.Context, dht interface{}, key string) ([]peer.ID, error)
+}
+
+// NetsizeSampler gathers lookup results for the network size estimator.
+type NetsizeSampler interface {
+	// Sample looks up sample keys with lookup; randomKey returns a random key sharing cpl leading bits with the local
+	// peer ID.
+	Sample(ctx context.Context, lookup func(ctx context.Context, key string) error, randomKey func(cpl uint) (string, error)) error
+}
+
+// ProviderVantage looks up the providers of a key from a vantage point independent of the routing table of a DHT.
+type ProviderVantage interface {
+	// FindProviders returns the providers of key found from the vantage point, looked up on behalf of dht.
+	FindProviders(ctx context.Context, dht interface{}, key multihash.Multihash) ([]peer.ID, error)
+}
+
 // Config is a structure containing all the options that can be used when constructing a DHT.
 type Config struct {
 	Datastore          ds.Batching
@@ -42,10 +117,279 @@ type Config struct {
 	Concurrency        int
 	Resiliency         int
 	MaxRecordAge       time.Duration
+	MaxRecordClockSkew time.Duration
 	EnableProviders    bool
 	EnableValues       bool
-	ProviderStore      providers.ProviderStore
-	QueryPeerFilter    QueryFilterFunc
+
+	// Clock timestamps records and schedules refreshes, provides, GC and backoffs, see dht.WithClock.
+	Clock clock.Clock
+
+	// ValuePolicy and ProviderPolicy restrict the keys values and provider records are enabled for if not nil, see
+	// dht.ValueKeyPolicy and dht.ProviderKeyPolicy.
+	ValuePolicy     KeyPolicy
+	ProviderPolicy  KeyPolicy
+	ProviderStore   providers.ProviderStore
+	QueryPeerFilter QueryFilterFunc
+
+	// CandidateFilter vetoes closer peers during lookups, see dht.WithCandidateFilter.
+	CandidateFilter CandidateFilterFunc
+
+	// BlackholeThreshold is the number of consecutive failed lookups signaling a blackhole, 0 if blackhole
+	// detection is disabled, see dht.BlackholeDetection.
+	BlackholeThreshold int
+
+	// ChurnReprovide sends the provider records of the provided keys to the peers joining their closest peers, see
+	// dht.ReprovideOnChurn.
+	ChurnReprovide struct {
+		Enabled  bool
+		Interval time.Duration
+		Rate     float64
+	}
+
+	// ClosestPeersWatch snapshots the closest peers of watched keys, see dht.WatchClosestPeers.
+	ClosestPeersWatch struct {
+		Enabled        bool
+		Interval       time.Duration
+		History        int
+		ChurnThreshold float64
+	}
+
+	// CloserPeerValidation discards closer peers that aren't closer to the lookup target, see
+	// dht.CloserPeerValidation.
+	CloserPeerValidation struct {
+		Enabled bool
+		Slack   int
+	}
+
+	// ProviderAcceptPolicy decides which received provider records are stored, see dht.ProviderAcceptPolicy.
+	ProviderAcceptPolicy ProviderAcceptFunc
+
+	// AddrGater and AddrFilter vet the addresses of peers learned from other peers before they are added to the
+	// peerstore, see dht.AddressGater and dht.AddressFilter.
+	AddrGater  connmgr.ConnectionGater
+	AddrFilter func(peer.ID, ma.Multiaddr) bool
+
+	// ProvideTargetsRetention is how long the peers provider records were sent to are kept, see
+	// dht.RecordProvideTargets.
+	ProvideTargetsRetention time.Duration
+
+	// ProviderAuditRetention is how long the submitters of the provider records we store are kept, see
+	// dht.RecordProviderAudit.
+	ProviderAuditRetention time.Duration
+
+	// MinProvideTargetGroups is the number of distinct IP groups the targets of a regular provide must span, see
+	// dht.MinProvideTargetGroups.
+	MinProvideTargetGroups int
+
+	// ValueCorroboration is the number of distinct IP groups the peers that returned a value must span before it is
+	// emitted by value lookups, 0 if not required, see dht.StrictValueCorroboration.
+	ValueCorroboration int
+
+	// CloserPeersPerGroup is the number of closer peers per IP group sent back with providers, 0 if unlimited, see
+	// dht.DiverseProviderCloserPeers.
+	CloserPeersPerGroup int
+
+	// ValidatorTimeout bounds the time the Validator may take per record, 0 if unbounded, see dht.ValidatorTimeout.
+	ValidatorTimeout time.Duration
+
+	// ProviderResolve configures the resolution of the addresses of providers found without addresses, see
+	// dht.ResolveProviderAddrs.
+	ProviderResolve struct {
+		Enabled     bool
+		Concurrency int
+		Timeout     time.Duration
+	}
+
+	// PeerAllowlist restricts the DHT to the listed peers if not nil, see dht.PeerAllowlist.
+	PeerAllowlist []peer.ID
+
+	// Overlay authenticates all messages with the membership credentials issued by Authority if it is not nil, see
+	// dht.AuthenticatedOverlay.
+	Overlay struct {
+		Authority  crypto.PubKey
+		Credential []byte
+	}
+
+	// ProviderRecords configures the encoding of the provider records we send, see dht.ProviderRecordMaxAddrs and
+	// dht.CompressProviderRecords.
+	ProviderRecords struct {
+		MaxAddrs int
+		Compress bool
+	}
+
+	// ValueMirroring replicates values put under attack to their whole keyspace region, see dht.ValueMirroring.
+	ValueMirroring struct {
+		Enabled   bool
+		PeerRate  float64
+		PeerBurst int
+	}
+
+	// TenantQuotas limits the provides and lookups of tenants, see dht.TenantQuotas.
+	TenantQuotas struct {
+		Enabled bool
+		Quotas  map[string]TenantQuota
+		Default TenantQuota
+	}
+
+	// LoadShedding rejects low priority requests with busy responses under pressure, see dht.LoadShedding.
+	LoadShedding struct {
+		Enabled    bool
+		Thresholds LoadSheddingThresholds
+	}
+
+	// RequestPrioritization bounds the number of inbound requests handled at a time if Concurrency is positive,
+	// handling the requests for the keys closest to us first, see dht.RequestPrioritization.
+	RequestPrioritization struct {
+		Concurrency int
+	}
+
+	// Readiness are the criteria for the DHT to be ready, see dht.ReadinessCriteria.
+	Readiness struct {
+		MinPeers       int
+		RequireNetsize bool
+	}
+
+	// DeferProvides defers the provides made before the DHT is ready, see dht.DeferProvidesUntilReady.
+	DeferProvides bool
+
+	// ProviderAddrTTL keeps the provider addresses claimed by third parties for Unverified, and for Verified once we
+	// were connected to the provider, if Unverified is positive, see dht.ProviderAddrTTL.
+	ProviderAddrTTL struct {
+		Unverified time.Duration
+		Verified   time.Duration
+	}
+
+	// ProviderAddrPolicy selects the addresses published in our provider records, see dht.ProviderAddrs.
+	ProviderAddrPolicy ProviderAddrPolicy
+
+	// LowPower defers expensive background work until the device is unconstrained, see dht.LowPowerMode.
+	LowPower bool
+
+	// QueryBudget bounds the resources of a single lookup, see dht.QueryBudget. Zero values are unlimited.
+	QueryBudget struct {
+		MaxRPCs  int
+		MaxDials int
+		MaxPeers int
+	}
+
+	// DialBackoff configures how long lookups skip peers that failed to dial, see dht.DialBackoff.
+	DialBackoff struct {
+		Base time.Duration
+		Max  time.Duration
+	}
+
+	// RPCTimeout bounds the adaptive timeout applied to every query RPC, see dht.RPCTimeout.
+	RPCTimeout struct {
+		Min time.Duration
+		Max time.Duration
+	}
+
+	// CPLLookupBudget bounds the enumeration of keyspace regions, see dht.CPLLookupBudget.
+	CPLLookupBudget struct {
+		MaxLookups int
+		MaxPeers   int
+		Timeout    time.Duration
+	}
+
+	// SlowRequestThreshold is the handling time above which received requests are logged, see dht.SlowRequestLog.
+	SlowRequestThreshold time.Duration
+
+	// RegionCacheTTL is how long enumerated keyspace regions are cached, see dht.RegionCacheTTL.
+	RegionCacheTTL time.Duration
+
+	// ClosestPeersCacheTTL is how long the closest peers found by lookups are cached, see dht.ClosestPeersCacheTTL.
+	ClosestPeersCacheTTL time.Duration
+
+	// ResponseLimits caps the responses to received requests, see dht.ResponsePeerLimits and dht.MaxResponseSize.
+	// Zero values are unlimited.
+	ResponseLimits struct {
+		MaxCloserPeers  int
+		MaxProviders    int
+		MaxAddrsPerPeer int
+		MaxSize         int
+	}
+
+	// ProvideQueue configures the durable provide queue, see dht.EnableProvideQueue.
+	ProvideQueue struct {
+		Enabled       bool
+		Workers       int
+		Rate          float64
+		MaxAttempts   int
+		RetryBackoff  time.Duration
+		PartitionBits int
+		// QueueProvides routes the provides of Provide through the queue, see dht.QueueProvides.
+		QueueProvides bool
+	}
+
+	// ProviderSubscriptions configures the experimental provider subscription protocol extension.
+	ProviderSubscriptions struct {
+		Enabled    bool
+		MaxTotal   int
+		MaxPerPeer int
+	}
+
+	// Netsize selects the network size estimator, see dht.NetsizeEstimator and dht.CrawlNetsizeEstimator.
+	Netsize struct {
+		Estimator    netsize.NetworkSizeEstimator
+		Crawl        bool
+		CrawlMaxAge  time.Duration
+		CrawlTimeout time.Duration
+		Sampler      NetsizeSampler
+		// Schedule runs the Sampler in the background, see dht.NetsizeGatheringSchedule.
+		Schedule struct {
+			Interval time.Duration
+			Jitter   time.Duration
+		}
+	}
+
+	// DetectionKeyspace is the keyspace the eclipse detector analyses common prefix lengths in.
+	DetectionKeyspace detection.Keyspace
+	// BayesianDetection accumulates the verdicts on keys into posterior probabilities of attack if Enabled, see
+	// dht.BayesianEclipseDetection.
+	BayesianDetection struct {
+		Enabled bool
+		Params  BayesianDetectionParams
+	}
+	// DetectionTest is the statistical test the verdict of the eclipse detector is based on, see
+	// dht.EclipseDetectionTest.
+	DetectionTest struct {
+		Test         detection.Test
+		Significance float64
+	}
+
+	// AsyncProvideDetection runs the eclipse detection of provides after they returned, see
+	// dht.AsyncEclipseDetection.
+	AsyncProvideDetection bool
+
+	// StrictProvideDetection fails the provides whose eclipse detection could not run, see
+	// dht.StrictEclipseDetection.
+	StrictProvideDetection bool
+
+	// CrossCheck configures lookup cross-checking, see dht.IpfsDHT.CrossCheckClosestPeers.
+	CrossCheck struct {
+		Threshold float64
+		Seeds     []peer.ID
+	}
+
+	// Audit configures checking lookups against a trusted auditor, see dht.TrustedAuditor.
+	Audit struct {
+		Auditor   ClosestPeersAuditor
+		Threshold float64
+	}
+
+	// Vantages configures verifying provides from independent vantage points, see dht.IndependentVantages.
+	Vantages struct {
+		Vantages []ProviderVantage
+		Delay    time.Duration
+	}
+
+	// DetectorHints configures the experimental detector hints protocol extension, see dht.ServeDetectorHints and
+	// dht.RequestDetectorHints.
+	DetectorHints struct {
+		Serve     bool
+		Request   bool
+		Tolerance float64
+	}
 
 	RoutingTable struct {
 		RefreshQueryTimeout time.Duration
@@ -55,10 +399,29 @@ type Config struct {
 		CheckInterval       time.Duration
 		PeerFilter          RouteTableFilterFunc
 		DiversityFilter     peerdiversity.PeerIPGroupFilter
+		AdmissionPolicy     AdmissionPolicy
+
+		// BehaviorEviction configures evicting peers returning suspicious closer peers, see dht.BehaviorEviction.
+		BehaviorEviction struct {
+			Enabled          bool
+			MinEvidence      int
+			EvictThreshold   float64
+			RecoverThreshold float64
+		}
 	}
 
+	// Denylist are peers known to be malicious, see dht.PeerDenylist.
+	Denylist []peer.ID
+
 	BootstrapPeers func() []peer.AddrInfo
 
+	// DeduplicateLookups coalesces concurrent lookups of the same key, see dht.DeduplicateLookups.
+	DeduplicateLookups bool
+
+	// QueriedPeersOnly keeps the routing table independent of the connections of the host: besides the bootstrap
+	// peers, only peers that answered our own queries are added. See dht.NewShadowDHT.
+	QueriedPeersOnly bool
+
 	// test specific Config options
 	DisableFixLowPeers          bool
 	TestAddressUpdateProcessing bool
@@ -115,11 +478,31 @@ var Defaults = func(o *Config) error {
 	o.RoutingTable.AutoRefresh = true
 	o.RoutingTable.PeerFilter = EmptyRTFilter
 	o.MaxRecordAge = time.Hour * 36
+	o.MaxRecordClockSkew = 5 * time.Minute
+	o.Clock = clock.New()
 
 	o.BucketSize = defaultBucketSize
 	o.Concurrency = 10
 	o.Resiliency = 3
 
+	o.RPCTimeout.Min = 2 * time.Second
+	o.RPCTimeout.Max = 10 * time.Second
+
+	o.ResponseLimits.MaxSize = network.MessageSizeMax
+
+	o.ProvideQueue.MaxAttempts = 10
+	o.ProvideQueue.RetryBackoff = time.Minute
+
+	o.CrossCheck.Threshold = 0.5
+	o.Audit.Threshold = 0.5
+
+	o.DetectionKeyspace = detection.SHA256Keyspace
+	o.DetectionTest.Test = detection.TestKL
+	o.DetectionTest.Significance = detection.DefaultSignificance
+
+	o.Readiness.MinPeers = defaultBucketSize
+	o.Readiness.RequireNetsize = true
+
 	return nil
 }
 
@@ -127,6 +510,9 @@ func (c *Config) Validate() error {
 	if c.ProtocolPrefix != DefaultPrefix {
 		return nil
 	}
+	if c.Overlay.Authority != nil {
+		return fmt.Errorf("protocol prefix %s must not be used by authenticated overlays", DefaultPrefix)
+	}
 	if c.BucketSize != defaultBucketSize {
 		return fmt.Errorf("protocol prefix %s must use bucket size %d", DefaultPrefix, defaultBucketSize)
 	}
@@ -0,0 +1,78 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"math/bits"
+
+	kb "github.com/libp2p/go-libp2p-kbucket"
+)
+
+// KadKey returns the key of id in the Kademlia keyspace, like kb.ConvertKey but without allocating it on the heap.
+func KadKey(id string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(id))
+}
+
+// CommonPrefixLen returns the number of leading bits a and b have in common, like kb.CommonPrefixLen but without
+// allocating their XOR.
+func CommonPrefixLen(a, b []byte) int {
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+	for i := 0; i < n; i++ {
+		if x := a[i] ^ b[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return n * 8
+}
+
+// CompareDistance compares the XOR distances of a and b to target, returning -1 if a is closer, 1 if b is closer and 0
+// if they are equally close. All three must have the same length.
+func CompareDistance(a, b, target []byte) int {
+	for i := range target {
+		da, db := a[i]^target[i], b[i]^target[i]
+		if da != db {
+			if da < db {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// CompareXOR compares the XOR distance of a and b to limit, returning -1, 0 or 1 if it is less than, equal to or
+// greater than limit. All three must have the same length.
+func CompareXOR(a, b, limit []byte) int {
+	for i := range limit {
+		if d := a[i] ^ b[i]; d != limit[i] {
+			if d < limit[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// KeyCache caches the conversions of keys and peer IDs to the Kademlia keyspace, so that loops converting the same
+// peers over and over, e.g. in the course of a query, hash each one only once. It is not safe for concurrent use.
+type KeyCache struct {
+	ids map[string]kb.ID
+}
+
+// NewKeyCache returns an empty KeyCache.
+func NewKeyCache() *KeyCache {
+	return &KeyCache{ids: make(map[string]kb.ID)}
+}
+
+// Key returns the key of id in the Kademlia keyspace, i.e. kb.ConvertKey(id).
+func (c *KeyCache) Key(id string) kb.ID {
+	k, ok := c.ids[id]
+	if !ok {
+		k = kb.ConvertKey(id)
+		c.ids[id] = k
+	}
+	return k
+}
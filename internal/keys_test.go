@@ -0,0 +1,52 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	u "github.com/ipfs/go-ipfs-util"
+	kb "github.com/libp2p/go-libp2p-kbucket"
+)
+
+func TestKeyHelpers(t *testing.T) {
+	target := KadKey("target")
+	if !bytes.Equal(target[:], kb.ConvertKey("target")) {
+		t.Fatal("expected KadKey to match kb.ConvertKey")
+	}
+
+	for i := 0; i < 100; i++ {
+		a, b := KadKey(fmt.Sprint("a", i)), KadKey(fmt.Sprint("b", i))
+		if got, want := CommonPrefixLen(a[:], target[:]), kb.CommonPrefixLen(a[:], target[:]); got != want {
+			t.Fatalf("expected common prefix length %d, got %d", want, got)
+		}
+
+		da, db := u.XOR(a[:], target[:]), u.XOR(b[:], target[:])
+		if got, want := CompareDistance(a[:], b[:], target[:]), bytes.Compare(da, db); got != want {
+			t.Fatalf("expected distance comparison %d, got %d", want, got)
+		}
+		if CompareXOR(a[:], target[:], da) != 0 || CompareXOR(a[:], target[:], db) != bytes.Compare(da, db) {
+			t.Fatal("unexpected comparison of the distance to a limit")
+		}
+	}
+	if CommonPrefixLen(target[:], target[:]) != 256 {
+		t.Fatal("expected identical keys to share all bits")
+	}
+
+	a, b := KadKey("a"), KadKey("b")
+	if n := testing.AllocsPerRun(100, func() {
+		CommonPrefixLen(a[:], target[:])
+		CompareDistance(a[:], b[:], target[:])
+	}); n != 0 {
+		t.Fatalf("expected no allocations, got %f", n)
+	}
+
+	c := NewKeyCache()
+	k := c.Key("target")
+	if !bytes.Equal(k, target[:]) {
+		t.Fatal("expected the cached key to match kb.ConvertKey")
+	}
+	if n := testing.AllocsPerRun(100, func() { c.Key("target") }); n != 0 {
+		t.Fatalf("expected cached conversions not to allocate, got %f", n)
+	}
+}
@@ -94,6 +94,14 @@ func (m *messageSenderImpl) SendRequest(ctx context.Context, p peer.ID, pmes *pb
 		logger.Debugw("request failed", "error", err, "to", p)
 		return nil, err
 	}
+	if rpmes.GetBusy() {
+		stats.Record(ctx,
+			metrics.SentRequests.M(1),
+			metrics.SentRequestErrors.M(1),
+		)
+		logger.Debugw("request rejected by busy peer", "to", p)
+		return nil, pb.ErrBusy
+	}
 
 	stats.Record(ctx,
 		metrics.SentRequests.M(1),
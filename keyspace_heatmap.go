@@ -0,0 +1,57 @@
+package dht
+
+import (
+	"context"
+	"sync/atomic"
+
+	kb "github.com/libp2p/go-libp2p-kbucket"
+	"go.opencensus.io/stats"
+
+	"github.com/libp2p/go-libp2p-kad-dht/internal"
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+)
+
+// KeyspaceHeatmapMaxCPL is the common prefix length counted by the last bucket of a KeyspaceHeatmap, which counts all
+// keys sharing at least as many bits with our ID.
+const KeyspaceHeatmapMaxCPL = 32
+
+// KeyspaceHeatmap is the distribution of the keys of the records and provider records stored with us by remote peers,
+// bucketed by their common prefix length (CPL) with our ID. Publishers store records with the peers closest to the key,
+// so most keys are expected to share about log2(network size / bucket size) bits with our ID. Many records with a much
+// lower CPL mean that publishers consider us part of wide provide regions, or that something is off.
+type KeyspaceHeatmap struct {
+	// Records and Providers count the records and provider records stored by CPL, from 0 to KeyspaceHeatmapMaxCPL.
+	Records   []uint64
+	Providers []uint64
+}
+
+// keyspaceHeatmap counts stored keys by CPL, see KeyspaceHeatmap.
+type keyspaceHeatmap struct {
+	records   [KeyspaceHeatmapMaxCPL + 1]uint64
+	providers [KeyspaceHeatmapMaxCPL + 1]uint64
+}
+
+// stored counts key, stored with us, in buckets and reports its CPL with self to the metrics.
+func (h *keyspaceHeatmap) stored(ctx context.Context, buckets *[KeyspaceHeatmapMaxCPL + 1]uint64, self kb.ID, key []byte) {
+	keyHash := internal.KadKey(string(key))
+	cpl := internal.CommonPrefixLen(self, keyHash[:])
+	stats.Record(ctx, metrics.StoredKeyCPL.M(int64(cpl)))
+	if cpl > KeyspaceHeatmapMaxCPL {
+		cpl = KeyspaceHeatmapMaxCPL
+	}
+	atomic.AddUint64(&buckets[cpl], 1)
+}
+
+// KeyspaceHeatmap returns the distribution of the keys of the records and provider records stored with us since the
+// DHT started, see KeyspaceHeatmap. The distribution is also exported by the metrics.StoredKeyCPL measure.
+func (dht *IpfsDHT) KeyspaceHeatmap() KeyspaceHeatmap {
+	hm := KeyspaceHeatmap{
+		Records:   make([]uint64, KeyspaceHeatmapMaxCPL+1),
+		Providers: make([]uint64, KeyspaceHeatmapMaxCPL+1),
+	}
+	for i := range hm.Records {
+		hm.Records[i] = atomic.LoadUint64(&dht.keyspaceHeatmap.records[i])
+		hm.Providers[i] = atomic.LoadUint64(&dht.keyspaceHeatmap.providers[i])
+	}
+	return hm
+}
@@ -0,0 +1,176 @@
+package dht
+
+import (
+	"math"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	sigar "github.com/elastic/gosigar"
+	"github.com/jbenet/goprocess"
+	"go.opencensus.io/stats"
+
+	dhtcfg "github.com/libp2p/go-libp2p-kad-dht/internal/config"
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+
+	kb "github.com/libp2p/go-libp2p-kbucket"
+)
+
+const (
+	// loadSampleInterval is the interval the CPU usage is sampled at.
+	loadSampleInterval = time.Second
+	// loadSheddingStep is the pressure from which every additional request priority is shed.
+	loadSheddingStep = 0.25
+)
+
+// Priorities of inbound requests, the lowest shed first under pressure.
+const (
+	// priorityFarProviders are the provider lookups for keys we aren't among the closest peers of.
+	priorityFarProviders = iota
+	priorityLookup
+	priorityStore
+	priorityFindNode
+	// priorityPing requests are never shed.
+	priorityPing
+)
+
+// LoadSheddingStatus is the resource usage load shedding is based on, see IpfsDHT.LoadSheddingStatus.
+type LoadSheddingStatus struct {
+	// Pressure is the highest ratio of a resource usage to its threshold, requests are shed from 1.
+	Pressure   float64
+	Inflight   int
+	Goroutines int
+	// CPU is the fraction of the CPUs used by the process during the last sampling interval.
+	CPU float64
+	// Shed is the number of requests rejected with a busy response so far.
+	Shed uint64
+}
+
+// loadShedder measures the resource usage of the node and decides which inbound requests to shed, see LoadShedding.
+type loadShedder struct {
+	// accessed atomically, first for alignment
+	inflight int64
+	shed     uint64
+	cpu      uint64 // math.Float64bits of the CPU usage
+
+	thresholds dhtcfg.LoadSheddingThresholds
+}
+
+// status returns the current resource usage.
+func (l *loadShedder) status() LoadSheddingStatus {
+	s := LoadSheddingStatus{
+		Inflight: int(atomic.LoadInt64(&l.inflight)),
+		CPU:      math.Float64frombits(atomic.LoadUint64(&l.cpu)),
+		Shed:     atomic.LoadUint64(&l.shed),
+	}
+	ratio := func(usage float64, threshold float64) {
+		if threshold > 0 && usage/threshold > s.Pressure {
+			s.Pressure = usage / threshold
+		}
+	}
+	ratio(float64(s.Inflight), float64(l.thresholds.Inflight))
+	if l.thresholds.Goroutines > 0 {
+		s.Goroutines = runtime.NumGoroutine()
+		ratio(float64(s.Goroutines), float64(l.thresholds.Goroutines))
+	}
+	ratio(s.CPU, l.thresholds.CPU)
+	return s
+}
+
+// shedsPriority tells whether requests of priority prio are shed under pressure.
+func shedsPriority(pressure float64, prio int) bool {
+	return prio < priorityPing && pressure >= 1+float64(prio)*loadSheddingStep
+}
+
+// requestPriority returns the priority of req when shedding load.
+func (dht *IpfsDHT) requestPriority(req *pb.Message) int {
+	switch req.GetType() {
+	case pb.Message_PING:
+		return priorityPing
+	case pb.Message_FIND_NODE:
+		return priorityFindNode
+	case pb.Message_PUT_VALUE, pb.Message_ADD_PROVIDER:
+		return priorityStore
+	case pb.Message_GET_PROVIDERS:
+		// the bucket of the key holds peers closer to it than us, if it is full we aren't among its closest peers
+		cpl := kb.CommonPrefixLen(dht.selfKey, kb.ConvertKey(string(req.GetKey())))
+		if dht.routingTable.NPeersForCpl(uint(cpl)) >= dht.bucketSize {
+			return priorityFarProviders
+		}
+	}
+	return priorityLookup
+}
+
+// shedRequest tells whether req is to be rejected with a busy response to shed load.
+func (dht *IpfsDHT) shedRequest(req *pb.Message) bool {
+	l := dht.loadShedder
+	if l == nil {
+		return false
+	}
+	if !shedsPriority(l.status().Pressure, dht.requestPriority(req)) {
+		return false
+	}
+	atomic.AddUint64(&l.shed, 1)
+	return true
+}
+
+// trackHandler counts a request being handled until the returned function is called.
+func (dht *IpfsDHT) trackHandler() func() {
+	l := dht.loadShedder
+	if l == nil {
+		return func() {}
+	}
+	atomic.AddInt64(&l.inflight, 1)
+	return func() { atomic.AddInt64(&l.inflight, -1) }
+}
+
+// LoadSheddingStatus returns the resource usage load shedding is based on, and false if load shedding is disabled,
+// see LoadShedding.
+func (dht *IpfsDHT) LoadSheddingStatus() (LoadSheddingStatus, bool) {
+	if dht.loadShedder == nil {
+		return LoadSheddingStatus{}, false
+	}
+	return dht.loadShedder.status(), true
+}
+
+// sampleLoad samples the CPU usage of the process and records the pressure every loadSampleInterval until proc
+// closes.
+func (dht *IpfsDHT) sampleLoad(proc goprocess.Process) {
+	l := dht.loadShedder
+	pid := os.Getpid()
+	var pt sigar.ProcTime
+	sampleCPU := l.thresholds.CPU > 0
+	if sampleCPU {
+		if err := pt.Get(pid); err != nil {
+			logger.Warnw("failed to sample the CPU usage, load shedding ignores it", "error", err)
+			sampleCPU = false
+		}
+	}
+	prevTotal, prevTime := pt.Total, time.Now()
+
+	ticker := dht.clock.Ticker(loadSampleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-proc.Closing():
+			return
+		}
+		if sampleCPU {
+			if err := pt.Get(pid); err != nil {
+				logger.Debugw("failed to sample the CPU usage", "error", err)
+				continue
+			}
+			now := time.Now()
+			if elapsed := now.Sub(prevTime); elapsed > 0 {
+				// ProcTime is in milliseconds
+				cpu := float64(pt.Total-prevTotal) / (float64(elapsed) / float64(time.Millisecond)) / float64(runtime.NumCPU())
+				atomic.StoreUint64(&l.cpu, math.Float64bits(cpu))
+			}
+			prevTotal, prevTime = pt.Total, now
+		}
+		stats.Record(dht.newContextWithLocalTags(dht.ctx), metrics.LoadPressure.M(l.status().Pressure))
+	}
+}
@@ -2,6 +2,8 @@ package dht
 
 import (
 	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"time"
 
@@ -10,24 +12,80 @@ import (
 
 	util "github.com/ipfs/go-ipfs-util"
 	kb "github.com/libp2p/go-libp2p-kbucket"
+
+	"github.com/libp2p/go-libp2p-kad-dht/internal"
 )
 
 type requestFn func(context.Context, string) ([]peer.ID, error)
 
+// regionEventPrefix prefixes the region identifiers tagging the QueryEvents of the sub-lookups of GetPeersWithCPL.
+const regionEventPrefix = "region "
+
+type lookupRegionKey struct{}
+
+// withLookupRegion tags the QueryEvents published by the lookups run with ctx with the keyspace region of the keys
+// sharing cpl leading bits with key, identified as "region <cpl>/<hex encoded prefix>".
+func withLookupRegion(ctx context.Context, key string, cpl int) context.Context {
+	if !routing.SubscribesToQueryEvents(ctx) {
+		return ctx
+	}
+	target := internal.KadKey(key)
+	return context.WithValue(ctx, lookupRegionKey{}, fmt.Sprintf("%s%d/%x", regionEventPrefix, cpl, regionPrefix(target[:], cpl)))
+}
+
+// publishQueryEvent publishes ev tagged with the region of the sub-lookup of GetPeersWithCPL it belongs to, if any.
+func publishQueryEvent(ctx context.Context, ev *routing.QueryEvent) {
+	if region, ok := ctx.Value(lookupRegionKey{}).(string); ok && ev.Extra == "" {
+		ev.Extra = region
+	}
+	routing.PublishQueryEvent(ctx, ev)
+}
+
 // GetClosestPeers is a Kademlia 'node lookup' operation. Returns a channel of
 // the K closest peers to the given key.
 //
 // If the context is canceled, this function will return the context error along
-// with the closest K peers it has found so far.
+// with the closest K peers it has found so far. The peers may come from the
+// closest peers cache, see ClosestPeersCacheTTL.
 func (dht *IpfsDHT) GetClosestPeers(ctx context.Context, key string) ([]peer.ID, error) {
+	return dht.getClosestPeersCached(ctx, key)
+}
+
+// GetClosestPeersSeeded is like GetClosestPeers but starts the lookup from the given seed peers (e.g. the result of
+// a previous lookup or a set of trusted peers) instead of the peers closest to the key in the local routing table.
+// This can speed up repeated lookups and makes it possible to cross-check lookup results against a routing table
+// that may have been poisoned.
+//
+// The addresses of seed peers that we are not connected to must be known to the peerstore.
+func (dht *IpfsDHT) GetClosestPeersSeeded(ctx context.Context, key string, seeds []peer.ID) ([]peer.ID, error) {
+	if len(seeds) == 0 {
+		return nil, fmt.Errorf("no seed peers given")
+	}
+	return dht.getClosestPeers(ctx, key, seeds)
+}
+
+// GetClosestPeersK is like GetClosestPeers but returns the k closest peers to key instead of bucket size peers, e.g.
+// exactly as many peers as the eclipse detector analyses.
+func (dht *IpfsDHT) GetClosestPeersK(ctx context.Context, key string, k int) ([]peer.ID, error) {
+	if k <= 0 {
+		return nil, fmt.Errorf("number of closest peers must be positive, got %d", k)
+	}
+	return dht.getClosestPeers(withLookupSize(ctx, k), key, nil)
+}
+
+func (dht *IpfsDHT) getClosestPeers(ctx context.Context, key string, seeds []peer.ID) ([]peer.ID, error) {
 	if key == "" {
 		return nil, fmt.Errorf("can't lookup empty key")
 	}
+	ctx, err := dht.chargeQuota(ctx, quotaOpLookup)
+	if err != nil {
+		return nil, err
+	}
 	// TODO: I can break the interface! return []peer.ID
-	lookupRes, err := dht.runLookupWithFollowup(ctx, key,
+	lookupRes, err := dht.runSeededLookupWithFollowup(ctx, key, seeds,
 		func(ctx context.Context, p peer.ID) ([]*peer.AddrInfo, error) {
 			// For DHT query command
-			routing.PublishQueryEvent(ctx, &routing.QueryEvent{
+			publishQueryEvent(ctx, &routing.QueryEvent{
 				Type: routing.SendingQuery,
 				ID:   p,
 			})
@@ -39,7 +97,7 @@ func (dht *IpfsDHT) GetClosestPeers(ctx context.Context, key string) ([]peer.ID,
 			}
 
 			// For DHT query command
-			routing.PublishQueryEvent(ctx, &routing.QueryEvent{
+			publishQueryEvent(ctx, &routing.QueryEvent{
 				Type:      routing.PeerResponse,
 				ID:        p,
 				Responses: peers,
@@ -47,7 +105,7 @@ func (dht *IpfsDHT) GetClosestPeers(ctx context.Context, key string) ([]peer.ID,
 
 			return peers, err
 		},
-		func() bool { return false },
+		neverStop,
 	)
 
 	if err != nil {
@@ -55,34 +113,116 @@ func (dht *IpfsDHT) GetClosestPeers(ctx context.Context, key string) ([]peer.ID,
 	}
 
 	if ctx.Err() == nil && lookupRes.completed {
-		// tracking lookup results for network size estimator
-		if err = dht.nsEstimator.Track(key, lookupRes.peers); err != nil {
-			logger.Warnf("network size estimator track peers: %s", err)
+		// tracking lookup results for network size estimator, which expects the bucket size closest peers
+		if dht.lookupSize(ctx) >= dht.bucketSize {
+			tracked := lookupRes.peers
+			if len(tracked) > dht.bucketSize {
+				tracked = tracked[:dht.bucketSize]
+			}
+			if err = dht.nsEstimator.Track(key, tracked); err != nil {
+				logger.Warnf("network size estimator track peers: %s", err)
+			}
 		}
 		// refresh the cpl for this key as the query was successful
-		dht.routingTable.ResetCplRefreshedAtForID(kb.ConvertKey(key), time.Now())
+		dht.routingTable.ResetCplRefreshedAtForID(kb.ConvertKey(key), dht.clock.Now())
 	}
 
 	return lookupRes.peers, ctx.Err()
 }
 
 func (dht *IpfsDHT) GetPeersWithCPLGet(ctx context.Context, key string, minCPL int) ([]peer.ID, int, error) {
-	return dht.GetPeersWithCPL(ctx, key, minCPL, dht.GetClosestPeers)
+	return dht.getPeersWithCPLCached(ctx, key, minCPL)
+}
+
+// ErrCPLBudgetExceeded is returned along with the peers found so far when the enumeration of a keyspace region
+// exceeds the budget configured with CPLLookupBudget.
+var ErrCPLBudgetExceeded = errors.New("CPL lookup budget exceeded")
+
+// cplBudget bounds the lookups spent enumerating a keyspace region. Zero limits are unlimited.
+type cplBudget struct {
+	maxLookups int
+	maxPeers   int
+	lookups    int
+	seen       map[peer.ID]struct{}
+	exceeded   bool
+}
+
+// spend accounts for a lookup about to be run. It returns false if the budget does not allow for it.
+func (b *cplBudget) spend(ctx context.Context) bool {
+	if b.exceeded || ctx.Err() != nil ||
+		(b.maxLookups > 0 && b.lookups >= b.maxLookups) ||
+		(b.maxPeers > 0 && len(b.seen) >= b.maxPeers) {
+		b.exceeded = true
+		return false
+	}
+	b.lookups++
+	return true
+}
+
+func (b *cplBudget) found(peers []peer.ID) {
+	for _, p := range peers {
+		b.seen[p] = struct{}{}
+	}
 }
 
 // Function to find all peers with common prefix length >= minCPL with key
+//
+// The number of lookups, peers and the time spent are bounded by the budget configured with CPLLookupBudget. If the
+// budget is hit, the peers found so far are returned along with ErrCPLBudgetExceeded.
+//
+// The QueryEvents published by the sub-lookups carry the keyspace region they enumerate in their Extra field, as
+// "region <cpl>/<hex encoded prefix>".
 func (dht *IpfsDHT) GetPeersWithCPL(ctx context.Context, key string, minCPL int, requestFn requestFn) ([]peer.ID, int, error) {
+	budgetCtx := ctx
+	if dht.cplTimeout > 0 {
+		var cancel context.CancelFunc
+		budgetCtx, cancel = context.WithTimeout(ctx, dht.cplTimeout)
+		defer cancel()
+	}
+	b := &cplBudget{
+		maxLookups: dht.cplMaxLookups,
+		maxPeers:   dht.cplMaxPeers,
+		seen:       make(map[peer.ID]struct{}),
+	}
+
+	set, numLookups, err := dht.getPeersWithCPL(budgetCtx, key, minCPL, requestFn, b)
+	if err != nil && ctx.Err() == nil && budgetCtx.Err() != nil {
+		// the time budget ran out in the middle of a lookup
+		b.exceeded, err = true, nil
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		return nil, numLookups, err
+	}
+	if b.exceeded {
+		if b.maxPeers > 0 && len(set) > b.maxPeers {
+			set = set[:b.maxPeers]
+		}
+		logger.Debugw("CPL lookup budget exceeded", "key", internal.LoggableRecordKeyString(key), "minCPL", minCPL,
+			"lookups", numLookups, "peers", len(set))
+		return set, numLookups, ErrCPLBudgetExceeded
+	}
+	return set, numLookups, nil
+}
+
+func (dht *IpfsDHT) getPeersWithCPL(ctx context.Context, key string, minCPL int, requestFn requestFn, b *cplBudget) ([]peer.ID, int, error) {
 	// Input validation
 	if minCPL < 0 {
 		minCPL = 0
 	}
 	numLookups := 0
+	if !b.spend(ctx) {
+		return nil, numLookups, nil
+	}
 	// set, err := dht.GetClosestPeers(ctx, key)
-	set, err := requestFn(ctx, key)
+	set, err := requestFn(withLookupRegion(ctx, key, minCPL), key)
 	if err != nil {
 		return nil, numLookups, err
 	}
 	numLookups += 1
+	b.found(set)
 	// fmt.Printf("Get peers with CPL %d  for %x\n", minCPL, []byte(kb.ConvertKey(key)))
 	// fmt.Println("From first query:", len(set), "peers")
 	cpl := minCommonPrefixLength(set, key)
@@ -94,7 +234,7 @@ func (dht *IpfsDHT) GetPeersWithCPL(ctx context.Context, key string, minCPL int,
 			return nil, numLookups, err
 		}
 	}
-	for cpl >= minCPL {
+	for cpl >= minCPL && !b.exceeded {
 		// Construct a random peerid to lookup, which has common prefix length EXACTLY cpl with key
 		var queryPeerID peer.ID
 		if cpl <= 15 { // This condition is because I can only generate random peerid with common prefix length <= 15
@@ -103,7 +243,7 @@ func (dht *IpfsDHT) GetPeersWithCPL(ctx context.Context, key string, minCPL int,
 				return nil, numLookups, err
 			}
 			// fmt.Printf("CPL: %d, Generated peerid: %x\n", cpl, kb.ConvertPeerID(queryPeerID))
-			newSet, addLookups, err := dht.GetPeersWithCPL(ctx, string(queryPeerID), cpl+1, requestFn)
+			newSet, addLookups, err := dht.getPeersWithCPL(ctx, string(queryPeerID), cpl+1, requestFn, b)
 			if err != nil {
 				return nil, numLookups, err
 			}
@@ -116,12 +256,16 @@ func (dht *IpfsDHT) GetPeersWithCPL(ctx context.Context, key string, minCPL int,
 			// At least, the function won't go into an infinite loop!
 			queryPeerID = set[len(set)-1]
 			// fmt.Printf("CPL: %d, Chosen peerid: %x\n", cpl, kb.ConvertPeerID(queryPeerID))
+			if !b.spend(ctx) {
+				break
+			}
 			// newSet, err := dht.GetClosestPeers(ctx, string(queryPeerID))
-			newSet, err := requestFn(ctx, string(queryPeerID))
+			newSet, err := requestFn(withLookupRegion(ctx, string(queryPeerID), cpl+1), string(queryPeerID))
 			if err != nil {
 				return nil, numLookups, err
 			}
 			numLookups += 1
+			b.found(newSet)
 			set = append(set, newSet...)
 			// cpl = minCommonPrefixLength(set, key)
 			cpl -= 1 // This does not guarantee correctness, but prevents an infinite loop!
@@ -131,16 +275,17 @@ func (dht *IpfsDHT) GetPeersWithCPL(ctx context.Context, key string, minCPL int,
 	// Remove duplicates and keep only those with required common prefix length
 	setMap := make(map[peer.ID]struct{})
 	truncSet := make([]peer.ID, 0, len(set))
+	keyHash := internal.KadKey(key)
 	for _, id := range set {
 		if _, ok := setMap[id]; !ok {
-			if kb.CommonPrefixLen(kb.ConvertPeerID(id), kb.ConvertKey(key)) >= minCPL {
+			if idHash := internal.KadKey(string(id)); internal.CommonPrefixLen(idHash[:], keyHash[:]) >= minCPL {
 				setMap[id] = struct{}{}
 				truncSet = append(truncSet, id)
 			}
 		}
 	}
 	// Sort by distance before returning
-	sortedSet := kb.SortClosestPeers(truncSet, kb.ConvertKey(key))
+	sortedSet := kb.SortClosestPeers(truncSet, keyHash[:])
 	return sortedSet, numLookups, nil
 	// Will probably be more efficient to truncate after sorting so that it could be done by a binary search
 }
@@ -157,30 +302,29 @@ func (dht *IpfsDHT) GetPeersWithCPL(ctx context.Context, key string, minCPL int,
 func (dht *IpfsDHT) GetPeersWithDistance(ctx context.Context, key string, maxDist []byte, requestFn requestFn) ([]peer.ID, int, error) {
 	minCPL := kb.CommonPrefixLen(maxDist, make([]byte, 32))
 	set, numLookups, err := dht.GetPeersWithCPL(ctx, key, minCPL, requestFn)
-	if err != nil {
+	if err != nil && err != ErrCPLBudgetExceeded {
 		return nil, numLookups, err
 	}
 	// Keep only those with required distance
 	truncSet := make([]peer.ID, 0, len(set))
-	keyHash := kb.ConvertKey(key)
-	maxDistHex := fmt.Sprintf("%x", maxDist)
+	keyHash := internal.KadKey(key)
 	for _, id := range set {
-		distHex := fmt.Sprintf("%x", util.XOR(keyHash, kb.ConvertPeerID(id)))
-		if distHex <= maxDistHex {
+		if idHash := internal.KadKey(string(id)); len(maxDist) == len(keyHash) && internal.CompareXOR(keyHash[:], idHash[:], maxDist) <= 0 {
 			truncSet = append(truncSet, id)
 		}
 	}
 	// Sort by distance before returning
-	sortedSet := kb.SortClosestPeers(truncSet, kb.ConvertKey(key))
-	return sortedSet, numLookups, nil
+	sortedSet := kb.SortClosestPeers(truncSet, keyHash[:])
+	return sortedSet, numLookups, err
 	// Will probably be more efficient to truncate after sorting so that it could be done by a binary search
 }
 
 func minCommonPrefixLength(peerids []peer.ID, target string) int {
 	minCPL := 256
-	targetHash := kb.ConvertKey(target)
+	targetHash := internal.KadKey(target)
 	for _, pid := range peerids {
-		cpl := kb.CommonPrefixLen(kb.ConvertPeerID(pid), targetHash)
+		pidHash := internal.KadKey(string(pid))
+		cpl := internal.CommonPrefixLen(pidHash[:], targetHash[:])
 		if cpl < minCPL {
 			minCPL = cpl
 		}
@@ -189,13 +333,17 @@ func minCommonPrefixLength(peerids []peer.ID, target string) int {
 }
 
 func maxDistance(peerids []peer.ID, target string) string {
-	maxDist := "0000000000000000000000000000000000000000000000000000000000000000"
-	targetHash := kb.ConvertKey(target)
+	targetHash := internal.KadKey(target)
+	var farthest [sha256.Size]byte
+	found := false
 	for _, pid := range peerids {
-		dist := fmt.Sprintf("%x", util.XOR(targetHash, kb.ConvertPeerID(pid)))
-		if dist > maxDist {
-			maxDist = dist
+		pidHash := internal.KadKey(string(pid))
+		if !found || internal.CompareDistance(pidHash[:], farthest[:], targetHash[:]) > 0 {
+			farthest, found = pidHash, true
 		}
 	}
-	return maxDist
+	if !found {
+		return "0000000000000000000000000000000000000000000000000000000000000000"
+	}
+	return fmt.Sprintf("%x", util.XOR(targetHash[:], farthest[:]))
 }
@@ -0,0 +1,246 @@
+package dht
+
+import (
+	"context"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/routing"
+	"github.com/multiformats/go-multihash"
+)
+
+// lookupDedup coalesces the concurrent lookups of the same key into a single shared lookup, see DeduplicateLookups.
+type lookupDedup struct {
+	ctx context.Context
+
+	mu      sync.Mutex
+	lookups map[string]*sharedLookup
+}
+
+func newLookupDedup(ctx context.Context) *lookupDedup {
+	return &lookupDedup{
+		ctx:     ctx,
+		lookups: make(map[string]*sharedLookup),
+	}
+}
+
+// sharedLookup is a lookup whose results are fanned out to all of its subscribers. Subscribers joining late receive
+// the results found so far first. The lookup is cancelled once no subscriber is left.
+type sharedLookup struct {
+	cancel context.CancelFunc
+
+	mu          sync.Mutex
+	results     []interface{}
+	result      interface{}
+	done        bool
+	cancelled   bool
+	subscribers int
+	// update is closed and replaced whenever results are added or the lookup is done
+	update chan struct{}
+}
+
+// dedupable tells whether the lookups run with ctx may be shared with other callers. Lookups reporting their progress
+// to the caller, with a custom followup or lookup size, recorded, replayed or collecting their statistics can't be, as
+// shared lookups run with the DHT context.
+func dedupable(ctx context.Context) bool {
+	if routing.SubscribesToQueryEvents(ctx) || lookupEventsEnabled(ctx) || followupMode(ctx) != FollowupDefault {
+		return false
+	}
+	for _, key := range []interface{}{lookupRecorderKey{}, lookupStatsKey{}, lookupSizeKey{}, lookupReplayKey{}} {
+		if ctx.Value(key) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// join subscribes to the shared lookup identified by key, starting it with run if there is none. run publishes the
+// results of the lookup and returns once it is done, the lookup being done with its return value as final result.
+// The subscription must be ended with leave.
+func (d *lookupDedup) join(key string, run func(ctx context.Context, l *sharedLookup) interface{}) *sharedLookup {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if l, ok := d.lookups[key]; ok {
+		l.mu.Lock()
+		joined := !l.cancelled
+		if joined {
+			l.subscribers++
+		}
+		l.mu.Unlock()
+		if joined {
+			return l
+		}
+	}
+
+	ctx, cancel := context.WithCancel(d.ctx)
+	l := &sharedLookup{
+		cancel:      cancel,
+		subscribers: 1,
+		update:      make(chan struct{}),
+	}
+	d.lookups[key] = l
+	go func() {
+		defer cancel()
+		res := run(ctx, l)
+
+		d.mu.Lock()
+		if d.lookups[key] == l {
+			delete(d.lookups, key)
+		}
+		d.mu.Unlock()
+
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.result = res
+		l.done = true
+		close(l.update)
+	}()
+	return l
+}
+
+// publish adds a result of the lookup.
+func (l *sharedLookup) publish(v interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.results = append(l.results, v)
+	close(l.update)
+	l.update = make(chan struct{})
+}
+
+// next returns the i-th result of the lookup, waiting for it. It returns false if the lookup is done without
+// publishing it, or ctx is done or stop closed first.
+func (l *sharedLookup) next(ctx context.Context, i int, stop <-chan struct{}) (interface{}, bool) {
+	for {
+		l.mu.Lock()
+		if i < len(l.results) {
+			v := l.results[i]
+			l.mu.Unlock()
+			return v, true
+		}
+		done, update := l.done, l.update
+		l.mu.Unlock()
+		if done {
+			return nil, false
+		}
+
+		select {
+		case <-update:
+		case <-ctx.Done():
+			return nil, false
+		case <-stop:
+			return nil, false
+		}
+	}
+}
+
+// wait waits for the lookup to be done and returns its final result, nil if ctx is done first.
+func (l *sharedLookup) wait(ctx context.Context) interface{} {
+	for {
+		l.mu.Lock()
+		done, update, res := l.done, l.update, l.result
+		l.mu.Unlock()
+		if done {
+			return res
+		}
+		select {
+		case <-update:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// leave ends a subscription, cancelling the lookup if it was the last one.
+func (l *sharedLookup) leave() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.subscribers--
+	if l.subscribers == 0 && !l.done {
+		l.cancelled = true
+		l.cancel()
+	}
+}
+
+// findProvidersShared sends up to count providers of key to peerOut, all of them if count is zero, taking them from a
+// lookup of all providers of key shared with the concurrent callers.
+func (dht *IpfsDHT) findProvidersShared(ctx context.Context, key multihash.Multihash, count int, peerOut chan peer.AddrInfo) {
+	defer close(peerOut)
+
+	l := dht.lookupDedup.join("providers/"+string(key), func(ctx context.Context, l *sharedLookup) interface{} {
+		out := make(chan peer.AddrInfo)
+		go dht.findProvidersAsyncRoutine(ctx, key, 0, out)
+		for p := range out {
+			l.publish(p)
+		}
+		return nil
+	})
+	defer l.leave()
+
+	for i := 0; count == 0 || i < count; i++ {
+		v, ok := l.next(ctx, i, nil)
+		if !ok {
+			return
+		}
+		select {
+		case peerOut <- v.(peer.AddrInfo):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// getValuesShared is getValues taking the values from a lookup of key shared with the concurrent callers. Closing
+// stopQuery ends the subscription of the caller, the shared lookup only stopping once all callers are satisfied.
+func (dht *IpfsDHT) getValuesShared(ctx context.Context, key string, stopQuery chan struct{}) (<-chan recvdVal, <-chan *lookupWithFollowupResult) {
+	valCh := make(chan recvdVal, 1)
+	lookupResCh := make(chan *lookupWithFollowupResult, 1)
+
+	l := dht.lookupDedup.join("value/"+key, func(ctx context.Context, l *sharedLookup) interface{} {
+		// never stopped, but cancelled once no caller is interested anymore
+		vals, res := dht.getValues(ctx, key, make(chan struct{}))
+		for v := range vals {
+			l.publish(v)
+		}
+		return <-res
+	})
+
+	go func() {
+		defer close(lookupResCh)
+		left := false
+		defer func() {
+			if !left {
+				l.leave()
+			}
+		}()
+
+	forward:
+		for i := 0; ; i++ {
+			v, ok := l.next(ctx, i, stopQuery)
+			if !ok {
+				break
+			}
+			select {
+			case valCh <- v.(recvdVal):
+			case <-ctx.Done():
+				break forward
+			case <-stopQuery:
+				break forward
+			}
+		}
+		close(valCh)
+
+		select {
+		case <-stopQuery:
+			// satisfied, no need to keep the lookup running for us
+			l.leave()
+			left = true
+		default:
+		}
+		if res, ok := l.wait(ctx).(*lookupWithFollowupResult); ok && res != nil {
+			lookupResCh <- res
+		}
+	}()
+
+	return valCh, lookupResCh
+}
@@ -0,0 +1,132 @@
+package dht
+
+import (
+	"context"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"go.opencensus.io/stats"
+
+	"github.com/libp2p/go-libp2p-kad-dht/internal"
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+	"github.com/libp2p/go-libp2p-kad-dht/qpeerset"
+	kb "github.com/libp2p/go-libp2p-kbucket"
+)
+
+// LookupStats describes the efficiency of a single lookup. Only the lookup itself is accounted for, not the followup
+// queries to the closest peers.
+type LookupStats struct {
+	// Key is the target of the lookup.
+	Key string
+	// Hops is the length of the longest referral path from a seed peer to a peer that answered, seeds being one hop
+	// away.
+	Hops int
+	// RPCs is the number of peers queried.
+	RPCs int
+	// FailedRPCs is the number of queried peers that could not be reached or did not answer.
+	FailedRPCs int
+	// ClosestCPL holds, for every hop, the longest common prefix length with the key among the peers that answered
+	// at that hop. The entry of a hop no peer answered at is -1.
+	ClosestCPL []int
+	// BudgetExhausted is set if the lookup ran out of its query budget, see QueryBudget, and its results are best
+	// effort.
+	BudgetExhausted bool
+}
+
+// DistanceImprovement returns how many bits of XOR distance to the key every hop after the first gained over the
+// best peer of the previous hops, measured as the increase in common prefix length.
+func (s *LookupStats) DistanceImprovement() []int {
+	if len(s.ClosestCPL) < 2 {
+		return nil
+	}
+	out := make([]int, 0, len(s.ClosestCPL)-1)
+	best := s.ClosestCPL[0]
+	for _, cpl := range s.ClosestCPL[1:] {
+		gain := 0
+		if cpl > best {
+			gain = cpl - best
+			best = cpl
+		}
+		out = append(out, gain)
+	}
+	return out
+}
+
+// LookupStatsCollector collects the statistics of all lookups run with a context returned by CollectLookupStats.
+type LookupStatsCollector struct {
+	mu    sync.Mutex
+	stats []*LookupStats
+}
+
+// Stats returns the statistics of the lookups completed so far.
+func (c *LookupStatsCollector) Stats() []*LookupStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]*LookupStats(nil), c.stats...)
+}
+
+type lookupStatsKey struct{}
+
+// CollectLookupStats returns a context that collects the LookupStats of every lookup run with it.
+func CollectLookupStats(ctx context.Context) (context.Context, *LookupStatsCollector) {
+	c := &LookupStatsCollector{}
+	return context.WithValue(ctx, lookupStatsKey{}, c), c
+}
+
+// lookupStats computes the statistics of a finished query.
+func (q *query) lookupStats(target kb.ID) *LookupStats {
+	s := &LookupStats{Key: q.key, RPCs: q.rpcs, FailedRPCs: q.failedRPCs, BudgetExhausted: q.isBudgetExhausted()}
+
+	hops := make(map[peer.ID]int)
+	var hopsOf func(p peer.ID) int
+	hopsOf = func(p peer.ID) int {
+		if p == q.dht.self {
+			return 0
+		}
+		if h, ok := hops[p]; ok {
+			return h
+		}
+		// guard against malformed referral chains
+		hops[p] = 1
+		h := hopsOf(q.queryPeers.GetReferrer(p)) + 1
+		hops[p] = h
+		return h
+	}
+
+	for _, p := range q.queryPeers.GetClosestInStates(qpeerset.PeerQueried) {
+		h := hopsOf(p)
+		for len(s.ClosestCPL) < h {
+			s.ClosestCPL = append(s.ClosestCPL, -1)
+		}
+		pHash := internal.KadKey(string(p))
+		if cpl := internal.CommonPrefixLen(pHash[:], target); cpl > s.ClosestCPL[h-1] {
+			s.ClosestCPL[h-1] = cpl
+		}
+		if h > s.Hops {
+			s.Hops = h
+		}
+	}
+	return s
+}
+
+// recordLookupStats reports s to the lookup metrics and to the collector in ctx, if any.
+func (dht *IpfsDHT) recordLookupStats(ctx context.Context, s *LookupStats) {
+	if c, ok := ctx.Value(lookupStatsKey{}).(*LookupStatsCollector); ok {
+		c.mu.Lock()
+		c.stats = append(c.stats, s)
+		c.mu.Unlock()
+	}
+	if isLookupReplay(ctx) {
+		return
+	}
+
+	// the DHT context carries the tags identifying this instance
+	stats.Record(dht.ctx,
+		metrics.LookupHops.M(int64(s.Hops)),
+		metrics.LookupRPCs.M(int64(s.RPCs)),
+		metrics.LookupFailedRPCs.M(int64(s.FailedRPCs)),
+	)
+	for _, gain := range s.DistanceImprovement() {
+		stats.Record(dht.ctx, metrics.LookupHopDistanceImprovement.M(int64(gain)))
+	}
+}
@@ -0,0 +1,123 @@
+package dht
+
+import (
+	"context"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"github.com/libp2p/go-libp2p-kad-dht/qpeerset"
+)
+
+// lookupState is a point-in-time view of a running lookup. It is handed to the stop function of
+// runLookupWithFollowup every time the lookup considers terminating, so that termination conditions
+// can take into account the progress made so far rather than only external state.
+//
+// The peerset must not be modified and must not be retained after the stop function returns.
+type lookupState struct {
+	// key is the target key of the lookup.
+	key string
+	// elapsed is the time since the lookup started.
+	elapsed time.Duration
+	// rounds is the number of peer responses (successful or not) processed so far.
+	rounds int
+	// peerset holds all peers known to the lookup and their states.
+	peerset *qpeerset.QueryPeerset
+}
+
+// state returns a snapshot of the query's current state.
+func (q *query) state() *lookupState {
+	return &lookupState{
+		key:     q.key,
+		elapsed: time.Since(q.startTime),
+		rounds:  q.rounds,
+		peerset: q.queryPeers,
+	}
+}
+
+// neverStop is a stop function that never terminates the lookup early.
+func neverStop(*lookupState) bool { return false }
+
+// stopWhenTopKStable terminates the lookup once the k closest successfully queried peers have not changed for the
+// given number of consecutive rounds. The returned function is stateful and must only be used for a single lookup.
+// Sampling lookups terminate with it, see withSamplingTermination.
+func stopWhenTopKStable(k, rounds int) stopFn {
+	var (
+		lastTop    []peer.ID
+		lastRound  = -1
+		stableFor  int
+		terminated bool
+	)
+	return func(s *lookupState) bool {
+		if terminated {
+			return true
+		}
+		// the stop function may be consulted several times per round, only count each round once.
+		if s.rounds == lastRound {
+			return false
+		}
+		lastRound = s.rounds
+
+		top := s.peerset.GetClosestNInStates(k, qpeerset.PeerQueried)
+		if len(top) < k || !samePeers(top, lastTop) {
+			lastTop = top
+			stableFor = 0
+			return false
+		}
+
+		stableFor++
+		terminated = stableFor >= rounds
+		return terminated
+	}
+}
+
+// samePeers returns true if both slices contain the same peers in the same order.
+func samePeers(a, b []peer.ID) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+type samplingTerminationKey struct{}
+
+// withSamplingTermination makes the lookups run with the returned context terminate only once their k closest peers,
+// see withLookupSize, were all queried and have not changed for the given number of consecutive rounds, instead of
+// as soon as the beta closest peers were queried. This yields a better sample of the closest peers at the cost of a
+// few more queries.
+func withSamplingTermination(ctx context.Context, rounds int) context.Context {
+	return context.WithValue(ctx, samplingTerminationKey{}, rounds)
+}
+
+// samplingTermination implements the termination condition of sampling lookups, see withSamplingTermination.
+type samplingTermination struct {
+	rounds int
+	// stable is stopWhenTopKStable for the k closest peers of the lookup, created once k is known.
+	stable stopFn
+}
+
+func newSamplingTermination(ctx context.Context) *samplingTermination {
+	rounds, ok := ctx.Value(samplingTerminationKey{}).(int)
+	if !ok {
+		return nil
+	}
+	return &samplingTermination{rounds: rounds}
+}
+
+func (s *samplingTermination) done(q *query) bool {
+	top := q.queryPeers.GetClosestNInStates(q.k, qpeerset.PeerHeard, qpeerset.PeerWaiting, qpeerset.PeerQueried)
+	for _, p := range top {
+		if q.queryPeers.GetState(p) != qpeerset.PeerQueried {
+			return false
+		}
+	}
+	if s.stable == nil {
+		s.stable = stopWhenTopKStable(q.k, s.rounds)
+	}
+	return s.stable(q.state())
+}
@@ -0,0 +1,253 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// LookupTrace is a serializable record of a single lookup: the peers it was seeded with and every response it got.
+// Traces are recorded with RecordLookups and can be replayed offline with ReplayLookup, e.g. to regression test
+// changes to the termination and peer selection logic of lookups against real world lookups.
+type LookupTrace struct {
+	// Operation is the correlation ID of the operation the lookup belongs to, see CorrelationID.
+	Operation uuid.UUID
+	// Key is the target of the lookup.
+	Key []byte
+	// Seeds are the peers the lookup started from.
+	Seeds []peer.ID
+	// Responses are all responses the lookup got, in the order they were received.
+	Responses []LookupTraceResponse
+	// Result is the set of closest peers the lookup returned.
+	Result []peer.ID
+	// FollowupOnly are the peers that were only queried by the followup phase of the lookup, see FollowupMode.
+	FollowupOnly []peer.ID `json:",omitempty"`
+}
+
+// LookupTraceResponse is the response of a single peer within a LookupTrace.
+type LookupTraceResponse struct {
+	// Peer is the peer that was queried.
+	Peer peer.ID
+	// CloserPeers are the peers returned by Peer.
+	CloserPeers []peer.AddrInfo `json:",omitempty"`
+	// Error is set if the query failed.
+	Error string `json:",omitempty"`
+	// Canceled is set if the query was aborted by the lookup, e.g. because it terminated before the peer answered.
+	Canceled bool `json:",omitempty"`
+	// Start is when the query was sent, relative to the start of the lookup.
+	Start time.Duration
+	// Latency is how long it took to get the response.
+	Latency time.Duration
+	// Followup is set if the query was sent by the followup phase of the lookup.
+	Followup bool `json:",omitempty"`
+}
+
+// LookupRecorder collects the traces of all lookups run with a context returned by RecordLookups.
+type LookupRecorder struct {
+	mu     sync.Mutex
+	traces []*LookupTrace
+}
+
+// Traces returns the traces of the lookups recorded so far.
+func (r *LookupRecorder) Traces() []*LookupTrace {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*LookupTrace(nil), r.traces...)
+}
+
+type lookupRecorderKey struct{}
+
+// RecordLookups returns a context that records a LookupTrace for every lookup run with it.
+func RecordLookups(ctx context.Context) (context.Context, *LookupRecorder) {
+	r := &LookupRecorder{}
+	return context.WithValue(ctx, lookupRecorderKey{}, r), r
+}
+
+// traceRecording records the trace of a single lookup.
+type traceRecording struct {
+	start time.Time
+
+	mu    sync.Mutex
+	trace *LookupTrace
+}
+
+// startLookupTrace starts recording a trace of a lookup for key if ctx asks for it, returning nil otherwise.
+func startLookupTrace(ctx context.Context, key string) *traceRecording {
+	r, ok := ctx.Value(lookupRecorderKey{}).(*LookupRecorder)
+	if !ok {
+		return nil
+	}
+
+	rec := &traceRecording{start: time.Now(), trace: &LookupTrace{Key: []byte(key)}}
+	rec.trace.Operation, _ = CorrelationID(ctx)
+	r.mu.Lock()
+	r.traces = append(r.traces, rec.trace)
+	r.mu.Unlock()
+	return rec
+}
+
+type traceRecordingKey struct{}
+
+// lookupTraceRecording returns the recording of the lookup ctx belongs to, if any.
+func lookupTraceRecording(ctx context.Context) *traceRecording {
+	rec, _ := ctx.Value(traceRecordingKey{}).(*traceRecording)
+	return rec
+}
+
+// wrap returns a query function recording the responses of fn.
+func (rec *traceRecording) wrap(fn queryFn) queryFn {
+	return func(ctx context.Context, p peer.ID) ([]*peer.AddrInfo, error) {
+		start := time.Now()
+		closer, err := fn(ctx, p)
+
+		resp := LookupTraceResponse{Peer: p}
+		for _, ai := range closer {
+			resp.CloserPeers = append(resp.CloserPeers, *ai)
+		}
+		rec.record(ctx, resp, start, err)
+		return closer, err
+	}
+}
+
+// record adds resp, for a query sent at start that failed with err (if not nil), to the trace.
+func (rec *traceRecording) record(ctx context.Context, resp LookupTraceResponse, start time.Time, err error) {
+	resp.Start = start.Sub(rec.start)
+	resp.Followup = isFollowup(ctx)
+	resp.Latency = time.Since(start)
+	if err != nil {
+		resp.Error = err.Error()
+		resp.Canceled = ctx.Err() != nil
+	}
+
+	rec.mu.Lock()
+	rec.trace.Responses = append(rec.trace.Responses, resp)
+	rec.mu.Unlock()
+}
+
+func (rec *traceRecording) finish(seeds []peer.ID, res *lookupWithFollowupResult) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.trace.Seeds = seeds
+	if res != nil {
+		rec.trace.Result = res.peers
+	}
+
+	lookup := make(map[peer.ID]bool)
+	for _, r := range rec.trace.Responses {
+		lookup[r.Peer] = lookup[r.Peer] || !r.Followup
+	}
+	rec.trace.FollowupOnly = nil
+	for _, r := range rec.trace.Responses {
+		if !lookup[r.Peer] {
+			rec.trace.FollowupOnly = append(rec.trace.FollowupOnly, r.Peer)
+			// only list the peer once
+			lookup[r.Peer] = true
+		}
+	}
+}
+
+// LookupReplay is the outcome of replaying a LookupTrace.
+type LookupReplay struct {
+	// Result is the set of closest peers the replayed lookup returned.
+	Result []peer.ID
+	// Queried are the peers queried by the replayed lookup, in order.
+	Queried []peer.ID
+	// Unknown are the peers the replayed lookup queried that were not queried when the trace was recorded. They are
+	// treated as unreachable.
+	Unknown []peer.ID
+}
+
+type lookupReplayKey struct{}
+
+// isLookupReplay returns true if ctx belongs to a replayed lookup, which must not touch the network or the routing
+// table.
+func isLookupReplay(ctx context.Context) bool {
+	_, ok := ctx.Value(lookupReplayKey{}).(bool)
+	return ok
+}
+
+// ReplayLookup runs the lookup logic of this DHT, with its current configuration, offline against the responses
+// recorded in trace. Every query is answered from the trace after the recorded latency multiplied by latencyScale
+// (0 answers immediately), so that the order in which responses arrive is preserved when latencyScale is large
+// enough to dominate scheduling noise. Peers queried more than once get their recorded responses in order. Queries
+// that were aborted while recording are skipped if the peer answered a later query, otherwise they never complete.
+func (dht *IpfsDHT) ReplayLookup(ctx context.Context, trace *LookupTrace, latencyScale float64) (*LookupReplay, error) {
+	if len(trace.Seeds) == 0 {
+		return nil, fmt.Errorf("trace has no seeds")
+	}
+
+	responses := make(map[peer.ID][]LookupTraceResponse)
+	for _, r := range trace.Responses {
+		responses[r.Peer] = append(responses[r.Peer], r)
+	}
+	for p, recorded := range responses {
+		answered := recorded[:0]
+		for _, r := range recorded {
+			if !r.Canceled {
+				answered = append(answered, r)
+			}
+		}
+		if len(answered) > 0 {
+			responses[p] = answered
+		}
+	}
+
+	var (
+		mu     sync.Mutex
+		replay = &LookupReplay{}
+	)
+	queryFn := func(ctx context.Context, p peer.ID) ([]*peer.AddrInfo, error) {
+		mu.Lock()
+		replay.Queried = append(replay.Queried, p)
+		recorded := responses[p]
+		if len(recorded) == 0 {
+			replay.Unknown = append(replay.Unknown, p)
+			mu.Unlock()
+			return nil, fmt.Errorf("peer %s not in trace", p)
+		}
+		resp := recorded[0]
+		if len(recorded) > 1 {
+			responses[p] = recorded[1:]
+		}
+		mu.Unlock()
+
+		if resp.Canceled {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+
+		if d := time.Duration(float64(resp.Latency) * latencyScale); d > 0 {
+			t := time.NewTimer(d)
+			defer t.Stop()
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		if resp.Error != "" {
+			return nil, fmt.Errorf("%s", resp.Error)
+		}
+		closer := make([]*peer.AddrInfo, len(resp.CloserPeers))
+		for i := range resp.CloserPeers {
+			ai := resp.CloserPeers[i]
+			closer[i] = &ai
+		}
+		return closer, nil
+	}
+
+	ctx = context.WithValue(ctx, lookupReplayKey{}, true)
+	res, err := dht.runSeededLookupWithFollowup(ctx, string(trace.Key), trace.Seeds, queryFn, neverStop)
+	if err != nil {
+		return nil, err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	replay.Result = res.peers
+	return replay, nil
+}
@@ -9,6 +9,10 @@ import (
 
 var (
 	defaultBytesDistribution        = view.Distribution(1024, 2048, 4096, 16384, 65536, 262144, 1048576, 4194304, 16777216, 67108864, 268435456, 1073741824, 4294967296)
+	defaultHopsDistribution         = view.Distribution(0, 1, 2, 3, 4, 5, 6, 7, 8, 10, 12, 16, 20)
+	defaultRPCsDistribution         = view.Distribution(0, 1, 2, 5, 10, 20, 30, 50, 75, 100, 150, 200, 300, 500)
+	defaultFractionDistribution     = view.Distribution(0, 0.1, 0.2, 0.3, 0.4, 0.5, 0.6, 0.7, 0.8, 0.9, 0.95, 1)
+	defaultCPLDistribution          = view.Distribution(0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 20, 24, 32)
 	defaultMillisecondsDistribution = view.Distribution(0.01, 0.05, 0.1, 0.3, 0.6, 0.8, 1, 2, 3, 4, 5, 6, 8, 10, 13, 16, 20, 25, 30, 40, 50, 65, 80, 100, 130, 160, 200, 250, 300, 400, 500, 650, 800, 1000, 2000, 5000, 10000, 20000, 50000, 100000)
 )
 
@@ -19,6 +23,22 @@ var (
 	// KeyInstanceID identifies a dht instance by the pointer address.
 	// Useful for differentiating between different dhts that have the same peer id.
 	KeyInstanceID, _ = tag.NewKey("instance_id")
+	// KeyRouter, KeyRouterOperation and KeyRouterOutcome describe a request served by a router of a FallbackRouter.
+	KeyRouter, _          = tag.NewKey("router")
+	KeyRouterOperation, _ = tag.NewKey("router_operation")
+	KeyRouterOutcome, _   = tag.NewKey("router_outcome")
+	// KeyProvideStrategy and KeyProvideOutcome describe a provide: the strategy selecting the peers the provider record
+	// is sent to, and whether all, some or none of them accepted it, or whether there was no peer to send it to.
+	KeyProvideStrategy, _ = tag.NewKey("provide_strategy")
+	KeyProvideOutcome, _  = tag.NewKey("provide_outcome")
+	// KeyTenant, KeyTenantOperation and KeyTenantOutcome describe an operation of a tenant subject to its quota.
+	KeyTenant, _          = tag.NewKey("tenant")
+	KeyTenantOperation, _ = tag.NewKey("tenant_operation")
+	KeyTenantOutcome, _   = tag.NewKey("tenant_outcome")
+	// KeyResponseAnomaly is the kind of anomaly detected in the closer peers returned to a lookup.
+	KeyResponseAnomaly, _ = tag.NewKey("response_anomaly")
+	// KeyCacheOutcome tells whether a request to a cache was a hit or a miss.
+	KeyCacheOutcome, _ = tag.NewKey("cache_outcome")
 )
 
 // UpsertMessageType is a convenience upserts the message type
@@ -33,12 +53,38 @@ var (
 	ReceivedMessageErrors  = stats.Int64("libp2p.io/dht/kad/received_message_errors", "Total number of errors for messages received per RPC", stats.UnitDimensionless)
 	ReceivedBytes          = stats.Int64("libp2p.io/dht/kad/received_bytes", "Total received bytes per RPC", stats.UnitBytes)
 	InboundRequestLatency  = stats.Float64("libp2p.io/dht/kad/inbound_request_latency", "Latency per RPC", stats.UnitMilliseconds)
+	HandlerLatency         = stats.Float64("libp2p.io/dht/kad/handler_latency", "Time spent handling a received request per RPC, excluding writing the response", stats.UnitMilliseconds)
+	ResponseBytes          = stats.Int64("libp2p.io/dht/kad/response_bytes", "Total bytes of responses to received requests per RPC", stats.UnitBytes)
 	OutboundRequestLatency = stats.Float64("libp2p.io/dht/kad/outbound_request_latency", "Latency per RPC", stats.UnitMilliseconds)
 	SentMessages           = stats.Int64("libp2p.io/dht/kad/sent_messages", "Total number of messages sent per RPC", stats.UnitDimensionless)
 	SentMessageErrors      = stats.Int64("libp2p.io/dht/kad/sent_message_errors", "Total number of errors for messages sent per RPC", stats.UnitDimensionless)
 	SentRequests           = stats.Int64("libp2p.io/dht/kad/sent_requests", "Total number of requests sent per RPC", stats.UnitDimensionless)
 	SentRequestErrors      = stats.Int64("libp2p.io/dht/kad/sent_request_errors", "Total number of errors for requests sent per RPC", stats.UnitDimensionless)
 	SentBytes              = stats.Int64("libp2p.io/dht/kad/sent_bytes", "Total sent bytes per RPC", stats.UnitBytes)
+
+	LookupHops                   = stats.Int64("libp2p.io/dht/kad/lookup_hops", "Number of hops per lookup", stats.UnitDimensionless)
+	LookupRPCs                   = stats.Int64("libp2p.io/dht/kad/lookup_rpcs", "Number of RPCs per lookup", stats.UnitDimensionless)
+	LookupFailedRPCs             = stats.Int64("libp2p.io/dht/kad/lookup_failed_rpcs", "Number of failed RPCs per lookup", stats.UnitDimensionless)
+	LookupHopDistanceImprovement = stats.Int64("libp2p.io/dht/kad/lookup_hop_distance_improvement", "Bits of XOR distance to the target gained per lookup hop", stats.UnitDimensionless)
+
+	RouterRequests = stats.Int64("libp2p.io/dht/kad/router_requests", "Total number of requests per router of a fallback chain", stats.UnitDimensionless)
+	RouterLatency  = stats.Float64("libp2p.io/dht/kad/router_latency", "Latency per request per router of a fallback chain", stats.UnitMilliseconds)
+
+	ProvideLatency        = stats.Float64("libp2p.io/dht/kad/provide_latency", "Latency per provide", stats.UnitMilliseconds)
+	ProvidePeers          = stats.Int64("libp2p.io/dht/kad/provide_peers", "Number of peers that accepted the provider record per provide", stats.UnitDimensionless)
+	ProvideFailedPeers    = stats.Int64("libp2p.io/dht/kad/provide_failed_peers", "Number of peers the provider record could not be sent to per provide", stats.UnitDimensionless)
+	ProvideRetrievability = stats.Float64("libp2p.io/dht/kad/provide_retrievability", "Fraction of the peers sent a provider record returning it when verified", stats.UnitDimensionless)
+
+	ResponseAnomalies     = stats.Int64("libp2p.io/dht/kad/response_anomalies", "Total number of responses listing closer peers more than once and of peers returned with conflicting addresses", stats.UnitDimensionless)
+	IrrelevantCloserPeers = stats.Int64("libp2p.io/dht/kad/irrelevant_closer_peers", "Total number of closer peers discarded for not leading towards the lookup target", stats.UnitDimensionless)
+	TenantRequests        = stats.Int64("libp2p.io/dht/kad/tenant_requests", "Total number of provides and lookups per tenant, accepted or rejected by its quota", stats.UnitDimensionless)
+
+	ClosestPeersCacheRequests = stats.Int64("libp2p.io/dht/kad/closest_peers_cache_requests", "Total number of closest peers lookups served from the cache or run on the network", stats.UnitDimensionless)
+
+	ShedRequests = stats.Int64("libp2p.io/dht/kad/shed_requests", "Total number of received requests rejected with a busy response per RPC while shedding load", stats.UnitDimensionless)
+	LoadPressure = stats.Float64("libp2p.io/dht/kad/load_pressure", "Highest ratio of a resource usage to its load shedding threshold", stats.UnitDimensionless)
+
+	StoredKeyCPL = stats.Int64("libp2p.io/dht/kad/stored_key_cpl", "Common prefix length with the local peer ID of the key of every stored record and provider record", stats.UnitDimensionless)
 )
 
 // Views
@@ -63,6 +109,16 @@ var (
 		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID},
 		Aggregation: defaultMillisecondsDistribution,
 	}
+	HandlerLatencyView = &view.View{
+		Measure:     HandlerLatency,
+		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID},
+		Aggregation: defaultMillisecondsDistribution,
+	}
+	ResponseBytesView = &view.View{
+		Measure:     ResponseBytes,
+		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID},
+		Aggregation: defaultBytesDistribution,
+	}
 	OutboundRequestLatencyView = &view.View{
 		Measure:     OutboundRequestLatency,
 		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID},
@@ -93,6 +149,91 @@ var (
 		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID},
 		Aggregation: defaultBytesDistribution,
 	}
+	LookupHopsView = &view.View{
+		Measure:     LookupHops,
+		TagKeys:     []tag.Key{KeyPeerID, KeyInstanceID},
+		Aggregation: defaultHopsDistribution,
+	}
+	LookupRPCsView = &view.View{
+		Measure:     LookupRPCs,
+		TagKeys:     []tag.Key{KeyPeerID, KeyInstanceID},
+		Aggregation: defaultRPCsDistribution,
+	}
+	LookupFailedRPCsView = &view.View{
+		Measure:     LookupFailedRPCs,
+		TagKeys:     []tag.Key{KeyPeerID, KeyInstanceID},
+		Aggregation: defaultRPCsDistribution,
+	}
+	LookupHopDistanceImprovementView = &view.View{
+		Measure:     LookupHopDistanceImprovement,
+		TagKeys:     []tag.Key{KeyPeerID, KeyInstanceID},
+		Aggregation: defaultHopsDistribution,
+	}
+	RouterRequestsView = &view.View{
+		Measure:     RouterRequests,
+		TagKeys:     []tag.Key{KeyRouter, KeyRouterOperation, KeyRouterOutcome, KeyPeerID, KeyInstanceID},
+		Aggregation: view.Count(),
+	}
+	RouterLatencyView = &view.View{
+		Measure:     RouterLatency,
+		TagKeys:     []tag.Key{KeyRouter, KeyRouterOperation, KeyRouterOutcome, KeyPeerID, KeyInstanceID},
+		Aggregation: defaultMillisecondsDistribution,
+	}
+	ProvideLatencyView = &view.View{
+		Measure:     ProvideLatency,
+		TagKeys:     []tag.Key{KeyProvideStrategy, KeyProvideOutcome, KeyPeerID, KeyInstanceID},
+		Aggregation: defaultMillisecondsDistribution,
+	}
+	ProvidePeersView = &view.View{
+		Measure:     ProvidePeers,
+		TagKeys:     []tag.Key{KeyProvideStrategy, KeyProvideOutcome, KeyPeerID, KeyInstanceID},
+		Aggregation: defaultRPCsDistribution,
+	}
+	ProvideFailedPeersView = &view.View{
+		Measure:     ProvideFailedPeers,
+		TagKeys:     []tag.Key{KeyProvideStrategy, KeyProvideOutcome, KeyPeerID, KeyInstanceID},
+		Aggregation: defaultRPCsDistribution,
+	}
+	ProvideRetrievabilityView = &view.View{
+		Measure:     ProvideRetrievability,
+		TagKeys:     []tag.Key{KeyProvideStrategy, KeyPeerID, KeyInstanceID},
+		Aggregation: defaultFractionDistribution,
+	}
+	ResponseAnomaliesView = &view.View{
+		Measure:     ResponseAnomalies,
+		TagKeys:     []tag.Key{KeyResponseAnomaly, KeyPeerID, KeyInstanceID},
+		Aggregation: view.Sum(),
+	}
+	IrrelevantCloserPeersView = &view.View{
+		Measure:     IrrelevantCloserPeers,
+		TagKeys:     []tag.Key{KeyPeerID, KeyInstanceID},
+		Aggregation: view.Sum(),
+	}
+	TenantRequestsView = &view.View{
+		Measure:     TenantRequests,
+		TagKeys:     []tag.Key{KeyTenant, KeyTenantOperation, KeyTenantOutcome, KeyPeerID, KeyInstanceID},
+		Aggregation: view.Count(),
+	}
+	ClosestPeersCacheRequestsView = &view.View{
+		Measure:     ClosestPeersCacheRequests,
+		TagKeys:     []tag.Key{KeyCacheOutcome, KeyPeerID, KeyInstanceID},
+		Aggregation: view.Count(),
+	}
+	ShedRequestsView = &view.View{
+		Measure:     ShedRequests,
+		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID},
+		Aggregation: view.Count(),
+	}
+	LoadPressureView = &view.View{
+		Measure:     LoadPressure,
+		TagKeys:     []tag.Key{KeyPeerID, KeyInstanceID},
+		Aggregation: view.LastValue(),
+	}
+	StoredKeyCPLView = &view.View{
+		Measure:     StoredKeyCPL,
+		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID},
+		Aggregation: defaultCPLDistribution,
+	}
 )
 
 // DefaultViews with all views in it.
@@ -101,10 +242,29 @@ var DefaultViews = []*view.View{
 	ReceivedMessageErrorsView,
 	ReceivedBytesView,
 	InboundRequestLatencyView,
+	HandlerLatencyView,
+	ResponseBytesView,
 	OutboundRequestLatencyView,
 	SentMessagesView,
 	SentMessageErrorsView,
 	SentRequestsView,
 	SentRequestErrorsView,
 	SentBytesView,
+	LookupHopsView,
+	LookupRPCsView,
+	LookupFailedRPCsView,
+	LookupHopDistanceImprovementView,
+	RouterRequestsView,
+	RouterLatencyView,
+	ProvideLatencyView,
+	ProvidePeersView,
+	ProvideFailedPeersView,
+	ProvideRetrievabilityView,
+	StoredKeyCPLView,
+	TenantRequestsView,
+	IrrelevantCloserPeersView,
+	ResponseAnomaliesView,
+	ClosestPeersCacheRequestsView,
+	ShedRequestsView,
+	LoadPressureView,
 }
@@ -0,0 +1,39 @@
+package dht
+
+import (
+	"context"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multihash"
+)
+
+// mhCid wraps mh into a raw CID, whose hash, the only part of a CID the DHT uses as key, is mh.
+func mhCid(mh multihash.Multihash) (cid.Cid, error) {
+	if _, err := multihash.Decode(mh); err != nil {
+		return cid.Undef, err
+	}
+	return cid.NewCidV1(cid.Raw, mh), nil
+}
+
+// ProvideMH is Provide for a multihash, for callers such as indexers that work with multihashes rather than CIDs.
+func (dht *IpfsDHT) ProvideMH(ctx context.Context, mh multihash.Multihash, brdcst bool) error {
+	c, err := mhCid(mh)
+	if err != nil {
+		return err
+	}
+	return dht.Provide(ctx, c, brdcst)
+}
+
+// FindProvidersAsyncMH is FindProvidersAsync for a multihash, for callers such as indexers that work with multihashes
+// rather than CIDs. The returned channel is closed right away if mh isn't a valid multihash.
+func (dht *IpfsDHT) FindProvidersAsyncMH(ctx context.Context, mh multihash.Multihash, count int) <-chan peer.AddrInfo {
+	c, err := mhCid(mh)
+	if err != nil {
+		logger.Debugw("not finding providers, invalid multihash", "error", err)
+		peerOut := make(chan peer.AddrInfo)
+		close(peerOut)
+		return peerOut
+	}
+	return dht.FindProvidersAsync(ctx, c, count)
+}
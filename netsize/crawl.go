@@ -0,0 +1,127 @@
+package netsize
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+
+	"github.com/libp2p/go-libp2p-kad-dht/crawler"
+)
+
+// NetworkSizeEstimator estimates the number of DHT servers in the network.
+type NetworkSizeEstimator interface {
+	// Track feeds the result of a lookup for key, the closest peers to key sorted by distance, to the estimator.
+	Track(key string, peers []peer.ID) error
+	// NetworkSize returns the current estimate, or ErrNotEnoughData if there is none yet.
+	NetworkSize() (float64, error)
+}
+
+var (
+	_ NetworkSizeEstimator = (*Estimator)(nil)
+	_ NetworkSizeEstimator = (*CrawlCounter)(nil)
+)
+
+// CrawlCounter is a NetworkSizeEstimator that counts the DHT servers of the network exactly by crawling it. Crawls
+// are expensive, so it is only suited for small, e.g. private, networks in which the distance based Estimator is
+// inaccurate because buckets are rarely full.
+type CrawlCounter struct {
+	crawler  *crawler.Crawler
+	seeds    func() []peer.ID
+	isServer func() bool
+	maxAge   time.Duration
+	timeout  time.Duration
+
+	mu      sync.Mutex
+	count   int
+	crawled time.Time
+	// crawling is closed once the running crawl is done, nil if none runs
+	crawling chan struct{}
+}
+
+// NewCrawlCounter returns a CrawlCounter crawling the DHT speaking protocols with host h, starting from the peers
+// returned by seeds. Servers don't return the peer asking them, so isServer reports whether to count the local node.
+// Counts are reused for maxAge, after which NetworkSize crawls again, for at most timeout.
+func NewCrawlCounter(h host.Host, protocols []protocol.ID, seeds func() []peer.ID, isServer func() bool, maxAge, timeout time.Duration) (*CrawlCounter, error) {
+	c, err := crawler.New(h, crawler.WithProtocols(protocols), crawler.WithParallelism(16))
+	if err != nil {
+		return nil, err
+	}
+	return &CrawlCounter{
+		crawler:  c,
+		seeds:    seeds,
+		isServer: isServer,
+		maxAge:   maxAge,
+		timeout:  timeout,
+	}, nil
+}
+
+// Track is a no-op, the network is counted by crawling it.
+func (c *CrawlCounter) Track(string, []peer.ID) error {
+	return nil
+}
+
+// NetworkSize returns the number of DHT servers found by the last crawl, crawling the network first if the count is
+// older than the configured max age. While a crawl runs, the previous count is returned if there is one, otherwise
+// NetworkSize waits for the crawl.
+func (c *CrawlCounter) NetworkSize() (float64, error) {
+	c.mu.Lock()
+	if c.count > 0 && (time.Since(c.crawled) < c.maxAge || c.crawling != nil) {
+		count := c.count
+		c.mu.Unlock()
+		return float64(count), nil
+	}
+	if done := c.crawling; done != nil {
+		c.mu.Unlock()
+		<-done
+		c.mu.Lock()
+		count := c.count
+		c.mu.Unlock()
+		if count == 0 {
+			return 0, ErrNotEnoughData
+		}
+		return float64(count), nil
+	}
+	done := make(chan struct{})
+	c.crawling = done
+	c.mu.Unlock()
+
+	count := c.crawl()
+	if count > 0 && c.isServer() {
+		count++
+	}
+
+	c.mu.Lock()
+	c.crawling = nil
+	if count > 0 {
+		c.count, c.crawled = count, time.Now()
+	}
+	c.mu.Unlock()
+	close(done)
+
+	if count == 0 {
+		return 0, ErrNotEnoughData
+	}
+	logger.Debugw("New network size count", "count", count)
+	return float64(count), nil
+}
+
+// crawl counts the servers that answer the crawler.
+func (c *CrawlCounter) crawl() int {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	var seeds []*peer.AddrInfo
+	for _, p := range c.seeds() {
+		seeds = append(seeds, &peer.AddrInfo{ID: p})
+	}
+
+	servers := make(map[peer.ID]struct{})
+	c.crawler.Run(ctx, seeds, func(p peer.ID, _ []*peer.AddrInfo) {
+		servers[p] = struct{}{}
+	}, nil)
+	return len(servers)
+}
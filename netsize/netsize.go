@@ -68,8 +68,35 @@ type measurement struct {
 	distance  float64
 	weight    float64
 	timestamp time.Time
+
+	// key, cpl and bucketLevel are kept for Observations
+	key         string
+	cpl         int
+	bucketLevel int
+}
+
+// Observation is a data point the Estimator calculates the network size from: the normed distance of the peer at
+// Rank, from 0 for the closest one, among the closest peers found for Key.
+type Observation struct {
+	Rank     int
+	Key      string
+	Distance float64
+	// Weight is the weight of the data point, derived from the number of peers BucketLevel in the bucket of the
+	// routing table for the common prefix length CPL of Key with the local ID when it was tracked.
+	Weight      float64
+	CPL         int
+	BucketLevel int
+	Time        time.Time
 }
 
+// ObservationReporter is implemented by the NetworkSizeEstimators reporting the data points their estimates are
+// calculated from.
+type ObservationReporter interface {
+	Observations() []Observation
+}
+
+var _ ObservationReporter = (*Estimator)(nil)
+
 // Track tracks the list of peers for the given key to incorporate in the next network size estimate.
 // key is expected **NOT** to be in the kademlia keyspace and peers is expected to be a sorted list of
 // the closest peers to the given key (the closest first).
@@ -92,7 +119,7 @@ func (e *Estimator) Track(key string, peers []peer.ID) error {
 	e.netSizeCache = nil
 
 	// Calculate weight for the peer distances.
-	weight := e.calcWeight(key)
+	weight, cpl, bucketLevel := e.calcWeight(key)
 
 	// Map given key to the Kademlia key space (hash it)
 	ksKey := ks.XORKeySpace.Key([]byte(key))
@@ -103,9 +130,12 @@ func (e *Estimator) Track(key string, peers []peer.ID) error {
 	for i, p := range peers {
 		// Construct measurement struct
 		m := measurement{
-			distance:  NormedDistance(p, ksKey),
-			weight:    weight,
-			timestamp: now,
+			distance:    NormedDistance(p, ksKey),
+			weight:      weight,
+			timestamp:   now,
+			key:         key,
+			cpl:         cpl,
+			bucketLevel: bucketLevel,
 		}
 
 		// keep track of this measurement
@@ -205,15 +235,42 @@ func (e *Estimator) NetworkSize() (float64, error) {
 	return netSize, nil
 }
 
+// Observations returns the data points the current network size estimate is calculated from, ordered by rank and
+// then by time, the oldest first. Data points that fell out of the measurement time window are left out.
+func (e *Estimator) Observations() []Observation {
+	e.measurementsLk.RLock()
+	defer e.measurementsLk.RUnlock()
+
+	maxAgeTs := time.Now().Add(-MaxMeasurementAge)
+	var obs []Observation
+	for i := 0; i < e.bucketSize; i++ {
+		for _, m := range e.measurements[i] {
+			if !m.timestamp.After(maxAgeTs) {
+				continue
+			}
+			obs = append(obs, Observation{
+				Rank:        i,
+				Key:         m.key,
+				Distance:    m.distance,
+				Weight:      m.weight,
+				CPL:         m.cpl,
+				BucketLevel: m.bucketLevel,
+				Time:        m.timestamp,
+			})
+		}
+	}
+	return obs
+}
+
 // calcWeight weighs data points exponentially less if they fall into a non-full bucket.
-// It weighs distance estimates based on their CPLs and bucket levels.
+// It weighs distance estimates based on their CPLs and bucket levels, which it returns along with the weight.
 // Bucket Level: 20 -> 1/2^0 -> weight: 1
 // Bucket Level: 17 -> 1/2^3 -> weight: 1/8
 // Bucket Level: 10 -> 1/2^10 -> weight: 1/1024
-func (e *Estimator) calcWeight(key string) float64 {
-	cpl := kbucket.CommonPrefixLen(kbucket.ConvertKey(key), e.localID)
-	bucketLevel := e.rt.NPeersForCpl(uint(cpl))
-	return math.Pow(2, float64(bucketLevel-e.bucketSize))
+func (e *Estimator) calcWeight(key string) (weight float64, cpl, bucketLevel int) {
+	cpl = kbucket.CommonPrefixLen(kbucket.ConvertKey(key), e.localID)
+	bucketLevel = e.rt.NPeersForCpl(uint(cpl))
+	return math.Pow(2, float64(bucketLevel-e.bucketSize)), cpl, bucketLevel
 }
 
 // garbageCollect removes all measurements from the list that fell out of the measurement time window.
@@ -0,0 +1,204 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/jbenet/goprocess"
+	"github.com/libp2p/go-libp2p/core/routing"
+
+	"github.com/libp2p/go-libp2p-kad-dht/netsize"
+)
+
+// ErrNetsizeGatheringDeferred is returned by GatherNetsizeDataContext while the power state is constrained, see
+// IpfsDHT.PowerStateChanged.
+var ErrNetsizeGatheringDeferred = errors.New("netsize gathering deferred until the device is unconstrained")
+
+// NetsizeGatheringProgress is the progress of the netsize data gathering in flight, see
+// IpfsDHT.NetsizeGatheringProgress.
+type NetsizeGatheringProgress struct {
+	Running bool
+	Started time.Time
+	// Completed is the number of sample lookups done so far, successful or not, and Planned the number of lookups the
+	// NetsizeSampler runs, zero if unknown.
+	Completed, Planned int
+}
+
+// PlannedLookups is implemented by the NetsizeSamplers knowing the number of lookups they run, for the progress of
+// the gathering to be reported, see IpfsDHT.NetsizeGatheringProgress.
+type PlannedLookups interface {
+	PlannedLookups() int
+}
+
+// PlannedLookups implements PlannedLookups.
+func (s RegionNetsizeSampler) PlannedLookups() int {
+	return s.Keys
+}
+
+// netsizeGathering runs the netsize data gathering, sharing a single gathering between concurrent callers, and
+// schedules it in the background if configured, see NetsizeGatheringSchedule.
+type netsizeGathering struct {
+	shared           *lookupDedup
+	interval, jitter time.Duration
+	// trigger wakes the background gathering up before its next scheduled run
+	trigger chan struct{}
+
+	mu       sync.Mutex
+	progress NetsizeGatheringProgress
+}
+
+func newNetsizeGathering(ctx context.Context, interval, jitter time.Duration) *netsizeGathering {
+	return &netsizeGathering{
+		shared:   newLookupDedup(ctx),
+		interval: interval,
+		jitter:   jitter,
+		trigger:  make(chan struct{}, 1),
+	}
+}
+
+// scheduled tells whether the gathering runs in the background rather than when an estimate is needed.
+func (g *netsizeGathering) scheduled() bool {
+	return g.interval > 0
+}
+
+// GatherNetsizeData runs the lookups of the NetsizeSampler so that the network size estimator gets an estimate, see
+// NetsizeSampling. It is deferred while the power state is constrained, see IpfsDHT.PowerStateChanged.
+func (dht *IpfsDHT) GatherNetsizeData() {
+	if err := dht.GatherNetsizeDataContext(dht.ctx); err != nil {
+		logger.Warnw("failed to gather netsize data", "error", err)
+	}
+}
+
+// GatherNetsizeDataContext is GatherNetsizeData returning once ctx is done. Concurrent callers share a single
+// gathering, which is cancelled once all of them are done. Its progress is reported by NetsizeGatheringProgress.
+func (dht *IpfsDHT) GatherNetsizeDataContext(ctx context.Context) error {
+	if dht.deferNetsizeGathering() {
+		logger.Debug("deferring netsize gathering until the device is charging and on an unmetered network")
+		return ErrNetsizeGatheringDeferred
+	}
+	g := dht.netsizeGathering
+	l := g.shared.join("netsize", func(ctx context.Context, _ *sharedLookup) interface{} {
+		return dht.sampleNetsize(ctx)
+	})
+	defer l.leave()
+	res := l.wait(ctx)
+	if res == nil {
+		return ctx.Err()
+	}
+	if err, ok := res.(error); ok {
+		return err
+	}
+	return nil
+}
+
+// sampleNetsize runs the NetsizeSampler, tracking its progress.
+func (dht *IpfsDHT) sampleNetsize(ctx context.Context) interface{} {
+	g := dht.netsizeGathering
+	planned := 0
+	if p, ok := dht.netsizeSampler.(PlannedLookups); ok {
+		planned = p.PlannedLookups()
+	}
+	g.mu.Lock()
+	g.progress = NetsizeGatheringProgress{Running: true, Started: time.Now(), Planned: planned}
+	g.mu.Unlock()
+	defer func() {
+		g.mu.Lock()
+		g.progress.Running = false
+		g.mu.Unlock()
+	}()
+
+	logger.Info("doing a few queries to initialize the netsize estimator, this may take some time")
+	lookup := func(ctx context.Context, key string) error {
+		_, err := dht.getClosestPeers(ctx, key, nil)
+		g.mu.Lock()
+		g.progress.Completed++
+		g.mu.Unlock()
+		return err
+	}
+	randomKey := func(cpl uint) (string, error) {
+		id, err := dht.routingTable.GenRandPeerID(cpl)
+		return string(id), err
+	}
+	if err := dht.netsizeSampler.Sample(ctx, lookup, randomKey); err != nil {
+		return err
+	}
+	// not nil, which tells callers that they are done first
+	return struct{}{}
+}
+
+// NetsizeGatheringProgress returns the progress of the netsize data gathering in flight, or of the last one once it
+// is done.
+func (dht *IpfsDHT) NetsizeGatheringProgress() NetsizeGatheringProgress {
+	g := dht.netsizeGathering
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.progress
+}
+
+// NetsizeObservations returns the data points the network size estimate is calculated from, for operators to debug
+// estimates that are far off, as the estimate sets the thresholds of the eclipse detection among others. It returns
+// routing.ErrNotSupported if the NetworkSizeEstimator doesn't report them, see netsize.ObservationReporter.
+func (dht *IpfsDHT) NetsizeObservations() ([]netsize.Observation, error) {
+	r, ok := dht.nsEstimator.(netsize.ObservationReporter)
+	if !ok {
+		return nil, routing.ErrNotSupported
+	}
+	return r.Observations(), nil
+}
+
+// networkSize returns the estimate of the network size, gathering netsize data until ctx is done if there is none
+// yet. If the gathering is scheduled in the background, see NetsizeGatheringSchedule, it is triggered instead and the
+// error of the estimator returned right away.
+func (dht *IpfsDHT) networkSize(ctx context.Context) (float64, error) {
+	netsize, err := dht.nsEstimator.NetworkSize()
+	if err == nil {
+		return netsize, nil
+	}
+	if g := dht.netsizeGathering; g.scheduled() {
+		select {
+		case g.trigger <- struct{}{}:
+		default:
+		}
+		return 0, err
+	}
+	if gerr := dht.GatherNetsizeDataContext(ctx); gerr != nil {
+		logger.Debugw("failed to gather netsize data", "error", gerr)
+	}
+	return dht.nsEstimator.NetworkSize()
+}
+
+// gatherNetsizePeriodically gathers netsize data in the background every interval, give or take the jitter, as long
+// as the estimator has no estimate, or right away when an estimate is needed.
+func (dht *IpfsDHT) gatherNetsizePeriodically(proc goprocess.Process) {
+	g := dht.netsizeGathering
+	next := func() time.Duration {
+		d := g.interval
+		if g.jitter > 0 {
+			d += time.Duration(rand.Int63n(int64(2*g.jitter))) - g.jitter
+		}
+		if d < 0 {
+			d = 0
+		}
+		return d
+	}
+	timer := dht.clock.Timer(next())
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			timer.Reset(next())
+		case <-g.trigger:
+		case <-proc.Closing():
+			return
+		}
+		if _, err := dht.nsEstimator.NetworkSize(); err == nil {
+			continue
+		}
+		if err := dht.GatherNetsizeDataContext(dht.ctx); err != nil {
+			logger.Debugw("scheduled netsize gathering failed", "error", err)
+		}
+	}
+}
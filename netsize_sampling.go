@@ -0,0 +1,80 @@
+package dht
+
+import (
+	"context"
+	"sync"
+
+	dhtcfg "github.com/libp2p/go-libp2p-kad-dht/internal/config"
+)
+
+// NetsizeSampler gathers lookup results for the network size estimator when it has no estimate yet, see
+// IpfsDHT.GatherNetsizeData and NetsizeSampling. Implementations pick the sample keys and run their lookups with
+// lookup, whose results the estimator tracks; randomKey returns a random key sharing cpl leading bits with the local
+// peer ID.
+type NetsizeSampler = dhtcfg.NetsizeSampler
+
+var _ NetsizeSampler = RegionNetsizeSampler{}
+
+// RegionNetsizeSampler looks up Keys random keys spread over the keyspace regions sharing MinCPL to MaxCPL leading
+// bits with the local peer ID, running at most Concurrency lookups at a time.
+type RegionNetsizeSampler struct {
+	Keys           int
+	Concurrency    int
+	MinCPL, MaxCPL int
+}
+
+// DefaultNetsizeSampler looks up one key per region sharing 0 to 9 leading bits with the local peer ID, one after the
+// other.
+var DefaultNetsizeSampler = RegionNetsizeSampler{Keys: 10, Concurrency: 1, MinCPL: 0, MaxCPL: 9}
+
+// Sample implements NetsizeSampler. It fails with the error of the last lookup if none succeeded.
+func (s RegionNetsizeSampler) Sample(ctx context.Context, lookup func(ctx context.Context, key string) error, randomKey func(cpl uint) (string, error)) error {
+	concurrency := s.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	regions := s.MaxCPL - s.MinCPL + 1
+	if regions < 1 {
+		regions = 1
+	}
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		succeeded bool
+		lastErr   error
+		sem       = make(chan struct{}, concurrency)
+	)
+	for i := 0; i < s.Keys && ctx.Err() == nil; i++ {
+		key, err := randomKey(uint(s.MinCPL + i%regions))
+		if err != nil {
+			logger.Debugw("failed to generate netsize sample key", "error", err)
+			lastErr = err
+			continue
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			err := lookup(ctx, key)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				logger.Debugw("netsize sample lookup failed", "error", err)
+				lastErr = err
+			} else {
+				succeeded = true
+			}
+		}()
+	}
+	wg.Wait()
+
+	if succeeded {
+		return nil
+	}
+	if lastErr == nil {
+		lastErr = ctx.Err()
+	}
+	return lastErr
+}
@@ -0,0 +1,233 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/core/record"
+
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+)
+
+const (
+	// membershipDomain is the signature domain of membership credential envelopes.
+	membershipDomain = "libp2p-kad-dht-overlay-membership"
+	// membershipCodec is the payload type of membership credential envelopes.
+	membershipCodec = "/libp2p/kad-dht/overlay-membership"
+	// overlayMessageDomain prefixes the messages signed by the members of an authenticated overlay.
+	overlayMessageDomain = "libp2p-kad-dht-overlay-message:"
+	// maxVerifiedCredentials bounds the number of credentials kept verified, see overlayAuth.
+	maxVerifiedCredentials = 1024
+)
+
+// MembershipCredential admits a peer to an authenticated private overlay, see NewMembershipCredential and
+// AuthenticatedOverlay.
+type MembershipCredential struct {
+	// Member is the peer admitted to the overlay.
+	Member peer.ID
+	// Expiry is when the credential expires.
+	Expiry time.Time
+}
+
+var _ record.Record = (*MembershipCredential)(nil)
+
+// Domain implements record.Record.
+func (c *MembershipCredential) Domain() string {
+	return membershipDomain
+}
+
+// Codec implements record.Record.
+func (c *MembershipCredential) Codec() []byte {
+	return []byte(membershipCodec)
+}
+
+// MarshalRecord implements record.Record.
+func (c *MembershipCredential) MarshalRecord() ([]byte, error) {
+	return json.Marshal(c)
+}
+
+// UnmarshalRecord implements record.Record.
+func (c *MembershipCredential) UnmarshalRecord(b []byte) error {
+	return json.Unmarshal(b, c)
+}
+
+// NewMembershipCredential returns a signed envelope in which the authority of an overlay, the owner of sk, admits
+// member to the overlay until expiry. The member passes it to AuthenticatedOverlay.
+func NewMembershipCredential(sk crypto.PrivKey, member peer.ID, expiry time.Time) ([]byte, error) {
+	env, err := record.Seal(&MembershipCredential{Member: member, Expiry: expiry}, sk)
+	if err != nil {
+		return nil, err
+	}
+	return env.Marshal()
+}
+
+// verifyMembershipCredential checks that env is signed by authority and admits member.
+func verifyMembershipCredential(env []byte, authority crypto.PubKey, member peer.ID) (*MembershipCredential, error) {
+	var cred MembershipCredential
+	e, err := record.ConsumeTypedEnvelope(env, &cred)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case !e.PublicKey.Equals(authority):
+		return nil, errors.New("credential not signed by the overlay authority")
+	case cred.Member != member:
+		return nil, fmt.Errorf("credential is for %s, not for %s", cred.Member, member)
+	case time.Now().After(cred.Expiry):
+		return nil, fmt.Errorf("credential expired at %s", cred.Expiry)
+	}
+	return &cred, nil
+}
+
+// overlayAuth signs the outbound messages of an authenticated overlay and verifies the inbound ones. Credentials are
+// only verified the first time they are seen, until they expire.
+type overlayAuth struct {
+	authority  crypto.PubKey
+	credential []byte
+	sk         crypto.PrivKey
+	peerstore  peerstore.Peerstore
+
+	mu sync.Mutex
+	// verified are the last credentials verified per peer
+	verified map[peer.ID]*verifiedCredential
+}
+
+type verifiedCredential struct {
+	env    []byte
+	expiry time.Time
+}
+
+func newOverlayAuth(self peer.ID, ps peerstore.Peerstore, authority crypto.PubKey, credential []byte) (*overlayAuth, error) {
+	if _, err := verifyMembershipCredential(credential, authority, self); err != nil {
+		return nil, fmt.Errorf("invalid overlay membership credential: %w", err)
+	}
+	sk := ps.PrivKey(self)
+	if sk == nil {
+		return nil, fmt.Errorf("authenticated overlays need the private key of %s", self)
+	}
+	return &overlayAuth{
+		authority:  authority,
+		credential: credential,
+		sk:         sk,
+		peerstore:  ps,
+		verified:   make(map[peer.ID]*verifiedCredential),
+	}, nil
+}
+
+// signedBytes returns the bytes of pmes covered by its signature.
+func signedBytes(pmes *pb.Message) ([]byte, error) {
+	unsigned := *pmes
+	unsigned.Signature = nil
+	b, err := unsigned.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(overlayMessageDomain), b...), nil
+}
+
+// sign returns a copy of pmes carrying our credential and signature.
+func (a *overlayAuth) sign(pmes *pb.Message) (*pb.Message, error) {
+	signed := *pmes
+	signed.Membership = a.credential
+	b, err := signedBytes(&signed)
+	if err != nil {
+		return nil, err
+	}
+	if signed.Signature, err = a.sk.Sign(b); err != nil {
+		return nil, err
+	}
+	return &signed, nil
+}
+
+// verify checks that pmes, received from from, carries a valid credential of from and its signature.
+func (a *overlayAuth) verify(from peer.ID, pmes *pb.Message) error {
+	if len(pmes.GetMembership()) == 0 || len(pmes.GetSignature()) == 0 {
+		return errors.New("message not authenticated")
+	}
+	if err := a.verifyCredential(from, pmes.GetMembership()); err != nil {
+		return err
+	}
+	pk := a.peerstore.PubKey(from)
+	if pk == nil {
+		return fmt.Errorf("no public key for %s", from)
+	}
+	b, err := signedBytes(pmes)
+	if err != nil {
+		return err
+	}
+	if ok, err := pk.Verify(b, pmes.GetSignature()); err != nil {
+		return err
+	} else if !ok {
+		return errors.New("invalid message signature")
+	}
+	return nil
+}
+
+// verifyCredential checks that env admits from, reusing a previous verification of env.
+func (a *overlayAuth) verifyCredential(from peer.ID, env []byte) error {
+	a.mu.Lock()
+	v, ok := a.verified[from]
+	a.mu.Unlock()
+	if ok && bytes.Equal(v.env, env) && time.Now().Before(v.expiry) {
+		return nil
+	}
+
+	cred, err := verifyMembershipCredential(env, a.authority, from)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	if len(a.verified) >= maxVerifiedCredentials {
+		a.verified = make(map[peer.ID]*verifiedCredential)
+	}
+	a.verified[from] = &verifiedCredential{env: env, expiry: cred.Expiry}
+	a.mu.Unlock()
+	return nil
+}
+
+// overlayMessageSender signs the messages sent through a MessageSender and verifies the responses.
+type overlayMessageSender struct {
+	pb.MessageSender
+	auth *overlayAuth
+}
+
+// SendRequest implements pb.MessageSender.
+func (s *overlayMessageSender) SendRequest(ctx context.Context, p peer.ID, pmes *pb.Message) (*pb.Message, error) {
+	signed, err := s.auth.sign(pmes)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.MessageSender.SendRequest(ctx, p, signed)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.auth.verify(p, resp); err != nil {
+		logger.Debugw("rejecting unauthenticated response", "from", p, "error", err)
+		return nil, fmt.Errorf("unauthenticated response from %s: %w", p, err)
+	}
+	return resp, nil
+}
+
+// SendMessage implements pb.MessageSender.
+func (s *overlayMessageSender) SendMessage(ctx context.Context, p peer.ID, pmes *pb.Message) error {
+	signed, err := s.auth.sign(pmes)
+	if err != nil {
+		return err
+	}
+	return s.MessageSender.SendMessage(ctx, p, signed)
+}
+
+// OnDisconnect forwards disconnections to the wrapped MessageSender, see disconnector.
+func (s *overlayMessageSender) OnDisconnect(ctx context.Context, p peer.ID) {
+	if d, ok := s.MessageSender.(disconnector); ok {
+		d.OnDisconnect(ctx, p)
+	}
+}
@@ -34,6 +34,10 @@ const (
 	Message_GET_PROVIDERS Message_MessageType = 3
 	Message_FIND_NODE     Message_MessageType = 4
 	Message_PING          Message_MessageType = 5
+	// experimental: subscribe to provider records added for a key
+	Message_SUBSCRIBE_PROVIDERS Message_MessageType = 6
+	// experimental: notification that a provider has been added for a subscribed key
+	Message_PROVIDER_NOTIFY Message_MessageType = 7
 )
 
 var Message_MessageType_name = map[int32]string{
@@ -43,15 +47,19 @@ var Message_MessageType_name = map[int32]string{
 	3: "GET_PROVIDERS",
 	4: "FIND_NODE",
 	5: "PING",
+	6: "SUBSCRIBE_PROVIDERS",
+	7: "PROVIDER_NOTIFY",
 }
 
 var Message_MessageType_value = map[string]int32{
-	"PUT_VALUE":     0,
-	"GET_VALUE":     1,
-	"ADD_PROVIDER":  2,
-	"GET_PROVIDERS": 3,
-	"FIND_NODE":     4,
-	"PING":          5,
+	"PUT_VALUE":           0,
+	"GET_VALUE":           1,
+	"ADD_PROVIDER":        2,
+	"GET_PROVIDERS":       3,
+	"FIND_NODE":           4,
+	"PING":                5,
+	"SUBSCRIBE_PROVIDERS": 6,
+	"PROVIDER_NOTIFY":     7,
 }
 
 func (x Message_MessageType) String() string {
@@ -115,10 +123,38 @@ type Message struct {
 	CloserPeers []Message_Peer `protobuf:"bytes,8,rep,name=closerPeers,proto3" json:"closerPeers"`
 	// Used to return Providers
 	// GET_VALUE, ADD_PROVIDER, GET_PROVIDERS
-	ProviderPeers        []Message_Peer `protobuf:"bytes,9,rep,name=providerPeers,proto3" json:"providerPeers"`
-	XXX_NoUnkeyedLiteral struct{}       `json:"-"`
-	XXX_unrecognized     []byte         `json:"-"`
-	XXX_sizecache        int32          `json:"-"`
+	ProviderPeers []Message_Peer `protobuf:"bytes,9,rep,name=providerPeers,proto3" json:"providerPeers"`
+	// Used to request paged responses: the maximum number of providers to return.
+	// GET_PROVIDERS
+	ProviderPageSize int32 `protobuf:"varint,11,opt,name=providerPageSize,proto3" json:"providerPageSize,omitempty"`
+	// Used to page through large sets of providers: an opaque token identifying the next page.
+	// GET_PROVIDERS
+	ContinuationToken []byte `protobuf:"bytes,12,opt,name=continuationToken,proto3" json:"continuationToken,omitempty"`
+	// Used to provide on behalf of another peer: a signed envelope in which the provider authorizes the sender.
+	// ADD_PROVIDER
+	ProviderAuthorization []byte `protobuf:"bytes,13,opt,name=providerAuthorization,proto3" json:"providerAuthorization,omitempty"`
+	// Used to save bandwidth: the providerPeers, deflate compressed, encoded as a Message holding only providerPeers.
+	// ADD_PROVIDER
+	CompressedProviderPeers []byte `protobuf:"bytes,14,opt,name=compressedProviderPeers,proto3" json:"compressedProviderPeers,omitempty"`
+	// Used to ask for a detectorHint in the response, which servers are free to ignore.
+	// GET_PROVIDERS
+	WantDetectorHint bool `protobuf:"varint,15,opt,name=wantDetectorHint,proto3" json:"wantDetectorHint,omitempty"`
+	// Used to return the local estimate of the server of the distribution of the closest peers to the key, see DetectorHint.
+	// GET_PROVIDERS
+	DetectorHint []byte `protobuf:"bytes,16,opt,name=detectorHint,proto3" json:"detectorHint,omitempty"`
+	// Used in authenticated private overlays: the credential of the sender, a signed envelope in which the authority
+	// of the overlay admits the sender as a member.
+	// all message types
+	Membership []byte `protobuf:"bytes,17,opt,name=membership,proto3" json:"membership,omitempty"`
+	// Used in authenticated private overlays: the signature of the sender over the message without this field.
+	// all message types
+	Signature []byte `protobuf:"bytes,18,opt,name=signature,proto3" json:"signature,omitempty"`
+	// Used by servers shedding load: the request was rejected, to be retried later or sent to other peers.
+	// all request types
+	Busy                 bool     `protobuf:"varint,19,opt,name=busy,proto3" json:"busy,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
 }
 
 func (m *Message) Reset()         { *m = Message{} }
@@ -196,6 +232,69 @@ func (m *Message) GetProviderPeers() []Message_Peer {
 	return nil
 }
 
+func (m *Message) GetProviderPageSize() int32 {
+	if m != nil {
+		return m.ProviderPageSize
+	}
+	return 0
+}
+
+func (m *Message) GetContinuationToken() []byte {
+	if m != nil {
+		return m.ContinuationToken
+	}
+	return nil
+}
+
+func (m *Message) GetProviderAuthorization() []byte {
+	if m != nil {
+		return m.ProviderAuthorization
+	}
+	return nil
+}
+
+func (m *Message) GetCompressedProviderPeers() []byte {
+	if m != nil {
+		return m.CompressedProviderPeers
+	}
+	return nil
+}
+
+func (m *Message) GetWantDetectorHint() bool {
+	if m != nil {
+		return m.WantDetectorHint
+	}
+	return false
+}
+
+func (m *Message) GetDetectorHint() []byte {
+	if m != nil {
+		return m.DetectorHint
+	}
+	return nil
+}
+
+func (m *Message) GetMembership() []byte {
+	if m != nil {
+		return m.Membership
+	}
+	return nil
+}
+
+func (m *Message) GetSignature() []byte {
+	if m != nil {
+		return m.Signature
+	}
+	return nil
+}
+
+func (m *Message) GetBusy() bool {
+	if m != nil {
+		return m.Busy
+	}
+	return false
+}
+
 type Message_Peer struct {
 	// ID of a given peer.
 	Id byteString `protobuf:"bytes,1,opt,name=id,proto3,customtype=byteString" json:"id"`
@@ -265,37 +364,41 @@ func init() {
 func init() { proto.RegisterFile("dht.proto", fileDescriptor_616a434b24c97ff4) }
 
 var fileDescriptor_616a434b24c97ff4 = []byte{
-	// 469 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x84, 0x92, 0xb1, 0x6f, 0x9b, 0x40,
-	0x18, 0xc5, 0x73, 0x80, 0xdd, 0xf8, 0x03, 0x3b, 0xe4, 0x94, 0x01, 0xb9, 0x92, 0x83, 0x3c, 0xd1,
-	0xc1, 0x20, 0xd1, 0xb5, 0xaa, 0x6a, 0x03, 0x8d, 0x2c, 0xa5, 0xd8, 0xba, 0x38, 0xe9, 0x68, 0x19,
-	0xb8, 0x12, 0x54, 0xd7, 0x87, 0x00, 0xa7, 0xf2, 0xd6, 0x3f, 0x2f, 0x63, 0xe7, 0x0e, 0x51, 0xe5,
-	0xa9, 0x7f, 0x46, 0xc5, 0x11, 0x5a, 0xec, 0x25, 0x13, 0xef, 0x7d, 0xf7, 0x7e, 0xe2, 0xdd, 0xa7,
-	0x83, 0x4e, 0x74, 0x5f, 0x98, 0x69, 0xc6, 0x0a, 0x86, 0xdb, 0x5c, 0x06, 0x7d, 0x3b, 0x4e, 0x8a,
-	0xfb, 0x6d, 0x60, 0x86, 0xec, 0x9b, 0xb5, 0x4e, 0x82, 0xd4, 0x4e, 0xad, 0x98, 0x8d, 0x2a, 0x35,
-	0xca, 0x68, 0xc8, 0xb2, 0xc8, 0x4a, 0x03, 0xab, 0x52, 0x15, 0xdb, 0x1f, 0x35, 0x98, 0x98, 0xc5,
-	0xcc, 0xe2, 0xe3, 0x60, 0xfb, 0x85, 0x3b, 0x6e, 0xb8, 0xaa, 0xe2, 0xc3, 0x3f, 0x12, 0xbc, 0xfa,
-	0x44, 0xf3, 0x7c, 0x15, 0x53, 0x6c, 0x81, 0x54, 0xec, 0x52, 0xaa, 0x21, 0x1d, 0x19, 0x3d, 0xfb,
-	0xb5, 0x59, 0xb5, 0x30, 0x9f, 0x8f, 0xeb, 0xef, 0x62, 0x97, 0x52, 0xc2, 0x83, 0xd8, 0x80, 0xb3,
-	0x70, 0xbd, 0xcd, 0x0b, 0x9a, 0x5d, 0xd3, 0x07, 0xba, 0x26, 0xab, 0xef, 0x1a, 0xe8, 0xc8, 0x68,
-	0x91, 0xe3, 0x31, 0x56, 0x41, 0xfc, 0x4a, 0x77, 0x9a, 0xa0, 0x23, 0x43, 0x21, 0xa5, 0xc4, 0x6f,
-	0xa0, 0x5d, 0xf5, 0xd6, 0x44, 0x1d, 0x19, 0xb2, 0x7d, 0x6e, 0xd6, 0xd7, 0x08, 0x4c, 0xc2, 0x15,
-	0x79, 0x0e, 0xe0, 0x77, 0x20, 0x87, 0x6b, 0x96, 0xd3, 0x6c, 0x4e, 0x69, 0x96, 0x6b, 0xa7, 0xba,
-	0x68, 0xc8, 0xf6, 0xc5, 0x71, 0xbd, 0xf2, 0x70, 0x22, 0x3d, 0x3e, 0x5d, 0x9e, 0x90, 0x66, 0x1c,
-	0x7f, 0x80, 0x6e, 0x9a, 0xb1, 0x87, 0x24, 0xaa, 0xf9, 0xce, 0x8b, 0xfc, 0x21, 0xd0, 0xff, 0x81,
-	0x40, 0x2a, 0x15, 0x1e, 0x82, 0x90, 0x44, 0x7c, 0x3d, 0xca, 0x04, 0x97, 0xc9, 0x5f, 0x4f, 0x97,
-	0x10, 0xec, 0x0a, 0x7a, 0x53, 0x64, 0xc9, 0x26, 0x26, 0x42, 0x12, 0xe1, 0x0b, 0x68, 0xad, 0xa2,
-	0x28, 0xcb, 0x35, 0x41, 0x17, 0x0d, 0x85, 0x54, 0x06, 0xbf, 0x07, 0x08, 0xd9, 0x66, 0x43, 0xc3,
-	0x22, 0x61, 0x1b, 0x7e, 0xe3, 0x9e, 0x3d, 0x38, 0x6e, 0xe0, 0xfc, 0x4b, 0xf0, 0x1d, 0x37, 0x88,
-	0x61, 0x02, 0x72, 0x63, 0xfd, 0xb8, 0x0b, 0x9d, 0xf9, 0xed, 0x62, 0x79, 0x37, 0xbe, 0xbe, 0xf5,
-	0xd4, 0x93, 0xd2, 0x5e, 0x79, 0xb5, 0x45, 0x58, 0x05, 0x65, 0xec, 0xba, 0xcb, 0x39, 0x99, 0xdd,
-	0x4d, 0x5d, 0x8f, 0xa8, 0x02, 0x3e, 0x87, 0x6e, 0x19, 0xa8, 0x27, 0x37, 0xaa, 0x58, 0x32, 0x1f,
-	0xa7, 0xbe, 0xbb, 0xf4, 0x67, 0xae, 0xa7, 0x4a, 0xf8, 0x14, 0xa4, 0xf9, 0xd4, 0xbf, 0x52, 0x5b,
-	0xc3, 0xcf, 0xd0, 0x3b, 0x2c, 0x52, 0xd2, 0xfe, 0x6c, 0xb1, 0x74, 0x66, 0xbe, 0xef, 0x39, 0x0b,
-	0xcf, 0xad, 0xfe, 0xf8, 0xdf, 0x22, 0x7c, 0x06, 0xb2, 0x33, 0xf6, 0xeb, 0x84, 0x2a, 0x60, 0x0c,
-	0x3d, 0x67, 0xec, 0x37, 0x28, 0x55, 0x9c, 0x28, 0x8f, 0xfb, 0x01, 0xfa, 0xb9, 0x1f, 0xa0, 0xdf,
-	0xfb, 0x01, 0x0a, 0xda, 0xfc, 0xfd, 0xbd, 0xfd, 0x1b, 0x00, 0x00, 0xff, 0xff, 0x8d, 0x1a, 0xa1,
-	0xbe, 0xf7, 0x02, 0x00, 0x00,
+	// 543 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x84, 0x53, 0xc1, 0x6e, 0x9b, 0x4c,
+	0x18, 0xcc, 0x1a, 0xdb, 0x49, 0x3e, 0x88, 0x43, 0x36, 0x91, 0x7e, 0x94, 0x5f, 0x72, 0x90, 0x4f,
+	0xb4, 0x6a, 0x40, 0xa2, 0xd7, 0xaa, 0xaa, 0x0d, 0x24, 0xb2, 0x94, 0x62, 0x6b, 0x4d, 0x52, 0xf5,
+	0x64, 0x19, 0xd8, 0x12, 0x14, 0x97, 0x45, 0x80, 0x53, 0xb9, 0xa7, 0xbe, 0x45, 0x5f, 0x29, 0xc7,
+	0x9e, 0x7b, 0x88, 0xaa, 0xbc, 0x41, 0xdf, 0xa0, 0x62, 0x09, 0x29, 0x49, 0x0e, 0x3d, 0x79, 0x66,
+	0xbe, 0x19, 0xef, 0x7c, 0xbb, 0x02, 0xb6, 0xc3, 0xcb, 0x42, 0x4f, 0x33, 0x56, 0x30, 0xdc, 0xe5,
+	0xd0, 0x3f, 0x34, 0xa3, 0xb8, 0xb8, 0x5c, 0xf9, 0x7a, 0xc0, 0x3e, 0x1b, 0xcb, 0xd8, 0x4f, 0xcd,
+	0xd4, 0x88, 0xd8, 0x71, 0x85, 0x8e, 0x33, 0x1a, 0xb0, 0x2c, 0x34, 0x52, 0xdf, 0xa8, 0x50, 0x95,
+	0x3d, 0x3c, 0x6e, 0x64, 0x22, 0x16, 0x31, 0x83, 0xcb, 0xfe, 0xea, 0x13, 0x67, 0x9c, 0x70, 0x54,
+	0xd9, 0x07, 0xbf, 0x3b, 0xb0, 0xf9, 0x9e, 0xe6, 0xf9, 0x22, 0xa2, 0xd8, 0x80, 0x76, 0xb1, 0x4e,
+	0xa9, 0x82, 0x54, 0xa4, 0xf5, 0xcc, 0xff, 0xf5, 0xaa, 0x85, 0x7e, 0x3f, 0xae, 0x7f, 0xbd, 0x75,
+	0x4a, 0x09, 0x37, 0x62, 0x0d, 0x76, 0x83, 0xe5, 0x2a, 0x2f, 0x68, 0x76, 0x46, 0xaf, 0xe9, 0x92,
+	0x2c, 0xbe, 0x28, 0xa0, 0x22, 0xad, 0x43, 0x9e, 0xca, 0x58, 0x06, 0xe1, 0x8a, 0xae, 0x95, 0x96,
+	0x8a, 0x34, 0x89, 0x94, 0x10, 0xbf, 0x80, 0x6e, 0xd5, 0x5b, 0x11, 0x54, 0xa4, 0x89, 0xe6, 0x9e,
+	0x5e, 0xaf, 0xe1, 0xeb, 0x84, 0x23, 0x72, 0x6f, 0xc0, 0x6f, 0x40, 0x0c, 0x96, 0x2c, 0xa7, 0xd9,
+	0x94, 0xd2, 0x2c, 0x57, 0xb6, 0x54, 0x41, 0x13, 0xcd, 0x83, 0xa7, 0xf5, 0xca, 0xe1, 0xa8, 0x7d,
+	0x73, 0x7b, 0xb4, 0x41, 0x9a, 0x76, 0xfc, 0x0e, 0x76, 0xd2, 0x8c, 0x5d, 0xc7, 0x61, 0x9d, 0xdf,
+	0xfe, 0x67, 0xfe, 0x71, 0x00, 0xbf, 0x04, 0xf9, 0x41, 0x58, 0x44, 0x74, 0x16, 0x7f, 0xa5, 0x8a,
+	0xc8, 0xf7, 0x7c, 0xa6, 0xe3, 0x57, 0xb0, 0x17, 0xb0, 0xa4, 0x88, 0x93, 0xd5, 0xa2, 0x88, 0x59,
+	0xe2, 0xb1, 0x2b, 0x9a, 0x28, 0x12, 0x5f, 0xfb, 0xf9, 0xe0, 0xf0, 0x1b, 0x82, 0x76, 0x79, 0x06,
+	0x1e, 0x40, 0x2b, 0x0e, 0xf9, 0xc5, 0x4b, 0x23, 0x5c, 0x76, 0xf8, 0x79, 0x7b, 0x04, 0xfe, 0xba,
+	0xa0, 0xb3, 0x22, 0x8b, 0x93, 0x88, 0xb4, 0xe2, 0x10, 0x1f, 0x40, 0x67, 0x11, 0x86, 0x59, 0xae,
+	0xb4, 0x54, 0x41, 0x93, 0x48, 0x45, 0xf0, 0x5b, 0x80, 0x80, 0x25, 0x09, 0x0d, 0xca, 0x7f, 0xe5,
+	0x77, 0xd9, 0x33, 0xfb, 0x4f, 0x77, 0xb3, 0x1e, 0x1c, 0xfc, 0xf5, 0x1a, 0x89, 0xc1, 0x77, 0x04,
+	0x62, 0xe3, 0x65, 0xf1, 0x0e, 0x6c, 0x4f, 0xcf, 0xbd, 0xf9, 0xc5, 0xf0, 0xec, 0xdc, 0x91, 0x37,
+	0x4a, 0x7a, 0xea, 0xd4, 0x14, 0x61, 0x19, 0xa4, 0xa1, 0x6d, 0xcf, 0xa7, 0x64, 0x72, 0x31, 0xb6,
+	0x1d, 0x22, 0xb7, 0xf0, 0x1e, 0xec, 0x94, 0x86, 0x5a, 0x99, 0xc9, 0x42, 0x99, 0x39, 0x19, 0xbb,
+	0xf6, 0xdc, 0x9d, 0xd8, 0x8e, 0xdc, 0xc6, 0x5b, 0xd0, 0x9e, 0x8e, 0xdd, 0x53, 0xb9, 0x83, 0xff,
+	0x83, 0xfd, 0xd9, 0xf9, 0x68, 0x66, 0x91, 0xf1, 0xc8, 0x69, 0x24, 0xba, 0x78, 0x1f, 0x76, 0x6b,
+	0x3a, 0x77, 0x27, 0xde, 0xf8, 0xe4, 0xa3, 0xbc, 0x39, 0xf8, 0x00, 0xbd, 0xc7, 0xbd, 0xcb, 0xb3,
+	0xdc, 0x89, 0x37, 0xb7, 0x26, 0xae, 0xeb, 0x58, 0x9e, 0x63, 0x57, 0xfd, 0xfe, 0x52, 0x84, 0x77,
+	0x41, 0xb4, 0x86, 0x6e, 0xed, 0x90, 0x5b, 0x18, 0x43, 0xcf, 0x1a, 0xba, 0x8d, 0x94, 0x2c, 0x8c,
+	0xa4, 0x9b, 0xbb, 0x3e, 0xfa, 0x71, 0xd7, 0x47, 0xbf, 0xee, 0xfa, 0xc8, 0xef, 0xf2, 0x0f, 0xe1,
+	0xf5, 0x9f, 0x00, 0x00, 0x00, 0xff, 0xff, 0x0a, 0x96, 0x89, 0xd9, 0x80, 0x03, 0x00, 0x00,
 }
 
 func (m *Message) Marshal() (dAtA []byte, err error) {
@@ -322,6 +425,81 @@ func (m *Message) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 		i -= len(m.XXX_unrecognized)
 		copy(dAtA[i:], m.XXX_unrecognized)
 	}
+	if m.Busy {
+		i--
+		if m.Busy {
+			dAtA[i] = 1
+		} else {
+			dAtA[i] = 0
+		}
+		i--
+		dAtA[i] = 0x1
+		i--
+		dAtA[i] = 0x98
+	}
+	if len(m.Signature) > 0 {
+		i -= len(m.Signature)
+		copy(dAtA[i:], m.Signature)
+		i = encodeVarintDht(dAtA, i, uint64(len(m.Signature)))
+		i--
+		dAtA[i] = 0x1
+		i--
+		dAtA[i] = 0x92
+	}
+	if len(m.Membership) > 0 {
+		i -= len(m.Membership)
+		copy(dAtA[i:], m.Membership)
+		i = encodeVarintDht(dAtA, i, uint64(len(m.Membership)))
+		i--
+		dAtA[i] = 0x1
+		i--
+		dAtA[i] = 0x8a
+	}
+	if len(m.DetectorHint) > 0 {
+		i -= len(m.DetectorHint)
+		copy(dAtA[i:], m.DetectorHint)
+		i = encodeVarintDht(dAtA, i, uint64(len(m.DetectorHint)))
+		i--
+		dAtA[i] = 0x1
+		i--
+		dAtA[i] = 0x82
+	}
+	if m.WantDetectorHint {
+		i--
+		if m.WantDetectorHint {
+			dAtA[i] = 1
+		} else {
+			dAtA[i] = 0
+		}
+		i--
+		dAtA[i] = 0x78
+	}
+	if len(m.CompressedProviderPeers) > 0 {
+		i -= len(m.CompressedProviderPeers)
+		copy(dAtA[i:], m.CompressedProviderPeers)
+		i = encodeVarintDht(dAtA, i, uint64(len(m.CompressedProviderPeers)))
+		i--
+		dAtA[i] = 0x72
+	}
+	if len(m.ProviderAuthorization) > 0 {
+		i -= len(m.ProviderAuthorization)
+		copy(dAtA[i:], m.ProviderAuthorization)
+		i = encodeVarintDht(dAtA, i, uint64(len(m.ProviderAuthorization)))
+		i--
+		dAtA[i] = 0x6a
+	}
+	if len(m.ContinuationToken) > 0 {
+		i -= len(m.ContinuationToken)
+		copy(dAtA[i:], m.ContinuationToken)
+		i = encodeVarintDht(dAtA, i, uint64(len(m.ContinuationToken)))
+		i--
+		dAtA[i] = 0x62
+	}
+	if m.ProviderPageSize != 0 {
+		i = encodeVarintDht(dAtA, i, uint64(m.ProviderPageSize))
+		i--
+		dAtA[i] = 0x58
+	}
 	if m.ClusterLevelRaw != 0 {
 		i = encodeVarintDht(dAtA, i, uint64(m.ClusterLevelRaw))
 		i--
@@ -476,6 +654,39 @@ func (m *Message) Size() (n int) {
 	if m.ClusterLevelRaw != 0 {
 		n += 1 + sovDht(uint64(m.ClusterLevelRaw))
 	}
+	if m.ProviderPageSize != 0 {
+		n += 1 + sovDht(uint64(m.ProviderPageSize))
+	}
+	l = len(m.ContinuationToken)
+	if l > 0 {
+		n += 1 + l + sovDht(uint64(l))
+	}
+	l = len(m.ProviderAuthorization)
+	if l > 0 {
+		n += 1 + l + sovDht(uint64(l))
+	}
+	l = len(m.CompressedProviderPeers)
+	if l > 0 {
+		n += 1 + l + sovDht(uint64(l))
+	}
+	if m.WantDetectorHint {
+		n += 2
+	}
+	l = len(m.DetectorHint)
+	if l > 0 {
+		n += 2 + l + sovDht(uint64(l))
+	}
+	l = len(m.Membership)
+	if l > 0 {
+		n += 2 + l + sovDht(uint64(l))
+	}
+	l = len(m.Signature)
+	if l > 0 {
+		n += 2 + l + sovDht(uint64(l))
+	}
+	if m.Busy {
+		n += 3
+	}
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -716,6 +927,269 @@ func (m *Message) Unmarshal(dAtA []byte) error {
 					break
 				}
 			}
+		case 11:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ProviderPageSize", wireType)
+			}
+			m.ProviderPageSize = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDht
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.ProviderPageSize |= int32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 12:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ContinuationToken", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDht
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthDht
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthDht
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.ContinuationToken = append(m.ContinuationToken[:0], dAtA[iNdEx:postIndex]...)
+			if m.ContinuationToken == nil {
+				m.ContinuationToken = []byte{}
+			}
+			iNdEx = postIndex
+		case 13:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ProviderAuthorization", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDht
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthDht
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthDht
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.ProviderAuthorization = append(m.ProviderAuthorization[:0], dAtA[iNdEx:postIndex]...)
+			if m.ProviderAuthorization == nil {
+				m.ProviderAuthorization = []byte{}
+			}
+			iNdEx = postIndex
+		case 14:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field CompressedProviderPeers", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDht
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthDht
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthDht
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.CompressedProviderPeers = append(m.CompressedProviderPeers[:0], dAtA[iNdEx:postIndex]...)
+			if m.CompressedProviderPeers == nil {
+				m.CompressedProviderPeers = []byte{}
+			}
+			iNdEx = postIndex
+		case 15:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field WantDetectorHint", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDht
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				v |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.WantDetectorHint = bool(v != 0)
+		case 16:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field DetectorHint", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDht
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthDht
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthDht
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.DetectorHint = append(m.DetectorHint[:0], dAtA[iNdEx:postIndex]...)
+			if m.DetectorHint == nil {
+				m.DetectorHint = []byte{}
+			}
+			iNdEx = postIndex
+		case 17:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Membership", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDht
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthDht
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthDht
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Membership = append(m.Membership[:0], dAtA[iNdEx:postIndex]...)
+			if m.Membership == nil {
+				m.Membership = []byte{}
+			}
+			iNdEx = postIndex
+		case 18:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Signature", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDht
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthDht
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthDht
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Signature = append(m.Signature[:0], dAtA[iNdEx:postIndex]...)
+			if m.Signature == nil {
+				m.Signature = []byte{}
+			}
+			iNdEx = postIndex
+		case 19:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Busy", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDht
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				v |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.Busy = bool(v != 0)
 		default:
 			iNdEx = preIndex
 			skippy, err := skipDht(dAtA[iNdEx:])
@@ -1,15 +1,28 @@
 package dht_pb
 
 import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 
 	logging "github.com/ipfs/go-log"
 	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
 )
 
 var log = logging.Logger("dht.pb")
 
+// ErrBusy is returned for requests the peer rejected with a busy response, see Message.Busy.
+var ErrBusy = errors.New("peer is busy")
+
 type PeerRoutingInfo struct {
 	peer.AddrInfo
 	network.Connectedness
@@ -169,3 +182,164 @@ func Connectedness(c Message_ConnectionType) network.Connectedness {
 		return network.CannotConnect
 	}
 }
+
+// CompressProviderPeers moves the provider peers of m into its compressed provider peers, saving bandwidth on records
+// with many addresses. Only peers accepting the compressed encoding understand the message.
+func (m *Message) CompressProviderPeers() error {
+	if len(m.ProviderPeers) == 0 {
+		return nil
+	}
+	raw, err := (&Message{ProviderPeers: m.ProviderPeers}).Marshal()
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(raw); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	m.CompressedProviderPeers = buf.Bytes()
+	m.ProviderPeers = nil
+	return nil
+}
+
+// DecompressedProviderPeers returns the provider peers of m, including its compressed provider peers. Decompressed
+// provider peers are bounded to the maximum message size.
+func (m *Message) DecompressedProviderPeers() ([]Message_Peer, error) {
+	if len(m.CompressedProviderPeers) == 0 {
+		return m.ProviderPeers, nil
+	}
+	r := flate.NewReader(bytes.NewReader(m.CompressedProviderPeers))
+	defer r.Close()
+	raw, err := io.ReadAll(io.LimitReader(r, network.MessageSizeMax+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) > network.MessageSizeMax {
+		return nil, fmt.Errorf("compressed provider peers exceed the maximum message size")
+	}
+	var decoded Message
+	if err := decoded.Unmarshal(raw); err != nil {
+		return nil, err
+	}
+	return append(m.ProviderPeers, decoded.ProviderPeers...), nil
+}
+
+// PruneProviderAddrs returns the n most useful addresses of a provider, all of them if n is 0. Addresses are ranked by
+// how likely peers are to reach the provider on them: public direct addresses first, then relay addresses, then
+// private and loopback addresses, and QUIC before TCP before other transports. Duplicates are dropped.
+func PruneProviderAddrs(addrs []ma.Multiaddr, n int) []ma.Multiaddr {
+	if n <= 0 || len(addrs) <= n {
+		return addrs
+	}
+	pruned := make([]ma.Multiaddr, 0, len(addrs))
+	for _, a := range addrs {
+		dup := false
+		for _, b := range pruned {
+			if a.Equal(b) {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			pruned = append(pruned, a)
+		}
+	}
+	sort.SliceStable(pruned, func(i, j int) bool {
+		return providerAddrRank(pruned[i]) < providerAddrRank(pruned[j])
+	})
+	if len(pruned) > n {
+		pruned = pruned[:n]
+	}
+	return pruned
+}
+
+// providerAddrRank estimates how useful a provider address is, lower being more useful.
+func providerAddrRank(a ma.Multiaddr) int {
+	var reach int
+	switch {
+	case hasProtocol(a, ma.P_CIRCUIT):
+		reach = 1
+	case manet.IsPublicAddr(a):
+		reach = 0
+	case manet.IsIPLoopback(a):
+		reach = 3
+	default:
+		reach = 2
+	}
+	var transport int
+	switch {
+	case hasProtocol(a, ma.P_QUIC):
+		transport = 0
+	case hasProtocol(a, ma.P_TCP):
+		transport = 1
+	default:
+		transport = 2
+	}
+	return reach*3 + transport
+}
+
+func hasProtocol(a ma.Multiaddr, code int) bool {
+	_, err := a.ValueForProtocol(code)
+	return err == nil
+}
+
+// MaxDetectorHintLen bounds the number of prefix lengths of a DetectorHint.
+const MaxDetectorHintLen = 256
+
+// detectorHintVersion is the version of the encoding of DetectorHint.
+const detectorHintVersion = 1
+
+// DetectorHint is the local estimate of a server of the distribution of the prefix lengths the closest peers to a key
+// share with it, returned in GET_PROVIDERS responses to clients asking for it.
+type DetectorHint struct {
+	// Netsize is the network size estimate of the server.
+	Netsize float64
+	// Expected is the expected number of the closest peers to the key per prefix length, derived from Netsize.
+	// Trailing prefix lengths no peer is expected at are omitted.
+	Expected []float64
+}
+
+// Marshal encodes h as a version byte, followed by Netsize and the entries of Expected as big endian IEEE 754 doubles.
+func (h *DetectorHint) Marshal() []byte {
+	buf := make([]byte, 1, 1+8*(1+len(h.Expected)))
+	buf[0] = detectorHintVersion
+	buf = binary.BigEndian.AppendUint64(buf, math.Float64bits(h.Netsize))
+	for _, e := range h.Expected {
+		buf = binary.BigEndian.AppendUint64(buf, math.Float64bits(e))
+	}
+	return buf
+}
+
+// UnmarshalDetectorHint decodes a DetectorHint, rejecting hints of an unknown version, longer than
+// MaxDetectorHintLen, or holding negative or non-finite values.
+func UnmarshalDetectorHint(b []byte) (*DetectorHint, error) {
+	if len(b) < 9 || (len(b)-1)%8 != 0 {
+		return nil, fmt.Errorf("invalid detector hint length %d", len(b))
+	}
+	if b[0] != detectorHintVersion {
+		return nil, fmt.Errorf("unknown detector hint version %d", b[0])
+	}
+	n := (len(b)-1)/8 - 1
+	if n > MaxDetectorHintLen {
+		return nil, fmt.Errorf("detector hint too long: %d prefix lengths", n)
+	}
+	vals := make([]float64, n+1)
+	for i := range vals {
+		v := math.Float64frombits(binary.BigEndian.Uint64(b[1+8*i:]))
+		if math.IsNaN(v) || math.IsInf(v, 0) || v < 0 {
+			return nil, fmt.Errorf("invalid detector hint value %v", v)
+		}
+		vals[i] = v
+	}
+	if vals[0] < 1 {
+		return nil, fmt.Errorf("invalid detector hint network size %v", vals[0])
+	}
+	return &DetectorHint{Netsize: vals[0], Expected: vals[1:]}, nil
+}
@@ -1,7 +1,11 @@
 package dht_pb
 
 import (
+	"math"
 	"testing"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
 )
 
 func TestBadAddrsDontReturnNil(t *testing.T) {
@@ -13,3 +17,116 @@ func TestBadAddrsDontReturnNil(t *testing.T) {
 		t.Fatal("shouldnt have any multiaddrs")
 	}
 }
+
+func TestCompressProviderPeers(t *testing.T) {
+	addrs := []ma.Multiaddr{
+		ma.StringCast("/ip4/1.2.3.4/tcp/4001"),
+		ma.StringCast("/ip4/1.2.3.4/udp/4001/quic"),
+		ma.StringCast("/ip6/::1/tcp/4001"),
+	}
+	m := NewMessage(Message_ADD_PROVIDER, []byte("key"), 0)
+	m.ProviderPeers = RawPeerInfosToPBPeers([]peer.AddrInfo{{ID: "provider", Addrs: addrs}})
+	if err := m.CompressProviderPeers(); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.ProviderPeers) != 0 || len(m.CompressedProviderPeers) == 0 {
+		t.Fatal("expected provider peers to be compressed")
+	}
+
+	b, err := m.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Message
+	if err := decoded.Unmarshal(b); err != nil {
+		t.Fatal(err)
+	}
+	peers, err := decoded.DecompressedProviderPeers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	infos := PBPeersToPeerInfos(peers)
+	if len(infos) != 1 || infos[0].ID != "provider" || len(infos[0].Addrs) != len(addrs) {
+		t.Fatalf("unexpected provider peers %v", infos)
+	}
+	for i, a := range addrs {
+		if !infos[0].Addrs[i].Equal(a) {
+			t.Fatalf("expected address %s, got %s", a, infos[0].Addrs[i])
+		}
+	}
+
+	decoded.CompressedProviderPeers = []byte("not deflate")
+	if _, err := decoded.DecompressedProviderPeers(); err == nil {
+		t.Fatal("expected invalid compressed provider peers to fail")
+	}
+}
+
+func TestDetectorHint(t *testing.T) {
+	hint := &DetectorHint{Netsize: 1000, Expected: []float64{0, 0.5, 3.25, 16.25}}
+	m := NewMessage(Message_GET_PROVIDERS, []byte("key"), 0)
+	m.WantDetectorHint = true
+	m.DetectorHint = hint.Marshal()
+
+	b, err := m.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Message
+	if err := decoded.Unmarshal(b); err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.GetWantDetectorHint() {
+		t.Fatal("expected the detector hint to be requested")
+	}
+	got, err := UnmarshalDetectorHint(decoded.GetDetectorHint())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Netsize != hint.Netsize || len(got.Expected) != len(hint.Expected) {
+		t.Fatalf("unexpected detector hint %v", got)
+	}
+	for i, e := range hint.Expected {
+		if got.Expected[i] != e {
+			t.Fatalf("expected %v at prefix length %d, got %v", e, i, got.Expected[i])
+		}
+	}
+
+	for _, bad := range []*DetectorHint{
+		{Netsize: 0.5},
+		{Netsize: 1000, Expected: []float64{-1}},
+		{Netsize: math.Inf(1)},
+		{Netsize: 1000, Expected: []float64{math.NaN()}},
+		{Netsize: 1000, Expected: make([]float64, MaxDetectorHintLen+1)},
+	} {
+		if _, err := UnmarshalDetectorHint(bad.Marshal()); err == nil {
+			t.Fatalf("expected detector hint %v to be rejected", bad)
+		}
+	}
+	if _, err := UnmarshalDetectorHint(hint.Marshal()[:12]); err == nil {
+		t.Fatal("expected truncated detector hint to be rejected")
+	}
+}
+
+func TestPruneProviderAddrs(t *testing.T) {
+	loopback := ma.StringCast("/ip4/127.0.0.1/tcp/4001")
+	private := ma.StringCast("/ip4/192.168.0.10/tcp/4001")
+	relay := ma.StringCast("/ip4/5.6.7.8/tcp/4001/p2p/QmZ7fyyGGaD4ejBaYnSShdKBAs8rmjMB3nKJmTnrLRqyXP/p2p-circuit")
+	publicTCP := ma.StringCast("/ip4/1.2.3.4/tcp/4001")
+	publicQUIC := ma.StringCast("/ip4/1.2.3.4/udp/4001/quic")
+	addrs := []ma.Multiaddr{loopback, private, relay, publicTCP, publicTCP, publicQUIC}
+
+	pruned := PruneProviderAddrs(addrs, 4)
+	expected := []ma.Multiaddr{publicQUIC, publicTCP, relay, private}
+	if len(pruned) != len(expected) {
+		t.Fatalf("expected %d addresses, got %v", len(expected), pruned)
+	}
+	for i, a := range expected {
+		if !pruned[i].Equal(a) {
+			t.Fatalf("expected %s at %d, got %s", a, i, pruned[i])
+		}
+	}
+
+	if len(PruneProviderAddrs(addrs, 0)) != len(addrs) {
+		t.Fatal("expected no pruning without a maximum")
+	}
+}
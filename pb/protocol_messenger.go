@@ -25,10 +25,47 @@ var logger = logging.Logger("dht")
 // varint-delineated protobufs
 type ProtocolMessenger struct {
 	m MessageSender
+
+	maxCloserPeers    int
+	compressProviders bool
+	maxProviderAddrs  int
 }
 
 type ProtocolMessengerOption func(*ProtocolMessenger) error
 
+// WithMaxCloserPeers caps the number of closer peers taken from a response, the rest is dropped. This bounds the
+// memory a single peer can make us spend on the closer peers of a query. A cap of 0 is unlimited.
+func WithMaxCloserPeers(n int) ProtocolMessengerOption {
+	return func(pm *ProtocolMessenger) error {
+		if n < 0 {
+			return fmt.Errorf("max closer peers must not be negative")
+		}
+		pm.maxCloserPeers = n
+		return nil
+	}
+}
+
+// WithCompressedProviderRecords sends provider records using the compressed provider peers encoding. Peers not
+// accepting the encoding ignore the records, it is only meant for networks whose peers all accept it.
+func WithCompressedProviderRecords() ProtocolMessengerOption {
+	return func(pm *ProtocolMessenger) error {
+		pm.compressProviders = true
+		return nil
+	}
+}
+
+// WithMaxProviderRecordAddrs caps the number of addresses sent in provider records, the most useful addresses are
+// kept, see PruneProviderAddrs. A cap of 0 is unlimited.
+func WithMaxProviderRecordAddrs(n int) ProtocolMessengerOption {
+	return func(pm *ProtocolMessenger) error {
+		if n < 0 {
+			return fmt.Errorf("max provider record addresses must not be negative")
+		}
+		pm.maxProviderAddrs = n
+		return nil
+	}
+}
+
 // NewProtocolMessenger creates a new ProtocolMessenger that is used for sending DHT messages to peers and processing
 // their responses.
 func NewProtocolMessenger(msgSender MessageSender, opts ...ProtocolMessengerOption) (*ProtocolMessenger, error) {
@@ -82,7 +119,7 @@ func (pm *ProtocolMessenger) GetValue(ctx context.Context, p peer.ID, key string
 	}
 
 	// Perhaps we were given closer peers
-	peers := PBPeersToPeerInfos(respMsg.GetCloserPeers())
+	peers := pm.closerPeers(respMsg)
 
 	if rec := respMsg.GetRecord(); rec != nil {
 		// Success! We were given the value
@@ -109,25 +146,58 @@ func (pm *ProtocolMessenger) GetClosestPeers(ctx context.Context, p peer.ID, id
 	if err != nil {
 		return nil, err
 	}
-	peers := PBPeersToPeerInfos(respMsg.GetCloserPeers())
+	peers := pm.closerPeers(respMsg)
 	return peers, nil
 }
 
 // PutProvider asks a peer to store that we are a provider for the given key.
 func (pm *ProtocolMessenger) PutProvider(ctx context.Context, p peer.ID, key multihash.Multihash, host host.Host) error {
-	pi := peer.AddrInfo{
-		ID:    host.ID(),
-		Addrs: host.Addrs(),
-	}
+	return pm.PutProviderAddrs(ctx, p, key, peer.AddrInfo{ID: host.ID(), Addrs: host.Addrs()})
+}
 
+// PutProviderAddrs asks a peer to store that we, pi.ID, are a provider for the given key, reachable at the addresses of
+// pi.
+func (pm *ProtocolMessenger) PutProviderAddrs(ctx context.Context, p peer.ID, key multihash.Multihash, pi peer.AddrInfo) error {
 	// TODO: We may want to limit the type of addresses in our provider records
 	// For example, in a WAN-only DHT prohibit sharing non-WAN addresses (e.g. 192.168.0.100)
 	if len(pi.Addrs) < 1 {
 		return fmt.Errorf("no known addresses for self, cannot put provider")
 	}
 
+	pmes, err := pm.addProviderMessage(key, pi)
+	if err != nil {
+		return err
+	}
+	return pm.m.SendMessage(ctx, p, pmes)
+}
+
+// addProviderMessage returns the ADD_PROVIDER message for provider pi, pruning its addresses and compressing it as
+// configured.
+func (pm *ProtocolMessenger) addProviderMessage(key multihash.Multihash, pi peer.AddrInfo) (*Message, error) {
+	pi.Addrs = PruneProviderAddrs(pi.Addrs, pm.maxProviderAddrs)
 	pmes := NewMessage(Message_ADD_PROVIDER, key, 0)
 	pmes.ProviderPeers = RawPeerInfosToPBPeers([]peer.AddrInfo{pi})
+	if pm.compressProviders {
+		if err := pmes.CompressProviderPeers(); err != nil {
+			return nil, err
+		}
+	}
+	return pmes, nil
+}
+
+// PutProviderFor asks a peer to store that provider is a provider for the given key. The record is published on behalf
+// of provider, which authorizes us to do so with the signed envelope authorization. Without an authorization, peers
+// only store the record if they accept third-party provider records.
+func (pm *ProtocolMessenger) PutProviderFor(ctx context.Context, p peer.ID, key multihash.Multihash, provider peer.AddrInfo, authorization []byte) error {
+	if len(provider.Addrs) < 1 {
+		return fmt.Errorf("no known addresses for provider %s, cannot put provider", provider.ID)
+	}
+
+	pmes, err := pm.addProviderMessage(key, provider)
+	if err != nil {
+		return err
+	}
+	pmes.ProviderAuthorization = authorization
 
 	return pm.m.SendMessage(ctx, p, pmes)
 }
@@ -141,10 +211,60 @@ func (pm *ProtocolMessenger) GetProviders(ctx context.Context, p peer.ID, key mu
 		return nil, nil, err
 	}
 	provs := PBPeersToPeerInfos(respMsg.GetProviderPeers())
-	closerPeers := PBPeersToPeerInfos(respMsg.GetCloserPeers())
+	closerPeers := pm.closerPeers(respMsg)
 	return provs, closerPeers, nil
 }
 
+// SubscribeProviders asks a peer to notify us of providers added for the given key.
+// Subscriptions expire and must be renewed periodically.
+func (pm *ProtocolMessenger) SubscribeProviders(ctx context.Context, p peer.ID, key multihash.Multihash) error {
+	req := NewMessage(Message_SUBSCRIBE_PROVIDERS, key, 0)
+	resp, err := pm.m.SendRequest(ctx, p, req)
+	if err != nil {
+		return err
+	}
+	if resp.Type != Message_SUBSCRIBE_PROVIDERS || !bytes.Equal(resp.GetKey(), key) {
+		return fmt.Errorf("got unexpected response to provider subscription: %v", resp.Type)
+	}
+	return nil
+}
+
+// GetProvidersPage is like GetProviders but asks the peer for at most pageSize providers, starting at the page
+// identified by token (nil for the first page). The returned token identifies the next page and is nil if there are
+// no more providers. Peers that do not support paging return all providers at once and no token.
+func (pm *ProtocolMessenger) GetProvidersPage(ctx context.Context, p peer.ID, key multihash.Multihash, pageSize int, token []byte) ([]*peer.AddrInfo, []*peer.AddrInfo, []byte, error) {
+	provs, closerPeers, token, _, err := pm.getProvidersPage(ctx, p, key, pageSize, token, false)
+	return provs, closerPeers, token, err
+}
+
+// GetProvidersPageWithHint is GetProvidersPage also asking the remote peer for a DetectorHint. The hint is nil if the
+// remote peer didn't return one or it was invalid.
+func (pm *ProtocolMessenger) GetProvidersPageWithHint(ctx context.Context, p peer.ID, key multihash.Multihash, pageSize int, token []byte) ([]*peer.AddrInfo, []*peer.AddrInfo, []byte, *DetectorHint, error) {
+	return pm.getProvidersPage(ctx, p, key, pageSize, token, true)
+}
+
+func (pm *ProtocolMessenger) getProvidersPage(ctx context.Context, p peer.ID, key multihash.Multihash, pageSize int, token []byte, wantHint bool) ([]*peer.AddrInfo, []*peer.AddrInfo, []byte, *DetectorHint, error) {
+	pmes := NewMessage(Message_GET_PROVIDERS, key, 0)
+	pmes.ProviderPageSize = int32(pageSize)
+	pmes.ContinuationToken = token
+	pmes.WantDetectorHint = wantHint
+	respMsg, err := pm.m.SendRequest(ctx, p, pmes)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	provs := PBPeersToPeerInfos(respMsg.GetProviderPeers())
+	closerPeers := pm.closerPeers(respMsg)
+
+	var hint *DetectorHint
+	if raw := respMsg.GetDetectorHint(); wantHint && len(raw) > 0 {
+		if hint, err = UnmarshalDetectorHint(raw); err != nil {
+			logger.Debugw("invalid detector hint", "from", p, "error", err)
+			hint = nil
+		}
+	}
+	return provs, closerPeers, respMsg.GetContinuationToken(), hint, nil
+}
+
 // Ping sends a ping message to the passed peer and waits for a response.
 func (pm *ProtocolMessenger) Ping(ctx context.Context, p peer.ID) error {
 	req := NewMessage(Message_PING, nil, 0)
@@ -157,3 +277,13 @@ func (pm *ProtocolMessenger) Ping(ctx context.Context, p peer.ID) error {
 	}
 	return nil
 }
+
+// closerPeers returns the closer peers of resp, at most maxCloserPeers of them.
+func (pm *ProtocolMessenger) closerPeers(resp *Message) []*peer.AddrInfo {
+	pbPeers := resp.GetCloserPeers()
+	if pm.maxCloserPeers > 0 && len(pbPeers) > pm.maxCloserPeers {
+		logger.Debugw("truncating closer peers", "peers", len(pbPeers), "max", pm.maxCloserPeers)
+		pbPeers = pbPeers[:pm.maxCloserPeers]
+	}
+	return PBPeersToPeerInfos(pbPeers)
+}
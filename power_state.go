@@ -0,0 +1,60 @@
+package dht
+
+import (
+	"sync"
+)
+
+// PowerStateListener is notified of the power and network state of the device the DHT runs on. IpfsDHT implements it:
+// mobile applications call it from their charging and network callbacks so that, with LowPowerMode, the DHT defers
+// expensive background work until the device is charging and on an unmetered network such as Wi-Fi.
+type PowerStateListener interface {
+	PowerStateChanged(charging, unmetered bool)
+}
+
+var _ PowerStateListener = (*IpfsDHT)(nil)
+
+// powerState tracks the device state reported to a DHT in low power mode. Devices are assumed to be on battery and a
+// metered network until told otherwise.
+type powerState struct {
+	mu            sync.Mutex
+	unconstrained bool
+	// netsizePending is set if netsize gathering was deferred
+	netsizePending bool
+}
+
+// PowerStateChanged implements PowerStateListener. It runs the background work deferred while the device was
+// constrained once it is charging and on an unmetered network. It has no effect unless LowPowerMode is enabled.
+func (dht *IpfsDHT) PowerStateChanged(charging, unmetered bool) {
+	ps := dht.powerState
+	if ps == nil {
+		return
+	}
+	ps.mu.Lock()
+	ps.unconstrained = charging && unmetered
+	gatherNetsize := ps.unconstrained && ps.netsizePending
+	if gatherNetsize {
+		ps.netsizePending = false
+	}
+	ps.mu.Unlock()
+
+	logger.Debugw("power state changed", "charging", charging, "unmetered", unmetered)
+	if gatherNetsize {
+		go dht.GatherNetsizeData()
+	}
+}
+
+// deferNetsizeGathering returns true if gathering netsize data must be deferred until the device is unconstrained,
+// in which case it is run once PowerStateChanged reports so.
+func (dht *IpfsDHT) deferNetsizeGathering() bool {
+	ps := dht.powerState
+	if ps == nil {
+		return false
+	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.unconstrained {
+		return false
+	}
+	ps.netsizePending = true
+	return true
+}
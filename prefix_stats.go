@@ -0,0 +1,60 @@
+package dht
+
+import (
+	"math"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// PrefixStats is the analysis of the prefix lengths a set of peers shares with a target by the eclipse detector.
+type PrefixStats struct {
+	// Counts is the number of peers per prefix length with the target, in the keyspace of the detector.
+	Counts []int
+	// Netsize is the network size estimate the expected distribution is derived from, 0 if there is no estimate.
+	Netsize float64
+	// Expected is the expected number of peers per prefix length if the peers were the closest peers to the target
+	// among Netsize uniformly distributed peers, nil if there is no network size estimate.
+	Expected []float64
+	// ZScores is the deviation of Counts from Expected per prefix length in standard deviations, nil if there is no
+	// network size estimate. It is 0 for prefix lengths no peer is expected at.
+	ZScores []float64
+	// KL is the KL divergence of Counts from the ideal distribution as computed by the detector, and Eclipsed whether
+	// it exceeds the current threshold of the detector. Both assume sets of K peers, see Config.
+	KL       float64
+	Eclipsed bool
+}
+
+// AnalyzePeerSet runs the prefix length analysis of the eclipse detector on an arbitrary set of peers, e.g. the
+// closest peers to target found by another tool, without providing anything. target is the key the peers are close
+// to, such as a multihash, which is converted to the keyspace of the detector like the peers.
+//
+// The detector's parameters derived from the network size are those of the last eclipse detection.
+func (dht *IpfsDHT) AnalyzePeerSet(target []byte, peers []peer.ID) PrefixStats {
+	ks := dht.detector.Keyspace()
+	ids := make([][]byte, len(peers))
+	for i, p := range peers {
+		ids[i] = ks.Key([]byte(p))
+	}
+	counts := dht.detector.ComputePrefixLenCounts(ks.Key(target), ids)
+	kl := dht.detector.ComputeKLFromCounts(counts)
+	stats := PrefixStats{
+		Counts:   counts,
+		KL:       kl,
+		Eclipsed: dht.detector.DetectFromKL(kl),
+	}
+
+	netsize, err := dht.nsEstimator.NetworkSize()
+	if err != nil || netsize < 1 {
+		return stats
+	}
+	stats.Netsize = netsize
+	mean, variance := dht.detector.ExpectedPrefixLenCounts(int(math.Round(netsize)), len(peers))
+	stats.Expected = mean
+	stats.ZScores = make([]float64, len(counts))
+	for x := range counts {
+		if variance[x] > 0 {
+			stats.ZScores[x] = (float64(counts[x]) - mean[x]) / math.Sqrt(variance[x])
+		}
+	}
+	return stats
+}
@@ -0,0 +1,97 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+)
+
+// ProbeResult is the outcome of probing a peer with IpfsDHT.Probe.
+type ProbeResult struct {
+	// Protocol is the first of our DHT protocols the peer supports, empty if it supports none of them, in which case
+	// the peer isn't probed any further.
+	Protocol protocol.ID
+	// RTT is the round trip time of a ping, zero if PingErr is set.
+	RTT     time.Duration
+	PingErr error
+	// FindNode tells whether the peer answered a FIND_NODE request for a random key correctly, FindNodeErr explaining
+	// why not otherwise.
+	FindNode    bool
+	FindNodeErr error
+}
+
+// Probe vets a peer before trusting its query responses or adding it to the routing table, see AddPeer. It connects to
+// the peer, checks which of our DHT protocols it supports, pings it, and checks that it answers a FIND_NODE request for
+// a random key with a well-formed set of closer peers: at most the bucket size of them, all valid and with addresses,
+// without duplicates, and neither us nor itself.
+//
+// The error is only set when connecting to the peer fails. Probing a peer doesn't add it to the routing table.
+func (dht *IpfsDHT) Probe(ctx context.Context, p peer.ID) (ProbeResult, error) {
+	var res ProbeResult
+	// waits for identify, so that the protocols of the peer are known
+	if err := dht.host.Connect(ctx, peer.AddrInfo{ID: p}); err != nil {
+		return res, err
+	}
+	proto, err := dht.peerstore.FirstSupportedProtocol(p, dht.protocolsStrs...)
+	if err != nil {
+		return res, err
+	}
+	if proto == "" {
+		return res, nil
+	}
+	res.Protocol = protocol.ID(proto)
+
+	start := time.Now()
+	if res.PingErr = dht.Ping(ctx, p); res.PingErr == nil {
+		res.RTT = time.Since(start)
+	}
+
+	res.FindNodeErr = dht.probeFindNode(ctx, p)
+	res.FindNode = res.FindNodeErr == nil
+	return res, nil
+}
+
+// probeFindNode sends a FIND_NODE request for a random key to p and checks its response. The closer peers are checked
+// before the truncation to MaxCloserPeers applied to lookups.
+func (dht *IpfsDHT) probeFindNode(ctx context.Context, p peer.ID) error {
+	key, err := dht.routingTable.GenRandPeerID(0)
+	if err != nil {
+		return err
+	}
+	resp, err := dht.msgSender.SendRequest(ctx, p, pb.NewMessage(pb.Message_FIND_NODE, []byte(key), 0))
+	if err != nil {
+		return err
+	}
+	if resp.GetType() != pb.Message_FIND_NODE {
+		return fmt.Errorf("unexpected response type %v", resp.GetType())
+	}
+
+	closer := pb.PBPeersToPeerInfos(resp.GetCloserPeers())
+	if len(closer) > dht.bucketSize {
+		return fmt.Errorf("%d closer peers, more than the bucket size", len(closer))
+	}
+	seen := make(map[peer.ID]struct{}, len(closer))
+	for _, ai := range closer {
+		switch {
+		case ai.ID.Validate() != nil:
+			return errors.New("returned a malformed closer peer")
+		case ai.ID == dht.self:
+			return errors.New("returned us as a closer peer")
+		case ai.ID == p:
+			return errors.New("returned itself as a closer peer")
+		case len(ai.Addrs) == 0:
+			return fmt.Errorf("returned closer peer %s without addresses", ai.ID)
+		}
+		if _, ok := seen[ai.ID]; ok {
+			return fmt.Errorf("returned closer peer %s twice", ai.ID)
+		}
+		seen[ai.ID] = struct{}{}
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package dht
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jbenet/goprocess"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multihash"
+
+	"github.com/libp2p/go-libp2p-kad-dht/internal"
+	"github.com/libp2p/go-libp2p-kad-dht/providers"
+)
+
+// maxChurnWatchedKeys bounds the number of provided keys whose closest peers are watched by ReprovideOnChurn.
+const maxChurnWatchedKeys = 10000
+
+// churnReprovider watches the closest peers of the keys this node provided and sends the provider record to the
+// peers joining them, see ReprovideOnChurn.
+type churnReprovider struct {
+	interval time.Duration
+	rate     float64
+
+	mu   sync.Mutex
+	keys map[string]*churnWatchedKey
+}
+
+type churnWatchedKey struct {
+	// provided is when the key was last provided
+	provided time.Time
+	// targets are the peers that accepted the provider record
+	targets map[peer.ID]struct{}
+}
+
+func newChurnReprovider(interval time.Duration, rate float64) *churnReprovider {
+	return &churnReprovider{
+		interval: interval,
+		rate:     rate,
+		keys:     make(map[string]*churnWatchedKey),
+	}
+}
+
+// track records the peers the provider record of key was sent to. A provide replaces the targets of the key, a
+// re-send to the peers that joined the closest peers adds to them.
+func (c *churnReprovider) track(key multihash.Multihash, strategy string, peers []peer.ID, failed map[peer.ID]error, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w, ok := c.keys[string(key)]
+	if !ok {
+		if strategy == ProvideStrategyChurn {
+			return
+		}
+		if len(c.keys) >= maxChurnWatchedKeys {
+			logger.Debugw("not watching the closest peers of provided key, too many keys watched", "key", internal.LoggableProviderRecordBytes(key))
+			return
+		}
+		w = new(churnWatchedKey)
+		c.keys[string(key)] = w
+	}
+	if strategy != ProvideStrategyChurn {
+		w.provided = now
+		w.targets = make(map[peer.ID]struct{}, len(peers))
+	}
+	for _, p := range peers {
+		if _, ok := failed[p]; !ok {
+			w.targets[p] = struct{}{}
+		}
+	}
+}
+
+// watched returns the keys whose provider records are still valid, forgetting the others.
+func (c *churnReprovider) watched(now time.Time) []multihash.Multihash {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := make([]multihash.Multihash, 0, len(c.keys))
+	for k, w := range c.keys {
+		if now.Sub(w.provided) > providers.ProvideValidity {
+			delete(c.keys, k)
+			continue
+		}
+		keys = append(keys, multihash.Multihash(k))
+	}
+	return keys
+}
+
+// joined returns the peers among closest that the provider record of key wasn't sent to.
+func (c *churnReprovider) joined(key multihash.Multihash, closest []peer.ID) []peer.ID {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w, ok := c.keys[string(key)]
+	if !ok {
+		return nil
+	}
+	var joined []peer.ID
+	for _, p := range closest {
+		if _, ok := w.targets[p]; !ok {
+			joined = append(joined, p)
+		}
+	}
+	return joined
+}
+
+// reprovideOnChurn checks the closest peers of the provided keys every interval, at most rate keys per second, until
+// proc closes.
+func (dht *IpfsDHT) reprovideOnChurn(proc goprocess.Process) {
+	c := dht.churnReprovider
+	ticker := dht.clock.Ticker(c.interval)
+	defer ticker.Stop()
+	limiter := dht.clock.Ticker(time.Duration(float64(time.Second) / c.rate))
+	defer limiter.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-proc.Closing():
+			return
+		}
+		for _, key := range c.watched(dht.clock.Now()) {
+			select {
+			case <-limiter.C:
+			case <-proc.Closing():
+				return
+			}
+			ctx, cancel := context.WithTimeout(dht.ctx, c.interval)
+			dht.reprovideJoined(ctx, key)
+			cancel()
+		}
+	}
+}
+
+// reprovideJoined looks up the closest peers to key and sends the provider record to those it wasn't sent to yet. It
+// returns the peers the record was sent to.
+func (dht *IpfsDHT) reprovideJoined(ctx context.Context, key multihash.Multihash) []peer.ID {
+	start := time.Now()
+	closest, err := dht.getClosestPeers(ctx, string(key), nil)
+	if err != nil {
+		logger.Debugw("failed to look up the closest peers of provided key", "key", internal.LoggableProviderRecordBytes(key), "error", err)
+		return nil
+	}
+	joined := dht.churnReprovider.joined(key, closest)
+	if len(joined) == 0 {
+		return nil
+	}
+	logger.Infow("peers joined the closest peers of provided key, sending them the provider record",
+		"key", internal.LoggableProviderRecordBytes(key), "peers", joined)
+	dht.sendProviderRecords(ctx, key, ProvideStrategyChurn, start, joined)
+	return joined
+}
@@ -0,0 +1,126 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	"github.com/jbenet/goprocess"
+)
+
+// maxDeferredProvides bounds the number of provides deferred until the DHT is ready.
+const maxDeferredProvides = 16384
+
+// ErrTooManyDeferredProvides is returned by Provide when the DHT isn't ready and too many provides are already
+// deferred, see DeferProvidesUntilReady.
+var ErrTooManyDeferredProvides = errors.New("too many provides deferred until the DHT is ready")
+
+// provideDeferral holds the provides made before the DHT is ready, see DeferProvidesUntilReady.
+type provideDeferral struct {
+	// flush is notified when the DHT becomes ready
+	flush chan struct{}
+
+	mu   sync.Mutex
+	keys map[string]deferredProvide
+}
+
+type deferredProvide struct {
+	key cid.Cid
+	// provide is the function the provide was made with
+	provide func(ctx context.Context, key cid.Cid, brdcst bool) error
+	// tenant is the tenant that made the provide, already charged for it
+	tenant string
+}
+
+func newProvideDeferral() *provideDeferral {
+	return &provideDeferral{
+		flush: make(chan struct{}, 1),
+		keys:  make(map[string]deferredProvide),
+	}
+}
+
+// notify schedules a flush of the deferred provides.
+func (d *provideDeferral) notify() {
+	select {
+	case d.flush <- struct{}{}:
+	default:
+	}
+}
+
+// take removes and returns the deferred provides.
+func (d *provideDeferral) take() []deferredProvide {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	provides := make([]deferredProvide, 0, len(d.keys))
+	for _, p := range d.keys {
+		provides = append(provides, p)
+	}
+	d.keys = make(map[string]deferredProvide)
+	return provides
+}
+
+// deferProvide defers the provide of key, made with provide, if the DHT isn't ready, returning whether it did.
+func (dht *IpfsDHT) deferProvide(ctx context.Context, key cid.Cid, provide func(context.Context, cid.Cid, bool) error) (bool, error) {
+	d := dht.provideDeferral
+	if d == nil || dht.State() == StateReady {
+		return false, nil
+	}
+
+	tenant, _ := TenantFromContext(ctx)
+	d.mu.Lock()
+	if _, ok := d.keys[key.KeyString()]; !ok && len(d.keys) >= maxDeferredProvides {
+		d.mu.Unlock()
+		return false, ErrTooManyDeferredProvides
+	}
+	d.keys[key.KeyString()] = deferredProvide{key: key, provide: provide, tenant: tenant}
+	d.mu.Unlock()
+	opLogger(ctx).Debugw("deferring provide until the dht is ready", "cid", key)
+
+	// the DHT may have become ready since we checked, in which case the flush could have missed key
+	if dht.State() == StateReady {
+		d.notify()
+	}
+	return true, nil
+}
+
+// DeferredProvides returns the number of provides waiting for the DHT to be ready, see DeferProvidesUntilReady.
+func (dht *IpfsDHT) DeferredProvides() int {
+	d := dht.provideDeferral
+	if d == nil {
+		return 0
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.keys)
+}
+
+// flushDeferredProvides provides the deferred keys every time the DHT becomes ready, until proc closes. Keys are
+// deferred again if the DHT stops being ready during the flush.
+func (dht *IpfsDHT) flushDeferredProvides(proc goprocess.Process) {
+	d := dht.provideDeferral
+	for {
+		select {
+		case <-d.flush:
+		case <-proc.Closing():
+			return
+		}
+		provides := d.take()
+		if len(provides) > 0 {
+			logger.Infow("flushing provides deferred until the dht is ready", "count", len(provides))
+		}
+		for _, p := range provides {
+			// the tenant was charged when the provide was deferred
+			ctx := context.WithValue(dht.ctx, quotaChargedKey{}, struct{}{})
+			if p.tenant != "" {
+				ctx = WithTenant(ctx, p.tenant)
+			}
+			if err := p.provide(ctx, p.key, true); err != nil {
+				logger.Debugw("failed to provide deferred key", "cid", p.key, "error", err)
+			}
+			if dht.ctx.Err() != nil {
+				return
+			}
+		}
+	}
+}
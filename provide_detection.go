@@ -0,0 +1,135 @@
+package dht
+
+import (
+	"context"
+	"errors"
+
+	"github.com/google/uuid"
+	"github.com/jbenet/goprocess"
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multihash"
+
+	detection "github.com/ssrivatsan97/go-libp2p-kad-dht/eclipse-detection"
+)
+
+// Bounds of the eclipse detections run in the background with AsyncEclipseDetection.
+const (
+	// asyncDetectionWorkers is the number of detections run concurrently.
+	asyncDetectionWorkers = 4
+	// asyncDetectionBacklog is the number of detections waiting for a worker, further ones are skipped.
+	asyncDetectionBacklog = 256
+)
+
+// ErrEclipseDetectionBacklog is the error of the eclipse detection of a provide skipped because too many detections
+// are waiting to run in the background, see AsyncEclipseDetection.
+var ErrEclipseDetectionBacklog = errors.New("too many eclipse detections waiting to run")
+
+// asyncDetection is an eclipse detection waiting to run in the background.
+type asyncDetection struct {
+	ctx   context.Context
+	key   multihash.Multihash
+	peers []peer.ID
+}
+
+// EvtEclipseDetection is emitted with the outcome of the eclipse detection run by a provide, see
+// IpfsDHT.EclipseDetectionEvents.
+type EvtEclipseDetection struct {
+	Key multihash.Multihash
+	// Operation is the correlation ID of the provide, see CorrelationID.
+	Operation uuid.UUID
+	// Attack is set if the closest peers of the key look like an eclipse attack.
+	Attack bool
+	// Err is why the detection could not run, e.g. too few peers or no network size estimate.
+	Err error
+	// Report details the detection, nil if it could not run.
+	Report *EclipseReport
+}
+
+// EclipseReport details a run of the eclipse detector on the closest peers to a key, see
+// IpfsDHT.EclipseDetectionReport.
+type EclipseReport struct {
+	Key multihash.Multihash
+	// Netsize is the network size estimate the parameters of the detector were derived from.
+	Netsize float64
+	// L is the shortest prefix length the distribution is analysed from, and Threshold the KL divergence threshold.
+	L         int
+	Threshold float64
+	// Counts is the number of peers per prefix length with the key, in the keyspace of the detector.
+	Counts []int
+	// Test is the test Attack is the verdict of, see EclipseDetectionTest.
+	Test detection.Test
+	// Posterior is the posterior of the key updated with the verdict of Test, nil without BayesianEclipseDetection.
+	Posterior *detection.Posterior
+	// Attack is the verdict of Test, or of Posterior if set.
+	Attack bool
+	// Tests are the outcomes of all the tests of the detector, in the order of detection.Tests, for comparison.
+	Tests []detection.TestResult
+}
+
+// provideDetection runs the eclipse detection on the peers a provide sent the provider record of keyMH to. Its outcome
+// is reported as an EvtEclipseDetection event, and its error is only returned with StrictEclipseDetection since the
+// provider records were sent regardless. With AsyncEclipseDetection it is handed to the background workers, see
+// runAsyncDetections, and skipped with ErrEclipseDetectionBacklog if too many detections are waiting already.
+func (dht *IpfsDHT) provideDetection(ctx context.Context, keyMH multihash.Multihash, peers []peer.ID) error {
+	if dht.strictProvideDetection {
+		return dht.runProvideDetection(ctx, keyMH, peers)
+	}
+	if !dht.asyncProvideDetection {
+		dht.runProvideDetection(ctx, keyMH, peers)
+		return nil
+	}
+	// detached from the provide, which is done by the time the detection runs
+	dctx := dht.ctx
+	if id, ok := CorrelationID(ctx); ok {
+		dctx = WithCorrelationID(dctx, id)
+	}
+	select {
+	case dht.asyncDetections <- asyncDetection{ctx: dctx, key: keyMH, peers: peers}:
+	default:
+		opLogger(ctx).Debugw("eclipse detection skipped", "key", keyMH, "error", ErrEclipseDetectionBacklog)
+		dht.emitDetection(dctx, EvtEclipseDetection{Key: keyMH, Err: ErrEclipseDetectionBacklog})
+	}
+	return nil
+}
+
+// runAsyncDetections runs the eclipse detections of provides in the background until the DHT is closed, see
+// AsyncEclipseDetection. Detections still running when the DHT is closed are canceled and waited for.
+func (dht *IpfsDHT) runAsyncDetections(proc goprocess.Process) {
+	for {
+		select {
+		case d := <-dht.asyncDetections:
+			dht.runProvideDetection(d.ctx, d.key, d.peers)
+		case <-proc.Closing():
+			return
+		}
+	}
+}
+
+func (dht *IpfsDHT) runProvideDetection(ctx context.Context, keyMH multihash.Multihash, peers []peer.ID) error {
+	report, err := dht.eclipseReportWithSampling(ctx, keyMH, peers)
+	evt := EvtEclipseDetection{Key: keyMH, Err: err, Report: report}
+	if err != nil {
+		opLogger(ctx).Debugw("eclipse detection failed", "key", keyMH, "error", err)
+	} else {
+		evt.Attack = report.Attack
+	}
+	dht.emitDetection(ctx, evt)
+	return err
+}
+
+// emitDetection emits evt as the outcome of the eclipse detection of the provide of ctx.
+func (dht *IpfsDHT) emitDetection(ctx context.Context, evt EvtEclipseDetection) {
+	evt.Operation, _ = CorrelationID(ctx)
+	if err := dht.detectionEmitter.Emit(evt); err != nil {
+		logger.Debugw("failed to emit eclipse detection", "error", err)
+	}
+}
+
+// EclipseDetectionEvents subscribes to the outcomes of the eclipse detection run by provides, delivered as
+// EvtEclipseDetection events.
+//
+// The subscription must be closed when no longer needed.
+func (dht *IpfsDHT) EclipseDetectionEvents(opts ...event.SubscriptionOpt) (event.Subscription, error) {
+	return dht.rtEvents.bus.Subscribe(new(EvtEclipseDetection), opts...)
+}
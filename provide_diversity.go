@@ -0,0 +1,63 @@
+package dht
+
+import (
+	"context"
+	"math"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	manet "github.com/multiformats/go-multiaddr/net"
+	"github.com/multiformats/go-multihash"
+)
+
+// peerGroup returns the IP group of p, see ipGroup, taken from the address we are connected to p on or, if we aren't
+// connected, from the first IP address we know for p. A single group per peer keeps peers advertising many addresses
+// from inflating the diversity of a set of peers. It returns false if no IP address of p is known.
+func (dht *IpfsDHT) peerGroup(p peer.ID) (string, bool) {
+	if groups := dht.peerIPGroups(p); len(groups) > 0 {
+		return groups[0], true
+	}
+	for _, a := range dht.peerstore.Addrs(p) {
+		if ip, err := manet.ToIP(a); err == nil {
+			return ipGroup(ip), true
+		}
+	}
+	return "", false
+}
+
+// provideTargetGroups returns the number of distinct IP groups the peers span.
+func (dht *IpfsDHT) provideTargetGroups(peers []peer.ID) int {
+	groups := make(map[string]struct{}, len(peers))
+	for _, p := range peers {
+		if g, ok := dht.peerGroup(p); ok {
+			groups[g] = struct{}{}
+		}
+	}
+	return len(groups)
+}
+
+// lacksProvideDiversity tells whether the provide targets span fewer distinct IP groups than required by
+// MinProvideTargetGroups.
+func (dht *IpfsDHT) lacksProvideDiversity(peers []peer.ID) bool {
+	return dht.minProvideTargetGroups > 0 && dht.provideTargetGroups(peers) < dht.minProvideTargetGroups
+}
+
+// wideProvideTargets returns the peers of the special provide of key, along with the number of lookups it took. It
+// returns false if they can't be enumerated, leaving the provide to the peers selected so far.
+func (dht *IpfsDHT) wideProvideTargets(ctx context.Context, key multihash.Multihash) ([]peer.ID, int, bool) {
+	netsize, err := dht.networkSize(ctx)
+	if err != nil {
+		logger.Warnw("can't escalate provide to the special strategy without a network size estimate", "error", err)
+		return nil, 0, false
+	}
+	minCPL := int(math.Ceil(math.Log2(netsize/float64(dht.getSpecialProvideNumber())))) - 1
+	peers, numLookups, err := dht.GetPeersWithCPLGet(ctx, string(key), minCPL)
+	switch err {
+	case nil:
+	case ErrCPLBudgetExceeded:
+		logger.Warnw("special provide exceeded its lookup budget", "peers", len(peers))
+	default:
+		logger.Warnw("failed to escalate provide to the special strategy", "error", err)
+		return nil, numLookups, false
+	}
+	return peers, numLookups, true
+}
@@ -0,0 +1,162 @@
+package dht
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"github.com/libp2p/go-libp2p-kad-dht/qpeerset"
+	kb "github.com/libp2p/go-libp2p-kbucket"
+)
+
+// maxProvideBatch bounds the number of keys of a partition a worker provides in a row before the dispatcher looks for
+// provides of higher priority again.
+const maxProvideBatch = 32
+
+// provideBatch is a run of due provides handed to a single worker. Without partitioning every batch holds one key.
+type provideBatch struct {
+	// partition is the keyspace partition of the keys, -1 without partitioning
+	partition int
+	keys      []ds.Key
+}
+
+// keyPartition returns the keyspace partition of c, the first partitionBits bits of its Kademlia key.
+func (q *provideQueue) keyPartition(c cid.Cid) int {
+	kadID := kb.ConvertKey(string(c.Hash()))
+	return int(binary.BigEndian.Uint16(kadID) >> (16 - q.partitionBits))
+}
+
+// batch groups the due provides, highest priority first, into the batches dispatched to the workers. With partitioning
+// the keys of a partition are batched together in priority order, and partitions a worker is busy with are skipped.
+// q.mu must be held.
+func (q *provideQueue) batch(due []queuedProvide, keys map[cid.Cid]ds.Key) []provideBatch {
+	if q.partitionBits == 0 {
+		batches := make([]provideBatch, len(due))
+		for i, qp := range due {
+			batches[i] = provideBatch{partition: -1, keys: []ds.Key{keys[qp.Cid]}}
+		}
+		return batches
+	}
+
+	var (
+		batches []provideBatch
+		index   = make(map[int]int)
+	)
+	for _, qp := range due {
+		p := q.keyPartition(qp.Cid)
+		if _, ok := q.busy[p]; ok {
+			continue
+		}
+		i, ok := index[p]
+		if !ok {
+			i = len(batches)
+			index[p] = i
+			batches = append(batches, provideBatch{partition: p})
+		}
+		if len(batches[i].keys) < maxProvideBatch {
+			batches[i].keys = append(batches[i].keys, keys[qp.Cid])
+		}
+	}
+	return batches
+}
+
+// processBatch provides the keys of b one after the other. The lookups of a partition start from the closest peers
+// found by the previous lookup in the partition, reusing the routing path and connections of its region.
+func (q *provideQueue) processBatch(ctx context.Context, b provideBatch, limiter <-chan time.Time, closing <-chan struct{}) {
+	if b.partition >= 0 {
+		q.mu.Lock()
+		w := q.warm[b.partition]
+		if w == nil {
+			w = new(warmPath)
+			q.warm[b.partition] = w
+		}
+		q.mu.Unlock()
+		ctx = withWarmPath(ctx, w)
+
+		defer func() {
+			q.mu.Lock()
+			delete(q.busy, b.partition)
+			q.mu.Unlock()
+			// the remaining due keys of the partition were skipped meanwhile
+			q.notify()
+		}()
+	}
+
+	for i, k := range b.keys {
+		if i > 0 && !q.waitNext(limiter, closing) {
+			// stopping, the remaining keys are provided after the next start
+			q.mu.Lock()
+			for _, k := range b.keys[i:] {
+				delete(q.inflight, k)
+			}
+			q.mu.Unlock()
+			return
+		}
+		q.process(ctx, k)
+	}
+}
+
+// waitNext waits for the rate limiter, if any, before the next provide of a batch. It returns false if the queue
+// stops first.
+func (q *provideQueue) waitNext(limiter <-chan time.Time, closing <-chan struct{}) bool {
+	select {
+	case <-closing:
+		return false
+	default:
+	}
+	if limiter == nil {
+		return true
+	}
+	select {
+	case <-limiter:
+		return true
+	case <-closing:
+		return false
+	}
+}
+
+type warmPathKey struct{}
+
+// warmPath holds the closest peers found by the last lookup of a keyspace partition of the provide queue.
+type warmPath struct {
+	mu    sync.Mutex
+	peers []peer.ID
+}
+
+// withWarmPath makes the lookups run with the returned context start from the peers of w in addition to the closest
+// peers of our routing table, and remember the closest peers they found in w.
+func withWarmPath(ctx context.Context, w *warmPath) context.Context {
+	return context.WithValue(ctx, warmPathKey{}, w)
+}
+
+func warmPathFrom(ctx context.Context) *warmPath {
+	w, _ := ctx.Value(warmPathKey{}).(*warmPath)
+	return w
+}
+
+func (w *warmPath) seeds() []peer.ID {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]peer.ID(nil), w.peers...)
+}
+
+// update remembers the closest peers of res that answered the lookup.
+func (w *warmPath) update(res *lookupWithFollowupResult) {
+	peers := make([]peer.ID, 0, len(res.peers))
+	for i, p := range res.peers {
+		if res.state[i] == qpeerset.PeerQueried {
+			peers = append(peers, p)
+		}
+	}
+	if len(peers) == 0 {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.peers = peers
+}
@@ -0,0 +1,461 @@
+package dht
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	"github.com/jbenet/goprocess"
+	"github.com/libp2p/go-libp2p/core/routing"
+	"github.com/multiformats/go-base32"
+	"github.com/multiformats/go-multihash"
+
+	"github.com/libp2p/go-libp2p-kad-dht/internal"
+)
+
+// provideQueuePrefix is the datastore namespace queued provides are persisted under.
+const provideQueuePrefix = "/provide-queue/"
+
+// maxProvideQueueBackoff caps the backoff between attempts of a queued provide.
+const maxProvideQueueBackoff = time.Hour
+
+// ProvidePriority orders the provide queue: due provides of higher priority are started first.
+type ProvidePriority int
+
+const (
+	// ProvidePriorityRoutine is the priority of routine provides and reprovides.
+	ProvidePriorityRoutine ProvidePriority = 0
+	// ProvidePriorityAttacked is the priority of keys an attack was detected on, which need to be provided again
+	// widely before routine provides.
+	ProvidePriorityAttacked ProvidePriority = 10
+)
+
+// queuedProvide is a queued provide as persisted in the datastore.
+type queuedProvide struct {
+	Cid         cid.Cid
+	Priority    ProvidePriority `json:",omitempty"`
+	Attempts    int             `json:",omitempty"`
+	NextAttempt time.Time       `json:",omitempty"`
+	LastError   string          `json:",omitempty"`
+	// Tenant is the tenant that enqueued the provide, charged for it when it is processed.
+	Tenant string `json:",omitempty"`
+}
+
+func provideQueueDsKey(c cid.Cid) ds.Key {
+	return ds.NewKey(provideQueuePrefix + base32.RawStdEncoding.EncodeToString(c.Bytes()))
+}
+
+// provideQueue provides enqueued keys in the background. The queue lives in the datastore so that it survives
+// restarts; the in-memory state only tracks which keys are being provided.
+type provideQueue struct {
+	dht *IpfsDHT
+
+	interval    time.Duration
+	maxAttempts int
+	backoff     time.Duration
+
+	// provide is IpfsDHT.Provide, replaceable by tests
+	provide func(ctx context.Context, key cid.Cid, brdcst bool) error
+
+	wake chan struct{}
+
+	// workers is the maximum number of concurrent provides, running the number of provides running, freed is
+	// notified when a provide finishes or workers changes
+	workers, running int32
+	freed            chan struct{}
+
+	// partitionBits is the number of leading bits of the Kademlia key partitioning the queued keys, 0 without
+	// partitioning, see PartitionProvideQueue
+	partitionBits int
+
+	// queueProvides makes Provide enqueue keys instead of providing them, see QueueProvides
+	queueProvides bool
+
+	mu       sync.Mutex
+	inflight map[ds.Key]struct{}
+	// busy holds the partitions a worker is providing keys of, warm the routing paths of the partitions
+	busy map[int]struct{}
+	warm map[int]*warmPath
+
+	// stop stops the dispatch of provides, stopped is closed once the provides dispatched finished, see Shutdown
+	stop     chan struct{}
+	stopOnce sync.Once
+	stopped  chan struct{}
+}
+
+func newProvideQueue(dht *IpfsDHT, workers int, rate float64, maxAttempts int, backoff time.Duration, partitionBits int) *provideQueue {
+	q := &provideQueue{
+		dht:           dht,
+		workers:       int32(workers),
+		maxAttempts:   maxAttempts,
+		backoff:       backoff,
+		partitionBits: partitionBits,
+		provide:       dht.Provide,
+		wake:          make(chan struct{}, 1),
+		freed:         make(chan struct{}, 1),
+		inflight:      make(map[ds.Key]struct{}),
+		busy:          make(map[int]struct{}),
+		warm:          make(map[int]*warmPath),
+		stop:          make(chan struct{}),
+		stopped:       make(chan struct{}),
+	}
+	if rate > 0 {
+		q.interval = time.Duration(float64(time.Second) / rate)
+	}
+	return q
+}
+
+// queuedProvideKey marks the contexts of the provides run by the provide queue, which must not be enqueued again.
+type queuedProvideKey struct{}
+
+// isQueuedProvide returns true if ctx is the context of a provide run by the provide queue.
+func isQueuedProvide(ctx context.Context) bool {
+	return ctx.Value(queuedProvideKey{}) != nil
+}
+
+// queuesProvide returns true if Provide should enqueue the provide of ctx instead of running it, see QueueProvides.
+func (dht *IpfsDHT) queuesProvide(ctx context.Context) bool {
+	return dht.provideQueue != nil && dht.provideQueue.queueProvides && !isQueuedProvide(ctx)
+}
+
+// EnqueueProvide queues key to be provided in the background and returns as soon as it is persisted. Failed provides
+// are retried with backoff, and queued keys survive restarts of the DHT as long as the datastore does. Enqueuing a key
+// that is already queued resets its retries and keeps the higher of both priorities.
+//
+// The queue must be enabled with EnableProvideQueue, otherwise routing.ErrNotSupported is returned.
+func (dht *IpfsDHT) EnqueueProvide(ctx context.Context, key cid.Cid, priority ProvidePriority) error {
+	if dht.provideQueue == nil || !dht.enableProviders {
+		return routing.ErrNotSupported
+	}
+	if !key.Defined() {
+		return fmt.Errorf("invalid cid: undefined")
+	}
+	if !dht.providersEnabled(key.Hash()) {
+		return routing.ErrNotSupported
+	}
+
+	dsKey := provideQueueDsKey(key)
+	qp := &queuedProvide{Cid: key, Priority: priority}
+	qp.Tenant, _ = TenantFromContext(ctx)
+	if b, err := dht.datastore.Get(ctx, dsKey); err == nil {
+		var queued queuedProvide
+		if json.Unmarshal(b, &queued) == nil && queued.Priority > priority {
+			qp.Priority = queued.Priority
+		}
+	} else if err != ds.ErrNotFound {
+		return err
+	}
+
+	b, err := json.Marshal(qp)
+	if err != nil {
+		return err
+	}
+	if err := dht.datastore.Put(ctx, dsKey, b); err != nil {
+		return err
+	}
+	dht.provideQueue.notify()
+	return nil
+}
+
+// reprovideAttacked queues a provide of key with ProvidePriorityAttacked if an attack was detected on key and this
+// node provides it, so that the provider record is spread again ahead of routine provides.
+func (dht *IpfsDHT) reprovideAttacked(ctx context.Context, key string) {
+	if dht.provideQueue == nil {
+		return
+	}
+	mh, err := multihash.Cast([]byte(key))
+	if err != nil {
+		return
+	}
+	provs, err := dht.providerStore.GetProviders(ctx, mh)
+	if err != nil {
+		return
+	}
+	for _, p := range provs {
+		if p.ID != dht.self {
+			continue
+		}
+		if err := dht.EnqueueProvide(ctx, cid.NewCidV1(cid.Raw, mh), ProvidePriorityAttacked); err != nil {
+			logger.Warnw("failed to queue reprovide of attacked key", "key", internal.LoggableProviderRecordBytes(key), "error", err)
+		}
+		return
+	}
+}
+
+// PendingProvides returns the number of keys in the provide queue, including those being provided.
+func (dht *IpfsDHT) PendingProvides(ctx context.Context) (int, error) {
+	if dht.provideQueue == nil {
+		return 0, routing.ErrNotSupported
+	}
+	res, err := dht.datastore.Query(ctx, dsq.Query{Prefix: provideQueuePrefix, KeysOnly: true})
+	if err != nil {
+		return 0, err
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return 0, err
+	}
+	return len(entries), nil
+}
+
+// release frees the worker of a provide.
+func (q *provideQueue) release() {
+	atomic.AddInt32(&q.running, -1)
+	select {
+	case q.freed <- struct{}{}:
+	default:
+	}
+}
+
+// setWorkers changes the maximum number of concurrent provides. Provides running beyond a lowered maximum finish.
+func (q *provideQueue) setWorkers(workers int) {
+	atomic.StoreInt32(&q.workers, int32(workers))
+	select {
+	case q.freed <- struct{}{}:
+	default:
+	}
+}
+
+func (q *provideQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// stopDispatch makes run stop dispatching provides. The provides already dispatched run to completion.
+func (q *provideQueue) stopDispatch() {
+	q.stopOnce.Do(func() { close(q.stop) })
+}
+
+// run dispatches the due provides to at most workers concurrent workers until proc closes or stopDispatch is called.
+// A provide is only picked once a worker is free, so that provides queued meanwhile with a higher priority are started
+// first. With partitioning, workers are handed batches of keys of a single partition instead, see processBatch.
+func (q *provideQueue) run(proc goprocess.Process) {
+	defer close(q.stopped)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	closing := make(chan struct{})
+	go func() {
+		defer close(closing)
+		select {
+		case <-proc.Closing():
+		case <-q.stop:
+		}
+	}()
+
+	var limiter <-chan time.Time
+	if q.interval > 0 {
+		ticker := q.dht.clock.Ticker(q.interval)
+		defer ticker.Stop()
+		limiter = ticker.C
+	}
+
+	timer := q.dht.clock.Timer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-q.wake:
+		case <-closing:
+			return
+		}
+
+		due, next := q.due(q.dht.ctx)
+	dispatch:
+		for _, b := range due {
+			for atomic.LoadInt32(&q.running) >= atomic.LoadInt32(&q.workers) {
+				select {
+				case <-q.freed:
+				case <-closing:
+					return
+				}
+			}
+			atomic.AddInt32(&q.running, 1)
+			if limiter != nil {
+				select {
+				case <-limiter:
+				case <-closing:
+					return
+				}
+			}
+			select {
+			case <-q.wake:
+				// new provides may have a higher priority than the remaining ones, look again
+				q.release()
+				next = q.dht.clock.Now()
+				break dispatch
+			default:
+			}
+
+			q.mu.Lock()
+			for _, k := range b.keys {
+				q.inflight[k] = struct{}{}
+			}
+			if b.partition >= 0 {
+				q.busy[b.partition] = struct{}{}
+			}
+			q.mu.Unlock()
+			wg.Add(1)
+			go func(b provideBatch) {
+				defer wg.Done()
+				defer q.release()
+				q.processBatch(q.dht.ctx, b, limiter, closing)
+			}(b)
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		if !next.IsZero() {
+			timer.Reset(q.dht.clock.Until(next))
+		}
+	}
+}
+
+// due returns the batches of queued provides that are due and not being provided, highest priority first, and when
+// the next one is due, if any.
+func (q *provideQueue) due(ctx context.Context) ([]provideBatch, time.Time) {
+	res, err := q.dht.datastore.Query(ctx, dsq.Query{Prefix: provideQueuePrefix})
+	if err != nil {
+		logger.Warnw("failed to query provide queue", "error", err)
+		return nil, time.Time{}
+	}
+	defer res.Close()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := q.dht.clock.Now()
+	var (
+		due  []queuedProvide
+		keys = make(map[cid.Cid]ds.Key)
+		next time.Time
+	)
+	for e := range res.Next() {
+		if e.Error != nil {
+			logger.Warnw("failed to read provide queue", "error", e.Error)
+			break
+		}
+		k := ds.RawKey(e.Key)
+		if _, ok := q.inflight[k]; ok {
+			continue
+		}
+		var qp queuedProvide
+		if err := json.Unmarshal(e.Value, &qp); err != nil {
+			logger.Warnw("dropping corrupt provide queue entry", "key", e.Key, "error", err)
+			if err := q.dht.datastore.Delete(ctx, k); err != nil {
+				logger.Debugw("failed to delete provide queue entry", "error", err)
+			}
+			continue
+		}
+		if qp.NextAttempt.After(now) {
+			if next.IsZero() || qp.NextAttempt.Before(next) {
+				next = qp.NextAttempt
+			}
+			continue
+		}
+		due = append(due, qp)
+		keys[qp.Cid] = k
+	}
+
+	sort.SliceStable(due, func(i, j int) bool {
+		if due[i].Priority != due[j].Priority {
+			return due[i].Priority > due[j].Priority
+		}
+		return due[i].NextAttempt.Before(due[j].NextAttempt)
+	})
+	return q.batch(due, keys), next
+}
+
+// process provides the queued key k and removes it from the queue, or schedules a retry if the provide failed.
+func (q *provideQueue) process(ctx context.Context, k ds.Key) {
+	defer func() {
+		q.mu.Lock()
+		delete(q.inflight, k)
+		q.mu.Unlock()
+	}()
+
+	b, err := q.dht.datastore.Get(ctx, k)
+	if err == ds.ErrNotFound {
+		return
+	} else if err != nil {
+		logger.Warnw("failed to read provide queue entry", "key", k, "error", err)
+		return
+	}
+	var qp queuedProvide
+	if err := json.Unmarshal(b, &qp); err != nil {
+		return
+	}
+
+	pctx := context.WithValue(ctx, queuedProvideKey{}, struct{}{})
+	if qp.Tenant != "" {
+		pctx = WithTenant(pctx, qp.Tenant)
+	}
+	err = q.provide(pctx, qp.Cid, true)
+	if ctx.Err() != nil || errors.Is(err, ErrShuttingDown) {
+		// shutting down, the key is provided after the next start
+		return
+	}
+	var perr *PartialProvideError
+	if err == nil || errors.As(err, &perr) && perr.Succeeded > 0 {
+		// the key might have been enqueued again meanwhile, that's fine as it was just provided
+		if err := q.dht.datastore.Delete(ctx, k); err != nil {
+			logger.Warnw("failed to dequeue provide", "cid", qp.Cid, "error", err)
+		}
+		return
+	}
+
+	var qerr *QuotaExceededError
+	if errors.As(err, &qerr) {
+		// the tenant is out of quota, this isn't a failed attempt
+		qp.NextAttempt = q.dht.clock.Now().Add(q.backoff)
+		q.reschedule(ctx, k, &qp)
+		return
+	}
+
+	qp.Attempts++
+	if qp.Attempts >= q.maxAttempts {
+		logger.Warnw("giving up queued provide", "cid", qp.Cid, "attempts", qp.Attempts, "error", err)
+		if err := q.dht.datastore.Delete(ctx, k); err != nil {
+			logger.Warnw("failed to dequeue provide", "cid", qp.Cid, "error", err)
+		}
+		return
+	}
+	backoff := q.backoff
+	for i := 1; i < qp.Attempts && backoff < maxProvideQueueBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxProvideQueueBackoff {
+		backoff = maxProvideQueueBackoff
+	}
+	logger.Debugw("queued provide failed, retrying", "cid", qp.Cid, "attempts", qp.Attempts, "backoff", backoff, "error", err)
+	qp.NextAttempt = q.dht.clock.Now().Add(backoff)
+	qp.LastError = err.Error()
+	q.reschedule(ctx, k, &qp)
+}
+
+// reschedule persists the next attempt of qp.
+func (q *provideQueue) reschedule(ctx context.Context, k ds.Key, qp *queuedProvide) {
+	b, err := json.Marshal(qp)
+	if err == nil {
+		err = q.dht.datastore.Put(ctx, k, b)
+	}
+	if err != nil {
+		logger.Warnw("failed to reschedule queued provide", "cid", qp.Cid, "error", err)
+	}
+	// wake the dispatcher so that it picks up the new attempt time
+	q.notify()
+}
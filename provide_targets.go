@@ -0,0 +1,368 @@
+package dht
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	"github.com/jbenet/goprocess"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/routing"
+	"github.com/multiformats/go-base32"
+	"github.com/multiformats/go-multihash"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+
+	"github.com/libp2p/go-libp2p-kad-dht/internal"
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+)
+
+// provideTargetsPrefix is the datastore namespace provide targets are persisted under.
+const provideTargetsPrefix = "/provide-targets/"
+
+// provideTargetsGCInterval is how often expired provide targets are removed from the datastore.
+const provideTargetsGCInterval = time.Hour
+
+// Provide strategies, selecting the peers a provider record is sent to.
+const (
+	// ProvideStrategyRegular sends the provider record to the closest peers to the key.
+	ProvideStrategyRegular = "regular"
+	// ProvideStrategySpecial sends the provider record to all peers in the keyspace region around the key expected to
+	// contain specialProvideNumber peers.
+	ProvideStrategySpecial = "special"
+	// ProvideStrategyChurn sends the provider record to the peers that joined the closest peers to the key since it was
+	// provided, see ReprovideOnChurn.
+	ProvideStrategyChurn = "churn"
+)
+
+// Outcomes of a provide, as reported in the provide metrics.
+const (
+	provideSuccess = "success"
+	providePartial = "partial"
+	provideFailure = "failure"
+	// provideNoTargets is a provide that found no peer to send the provider record to
+	provideNoTargets = "no_targets"
+)
+
+// ProvideTargets records which peers were sent a provider record by the last provide of a key, so that the record
+// can later be verified on exactly those peers.
+type ProvideTargets struct {
+	// Key is the provided multihash.
+	Key multihash.Multihash
+	// Time is when the provider record was sent.
+	Time time.Time
+	// Strategy is the provide strategy that selected the peers, ProvideStrategyRegular or ProvideStrategySpecial.
+	// The peers the record was sent to later by ProvideStrategyChurn are added to those of the provide.
+	Strategy string `json:",omitempty"`
+	// Peers are the peers that accepted the provider record.
+	Peers []peer.ID
+	// Failed are the peers that the provider record could not be sent to.
+	Failed []peer.ID `json:",omitempty"`
+}
+
+func provideTargetsDsKey(key multihash.Multihash) ds.Key {
+	return ds.NewKey(provideTargetsPrefix + base32.RawStdEncoding.EncodeToString(key))
+}
+
+// PartialProvideError is returned by a provide when the provider record could not be sent to some of the peers it
+// was meant for. The record was stored with the remaining peers, callers can decide whether that is enough, retry, or
+// provide more widely. Callers that accept a partial provide check Succeeded:
+//
+//	var perr *PartialProvideError
+//	if errors.As(err, &perr) && perr.Succeeded > 0 {
+//		// stored with some of the peers
+//	}
+type PartialProvideError struct {
+	// Key is the provided multihash.
+	Key multihash.Multihash
+	// Failed maps the peers the provider record could not be sent to to the reason.
+	Failed map[peer.ID]error
+	// Succeeded is the number of peers that accepted the provider record.
+	Succeeded int
+}
+
+func (e *PartialProvideError) Error() string {
+	return fmt.Sprintf("provider record could not be sent to %d of %d peers", len(e.Failed), len(e.Failed)+e.Succeeded)
+}
+
+// provideResult returns a PartialProvideError if sending the provider record for key to some of peers failed.
+func provideResult(key multihash.Multihash, peers []peer.ID, failed map[peer.ID]error) error {
+	if len(failed) == 0 {
+		return nil
+	}
+	return &PartialProvideError{Key: key, Failed: failed, Succeeded: len(peers) - len(failed)}
+}
+
+// sendProviderRecords sends the provider record for key to all peers selected by strategy, returning the error for
+// every peer it failed for. The provide, started at start, is reported to the provide metrics and, if recording provide
+// targets is enabled, its outcome is persisted.
+func (dht *IpfsDHT) sendProviderRecords(ctx context.Context, key multihash.Multihash, strategy string, start time.Time, peers []peer.ID) map[peer.ID]error {
+	self := peer.AddrInfo{ID: dht.self, Addrs: dht.providerAddrs()}
+	return dht.putProviderRecords(ctx, key, strategy, start, peers, func(ctx context.Context, p peer.ID) error {
+		return dht.protoMessenger.PutProviderAddrs(ctx, p, key, self)
+	})
+}
+
+// putProviderRecords is sendProviderRecords with put sending the provider record to a single peer. It returns as soon
+// as ctx is canceled, without waiting for the puts in flight, which fail with the error of ctx.
+func (dht *IpfsDHT) putProviderRecords(ctx context.Context, key multihash.Multihash, strategy string, start time.Time, peers []peer.ID,
+	put func(ctx context.Context, p peer.ID) error) map[peer.ID]error {
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		finished = make(map[peer.ID]error, len(peers))
+	)
+	for _, p := range peers {
+		wg.Add(1)
+		go func(p peer.ID) {
+			defer wg.Done()
+			logger.Debugf("putProvider(%s, %s)", internal.LoggableProviderRecordBytes(key), p)
+			err := put(ctx, p)
+			if err != nil {
+				logger.Debug(err)
+				if ctx.Err() == nil {
+					dht.regionCache.invalidatePeer(p)
+					dht.closestCache.invalidatePeer(p)
+				}
+			}
+			mu.Lock()
+			finished[p] = err
+			mu.Unlock()
+		}(p)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+
+	// the puts still in flight may finish meanwhile, take a snapshot
+	failed := make(map[peer.ID]error)
+	mu.Lock()
+	for _, p := range peers {
+		err, ok := finished[p]
+		if !ok {
+			err = ctx.Err()
+		}
+		if err != nil {
+			failed[p] = err
+		}
+	}
+	mu.Unlock()
+	dht.recordProvide(strategy, start, len(peers), len(failed))
+	if dht.churnReprovider != nil {
+		dht.churnReprovider.track(key, strategy, peers, failed, dht.clock.Now())
+	}
+	if dht.vantages != nil && len(failed) < len(peers) {
+		dht.vantages.schedule(dht, key)
+	}
+
+	if dht.provideTargetsRetention > 0 {
+		t := &ProvideTargets{Key: key, Time: dht.clock.Now(), Strategy: strategy}
+		for _, p := range peers {
+			if _, ok := failed[p]; ok {
+				t.Failed = append(t.Failed, p)
+			} else {
+				t.Peers = append(t.Peers, p)
+			}
+		}
+		if strategy == ProvideStrategyChurn {
+			prev, err := dht.GetProvideTargets(ctx, key)
+			if err != nil {
+				return failed
+			}
+			t.Time, t.Strategy = prev.Time, prev.Strategy
+			t.Peers, t.Failed = append(prev.Peers, t.Peers...), append(prev.Failed, t.Failed...)
+		}
+		if err := dht.putProvideTargets(ctx, t); err != nil {
+			logger.Warnw("failed to record provide targets", "key", internal.LoggableProviderRecordBytes(key), "error", err)
+		}
+	}
+	return failed
+}
+
+// lockProvides waits until no other provide runs, or until ctx is canceled.
+func (dht *IpfsDHT) lockProvides(ctx context.Context) error {
+	select {
+	case dht.providerLk <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (dht *IpfsDHT) unlockProvides() {
+	<-dht.providerLk
+}
+
+// recordProvide reports a provide to the provide metrics.
+func (dht *IpfsDHT) recordProvide(strategy string, start time.Time, peers, failed int) {
+	outcome := provideSuccess
+	switch {
+	case peers == 0:
+		outcome = provideNoTargets
+	case failed == peers:
+		outcome = provideFailure
+	case failed > 0:
+		outcome = providePartial
+	}
+	ctx := dht.newContextWithLocalTags(context.Background(),
+		tag.Upsert(metrics.KeyProvideStrategy, strategy),
+		tag.Upsert(metrics.KeyProvideOutcome, outcome),
+	)
+	stats.Record(ctx,
+		metrics.ProvideLatency.M(float64(time.Since(start))/float64(time.Millisecond)),
+		metrics.ProvidePeers.M(int64(peers-failed)),
+		metrics.ProvideFailedPeers.M(int64(failed)),
+	)
+}
+
+func (dht *IpfsDHT) putProvideTargets(ctx context.Context, t *ProvideTargets) error {
+	b, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return dht.datastore.Put(ctx, provideTargetsDsKey(t.Key), b)
+}
+
+// GetProvideTargets returns the peers the provider record for key was last sent to. It returns routing.ErrNotFound if
+// key was not provided within the retention window configured with RecordProvideTargets.
+func (dht *IpfsDHT) GetProvideTargets(ctx context.Context, key multihash.Multihash) (*ProvideTargets, error) {
+	if dht.provideTargetsRetention <= 0 {
+		return nil, routing.ErrNotSupported
+	}
+
+	dsKey := provideTargetsDsKey(key)
+	b, err := dht.datastore.Get(ctx, dsKey)
+	if err == ds.ErrNotFound {
+		return nil, routing.ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	t := new(ProvideTargets)
+	if err := json.Unmarshal(b, t); err != nil {
+		return nil, err
+	}
+	if dht.clock.Since(t.Time) > dht.provideTargetsRetention {
+		if err := dht.datastore.Delete(ctx, dsKey); err != nil {
+			logger.Debugw("failed to delete expired provide targets", "error", err)
+		}
+		return nil, routing.ErrNotFound
+	}
+	return t, nil
+}
+
+// provideTargetsGC periodically removes provide targets older than the retention window.
+func (dht *IpfsDHT) provideTargetsGC(proc goprocess.Process) {
+	ticker := dht.clock.Ticker(provideTargetsGCInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			dht.gcProvideTargets(dht.ctx)
+		case <-proc.Closing():
+			return
+		}
+	}
+}
+
+func (dht *IpfsDHT) gcProvideTargets(ctx context.Context) {
+	res, err := dht.datastore.Query(ctx, dsq.Query{Prefix: provideTargetsPrefix})
+	if err != nil {
+		logger.Warnw("failed to query provide targets", "error", err)
+		return
+	}
+	defer res.Close()
+
+	for e := range res.Next() {
+		if e.Error != nil {
+			logger.Warnw("failed to read provide targets", "error", e.Error)
+			return
+		}
+		var t ProvideTargets
+		if err := json.Unmarshal(e.Value, &t); err == nil && dht.clock.Since(t.Time) <= dht.provideTargetsRetention {
+			continue
+		}
+		if err := dht.datastore.Delete(ctx, ds.RawKey(e.Key)); err != nil {
+			logger.Warnw("failed to delete provide targets", "error", err)
+		}
+	}
+}
+
+// ProvideVerification is the outcome of VerifyProvide.
+type ProvideVerification struct {
+	// Strategy is the provide strategy that selected the verified peers.
+	Strategy string
+	// Retrievable are the peers that returned this node as a provider of the key.
+	Retrievable []peer.ID
+	// Missing are the peers that did not return this node as a provider, or could not be asked.
+	Missing []peer.ID
+}
+
+// Retrievability is the fraction of the verified peers that return the provider record.
+func (v *ProvideVerification) Retrievability() float64 {
+	n := len(v.Retrievable) + len(v.Missing)
+	if n == 0 {
+		return 0
+	}
+	return float64(len(v.Retrievable)) / float64(n)
+}
+
+// VerifyProvide asks every peer the provider record for key was last sent to, as recorded with RecordProvideTargets,
+// whether it returns this node as a provider of key. The retrievability is reported to the provide metrics per
+// provide strategy, allowing the strategies to be compared.
+func (dht *IpfsDHT) VerifyProvide(ctx context.Context, key multihash.Multihash) (*ProvideVerification, error) {
+	t, err := dht.GetProvideTargets(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		wg  sync.WaitGroup
+		mu  sync.Mutex
+		res = &ProvideVerification{Strategy: t.Strategy}
+	)
+	for _, p := range t.Peers {
+		wg.Add(1)
+		go func(p peer.ID) {
+			defer wg.Done()
+			provs, _, err := dht.protoMessenger.GetProviders(ctx, p, key)
+			found := false
+			if err == nil {
+				for _, prov := range provs {
+					if prov.ID == dht.self {
+						found = true
+						break
+					}
+				}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if found {
+				res.Retrievable = append(res.Retrievable, p)
+			} else {
+				res.Missing = append(res.Missing, p)
+			}
+		}(p)
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if t.Strategy != "" {
+		stats.Record(dht.newContextWithLocalTags(ctx, tag.Upsert(metrics.KeyProvideStrategy, t.Strategy)),
+			metrics.ProvideRetrievability.M(res.Retrievability()))
+	}
+	return res, nil
+}
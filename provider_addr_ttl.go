@@ -0,0 +1,159 @@
+package dht
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jbenet/goprocess"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// maxProviderClaims bounds the number of providers whose addresses are tracked, see providerAddrBook.
+const maxProviderClaims = 4096
+
+// providerAddrBook applies the TTL policy of the provider addresses claimed by third parties, see ProviderAddrTTL.
+type providerAddrBook struct {
+	unverified, verified time.Duration
+
+	mu sync.Mutex
+	// claims are the providers whose addresses were claimed by third parties
+	claims map[peer.ID]*providerClaim
+}
+
+type providerClaim struct {
+	// last is when the addresses of the provider were last claimed
+	last time.Time
+	// verified is set once we were connected to the provider
+	verified bool
+}
+
+func newProviderAddrBook(unverified, verified time.Duration) *providerAddrBook {
+	return &providerAddrBook{
+		unverified: unverified,
+		verified:   verified,
+		claims:     make(map[peer.ID]*providerClaim),
+	}
+}
+
+// ttl returns how long the claimed addresses of the provider are kept.
+func (b *providerAddrBook) ttl(c *providerClaim) time.Duration {
+	if c != nil && c.verified {
+		return b.verified
+	}
+	return b.unverified
+}
+
+// addProviderAddrs adds the addresses of a provider learned from a provider record or resolution, i.e. claimed by a
+// third party, to the peerstore.
+func (dht *IpfsDHT) addProviderAddrs(p peer.ID, addrs []ma.Multiaddr) {
+	b := dht.providerAddrBook
+	if b == nil {
+		dht.maybeAddAddrs(p, addrs, peerstore.TempAddrTTL)
+		return
+	}
+	if p == dht.self || len(addrs) == 0 {
+		return
+	}
+	connected := dht.host.Network().Connectedness(p) == network.Connected
+
+	now := dht.clock.Now()
+	b.mu.Lock()
+	c, ok := b.claims[p]
+	if !ok {
+		if len(b.claims) >= maxProviderClaims {
+			b.expire(now)
+		}
+		if len(b.claims) < maxProviderClaims {
+			c = new(providerClaim)
+			b.claims[p] = c
+		}
+	}
+	if c != nil {
+		c.last = now
+		c.verified = c.verified || connected
+	}
+	ttl := b.ttl(c)
+	b.mu.Unlock()
+
+	dht.maybeAddAddrs(p, addrs, ttl)
+}
+
+// providerConnected marks a provider whose addresses were claimed as verified once we are connected to it.
+func (dht *IpfsDHT) providerConnected(p peer.ID) {
+	b := dht.providerAddrBook
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	if c, ok := b.claims[p]; ok {
+		c.verified = true
+	}
+	b.mu.Unlock()
+}
+
+// providerDisconnected keeps the addresses of a verified provider we got disconnected from for the verified TTL.
+// Identify lowers the TTL of the addresses of disconnected peers from ConnectedAddrTTL to RecentlyConnectedAddrTTL,
+// concurrently with us, so both are raised.
+func (dht *IpfsDHT) providerDisconnected(p peer.ID) {
+	b := dht.providerAddrBook
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	c, ok := b.claims[p]
+	verified := ok && c.verified
+	b.mu.Unlock()
+	if !verified || b.verified <= peerstore.RecentlyConnectedAddrTTL {
+		return
+	}
+	dht.peerstore.UpdateAddrs(p, peerstore.ConnectedAddrTTL, b.verified)
+	dht.peerstore.UpdateAddrs(p, peerstore.RecentlyConnectedAddrTTL, b.verified)
+}
+
+// expire drops the claims older than their TTL and returns the unverified ones. b.mu must be held.
+func (b *providerAddrBook) expire(now time.Time) []peer.ID {
+	var unverified []peer.ID
+	for p, c := range b.claims {
+		if now.Sub(c.last) < b.ttl(c) {
+			continue
+		}
+		delete(b.claims, p)
+		if !c.verified {
+			unverified = append(unverified, p)
+		}
+	}
+	return unverified
+}
+
+// gcProviderAddrs drops the expired claims, and clears the addresses of the providers that were never verified and
+// that we have no other use for, in case their addresses were kept alive past the unverified TTL.
+func (dht *IpfsDHT) gcProviderAddrs() {
+	b := dht.providerAddrBook
+	b.mu.Lock()
+	unverified := b.expire(dht.clock.Now())
+	b.mu.Unlock()
+
+	for _, p := range unverified {
+		if dht.host.Network().Connectedness(p) == network.Connected || dht.routingTable.Find(p) != "" {
+			continue
+		}
+		dht.peerstore.ClearAddrs(p)
+	}
+}
+
+// providerAddrsGC collects the expired claims every unverified TTL until proc closes.
+func (dht *IpfsDHT) providerAddrsGC(proc goprocess.Process) {
+	ticker := dht.clock.Ticker(dht.providerAddrBook.unverified)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			dht.gcProviderAddrs()
+		case <-proc.Closing():
+			return
+		}
+	}
+}
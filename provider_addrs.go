@@ -0,0 +1,62 @@
+package dht
+
+import (
+	"sync/atomic"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// setReachability records our reachability as reported by the host.
+func (dht *IpfsDHT) setReachability(r network.Reachability) {
+	atomic.StoreInt32(&dht.reachability, int32(r))
+}
+
+// providerAddrs returns the addresses to publish in our provider records, see ProviderAddrs.
+func (dht *IpfsDHT) providerAddrs() []ma.Multiaddr {
+	r := network.Reachability(atomic.LoadInt32(&dht.reachability))
+	return selectProviderAddrs(dht.providerAddrPolicy, r, dht.host.Addrs())
+}
+
+// selectProviderAddrs selects the addresses of addrs to publish in provider records under policy given our
+// reachability r. Under ProviderAddrsReachability, all addresses are published if none of the preferred ones are
+// available, so that a provider is never left without addresses.
+func selectProviderAddrs(policy ProviderAddrPolicy, r network.Reachability, addrs []ma.Multiaddr) []ma.Multiaddr {
+	if policy == ProviderAddrsAll {
+		return addrs
+	}
+
+	var relay, public, private []ma.Multiaddr
+	for _, a := range addrs {
+		switch {
+		case isRelayAddr(a):
+			relay = append(relay, a)
+		case manet.IsPublicAddr(a):
+			public = append(public, a)
+		default:
+			private = append(private, a)
+		}
+	}
+	if policy == ProviderAddrsDirectOnly {
+		return append(public, private...)
+	}
+
+	var selected []ma.Multiaddr
+	switch r {
+	case network.ReachabilityPrivate:
+		// peers reach us through our relays, and may hole punch to our public addresses from there
+		selected = append(relay, public...)
+	case network.ReachabilityPublic:
+		selected = public
+	default:
+		selected = public
+		if len(selected) == 0 {
+			selected = relay
+		}
+	}
+	if len(selected) == 0 {
+		return addrs
+	}
+	return selected
+}
@@ -0,0 +1,149 @@
+package dht
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	"github.com/jbenet/goprocess"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/routing"
+	"github.com/multiformats/go-base32"
+	"github.com/multiformats/go-multihash"
+)
+
+// providerAuditPrefix is the datastore namespace the provider audit trail is persisted under.
+const providerAuditPrefix = "/provider-audit/"
+
+// providerAuditGCInterval is how often expired audit entries are removed from the datastore.
+const providerAuditGCInterval = time.Hour
+
+// ProviderAuditEntry records which peer submitted a provider record to this node, see RecordProviderAudit.
+type ProviderAuditEntry struct {
+	// Key is the multihash the provider record is for.
+	Key multihash.Multihash
+	// Provider is the peer the provider record announces.
+	Provider peer.ID
+	// Submitter is the peer that sent the provider record, the provider itself unless it provided through a delegate.
+	Submitter peer.ID
+	// FirstSeen and LastSeen are when the submitter first and last sent the provider record within the retention
+	// window, and Count how many times it did.
+	FirstSeen time.Time
+	LastSeen  time.Time
+	Count     int
+}
+
+func providerAuditDsKey(key []byte, provider, submitter peer.ID) ds.Key {
+	return ds.NewKey(providerAuditPrefix + base32.RawStdEncoding.EncodeToString(key) + "/" +
+		base32.RawStdEncoding.EncodeToString([]byte(provider)) + "/" +
+		base32.RawStdEncoding.EncodeToString([]byte(submitter)))
+}
+
+// auditProviderRecord records that submitter sent the provider record of provider for key.
+func (dht *IpfsDHT) auditProviderRecord(ctx context.Context, key []byte, provider, submitter peer.ID) {
+	if dht.providerAuditRetention <= 0 {
+		return
+	}
+	now := time.Now()
+	dsKey := providerAuditDsKey(key, provider, submitter)
+	e := &ProviderAuditEntry{Key: key, Provider: provider, Submitter: submitter, FirstSeen: now}
+	if b, err := dht.datastore.Get(ctx, dsKey); err == nil {
+		var prev ProviderAuditEntry
+		if json.Unmarshal(b, &prev) == nil && now.Sub(prev.LastSeen) <= dht.providerAuditRetention {
+			e.FirstSeen, e.Count = prev.FirstSeen, prev.Count
+		}
+	}
+	e.LastSeen = now
+	e.Count++
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	if err := dht.datastore.Put(ctx, dsKey, b); err != nil {
+		logger.Warnw("failed to record provider audit entry", "error", err)
+	}
+}
+
+// ProviderAudit returns the submissions of provider records for key received within the retention window configured
+// with RecordProviderAudit, oldest first.
+func (dht *IpfsDHT) ProviderAudit(ctx context.Context, key multihash.Multihash) ([]ProviderAuditEntry, error) {
+	return dht.queryProviderAudit(ctx, providerAuditPrefix+base32.RawStdEncoding.EncodeToString(key), nil)
+}
+
+// ProviderAuditFrom returns the submissions of provider records by submitter received within the retention window
+// configured with RecordProviderAudit, for any key, oldest first. It scans the whole audit trail.
+func (dht *IpfsDHT) ProviderAuditFrom(ctx context.Context, submitter peer.ID) ([]ProviderAuditEntry, error) {
+	return dht.queryProviderAudit(ctx, providerAuditPrefix, func(e *ProviderAuditEntry) bool {
+		return e.Submitter == submitter
+	})
+}
+
+func (dht *IpfsDHT) queryProviderAudit(ctx context.Context, prefix string, filter func(*ProviderAuditEntry) bool) ([]ProviderAuditEntry, error) {
+	if dht.providerAuditRetention <= 0 {
+		return nil, routing.ErrNotSupported
+	}
+	res, err := dht.datastore.Query(ctx, dsq.Query{Prefix: prefix})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	var entries []ProviderAuditEntry
+	for r := range res.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		var e ProviderAuditEntry
+		if err := json.Unmarshal(r.Value, &e); err != nil {
+			logger.Debugw("skipping corrupt provider audit entry", "key", r.Key, "error", err)
+			continue
+		}
+		if time.Since(e.LastSeen) > dht.providerAuditRetention || (filter != nil && !filter(&e)) {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].FirstSeen.Before(entries[j].FirstSeen) })
+	return entries, nil
+}
+
+// providerAuditGC periodically removes audit entries older than the retention window.
+func (dht *IpfsDHT) providerAuditGC(proc goprocess.Process) {
+	ticker := time.NewTicker(providerAuditGCInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			dht.gcProviderAudit(dht.ctx)
+		case <-proc.Closing():
+			return
+		}
+	}
+}
+
+func (dht *IpfsDHT) gcProviderAudit(ctx context.Context) {
+	res, err := dht.datastore.Query(ctx, dsq.Query{Prefix: providerAuditPrefix})
+	if err != nil {
+		logger.Warnw("failed to query provider audit trail", "error", err)
+		return
+	}
+	defer res.Close()
+
+	for e := range res.Next() {
+		if e.Error != nil {
+			logger.Warnw("failed to read provider audit trail", "error", e.Error)
+			return
+		}
+		var entry ProviderAuditEntry
+		if err := json.Unmarshal(e.Value, &entry); err == nil && time.Since(entry.LastSeen) <= dht.providerAuditRetention {
+			continue
+		}
+		if err := dht.datastore.Delete(ctx, ds.RawKey(e.Key)); err != nil {
+			logger.Warnw("failed to delete provider audit entry", "error", err)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/record"
+	"github.com/libp2p/go-libp2p/core/routing"
+	"github.com/multiformats/go-multihash"
+
+	"github.com/libp2p/go-libp2p-kad-dht/internal"
+)
+
+const (
+	// providerAuthorizationDomain is the signature domain of provider authorization envelopes.
+	providerAuthorizationDomain = "libp2p-kad-dht-provider-authorization"
+	// providerAuthorizationCodec is the payload type of provider authorization envelopes.
+	providerAuthorizationCodec = "/libp2p/kad-dht/provider-authorization"
+)
+
+// ProviderAuthorization authorizes a delegate, e.g. a provider service node, to publish provider records naming the
+// peer that signed it, see NewProviderAuthorization and IpfsDHT.ProvideFor.
+type ProviderAuthorization struct {
+	// Delegate is the peer allowed to provide on behalf of the signer.
+	Delegate peer.ID
+	// Keys restricts the authorization to the given keys, it covers all keys if empty.
+	Keys []multihash.Multihash `json:",omitempty"`
+	// Expiry is when the authorization expires.
+	Expiry time.Time
+}
+
+var _ record.Record = (*ProviderAuthorization)(nil)
+
+// Domain implements record.Record.
+func (a *ProviderAuthorization) Domain() string {
+	return providerAuthorizationDomain
+}
+
+// Codec implements record.Record.
+func (a *ProviderAuthorization) Codec() []byte {
+	return []byte(providerAuthorizationCodec)
+}
+
+// MarshalRecord implements record.Record.
+func (a *ProviderAuthorization) MarshalRecord() ([]byte, error) {
+	return json.Marshal(a)
+}
+
+// UnmarshalRecord implements record.Record.
+func (a *ProviderAuthorization) UnmarshalRecord(b []byte) error {
+	return json.Unmarshal(b, a)
+}
+
+// covers returns true if the authorization covers key.
+func (a *ProviderAuthorization) covers(key []byte) bool {
+	if len(a.Keys) == 0 {
+		return true
+	}
+	for _, k := range a.Keys {
+		if bytes.Equal(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewProviderAuthorization returns a signed envelope authorizing delegate to provide the given keys, or all keys if
+// none are given, on behalf of the owner of sk until expiry. The delegate registers it with
+// IpfsDHT.AddProviderAuthorization.
+func NewProviderAuthorization(sk crypto.PrivKey, delegate peer.ID, expiry time.Time, keys ...multihash.Multihash) ([]byte, error) {
+	env, err := record.Seal(&ProviderAuthorization{Delegate: delegate, Keys: keys, Expiry: expiry}, sk)
+	if err != nil {
+		return nil, err
+	}
+	return env.Marshal()
+}
+
+// consumeProviderAuthorization verifies the signature of the envelope env and returns the signing peer and the
+// authorization.
+func consumeProviderAuthorization(env []byte) (peer.ID, *ProviderAuthorization, error) {
+	var auth ProviderAuthorization
+	e, err := record.ConsumeTypedEnvelope(env, &auth)
+	if err != nil {
+		return "", nil, err
+	}
+	signer, err := peer.IDFromPublicKey(e.PublicKey)
+	if err != nil {
+		return "", nil, err
+	}
+	return signer, &auth, nil
+}
+
+// verifyProviderAuthorization checks that env authorizes from to provide key on behalf of provider at time now.
+func verifyProviderAuthorization(env []byte, from peer.ID, key []byte, provider peer.ID, now time.Time) error {
+	signer, auth, err := consumeProviderAuthorization(env)
+	if err != nil {
+		return err
+	}
+	switch {
+	case signer != provider:
+		return fmt.Errorf("authorization signed by %s, not by the provider %s", signer, provider)
+	case auth.Delegate != from:
+		return fmt.Errorf("authorization is for %s, not for %s", auth.Delegate, from)
+	case now.After(auth.Expiry):
+		return fmt.Errorf("authorization expired at %s", auth.Expiry)
+	case !auth.covers(key):
+		return fmt.Errorf("authorization does not cover the key")
+	}
+	return nil
+}
+
+// providerAuthorized returns true if the authorization env received from from authorizes it to provide key on behalf
+// of provider.
+func (dht *IpfsDHT) providerAuthorized(from peer.ID, key []byte, provider peer.ID, env []byte) bool {
+	if len(env) == 0 || provider == from {
+		return false
+	}
+	if err := verifyProviderAuthorization(env, from, key, provider, dht.clock.Now()); err != nil {
+		logger.Debugw("invalid provider authorization", "from", from, "provider", provider, "error", err)
+		return false
+	}
+	return true
+}
+
+// AddProviderAuthorization registers an authorization created with NewProviderAuthorization, which ProvideFor attaches
+// to the provider records of the signing peer. It replaces a previous authorization of the same peer.
+func (dht *IpfsDHT) AddProviderAuthorization(env []byte) error {
+	signer, auth, err := consumeProviderAuthorization(env)
+	if err != nil {
+		return err
+	}
+	if auth.Delegate != dht.self {
+		return fmt.Errorf("authorization is for %s, not for us", auth.Delegate)
+	}
+	if dht.clock.Now().After(auth.Expiry) {
+		return fmt.Errorf("authorization expired at %s", auth.Expiry)
+	}
+
+	dht.providerAuthsLk.Lock()
+	defer dht.providerAuthsLk.Unlock()
+	if dht.providerAuths == nil {
+		dht.providerAuths = make(map[peer.ID]providerAuth)
+	}
+	// drop the expired authorizations so that the registered ones don't pile up
+	now := dht.clock.Now()
+	for p, a := range dht.providerAuths {
+		if now.After(a.expiry) {
+			delete(dht.providerAuths, p)
+		}
+	}
+	dht.providerAuths[signer] = providerAuth{env: env, expiry: auth.Expiry}
+	return nil
+}
+
+// providerAuth is an authorization registered with AddProviderAuthorization.
+type providerAuth struct {
+	env    []byte
+	expiry time.Time
+}
+
+// providerAuthorization returns the registered authorization of provider, nil if there is none or it expired.
+func (dht *IpfsDHT) providerAuthorization(provider peer.ID) []byte {
+	dht.providerAuthsLk.Lock()
+	defer dht.providerAuthsLk.Unlock()
+	a, ok := dht.providerAuths[provider]
+	if !ok {
+		return nil
+	}
+	if dht.clock.Now().After(a.expiry) {
+		delete(dht.providerAuths, provider)
+		return nil
+	}
+	return a.env
+}
+
+// ProvideFor publishes a provider record naming provider instead of ourselves to the closest peers of key, for
+// delegates such as provider service nodes. The authorization of provider registered with AddProviderAuthorization
+// is attached to the records, and remote peers only store them if it is valid, or if their ProviderAcceptPolicy
+// accepts third-party records.
+func (dht *IpfsDHT) ProvideFor(ctx context.Context, key cid.Cid, provider peer.AddrInfo) error {
+	start := time.Now()
+	if !dht.enableProviders {
+		return routing.ErrNotSupported
+	} else if !key.Defined() {
+		return fmt.Errorf("invalid cid: undefined")
+	} else if !dht.providersEnabled(key.Hash()) {
+		return routing.ErrNotSupported
+	} else if len(provider.Addrs) == 0 {
+		return fmt.Errorf("no addresses for provider %s", provider.ID)
+	}
+	ctx, err := dht.chargeQuota(ctx, quotaOpProvide)
+	if err != nil {
+		return err
+	}
+	keyMH := key.Hash()
+	logger.Debugw("providing on behalf of peer", "cid", key, "mh", internal.LoggableProviderRecordBytes(keyMH), "provider", provider.ID)
+
+	auth := dht.providerAuthorization(provider.ID)
+	if auth == nil {
+		logger.Debugw("no authorization for provider, records are only stored by peers accepting third-party records", "provider", provider.ID)
+	}
+
+	// add the provider locally
+	dht.providerStore.AddProvider(ctx, keyMH, provider)
+
+	peers, err := dht.GetClosestPeers(ctx, string(keyMH))
+	if err != nil {
+		return err
+	}
+	failed := dht.putProviderRecords(ctx, keyMH, ProvideStrategyRegular, start, peers, func(ctx context.Context, p peer.ID) error {
+		return dht.protoMessenger.PutProviderFor(ctx, p, keyMH, provider, auth)
+	})
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return provideResult(keyMH, peers, failed)
+}
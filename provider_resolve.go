@@ -0,0 +1,75 @@
+package dht
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// providerResolver resolves the addresses of the providers found without addresses, see ResolveProviderAddrs.
+type providerResolver struct {
+	concurrency int
+	timeout     time.Duration
+}
+
+// needsAddrs tells whether the addresses of provider p must be resolved before returning it: we don't know any
+// address of it, e.g. because its provider record was stored without addresses or they expired.
+func (dht *IpfsDHT) needsAddrs(p peer.AddrInfo) bool {
+	return len(p.Addrs) == 0 && p.ID != dht.self && dht.host.Network().Connectedness(p.ID) != network.Connected &&
+		len(dht.peerstore.Addrs(p.ID)) == 0
+}
+
+// resolveProviderAddrs sends the providers received from in to out, resolving the addresses of the providers we know
+// no address of with FindPeer lookups first. Providers with addresses are sent right away, the others once their
+// lookup ends, with the addresses found if any. out is closed once in is closed and all lookups ended.
+func (dht *IpfsDHT) resolveProviderAddrs(ctx context.Context, in <-chan peer.AddrInfo, out chan<- peer.AddrInfo) {
+	defer close(out)
+
+	r := dht.providerResolver
+	var (
+		wg  sync.WaitGroup
+		sem = make(chan struct{}, r.concurrency)
+	)
+	defer wg.Wait()
+
+	send := func(p peer.AddrInfo) bool {
+		select {
+		case out <- p:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	for p := range in {
+		if !dht.needsAddrs(p) {
+			if !send(p) {
+				return
+			}
+			continue
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		wg.Add(1)
+		go func(p peer.AddrInfo) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			lctx, cancel := context.WithTimeout(ctx, r.timeout)
+			found, err := dht.findPeerAddrs(lctx, p.ID)
+			cancel()
+			if err == nil && len(found.Addrs) > 0 {
+				p.Addrs = found.Addrs
+				dht.addProviderAddrs(p.ID, p.Addrs)
+			} else {
+				opLogger(ctx).Debugw("failed to resolve provider addresses", "provider", p.ID, "error", err)
+			}
+			send(p)
+		}(p)
+	}
+}
@@ -0,0 +1,371 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-libp2p/core/routing"
+	"github.com/libp2p/go-msgio"
+	"github.com/multiformats/go-multihash"
+
+	"github.com/libp2p/go-libp2p-kad-dht/internal"
+	"github.com/libp2p/go-libp2p-kad-dht/internal/net"
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+)
+
+// Provider subscriptions are an experimental protocol extension allowing a client to register interest in a key with
+// the servers closest to it. Whenever one of those servers stores a new provider record for the key, it pushes the
+// provider to the client over a dedicated protocol instead of the client having to poll with FindProviders.
+
+// kadProviderNotify is the protocol, appended to the protocol prefix, servers use to push provider notifications to
+// subscribers.
+const kadProviderNotify protocol.ID = "/kad/provider-notify/1.0.0"
+
+const (
+	// providerSubscriptionTTL is how long a server keeps a subscription alive without it being renewed.
+	providerSubscriptionTTL = 10 * time.Minute
+	// providerNotifyTimeout bounds the time a server spends pushing a single notification.
+	providerNotifyTimeout = 10 * time.Second
+	// providerWatchBuffer is the number of providers buffered for a subscriber, further ones are dropped until the
+	// subscriber catches up.
+	providerWatchBuffer = 64
+)
+
+var errTooManySubscriptions = errors.New("too many provider subscriptions")
+
+// providerSubscriptions is the server side subscription registry. It enforces a cap on the total number of
+// subscriptions as well as on the number of subscriptions per peer. Subscriptions that weren't renewed expire, and are
+// removed by a sweep at least once per TTL while the registry is in use.
+type providerSubscriptions struct {
+	maxTotal, maxPerPeer int
+
+	mu        sync.Mutex
+	subs      map[string]map[peer.ID]time.Time // key -> subscriber -> expiry
+	perPeer   map[peer.ID]int
+	total     int
+	lastPrune time.Time
+}
+
+func newProviderSubscriptions(maxTotal, maxPerPeer int) *providerSubscriptions {
+	return &providerSubscriptions{
+		maxTotal:   maxTotal,
+		maxPerPeer: maxPerPeer,
+		subs:       make(map[string]map[peer.ID]time.Time),
+		perPeer:    make(map[peer.ID]int),
+	}
+}
+
+// add registers or renews the subscription of p to key.
+func (s *providerSubscriptions) add(key string, p peer.ID, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maybePruneLocked(now)
+
+	if _, ok := s.subs[key][p]; ok {
+		s.subs[key][p] = now.Add(providerSubscriptionTTL)
+		return nil
+	}
+
+	if s.total >= s.maxTotal || s.perPeer[p] >= s.maxPerPeer {
+		s.pruneLocked(now)
+		if s.total >= s.maxTotal || s.perPeer[p] >= s.maxPerPeer {
+			return errTooManySubscriptions
+		}
+	}
+
+	if s.subs[key] == nil {
+		s.subs[key] = make(map[peer.ID]time.Time)
+	}
+	s.subs[key][p] = now.Add(providerSubscriptionTTL)
+	s.perPeer[p]++
+	s.total++
+	return nil
+}
+
+// subscribers returns the peers with a live subscription to key.
+func (s *providerSubscriptions) subscribers(key string, now time.Time) []peer.ID {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maybePruneLocked(now)
+
+	var out []peer.ID
+	for p, expiry := range s.subs[key] {
+		if now.Before(expiry) {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// maybePruneLocked removes the expired subscriptions if they weren't for a TTL.
+func (s *providerSubscriptions) maybePruneLocked(now time.Time) {
+	if now.Sub(s.lastPrune) >= providerSubscriptionTTL {
+		s.pruneLocked(now)
+	}
+}
+
+func (s *providerSubscriptions) pruneLocked(now time.Time) {
+	s.lastPrune = now
+	for key, subs := range s.subs {
+		for p, expiry := range subs {
+			if now.Before(expiry) {
+				continue
+			}
+			delete(subs, p)
+			s.total--
+			if s.perPeer[p]--; s.perPeer[p] == 0 {
+				delete(s.perPeer, p)
+			}
+		}
+		if len(subs) == 0 {
+			delete(s.subs, key)
+		}
+	}
+}
+
+func (dht *IpfsDHT) handleSubscribeProviders(ctx context.Context, p peer.ID, pmes *pb.Message) (*pb.Message, error) {
+	key := pmes.GetKey()
+	if len(key) > 80 {
+		return nil, fmt.Errorf("handleSubscribeProviders key size too large")
+	} else if len(key) == 0 {
+		return nil, fmt.Errorf("handleSubscribeProviders key is empty")
+	}
+	if !dht.providersEnabled(key) {
+		return nil, errKeyNotServed
+	}
+
+	if err := dht.providerSubs.add(string(key), p, dht.clock.Now()); err != nil {
+		return nil, err
+	}
+	logger.Debugw("provider subscription", "from", p, "key", internal.LoggableProviderRecordBytes(key))
+
+	return pb.NewMessage(pb.Message_SUBSCRIBE_PROVIDERS, key, 0), nil
+}
+
+// notifyProviderSubscribers pushes a newly added provider of key to all subscribers of key.
+func (dht *IpfsDHT) notifyProviderSubscribers(key []byte, prov peer.AddrInfo) {
+	if dht.providerSubs == nil {
+		return
+	}
+	subscribers := dht.providerSubs.subscribers(string(key), dht.clock.Now())
+	if len(subscribers) == 0 {
+		return
+	}
+
+	msg := pb.NewMessage(pb.Message_PROVIDER_NOTIFY, key, 0)
+	msg.ProviderPeers = pb.RawPeerInfosToPBPeers([]peer.AddrInfo{prov})
+	if dht.overlay != nil {
+		var err error
+		if msg, err = dht.overlay.sign(msg); err != nil {
+			logger.Debugw("failed to sign provider notification", "error", err)
+			return
+		}
+	}
+	for _, p := range subscribers {
+		go func(p peer.ID) {
+			ctx, cancel := context.WithTimeout(dht.ctx, providerNotifyTimeout)
+			defer cancel()
+
+			s, err := dht.host.NewStream(ctx, p, dht.providerNotifyProto)
+			if err != nil {
+				logger.Debugw("failed to open provider notification stream", "peer", p, "error", err)
+				return
+			}
+			if err := net.WriteMsg(s, msg); err != nil {
+				logger.Debugw("failed to send provider notification", "peer", p, "error", err)
+				_ = s.Reset()
+				return
+			}
+			_ = s.Close()
+		}(p)
+	}
+}
+
+// providerWatch is a client side subscription created by SubscribeProviders.
+type providerWatch struct {
+	out chan peer.AddrInfo
+
+	mu      sync.Mutex
+	servers map[peer.ID]struct{} // the peers we are subscribed with
+	seen    map[peer.ID]struct{} // providers already delivered
+	closed  bool
+}
+
+// deliver hands prov, pushed by server, to the subscriber unless it was already delivered. It never blocks: if the
+// subscriber fell behind by more than providerWatchBuffer providers, prov is dropped, and delivered if pushed again.
+func (w *providerWatch) deliver(server peer.ID, prov peer.AddrInfo) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.servers[server]; !ok || w.closed {
+		return
+	}
+	if _, ok := w.seen[prov.ID]; ok {
+		return
+	}
+	select {
+	case w.out <- prov:
+		w.seen[prov.ID] = struct{}{}
+	default:
+		logger.Debugw("dropping provider notification for slow subscriber", "provider", prov.ID)
+	}
+}
+
+// handleProviderNotify handles provider notifications pushed by servers we subscribed with.
+func (dht *IpfsDHT) handleProviderNotify(s network.Stream) {
+	defer func() { _ = s.Close() }()
+
+	_ = s.SetReadDeadline(time.Now().Add(providerNotifyTimeout))
+	r := msgio.NewVarintReaderSize(s, network.MessageSizeMax)
+	msgbytes, err := r.ReadMsg()
+	if err != nil {
+		_ = s.Reset()
+		return
+	}
+	var msg pb.Message
+	err = msg.Unmarshal(msgbytes)
+	r.ReleaseMsg(msgbytes)
+	if err != nil || msg.GetType() != pb.Message_PROVIDER_NOTIFY {
+		_ = s.Reset()
+		return
+	}
+
+	server := s.Conn().RemotePeer()
+	if !dht.peerAllowed(server) {
+		return
+	}
+	if dht.overlay != nil {
+		if err := dht.overlay.verify(server, &msg); err != nil {
+			logger.Debugw("rejecting unauthenticated provider notification", "from", server, "error", err)
+			return
+		}
+	}
+	key := string(msg.GetKey())
+
+	dht.providerWatchesLk.Lock()
+	watches := append([]*providerWatch(nil), dht.providerWatches[key]...)
+	dht.providerWatchesLk.Unlock()
+	if len(watches) == 0 {
+		return
+	}
+
+	for _, prov := range pb.PBPeersToPeerInfos(msg.GetProviderPeers()) {
+		if prov.ID == dht.self {
+			continue
+		}
+		dht.addProviderAddrs(prov.ID, prov.Addrs)
+		for _, w := range watches {
+			w.deliver(server, *prov)
+		}
+	}
+}
+
+// SubscribeProviders registers interest in providers of key with the servers closest to it. Providers added after
+// the subscription are pushed to the returned channel as the servers learn about them; each provider is delivered at
+// most once. Providers pushed while the channel is full are dropped, so the channel must be drained promptly. The
+// subscription is renewed periodically and lasts until ctx is done, at which point the channel is
+// closed.
+//
+// This is an experimental protocol extension, both the subscriber and the servers need to have enabled it with
+// EnableProviderSubscriptions. Providers that were added before the subscription was made must still be looked up
+// with FindProvidersAsync.
+func (dht *IpfsDHT) SubscribeProviders(ctx context.Context, key cid.Cid) (<-chan peer.AddrInfo, error) {
+	if !dht.enableProviders {
+		return nil, routing.ErrNotSupported
+	}
+	if dht.providerSubs == nil {
+		return nil, fmt.Errorf("provider subscriptions are not enabled")
+	}
+	if !key.Defined() {
+		return nil, fmt.Errorf("invalid cid: undefined")
+	}
+	if !dht.providersEnabled(key.Hash()) {
+		return nil, routing.ErrNotSupported
+	}
+
+	keyMH := key.Hash()
+	w := &providerWatch{
+		out:     make(chan peer.AddrInfo, providerWatchBuffer),
+		servers: make(map[peer.ID]struct{}),
+		seen:    make(map[peer.ID]struct{}),
+	}
+
+	dht.providerWatchesLk.Lock()
+	dht.providerWatches[string(keyMH)] = append(dht.providerWatches[string(keyMH)], w)
+	dht.providerWatchesLk.Unlock()
+
+	go func() {
+		defer dht.removeProviderWatch(string(keyMH), w)
+
+		ticker := dht.clock.Ticker(providerSubscriptionTTL / 2)
+		defer ticker.Stop()
+		for {
+			dht.subscribeProvidersOnce(ctx, keyMH, w)
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return w.out, nil
+}
+
+// subscribeProvidersOnce (re-)subscribes w with the peers currently closest to key.
+func (dht *IpfsDHT) subscribeProvidersOnce(ctx context.Context, key multihash.Multihash, w *providerWatch) {
+	peers, err := dht.GetClosestPeers(ctx, string(key))
+	if err != nil {
+		logger.Debugw("failed to find peers for provider subscription", "key", internal.LoggableProviderRecordBytes(key), "error", err)
+		return
+	}
+
+	// register the servers before subscribing so we don't drop notifications racing with the response
+	w.mu.Lock()
+	for _, p := range peers {
+		w.servers[p] = struct{}{}
+	}
+	w.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, p := range peers {
+		wg.Add(1)
+		go func(p peer.ID) {
+			defer wg.Done()
+			if err := dht.protoMessenger.SubscribeProviders(ctx, p, key); err != nil {
+				logger.Debugw("provider subscription failed", "peer", p, "error", err)
+			}
+		}(p)
+	}
+	wg.Wait()
+}
+
+func (dht *IpfsDHT) removeProviderWatch(key string, w *providerWatch) {
+	dht.providerWatchesLk.Lock()
+	defer dht.providerWatchesLk.Unlock()
+
+	watches := dht.providerWatches[key]
+	for i, other := range watches {
+		if other == w {
+			watches = append(watches[:i], watches[i+1:]...)
+			break
+		}
+	}
+	if len(watches) == 0 {
+		delete(dht.providerWatches, key)
+	} else {
+		dht.providerWatches[key] = watches
+	}
+
+	// deliveries send under the lock, so none is in flight once closed is set
+	w.mu.Lock()
+	w.closed = true
+	close(w.out)
+	w.mu.Unlock()
+}
@@ -0,0 +1,103 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/test"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProviderSubscriptionCaps(t *testing.T) {
+	s := newProviderSubscriptions(3, 2)
+	now := time.Now()
+	a, b := test.RandPeerIDFatal(t), test.RandPeerIDFatal(t)
+
+	require.NoError(t, s.add("k1", a, now))
+	require.NoError(t, s.add("k2", a, now))
+	require.ErrorIs(t, s.add("k3", a, now), errTooManySubscriptions)
+	// renewals don't count against the caps
+	require.NoError(t, s.add("k1", a, now))
+
+	require.NoError(t, s.add("k1", b, now))
+	require.ErrorIs(t, s.add("k2", b, now), errTooManySubscriptions)
+	require.ElementsMatch(t, []peer.ID{a, b}, s.subscribers("k1", now))
+
+	// expired subscriptions make room for new ones
+	later := now.Add(providerSubscriptionTTL + time.Second)
+	require.Empty(t, s.subscribers("k1", later))
+	// and are swept even if the caps aren't hit
+	require.Zero(t, s.total)
+	require.Empty(t, s.subs)
+	require.NoError(t, s.add("k3", b, later))
+}
+
+func TestSubscribeProviders(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 5, EnableProviderSubscriptions(100, 10))
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			defer d.host.Close()
+		}
+	}()
+	for i, a := range dhts {
+		for _, b := range dhts[i+1:] {
+			connect(t, ctx, a, b)
+		}
+	}
+
+	subscriber, provider := dhts[0], dhts[1]
+	key := testCaseCids[0]
+
+	subCtx, subCancel := context.WithCancel(ctx)
+	provs, err := subscriber.SubscribeProviders(subCtx, key)
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		for _, d := range dhts[1:] {
+			if len(d.providerSubs.subscribers(string(key.Hash()), time.Now())) == 0 {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, provider.ProvideWithoutEclipseDetection(ctx, key, true))
+
+	select {
+	case prov := <-provs:
+		require.Equal(t, provider.self, prov.ID)
+	case <-time.After(5 * time.Second):
+		t.Fatal("did not receive provider notification")
+	}
+
+	subCancel()
+	for range provs {
+	}
+}
+
+func TestProviderWatchDeliver(t *testing.T) {
+	server := test.RandPeerIDFatal(t)
+	w := &providerWatch{
+		out:     make(chan peer.AddrInfo, 1),
+		servers: map[peer.ID]struct{}{server: {}},
+		seen:    make(map[peer.ID]struct{}),
+	}
+	a, b := test.RandPeerIDFatal(t), test.RandPeerIDFatal(t)
+
+	// a slow subscriber doesn't block the delivery, providers beyond the buffer are dropped
+	w.deliver(server, peer.AddrInfo{ID: a})
+	w.deliver(server, peer.AddrInfo{ID: b})
+	require.Equal(t, a, (<-w.out).ID)
+	// and delivered when pushed again
+	w.deliver(server, peer.AddrInfo{ID: b})
+	w.deliver(server, peer.AddrInfo{ID: a})
+	require.Equal(t, b, (<-w.out).ID)
+	require.Empty(t, w.out)
+}
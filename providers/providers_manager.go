@@ -5,12 +5,14 @@ import (
 	"encoding/binary"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/peerstore"
 	peerstoreImpl "github.com/libp2p/go-libp2p/p2p/host/peerstore"
 
+	"github.com/benbjohnson/clock"
 	lru "github.com/hashicorp/golang-lru/simplelru"
 	ds "github.com/ipfs/go-datastore"
 	"github.com/ipfs/go-datastore/autobatch"
@@ -19,6 +21,8 @@ import (
 	"github.com/jbenet/goprocess"
 	goprocessctx "github.com/jbenet/goprocess/context"
 	"github.com/multiformats/go-base32"
+
+	"github.com/libp2p/go-libp2p-kad-dht/internal"
 )
 
 // ProvidersKeyPrefix is the prefix/namespace for ALL provider record
@@ -30,6 +34,11 @@ var ProvideValidity = time.Hour * 24
 var defaultCleanupInterval = time.Hour
 var lruCacheSize = 256
 var batchBufferSize = 256
+var defaultShards = 16
+
+// maxShards is the maximum number of shards, one per value of the leading byte of the key hashes.
+const maxShards = 256
+
 var log = logging.Logger("providers")
 
 // ProviderStore represents a store that associates peers and their addresses to keys.
@@ -39,20 +48,30 @@ type ProviderStore interface {
 }
 
 // ProviderManager adds and pulls providers out of the datastore,
-// caching them in between
+// caching them in between.
+//
+// Keys are sharded by the prefix of their hash across segments with a lock,
+// a cache and a write batch of their own, so that reads and writes of keys in
+// different shards don't wait for each other.
 type ProviderManager struct {
-	self peer.ID
-	// all non channel fields are meant to be accessed only within
-	// the run method
-	cache  lru.LRUCache
+	self   peer.ID
 	pstore peerstore.Peerstore
-	dstore *autobatch.Datastore
-
-	newprovs chan *addProv
-	getprovs chan *getProv
-	proc     goprocess.Process
+	dstore ds.Batching
+	shards []*providerShard
+	proc   goprocess.Process
 
+	// cache is the cache set with the Cache option, if any
+	cache           lru.LRUCache
+	nshards         int
 	cleanupInterval time.Duration
+	clock           clock.Clock
+}
+
+// providerShard holds the provider records of the keys whose hash starts with the prefix of the shard.
+type providerShard struct {
+	mu     sync.Mutex
+	cache  lru.LRUCache
+	dstore *autobatch.Datastore
 }
 
 var _ ProviderStore = (*ProviderManager)(nil)
@@ -78,8 +97,18 @@ func CleanupInterval(d time.Duration) Option {
 	}
 }
 
+// Clock sets the clock used to timestamp and expire provider records and to schedule GC runs.
+// Defaults to the system clock.
+func Clock(c clock.Clock) Option {
+	return func(pm *ProviderManager) error {
+		pm.clock = c
+		return nil
+	}
+}
+
 // Cache sets the LRU cache implementation.
-// Defaults to a simple LRU cache.
+// Defaults to a simple LRU cache per shard. As the cache can't be split,
+// setting it disables sharding.
 func Cache(c lru.LRUCache) Option {
 	return func(pm *ProviderManager) error {
 		pm.cache = c
@@ -87,35 +116,54 @@ func Cache(c lru.LRUCache) Option {
 	}
 }
 
-type addProv struct {
-	ctx context.Context
-	key []byte
-	val peer.ID
-}
-
-type getProv struct {
-	ctx  context.Context
-	key  []byte
-	resp chan []peer.ID
+// Shards sets the number of shards the keys are split into, between 1 and
+// 256. More shards let more reads and writes of different keys run in parallel.
+// Defaults to 16.
+func Shards(n int) Option {
+	return func(pm *ProviderManager) error {
+		if n < 1 || n > maxShards {
+			return fmt.Errorf("number of shards must be between 1 and %d, got %d", maxShards, n)
+		}
+		pm.nshards = n
+		return nil
+	}
 }
 
 // NewProviderManager constructor
 func NewProviderManager(ctx context.Context, local peer.ID, ps peerstore.Peerstore, dstore ds.Batching, opts ...Option) (*ProviderManager, error) {
 	pm := new(ProviderManager)
 	pm.self = local
-	pm.getprovs = make(chan *getProv)
-	pm.newprovs = make(chan *addProv)
 	pm.pstore = ps
-	pm.dstore = autobatch.NewAutoBatching(dstore, batchBufferSize)
-	cache, err := lru.NewLRU(lruCacheSize, nil)
-	if err != nil {
-		return nil, err
-	}
-	pm.cache = cache
+	pm.dstore = dstore
+	pm.nshards = defaultShards
 	pm.cleanupInterval = defaultCleanupInterval
+	pm.clock = clock.New()
 	if err := pm.applyOptions(opts...); err != nil {
 		return nil, err
 	}
+	if pm.cache != nil {
+		pm.nshards = 1
+	}
+
+	cacheSize := lruCacheSize / pm.nshards
+	if cacheSize < 1 {
+		cacheSize = 1
+	}
+	pm.shards = make([]*providerShard, pm.nshards)
+	for i := range pm.shards {
+		cache := pm.cache
+		if cache == nil {
+			var err error
+			if cache, err = lru.NewLRU(cacheSize, nil); err != nil {
+				return nil, err
+			}
+		}
+		pm.shards[i] = &providerShard{
+			cache:  cache,
+			dstore: autobatch.NewAutoBatching(dstore, batchBufferSize),
+		}
+	}
+
 	pm.proc = goprocessctx.WithContext(ctx)
 	pm.proc.Go(func(proc goprocess.Process) { pm.run(ctx, proc) })
 	return pm, nil
@@ -126,106 +174,114 @@ func (pm *ProviderManager) Process() goprocess.Process {
 	return pm.proc
 }
 
-func (pm *ProviderManager) run(ctx context.Context, proc goprocess.Process) {
-	var (
-		gcQuery    dsq.Results
-		gcQueryRes <-chan dsq.Result
-		gcSkip     map[string]struct{}
-		gcTime     time.Time
-		gcTimer    = time.NewTimer(pm.cleanupInterval)
-	)
+// shard returns the shard of key k, selected by the leading bits of its hash.
+func (pm *ProviderManager) shard(k []byte) *providerShard {
+	h := internal.KadKey(string(k))
+	return pm.shards[int(h[0])*len(pm.shards)/maxShards]
+}
 
+// run collects garbage every cleanup interval until proc closes.
+func (pm *ProviderManager) run(ctx context.Context, proc goprocess.Process) {
+	gcTimer := pm.clock.Timer(pm.cleanupInterval)
 	defer func() {
 		gcTimer.Stop()
-		if gcQuery != nil {
-			// don't really care if this fails.
-			_ = gcQuery.Close()
-		}
-		if err := pm.dstore.Flush(ctx); err != nil {
-			log.Error("failed to flush datastore: ", err)
+		for _, s := range pm.shards {
+			s.mu.Lock()
+			if err := s.dstore.Flush(ctx); err != nil {
+				log.Error("failed to flush datastore: ", err)
+			}
+			s.mu.Unlock()
 		}
 	}()
 
 	for {
 		select {
-		case np := <-pm.newprovs:
-			err := pm.addProv(np.ctx, np.key, np.val)
-			if err != nil {
-				log.Error("error adding new providers: ", err)
-				continue
-			}
-			if gcSkip != nil {
-				// we have an gc, tell it to skip this provider
-				// as we've updated it since the GC started.
-				gcSkip[mkProvKeyFor(np.key, np.val)] = struct{}{}
-			}
-		case gp := <-pm.getprovs:
-			provs, err := pm.getProvidersForKey(gp.ctx, gp.key)
-			if err != nil && err != ds.ErrNotFound {
-				log.Error("error reading providers: ", err)
-			}
+		case gcTime := <-gcTimer.C:
+			pm.gc(ctx, proc, gcTime)
+			gcTimer.Reset(pm.cleanupInterval)
+		case <-proc.Closing():
+			return
+		}
+	}
+}
 
-			// set the cap so the user can't append to this.
-			gp.resp <- provs[0:len(provs):len(provs)]
-		case res, ok := <-gcQueryRes:
-			if !ok {
-				if err := gcQuery.Close(); err != nil {
-					log.Error("failed to close provider GC query: ", err)
-				}
-				gcTimer.Reset(pm.cleanupInterval)
-
-				// cleanup GC round
-				gcQueryRes = nil
-				gcSkip = nil
-				gcQuery = nil
-				continue
-			}
-			if res.Error != nil {
-				log.Error("got error from GC query: ", res.Error)
-				continue
-			}
-			if _, ok := gcSkip[res.Key]; ok {
-				// We've updated this record since starting the
-				// GC round, skip it.
-				continue
-			}
+// gc drops the caches and removes the provider records that expired at gcTime from the datastore.
+func (pm *ProviderManager) gc(ctx context.Context, proc goprocess.Process, gcTime time.Time) {
+	// You know the wonderful thing about caches? You can
+	// drop them.
+	//
+	// Much faster than GCing.
+	for _, s := range pm.shards {
+		s.mu.Lock()
+		s.cache.Purge()
+		if err := s.dstore.Flush(ctx); err != nil {
+			log.Error("failed to flush datastore: ", err)
+		}
+		s.mu.Unlock()
+	}
 
-			// check expiration time
-			t, err := readTimeValue(res.Value)
-			switch {
-			case err != nil:
-				// couldn't parse the time
-				log.Error("parsing providers record from disk: ", err)
-				fallthrough
-			case gcTime.Sub(t) > ProvideValidity:
-				// or expired
-				err = pm.dstore.Delete(ctx, ds.RawKey(res.Key))
-				if err != nil && err != ds.ErrNotFound {
-					log.Error("failed to remove provider record from disk: ", err)
-				}
-			}
+	// Now, GC the datastore.
+	q, err := pm.dstore.Query(ctx, dsq.Query{
+		Prefix: ProvidersKeyPrefix,
+	})
+	if err != nil {
+		log.Error("provider record GC query failed: ", err)
+		return
+	}
+	defer func() {
+		if err := q.Close(); err != nil {
+			log.Error("failed to close provider GC query: ", err)
+		}
+	}()
 
-		case gcTime = <-gcTimer.C:
-			// You know the wonderful thing about caches? You can
-			// drop them.
-			//
-			// Much faster than GCing.
-			pm.cache.Purge()
-
-			// Now, kick off a GC of the datastore.
-			q, err := pm.dstore.Query(ctx, dsq.Query{
-				Prefix: ProvidersKeyPrefix,
-			})
-			if err != nil {
-				log.Error("provider record GC query failed: ", err)
-				continue
+	for {
+		var res dsq.Result
+		select {
+		case r, ok := <-q.Next():
+			if !ok {
+				return
 			}
-			gcQuery = q
-			gcQueryRes = q.Next()
-			gcSkip = make(map[string]struct{})
+			res = r
 		case <-proc.Closing():
 			return
 		}
+		if res.Error != nil {
+			log.Error("got error from GC query: ", res.Error)
+			continue
+		}
+		if t, err := readTimeValue(res.Value); err == nil && gcTime.Sub(t) <= ProvideValidity {
+			continue
+		}
+		pm.gcEntry(ctx, ds.RawKey(res.Key), gcTime)
+	}
+}
+
+// gcEntry removes the provider record stored at dsk if it expired at gcTime. The record is checked again under the
+// lock of its shard, as it may have been updated since the GC read it.
+func (pm *ProviderManager) gcEntry(ctx context.Context, dsk ds.Key, gcTime time.Time) {
+	s := pm.shards[0]
+	if k, err := base32.RawStdEncoding.DecodeString(dsk.Parent().BaseNamespace()); err == nil {
+		s = pm.shard(k)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, err := s.dstore.Get(ctx, dsk)
+	if err != nil {
+		return
+	}
+	t, err := readTimeValue(v)
+	switch {
+	case err != nil:
+		// couldn't parse the time
+		log.Error("parsing providers record from disk: ", err)
+		fallthrough
+	case gcTime.Sub(t) > ProvideValidity:
+		// or expired
+		err = s.dstore.Delete(ctx, dsk)
+		if err != nil && err != ds.ErrNotFound {
+			log.Error("failed to remove provider record from disk: ", err)
+		}
 	}
 }
 
@@ -234,27 +290,27 @@ func (pm *ProviderManager) AddProvider(ctx context.Context, k []byte, provInfo p
 	if provInfo.ID != pm.self { // don't add own addrs.
 		pm.pstore.AddAddrs(provInfo.ID, provInfo.Addrs, peerstore.ProviderAddrTTL)
 	}
-	prov := &addProv{
-		ctx: ctx,
-		key: k,
-		val: provInfo.ID,
+	if err := ctx.Err(); err != nil {
+		return err
 	}
-	select {
-	case pm.newprovs <- prov:
-		return nil
-	case <-ctx.Done():
-		return ctx.Err()
+	if err := pm.addProv(ctx, k, provInfo.ID); err != nil {
+		log.Error("error adding new providers: ", err)
 	}
+	return nil
 }
 
 // addProv updates the cache if needed
 func (pm *ProviderManager) addProv(ctx context.Context, k []byte, p peer.ID) error {
-	now := time.Now()
-	if provs, ok := pm.cache.Get(string(k)); ok {
+	s := pm.shard(k)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := pm.clock.Now()
+	if provs, ok := s.cache.Get(string(k)); ok {
 		provs.(*providerSet).setVal(p, now)
 	} // else not cached, just write through
 
-	return writeProviderEntry(ctx, pm.dstore, k, p, now)
+	return writeProviderEntry(ctx, s.dstore, k, p, now)
 }
 
 // writeProviderEntry writes the provider into the datastore
@@ -278,26 +334,23 @@ func mkProvKey(k []byte) string {
 // GetProviders returns the set of providers for the given key.
 // This method _does not_ copy the set. Do not modify it.
 func (pm *ProviderManager) GetProviders(ctx context.Context, k []byte) ([]peer.AddrInfo, error) {
-	gp := &getProv{
-		ctx:  ctx,
-		key:  k,
-		resp: make(chan []peer.ID, 1), // buffered to prevent sender from blocking
-	}
-	select {
-	case <-ctx.Done():
-		return nil, ctx.Err()
-	case pm.getprovs <- gp:
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
-	select {
-	case <-ctx.Done():
-		return nil, ctx.Err()
-	case peers := <-gp.resp:
-		return peerstoreImpl.PeerInfos(pm.pstore, peers), nil
+	provs, err := pm.getProvidersForKey(ctx, k)
+	if err != nil && err != ds.ErrNotFound {
+		log.Error("error reading providers: ", err)
 	}
+	// set the cap so the user can't append to this.
+	return peerstoreImpl.PeerInfos(pm.pstore, provs[0:len(provs):len(provs)]), nil
 }
 
 func (pm *ProviderManager) getProvidersForKey(ctx context.Context, k []byte) ([]peer.ID, error) {
-	pset, err := pm.getProviderSetForKey(ctx, k)
+	s := pm.shard(k)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pset, err := s.getProviderSetForKey(ctx, k, pm.clock.Now())
 	if err != nil {
 		return nil, err
 	}
@@ -305,33 +358,32 @@ func (pm *ProviderManager) getProvidersForKey(ctx context.Context, k []byte) ([]
 }
 
 // returns the ProviderSet if it already exists on cache, otherwise loads it from datasatore
-func (pm *ProviderManager) getProviderSetForKey(ctx context.Context, k []byte) (*providerSet, error) {
-	cached, ok := pm.cache.Get(string(k))
+func (s *providerShard) getProviderSetForKey(ctx context.Context, k []byte, now time.Time) (*providerSet, error) {
+	cached, ok := s.cache.Get(string(k))
 	if ok {
 		return cached.(*providerSet), nil
 	}
 
-	pset, err := loadProviderSet(ctx, pm.dstore, k)
+	pset, err := loadProviderSet(ctx, s.dstore, k, now)
 	if err != nil {
 		return nil, err
 	}
 
 	if len(pset.providers) > 0 {
-		pm.cache.Add(string(k), pset)
+		s.cache.Add(string(k), pset)
 	}
 
 	return pset, nil
 }
 
 // loads the ProviderSet out of the datastore
-func loadProviderSet(ctx context.Context, dstore ds.Datastore, k []byte) (*providerSet, error) {
+func loadProviderSet(ctx context.Context, dstore ds.Datastore, k []byte, now time.Time) (*providerSet, error) {
 	res, err := dstore.Query(ctx, dsq.Query{Prefix: mkProvKey(k)})
 	if err != nil {
 		return nil, err
 	}
 	defer res.Close()
 
-	now := time.Now()
 	out := newProviderSet()
 	for {
 		e, ok := res.NextSync()
@@ -5,12 +5,14 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/p2p/host/peerstore/pstoremem"
 
+	"github.com/benbjohnson/clock"
 	mh "github.com/multiformats/go-multihash"
 
 	ds "github.com/ipfs/go-datastore"
@@ -121,7 +123,7 @@ func TestProvidersSerialization(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	pset, err := loadProviderSet(context.Background(), dstore, k)
+	pset, err := loadProviderSet(context.Background(), dstore, k, time.Now())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -218,8 +220,10 @@ func TestProvidesExpire(t *testing.T) {
 	// Stop to prevent data races
 	p.Process().Close()
 
-	if p.cache.Len() != 0 {
-		t.Fatal("providers map not cleaned up")
+	for _, s := range p.shards {
+		if s.cache.Len() != 0 {
+			t.Fatal("providers map not cleaned up")
+		}
 	}
 
 	res, err := ds.Query(context.Background(), dsq.Query{Prefix: ProvidersKeyPrefix})
@@ -235,6 +239,124 @@ func TestProvidesExpire(t *testing.T) {
 	}
 }
 
+func TestProvidesExpireWithClock(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clk := clock.NewMock()
+	ps, err := pstoremem.NewPeerstore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewProviderManager(ctx, peer.ID("testing"), ps, dssync.MutexWrap(ds.NewMapDatastore()), Clock(clk))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Process().Close()
+
+	var mhs []mh.Multihash
+	for i := 0; i < 4; i++ {
+		mhs = append(mhs, u.Hash([]byte(fmt.Sprint(i))))
+	}
+	for _, h := range mhs[:2] {
+		p.AddProvider(ctx, h, peer.AddrInfo{ID: "a"})
+	}
+	clk.Add(ProvideValidity / 2)
+	for _, h := range mhs[2:] {
+		p.AddProvider(ctx, h, peer.AddrInfo{ID: "a"})
+	}
+	clk.Add(ProvideValidity/2 + time.Minute)
+
+	for _, h := range mhs[:2] {
+		if out, _ := p.GetProviders(ctx, h); len(out) != 0 {
+			t.Fatal("expected providers to be expired, got: ", out)
+		}
+	}
+	for _, h := range mhs[2:] {
+		if out, _ := p.GetProviders(ctx, h); len(out) != 1 {
+			t.Fatal("expected providers to still be there")
+		}
+	}
+}
+
+func TestShardedProvidersConcurrent(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ps, err := pstoremem.NewPeerstore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewProviderManager(ctx, peer.ID("testing"), ps, dssync.MutexWrap(ds.NewMapDatastore()), Shards(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Process().Close()
+
+	var mhs []mh.Multihash
+	for i := 0; i < 64; i++ {
+		mhs = append(mhs, u.Hash([]byte(fmt.Sprint(i))))
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for _, h := range mhs {
+				p.AddProvider(ctx, h, peer.AddrInfo{ID: peer.ID(fmt.Sprint(w))})
+				p.GetProviders(ctx, h)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	for _, h := range mhs {
+		if out, _ := p.GetProviders(ctx, h); len(out) != 8 {
+			t.Fatalf("expected 8 providers, got %d", len(out))
+		}
+	}
+
+	if _, err := NewProviderManager(ctx, peer.ID("testing"), ps, ds.NewMapDatastore(), Shards(0)); err == nil {
+		t.Fatal("expected an invalid number of shards to fail")
+	}
+}
+
+// BenchmarkGetProvidersParallel reads the providers of many keys from many goroutines at once, as when serving
+// GET_PROVIDERS under heavy load.
+func BenchmarkGetProvidersParallel(b *testing.B) {
+	for _, shards := range []int{1, defaultShards} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			ps, err := pstoremem.NewPeerstore()
+			if err != nil {
+				b.Fatal(err)
+			}
+			p, err := NewProviderManager(ctx, peer.ID("testing"), ps, dssync.MutexWrap(ds.NewMapDatastore()), Shards(shards))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer p.Process().Close()
+
+			var mhs []mh.Multihash
+			for i := 0; i < 10000; i++ {
+				h := u.Hash([]byte(fmt.Sprint(i)))
+				mhs = append(mhs, h)
+				p.AddProvider(ctx, h, peer.AddrInfo{ID: "a"})
+			}
+
+			b.SetParallelism(64)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					p.GetProviders(ctx, mhs[i%len(mhs)])
+				}
+			})
+		})
+	}
+}
+
 var _ = io.NopCloser
 var _ = os.DevNull
 
@@ -0,0 +1,77 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"sort"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multihash"
+
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+)
+
+const (
+	// providersPageSize is the number of providers we ask for per GET_PROVIDERS page.
+	providersPageSize = 200
+	// maxProvidersPageSize caps the page size requested by remote peers.
+	maxProvidersPageSize = 1000
+	// maxProvidersPages bounds the number of pages we fetch from a single peer.
+	maxProvidersPages = 50
+)
+
+// providersPage returns the page of at most pageSize providers following token, as well as the token of the next
+// page. Providers are ordered by peer ID and the token is the ID of the last provider of the previous page, so paging
+// is stateless and stable with respect to providers being added or removed between requests.
+func providersPage(provs []peer.AddrInfo, pageSize int, token []byte) ([]peer.AddrInfo, []byte) {
+	if pageSize > maxProvidersPageSize {
+		pageSize = maxProvidersPageSize
+	}
+
+	provs = append([]peer.AddrInfo(nil), provs...)
+	sort.Slice(provs, func(i, j int) bool { return provs[i].ID < provs[j].ID })
+	start := sort.Search(len(provs), func(i int) bool {
+		return bytes.Compare([]byte(provs[i].ID), token) > 0
+	})
+	provs = provs[start:]
+
+	if len(provs) <= pageSize {
+		return provs, nil
+	}
+	page := provs[:pageSize]
+	return page, []byte(page[pageSize-1].ID)
+}
+
+// getProviders asks p for the providers of key, paging through the response until at least want providers have been
+// received or p has no more. A negative want fetches all of them. The closer peers are those of the first page.
+func (dht *IpfsDHT) getProviders(ctx context.Context, p peer.ID, key multihash.Multihash, want int) ([]*peer.AddrInfo, []*peer.AddrInfo, error) {
+	var (
+		provs, closest []*peer.AddrInfo
+		token          []byte
+		err            error
+	)
+	if hints, ok := ctx.Value(lookupHintsKey{}).(*lookupHints); ok {
+		var hint *pb.DetectorHint
+		provs, closest, token, hint, err = dht.protoMessenger.GetProvidersPageWithHint(ctx, p, key, providersPageSize, nil)
+		if err == nil && hint != nil {
+			hints.add(hint.Netsize, dht.detectorHints.verify(dht, hint))
+		}
+	} else {
+		provs, closest, token, err = dht.protoMessenger.GetProvidersPage(ctx, p, key, providersPageSize, nil)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for pages := 1; len(token) > 0 && pages < maxProvidersPages && (want < 0 || len(provs) < want); pages++ {
+		var page []*peer.AddrInfo
+		page, _, token, err = dht.protoMessenger.GetProvidersPage(ctx, p, key, providersPageSize, token)
+		if err != nil {
+			// keep what we have so far
+			logger.Debugw("failed to get providers page", "peer", p, "error", err)
+			break
+		}
+		provs = append(provs, page...)
+	}
+	return provs, closest, nil
+}
@@ -0,0 +1,70 @@
+package dht
+
+import (
+	"context"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/test"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProvidersPage(t *testing.T) {
+	provs := make([]peer.AddrInfo, 5)
+	for i := range provs {
+		provs[i] = peer.AddrInfo{ID: test.RandPeerIDFatal(t)}
+	}
+
+	var (
+		all   []peer.ID
+		token []byte
+	)
+	for pages := 0; ; pages++ {
+		require.Less(t, pages, 3)
+		var page []peer.AddrInfo
+		page, token = providersPage(provs, 2, token)
+		for _, p := range page {
+			all = append(all, p.ID)
+		}
+		if token == nil {
+			break
+		}
+	}
+	require.Len(t, all, 5)
+	for i := range provs {
+		require.Contains(t, all, provs[i].ID)
+	}
+}
+
+func TestGetProvidersPaging(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 2)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			defer d.host.Close()
+		}
+	}()
+	connect(t, ctx, dhts[0], dhts[1])
+
+	key := testCaseCids[0].Hash()
+	const numProviders = 2*providersPageSize + 50
+	for i := 0; i < numProviders; i++ {
+		require.NoError(t, dhts[1].providerStore.AddProvider(ctx, key, peer.AddrInfo{ID: test.RandPeerIDFatal(t)}))
+	}
+
+	provs, _, err := dhts[0].getProviders(ctx, dhts[1].self, key, providersPageSize+1)
+	require.NoError(t, err)
+	require.Len(t, provs, 2*providersPageSize)
+
+	provs, _, err = dhts[0].getProviders(ctx, dhts[1].self, key, -1)
+	require.NoError(t, err)
+	seen := make(map[peer.ID]struct{})
+	for _, p := range provs {
+		seen[p.ID] = struct{}{}
+	}
+	require.Len(t, seen, numProviders)
+}
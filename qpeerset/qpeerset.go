@@ -1,11 +1,11 @@
 package qpeerset
 
 import (
-	"math/big"
+	"bytes"
+	"crypto/sha256"
 	"sort"
 
 	"github.com/libp2p/go-libp2p/core/peer"
-	ks "github.com/whyrusleeping/go-keyspace"
 )
 
 // PeerState describes the state of a peer ID during the lifecycle of an individual lookup.
@@ -25,8 +25,8 @@ const (
 // QueryPeerset maintains the state of a Kademlia asynchronous lookup.
 // The lookup state is a set of peers, each labeled with a peer state.
 type QueryPeerset struct {
-	// the key being searched for
-	key ks.Key
+	// the key being searched for, in the Kademlia keyspace
+	key [sha256.Size]byte
 
 	// all known peers
 	all []queryPeerState
@@ -37,7 +37,7 @@ type QueryPeerset struct {
 
 type queryPeerState struct {
 	id         peer.ID
-	distance   *big.Int
+	distance   [sha256.Size]byte
 	state      PeerState
 	referredBy peer.ID
 }
@@ -53,15 +53,14 @@ func (sqp *sortedQueryPeerset) Swap(i, j int) {
 }
 
 func (sqp *sortedQueryPeerset) Less(i, j int) bool {
-	di, dj := sqp.all[i].distance, sqp.all[j].distance
-	return di.Cmp(dj) == -1
+	return bytes.Compare(sqp.all[i].distance[:], sqp.all[j].distance[:]) < 0
 }
 
 // NewQueryPeerset creates a new empty set of peers.
 // key is the target key of the lookup that this peer set is for.
 func NewQueryPeerset(key string) *QueryPeerset {
 	return &QueryPeerset{
-		key:    ks.XORKeySpace.Key([]byte(key)),
+		key:    sha256.Sum256([]byte(key)),
 		all:    []queryPeerState{},
 		sorted: false,
 	}
@@ -76,8 +75,19 @@ func (qp *QueryPeerset) find(p peer.ID) int {
 	return -1
 }
 
-func (qp *QueryPeerset) distanceToKey(p peer.ID) *big.Int {
-	return ks.XORKeySpace.Key([]byte(p)).Distance(qp.key)
+// Contains returns true if the peerset knows p.
+func (qp *QueryPeerset) Contains(p peer.ID) bool {
+	return qp.find(p) >= 0
+}
+
+// distanceToKey returns the XOR distance of p to the key as a big-endian number, which orders like the distance in
+// the keyspace without allocating big integers.
+func (qp *QueryPeerset) distanceToKey(p peer.ID) (d [sha256.Size]byte) {
+	d = sha256.Sum256([]byte(p))
+	for i := range d {
+		d[i] ^= qp.key[i]
+	}
+	return d
 }
 
 // TryAdd adds the peer p to the peer set.
@@ -14,6 +14,7 @@ import (
 	"github.com/libp2p/go-libp2p/core/routing"
 
 	"github.com/google/uuid"
+	"github.com/libp2p/go-libp2p-kad-dht/internal"
 	"github.com/libp2p/go-libp2p-kad-dht/qpeerset"
 	kb "github.com/libp2p/go-libp2p-kbucket"
 )
@@ -22,7 +23,7 @@ import (
 var ErrNoPeersQueried = errors.New("failed to query any peers")
 
 type queryFn func(context.Context, peer.ID) ([]*peer.AddrInfo, error)
-type stopFn func() bool
+type stopFn func(*lookupState) bool
 
 // query represents a single DHT query.
 type query struct {
@@ -32,6 +33,16 @@ type query struct {
 	// target key for the lookup
 	key string
 
+	// keys caches the Kademlia keys of the peers in lookup events, nil if nobody listens to lookup events
+	keys *internal.KeyCache
+
+	// addrClaims are the addresses claimed for the peers returned by the responders of the query
+	addrClaims addrClaims
+
+	// closerPeerDepth is the number of leading bits the closest peers of the network share with the key, -1 if
+	// unknown or closer peers aren't validated
+	closerPeerDepth int
+
 	// the query context.
 	ctx context.Context
 
@@ -58,6 +69,34 @@ type query struct {
 
 	// stopFn is used to determine if we should stop the WHOLE disjoint query.
 	stopFn stopFn
+
+	// startTime is when the query started running.
+	startTime time.Time
+
+	// rounds is the number of query updates processed so far.
+	rounds int
+
+	// rpcs and failedRPCs count the peers queried and those that failed to answer.
+	rpcs       int
+	failedRPCs int
+	// closerHeard counts the peers returned by the queried peers.
+	closerHeard int
+
+	// k is the number of closest peers the query returns, the bucket size unless set with withLookupSize.
+	k int
+
+	// sampling, if not nil, replaces the lookup termination condition, see withSamplingTermination.
+	sampling *samplingTermination
+
+	// budget bounds the resources of the query, see QueryBudget. dials and peersHeard count the peers dialed and
+	// discovered so far, and budgetExhausted is set to 1 once any budget ran out.
+	budget          queryBudget
+	dials           int32
+	peersHeard      int
+	budgetExhausted int32
+
+	// active is the entry of the query in the registry of in-flight queries, see IpfsDHT.ActiveQueries.
+	active *activeQuery
 }
 
 type lookupWithFollowupResult struct {
@@ -67,21 +106,53 @@ type lookupWithFollowupResult struct {
 	// indicates that neither the lookup nor the followup has been prematurely terminated by an external condition such
 	// as context cancellation or the stop function being called.
 	completed bool
+
+	// budgetExhausted indicates that the query ran out of its query budget and the result is best effort.
+	budgetExhausted bool
+
+	// backups are the next closest not unreachable peers after peers and backupState their states, replacing the
+	// peers the followup fails for with FollowupConfirm
+	backups     []peer.ID
+	backupState []qpeerset.PeerState
 }
 
 // runLookupWithFollowup executes the lookup on the target using the given query function and stopping when either the
-// context is cancelled or the stop function returns true. Note: if the stop function is not sticky, i.e. it does not
-// return true every time after the first time it returns true, it is not guaranteed to cause a stop to occur just
-// because it momentarily returns true.
+// context is cancelled or the stop function returns true. The stop function is handed a snapshot of the lookup state
+// (see lookupState) every time it is consulted. Note: if the stop function is not sticky, i.e. it does not return true
+// every time after the first time it returns true, it is not guaranteed to cause a stop to occur just because it
+// momentarily returns true.
 //
 // After the lookup is complete the query function is run (unless stopped) against all of the top K peers from the
-// lookup that have not already been successfully queried.
+// lookup that have not already been successfully queried, as controlled by the FollowupMode of ctx.
 func (dht *IpfsDHT) runLookupWithFollowup(ctx context.Context, target string, queryFn queryFn, stopFn stopFn) (*lookupWithFollowupResult, error) {
+	return dht.runSeededLookupWithFollowup(ctx, target, nil, queryFn, stopFn)
+}
+
+// runSeededLookupWithFollowup is like runLookupWithFollowup but starts the lookup from the given seed peers instead
+// of the peers closest to the target in our routing table. A nil seed set seeds the lookup from the routing table.
+func (dht *IpfsDHT) runSeededLookupWithFollowup(ctx context.Context, target string, seedPeers []peer.ID, queryFn queryFn, stopFn stopFn) (*lookupWithFollowupResult, error) {
+	rec := startLookupTrace(ctx, target)
+	if rec != nil {
+		ctx = context.WithValue(ctx, traceRecordingKey{}, rec)
+		queryFn = rec.wrap(queryFn)
+	}
+
 	// run the query
-	lookupRes, err := dht.runQuery(ctx, target, queryFn, stopFn)
+	lookupRes, q, err := dht.runQuery(ctx, target, seedPeers, queryFn, stopFn)
 	if err != nil {
 		return nil, err
 	}
+	if rec != nil {
+		defer rec.finish(q.seedPeers, lookupRes)
+	}
+	if q.active.isCancelled() {
+		return nil, ErrQueryCancelled
+	}
+
+	mode := followupMode(ctx)
+	if mode == FollowupSkip {
+		return lookupRes, nil
+	}
 
 	// query all of the top K peers we've either Heard about or have outstanding queries we're Waiting on.
 	// This ensures that all of the top K results have been queried which adds to resiliency against churn for query
@@ -94,69 +165,79 @@ func (dht *IpfsDHT) runLookupWithFollowup(ctx context.Context, target string, qu
 		}
 	}
 
-	if len(queryPeers) == 0 {
-		return lookupRes, nil
-	}
-
-	// return if the lookup has been externally stopped
-	if ctx.Err() != nil || stopFn() {
-		lookupRes.completed = false
-		return lookupRes, nil
-	}
+	followupRPCs := 0
+	for {
+		// the followup counts against the RPC budget
+		if maxRPCs := dht.queryBudget.maxRPCs; maxRPCs > 0 && len(queryPeers) > maxRPCs-q.rpcs-followupRPCs {
+			left := maxRPCs - q.rpcs - followupRPCs
+			if left < 0 {
+				left = 0
+			}
+			queryPeers = queryPeers[:left]
+			lookupRes.budgetExhausted = true
+			lookupRes.completed = false
+		}
 
-	doneCh := make(chan struct{}, len(queryPeers))
-	followUpCtx, cancelFollowUp := context.WithCancel(ctx)
-	defer cancelFollowUp()
-	for _, p := range queryPeers {
-		qp := p
-		go func() {
-			_, _ = queryFn(followUpCtx, qp)
-			doneCh <- struct{}{}
-		}()
-	}
+		if len(queryPeers) == 0 {
+			return lookupRes, nil
+		}
 
-	// wait for all queries to complete before returning, aborting ongoing queries if we've been externally stopped
-	followupsCompleted := 0
-processFollowUp:
-	for i := 0; i < len(queryPeers); i++ {
-		select {
-		case <-doneCh:
-			followupsCompleted++
-			if stopFn() {
-				cancelFollowUp()
-				if i < len(queryPeers)-1 {
-					lookupRes.completed = false
-				}
-				break processFollowUp
-			}
-		case <-ctx.Done():
+		// return if the lookup has been externally stopped
+		if ctx.Err() != nil || stopFn(q.state()) {
 			lookupRes.completed = false
-			cancelFollowUp()
-			break processFollowUp
+			return lookupRes, nil
 		}
-	}
 
-	if !lookupRes.completed {
-		for i := followupsCompleted; i < len(queryPeers); i++ {
-			<-doneCh
+		failed := dht.followup(ctx, q, lookupRes, queryPeers, queryFn, stopFn)
+		followupRPCs += len(queryPeers)
+		if mode != FollowupConfirm || !lookupRes.completed || len(failed) == 0 {
+			return lookupRes, nil
 		}
+		queryPeers = lookupRes.replaceFailed(failed)
 	}
+}
+
+type lookupSizeKey struct{}
 
-	return lookupRes, nil
+// withLookupSize makes the lookups run with the returned context return the k closest peers instead of bucket size
+// peers.
+func withLookupSize(ctx context.Context, k int) context.Context {
+	return context.WithValue(ctx, lookupSizeKey{}, k)
 }
 
-func (dht *IpfsDHT) runQuery(ctx context.Context, target string, queryFn queryFn, stopFn stopFn) (*lookupWithFollowupResult, error) {
-	// pick the K closest peers to the key in our Routing table.
+// lookupSize returns the number of closest peers lookups run with ctx return.
+func (dht *IpfsDHT) lookupSize(ctx context.Context) int {
+	if k, ok := ctx.Value(lookupSizeKey{}).(int); ok && k > 0 {
+		return k
+	}
+	return dht.bucketSize
+}
+
+func (dht *IpfsDHT) runQuery(ctx context.Context, target string, seedPeers []peer.ID, queryFn queryFn, stopFn stopFn) (*lookupWithFollowupResult, *query, error) {
 	targetKadID := kb.ConvertKey(target)
-	seedPeers := dht.routingTable.NearestPeers(targetKadID, dht.bucketSize)
+	k := dht.lookupSize(ctx)
+	if seedPeers == nil {
+		// pick the K closest peers to the key in our Routing table.
+		seedPeers = dht.routingTable.NearestPeers(targetKadID, k)
+		if w := warmPathFrom(ctx); w != nil {
+			seedPeers = dht.filterSeedPeers(append(seedPeers, w.seeds()...))
+		}
+	} else {
+		seedPeers = dht.filterSeedPeers(seedPeers)
+	}
 	if len(seedPeers) == 0 {
 		routing.PublishQueryEvent(ctx, &routing.QueryEvent{
 			Type:  routing.QueryError,
 			Extra: kb.ErrLookupFailure.Error(),
 		})
-		return nil, kb.ErrLookupFailure
+		if dht.blackhole != nil && ctx.Err() == nil && !isLookupReplay(ctx) {
+			dht.blackhole.observe(targetKadID, true)
+		}
+		return nil, nil, kb.ErrLookupFailure
 	}
 
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	q := &query{
 		id:         uuid.New(),
 		key:        target,
@@ -168,17 +249,53 @@ func (dht *IpfsDHT) runQuery(ctx context.Context, target string, queryFn queryFn
 		terminated: false,
 		queryFn:    queryFn,
 		stopFn:     stopFn,
+		startTime:  time.Now(),
+		k:          k,
+		sampling:   newSamplingTermination(ctx),
+		budget:     dht.queryBudget,
 	}
+	if lookupEventsEnabled(ctx) {
+		q.keys = internal.NewKeyCache()
+	}
+	q.closerPeerDepth = -1
+	if dht.closerPeerValidation {
+		q.closerPeerDepth = dht.closerPeerDepth()
+	}
+
+	q.active = dht.queries.register(ctx, q, cancel)
+	defer dht.queries.unregister(q.id)
 
 	// run the query
 	q.run()
 
-	if ctx.Err() == nil {
+	if ctx.Err() == nil && !isLookupReplay(ctx) {
 		q.recordValuablePeers()
+		// lookups stopped before querying anyone, e.g. by their stop function, tell nothing
+		if dht.blackhole != nil && q.rpcs > 0 {
+			dht.blackhole.observe(targetKadID, q.rpcs == q.failedRPCs || q.closerHeard == 0)
+		}
 	}
+	dht.recordLookupStats(ctx, q.lookupStats(targetKadID))
 
 	res := q.constructLookupResult(targetKadID)
-	return res, nil
+	if w := warmPathFrom(ctx); w != nil && ctx.Err() == nil {
+		w.update(res)
+	}
+	return res, q, nil
+}
+
+// filterSeedPeers removes ourselves, duplicates and peers that are not allowed from caller-provided seed peers.
+func (dht *IpfsDHT) filterSeedPeers(seeds []peer.ID) []peer.ID {
+	seen := make(map[peer.ID]struct{}, len(seeds))
+	filtered := make([]peer.ID, 0, len(seeds))
+	for _, p := range seeds {
+		if _, ok := seen[p]; ok || p == dht.self || !dht.peerAllowed(p) {
+			continue
+		}
+		seen[p] = struct{}{}
+		filtered = append(filtered, p)
+	}
+	return filtered
 }
 
 func (q *query) recordPeerIsValuable(p peer.ID) {
@@ -222,7 +339,7 @@ func (q *query) constructLookupResult(target kb.ID) *lookupWithFollowupResult {
 	// extract the top K not unreachable peers
 	var peers []peer.ID
 	peerState := make(map[peer.ID]qpeerset.PeerState)
-	qp := q.queryPeers.GetClosestNInStates(q.dht.bucketSize, qpeerset.PeerHeard, qpeerset.PeerWaiting, qpeerset.PeerQueried)
+	qp := q.queryPeers.GetClosestNInStates(q.k, qpeerset.PeerHeard, qpeerset.PeerWaiting, qpeerset.PeerQueried)
 	for _, p := range qp {
 		state := q.queryPeers.GetState(p)
 		peerState[p] = state
@@ -231,21 +348,32 @@ func (q *query) constructLookupResult(target kb.ID) *lookupWithFollowupResult {
 
 	// get the top K overall peers
 	sortedPeers := kb.SortClosestPeers(peers, target)
-	if len(sortedPeers) > q.dht.bucketSize {
-		sortedPeers = sortedPeers[:q.dht.bucketSize]
+	if len(sortedPeers) > q.k {
+		sortedPeers = sortedPeers[:q.k]
 	}
 
 	// return the top K not unreachable peers as well as their states at the end of the query
 	res := &lookupWithFollowupResult{
-		peers:     sortedPeers,
-		state:     make([]qpeerset.PeerState, len(sortedPeers)),
-		completed: completed,
+		peers:           sortedPeers,
+		state:           make([]qpeerset.PeerState, len(sortedPeers)),
+		completed:       completed && !q.isBudgetExhausted(),
+		budgetExhausted: q.isBudgetExhausted(),
 	}
 
 	for i, p := range sortedPeers {
 		res.state[i] = peerState[p]
 	}
 
+	if followupMode(q.ctx) == FollowupConfirm {
+		closest := q.queryPeers.GetClosestNInStates(2*q.k, qpeerset.PeerHeard, qpeerset.PeerWaiting, qpeerset.PeerQueried)
+		for _, p := range closest {
+			if _, ok := peerState[p]; !ok {
+				res.backups = append(res.backups, p)
+				res.backupState = append(res.backupState, q.queryPeers.GetState(p))
+			}
+		}
+	}
+
 	return res
 }
 
@@ -298,17 +426,15 @@ func (q *query) run() {
 		for _, p := range qPeers {
 			q.spawnQuery(pathCtx, cause, p, ch)
 		}
+		q.updateSnapshot()
 	}
 }
 
 // spawnQuery starts one query, if an available heard peer is found
 func (q *query) spawnQuery(ctx context.Context, cause peer.ID, queryPeer peer.ID, ch chan<- *queryUpdate) {
-	PublishLookupEvent(ctx,
-		NewLookupEvent(
-			q.dht.self,
-			q.id,
-			q.key,
-			NewLookupUpdateEvent(
+	if q.keys != nil {
+		q.publishLookupEvent(ctx,
+			q.lookupUpdateEvent(
 				cause,
 				q.queryPeers.GetReferrer(queryPeer),
 				nil,                  // heard
@@ -318,16 +444,17 @@ func (q *query) spawnQuery(ctx context.Context, cause peer.ID, queryPeer peer.ID
 			),
 			nil,
 			nil,
-		),
-	)
+		)
+	}
 	q.queryPeers.SetState(queryPeer, qpeerset.PeerWaiting)
+	q.rpcs++
 	q.waitGroup.Add(1)
 	go q.queryPeer(ctx, ch, queryPeer)
 }
 
 func (q *query) isReadyToTerminate(ctx context.Context, nPeersToQuery int) (bool, LookupTerminationReason, []peer.ID) {
 	// give the application logic a chance to terminate
-	if q.stopFn() {
+	if q.stopFn(q.state()) {
 		return true, LookupStopped, nil
 	}
 	if q.isStarvationTermination() {
@@ -337,6 +464,21 @@ func (q *query) isReadyToTerminate(ctx context.Context, nPeersToQuery int) (bool
 		return true, LookupCompleted, nil
 	}
 
+	// stay within the RPC budget, and stop once it is used up and the outstanding queries returned
+	if q.budget.maxRPCs > 0 {
+		left := q.budget.maxRPCs - q.rpcs
+		if left <= 0 {
+			q.exhaustBudget()
+			if q.queryPeers.NumWaiting() == 0 {
+				return true, LookupBudgetExhausted, nil
+			}
+			return false, -1, nil
+		}
+		if nPeersToQuery > left {
+			nPeersToQuery = left
+		}
+	}
+
 	// The peers we query next should be ones that we have only Heard about.
 	var peersToQuery []peer.ID
 	peers := q.queryPeers.GetClosestInStates(qpeerset.PeerHeard)
@@ -355,6 +497,9 @@ func (q *query) isReadyToTerminate(ctx context.Context, nPeersToQuery int) (bool
 // From the set of all nodes that are not unreachable,
 // if the closest beta nodes are all queried, the lookup can terminate.
 func (q *query) isLookupTermination() bool {
+	if q.sampling != nil {
+		return q.sampling.done(q)
+	}
 	peers := q.queryPeers.GetClosestNInStates(q.dht.beta, qpeerset.PeerHeard, qpeerset.PeerWaiting, qpeerset.PeerQueried)
 	for _, p := range peers {
 		if q.queryPeers.GetState(p) != qpeerset.PeerQueried {
@@ -373,16 +518,9 @@ func (q *query) terminate(ctx context.Context, cancel context.CancelFunc, reason
 		return
 	}
 
-	PublishLookupEvent(ctx,
-		NewLookupEvent(
-			q.dht.self,
-			q.id,
-			q.key,
-			nil,
-			nil,
-			NewLookupTerminateEvent(reason),
-		),
-	)
+	if q.keys != nil {
+		q.publishLookupEvent(ctx, nil, nil, NewLookupTerminateEvent(reason))
+	}
 	cancel() // abort outstanding queries
 	q.terminated = true
 }
@@ -392,22 +530,41 @@ func (q *query) terminate(ctx context.Context, cancel context.CancelFunc, reason
 func (q *query) queryPeer(ctx context.Context, ch chan<- *queryUpdate, p peer.ID) {
 	defer q.waitGroup.Done()
 	dialCtx, queryCtx := ctx, ctx
+	// replayed lookups run offline and must leave the routing table alone
+	replay := isLookupReplay(ctx)
 
 	// dial the peer
-	if err := q.dht.dialPeer(dialCtx, p); err != nil {
-		// remove the peer if there was a dial failure..but not because of a context cancellation
-		if dialCtx.Err() == nil {
-			q.dht.peerStoppedDHT(q.dht.ctx, p)
+	if !replay {
+		if !q.takeDial(p) {
+			opLogger(ctx).Debugw("skipping peer, lookup dial budget exhausted", "peer", p)
+			ch <- &queryUpdate{cause: p, unreachable: []peer.ID{p}}
+			return
+		}
+		startDial := time.Now()
+		if err := q.dht.dialPeer(dialCtx, p); err != nil {
+			// dial failures are part of the trace, replays don't dial
+			if rec := lookupTraceRecording(dialCtx); rec != nil {
+				rec.record(dialCtx, LookupTraceResponse{Peer: p}, startDial, err)
+			}
+			// remove the peer if there was a dial failure..but not because of a context cancellation, backed off peers
+			// were removed when their dial failed
+			if dialCtx.Err() == nil && err != errDialBackoff {
+				q.dht.peerStoppedDHT(q.dht.ctx, p)
+			}
+			ch <- &queryUpdate{cause: p, unreachable: []peer.ID{p}}
+			return
 		}
-		ch <- &queryUpdate{cause: p, unreachable: []peer.ID{p}}
-		return
 	}
 
+	queryCtx, cancelQuery := q.dht.withRPCTimeout(queryCtx, p)
+	defer cancelQuery()
+
 	startQuery := time.Now()
 	// send query RPC to the remote peer
 	newPeers, err := q.queryFn(queryCtx, p)
 	if err != nil {
-		if queryCtx.Err() == nil {
+		// busy peers are shedding load, they didn't stop being DHT servers
+		if queryCtx.Err() == nil && !replay && !errors.Is(err, ErrBusy) {
 			q.dht.peerStoppedDHT(q.dht.ctx, p)
 		}
 		ch <- &queryUpdate{cause: p, unreachable: []peer.ID{p}}
@@ -416,14 +573,36 @@ func (q *query) queryPeer(ctx context.Context, ch chan<- *queryUpdate, p peer.ID
 
 	queryDuration := time.Since(startQuery)
 
+	newPeers, duplicates := dedupeCloserPeers(newPeers)
+	if duplicates > 0 {
+		opLogger(ctx).Debugw("dropping duplicate closer peers", "from", p, "duplicates", duplicates)
+		q.dht.recordAnomaly(ctx, anomalyDuplicate, 1)
+	}
+	newPeers, irrelevant := q.validateCloserPeers(ctx, p, newPeers)
+	q.checkAddrClaims(ctx, p, newPeers)
+
 	// query successful, try to add to RT
-	q.dht.peerFound(q.dht.ctx, p, true)
+	if !replay {
+		if duplicates > 0 {
+			q.dht.penalize(p)
+		} else if irrelevant {
+			q.dht.recordBehavior(p, true)
+		} else {
+			q.dht.observeBehavior(p, newPeers)
+		}
+		q.dht.peerFound(q.dht.ctx, p, true)
+	}
 
 	// process new peers
 	saw := []peer.ID{}
 	for _, next := range newPeers {
 		if next.ID == q.dht.self { // don't add self.
-			logger.Debugf("PEERS CLOSER -- worker for: %v found self", p)
+			opLogger(ctx).Debugw("closer peers contain self", "from", p)
+			continue
+		}
+
+		if q.dht.candidateFilter != nil && !q.dht.candidateFilter(p, next) {
+			opLogger(ctx).Debugw("candidate filter vetoed closer peer", "from", p, "peer", next.ID)
 			continue
 		}
 
@@ -436,6 +615,9 @@ func (q *query) queryPeer(ctx context.Context, ch chan<- *queryUpdate, p peer.ID
 		// add the next peer to the query if matches the query target even if it would otherwise fail the query filter
 		// TODO: this behavior is really specific to how FindPeer works and not GetClosestPeers or any other function
 		isTarget := string(next.ID) == q.key
+		if !q.dht.peerAllowed(next.ID) {
+			continue
+		}
 		if isTarget || q.dht.queryPeerFilter(q.dht, *next) {
 			q.dht.maybeAddAddrs(next.ID, next.Addrs, pstore.TempAddrTTL)
 			saw = append(saw, next.ID)
@@ -449,13 +631,14 @@ func (q *query) updateState(ctx context.Context, up *queryUpdate) {
 	if q.terminated {
 		panic("update should not be invoked after the logical lookup termination")
 	}
-	PublishLookupEvent(ctx,
-		NewLookupEvent(
-			q.dht.self,
-			q.id,
-			q.key,
+	q.rounds++
+	if up.cause != q.dht.self {
+		q.closerHeard += len(up.heard)
+	}
+	if q.keys != nil {
+		q.publishLookupEvent(ctx,
 			nil,
-			NewLookupUpdateEvent(
+			q.lookupUpdateEvent(
 				up.cause,
 				up.cause,
 				up.heard,       // heard
@@ -464,12 +647,16 @@ func (q *query) updateState(ctx context.Context, up *queryUpdate) {
 				up.unreachable, // unreachable
 			),
 			nil,
-		),
-	)
+		)
+	}
 	for _, p := range up.heard {
 		if p == q.dht.self { // don't add self.
 			continue
 		}
+		// seed peers don't count against the budget of discovered peers
+		if up.cause != q.dht.self && !q.queryPeers.Contains(p) && !q.admitPeer() {
+			continue
+		}
 		q.queryPeers.TryAdd(p, up.cause)
 	}
 	for _, p := range up.queried {
@@ -490,27 +677,71 @@ func (q *query) updateState(ctx context.Context, up *queryUpdate) {
 
 		if st := q.queryPeers.GetState(p); st == qpeerset.PeerWaiting {
 			q.queryPeers.SetState(p, qpeerset.PeerUnreachable)
+			q.failedRPCs++
 		} else {
 			panic(fmt.Errorf("kademlia protocol error: tried to transition to the unreachable state from state %v", st))
 		}
 	}
 }
 
+// rpcTimeoutLatencyFactor is the multiple of a peer's observed latency we are willing to wait for a response.
+const rpcTimeoutLatencyFactor = 5
+
+// rpcTimeout returns the adaptive timeout for a single RPC to p. The timeout is derived from the latency EWMA the
+// peerstore keeps for p, clamped to the configured bounds. A zero return value means no timeout.
+func (dht *IpfsDHT) rpcTimeout(p peer.ID) time.Duration {
+	if dht.rpcTimeoutMax == 0 {
+		return 0
+	}
+
+	latency := dht.peerstore.LatencyEWMA(p)
+	if latency == 0 {
+		// never measured, be conservative
+		return dht.rpcTimeoutMax
+	}
+
+	timeout := rpcTimeoutLatencyFactor * latency
+	if timeout < dht.rpcTimeoutMin {
+		return dht.rpcTimeoutMin
+	}
+	if timeout > dht.rpcTimeoutMax {
+		return dht.rpcTimeoutMax
+	}
+	return timeout
+}
+
+// withRPCTimeout derives a context bounded by the adaptive RPC timeout for p.
+func (dht *IpfsDHT) withRPCTimeout(ctx context.Context, p peer.ID) (context.Context, context.CancelFunc) {
+	timeout := dht.rpcTimeout(p)
+	if timeout == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
 func (dht *IpfsDHT) dialPeer(ctx context.Context, p peer.ID) error {
 	// short-circuit if we're already connected.
 	if dht.host.Network().Connectedness(p) == network.Connected {
 		return nil
 	}
 
-	logger.Debug("not connected. dialing.")
-	routing.PublishQueryEvent(ctx, &routing.QueryEvent{
+	if dht.dialBackoff != nil && dht.dialBackoff.backedOff(p) {
+		opLogger(ctx).Debugw("skipping backed off peer", "peer", p)
+		return errDialBackoff
+	}
+
+	opLogger(ctx).Debugw("not connected, dialing", "peer", p)
+	publishQueryEvent(ctx, &routing.QueryEvent{
 		Type: routing.DialingPeer,
 		ID:   p,
 	})
 
 	pi := peer.AddrInfo{ID: p}
 	if err := dht.host.Connect(ctx, pi); err != nil {
-		logger.Debugf("error connecting: %s", err)
+		opLogger(ctx).Debugw("error connecting", "peer", p, "error", err)
+		if dht.dialBackoff != nil && ctx.Err() == nil {
+			dht.dialBackoff.failed(p)
+		}
 		routing.PublishQueryEvent(ctx, &routing.QueryEvent{
 			Type:  routing.QueryError,
 			Extra: err.Error(),
@@ -519,6 +750,54 @@ func (dht *IpfsDHT) dialPeer(ctx context.Context, p peer.ID) error {
 
 		return err
 	}
-	logger.Debugf("connected. dial success.")
+	opLogger(ctx).Debugw("connected, dial succeeded", "peer", p)
+	if dht.dialBackoff != nil {
+		dht.dialBackoff.succeeded(p)
+	}
 	return nil
 }
+
+// publishLookupEvent publishes a lookup event of q, like PublishLookupEvent with NewLookupEvent but converting the
+// node and key through the key cache of q. It must only be called if q.keys is set.
+func (q *query) publishLookupEvent(ctx context.Context, request, response *LookupUpdateEvent, terminate *LookupTerminateEvent) {
+	PublishLookupEvent(ctx, &LookupEvent{
+		Node:      q.peerKadID(q.dht.self),
+		ID:        q.id,
+		Key:       &KeyKadID{Key: q.key, Kad: q.keys.Key(q.key)},
+		Request:   request,
+		Response:  response,
+		Terminate: terminate,
+	})
+}
+
+// lookupUpdateEvent is NewLookupUpdateEvent converting the peers through the key cache of q, so that peers appearing
+// in several events of the lookup are only converted once.
+func (q *query) lookupUpdateEvent(cause, source peer.ID, heard, waiting, queried, unreachable []peer.ID) *LookupUpdateEvent {
+	return &LookupUpdateEvent{
+		Cause:       q.optPeerKadID(cause),
+		Source:      q.optPeerKadID(source),
+		Heard:       q.peerKadIDs(heard),
+		Waiting:     q.peerKadIDs(waiting),
+		Queried:     q.peerKadIDs(queried),
+		Unreachable: q.peerKadIDs(unreachable),
+	}
+}
+
+func (q *query) peerKadID(p peer.ID) *PeerKadID {
+	return &PeerKadID{Peer: p, Kad: q.keys.Key(string(p))}
+}
+
+func (q *query) optPeerKadID(p peer.ID) *PeerKadID {
+	if p == "" {
+		return nil
+	}
+	return q.peerKadID(p)
+}
+
+func (q *query) peerKadIDs(ps []peer.ID) []*PeerKadID {
+	r := make([]*PeerKadID, len(ps))
+	for i := range ps {
+		r[i] = q.peerKadID(ps[i])
+	}
+	return r
+}
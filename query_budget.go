@@ -0,0 +1,48 @@
+package dht
+
+import (
+	"sync/atomic"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// queryBudget bounds the resources a single lookup may use, zero values being unlimited, see QueryBudget.
+type queryBudget struct {
+	maxRPCs  int
+	maxDials int
+	maxPeers int
+}
+
+// takeDial uses up one dial of the budget to query p, returning false if p must be dialed but the dial budget is
+// exhausted. Called concurrently from the query workers.
+func (q *query) takeDial(p peer.ID) bool {
+	if q.budget.maxDials <= 0 || q.dht.host.Network().Connectedness(p) == network.Connected {
+		return true
+	}
+	if atomic.AddInt32(&q.dials, 1) <= int32(q.budget.maxDials) {
+		return true
+	}
+	q.exhaustBudget()
+	return false
+}
+
+// admitPeer returns false if the query has discovered as many peers as its budget allows. Only called from the query
+// loop.
+func (q *query) admitPeer() bool {
+	if q.budget.maxPeers <= 0 || q.peersHeard < q.budget.maxPeers {
+		q.peersHeard++
+		return true
+	}
+	q.exhaustBudget()
+	return false
+}
+
+func (q *query) exhaustBudget() {
+	atomic.StoreInt32(&q.budgetExhausted, 1)
+}
+
+// isBudgetExhausted returns true if the query ran out of any of its budgets and returns best-effort results.
+func (q *query) isBudgetExhausted() bool {
+	return atomic.LoadInt32(&q.budgetExhausted) == 1
+}
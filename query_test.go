@@ -2,12 +2,25 @@ package dht
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/routing"
+	"github.com/libp2p/go-libp2p/core/test"
+	"github.com/libp2p/go-libp2p/p2p/host/eventbus"
+
+	"github.com/libp2p/go-libp2p-kad-dht/qpeerset"
+	kb "github.com/libp2p/go-libp2p-kbucket"
 	tu "github.com/libp2p/go-libp2p-testing/etc"
 
+	"github.com/benbjohnson/clock"
+	"github.com/google/uuid"
+	ma "github.com/multiformats/go-multiaddr"
 	"github.com/stretchr/testify/require"
 )
 
@@ -116,3 +129,898 @@ func checkRoutingTable(a, b *IpfsDHT) bool {
 	// under high load, this may not happen as immediately as we would like.
 	return a.routingTable.Find(b.self) != "" && b.routingTable.Find(a.self) != ""
 }
+
+func TestStopWhenTopKStable(t *testing.T) {
+	qp := qpeerset.NewQueryPeerset("test")
+	for i := 0; i < 3; i++ {
+		p := test.RandPeerIDFatal(t)
+		qp.TryAdd(p, "")
+		qp.SetState(p, qpeerset.PeerQueried)
+	}
+
+	stop := stopWhenTopKStable(3, 2)
+	state := &lookupState{key: "test", peerset: qp}
+
+	// the first round only records the top peers
+	state.rounds = 1
+	require.False(t, stop(state))
+	// consulting the stop function again in the same round doesn't count as stability
+	require.False(t, stop(state))
+
+	state.rounds = 2
+	require.False(t, stop(state))
+
+	// a newly heard, not yet queried peer doesn't change the top 3 and the third stable round terminates
+	p := test.RandPeerIDFatal(t)
+	qp.TryAdd(p, "")
+	state.rounds = 3
+	require.True(t, stop(state))
+
+	// termination is sticky
+	require.True(t, stop(state))
+}
+
+func TestSamplingTermination(t *testing.T) {
+	qp := qpeerset.NewQueryPeerset("test")
+	var peers []peer.ID
+	for i := 0; i < 3; i++ {
+		p := test.RandPeerIDFatal(t)
+		qp.TryAdd(p, "")
+		peers = append(peers, p)
+	}
+	q := &query{queryPeers: qp, k: 3}
+	q.sampling = newSamplingTermination(withSamplingTermination(context.Background(), 2))
+	require.NotNil(t, q.sampling)
+
+	// the closest peers must all be queried, unlike the regular termination only requiring the beta closest
+	q.rounds = 1
+	require.False(t, q.isLookupTermination())
+	for _, p := range peers {
+		qp.SetState(p, qpeerset.PeerQueried)
+	}
+	q.rounds = 2
+	require.False(t, q.isLookupTermination())
+	q.rounds = 3
+	require.False(t, q.isLookupTermination())
+	require.False(t, q.isLookupTermination())
+	q.rounds = 4
+	require.True(t, q.isLookupTermination())
+
+	require.Nil(t, newSamplingTermination(context.Background()))
+}
+
+func TestRPCTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false, RPCTimeout(time.Second, 5*time.Second))
+	defer d.Close()
+
+	unknown := test.RandPeerIDFatal(t)
+	require.Equal(t, 5*time.Second, d.rpcTimeout(unknown), "peers without latency data should get the max timeout")
+
+	fast := test.RandPeerIDFatal(t)
+	d.peerstore.RecordLatency(fast, time.Millisecond)
+	require.Equal(t, time.Second, d.rpcTimeout(fast))
+
+	medium := test.RandPeerIDFatal(t)
+	d.peerstore.RecordLatency(medium, 500*time.Millisecond)
+	require.Equal(t, rpcTimeoutLatencyFactor*500*time.Millisecond, d.rpcTimeout(medium))
+
+	slow := test.RandPeerIDFatal(t)
+	d.peerstore.RecordLatency(slow, 3*time.Second)
+	require.Equal(t, 5*time.Second, d.rpcTimeout(slow))
+
+	disabled := setupDHT(ctx, t, false, RPCTimeout(0, 0))
+	defer disabled.Close()
+	require.Zero(t, disabled.rpcTimeout(slow))
+}
+
+func TestDialBackoff(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false, DialBackoff(time.Hour, 4*time.Hour))
+	defer d.Close()
+
+	// the peer has no addresses, dialing it fails
+	unreachable := test.RandPeerIDFatal(t)
+	require.Error(t, d.dialPeer(ctx, unreachable))
+	require.ErrorIs(t, d.dialPeer(ctx, unreachable), errDialBackoff)
+
+	// the backoff doubles with consecutive failures, up to the max
+	clk := clock.NewMock()
+	b := newDialBackoff(time.Minute, 3*time.Minute, clk)
+	for _, want := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute} {
+		b.failed(unreachable)
+		e := b.peers[unreachable]
+		require.Equal(t, want, e.until.Sub(e.lastFailure))
+	}
+	require.True(t, b.backedOff(unreachable))
+	clk.Add(3 * time.Minute)
+	require.False(t, b.backedOff(unreachable))
+
+	// failures decay
+	clk.Add(time.Hour)
+	b.failed(unreachable)
+	require.Equal(t, 1, b.peers[unreachable].failures)
+
+	b.succeeded(unreachable)
+	require.False(t, b.backedOff(unreachable))
+
+	disabled := setupDHT(ctx, t, false, DialBackoff(0, 0))
+	defer disabled.Close()
+	require.Nil(t, disabled.dialBackoff)
+}
+
+func TestCloserPeerValidation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false, CloserPeerValidation(1))
+	defer d.Close()
+
+	target := kb.ConvertKey("foo")
+	// randPeerWithCPL returns a peer sharing at least (or, if exact, exactly) cpl leading bits with the target
+	randPeerWithCPL := func(cpl int, exact bool) peer.ID {
+		for {
+			p := test.RandPeerIDFatal(t)
+			c := kb.CommonPrefixLen(kb.ConvertPeerID(p), target)
+			if c == cpl || (!exact && c > cpl) {
+				return p
+			}
+		}
+	}
+
+	responder := randPeerWithCPL(4, true)
+	far := []*peer.AddrInfo{{ID: randPeerWithCPL(0, true)}, {ID: randPeerWithCPL(1, true)}, {ID: randPeerWithCPL(2, true)}}
+	near := []*peer.AddrInfo{{ID: randPeerWithCPL(3, false)}, {ID: randPeerWithCPL(5, false)}}
+
+	q := &query{dht: d, key: "foo", closerPeerDepth: -1}
+	relevant, irrelevant := q.validateCloserPeers(ctx, responder, append(append([]*peer.AddrInfo{}, near...), far...))
+	require.Equal(t, near, relevant)
+	require.True(t, irrelevant)
+
+	relevant, irrelevant = q.validateCloserPeers(ctx, responder, append(append([]*peer.AddrInfo{}, near...), far[2]))
+	require.Equal(t, near, relevant)
+	require.False(t, irrelevant)
+
+	// responders closer to the target than the closest peers of the network aren't expected to know closer peers
+	q.closerPeerDepth = 1
+	relevant, irrelevant = q.validateCloserPeers(ctx, responder, far)
+	require.Equal(t, far, relevant)
+	require.False(t, irrelevant)
+}
+
+func TestResponseAnomalies(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false)
+	defer d.Close()
+	other := setupDHT(ctx, t, false)
+	defer other.Close()
+	connect(t, ctx, d, other)
+
+	a, b := test.RandPeerIDFatal(t), test.RandPeerIDFatal(t)
+	unique, duplicates := dedupeCloserPeers([]*peer.AddrInfo{{ID: a}, {ID: b}, {ID: a}, {ID: a}})
+	require.Equal(t, []*peer.AddrInfo{{ID: a}, {ID: b}}, unique)
+	require.Equal(t, 2, duplicates)
+
+	addr := func(s string) []ma.Multiaddr { return []ma.Multiaddr{ma.StringCast(s)} }
+	q := &query{dht: d}
+	// we are connected to other over loopback, so the responder claiming another address for it is penalized
+	q.checkAddrClaims(ctx, a, []*peer.AddrInfo{{ID: other.self, Addrs: addr("/ip4/127.0.0.1/tcp/4001")}})
+	q.checkAddrClaims(ctx, b, []*peer.AddrInfo{{ID: other.self, Addrs: addr("/ip4/6.6.6.6/tcp/4001")}})
+	// without connections, conflicts are only counted
+	unknown := test.RandPeerIDFatal(t)
+	q.checkAddrClaims(ctx, a, []*peer.AddrInfo{{ID: unknown, Addrs: addr("/ip4/1.2.3.4/tcp/4001")}})
+	q.checkAddrClaims(ctx, b, []*peer.AddrInfo{{ID: unknown, Addrs: addr("/ip4/5.6.7.8/tcp/4001")}})
+	// overlapping addresses don't conflict
+	q.checkAddrClaims(ctx, b, []*peer.AddrInfo{{ID: unknown, Addrs: addr("/ip4/1.2.3.4/udp/4001/quic")}})
+
+	require.Equal(t, ResponseAnomalies{ConflictingAddrs: 2, Penalized: 1}, d.ResponseAnomalies())
+}
+
+func TestLookupEvents(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 5)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			defer d.host.Close()
+		}
+	}()
+	for i := 1; i < len(dhts); i++ {
+		connect(t, ctx, dhts[0], dhts[i])
+	}
+
+	evCtx, events := RegisterForLookupEvents(ctx)
+	done := make(chan struct{})
+	var evs []*LookupEvent
+	go func() {
+		defer close(done)
+		for ev := range events {
+			evs = append(evs, ev)
+		}
+	}()
+	_, err := dhts[0].GetClosestPeers(evCtx, "foo")
+	require.NoError(t, err)
+	cancel()
+	<-done
+
+	require.NotEmpty(t, evs)
+	require.NotNil(t, evs[len(evs)-1].Terminate)
+	for _, ev := range evs {
+		require.Equal(t, dhts[0].self, ev.Node.Peer)
+		require.Equal(t, kb.ConvertPeerID(dhts[0].self), ev.Node.Kad)
+		require.Equal(t, kb.ConvertKey("foo"), ev.Key.Kad)
+		for _, up := range []*LookupUpdateEvent{ev.Request, ev.Response} {
+			if up == nil {
+				continue
+			}
+			for _, p := range append(up.Heard, up.Waiting...) {
+				require.Equal(t, kb.ConvertPeerID(p.Peer), p.Kad)
+			}
+		}
+	}
+}
+
+func TestLookupTraceReplay(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 15)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			defer d.host.Close()
+		}
+	}()
+	for i := range dhts {
+		connect(t, ctx, dhts[i], dhts[(i+1)%len(dhts)])
+		connect(t, ctx, dhts[i], dhts[(i+5)%len(dhts)])
+	}
+
+	recCtx, rec := RecordLookups(ctx)
+	peers, err := dhts[0].GetClosestPeers(recCtx, "foo")
+	require.NoError(t, err)
+	require.Len(t, rec.Traces(), 1)
+
+	// the trace survives serialization
+	b, err := json.Marshal(rec.Traces()[0])
+	require.NoError(t, err)
+	var trace LookupTrace
+	require.NoError(t, json.Unmarshal(b, &trace))
+	require.Equal(t, peers, trace.Result)
+	require.NotEmpty(t, trace.Responses)
+
+	// replay on a DHT that is not connected to anyone, it only learns about the peers in the trace
+	offline := setupDHT(ctx, t, false)
+	defer offline.Close()
+	replay, err := offline.ReplayLookup(ctx, &trace, 1)
+	require.NoError(t, err)
+	require.NotEmpty(t, replay.Queried)
+	require.NotEmpty(t, replay.Result)
+	require.Zero(t, offline.routingTable.Size())
+
+	known := make(map[peer.ID]struct{})
+	for _, r := range trace.Responses {
+		known[r.Peer] = struct{}{}
+		for _, ai := range r.CloserPeers {
+			known[ai.ID] = struct{}{}
+		}
+	}
+	for _, p := range replay.Result {
+		require.Contains(t, known, p)
+	}
+}
+
+func TestLookupTraceReplayDeterministic(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	offline := setupDHT(ctx, t, false)
+	defer offline.Close()
+
+	var ids []peer.ID
+	for i := 0; i < 3; i++ {
+		ids = append(ids, test.RandPeerIDFatal(t))
+	}
+	addr := ma.StringCast("/ip4/1.2.3.4/tcp/4001")
+
+	// ids[0] knows the other two, ids[2] is unreachable and ids[1] was only aborted the first time it was queried
+	trace := &LookupTrace{
+		Key:   []byte("foo"),
+		Seeds: ids[:1],
+		Responses: []LookupTraceResponse{
+			{Peer: ids[0], CloserPeers: []peer.AddrInfo{{ID: ids[1], Addrs: []ma.Multiaddr{addr}}, {ID: ids[2], Addrs: []ma.Multiaddr{addr}}}},
+			{Peer: ids[1], Error: "context canceled", Canceled: true},
+			{Peer: ids[2], Error: "dial backoff"},
+			{Peer: ids[1]},
+		},
+	}
+
+	for i := 0; i < 3; i++ {
+		replay, err := offline.ReplayLookup(ctx, trace, 0)
+		require.NoError(t, err)
+		require.ElementsMatch(t, ids[:2], replay.Result)
+		require.Subset(t, replay.Queried, ids)
+		require.Empty(t, replay.Unknown)
+	}
+}
+
+func TestLookupStats(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 10)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			defer d.host.Close()
+		}
+	}()
+	// a line, so the lookup has to walk
+	for i := 0; i < len(dhts)-1; i++ {
+		connect(t, ctx, dhts[i], dhts[i+1])
+	}
+
+	statsCtx, collector := CollectLookupStats(ctx)
+	_, err := dhts[0].GetClosestPeers(statsCtx, "foo")
+	require.NoError(t, err)
+
+	stats := collector.Stats()
+	require.Len(t, stats, 1)
+	s := stats[0]
+	require.Equal(t, "foo", s.Key)
+	require.GreaterOrEqual(t, s.Hops, 2)
+	require.GreaterOrEqual(t, s.RPCs, s.Hops)
+	require.Len(t, s.ClosestCPL, s.Hops)
+	require.Len(t, s.DistanceImprovement(), s.Hops-1)
+
+	s = &LookupStats{ClosestCPL: []int{3, 5, -1, 4, 9}}
+	require.Equal(t, []int{2, 0, 0, 4}, s.DistanceImprovement())
+}
+
+func TestQueryBudget(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 10)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			defer d.host.Close()
+		}
+	}()
+	// a line, so the lookup has to walk
+	for i := 0; i < len(dhts)-1; i++ {
+		connect(t, ctx, dhts[i], dhts[i+1])
+	}
+
+	lookup := func(budget queryBudget) (*lookupWithFollowupResult, int) {
+		dhts[0].queryBudget = budget
+		var (
+			mu   sync.Mutex
+			rpcs int
+		)
+		res, err := dhts[0].runLookupWithFollowup(ctx, "foo", func(ctx context.Context, p peer.ID) ([]*peer.AddrInfo, error) {
+			mu.Lock()
+			rpcs++
+			mu.Unlock()
+			return dhts[0].protoMessenger.GetClosestPeers(ctx, p, peer.ID("foo"))
+		}, func(*lookupState) bool { return false })
+		require.NoError(t, err)
+		return res, rpcs
+	}
+
+	// only the seed we are connected to and a single dialed peer answer, lookups connect to the peers they query so
+	// this goes first
+	res, rpcs := lookup(queryBudget{maxDials: 1})
+	require.True(t, res.budgetExhausted)
+	require.LessOrEqual(t, rpcs, 2)
+
+	res, rpcs = lookup(queryBudget{})
+	require.False(t, res.budgetExhausted)
+	require.Greater(t, rpcs, 3)
+
+	res, rpcs = lookup(queryBudget{maxRPCs: 3})
+	require.True(t, res.budgetExhausted)
+	require.False(t, res.completed)
+	require.LessOrEqual(t, rpcs, 3, "the followup must count against the budget")
+
+	// a single peer is discovered in addition to the seed
+	for _, p := range dhts[0].routingTable.ListPeers() {
+		if p != dhts[1].self {
+			dhts[0].routingTable.RemovePeer(p)
+		}
+	}
+	res, _ = lookup(queryBudget{maxPeers: 1})
+	require.True(t, res.budgetExhausted)
+	require.LessOrEqual(t, len(res.peers), 2)
+
+}
+
+func TestGetClosestPeersK(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 10)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			defer d.host.Close()
+		}
+	}()
+	for i := 1; i < len(dhts); i++ {
+		connect(t, ctx, dhts[0], dhts[i])
+	}
+	// the routing table holds all peers, but lookups return fewer by default
+	dhts[0].bucketSize = 4
+
+	all := make([]peer.ID, 0, len(dhts)-1)
+	for _, d := range dhts[1:] {
+		all = append(all, d.self)
+	}
+	all = kb.SortClosestPeers(all, kb.ConvertKey("foo"))
+
+	peers, err := dhts[0].GetClosestPeers(ctx, "foo")
+	require.NoError(t, err)
+	require.Len(t, peers, 4)
+
+	// more than the bucket size
+	peers, err = dhts[0].GetClosestPeersK(ctx, "foo", 8)
+	require.NoError(t, err)
+	require.Equal(t, all[:8], peers)
+
+	// fewer than the bucket size
+	peers, err = dhts[0].GetClosestPeersK(ctx, "foo", 2)
+	require.NoError(t, err)
+	require.Equal(t, all[:2], peers)
+
+	_, err = dhts[0].GetClosestPeersK(ctx, "foo", 0)
+	require.Error(t, err)
+}
+
+func TestSampleClosestPeers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 10)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			defer d.host.Close()
+		}
+	}()
+	// a line, so the lookup has to walk
+	for i := 0; i < len(dhts)-1; i++ {
+		connect(t, ctx, dhts[i], dhts[i+1])
+	}
+
+	all := make([]peer.ID, 0, len(dhts)-1)
+	for _, d := range dhts[1:] {
+		all = append(all, d.self)
+	}
+	peers, err := dhts[0].sampleClosestPeers(ctx, "foo")
+	require.NoError(t, err)
+	require.Equal(t, kb.SortClosestPeers(all, kb.ConvertKey("foo")), peers)
+}
+
+func TestCPLLookupBudget(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false)
+	defer d.Close()
+	defer d.host.Close()
+
+	// every lookup returns peers close to the key, so that the region looks densely populated
+	lookups := 0
+	requestFn := func(ctx context.Context, key string) ([]peer.ID, error) {
+		lookups++
+		rt, err := kb.NewRoutingTable(20, kb.ConvertKey(key), time.Minute, d.host.Peerstore(), time.Minute, nil)
+		require.NoError(t, err)
+		peers := make([]peer.ID, 4)
+		for i := range peers {
+			peers[i], err = rt.GenRandPeerID(uint(12 + i))
+			require.NoError(t, err)
+		}
+		return peers, nil
+	}
+
+	// lookup budget
+	d.cplMaxLookups = 3
+	_, n, err := d.GetPeersWithCPL(ctx, "key", 8, requestFn)
+	require.ErrorIs(t, err, ErrCPLBudgetExceeded)
+	require.Equal(t, 3, n)
+	require.Equal(t, 3, lookups)
+
+	// peer budget
+	d.cplMaxLookups, d.cplMaxPeers, lookups = 0, 5, 0
+	peers, n, err := d.GetPeersWithCPL(ctx, "key", 0, requestFn)
+	require.ErrorIs(t, err, ErrCPLBudgetExceeded)
+	require.Equal(t, 2, n)
+	require.Len(t, peers, 5)
+
+	// time budget
+	d.cplMaxPeers, d.cplTimeout = 0, 50*time.Millisecond
+	_, _, err = d.GetPeersWithCPL(ctx, "key", 8, func(ctx context.Context, _ string) ([]peer.ID, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	require.ErrorIs(t, err, ErrCPLBudgetExceeded)
+
+	// the caller's context is not mistaken for the time budget
+	cctx, ccancel := context.WithCancel(ctx)
+	ccancel()
+	_, _, err = d.GetPeersWithCPL(cctx, "key", 8, func(ctx context.Context, _ string) ([]peer.ID, error) {
+		return nil, ctx.Err()
+	})
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func TestCPLLookupQueryEvents(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	nDHTs := 4
+	dhts := setupDHTS(t, ctx, nDHTs)
+	defer func() {
+		for i := 0; i < nDHTs; i++ {
+			dhts[i].Close()
+			defer dhts[i].host.Close()
+		}
+	}()
+	for i := 1; i < nDHTs; i++ {
+		connect(t, ctx, dhts[0], dhts[i])
+	}
+
+	ctx, events := routing.RegisterForQueryEvents(ctx)
+	var tags []string
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for ev := range events {
+			if ev.Type == routing.SendingQuery || ev.Type == routing.PeerResponse {
+				tags = append(tags, ev.Extra)
+			}
+		}
+	}()
+
+	_, n, err := dhts[0].GetPeersWithCPL(ctx, "key", 0, dhts[0].GetClosestPeers)
+	require.NoError(t, err)
+	cancel()
+	<-done
+
+	// the first lookup enumerates the whole keyspace, the others the regions closer to the sampled keys
+	require.Greater(t, n, 1)
+	require.NotEmpty(t, tags)
+	regions := make(map[string]struct{})
+	for _, tag := range tags {
+		require.True(t, strings.HasPrefix(tag, regionEventPrefix), "untagged query event: %q", tag)
+		regions[tag] = struct{}{}
+	}
+	require.Contains(t, regions, regionEventPrefix+"0/")
+	require.Greater(t, len(regions), 1)
+}
+
+func TestRegionCache(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	nDHTs := 5
+	dhts := setupDHTS(t, ctx, nDHTs, RegionCacheTTL(time.Minute))
+	defer func() {
+		for i := 0; i < nDHTs; i++ {
+			dhts[i].Close()
+			defer dhts[i].host.Close()
+		}
+	}()
+	for i := 1; i < nDHTs; i++ {
+		connect(t, ctx, dhts[0], dhts[i])
+	}
+
+	peers, n, err := dhts[0].GetPeersWithCPLGet(ctx, "key", 0)
+	require.NoError(t, err)
+	require.NotZero(t, n)
+
+	// the region is served from the cache, as are regions it encloses
+	cached, n, err := dhts[0].GetPeersWithCPLGet(ctx, "key", 0)
+	require.NoError(t, err)
+	require.Zero(t, n)
+	require.Equal(t, peers, cached)
+
+	target := kb.ConvertKey("key")
+	inner, ok := dhts[0].regionCache.get(target, 1)
+	require.True(t, ok)
+	for _, p := range inner {
+		require.GreaterOrEqual(t, kb.CommonPrefixLen(kb.ConvertPeerID(p), target), 1)
+	}
+
+	// regions containing a peer found unreachable are dropped
+	dhts[0].regionCache.invalidatePeer(peers[0])
+	_, ok = dhts[0].regionCache.get(target, 0)
+	require.False(t, ok)
+
+	// as are expired regions
+	dhts[0].regionCache.ttl = -time.Second
+	dhts[0].regionCache.put(target, 0, peers)
+	_, ok = dhts[0].regionCache.get(target, 0)
+	require.False(t, ok)
+}
+
+func TestClosestPeersCache(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	nDHTs := 4
+	dhts := setupDHTS(t, ctx, nDHTs, ClosestPeersCacheTTL(time.Minute))
+	for i := 1; i < nDHTs; i++ {
+		connect(t, ctx, dhts[0], dhts[i])
+	}
+	d := dhts[0]
+
+	peers, err := d.GetClosestPeers(ctx, "key")
+	require.NoError(t, err)
+	require.NotEmpty(t, peers)
+	require.Equal(t, ClosestPeersCacheStats{Entries: 1, Misses: 1}, d.ClosestPeersCacheStats())
+
+	// the lookup is served from the cache
+	cached, err := d.GetClosestPeers(ctx, "key")
+	require.NoError(t, err)
+	require.Equal(t, peers, cached)
+	require.Equal(t, ClosestPeersCacheStats{Entries: 1, Hits: 1, Misses: 1}, d.ClosestPeersCacheStats())
+
+	// but not lookups reporting their progress
+	qctx, events := routing.RegisterForQueryEvents(ctx)
+	go func() {
+		for range events {
+		}
+	}()
+	_, err = d.GetClosestPeers(qctx, "key")
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), d.ClosestPeersCacheStats().Hits)
+
+	// keys are dropped explicitly, or because one of their closest peers turned out unreachable
+	d.InvalidateClosestPeers("key")
+	_, ok := d.closestCache.get("key", false)
+	require.False(t, ok)
+	d.closestCache.put("key", peers)
+	d.closestCache.invalidatePeer(peers[0])
+	_, ok = d.closestCache.get("key", false)
+	require.False(t, ok)
+	require.Equal(t, ClosestPeersCacheStats{Hits: 1, Misses: 1, Invalidations: 2}, d.ClosestPeersCacheStats())
+
+	// as are expired keys
+	d.closestCache.ttl = -time.Second
+	d.closestCache.put("key", peers)
+	_, ok = d.closestCache.get("key", false)
+	require.False(t, ok)
+}
+
+func TestBlackholeDetection(t *testing.T) {
+	bus := eventbus.NewBus()
+	b, err := newBlackholeDetector(bus, 3)
+	require.NoError(t, err)
+	sub, err := bus.Subscribe(new(EvtBlackholeStatusChanged), eventbus.BufSize(16))
+	require.NoError(t, err)
+	defer sub.Close()
+	next := func() EvtBlackholeStatusChanged {
+		t.Helper()
+		select {
+		case e := <-sub.Out():
+			return e.(EvtBlackholeStatusChanged)
+		case <-time.After(time.Second):
+			t.Fatal("expected a blackhole status event")
+		}
+		return EvtBlackholeStatusChanged{}
+	}
+
+	key := func(prefix byte) kb.ID {
+		k := make(kb.ID, 32)
+		k[0] = prefix
+		return k
+	}
+
+	// lookups of one region keep failing while the others succeed
+	for i := 0; i < 3; i++ {
+		b.observe(key(0x01), true)
+		b.observe(key(0x02), false)
+	}
+	require.Equal(t, EvtBlackholeStatusChanged{Kind: BlackholeTargeted, Regions: []string{"01"}, FailedLookups: 3}, next())
+
+	// lookups of all regions fail
+	b.observe(key(0x02), true)
+	b.observe(key(0x03), true)
+	b.observe(key(0x04), true)
+	require.Equal(t, EvtBlackholeStatusChanged{Kind: BlackholeLocal, FailedLookups: 3}, next())
+
+	b.observe(key(0x01), false)
+	require.Equal(t, BlackholeNone, next().Kind)
+
+	// without any peer to start lookups from, we are in a local blackhole
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d := setupDHT(ctx, t, false, BlackholeDetection(2))
+
+	require.Equal(t, BlackholeNone, d.BlackholeStatus().Kind)
+	for i := 0; i < 2; i++ {
+		_, _ = d.GetClosestPeers(ctx, fmt.Sprint("key", i))
+	}
+	require.Equal(t, BlackholeLocal, d.BlackholeStatus().Kind)
+
+	sub, err = d.BlackholeEvents()
+	require.NoError(t, err)
+	defer sub.Close()
+	require.Equal(t, BlackholeLocal, next().Kind)
+}
+
+func TestActiveQueries(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false)
+	peers := setupDHTS(t, ctx, 2)
+	for _, p := range peers {
+		connect(t, ctx, d, p)
+	}
+	require.Empty(t, d.ActiveQueries())
+
+	// the peers never answer
+	queried := make(chan struct{}, len(peers))
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := d.runLookupWithFollowup(ctx, "key",
+			func(ctx context.Context, p peer.ID) ([]*peer.AddrInfo, error) {
+				queried <- struct{}{}
+				<-ctx.Done()
+				return nil, ctx.Err()
+			},
+			func(*lookupState) bool { return false },
+		)
+		errCh <- err
+	}()
+	for range peers {
+		<-queried
+	}
+
+	var info QueryInfo
+	require.Eventually(t, func() bool {
+		active := d.ActiveQueries()
+		if len(active) != 1 {
+			return false
+		}
+		info = active[0]
+		return info.Waiting == len(peers)
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, "key", info.Key)
+	require.Equal(t, len(peers), info.RPCs)
+	require.Zero(t, info.Queried)
+	require.Zero(t, info.Heard)
+
+	require.True(t, d.CancelQuery(info.ID))
+	require.ErrorIs(t, <-errCh, ErrQueryCancelled)
+	require.Empty(t, d.ActiveQueries())
+	require.False(t, d.CancelQuery(info.ID))
+}
+
+func TestCorrelationID(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false)
+	peers := setupDHTS(t, ctx, 2)
+	for _, p := range peers {
+		connect(t, ctx, d, p)
+	}
+	connect(t, ctx, peers[0], peers[1])
+
+	lookup := func(ctx context.Context) ([]*LookupEvent, []*LookupTrace) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		ctx, events := RegisterForLookupEvents(ctx)
+		ctx, rec := RecordLookups(ctx)
+
+		var evs []*LookupEvent
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for ev := range events {
+				evs = append(evs, ev)
+			}
+		}()
+		_, err := d.FindProviders(ctx, testCaseCids[0])
+		require.NoError(t, err)
+		cancel()
+		<-done
+		return evs, rec.Traces()
+	}
+
+	// the caller's correlation ID is used
+	id := uuid.New()
+	events, traces := lookup(WithCorrelationID(ctx, id))
+	require.NotEmpty(t, events)
+	for _, ev := range events {
+		require.Equal(t, id, ev.Operation)
+	}
+	require.NotEmpty(t, traces)
+	for _, tr := range traces {
+		require.Equal(t, id, tr.Operation)
+	}
+
+	// otherwise a new one is assigned per operation
+	events, _ = lookup(ctx)
+	require.NotEmpty(t, events)
+	op := events[0].Operation
+	require.NotEqual(t, uuid.Nil, op)
+	require.NotEqual(t, id, op)
+	for _, ev := range events {
+		require.Equal(t, op, ev.Operation)
+	}
+	other, _ := lookup(ctx)
+	require.NotEqual(t, op, other[0].Operation)
+}
+
+func TestFollowupModes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the lookup terminates once it queried the closest peer, one peer at a time
+	d := setupDHT(ctx, t, false, Resiliency(1), Concurrency(1))
+	seed := test.RandPeerIDFatal(t)
+	var closer []*peer.AddrInfo
+	for i := 0; i < 8; i++ {
+		closer = append(closer, &peer.AddrInfo{ID: test.RandPeerIDFatal(t), Addrs: []ma.Multiaddr{ma.StringCast("/ip4/1.2.3.4/tcp/4001")}})
+	}
+
+	// offline lookup where the seed knows all peers and the followup always fails
+	lookup := func(mode FollowupMode) (*lookupWithFollowupResult, map[peer.ID]bool, *LookupTrace) {
+		var mu sync.Mutex
+		answered := make(map[peer.ID]bool)
+		lctx := context.WithValue(withLookupSize(WithFollowup(ctx, mode), 4), lookupReplayKey{}, true)
+		lctx, rec := RecordLookups(lctx)
+		res, err := d.runSeededLookupWithFollowup(lctx, "key", []peer.ID{seed},
+			func(ctx context.Context, p peer.ID) ([]*peer.AddrInfo, error) {
+				if isFollowup(ctx) {
+					return nil, fmt.Errorf("unreachable in followup")
+				}
+				mu.Lock()
+				answered[p] = true
+				mu.Unlock()
+				if p == seed {
+					return closer, nil
+				}
+				return nil, nil
+			},
+			func(*lookupState) bool { return false },
+		)
+		require.NoError(t, err)
+		return res, answered, rec.Traces()[0]
+	}
+
+	res, answered, trace := lookup(FollowupDefault)
+	require.Len(t, res.peers, 4)
+	require.NotEmpty(t, trace.FollowupOnly)
+	for _, p := range trace.FollowupOnly {
+		require.False(t, answered[p])
+	}
+
+	res, _, trace = lookup(FollowupSkip)
+	require.Len(t, res.peers, 4)
+	require.Empty(t, trace.FollowupOnly)
+	for _, r := range trace.Responses {
+		require.False(t, r.Followup)
+	}
+
+	// the peers failing the followup are replaced, only peers that answered are left
+	res, answered, _ = lookup(FollowupConfirm)
+	require.NotEmpty(t, res.peers)
+	for i, p := range res.peers {
+		require.True(t, answered[p], "peer %d never answered", i)
+		require.Equal(t, qpeerset.PeerQueried, res.state[i])
+	}
+}
@@ -0,0 +1,175 @@
+package dht
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jbenet/goprocess"
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/p2p/host/eventbus"
+)
+
+// readinessCheckInterval is how often the state of the DHT is re-evaluated in the absence of routing table changes.
+const readinessCheckInterval = 5 * time.Second
+
+// State is the state of the DHT, see IpfsDHT.State.
+type State int
+
+const (
+	// StateBootstrapping is the state of a DHT that was never ready yet.
+	StateBootstrapping State = iota
+	// StateDegraded is the state of a DHT that was ready but no longer meets the readiness criteria.
+	StateDegraded
+	// StateReady is the state of a DHT meeting the readiness criteria, see ReadinessCriteria.
+	StateReady
+)
+
+func (s State) String() string {
+	switch s {
+	case StateBootstrapping:
+		return "bootstrapping"
+	case StateDegraded:
+		return "degraded"
+	case StateReady:
+		return "ready"
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+// EvtStateChanged is emitted when the state of the DHT changes, see IpfsDHT.StateEvents.
+type EvtStateChanged struct {
+	From, To State
+}
+
+// readiness tracks the state of the DHT.
+type readiness struct {
+	minPeers       int
+	requireNetsize bool
+	emitter        event.Emitter
+
+	mu    sync.Mutex
+	state State
+	ready chan struct{}
+	// refreshed is whether the last refresh of the routing table succeeded
+	refreshed bool
+}
+
+func newReadiness(bus event.Bus, minPeers int, requireNetsize bool) (*readiness, error) {
+	emitter, err := bus.Emitter(new(EvtStateChanged))
+	if err != nil {
+		return nil, err
+	}
+	return &readiness{
+		minPeers:       minPeers,
+		requireNetsize: requireNetsize,
+		emitter:        emitter,
+		ready:          make(chan struct{}),
+	}, nil
+}
+
+// refreshFinished records the outcome of a refresh of the routing table.
+func (dht *IpfsDHT) refreshFinished(ok bool) {
+	r := dht.readiness
+	r.mu.Lock()
+	r.refreshed = ok
+	r.mu.Unlock()
+	dht.updateState()
+}
+
+// meetsReadiness tells whether the DHT meets the readiness criteria: a routing table of at least the minimum number of
+// peers, a successful last refresh and, if required, a network size estimate.
+func (dht *IpfsDHT) meetsReadiness(refreshed bool) bool {
+	r := dht.readiness
+	if !refreshed || dht.routingTable.Size() < r.minPeers {
+		return false
+	}
+	if r.requireNetsize {
+		if _, err := dht.nsEstimator.NetworkSize(); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// updateState re-evaluates the state of the DHT and returns it, emitting EvtStateChanged if it changed.
+func (dht *IpfsDHT) updateState() State {
+	r := dht.readiness
+	r.mu.Lock()
+	refreshed := r.refreshed
+	r.mu.Unlock()
+	ok := dht.meetsReadiness(refreshed)
+
+	r.mu.Lock()
+	from := r.state
+	switch {
+	case ok:
+		r.state = StateReady
+	case from == StateReady:
+		r.state = StateDegraded
+	}
+	to := r.state
+	if to == StateReady && from != StateReady {
+		select {
+		case <-r.ready:
+		default:
+			close(r.ready)
+		}
+	}
+	r.mu.Unlock()
+
+	if from != to {
+		logger.Infow("dht state changed", "from", from, "to", to)
+		if to == StateReady && dht.provideDeferral != nil {
+			dht.provideDeferral.notify()
+		}
+		if err := r.emitter.Emit(EvtStateChanged{From: from, To: to}); err != nil {
+			logger.Debugw("failed to emit state change", "error", err)
+		}
+	}
+	return to
+}
+
+// State returns the state of the DHT: bootstrapping until it meets the readiness criteria for the first time, see
+// ReadinessCriteria, then ready, or degraded while it no longer meets them.
+func (dht *IpfsDHT) State() State {
+	return dht.updateState()
+}
+
+// Ready returns a channel closed once the DHT meets the readiness criteria for the first time, see
+// ReadinessCriteria. Applications can wait on it before providing or putting values, which would otherwise reach
+// peers that aren't the closest to the keys. The DHT can become degraded afterwards, see State.
+func (dht *IpfsDHT) Ready() <-chan struct{} {
+	return dht.readiness.ready
+}
+
+// StateEvents subscribes to the state changes of the DHT, delivered as EvtStateChanged events.
+//
+// The subscription must be closed when no longer needed.
+func (dht *IpfsDHT) StateEvents(opts ...event.SubscriptionOpt) (event.Subscription, error) {
+	return dht.rtEvents.bus.Subscribe(new(EvtStateChanged), opts...)
+}
+
+// watchReadiness re-evaluates the state of the DHT on routing table changes and every readinessCheckInterval until
+// proc closes.
+func (dht *IpfsDHT) watchReadiness(proc goprocess.Process) {
+	defer dht.readiness.emitter.Close()
+	sub, err := dht.rtEvents.bus.Subscribe(new(EvtRoutingTableChanged), eventbus.BufSize(rtEventsBufferSize))
+	if err != nil {
+		logger.Errorw("failed to subscribe to routing table events", "error", err)
+		return
+	}
+	defer sub.Close()
+
+	ticker := dht.clock.Ticker(readinessCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sub.Out():
+		case <-ticker.C:
+		case <-proc.Closing():
+			return
+		}
+		dht.updateState()
+	}
+}
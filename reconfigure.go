@@ -0,0 +1,68 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// ConfigChanges are the changes applied by Reconfigure, nil fields are left unchanged.
+type ConfigChanges struct {
+	// DetectionThreshold overrides the KL divergence threshold the eclipse detector otherwise derives from the network
+	// size estimate, 0 reverts to the derived threshold.
+	DetectionThreshold *float64
+	// SpecialProvideNumber is the number of peers the keyspace region special provides send provider records to is
+	// expected to contain, see SetSpecialProvideNumber.
+	SpecialProvideNumber *int
+	// ProvideWorkers is the number of concurrent provides of the provide queue, see EnableProvideQueue.
+	ProvideWorkers *int
+	// RefreshInterval is the interval between routing table refreshes, see RoutingTableRefreshPeriod.
+	RefreshInterval *time.Duration
+}
+
+// Reconfigure changes a vetted subset of the configuration at runtime, e.g. to respond to an ongoing attack without
+// restarting the node. All changes are validated before any is applied, an invalid change fails the whole call. It
+// returns the error of ctx if it is canceled before the refresh interval change is taken up, in which case the other
+// changes are already applied.
+func (dht *IpfsDHT) Reconfigure(ctx context.Context, changes ConfigChanges) error {
+	if t := changes.DetectionThreshold; t != nil && (*t < 0 || math.IsNaN(*t)) {
+		return fmt.Errorf("detection threshold must not be negative")
+	}
+	if n := changes.SpecialProvideNumber; n != nil && *n <= 0 {
+		return fmt.Errorf("special provide number must be positive")
+	}
+	if n := changes.ProvideWorkers; n != nil {
+		if dht.provideQueue == nil {
+			return fmt.Errorf("provide queue is not enabled")
+		} else if *n <= 0 {
+			return fmt.Errorf("provide workers must be positive")
+		}
+	}
+	if d := changes.RefreshInterval; d != nil && *d <= 0 {
+		return fmt.Errorf("refresh interval must be positive")
+	}
+
+	if t := changes.DetectionThreshold; t != nil {
+		atomic.StoreUint64(&dht.detectionThreshold, math.Float64bits(*t))
+	}
+	if n := changes.SpecialProvideNumber; n != nil {
+		dht.SetSpecialProvideNumber(*n)
+	}
+	if n := changes.ProvideWorkers; n != nil {
+		dht.provideQueue.setWorkers(*n)
+	}
+	if d := changes.RefreshInterval; d != nil {
+		if err := dht.rtRefreshManager.SetRefreshInterval(ctx, *d); err != nil {
+			return err
+		}
+	}
+	logger.Info("reconfigured dht")
+	return nil
+}
+
+// getDetectionThreshold returns the detection threshold set with Reconfigure, 0 if the detector derives it.
+func (dht *IpfsDHT) getDetectionThreshold() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&dht.detectionThreshold))
+}
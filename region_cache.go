@@ -0,0 +1,200 @@
+package dht
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"github.com/libp2p/go-libp2p-kad-dht/internal"
+	kb "github.com/libp2p/go-libp2p-kbucket"
+)
+
+// maxRegionCacheEntries bounds the number of keyspace regions kept in the region cache.
+const maxRegionCacheEntries = 1024
+
+// regionCache caches the peers found by enumerating a keyspace region, the keys sharing a prefix of a given length,
+// so that special provides of keys hashing to the same region share a single enumeration. Concurrent enumerations of
+// the same region are coalesced.
+type regionCache struct {
+	ttl time.Duration
+
+	mu       sync.Mutex
+	regions  map[string]*regionEntry
+	inflight map[string]*regionCall
+}
+
+type regionEntry struct {
+	peers   []peer.ID
+	expires time.Time
+}
+
+type regionCall struct {
+	done  chan struct{}
+	peers []peer.ID
+	ok    bool
+}
+
+func newRegionCache(ttl time.Duration) *regionCache {
+	return &regionCache{
+		ttl:      ttl,
+		regions:  make(map[string]*regionEntry),
+		inflight: make(map[string]*regionCall),
+	}
+}
+
+// regionKey identifies the region of the keys sharing the first cpl bits with target.
+func regionKey(target kb.ID, cpl int) string {
+	if cpl > 8*len(target) {
+		cpl = 8 * len(target)
+	}
+	return strconv.Itoa(cpl) + "/" + string(regionPrefix(target, cpl))
+}
+
+// regionPrefix returns the first cpl bits of target, padded with zeros to whole bytes.
+func regionPrefix(target kb.ID, cpl int) []byte {
+	if cpl > 8*len(target) {
+		cpl = 8 * len(target)
+	}
+	prefix := make([]byte, (cpl+7)/8)
+	copy(prefix, target)
+	if rem := cpl % 8; rem != 0 {
+		prefix[len(prefix)-1] &= byte(0xff << (8 - rem))
+	}
+	return prefix
+}
+
+// get returns the cached peers sharing at least minCPL bits with target. A cached enclosing region serves as well,
+// its peers are narrowed down to the requested region.
+func (rc *regionCache) get(target kb.ID, minCPL int) ([]peer.ID, bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	now := time.Now()
+	for cpl := minCPL; cpl >= 0; cpl-- {
+		e, ok := rc.regions[regionKey(target, cpl)]
+		if !ok {
+			continue
+		}
+		if now.After(e.expires) {
+			delete(rc.regions, regionKey(target, cpl))
+			continue
+		}
+		if cpl == minCPL {
+			return e.peers, true
+		}
+		peers := make([]peer.ID, 0, len(e.peers))
+		for _, p := range e.peers {
+			if pHash := internal.KadKey(string(p)); internal.CommonPrefixLen(pHash[:], target) >= minCPL {
+				peers = append(peers, p)
+			}
+		}
+		return peers, true
+	}
+	return nil, false
+}
+
+func (rc *regionCache) put(target kb.ID, minCPL int, peers []peer.ID) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	now := time.Now()
+	if len(rc.regions) >= maxRegionCacheEntries {
+		for k, e := range rc.regions {
+			if now.After(e.expires) {
+				delete(rc.regions, k)
+			}
+		}
+		if len(rc.regions) >= maxRegionCacheEntries {
+			rc.regions = make(map[string]*regionEntry)
+		}
+	}
+	rc.regions[regionKey(target, minCPL)] = &regionEntry{peers: peers, expires: now.Add(rc.ttl)}
+}
+
+// invalidatePeer drops all regions p was found in, e.g. because p turned out to be unreachable.
+func (rc *regionCache) invalidatePeer(p peer.ID) {
+	if rc == nil {
+		return
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	for k, e := range rc.regions {
+		for _, other := range e.peers {
+			if other == p {
+				delete(rc.regions, k)
+				break
+			}
+		}
+	}
+}
+
+func (rc *regionCache) clear() {
+	rc.mu.Lock()
+	rc.regions = make(map[string]*regionEntry)
+	rc.mu.Unlock()
+}
+
+// getPeersWithCPLCached enumerates the region of the keys sharing at least minCPL bits with key, going through the
+// region cache if enabled. Partial results, e.g. because the lookup budget was exceeded, are not cached.
+func (dht *IpfsDHT) getPeersWithCPLCached(ctx context.Context, key string, minCPL int) ([]peer.ID, int, error) {
+	rc := dht.regionCache
+	if rc == nil {
+		return dht.GetPeersWithCPL(ctx, key, minCPL, dht.GetClosestPeers)
+	}
+	if minCPL < 0 {
+		minCPL = 0
+	}
+	target := kb.ConvertKey(key)
+
+	for {
+		if peers, ok := rc.get(target, minCPL); ok {
+			logger.Debugw("region cache hit", "minCPL", minCPL, "peers", len(peers))
+			return kb.SortClosestPeers(peers, target), 0, nil
+		}
+
+		rk := regionKey(target, minCPL)
+		rc.mu.Lock()
+		call, ok := rc.inflight[rk]
+		if !ok {
+			call = &regionCall{done: make(chan struct{})}
+			rc.inflight[rk] = call
+		}
+		rc.mu.Unlock()
+
+		if ok {
+			// another provide is enumerating the same region, wait for it
+			select {
+			case <-call.done:
+			case <-ctx.Done():
+				return nil, 0, ctx.Err()
+			}
+			if call.ok {
+				return kb.SortClosestPeers(call.peers, target), 0, nil
+			}
+			// it failed, try ourselves
+			continue
+		}
+
+		peers, numLookups, err := dht.GetPeersWithCPL(ctx, key, minCPL, dht.GetClosestPeers)
+		if err == nil {
+			rc.put(target, minCPL, peers)
+			call.peers, call.ok = peers, true
+		}
+		rc.mu.Lock()
+		delete(rc.inflight, rk)
+		rc.mu.Unlock()
+		close(call.done)
+		return peers, numLookups, err
+	}
+}
+
+// InvalidateRegionCache drops all keyspace regions cached by special provides, forcing the next provides to enumerate
+// their regions again.
+func (dht *IpfsDHT) InvalidateRegionCache() {
+	if dht.regionCache != nil {
+		dht.regionCache.clear()
+	}
+}
@@ -0,0 +1,116 @@
+package dht
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	u "github.com/ipfs/go-ipfs-util"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multihash"
+
+	kb "github.com/libp2p/go-libp2p-kbucket"
+)
+
+const (
+	// regionScanKeys is the number of synthetic keys ScanRegion runs the eclipse detection on.
+	regionScanKeys = 8
+	// regionScanAttackRatio is the fraction of the scanned keys found under attack from which ScanRegion finds the
+	// whole region under attack.
+	regionScanAttackRatio = 0.5
+	// maxRegionScanCPL bounds the length of the regions ScanRegion scans, since finding keys in a region takes
+	// 2^cpl hashes.
+	maxRegionScanCPL = 20
+)
+
+// RegionKeyScan is the outcome of the eclipse detection on a key of a region scanned with ScanRegion.
+type RegionKeyScan struct {
+	Key    multihash.Multihash
+	Attack bool
+	Err    error
+}
+
+// RegionScan is the outcome of ScanRegion.
+type RegionScan struct {
+	// Prefix and CPL identify the region, the keys whose Kademlia IDs share the first CPL bits with Prefix.
+	Prefix []byte
+	CPL    int
+	Keys   []RegionKeyScan
+	// Scanned and Attacked are the number of keys the detection ran on, and found under attack.
+	Scanned, Attacked int
+	// Attack is the verdict on the region, set if at least half of the scanned keys were found under attack.
+	Attack bool
+}
+
+// ScanRegion runs the eclipse detection on several synthetic keys of the keyspace region of the keys whose Kademlia
+// IDs, see kb.ConvertKey, share their first cpl bits with prefix, and aggregates a verdict on the whole region. It
+// detects attacks aimed at the key range of a content publisher rather than a single key.
+//
+// The keys are found by hashing random data until enough of them fall into the region, cpl is therefore limited to
+// 20. An error is only returned if the region is invalid or the detection failed on every key.
+func (dht *IpfsDHT) ScanRegion(ctx context.Context, prefix []byte, cpl int) (*RegionScan, error) {
+	if cpl < 0 || cpl > maxRegionScanCPL || cpl > 8*len(prefix) {
+		return nil, fmt.Errorf("invalid region: prefix of %d bits, cpl %d, at most %d", 8*len(prefix), cpl, maxRegionScanCPL)
+	}
+	keys, err := regionKeys(kb.ID(prefix), cpl, regionScanKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &RegionScan{Prefix: regionPrefix(kb.ID(prefix), cpl), CPL: cpl, Keys: make([]RegionKeyScan, len(keys))}
+	var wg sync.WaitGroup
+	for i, key := range keys {
+		wg.Add(1)
+		go func(i int, key multihash.Multihash) {
+			defer wg.Done()
+			s := RegionKeyScan{Key: key}
+			var peers []peer.ID
+			if peers, s.Err = dht.sampleClosestPeers(ctx, string(key)); s.Err == nil {
+				s.Attack, s.Err = dht.EclipseDetection(ctx, key, peers)
+			}
+			res.Keys[i] = s
+		}(i, key)
+	}
+	wg.Wait()
+
+	for _, s := range res.Keys {
+		if s.Err != nil {
+			err = s.Err
+			continue
+		}
+		res.Scanned++
+		if s.Attack {
+			res.Attacked++
+		}
+	}
+	if res.Scanned == 0 {
+		return nil, err
+	}
+	res.Attack = float64(res.Attacked) >= regionScanAttackRatio*float64(res.Scanned)
+	if res.Attack {
+		logger.Warnw("keyspace region under attack", "prefix", res.Prefix, "cpl", cpl, "attacked", res.Attacked,
+			"scanned", res.Scanned)
+	}
+	return res, nil
+}
+
+// regionKeys returns n random multihashes whose Kademlia IDs share their first cpl bits with prefix.
+func regionKeys(prefix kb.ID, cpl, n int) ([]multihash.Multihash, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	target := make(kb.ID, 32)
+	copy(target, prefix)
+	keys := make([]multihash.Multihash, 0, n)
+	for i := uint64(0); len(keys) < n; i++ {
+		binary.BigEndian.PutUint64(buf, i)
+		key := u.Hash(buf)
+		if kb.CommonPrefixLen(kb.ConvertKey(string(key)), target) >= cpl {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,133 @@
+package dht
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+
+	kb "github.com/libp2p/go-libp2p-kbucket"
+)
+
+// keylessRequestCPL is the priority of requests without a key, e.g. pings, which are cheap to handle and handled
+// before any other.
+const keylessRequestCPL = 8*32 + 1
+
+// requestScheduler lets at most slots inbound requests be handled at a time. Free slots go to the waiting request
+// whose key is the closest to us first, the records of those keys being the ones we are responsible for.
+type requestScheduler struct {
+	slots int
+
+	mu      sync.Mutex
+	running int
+	waiting waitingRequests
+	seq     uint64
+}
+
+func newRequestScheduler(slots int) *requestScheduler {
+	return &requestScheduler{slots: slots}
+}
+
+// waitingRequest is a request waiting for a slot, ordered by the common prefix length of its key with our ID and then
+// by arrival.
+type waitingRequest struct {
+	cpl   int
+	seq   uint64
+	ready chan struct{}
+	// index is the position of the request in the heap, -1 once it was handed a slot
+	index int
+}
+
+type waitingRequests []*waitingRequest
+
+func (w waitingRequests) Len() int { return len(w) }
+
+func (w waitingRequests) Less(i, j int) bool {
+	if w[i].cpl != w[j].cpl {
+		return w[i].cpl > w[j].cpl
+	}
+	return w[i].seq < w[j].seq
+}
+
+func (w waitingRequests) Swap(i, j int) {
+	w[i], w[j] = w[j], w[i]
+	w[i].index, w[j].index = i, j
+}
+
+func (w *waitingRequests) Push(x interface{}) {
+	r := x.(*waitingRequest)
+	r.index = len(*w)
+	*w = append(*w, r)
+}
+
+func (w *waitingRequests) Pop() interface{} {
+	old := *w
+	r := old[len(old)-1]
+	old[len(old)-1] = nil
+	r.index = -1
+	*w = old[:len(old)-1]
+	return r
+}
+
+// acquire waits for a slot for a request for a key sharing cpl bits with our ID, to be freed with release. It fails
+// if ctx is done first.
+func (s *requestScheduler) acquire(ctx context.Context, cpl int) error {
+	s.mu.Lock()
+	if s.running < s.slots && len(s.waiting) == 0 {
+		s.running++
+		s.mu.Unlock()
+		return nil
+	}
+	s.seq++
+	r := &waitingRequest{cpl: cpl, seq: s.seq, ready: make(chan struct{})}
+	heap.Push(&s.waiting, r)
+	s.mu.Unlock()
+
+	select {
+	case <-r.ready:
+		return nil
+	case <-ctx.Done():
+	}
+	s.mu.Lock()
+	if r.index >= 0 {
+		heap.Remove(&s.waiting, r.index)
+		s.mu.Unlock()
+	} else {
+		// handed a slot meanwhile
+		s.mu.Unlock()
+		s.release()
+	}
+	return ctx.Err()
+}
+
+// release frees a slot, handing it to the waiting request of highest priority.
+func (s *requestScheduler) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.waiting) > 0 {
+		close(heap.Pop(&s.waiting).(*waitingRequest).ready)
+		return
+	}
+	s.running--
+}
+
+// requestCPL returns the priority of req, the common prefix length of its key with our ID.
+func (dht *IpfsDHT) requestCPL(req *pb.Message) int {
+	if len(req.GetKey()) == 0 {
+		return keylessRequestCPL
+	}
+	return kb.CommonPrefixLen(dht.selfKey, kb.ConvertKey(string(req.GetKey())))
+}
+
+// scheduleRequest waits for a slot to handle req, see RequestPrioritization, returning the function freeing it.
+func (dht *IpfsDHT) scheduleRequest(ctx context.Context, req *pb.Message) (func(), error) {
+	s := dht.requestScheduler
+	if s == nil {
+		return func() {}, nil
+	}
+	if err := s.acquire(ctx, dht.requestCPL(req)); err != nil {
+		return nil, err
+	}
+	return s.release, nil
+}
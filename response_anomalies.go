@@ -0,0 +1,174 @@
+package dht
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+)
+
+const (
+	anomalyDuplicate   = "duplicate"
+	anomalyConflicting = "conflicting_addrs"
+)
+
+// ResponseAnomalies counts anomalies in the closer peers returned to our lookups, which hint at coordinated Sybil
+// responders.
+type ResponseAnomalies struct {
+	// DuplicateResponses is the number of responses listing a peer more than once, e.g. padded to fill the message.
+	DuplicateResponses uint64
+	// ConflictingAddrs is the number of peers returned by different responders of a lookup with disjoint addresses.
+	ConflictingAddrs uint64
+	// Penalized is the number of responders penalized for padded responses, or for addresses contradicting the
+	// connections we have to a peer. Penalties count as suspicious responses towards BehaviorEviction.
+	Penalized uint64
+}
+
+type responseAnomalies struct {
+	duplicates, conflicts, penalized uint64
+}
+
+// ResponseAnomalies returns the anomalies detected in the responses to our lookups so far.
+func (dht *IpfsDHT) ResponseAnomalies() ResponseAnomalies {
+	return ResponseAnomalies{
+		DuplicateResponses: atomic.LoadUint64(&dht.anomalies.duplicates),
+		ConflictingAddrs:   atomic.LoadUint64(&dht.anomalies.conflicts),
+		Penalized:          atomic.LoadUint64(&dht.anomalies.penalized),
+	}
+}
+
+func (dht *IpfsDHT) recordAnomaly(ctx context.Context, anomaly string, n int) {
+	counter := &dht.anomalies.duplicates
+	if anomaly == anomalyConflicting {
+		counter = &dht.anomalies.conflicts
+	}
+	atomic.AddUint64(counter, uint64(n))
+	stats.Record(dht.newContextWithLocalTags(ctx, tag.Upsert(metrics.KeyResponseAnomaly, anomaly)),
+		metrics.ResponseAnomalies.M(int64(n)))
+}
+
+// penalize records a suspicious response of p.
+func (dht *IpfsDHT) penalize(p peer.ID) {
+	atomic.AddUint64(&dht.anomalies.penalized, 1)
+	dht.recordBehavior(p, true)
+}
+
+// dedupeCloserPeers returns closer without the peers listed more than once, and the number of duplicates dropped.
+func dedupeCloserPeers(closer []*peer.AddrInfo) ([]*peer.AddrInfo, int) {
+	seen := make(map[peer.ID]struct{}, len(closer))
+	unique := closer[:0:0]
+	for _, ai := range closer {
+		if _, ok := seen[ai.ID]; ok {
+			continue
+		}
+		seen[ai.ID] = struct{}{}
+		unique = append(unique, ai)
+	}
+	if len(unique) == len(closer) {
+		return closer, 0
+	}
+	return unique, len(closer) - len(unique)
+}
+
+// addrClaims remembers the IPs the responders of a lookup claimed for the peers they returned.
+type addrClaims struct {
+	mu     sync.Mutex
+	claims map[peer.ID]addrClaim
+}
+
+type addrClaim struct {
+	from peer.ID
+	ips  map[string]struct{}
+}
+
+// claimedIPs returns the IPs of the direct addresses in addrs.
+func claimedIPs(addrs []ma.Multiaddr) map[string]struct{} {
+	var ips map[string]struct{}
+	for _, a := range addrs {
+		if isRelayAddr(a) {
+			continue
+		}
+		ip, err := manet.ToIP(a)
+		if err != nil {
+			continue
+		}
+		if ips == nil {
+			ips = make(map[string]struct{})
+		}
+		ips[ip.String()] = struct{}{}
+	}
+	return ips
+}
+
+func disjoint(a, b map[string]struct{}) bool {
+	for ip := range a {
+		if _, ok := b[ip]; ok {
+			return false
+		}
+	}
+	return true
+}
+
+// checkAddrClaims compares the addresses from claims for the closer peers with the ones other responders of q claimed
+// for them. Addresses that conflict are counted, and the responders whose claims contradict the connections we have to
+// the peer are penalized; without connections we can't tell who is right, as honest responders may know stale
+// addresses.
+func (q *query) checkAddrClaims(ctx context.Context, from peer.ID, closer []*peer.AddrInfo) {
+	var conflicts int
+	var liars []peer.ID
+	q.addrClaims.mu.Lock()
+	if q.addrClaims.claims == nil {
+		q.addrClaims.claims = make(map[peer.ID]addrClaim)
+	}
+	for _, ai := range closer {
+		ips := claimedIPs(ai.Addrs)
+		if len(ips) == 0 {
+			continue
+		}
+		prev, ok := q.addrClaims.claims[ai.ID]
+		if !ok {
+			q.addrClaims.claims[ai.ID] = addrClaim{from: from, ips: ips}
+			continue
+		}
+		if prev.from == from || !disjoint(prev.ips, ips) {
+			continue
+		}
+		conflicts++
+
+		var connected []ma.Multiaddr
+		for _, c := range q.dht.host.Network().ConnsToPeer(ai.ID) {
+			connected = append(connected, c.RemoteMultiaddr())
+		}
+		live := claimedIPs(connected)
+		if len(live) == 0 {
+			continue
+		}
+		if disjoint(live, ips) {
+			liars = append(liars, from)
+		}
+		if disjoint(live, prev.ips) {
+			liars = append(liars, prev.from)
+			// the responder proven right becomes the reference for the peer
+			q.addrClaims.claims[ai.ID] = addrClaim{from: from, ips: ips}
+		}
+	}
+	q.addrClaims.mu.Unlock()
+
+	if conflicts > 0 {
+		logger.Debugw("conflicting addresses in closer peers", "from", from, "conflicts", conflicts)
+		q.dht.recordAnomaly(ctx, anomalyConflicting, conflicts)
+	}
+	if isLookupReplay(ctx) {
+		return
+	}
+	for _, p := range liars {
+		q.dht.penalize(p)
+	}
+}
@@ -0,0 +1,39 @@
+package dht
+
+import (
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+)
+
+// diverseCandidatesFactor is how many times more peers than returned are taken from the routing table as candidates
+// for the diverse closer peers of a response.
+const diverseCandidatesFactor = 4
+
+// providerCloserPeers returns the closer peers sent back with the providers of the key of pmes to from, limited to
+// closerPeersPerGroup peers per IP group if set, see DiverseProviderCloserPeers.
+func (dht *IpfsDHT) providerCloserPeers(pmes *pb.Message, from peer.ID) []peer.ID {
+	if dht.closerPeersPerGroup <= 0 {
+		return dht.betterPeersToQuery(pmes, from, dht.bucketSize)
+	}
+
+	candidates := dht.betterPeersToQuery(pmes, from, diverseCandidatesFactor*dht.bucketSize)
+	if candidates == nil {
+		return nil
+	}
+	closer := make([]peer.ID, 0, dht.bucketSize)
+	perGroup := make(map[string]int)
+	for _, p := range candidates {
+		if len(closer) == dht.bucketSize {
+			break
+		}
+		if g, ok := dht.peerGroup(p); ok {
+			if perGroup[g] >= dht.closerPeersPerGroup {
+				continue
+			}
+			perGroup[g]++
+		}
+		closer = append(closer, p)
+	}
+	return closer
+}
@@ -0,0 +1,112 @@
+package dht
+
+import (
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+)
+
+// limitResponse truncates resp, the response to req, to the configured response limits, see ResponsePeerLimits and
+// MaxResponseSize. Closer peers are truncated preferring peers of distinct IP groups so that a truncated response
+// doesn't end up pointing into a single network. Providers are truncated from the end when paging, and the
+// continuation token is moved back so that the requester pages through the dropped providers later.
+func (dht *IpfsDHT) limitResponse(req, resp *pb.Message) {
+	if resp == nil {
+		return
+	}
+	paged := req.GetProviderPageSize() > 0
+
+	if dht.maxAddrsPerPeer > 0 {
+		for _, peers := range [][]pb.Message_Peer{resp.CloserPeers, resp.ProviderPeers} {
+			for i := range peers {
+				if len(peers[i].Addrs) > dht.maxAddrsPerPeer {
+					peers[i].Addrs = peers[i].Addrs[:dht.maxAddrsPerPeer]
+				}
+			}
+		}
+	}
+	if dht.maxCloserPeers > 0 && len(resp.CloserPeers) > dht.maxCloserPeers {
+		resp.CloserPeers = diversePBPeers(resp.CloserPeers, dht.maxCloserPeers)
+	}
+	if dht.maxProviders > 0 && len(resp.ProviderPeers) > dht.maxProviders {
+		if paged {
+			truncateProviderPage(resp, dht.maxProviders)
+		} else {
+			resp.ProviderPeers = diversePBPeers(resp.ProviderPeers, dht.maxProviders)
+		}
+	}
+
+	if dht.maxResponseSize <= 0 {
+		return
+	}
+	// drop the farthest closer peers first, they are the least useful, then providers
+	for resp.Size() > dht.maxResponseSize && len(resp.CloserPeers) > 0 {
+		resp.CloserPeers = resp.CloserPeers[:len(resp.CloserPeers)-1]
+	}
+	for resp.Size() > dht.maxResponseSize && len(resp.ProviderPeers) > 0 {
+		if paged && len(resp.ProviderPeers) > 1 {
+			truncateProviderPage(resp, len(resp.ProviderPeers)-1)
+		} else {
+			resp.ProviderPeers = resp.ProviderPeers[:len(resp.ProviderPeers)-1]
+		}
+	}
+	if resp.Size() > dht.maxResponseSize {
+		logger.Debugw("response exceeds the maximum response size", "type", resp.GetType(), "size", resp.Size())
+	}
+}
+
+// truncateProviderPage truncates the providers of a paged GET_PROVIDERS response to n, making the last remaining
+// provider the continuation token as providersPage does.
+func truncateProviderPage(resp *pb.Message, n int) {
+	resp.ProviderPeers = resp.ProviderPeers[:n]
+	resp.ContinuationToken = []byte(resp.ProviderPeers[n-1].Id)
+}
+
+// diversePBPeers returns n of peers, picking peers of IP groups not picked yet first, in the order of peers. Peers
+// without public IP addresses each count as a group of their own.
+func diversePBPeers(peers []pb.Message_Peer, n int) []pb.Message_Peer {
+	if len(peers) <= n {
+		return peers
+	}
+
+	groups := make([]string, len(peers))
+	for i, p := range peers {
+		groups[i] = "peer:" + string(p.Id)
+		for _, b := range p.Addrs {
+			a, err := ma.NewMultiaddrBytes(b)
+			if err != nil || !manet.IsPublicAddr(a) {
+				continue
+			}
+			if ip, err := manet.ToIP(a); err == nil {
+				groups[i] = ipGroup(ip)
+				break
+			}
+		}
+	}
+
+	// pick peers in rounds, at most one more peer per group each round
+	picked := make([]bool, len(peers))
+	perGroup := make(map[string]int)
+	count := 0
+	for round := 1; count < n; round++ {
+		for i := range peers {
+			if picked[i] || perGroup[groups[i]] >= round {
+				continue
+			}
+			picked[i] = true
+			perGroup[groups[i]]++
+			if count++; count == n {
+				break
+			}
+		}
+	}
+
+	out := make([]pb.Message_Peer, 0, n)
+	for i, p := range peers {
+		if picked[i] {
+			out = append(out, p)
+		}
+	}
+	return out
+}
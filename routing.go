@@ -6,11 +6,11 @@ import (
 	"fmt"
 	"math"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
-	"github.com/libp2p/go-libp2p/core/peerstore"
 	"github.com/libp2p/go-libp2p/core/routing"
 
 	"github.com/ipfs/go-cid"
@@ -31,7 +31,11 @@ const enableSpecialProvide = true
 // const specialProvideNumber = 30
 
 func (dht *IpfsDHT) SetSpecialProvideNumber(specialProvNum int) {
-	dht.specialProvideNumber = specialProvNum
+	atomic.StoreInt32(&dht.specialProvideNumber, int32(specialProvNum))
+}
+
+func (dht *IpfsDHT) getSpecialProvideNumber() int {
+	return int(atomic.LoadInt32(&dht.specialProvideNumber))
 }
 
 // This file implements the Routing interface for the IpfsDHT struct.
@@ -41,14 +45,17 @@ func (dht *IpfsDHT) SetSpecialProvideNumber(specialProvNum int) {
 // PutValue adds value corresponding to given Key.
 // This is the top level "Store" operation of the DHT
 func (dht *IpfsDHT) PutValue(ctx context.Context, key string, value []byte, opts ...routing.Option) (err error) {
-	if !dht.enableValues {
+	if !dht.valuesEnabled(key) {
 		return routing.ErrNotSupported
 	}
+	if ctx, err = dht.chargeQuota(ctx, quotaOpProvide); err != nil {
+		return err
+	}
 
 	logger.Debugw("putting value", "key", internal.LoggableRecordKeyString(key))
 
 	// don't even allow local users to put bad values.
-	if err := dht.Validator.Validate(key, value); err != nil {
+	if err := dht.validate(key, value); err != nil {
 		return err
 	}
 
@@ -61,7 +68,7 @@ func (dht *IpfsDHT) PutValue(ctx context.Context, key string, value []byte, opts
 	// Check if we have an old value that's not the same as the new one.
 	if old != nil && !bytes.Equal(old.GetValue(), value) {
 		// Check to see if the new one is better.
-		i, err := dht.Validator.Select(key, [][]byte{value, old.GetValue()})
+		i, err := dht.selectValue(key, [][]byte{value, old.GetValue()})
 		if err != nil {
 			return err
 		}
@@ -71,7 +78,7 @@ func (dht *IpfsDHT) PutValue(ctx context.Context, key string, value []byte, opts
 	}
 
 	rec := record.MakePutRecord(key, value)
-	rec.TimeReceived = u.FormatRFC3339(time.Now())
+	rec.TimeReceived = u.FormatRFC3339(dht.clock.Now())
 	err = dht.putLocal(ctx, key, rec)
 	if err != nil {
 		return err
@@ -102,6 +109,9 @@ func (dht *IpfsDHT) PutValue(ctx context.Context, key string, value []byte, opts
 	}
 	wg.Wait()
 
+	if dht.valueMirror != nil {
+		dht.enqueueMirror(key, rec, peers)
+	}
 	return nil
 }
 
@@ -113,7 +123,8 @@ type recvdVal struct {
 
 // GetValue searches for the value corresponding to given Key.
 func (dht *IpfsDHT) GetValue(ctx context.Context, key string, opts ...routing.Option) (_ []byte, err error) {
-	if !dht.enableValues {
+	ctx = withCorrelationID(ctx)
+	if !dht.valuesEnabled(key) {
 		return nil, routing.ErrNotSupported
 	}
 
@@ -141,13 +152,14 @@ func (dht *IpfsDHT) GetValue(ctx context.Context, key string, opts ...routing.Op
 	if best == nil {
 		return nil, routing.ErrNotFound
 	}
-	logger.Debugf("GetValue %v %x", internal.LoggableRecordKeyString(key), best)
+	opLogger(ctx).Debugw("got value", "key", internal.LoggableRecordKeyString(key), "value", fmt.Sprintf("%x", best))
 	return best, nil
 }
 
 // SearchValue searches for the value corresponding to given Key and streams the results.
 func (dht *IpfsDHT) SearchValue(ctx context.Context, key string, opts ...routing.Option) (<-chan []byte, error) {
-	if !dht.enableValues {
+	ctx = withCorrelationID(ctx)
+	if !dht.valuesEnabled(key) {
 		return nil, routing.ErrNotSupported
 	}
 
@@ -155,6 +167,11 @@ func (dht *IpfsDHT) SearchValue(ctx context.Context, key string, opts ...routing
 	if err := cfg.Apply(opts...); err != nil {
 		return nil, err
 	}
+	ctx, err := dht.chargeQuota(ctx, quotaOpLookup)
+	if err != nil {
+		return nil, err
+	}
+	ctx = withFollowupOption(ctx, &cfg)
 
 	responsesNeeded := 0
 	if !cfg.Offline {
@@ -162,7 +179,15 @@ func (dht *IpfsDHT) SearchValue(ctx context.Context, key string, opts ...routing
 	}
 
 	stopCh := make(chan struct{})
-	valCh, lookupRes := dht.getValues(ctx, key, stopCh)
+	var (
+		valCh     <-chan recvdVal
+		lookupRes <-chan *lookupWithFollowupResult
+	)
+	if dht.lookupDedup != nil && dedupable(ctx) {
+		valCh, lookupRes = dht.getValuesShared(ctx, key, stopCh)
+	} else {
+		valCh, lookupRes = dht.getValues(ctx, key, stopCh)
+	}
 
 	out := make(chan []byte)
 	go func() {
@@ -216,8 +241,27 @@ func (dht *IpfsDHT) searchValueQuorum(ctx context.Context, key string, valCh <-c
 		})
 }
 
+// processValues selects the best of the values received, calling newVal for every value, with better set when the
+// value becomes the best one. Of values the validator considers equivalent, the one returned by the peers with the
+// highest total reputation is the best, see PeerReputation. If StrictValueCorroboration is set, the best value is only
+// reported as better, and returned, once it has been returned by peers from enough distinct IP groups.
 func (dht *IpfsDHT) processValues(ctx context.Context, key string, vals <-chan recvdVal,
 	newVal func(ctx context.Context, v recvdVal, better bool) bool) (best []byte, peersWithBest map[peer.ID]struct{}, aborted bool) {
+	var (
+		// senders and support are the peers that returned each value and the sum of their reputations
+		senders = make(map[string][]peer.ID)
+		support = make(map[string]float64)
+		// groups are the IP groups of the peers that returned the best value, emitted whether it was reported
+		groups  map[string]struct{}
+		emitted bool
+	)
+	conflicts := newValueConflicts(ctx)
+	defer func() {
+		if !emitted {
+			best, peersWithBest = nil, nil
+		}
+	}()
+	defer func() { conflicts.publish(ctx, key, best) }()
 loop:
 	for {
 		if aborted {
@@ -229,28 +273,39 @@ loop:
 			if !ok {
 				break loop
 			}
+			conflicts.add(v)
+			senders[string(v.Val)] = append(senders[string(v.Val)], v.From)
+			support[string(v.Val)] += dht.PeerReputation(v.From)
 
 			// Select best value
 			if best != nil {
 				if bytes.Equal(best, v.Val) {
 					peersWithBest[v.From] = struct{}{}
-					aborted = newVal(ctx, v, false)
+					dht.addValueGroup(groups, v.From)
+					better := !emitted && dht.valueCorroborated(groups)
+					emitted = emitted || better
+					aborted = newVal(ctx, v, better)
 					continue
 				}
-				sel, err := dht.Validator.Select(key, [][]byte{best, v.Val})
+				sel, err := dht.selectValue(key, [][]byte{best, v.Val})
 				if err != nil {
-					logger.Warnw("failed to select best value", "key", internal.LoggableRecordKeyString(key), "error", err)
+					logger.Warnw("failed to select best value", "key", internal.LoggableRecordKeyString(key), "from", v.From, "error", err)
 					continue
 				}
-				if sel != 1 {
+				if sel != 1 && !dht.outweighs(key, v.Val, best, support) {
 					aborted = newVal(ctx, v, false)
 					continue
 				}
 			}
 			peersWithBest = make(map[peer.ID]struct{})
-			peersWithBest[v.From] = struct{}{}
+			groups = make(map[string]struct{})
+			for _, p := range senders[string(v.Val)] {
+				peersWithBest[p] = struct{}{}
+				dht.addValueGroup(groups, p)
+			}
 			best = v.Val
-			aborted = newVal(ctx, v, true)
+			emitted = dht.valueCorroborated(groups)
+			aborted = newVal(ctx, v, emitted)
 		case <-ctx.Done():
 			return
 		}
@@ -259,6 +314,36 @@ loop:
 	return
 }
 
+// outweighs tells whether val, which the validator doesn't prefer to best, is equivalent to best and was returned by
+// peers of a higher total reputation. The validator considers both equivalent if it selects the first of them in both
+// orders.
+func (dht *IpfsDHT) outweighs(key string, val, best []byte, support map[string]float64) bool {
+	if support[string(val)] <= support[string(best)] {
+		return false
+	}
+	sel, err := dht.selectValue(key, [][]byte{val, best})
+	return err == nil && sel == 0
+}
+
+// addValueGroup adds the IP group of p, a peer that returned a value, to groups. The local record counts as a group
+// of its own.
+func (dht *IpfsDHT) addValueGroup(groups map[string]struct{}, p peer.ID) {
+	if dht.valueCorroboration == 0 {
+		return
+	}
+	if p == dht.self {
+		groups[""] = struct{}{}
+	} else if g, ok := dht.peerGroup(p); ok {
+		groups[g] = struct{}{}
+	}
+}
+
+// valueCorroborated tells whether a value returned by peers of the given IP groups can be emitted, see
+// StrictValueCorroboration.
+func (dht *IpfsDHT) valueCorroborated(groups map[string]struct{}) bool {
+	return len(groups) >= dht.valueCorroboration
+}
+
 func (dht *IpfsDHT) updatePeerValues(ctx context.Context, key string, val []byte, peers []peer.ID) {
 	fixupRec := record.MakePutRecord(key, val)
 	for _, p := range peers {
@@ -329,9 +414,9 @@ func (dht *IpfsDHT) getValues(ctx context.Context, key string, stopQuery chan st
 					logger.Debug("received a nil record value")
 					return peers, nil
 				}
-				if err := dht.Validator.Validate(key, val); err != nil {
+				if err := dht.validate(key, val); err != nil {
 					// make sure record is valid
-					logger.Debugw("received invalid record (discarded)", "error", err)
+					logger.Debugw("received invalid record (discarded)", "from", p, "error", err)
 					return peers, nil
 				}
 
@@ -347,7 +432,7 @@ func (dht *IpfsDHT) getValues(ctx context.Context, key string, stopQuery chan st
 
 				return peers, nil
 			},
-			func() bool {
+			func(*lookupState) bool {
 				select {
 				case <-stopQuery:
 					return true
@@ -373,13 +458,63 @@ func (dht *IpfsDHT) getValues(ctx context.Context, key string, stopQuery chan st
 func (dht *IpfsDHT) refreshRTIfNoShortcut(key kb.ID, lookupRes *lookupWithFollowupResult) {
 	if lookupRes.completed {
 		// refresh the cpl for this key as the query was successful
-		dht.routingTable.ResetCplRefreshedAtForID(key, time.Now())
+		dht.routingTable.ResetCplRefreshedAtForID(key, dht.clock.Now())
 	}
 }
 
+// detectionSampleStableRounds is the number of rounds the closest peers must not change for before a detection
+// sampling lookup terminates.
+const detectionSampleStableRounds = 3
+
+// sampleClosestPeers runs a lookup dedicated to the eclipse detector: it returns exactly defaultEclipseDetectionK
+// closest peers to key, if that many exist, and terminates only once they are stable, see withSamplingTermination.
+// Enough closest peers cached by a lookup that just ran, see ClosestPeersCacheTTL, are reused instead.
+func (dht *IpfsDHT) sampleClosestPeers(ctx context.Context, key string) ([]peer.ID, error) {
+	if c := dht.closestCache; c != nil {
+		if peers, ok := c.get(key, false); ok && len(peers) >= defaultEclipseDetectionK {
+			return peers[:defaultEclipseDetectionK], nil
+		}
+	}
+	return dht.GetClosestPeersK(withSamplingTermination(ctx, detectionSampleStableRounds), key, defaultEclipseDetectionK)
+}
+
+// eclipseDetectionWithSampling runs the eclipse detection on the peers a provide found if they make a conclusive
+// sample, i.e. at least defaultEclipseDetectionK peers, and on the peers found by a dedicated sampling lookup
+// otherwise.
+func (dht *IpfsDHT) eclipseDetectionWithSampling(ctx context.Context, keyMH multihash.Multihash, peers []peer.ID) (bool, error) {
+	report, err := dht.eclipseReportWithSampling(ctx, keyMH, peers)
+	if err != nil {
+		return false, err
+	}
+	return report.Attack, nil
+}
+
+// eclipseReportWithSampling is eclipseDetectionWithSampling returning the details of the detection.
+func (dht *IpfsDHT) eclipseReportWithSampling(ctx context.Context, keyMH multihash.Multihash, peers []peer.ID) (*EclipseReport, error) {
+	if len(peers) < defaultEclipseDetectionK {
+		sample, err := dht.sampleClosestPeers(ctx, string(keyMH))
+		if err != nil {
+			logger.Debugw("detection sampling lookup failed", "key", internal.LoggableProviderRecordBytes(keyMH), "error", err)
+		} else if len(sample) > len(peers) {
+			peers = sample
+		}
+	}
+	return dht.EclipseDetectionReport(ctx, keyMH, peers)
+}
+
 func (dht *IpfsDHT) EclipseDetection(ctx context.Context, keyMH multihash.Multihash, peers []peer.ID) (bool, error) {
+	report, err := dht.EclipseDetectionReport(ctx, keyMH, peers)
+	if err != nil {
+		return false, err
+	}
+	return report.Attack, nil
+}
+
+// EclipseDetectionReport is EclipseDetection returning the details of the detection, including the verdicts of all
+// the statistical tests of the detector, see EclipseDetectionTest.
+func (dht *IpfsDHT) EclipseDetectionReport(ctx context.Context, keyMH multihash.Multihash, peers []peer.ID) (*EclipseReport, error) {
 	if len(peers) < defaultEclipseDetectionK {
-		return false, fmt.Errorf("Not enough peers for eclipse detection. Expected: %d, found: %d\n", defaultEclipseDetectionK, len(peers))
+		return nil, fmt.Errorf("Not enough peers for eclipse detection. Expected: %d, found: %d\n", defaultEclipseDetectionK, len(peers))
 	}
 	if len(peers) > defaultEclipseDetectionK {
 		peers = peers[:defaultEclipseDetectionK]
@@ -388,51 +523,63 @@ func (dht *IpfsDHT) EclipseDetection(ctx context.Context, keyMH multihash.Multih
 	// Eclipse attack detection here
 	// fmt.Println("Testing cid hash", keyMH, "for eclipse attack...")
 	if dht.detector == nil {
-		return false, fmt.Errorf("Detector not initialized!")
+		return nil, fmt.Errorf("Detector not initialized!")
 	}
 
-	netsize, netsizeErr := dht.nsEstimator.NetworkSize()
+	netsize, netsizeErr := dht.networkSize(ctx)
 	if netsizeErr != nil {
-		dht.GatherNetsizeData()
-		netsize, netsizeErr = dht.nsEstimator.NetworkSize()
-		if netsizeErr != nil {
-			return false, netsizeErr
-		}
+		return nil, netsizeErr
 	}
-	fmt.Println("Estimated network size as", netsize)
-
-	l_est := dht.detector.UpdateLFromNetsize(int(netsize))
-	fmt.Println("Estimated parameter l as", l_est)
+	// the parameters of this detection, which concurrent detections updating the detector's must not change
+	params := dht.detector.Params()
+	params.L = dht.detector.UpdateLFromNetsize(int(netsize))
 	// dht.detector.UpdateThreshold(1.0)
-	threshold := dht.detector.UpdateThresholdFromNetsize(int(netsize))
-	fmt.Println("Estimated threshold as", threshold)
+	if override := dht.getDetectionThreshold(); override > 0 {
+		dht.detector.UpdateThreshold(override)
+		params.Threshold = override
+	} else {
+		params.Threshold = dht.detector.UpdateThresholdFromNetsize(int(netsize))
+	}
 
-	targetBytes := []byte(kb.ConvertKey(string(keyMH)))
+	ks := dht.detector.Keyspace()
+	targetBytes := ks.Key(keyMH)
 	// fmt.Println("Eclipse attack detection for id hash:", keyMH)
 	// fmt.Printf("CID in the DHT keyspace: %x \n", targetBytes)
 	peeridsBytes := make([][]byte, len(peers))
 	//fmt.Println("Number of peers obtained: ", len(peers))
 	for i := range peeridsBytes {
-		peeridsBytes[i] = []byte(kb.ConvertKey(string(peers[i])))
+		peeridsBytes[i] = ks.Key([]byte(peers[i]))
 		// fmt.Printf("%s %x \n", peers[i], peeridsBytes[i])
 		// fmt.Printf("%s \n", peers[i])
 	}
 
 	counts := dht.detector.ComputePrefixLenCounts(targetBytes, peeridsBytes)
-	kl := dht.detector.ComputeKLFromCounts(counts)
-	fmt.Println("Counts:", counts)
-	fmt.Println("KL divergence:", kl)
-	result := dht.detector.DetectFromKL(kl)
-	fmt.Println("Eclipse detection result:", result)
-	var resultStr string
-	if result {
-		resultStr = "possible attack"
-	} else {
-		resultStr = "no attack"
+	report := &EclipseReport{
+		Key:       keyMH,
+		Netsize:   netsize,
+		L:         params.L,
+		Threshold: params.Threshold,
+		Counts:    counts,
+		Test:      dht.detectionTest,
+		Tests:     dht.detector.RunTestsWithParams(counts, params),
+	}
+	for _, res := range report.Tests {
+		if res.Test == report.Test {
+			report.Attack = res.Attack
+		}
+	}
+	if p := dht.observeAttack(string(keyMH), report.Attack, dht.bayesParams.Detector); p != nil {
+		report.Posterior = p
+		report.Attack = p.Attack
+	}
+	opLogger(ctx).Infow("eclipse detection", "key", internal.LoggableProviderRecordBytes(keyMH), "netsize", netsize,
+		"l", params.L, "threshold", params.Threshold, "counts", counts, "tests", report.Tests, "test", report.Test,
+		"posterior", report.Posterior, "attack", report.Attack)
+	if report.Attack {
+		dht.detections.Report(AttackSignal{Key: string(keyMH), Source: SignalEclipseDetection, Score: 1})
 	}
-	fmt.Println("Eclipse attack detector says: ", resultStr, ", threshold =", threshold)
 	// Eclipse attack detection code ends here
-	return result, nil
+	return report, nil
 }
 
 // Provider abstraction for indirect stores.
@@ -441,19 +588,34 @@ func (dht *IpfsDHT) EclipseDetection(ctx context.Context, keyMH multihash.Multih
 
 // Provide makes this node announce that it can provide a value for the given key
 func (dht *IpfsDHT) ProvideWithoutEclipseDetection(ctx context.Context, key cid.Cid, brdcst bool) (err error) {
+	start := time.Now()
+	ctx = withCorrelationID(ctx)
 	if !dht.enableProviders {
 		return routing.ErrNotSupported
 	} else if !key.Defined() {
 		return fmt.Errorf("invalid cid: undefined")
+	} else if !dht.providersEnabled(key.Hash()) {
+		return routing.ErrNotSupported
+	}
+	if ctx, err = dht.chargeQuota(ctx, quotaOpProvide); err != nil {
+		return err
 	}
 	keyMH := key.Hash()
-	logger.Debugw("providing", "cid", key, "mh", internal.LoggableProviderRecordBytes(keyMH))
+	opLogger(ctx).Debugw("providing", "cid", key, "mh", internal.LoggableProviderRecordBytes(keyMH))
 
 	// add self locally
 	dht.providerStore.AddProvider(ctx, keyMH, peer.AddrInfo{ID: dht.self})
 	if !brdcst {
 		return nil
 	}
+	if deferred, err := dht.deferProvide(ctx, key, dht.ProvideWithoutEclipseDetection); deferred || err != nil {
+		return err
+	}
+	done, err := dht.provideDrain.track(key)
+	if err != nil {
+		return err
+	}
+	defer done()
 
 	closerCtx := ctx
 	if deadline, ok := ctx.Deadline(); ok {
@@ -492,23 +654,14 @@ func (dht *IpfsDHT) ProvideWithoutEclipseDetection(ctx context.Context, key cid.
 		return err
 	}
 
-	wg := sync.WaitGroup{}
-	for _, p := range peers {
-		wg.Add(1)
-		go func(p peer.ID) {
-			defer wg.Done()
-			logger.Debugf("putProvider(%s, %s)", internal.LoggableProviderRecordBytes(keyMH), p)
-			err := dht.protoMessenger.PutProvider(ctx, p, keyMH, dht.host)
-			if err != nil {
-				logger.Debug(err)
-			}
-		}(p)
-	}
-	wg.Wait()
+	failed := dht.sendProviderRecords(ctx, keyMH, ProvideStrategyRegular, start, peers)
 	if exceededDeadline {
 		return context.DeadlineExceeded
 	}
-	return ctx.Err()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return provideResult(keyMH, peers, failed)
 }
 
 // Provider abstraction for indirect stores.
@@ -521,26 +674,52 @@ func (dht *IpfsDHT) ProvideWithoutEclipseDetection(ctx context.Context, key cid.
 // in which the provider record is sent to all peers within a distance expected to contain specialProvideNumber peers.
 // This is decided based on the flag enableSpecialProvide.
 // TODO later: Do special provide only if eclipse attack is detected.
+//
+// If the provider record could not be sent to some of the peers, a *PartialProvideError listing them is returned.
 
 func (dht *IpfsDHT) Provide(ctx context.Context, key cid.Cid, brdcst bool) (err error) {
-	dht.providerLk.Lock()         // TODO(Srivatsan): This is just to prevent concurrent provides from annoying me for now. Will be removed later
-	defer dht.providerLk.Unlock() // TODO(Srivatsan): This is just to prevent concurrent provides from annoying me for now. Will be removed later
+	if brdcst && dht.queuesProvide(ctx) {
+		// the queue runs the provide, and charges it to the tenant of ctx then
+		return dht.EnqueueProvide(ctx, key, ProvidePriorityRoutine)
+	}
+	start := time.Now()
+	ctx = withCorrelationID(ctx)
+	log := opLogger(ctx)
+	if ctx, err = dht.chargeQuota(ctx, quotaOpProvide); err != nil {
+		return err
+	}
+	if !isQueuedProvide(ctx) {
+		// the workers of the provide queue bound the number of its provides running at once
+		if err := dht.lockProvides(ctx); err != nil {
+			return err
+		}
+		defer dht.unlockProvides()
+	}
 
 	keyMH := key.Hash()
-	fmt.Println("Provide: cid", key, ", hash:", keyMH)
 
 	if !dht.enableProviders {
 		return routing.ErrNotSupported
 	} else if !key.Defined() {
 		return fmt.Errorf("invalid cid: undefined")
+	} else if !dht.providersEnabled(key.Hash()) {
+		return routing.ErrNotSupported
 	}
-	logger.Debugw("providing", "cid", key, "mh", internal.LoggableProviderRecordBytes(keyMH))
+	opLogger(ctx).Debugw("providing", "cid", key, "mh", internal.LoggableProviderRecordBytes(keyMH))
 
 	// add self locally
 	dht.providerStore.AddProvider(ctx, keyMH, peer.AddrInfo{ID: dht.self})
 	if !brdcst {
 		return nil
 	}
+	if deferred, err := dht.deferProvide(ctx, key, dht.Provide); deferred || err != nil {
+		return err
+	}
+	done, err := dht.provideDrain.track(key)
+	if err != nil {
+		return err
+	}
+	defer done()
 
 	closerCtx := ctx
 	if deadline, ok := ctx.Deadline(); ok {
@@ -569,23 +748,26 @@ func (dht *IpfsDHT) Provide(ctx context.Context, key cid.Cid, brdcst bool) (err
 	var netsize float64
 
 	if enableSpecialProvide {
-		netsize, netsizeErr = dht.nsEstimator.NetworkSize()
-		if netsizeErr != nil {
-			dht.GatherNetsizeData()
-			netsize, netsizeErr = dht.nsEstimator.NetworkSize()
-		}
+		netsize, netsizeErr = dht.networkSize(ctx)
 	}
+	strategy := ProvideStrategyRegular
 	if enableSpecialProvide && netsizeErr == nil {
+		strategy = ProvideStrategySpecial
 		// Calculate the expected maximum distance of the `specialProvideNumber` number of closest peers.
 		// Then calculate the minimum common prefix length of all peerids within that distance
-		minCPL := int(math.Ceil(math.Log2(netsize/float64(dht.specialProvideNumber)))) - 1
-		fmt.Println("Providing cid", key, ", hash:", keyMH, "to all peers with CPL", minCPL)
+		minCPL := int(math.Ceil(math.Log2(netsize/float64(dht.getSpecialProvideNumber())))) - 1
+		log.Debugw("providing to all peers in the region around the key", "cid", key, "cpl", minCPL)
 		var numLookups int
 		peers, numLookups, err = dht.GetPeersWithCPLGet(closerCtx, string(keyMH), minCPL)
-		fmt.Println("Provide", key, "took", numLookups, "lookups.")
+		if err == ErrCPLBudgetExceeded {
+			// provide to the part of the region we managed to enumerate
+			log.Warnw("special provide exceeded its lookup budget", "cid", key, "peers", len(peers))
+			err = nil
+		}
+		log.Debugw("enumerated the region around the key", "cid", key, "lookups", numLookups)
 	} else {
 		if netsizeErr != nil {
-			fmt.Println("Defaulting to regular provide operation due to error in netsize estimation:", netsizeErr)
+			log.Infow("defaulting to regular provide, network size estimation failed", "cid", key, "error", netsizeErr)
 		}
 		peers, err = dht.GetClosestPeers(closerCtx, string(keyMH))
 	}
@@ -604,59 +786,65 @@ func (dht *IpfsDHT) Provide(ctx context.Context, key cid.Cid, brdcst bool) (err
 		return err
 	}
 
-	fmt.Printf("Provide CID hash: %x\n", []byte(kb.ConvertKey(string(keyMH))))
-
-	fmt.Println("Sending provider record to", len(peers), "peers:")
-	for _, pid := range peers {
-		c := []byte(kb.ConvertKey(string(pid)))
-		fmt.Printf("%x\n", c)
+	if strategy == ProvideStrategyRegular && !exceededDeadline && dht.lacksProvideDiversity(peers) {
+		// the closest peers may all be run by the same party, provide to the whole region around the key instead
+		log.Infow("provide targets lack IP diversity, escalating to the special strategy", "cid", key,
+			"groups", dht.provideTargetGroups(peers), "required", dht.minProvideTargetGroups)
+		if wide, _, ok := dht.wideProvideTargets(closerCtx, keyMH); ok {
+			peers, strategy = wide, ProvideStrategySpecial
+		}
 	}
 
-	wg := sync.WaitGroup{}
-	for _, p := range peers {
-		wg.Add(1)
-		go func(p peer.ID) {
-			defer wg.Done()
-			logger.Debugf("putProvider(%s, %s)", internal.LoggableProviderRecordBytes(keyMH), p)
-			err := dht.protoMessenger.PutProvider(ctx, p, keyMH, dht.host)
-			if err != nil {
-				logger.Debug(err)
-			}
-		}(p)
-	}
-	wg.Wait()
+	log.Debugw("sending provider record", "cid", key, "strategy", strategy, "peers", peers)
+
+	failed := dht.sendProviderRecords(ctx, keyMH, strategy, start, peers)
 	if exceededDeadline {
 		return context.DeadlineExceeded
 	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
-	_, e := dht.EclipseDetection(ctx, keyMH, peers)
-	if e != nil {
+	if e := dht.provideDetection(ctx, keyMH, peers); e != nil {
 		return e
 	}
-
-	return ctx.Err()
+	return provideResult(keyMH, peers, failed)
 }
 
 func (dht *IpfsDHT) ProvideWithReturn(ctx context.Context, key cid.Cid, brdcst bool) (error, []peer.ID, int) {
+	start := time.Now()
+	ctx = withCorrelationID(ctx)
+	log := opLogger(ctx)
 	var err error
-	dht.providerLk.Lock()         // TODO(Srivatsan): This is just to prevent concurrent provides from annoying me for now. Will be removed later
-	defer dht.providerLk.Unlock() // TODO(Srivatsan): This is just to prevent concurrent provides from annoying me for now. Will be removed later
+	if ctx, err = dht.chargeQuota(ctx, quotaOpProvide); err != nil {
+		return err, make([]peer.ID, 0), 0
+	}
+	if err := dht.lockProvides(ctx); err != nil {
+		return err, make([]peer.ID, 0), 0
+	}
+	defer dht.unlockProvides()
 
 	keyMH := key.Hash()
-	fmt.Println("Provide: cid", key, ", hash:", keyMH)
 
 	if !dht.enableProviders {
 		return routing.ErrNotSupported, make([]peer.ID, 0), 0
 	} else if !key.Defined() {
 		return fmt.Errorf("invalid cid: undefined"), make([]peer.ID, 0), 0
+	} else if !dht.providersEnabled(key.Hash()) {
+		return routing.ErrNotSupported, make([]peer.ID, 0), 0
 	}
-	logger.Debugw("providing", "cid", key, "mh", internal.LoggableProviderRecordBytes(keyMH))
+	opLogger(ctx).Debugw("providing", "cid", key, "mh", internal.LoggableProviderRecordBytes(keyMH))
 
 	// add self locally
 	dht.providerStore.AddProvider(ctx, keyMH, peer.AddrInfo{ID: dht.self})
 	if !brdcst {
 		return nil, make([]peer.ID, 0), 0
 	}
+	done, err := dht.provideDrain.track(key)
+	if err != nil {
+		return err, make([]peer.ID, 0), 0
+	}
+	defer done()
 
 	closerCtx := ctx
 	if deadline, ok := ctx.Deadline(); ok {
@@ -685,23 +873,26 @@ func (dht *IpfsDHT) ProvideWithReturn(ctx context.Context, key cid.Cid, brdcst b
 	var netsize float64
 
 	if enableSpecialProvide {
-		netsize, netsizeErr = dht.nsEstimator.NetworkSize()
-		if netsizeErr != nil {
-			dht.GatherNetsizeData()
-			netsize, netsizeErr = dht.nsEstimator.NetworkSize()
-		}
+		netsize, netsizeErr = dht.networkSize(ctx)
 	}
 	var numLookups int
+	strategy := ProvideStrategyRegular
 	if enableSpecialProvide && netsizeErr == nil {
+		strategy = ProvideStrategySpecial
 		// Calculate the expected maximum distance of the `specialProvideNumber` number of closest peers.
 		// Then calculate the minimum common prefix length of all peerids within that distance
-		minCPL := int(math.Ceil(math.Log2(netsize/float64(dht.specialProvideNumber)))) - 1
-		fmt.Println("Providing cid", key, ", hash:", keyMH, "to all peers with CPL", minCPL)
+		minCPL := int(math.Ceil(math.Log2(netsize/float64(dht.getSpecialProvideNumber())))) - 1
+		log.Debugw("providing to all peers in the region around the key", "cid", key, "cpl", minCPL)
 		peers, numLookups, err = dht.GetPeersWithCPLGet(closerCtx, string(keyMH), minCPL)
-		fmt.Println("Provide", key, "took", numLookups, "lookups.")
+		if err == ErrCPLBudgetExceeded {
+			// provide to the part of the region we managed to enumerate
+			log.Warnw("special provide exceeded its lookup budget", "cid", key, "peers", len(peers))
+			err = nil
+		}
+		log.Debugw("enumerated the region around the key", "cid", key, "lookups", numLookups)
 	} else {
 		if netsizeErr != nil {
-			fmt.Println("Defaulting to regular provide operation due to error in netsize estimation:", netsizeErr)
+			log.Infow("defaulting to regular provide, network size estimation failed", "cid", key, "error", netsizeErr)
 		}
 		peers, err = dht.GetClosestPeers(closerCtx, string(keyMH))
 	}
@@ -720,37 +911,30 @@ func (dht *IpfsDHT) ProvideWithReturn(ctx context.Context, key cid.Cid, brdcst b
 		return err, make([]peer.ID, 0), 0
 	}
 
-	fmt.Printf("Provide CID hash: %x\n", []byte(kb.ConvertKey(string(keyMH))))
-
-	fmt.Println("Sending provider record to", len(peers), "peers:")
-	for _, pid := range peers {
-		c := []byte(kb.ConvertKey(string(pid)))
-		fmt.Printf("%x\n", c)
+	if strategy == ProvideStrategyRegular && !exceededDeadline && dht.lacksProvideDiversity(peers) {
+		// the closest peers may all be run by the same party, provide to the whole region around the key instead
+		log.Infow("provide targets lack IP diversity, escalating to the special strategy", "cid", key,
+			"groups", dht.provideTargetGroups(peers), "required", dht.minProvideTargetGroups)
+		if wide, n, ok := dht.wideProvideTargets(closerCtx, keyMH); ok {
+			peers, strategy = wide, ProvideStrategySpecial
+			numLookups += n
+		}
 	}
 
-	wg := sync.WaitGroup{}
-	for _, p := range peers {
-		wg.Add(1)
-		go func(p peer.ID) {
-			defer wg.Done()
-			logger.Debugf("putProvider(%s, %s)", internal.LoggableProviderRecordBytes(keyMH), p)
-			err := dht.protoMessenger.PutProvider(ctx, p, keyMH, dht.host)
-			if err != nil {
-				logger.Debug(err)
-			}
-		}(p)
-	}
-	wg.Wait()
+	log.Debugw("sending provider record", "cid", key, "strategy", strategy, "peers", peers)
+
+	failed := dht.sendProviderRecords(ctx, keyMH, strategy, start, peers)
 	if exceededDeadline {
 		return context.DeadlineExceeded, make([]peer.ID, 0), 0
 	}
+	if err := ctx.Err(); err != nil {
+		return err, peers, numLookups
+	}
 
-	_, e := dht.EclipseDetection(ctx, keyMH, peers)
-	if e != nil {
+	if e := dht.provideDetection(ctx, keyMH, peers); e != nil {
 		return e, make([]peer.ID, 0), 0
 	}
-
-	return ctx.Err(), peers, numLookups
+	return provideResult(keyMH, peers, failed), peers, numLookups
 }
 
 // FindProviders searches until the context expires.
@@ -759,8 +943,11 @@ func (dht *IpfsDHT) FindProvidersReturnOnPathNodes(ctx context.Context, c cid.Ci
 		return nil, nil, routing.ErrNotSupported
 	} else if !c.Defined() {
 		return nil, nil, fmt.Errorf("invalid cid: undefined")
+	} else if !dht.providersEnabled(c.Hash()) {
+		return nil, nil, routing.ErrNotSupported
 	}
-	fmt.Printf("[FindProvidersReturnOnPathNodes] %s", c.String())
+	ctx = withCorrelationID(ctx)
+	opLogger(ctx).Debugw("finding providers and on-path peers", "cid", c)
 
 	var providers []peer.AddrInfo
 	var onpathPeers []peer.ID
@@ -772,8 +959,7 @@ func (dht *IpfsDHT) FindProvidersReturnOnPathNodes(ctx context.Context, c cid.Ci
 		onpathPeers = append(onpathPeers, p)
 	}
 
-	fmt.Printf("[FindProviders] Find providers contacted %d providers", len(providers))
-	logger.Debugf("[FindProviders] Find providers contacted %d providers: %d", len(providers))
+	opLogger(ctx).Debugw("found providers", "cid", c, "providers", len(providers), "contacted", len(onpathPeers))
 
 	return providers, onpathPeers, nil
 }
@@ -784,7 +970,7 @@ func (dht *IpfsDHT) FindProvidersReturnOnPathNodes(ctx context.Context, c cid.Ci
 // completes. Note: not reading from the returned channel may block the query
 // from progressing.
 func (dht *IpfsDHT) FindProvidersAsyncReturnOnPathNodes(ctx context.Context, key cid.Cid, count int) (<-chan peer.AddrInfo, <-chan peer.ID) {
-	if !dht.enableProviders || !key.Defined() {
+	if !key.Defined() || !dht.providersEnabled(key.Hash()) {
 		peerOut := make(chan peer.AddrInfo)
 		peersContacted := make(chan peer.ID)
 		close(peerOut)
@@ -792,7 +978,7 @@ func (dht *IpfsDHT) FindProvidersAsyncReturnOnPathNodes(ctx context.Context, key
 		return peerOut, peersContacted
 	}
 
-	fmt.Printf("[FindProvidersAsyncReturnOnPathNodes] count is %d for Cid: %s \n", count, key.String())
+	ctx = withCorrelationID(ctx)
 
 	chSize := count
 	if count == 0 {
@@ -803,8 +989,7 @@ func (dht *IpfsDHT) FindProvidersAsyncReturnOnPathNodes(ctx context.Context, key
 
 	keyMH := key.Hash()
 
-	logger.Debugw("finding providers", "cid", key, "mh", internal.LoggableProviderRecordBytes(keyMH))
-	fmt.Printf("[FindProvidersAsyncReturnOnPathNodes] Finding providers for key: %s\n", key.String())
+	opLogger(ctx).Debugw("finding providers", "cid", key, "mh", internal.LoggableProviderRecordBytes(keyMH), "count", count)
 	go dht.findProvidersAsyncRoutineReturnOnPathNodes(ctx, keyMH, count, peerOut, peersContacted)
 
 	return peerOut, peersContacted
@@ -861,19 +1046,23 @@ func (dht *IpfsDHT) findProvidersAsyncRoutineReturnOnPathNodes(ctx context.Conte
 		lookupRes, err := dht.runLookupWithFollowup(ctx, string(key),
 			func(ctx context.Context, p peer.ID) ([]*peer.AddrInfo, error) {
 				// For DHT query command
-				routing.PublishQueryEvent(ctx, &routing.QueryEvent{
+				publishQueryEvent(ctx, &routing.QueryEvent{
 					Type: routing.SendingQuery,
 					ID:   p,
 				})
 				mutex.Lock()
 				queryCounter += 1
-				fmt.Printf("%d [runLookupWithFollowup] GetProviders sent to peer: %s for key: %s\n", queryCounter, peer.Encode(p), key.B58String())
+				opLogger(ctx).Debugw("sending GET_PROVIDERS", "peer", p, "key", internal.LoggableProviderRecordBytes(key), "query", queryCounter)
 				mutex.Unlock()
 				select {
 				case peersContacted <- p:
 				}
 
-				provs, closest, err := dht.protoMessenger.GetProviders(ctx, p, key)
+				want := -1
+				if !findAll {
+					want = count - psSize()
+				}
+				provs, closest, err := dht.getProviders(ctx, p, key, want)
 				if err != nil {
 					return nil, err
 				}
@@ -882,7 +1071,7 @@ func (dht *IpfsDHT) findProvidersAsyncRoutineReturnOnPathNodes(ctx context.Conte
 
 				// Add unique providers from request, up to 'count'
 				for _, prov := range provs {
-					dht.maybeAddAddrs(prov.ID, prov.Addrs, peerstore.TempAddrTTL)
+					dht.addProviderAddrs(prov.ID, prov.Addrs)
 					logger.Debugf("got provider: %s", prov)
 					if psTryAdd(prov.ID) {
 						logger.Debugf("using provider: %s", prov)
@@ -902,7 +1091,7 @@ func (dht *IpfsDHT) findProvidersAsyncRoutineReturnOnPathNodes(ctx context.Conte
 				// Give closer peers back to the query to be queried
 				logger.Debugf("got closer peers: %d %s", len(closest), closest)
 
-				routing.PublishQueryEvent(ctx, &routing.QueryEvent{
+				publishQueryEvent(ctx, &routing.QueryEvent{
 					Type:      routing.PeerResponse,
 					ID:        p,
 					Responses: closest,
@@ -910,13 +1099,13 @@ func (dht *IpfsDHT) findProvidersAsyncRoutineReturnOnPathNodes(ctx context.Conte
 
 				return closest, nil
 			},
-			func() bool {
+			func(*lookupState) bool {
 				return !findAll && psSize() >= count
 			},
 		)
 
 		if err == nil && ctx.Err() == nil && lookupRes.completed {
-			dht.routingTable.ResetCplRefreshedAtForID(kb.ConvertKey(string(key)), time.Now())
+			dht.routingTable.ResetCplRefreshedAtForID(kb.ConvertKey(string(key)), dht.clock.Now())
 		}
 		if lookupRes != nil {
 			return (*lookupRes).peers, err
@@ -928,26 +1117,26 @@ func (dht *IpfsDHT) findProvidersAsyncRoutineReturnOnPathNodes(ctx context.Conte
 	var netsize float64
 	var netsizeErr error
 	if enableSpecialProvide {
-		netsize, netsizeErr = dht.nsEstimator.NetworkSize()
-		if netsizeErr != nil {
-			dht.GatherNetsizeData()
-			netsize, netsizeErr = dht.nsEstimator.NetworkSize()
-		}
+		netsize, netsizeErr = dht.networkSize(ctx)
 	}
 	if enableSpecialProvide && netsizeErr == nil {
-		minCPL := int(math.Ceil(math.Log2(netsize/float64(dht.specialProvideNumber)))) - 1
-		fmt.Println("Finding providers from all peers with CPL", minCPL)
+		minCPL := int(math.Ceil(math.Log2(netsize/float64(dht.getSpecialProvideNumber())))) - 1
+		opLogger(ctx).Debugw("finding providers from all peers in the region around the key", "key", internal.LoggableProviderRecordBytes(key), "cpl", minCPL)
 		var numLookups int
 		peers, numLookups, err = dht.GetPeersWithCPL(ctx, string(key), minCPL, requestFn)
+		if err == ErrCPLBudgetExceeded {
+			// ask the part of the region we managed to enumerate
+			opLogger(ctx).Warnw("provider lookup exceeded its lookup budget", "key", internal.LoggableProviderRecordBytes(key), "peers", len(peers))
+			err = nil
+		}
 		if err != nil {
-			fmt.Println("Error in wider lookup for cid", key)
-			fmt.Println(err)
+			opLogger(ctx).Warnw("failed to enumerate the region around the key", "key", internal.LoggableProviderRecordBytes(key), "error", err)
 			return
 		}
-		fmt.Println("FindProviders for", key, "took", numLookups, "lookups.")
+		opLogger(ctx).Debugw("enumerated the region around the key", "key", internal.LoggableProviderRecordBytes(key), "lookups", numLookups)
 	} else {
 		if netsizeErr != nil {
-			fmt.Println("Defaulting to regular FindProviders operation due to error in netsize estimation:", netsizeErr)
+			opLogger(ctx).Infow("defaulting to regular provider lookup, network size estimation failed", "key", internal.LoggableProviderRecordBytes(key), "error", netsizeErr)
 		}
 		peers, err = requestFn(ctx, string(key))
 	}
@@ -959,21 +1148,25 @@ func (dht *IpfsDHT) findProvidersAsyncRoutineReturnOnPathNodes(ctx context.Conte
 		// 	fmt.Println(peers[i])
 		// }
 
-		_, e := dht.EclipseDetection(ctx, key, peers)
-		if e != nil {
-			fmt.Println(e)
+		if _, e := dht.EclipseDetection(ctx, key, peers); e != nil {
+			opLogger(ctx).Debugw("eclipse detection failed", "key", internal.LoggableProviderRecordBytes(key), "error", e)
 		}
 	}
 }
 
 // FindProviders searches until the context expires.
 func (dht *IpfsDHT) FindProviders(ctx context.Context, c cid.Cid) ([]peer.AddrInfo, error) {
-	fmt.Println("FindProviders: cid ", c, "hash:", c.Hash())
-
+	ctx = withCorrelationID(ctx)
 	if !dht.enableProviders {
 		return nil, routing.ErrNotSupported
 	} else if !c.Defined() {
 		return nil, fmt.Errorf("invalid cid: undefined")
+	} else if !dht.providersEnabled(c.Hash()) {
+		return nil, routing.ErrNotSupported
+	}
+	ctx, err := dht.chargeQuota(ctx, quotaOpLookup)
+	if err != nil {
+		return nil, err
 	}
 
 	var providers []peer.AddrInfo
@@ -989,9 +1182,15 @@ func (dht *IpfsDHT) FindProviders(ctx context.Context, c cid.Cid) ([]peer.AddrIn
 // completes. Note: not reading from the returned channel may block the query
 // from progressing.
 func (dht *IpfsDHT) FindProvidersAsync(ctx context.Context, key cid.Cid, count int) <-chan peer.AddrInfo {
-	fmt.Println("FindProvidersAsync: cid ", key, ", hash:", key.Hash())
-
-	if !dht.enableProviders || !key.Defined() {
+	ctx = withCorrelationID(ctx)
+	if !key.Defined() || !dht.providersEnabled(key.Hash()) {
+		peerOut := make(chan peer.AddrInfo)
+		close(peerOut)
+		return peerOut
+	}
+	ctx, err := dht.chargeQuota(ctx, quotaOpLookup)
+	if err != nil {
+		opLogger(ctx).Debugw("not finding providers", "cid", key, "error", err)
 		peerOut := make(chan peer.AddrInfo)
 		close(peerOut)
 		return peerOut
@@ -1005,14 +1204,25 @@ func (dht *IpfsDHT) FindProvidersAsync(ctx context.Context, key cid.Cid, count i
 
 	keyMH := key.Hash()
 
-	logger.Debugw("finding providers", "cid", key, "mh", internal.LoggableProviderRecordBytes(keyMH))
-	go dht.findProvidersAsyncRoutine(ctx, keyMH, count, peerOut)
+	opLogger(ctx).Debugw("finding providers", "cid", key, "mh", internal.LoggableProviderRecordBytes(keyMH))
+	found := peerOut
+	if dht.providerResolver != nil {
+		found = make(chan peer.AddrInfo, chSize)
+		go dht.resolveProviderAddrs(ctx, found, peerOut)
+	}
+	if dht.lookupDedup != nil && dedupable(ctx) {
+		go dht.findProvidersShared(ctx, keyMH, count, found)
+	} else {
+		go dht.findProvidersAsyncRoutine(ctx, keyMH, count, found)
+	}
 	return peerOut
 }
 
 func (dht *IpfsDHT) findProvidersAsyncRoutine(ctx context.Context, key multihash.Multihash, count int, peerOut chan peer.AddrInfo) {
 	defer close(peerOut)
 
+	ctx, hints := dht.withDetectorHints(ctx)
+
 	findAll := count == 0
 
 	ps := make(map[peer.ID]struct{})
@@ -1058,12 +1268,16 @@ func (dht *IpfsDHT) findProvidersAsyncRoutine(ctx context.Context, key multihash
 		lookupRes, err := dht.runLookupWithFollowup(ctx, keyStr,
 			func(ctx context.Context, p peer.ID) ([]*peer.AddrInfo, error) {
 				// For DHT query command
-				routing.PublishQueryEvent(ctx, &routing.QueryEvent{
+				publishQueryEvent(ctx, &routing.QueryEvent{
 					Type: routing.SendingQuery,
 					ID:   p,
 				})
 
-				provs, closest, err := dht.protoMessenger.GetProviders(ctx, p, key)
+				want := -1
+				if !findAll {
+					want = count - psSize()
+				}
+				provs, closest, err := dht.getProviders(ctx, p, key, want)
 				if err != nil {
 					return nil, err
 				}
@@ -1072,7 +1286,7 @@ func (dht *IpfsDHT) findProvidersAsyncRoutine(ctx context.Context, key multihash
 
 				// Add unique providers from request, up to 'count'
 				for _, prov := range provs {
-					dht.maybeAddAddrs(prov.ID, prov.Addrs, peerstore.TempAddrTTL)
+					dht.addProviderAddrs(prov.ID, prov.Addrs)
 					logger.Debugf("got provider: %s", prov)
 					if psTryAdd(prov.ID) {
 						logger.Debugf("using provider: %s", prov)
@@ -1092,7 +1306,7 @@ func (dht *IpfsDHT) findProvidersAsyncRoutine(ctx context.Context, key multihash
 				// Give closer peers back to the query to be queried
 				logger.Debugf("got closer peers: %d %s", len(closest), closest)
 
-				routing.PublishQueryEvent(ctx, &routing.QueryEvent{
+				publishQueryEvent(ctx, &routing.QueryEvent{
 					Type:      routing.PeerResponse,
 					ID:        p,
 					Responses: closest,
@@ -1100,12 +1314,12 @@ func (dht *IpfsDHT) findProvidersAsyncRoutine(ctx context.Context, key multihash
 
 				return closest, nil
 			},
-			func() bool {
+			func(*lookupState) bool {
 				return !findAll && psSize() >= count
 			},
 		)
 		if err == nil && ctx.Err() == nil && lookupRes.completed {
-			dht.routingTable.ResetCplRefreshedAtForID(kb.ConvertKey(string(key)), time.Now())
+			dht.routingTable.ResetCplRefreshedAtForID(kb.ConvertKey(string(key)), dht.clock.Now())
 		}
 		if lookupRes != nil {
 			return (*lookupRes).peers, err
@@ -1118,36 +1332,32 @@ func (dht *IpfsDHT) findProvidersAsyncRoutine(ctx context.Context, key multihash
 	var netsize float64
 	var netsizeErr error
 	if enableSpecialProvide {
-		netsize, netsizeErr = dht.nsEstimator.NetworkSize()
-		if netsizeErr != nil {
-			dht.GatherNetsizeData()
-			netsize, netsizeErr = dht.nsEstimator.NetworkSize()
-		}
+		netsize, netsizeErr = dht.networkSize(ctx)
 	}
 	if enableSpecialProvide && netsizeErr == nil {
-		minCPL := int(math.Ceil(math.Log2(netsize/float64(dht.specialProvideNumber)))) - 1
-		fmt.Println("Finding providers from all peers with CPL", minCPL)
+		minCPL := int(math.Ceil(math.Log2(netsize/float64(dht.getSpecialProvideNumber())))) - 1
+		opLogger(ctx).Debugw("finding providers from all peers in the region around the key", "key", internal.LoggableProviderRecordBytes(key), "cpl", minCPL)
 		var numLookups int
 		peers, numLookups, err = dht.GetPeersWithCPL(ctx, string(key), minCPL, requestFn)
+		if err == ErrCPLBudgetExceeded {
+			// ask the part of the region we managed to enumerate
+			opLogger(ctx).Warnw("provider lookup exceeded its lookup budget", "key", internal.LoggableProviderRecordBytes(key), "peers", len(peers))
+			err = nil
+		}
 		if err != nil {
-			fmt.Println("Error in wider lookup for cid", key)
-			fmt.Println(err)
+			opLogger(ctx).Warnw("failed to enumerate the region around the key", "key", internal.LoggableProviderRecordBytes(key), "error", err)
 			return
 		}
-		fmt.Println("FindProviders for", key, "took", numLookups, "lookups.")
+		opLogger(ctx).Debugw("enumerated the region around the key", "key", internal.LoggableProviderRecordBytes(key), "lookups", numLookups)
 	} else {
 		if netsizeErr != nil {
-			fmt.Println("Defaulting to regular FindProviders operation due to error in netsize estimation:", netsizeErr)
+			opLogger(ctx).Infow("defaulting to regular provider lookup, network size estimation failed", "key", internal.LoggableProviderRecordBytes(key), "error", netsizeErr)
 		}
 		peers, err = requestFn(ctx, string(key))
 	}
 
 	// // Check here also for eclipse attacks.
 	if peers != nil {
-		fmt.Println("Found closest peers: ")
-		for i := range peers {
-			fmt.Println(peers[i])
-		}
 		sybilcidlist := []string{
 			"12D3KooWNFF7dgefegbMFHXEag5WbKQcTcpNPMnxajrbgLcnLrQs",
 			"12D3KooWHXTpLjXiFAN27SPa3fmgqvAgFisZwWRKJrzx3qgUddKQ",
@@ -1191,30 +1401,44 @@ func (dht *IpfsDHT) findProvidersAsyncRoutine(ctx context.Context, key multihash
 				}
 			}
 		}
-		fmt.Println("Number of Sybils found:", numSybilsFound)
+		opLogger(ctx).Debugw("found closest peers", "key", internal.LoggableProviderRecordBytes(key), "peers", peers, "sybils", numSybilsFound)
 
-		_, e := dht.EclipseDetection(ctx, key, peers)
-		if e != nil {
-			fmt.Println(e)
+		if hints != nil {
+			dht.evaluateDetectorHints(key, peers, hints)
+		}
+
+		if _, e := dht.EclipseDetection(ctx, key, peers); e != nil {
+			opLogger(ctx).Debugw("eclipse detection failed", "key", internal.LoggableProviderRecordBytes(key), "error", e)
 		}
 	}
 }
 
 // FindPeer searches for a peer with given ID.
 func (dht *IpfsDHT) FindPeer(ctx context.Context, id peer.ID) (_ peer.AddrInfo, err error) {
-	fmt.Println("FindPeer: peerid ", id)
+	return dht.findPeer(ctx, id, nil)
+}
 
+// findPeer is FindPeer, collecting the addresses of id returned by the peers queried into srcs if not nil.
+func (dht *IpfsDHT) findPeer(ctx context.Context, id peer.ID, srcs *peerAddrSources) (_ peer.AddrInfo, err error) {
+	ctx = withCorrelationID(ctx)
 	if err := id.Validate(); err != nil {
 		return peer.AddrInfo{}, err
 	}
+	if ctx, err = dht.chargeQuota(ctx, quotaOpLookup); err != nil {
+		return peer.AddrInfo{}, err
+	}
 
-	logger.Debugw("finding peer", "peer", id)
+	opLogger(ctx).Debugw("finding peer", "peer", id)
 
 	// Check if were already connected to them
 	if pi := dht.FindLocal(id); pi.ID != "" {
 		return pi, nil
 	}
 
+	// dial the target as soon as we learn its addresses rather than waiting for the lookup to get to it
+	dialer := newTargetDialer(ctx, dht, id)
+	defer dialer.close()
+
 	lookupRes, err := dht.runLookupWithFollowup(ctx, string(id),
 		func(ctx context.Context, p peer.ID) ([]*peer.AddrInfo, error) {
 			// For DHT query command
@@ -1229,6 +1453,15 @@ func (dht *IpfsDHT) FindPeer(ctx context.Context, id peer.ID) (_ peer.AddrInfo,
 				return nil, err
 			}
 
+			for _, pi := range peers {
+				if pi.ID == id && len(pi.Addrs) > 0 {
+					dialer.offer(pi.Addrs)
+					if srcs != nil {
+						srcs.add(p, pi.Addrs)
+					}
+				}
+			}
+
 			// For DHT query command
 			routing.PublishQueryEvent(ctx, &routing.QueryEvent{
 				Type:      routing.PeerResponse,
@@ -1238,8 +1471,8 @@ func (dht *IpfsDHT) FindPeer(ctx context.Context, id peer.ID) (_ peer.AddrInfo,
 
 			return peers, err
 		},
-		func() bool {
-			return dht.host.Network().Connectedness(id) == network.Connected
+		func(*lookupState) bool {
+			return dialer.isConnected()
 		},
 	)
 
@@ -1247,6 +1480,9 @@ func (dht *IpfsDHT) FindPeer(ctx context.Context, id peer.ID) (_ peer.AddrInfo,
 		return peer.AddrInfo{}, err
 	}
 
+	// give dials started during the lookup a chance to complete
+	dialer.close()
+
 	dialedPeerDuringQuery := false
 	for i, p := range lookupRes.peers {
 		if p == id {
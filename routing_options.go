@@ -1,6 +1,9 @@
 package dht
 
 import (
+	"fmt"
+	"time"
+
 	internalConfig "github.com/libp2p/go-libp2p-kad-dht/internal/config"
 	"github.com/libp2p/go-libp2p/core/routing"
 )
@@ -19,3 +22,130 @@ func Quorum(n int) routing.Option {
 		return nil
 	}
 }
+
+type addressOnlyOptionKey struct{}
+
+// AddressOnly is a FindPeerWithOptions option that returns the addresses of the peer learned during the lookup without
+// dialing the peer, for callers that only need its addresses, e.g. to pass them to another subsystem.
+func AddressOnly() routing.Option {
+	return func(opts *routing.Options) error {
+		if opts.Other == nil {
+			opts.Other = make(map[interface{}]interface{}, 1)
+		}
+		opts.Other[addressOnlyOptionKey{}] = true
+		return nil
+	}
+}
+
+func isAddressOnly(opts *routing.Options) bool {
+	addrOnly, _ := opts.Other[addressOnlyOptionKey{}].(bool)
+	return addrOnly
+}
+
+type (
+	firstDialableOptionKey   struct{}
+	searchTimeoutOptionKey   struct{}
+	keepSearchingOptionKey   struct{}
+	livenessOptionKey        struct{}
+	dropUnreachableOptionKey struct{}
+)
+
+// livenessOption is the configuration of ProviderLivenessCheck.
+type livenessOption struct {
+	check       ProviderLiveness
+	concurrency int
+}
+
+// FirstDialableProvider is a FindProvidersWithOptions option that stops the search as soon as a provider could be
+// dialed, and only returns that provider. This suits consumers that fetch the content right away, e.g. gateways.
+func FirstDialableProvider() routing.Option {
+	return func(opts *routing.Options) error {
+		if opts.Other == nil {
+			opts.Other = make(map[interface{}]interface{}, 1)
+		}
+		opts.Other[firstDialableOptionKey{}] = true
+		return nil
+	}
+}
+
+// ProviderSearchTimeout is a FindProvidersWithOptions option that stops the search after d, returning the providers
+// found so far instead of an error.
+func ProviderSearchTimeout(d time.Duration) routing.Option {
+	return func(opts *routing.Options) error {
+		if opts.Other == nil {
+			opts.Other = make(map[interface{}]interface{}, 1)
+		}
+		opts.Other[searchTimeoutOptionKey{}] = d
+		return nil
+	}
+}
+
+// KeepSearching is a FindProvidersWithOptions option that keeps searching after count providers were found, until
+// the lookup completes or the context is done, returning every provider found. This suits consumers collecting as
+// many providers as possible, e.g. indexers.
+func KeepSearching() routing.Option {
+	return func(opts *routing.Options) error {
+		if opts.Other == nil {
+			opts.Other = make(map[interface{}]interface{}, 1)
+		}
+		opts.Other[keepSearchingOptionKey{}] = true
+		return nil
+	}
+}
+
+func isFirstDialable(opts *routing.Options) bool {
+	firstDialable, _ := opts.Other[firstDialableOptionKey{}].(bool)
+	return firstDialable
+}
+
+func searchTimeout(opts *routing.Options) time.Duration {
+	d, _ := opts.Other[searchTimeoutOptionKey{}].(time.Duration)
+	return d
+}
+
+func isKeepSearching(opts *routing.Options) bool {
+	keepSearching, _ := opts.Other[keepSearchingOptionKey{}].(bool)
+	return keepSearching
+}
+
+// ProviderLivenessCheck is a FindProvidersWithOptions option that checks whether providers are live before returning
+// them, checking at most concurrency providers at a time. Live providers are returned as soon as they pass the check,
+// the others only once the search is over, or not at all with DropUnreachableProviders. This spares consumers such as
+// gateways from trying dead providers first.
+func ProviderLivenessCheck(check ProviderLiveness, concurrency int) routing.Option {
+	return func(opts *routing.Options) error {
+		if check != LivenessAddrs && check != LivenessDial {
+			return fmt.Errorf("invalid provider liveness check %d", check)
+		}
+		if concurrency <= 0 {
+			return fmt.Errorf("liveness check concurrency must be positive, got %d", concurrency)
+		}
+		if opts.Other == nil {
+			opts.Other = make(map[interface{}]interface{}, 1)
+		}
+		opts.Other[livenessOptionKey{}] = livenessOption{check: check, concurrency: concurrency}
+		return nil
+	}
+}
+
+// DropUnreachableProviders is a FindProvidersWithOptions option that drops the providers failing the
+// ProviderLivenessCheck instead of returning them last.
+func DropUnreachableProviders() routing.Option {
+	return func(opts *routing.Options) error {
+		if opts.Other == nil {
+			opts.Other = make(map[interface{}]interface{}, 1)
+		}
+		opts.Other[dropUnreachableOptionKey{}] = true
+		return nil
+	}
+}
+
+func getLivenessOption(opts *routing.Options) (livenessOption, bool) {
+	l, ok := opts.Other[livenessOptionKey{}].(livenessOption)
+	return l, ok
+}
+
+func isDropUnreachable(opts *routing.Options) bool {
+	drop, _ := opts.Other[dropUnreachableOptionKey{}].(bool)
+	return drop
+}
@@ -0,0 +1,91 @@
+package dht
+
+import (
+	"context"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Reasons IpfsDHT.AddPeer doesn't add a peer to the routing table.
+const (
+	// AddPeerSelf means the peer is ourselves.
+	AddPeerSelf = "self"
+	// AddPeerPresent means the peer already is in the routing table.
+	AddPeerPresent = "present"
+	// AddPeerNotAllowed means the peer isn't allowed, see PeerAllowlist.
+	AddPeerNotAllowed = "not-allowed"
+	// AddPeerUnreachable means connecting to the peer failed.
+	AddPeerUnreachable = "unreachable"
+	// AddPeerNotDHTServer means the peer doesn't speak our DHT protocols as a server, or didn't answer our ping when
+	// only the peers that answered our queries are added.
+	AddPeerNotDHTServer = "not-dht-server"
+	// AddPeerFiltered means the peer was rejected by the RoutingTableFilter.
+	AddPeerFiltered = "filtered"
+	// AddPeerFlagged means the peer was flagged for returning suspicious closer peers, see BehaviorEviction.
+	AddPeerFlagged = "flagged"
+	// AddPeerNotAdmitted means the peer was rejected by the RoutingTableAdmission policy.
+	AddPeerNotAdmitted = "not-admitted"
+	// AddPeerRejected means the routing table rejected the peer, its bucket being full or the diversity filter
+	// refusing it.
+	AddPeerRejected = "rejected"
+)
+
+// AddPeer considers a peer the application discovered through other channels, e.g. mDNS or a rendezvous point, for
+// the routing table. The peer is connected to, and has to pass the same protocol checks, filters, admission policy and
+// diversity filter as the peers we discover ourselves. Peers added this way are reported with RTReasonAdded.
+//
+// It returns whether the peer was added and, if not, one of the AddPeer reasons. The error is only set when connecting
+// to or, with queried peers only, pinging the peer fails, or ctx is done.
+func (dht *IpfsDHT) AddPeer(ctx context.Context, ai peer.AddrInfo) (added bool, reason string, err error) {
+	p := ai.ID
+	if p == dht.self {
+		return false, AddPeerSelf, nil
+	}
+	if dht.routingTable.Find(p) != "" {
+		return false, AddPeerPresent, nil
+	}
+	if !dht.peerAllowed(p) {
+		return false, AddPeerNotAllowed, nil
+	}
+
+	ai.Addrs = dht.filterAddrs(p, ai.Addrs)
+	// waits for identify, so that the protocols of the peer are known
+	if err := dht.host.Connect(ctx, ai); err != nil {
+		return false, AddPeerUnreachable, err
+	}
+	if proto, err := dht.peerstore.FirstSupportedProtocol(p, dht.protocolsStrs...); err != nil {
+		return false, AddPeerNotDHTServer, err
+	} else if proto == "" {
+		return false, AddPeerNotDHTServer, nil
+	}
+	queryPeer := false
+	if dht.queriedPeersOnly && !dht.isBootstrapPeer(p) {
+		if err := dht.Ping(ctx, p); err != nil {
+			return false, AddPeerNotDHTServer, err
+		}
+		queryPeer = true
+	}
+	if dht.routingTablePeerFilter != nil && !dht.routingTablePeerFilter(dht, p) {
+		return false, AddPeerFiltered, nil
+	}
+	if dht.behavior.flagged(p) {
+		return false, AddPeerFlagged, nil
+	}
+	if !dht.admitRTPeer(p) {
+		return false, AddPeerNotAdmitted, nil
+	}
+
+	done := make(chan addPeerRTRes, 1)
+	select {
+	case dht.addPeerToRTChan <- addPeerRTReq{p: p, queryPeer: queryPeer, reason: RTReasonAdded, done: done}:
+	case <-ctx.Done():
+		return false, "", ctx.Err()
+	case <-dht.ctx.Done():
+		return false, "", dht.ctx.Err()
+	}
+	if res := <-done; res.err != nil {
+		return false, AddPeerRejected, nil
+	}
+	// the peer may also have been added on its own as it connected
+	return true, "", nil
+}
@@ -0,0 +1,161 @@
+package dht
+
+import (
+	"crypto/sha256"
+	"math/bits"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	manet "github.com/multiformats/go-multiaddr/net"
+
+	kb "github.com/libp2p/go-libp2p-kbucket"
+	"github.com/libp2p/go-libp2p-kbucket/peerdiversity"
+
+	dhtcfg "github.com/libp2p/go-libp2p-kad-dht/internal/config"
+)
+
+// AdmissionPolicy is consulted before a peer is added to the routing table, in addition to the routing table filter.
+// It allows raising the cost for an attacker of getting routing table slots, e.g. by requiring peers to have been
+// around for some time.
+type AdmissionPolicy = dhtcfg.AdmissionPolicy
+
+var (
+	_ AdmissionPolicy = AdmitAllPolicy{}
+	_ AdmissionPolicy = (*IPDiversityPolicy)(nil)
+	_ AdmissionPolicy = (*FirstSeenPolicy)(nil)
+)
+
+// AdmitAllPolicy admits every peer. This is the default.
+type AdmitAllPolicy struct{}
+
+// Admit implements AdmissionPolicy.
+func (AdmitAllPolicy) Admit(interface{}, peer.ID) bool { return true }
+
+// IPDiversityPolicy admits a peer only if fewer than a given number of routing table peers are in the same IP group as
+// the peer. The groups are those of the routing table diversity filter, see NewRTPeerDiversityFilter: the /16, or the
+// legacy /8 allocation, of IPv4 addresses and the ASN of IPv6 addresses, of the connections to the peers. Peers we are
+// not connected to are not admitted.
+type IPDiversityPolicy struct {
+	maxPerGroup int
+}
+
+// NewIPDiversityPolicy returns an IPDiversityPolicy allowing at most maxPerGroup routing table peers per IP group.
+func NewIPDiversityPolicy(maxPerGroup int) *IPDiversityPolicy {
+	return &IPDiversityPolicy{maxPerGroup: maxPerGroup}
+}
+
+// Admit implements AdmissionPolicy. It fills a diversity filter with the peers of the routing table and admits p if
+// the filter has room for it too.
+func (pol *IPDiversityPolicy) Admit(dht interface{}, p peer.ID) bool {
+	d, ok := dht.(*IpfsDHT)
+	if !ok {
+		return true
+	}
+	f, err := peerdiversity.NewFilter(NewRTPeerDiversityFilter(d.host, pol.maxPerGroup, pol.maxPerGroup), "rt/admission",
+		func(id peer.ID) int {
+			return kb.CommonPrefixLen(d.selfKey, kb.ConvertPeerID(id))
+		})
+	if err != nil {
+		logger.Warnw("failed to construct the IP diversity filter", "error", err)
+		return false
+	}
+	for _, other := range d.routingTable.ListPeers() {
+		f.TryAdd(other)
+	}
+	return f.TryAdd(p)
+}
+
+// peerIPGroups returns the IP groups of the addresses we are connected to p on.
+func (dht *IpfsDHT) peerIPGroups(p peer.ID) []string {
+	var groups []string
+	for _, c := range dht.host.Network().ConnsToPeer(p) {
+		ip, err := manet.ToIP(c.RemoteMultiaddr())
+		if err != nil {
+			continue
+		}
+		groups = append(groups, ipGroup(ip))
+	}
+	return groups
+}
+
+// ipGroup returns the /16 of an IPv4 address or the /32 of an IPv6 address.
+func ipGroup(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(16, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(32, 128)).String()
+}
+
+// maxFirstSeenEntries bounds the number of peers a FirstSeenPolicy keeps track of.
+const maxFirstSeenEntries = 100_000
+
+// FirstSeenPolicy is an experimental policy admitting a peer once it has been seen for a minimum time, or right away
+// if its ID solves a client puzzle: the SHA256 hash of the peer ID must start with a given number of zero bits. The
+// puzzle makes fresh identities expensive to mine, while the minimum age keeps an attacker that churns identities from
+// immediately taking over routing table slots.
+type FirstSeenPolicy struct {
+	minAge     time.Duration
+	difficulty int
+
+	mu        sync.Mutex
+	firstSeen map[peer.ID]time.Time
+}
+
+// NewFirstSeenPolicy returns a FirstSeenPolicy requiring peers to have been seen at least minAge ago or to solve a
+// puzzle of the given difficulty, in leading zero bits. A difficulty of 0 disables the puzzle.
+func NewFirstSeenPolicy(minAge time.Duration, difficulty int) *FirstSeenPolicy {
+	return &FirstSeenPolicy{
+		minAge:     minAge,
+		difficulty: difficulty,
+		firstSeen:  make(map[peer.ID]time.Time),
+	}
+}
+
+// Admit implements AdmissionPolicy.
+func (pol *FirstSeenPolicy) Admit(_ interface{}, p peer.ID) bool {
+	if pol.difficulty > 0 && peerIDPuzzleBits(p) >= pol.difficulty {
+		return true
+	}
+
+	pol.mu.Lock()
+	defer pol.mu.Unlock()
+
+	now := time.Now()
+	seen, ok := pol.firstSeen[p]
+	if !ok {
+		if len(pol.firstSeen) >= maxFirstSeenEntries {
+			pol.pruneLocked(now)
+		}
+		pol.firstSeen[p] = now
+		return pol.minAge <= 0
+	}
+	return now.Sub(seen) >= pol.minAge
+}
+
+// pruneLocked forgets peers seen long ago, they have had plenty of time to be admitted. If that is not enough, it
+// starts over.
+func (pol *FirstSeenPolicy) pruneLocked(now time.Time) {
+	for p, seen := range pol.firstSeen {
+		if now.Sub(seen) > 2*pol.minAge {
+			delete(pol.firstSeen, p)
+		}
+	}
+	if len(pol.firstSeen) >= maxFirstSeenEntries {
+		pol.firstSeen = make(map[peer.ID]time.Time)
+	}
+}
+
+// peerIDPuzzleBits returns the number of leading zero bits of the SHA256 hash of p.
+func peerIDPuzzleBits(p peer.ID) int {
+	h := sha256.Sum256([]byte(p))
+	n := 0
+	for _, b := range h {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+		n += 8
+	}
+	return n
+}
@@ -0,0 +1,199 @@
+package dht
+
+import (
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/peer"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+const (
+	// behaviorWindow is the number of most recent responses per peer evidence is collected over.
+	behaviorWindow = 50
+	// behaviorMinCloserPeers is the minimum size of a closer peer set to be judged on IP group dominance, so that
+	// small networks are not penalized.
+	behaviorMinCloserPeers = 4
+	// behaviorDominance is the fraction of a closer peer set that, if denylisted or from a single IP group, makes the
+	// response suspicious.
+	behaviorDominance = 0.5
+)
+
+// EvtRoutingTablePeerEvicted is emitted on the host's event bus when a peer is evicted from the routing table because
+// of the closer peers it returned.
+type EvtRoutingTablePeerEvicted struct {
+	Peer peer.ID
+	// Suspicious and Responses are the number of suspicious responses among the recent responses of the peer that
+	// led to the eviction.
+	Suspicious int
+	Responses  int
+}
+
+// behaviorTracker collects evidence on the closer peers routing table peers return to us, and is the only source of
+// evidence of the eviction. A response is suspicious if its closer peers are dominated by denylisted peers or by peers
+// from a single IP group. A peer is flagged, and
+// evicted from the routing table, once a large enough fraction of its recent responses is suspicious, and is only
+// readmitted once that fraction dropped below a lower threshold. The gap between both thresholds keeps peers from
+// flapping in and out of the routing table.
+type behaviorTracker struct {
+	denylist         map[peer.ID]struct{}
+	minEvidence      int
+	evictThreshold   float64
+	recoverThreshold float64
+	emitter          event.Emitter
+
+	mu    sync.Mutex
+	peers map[peer.ID]*peerBehavior
+}
+
+type peerBehavior struct {
+	outcomes   [behaviorWindow]bool // ring buffer of responses, true if suspicious
+	n, next    int
+	suspicious int
+	flagged    bool
+}
+
+func (b *peerBehavior) add(suspicious bool) {
+	if b.n == behaviorWindow {
+		if b.outcomes[b.next] {
+			b.suspicious--
+		}
+	} else {
+		b.n++
+	}
+	b.outcomes[b.next] = suspicious
+	b.next = (b.next + 1) % behaviorWindow
+	if suspicious {
+		b.suspicious++
+	}
+}
+
+func (b *peerBehavior) ratio() float64 {
+	if b.n == 0 {
+		return 0
+	}
+	return float64(b.suspicious) / float64(b.n)
+}
+
+// observeBehavior records a response of p and evicts p from the routing table if it just got flagged.
+func (dht *IpfsDHT) observeBehavior(p peer.ID, closer []*peer.AddrInfo) {
+	if dht.behavior == nil {
+		return
+	}
+	dht.recordBehavior(p, dht.behavior.suspicious(closer))
+}
+
+// recordBehavior records a response of p judged to be suspicious or not, and evicts p from the routing table if it
+// just got flagged.
+func (dht *IpfsDHT) recordBehavior(p peer.ID, suspicious bool) {
+	bt := dht.behavior
+	if bt == nil {
+		return
+	}
+
+	bt.mu.Lock()
+	b, ok := bt.peers[p]
+	if !ok {
+		if !suspicious {
+			// only keep state for peers we have something on
+			bt.mu.Unlock()
+			return
+		}
+		b = &peerBehavior{}
+		bt.peers[p] = b
+	}
+	b.add(suspicious)
+
+	evict := false
+	switch r := b.ratio(); {
+	case !b.flagged && b.n >= bt.minEvidence && r >= bt.evictThreshold:
+		b.flagged = true
+		evict = true
+	case b.flagged && r < bt.recoverThreshold:
+		b.flagged = false
+		logger.Debugw("peer recovered from suspicious behavior", "peer", p)
+	case !b.flagged && b.suspicious == 0:
+		delete(bt.peers, p)
+	}
+	evt := EvtRoutingTablePeerEvicted{Peer: p, Suspicious: b.suspicious, Responses: b.n}
+	bt.mu.Unlock()
+
+	if evict {
+		logger.Infow("evicting peer returning suspicious closer peers", "peer", p, "suspicious", evt.Suspicious, "responses", evt.Responses)
+		dht.removeFromRT(p, RTReasonSuspicious)
+		if err := bt.emitter.Emit(evt); err != nil {
+			logger.Debugw("failed to emit eviction event", "error", err)
+		}
+	}
+}
+
+// flagged returns true if p is flagged for suspicious behavior and must be kept out of the routing table.
+func (bt *behaviorTracker) flagged(p peer.ID) bool {
+	if bt == nil {
+		return false
+	}
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	b, ok := bt.peers[p]
+	return ok && b.flagged
+}
+
+// PeerReputation returns the reputation of p from 0 to 1, based on the closer peers it returned to our lookups, see
+// BehaviorEviction: the fraction of its recent responses that weren't suspicious, and 0 while it is flagged. Peers we
+// have no evidence on have a reputation of 1, as do all peers if BehaviorEviction is disabled.
+func (dht *IpfsDHT) PeerReputation(p peer.ID) float64 {
+	bt := dht.behavior
+	if bt == nil {
+		return 1
+	}
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	b, ok := bt.peers[p]
+	switch {
+	case !ok:
+		return 1
+	case b.flagged:
+		return 0
+	}
+	return 1 - b.ratio()
+}
+
+// suspicious returns true if the closer peers are dominated by denylisted peers or by a single IP group.
+func (bt *behaviorTracker) suspicious(closer []*peer.AddrInfo) bool {
+	if len(closer) == 0 {
+		return false
+	}
+
+	denied := 0
+	groups := make(map[string]int)
+	maxGroup := 0
+	for _, ai := range closer {
+		if _, ok := bt.denylist[ai.ID]; ok {
+			denied++
+		}
+		// count every peer once per group, private addresses say nothing about the peer's location
+		seen := make(map[string]struct{})
+		for _, a := range ai.Addrs {
+			if !manet.IsPublicAddr(a) {
+				continue
+			}
+			ip, err := manet.ToIP(a)
+			if err != nil {
+				continue
+			}
+			g := ipGroup(ip)
+			if _, ok := seen[g]; ok {
+				continue
+			}
+			seen[g] = struct{}{}
+			if groups[g]++; groups[g] > maxGroup {
+				maxGroup = groups[g]
+			}
+		}
+	}
+
+	if float64(denied) > behaviorDominance*float64(len(closer)) {
+		return true
+	}
+	return len(closer) >= behaviorMinCloserPeers && float64(maxGroup) > behaviorDominance*float64(len(closer))
+}
@@ -0,0 +1,187 @@
+package dht
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/jbenet/goprocess"
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/host/eventbus"
+
+	kb "github.com/libp2p/go-libp2p-kbucket"
+)
+
+// rtEventsBufferSize is the number of routing table events buffered before they are dropped. Events are produced
+// while the routing table is locked and must never block it.
+const rtEventsBufferSize = 256
+
+// RoutingTableEventType is the kind of a routing table change.
+type RoutingTableEventType int
+
+const (
+	// RoutingTablePeerAdded is emitted when a peer is added to the routing table.
+	RoutingTablePeerAdded RoutingTableEventType = iota
+	// RoutingTablePeerRemoved is emitted when a peer is removed from the routing table.
+	RoutingTablePeerRemoved
+	// RoutingTableBucketRefreshed is emitted when the bucket of a common prefix length was refreshed.
+	RoutingTableBucketRefreshed
+)
+
+func (t RoutingTableEventType) String() string {
+	switch t {
+	case RoutingTablePeerAdded:
+		return "peer-added"
+	case RoutingTablePeerRemoved:
+		return "peer-removed"
+	case RoutingTableBucketRefreshed:
+		return "bucket-refreshed"
+	}
+	return fmt.Sprintf("RoutingTableEventType(%d)", int(t))
+}
+
+// Reasons of routing table changes.
+const (
+	// RTReasonQueried means the peer was added after it answered a query.
+	RTReasonQueried = "queried"
+	// RTReasonConnected means the peer was added after connecting to us as a DHT server.
+	RTReasonConnected = "connected"
+	// RTReasonReplaced means the peer was replaced by a new peer in its full bucket.
+	RTReasonReplaced = "replaced"
+	// RTReasonUnresponsive means the peer failed the liveness check of a routing table refresh.
+	RTReasonUnresponsive = "unresponsive"
+	// RTReasonStoppedDHT means the peer stopped speaking the DHT protocol.
+	RTReasonStoppedDHT = "stopped-dht"
+	// RTReasonSuspicious means the peer was evicted for returning suspicious closer peers, see BehaviorEviction.
+	RTReasonSuspicious = "suspicious"
+	// RTReasonRefreshFailed means the refresh query of a bucket failed.
+	RTReasonRefreshFailed = "refresh-failed"
+	// RTReasonAdded means the peer was added by the application with IpfsDHT.AddPeer.
+	RTReasonAdded = "added"
+)
+
+// EvtRoutingTableChanged describes a change of the routing table, see IpfsDHT.RoutingTableEvents.
+type EvtRoutingTableChanged struct {
+	Type RoutingTableEventType
+	// Peer is the added or removed peer, empty for bucket refreshes.
+	Peer peer.ID
+	// CPL is the common prefix length of the peer, or of the refreshed bucket, with our own key.
+	CPL int
+	// Reason is one of the RTReason constants, empty for successful bucket refreshes.
+	Reason string
+}
+
+// rtEvents publishes routing table changes on an event bus private to the DHT, so that the routing tables of several
+// DHTs sharing a host, e.g. the LAN and WAN DHTs, don't mix up.
+type rtEvents struct {
+	bus     event.Bus
+	emitter event.Emitter
+	queue   chan EvtRoutingTableChanged
+
+	mu sync.Mutex
+	// removeReasons are the reasons of the removals the DHT initiated and that are in progress
+	removeReasons map[peer.ID]string
+	// addReason is the reason of the peer being added by rtPeerLoop
+	addReason string
+}
+
+func newRTEvents() (*rtEvents, error) {
+	bus := eventbus.NewBus()
+	emitter, err := bus.Emitter(new(EvtRoutingTableChanged))
+	if err != nil {
+		return nil, err
+	}
+	return &rtEvents{
+		bus:           bus,
+		emitter:       emitter,
+		queue:         make(chan EvtRoutingTableChanged, rtEventsBufferSize),
+		removeReasons: make(map[peer.ID]string),
+	}, nil
+}
+
+// publish queues evt without blocking, dropping it if the queue is full.
+func (e *rtEvents) publish(evt EvtRoutingTableChanged) {
+	select {
+	case e.queue <- evt:
+	default:
+		logger.Debugw("dropping routing table event", "type", evt.Type, "peer", evt.Peer)
+	}
+}
+
+// run forwards the queued events to the subscribers until proc closes.
+func (e *rtEvents) run(proc goprocess.Process) {
+	defer e.emitter.Close()
+	for {
+		select {
+		case evt := <-e.queue:
+			if err := e.emitter.Emit(evt); err != nil {
+				logger.Debugw("failed to emit routing table event", "error", err)
+			}
+		case <-proc.Closing():
+			return
+		}
+	}
+}
+
+// RoutingTableEvents subscribes to the changes of the routing table, delivered as EvtRoutingTableChanged events: peers
+// being added and removed, and buckets being refreshed. Events are dropped rather than slowing down the routing table
+// if the subscribers don't keep up.
+//
+// The subscription must be closed when no longer needed.
+func (dht *IpfsDHT) RoutingTableEvents(opts ...event.SubscriptionOpt) (event.Subscription, error) {
+	return dht.rtEvents.bus.Subscribe(new(EvtRoutingTableChanged), opts...)
+}
+
+// removeFromRT removes p from the routing table for the given reason.
+func (dht *IpfsDHT) removeFromRT(p peer.ID, reason string) {
+	e := dht.rtEvents
+	e.mu.Lock()
+	e.removeReasons[p] = reason
+	e.mu.Unlock()
+
+	dht.routingTable.RemovePeer(p)
+
+	e.mu.Lock()
+	delete(e.removeReasons, p)
+	e.mu.Unlock()
+}
+
+// peerAddedEvent and peerRemovedEvent are called by the routing table callbacks, with the routing table locked, so
+// they must not call into the routing table.
+func (dht *IpfsDHT) peerAddedEvent(p peer.ID) {
+	e := dht.rtEvents
+	e.mu.Lock()
+	reason := e.addReason
+	e.mu.Unlock()
+	e.publish(EvtRoutingTableChanged{
+		Type:   RoutingTablePeerAdded,
+		Peer:   p,
+		CPL:    kb.CommonPrefixLen(dht.selfKey, kb.ConvertPeerID(p)),
+		Reason: reason,
+	})
+}
+
+func (dht *IpfsDHT) peerRemovedEvent(p peer.ID) {
+	e := dht.rtEvents
+	e.mu.Lock()
+	reason, ok := e.removeReasons[p]
+	e.mu.Unlock()
+	if !ok {
+		// the routing table only removes peers on its own to make room for new ones
+		reason = RTReasonReplaced
+	}
+	e.publish(EvtRoutingTableChanged{
+		Type:   RoutingTablePeerRemoved,
+		Peer:   p,
+		CPL:    kb.CommonPrefixLen(dht.selfKey, kb.ConvertPeerID(p)),
+		Reason: reason,
+	})
+}
+
+func (dht *IpfsDHT) bucketRefreshedEvent(cpl int, failed bool) {
+	evt := EvtRoutingTableChanged{Type: RoutingTableBucketRefreshed, CPL: cpl}
+	if failed {
+		evt.Reason = RTReasonRefreshFailed
+	}
+	dht.rtEvents.publish(evt)
+}
@@ -11,6 +11,7 @@ import (
 
 	kbucket "github.com/libp2p/go-libp2p-kbucket"
 
+	"github.com/benbjohnson/clock"
 	"github.com/hashicorp/go-multierror"
 	logging "github.com/ipfs/go-log"
 	"github.com/multiformats/go-base32"
@@ -42,6 +43,7 @@ type RtRefreshManager struct {
 	refreshKeyGenFnc    func(cpl uint) (string, error)              // generate the key for the query to refresh this cpl
 	refreshQueryFnc     func(ctx context.Context, key string) error // query to run for a refresh.
 	refreshQueryTimeout time.Duration                               // timeout for one refresh query
+	evictPeerFnc        func(p peer.ID)                             // removes a peer failing the liveness check
 
 	// interval between two periodic refreshes.
 	// also, a cpl wont be refreshed if the time since it was last refreshed
@@ -51,7 +53,11 @@ type RtRefreshManager struct {
 
 	triggerRefresh chan *triggerRefreshReq // channel to write refresh requests to.
 
+	setRefreshInterval chan time.Duration // channel to write refresh interval changes to.
+
 	refreshDoneCh chan struct{} // write to this channel after every refresh
+
+	clock clock.Clock // schedules refreshes, tests can advance it
 }
 
 func NewRtRefreshManager(h host.Host, rt *kbucket.RoutingTable, autoRefresh bool,
@@ -60,8 +66,16 @@ func NewRtRefreshManager(h host.Host, rt *kbucket.RoutingTable, autoRefresh bool
 	refreshQueryTimeout time.Duration,
 	refreshInterval time.Duration,
 	successfulOutboundQueryGracePeriod time.Duration,
-	refreshDoneCh chan struct{}) (*RtRefreshManager, error) {
+	refreshDoneCh chan struct{},
+	evictPeerFnc func(p peer.ID),
+	clk clock.Clock) (*RtRefreshManager, error) {
 
+	if evictPeerFnc == nil {
+		evictPeerFnc = rt.RemovePeer
+	}
+	if clk == nil {
+		clk = clock.New()
+	}
 	ctx, cancel := context.WithCancel(context.Background())
 	return &RtRefreshManager{
 		ctx:       ctx,
@@ -73,13 +87,16 @@ func NewRtRefreshManager(h host.Host, rt *kbucket.RoutingTable, autoRefresh bool
 		enableAutoRefresh: autoRefresh,
 		refreshKeyGenFnc:  refreshKeyGenFnc,
 		refreshQueryFnc:   refreshQueryFnc,
+		evictPeerFnc:      evictPeerFnc,
 
 		refreshQueryTimeout:                refreshQueryTimeout,
 		refreshInterval:                    refreshInterval,
 		successfulOutboundQueryGracePeriod: successfulOutboundQueryGracePeriod,
 
-		triggerRefresh: make(chan *triggerRefreshReq),
-		refreshDoneCh:  refreshDoneCh,
+		triggerRefresh:     make(chan *triggerRefreshReq),
+		setRefreshInterval: make(chan time.Duration),
+		refreshDoneCh:      refreshDoneCh,
+		clock:              clk,
 	}, nil
 }
 
@@ -117,6 +134,22 @@ func (r *RtRefreshManager) Refresh(force bool) <-chan error {
 	return resp
 }
 
+// SetRefreshInterval changes the interval between two periodic refreshes, which is also the interval within which a
+// cpl isn't refreshed again, taking effect for the next refresh.
+func (r *RtRefreshManager) SetRefreshInterval(ctx context.Context, interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("refresh interval must be positive")
+	}
+	select {
+	case r.setRefreshInterval <- interval:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-r.ctx.Done():
+		return r.ctx.Err()
+	}
+}
+
 // RefreshNoWait requests the refresh manager to refresh the Routing Table.
 // However, it moves on without blocking if it's request can't get through.
 func (r *RtRefreshManager) RefreshNoWait() {
@@ -129,15 +162,18 @@ func (r *RtRefreshManager) RefreshNoWait() {
 func (r *RtRefreshManager) loop() {
 	defer r.refcount.Done()
 
-	var refreshTickrCh <-chan time.Time
+	var (
+		refreshTickr   *clock.Ticker
+		refreshTickrCh <-chan time.Time
+	)
 	if r.enableAutoRefresh {
 		err := r.doRefresh(true)
 		if err != nil {
 			logger.Warn("failed when refreshing routing table", err)
 		}
-		t := time.NewTicker(r.refreshInterval)
-		defer t.Stop()
-		refreshTickrCh = t.C
+		refreshTickr = r.clock.Ticker(r.refreshInterval)
+		defer refreshTickr.Stop()
+		refreshTickrCh = refreshTickr.C
 	}
 
 	for {
@@ -145,6 +181,12 @@ func (r *RtRefreshManager) loop() {
 		var forced bool
 		select {
 		case <-refreshTickrCh:
+		case interval := <-r.setRefreshInterval:
+			r.refreshInterval = interval
+			if refreshTickr != nil {
+				refreshTickr.Reset(interval)
+			}
+			continue
 		case triggerRefreshReq := <-r.triggerRefresh:
 			if triggerRefreshReq.respCh != nil {
 				waiting = append(waiting, triggerRefreshReq.respCh)
@@ -174,14 +216,14 @@ func (r *RtRefreshManager) loop() {
 		// and evict them if they don't reply.
 		var wg sync.WaitGroup
 		for _, ps := range r.rt.GetPeerInfos() {
-			if time.Since(ps.LastSuccessfulOutboundQueryAt) > r.successfulOutboundQueryGracePeriod {
+			if r.clock.Since(ps.LastSuccessfulOutboundQueryAt) > r.successfulOutboundQueryGracePeriod {
 				wg.Add(1)
 				go func(ps kbucket.PeerInfo) {
 					defer wg.Done()
 					livelinessCtx, cancel := context.WithTimeout(r.ctx, peerPingTimeout)
 					if err := r.h.Connect(livelinessCtx, peer.AddrInfo{ID: ps.Id}); err != nil {
 						logger.Debugw("evicting peer after failed ping", "peer", ps.Id, "error", err)
-						r.rt.RemovePeer(ps.Id)
+						r.evictPeerFnc(ps.Id)
 					}
 					cancel()
 				}(ps)
@@ -261,7 +303,7 @@ func min(a int, b int) int {
 }
 
 func (r *RtRefreshManager) refreshCplIfEligible(cpl uint, lastRefreshedAt time.Time) error {
-	if time.Since(lastRefreshedAt) <= r.refreshInterval {
+	if r.clock.Since(lastRefreshedAt) <= r.refreshInterval {
 		logger.Debugf("not running refresh for cpl %d as time since last refresh not above interval", cpl)
 		return nil
 	}
@@ -0,0 +1,179 @@
+package dht
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	u "github.com/ipfs/go-ipfs-util"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multihash"
+)
+
+// saltAttackScore is the DetectionAggregator score from which ProvideSalted considers a salted key under attack and
+// rotates its salt.
+const saltAttackScore = 0.5
+
+// SaltSchedule describes the salted keys content is provided under with ProvideSalted, see SaltedKey. Publishers and
+// clients must agree on the schedule.
+type SaltSchedule struct {
+	// Active is the number of salts content is provided under at once.
+	Active int
+	// Max is the number of salts clients look up, bounding the salts publishers rotate through.
+	Max int
+}
+
+// DefaultSaltSchedule provides content under 2 salts at once, rotating through 8 salts.
+var DefaultSaltSchedule = SaltSchedule{Active: 2, Max: 8}
+
+func (s SaltSchedule) validate() error {
+	if s.Active < 1 || s.Max < s.Active {
+		return fmt.Errorf("invalid salt schedule: %d active salts out of %d", s.Active, s.Max)
+	}
+	return nil
+}
+
+// SaltedKey derives the key content with key is provided under with the given salt: the SHA2-256 multihash of key
+// followed by the salt as a big-endian uint32. Eclipsing the salted keys of some content requires attacking as many
+// unrelated keyspace regions, which can't be targeted before the content is published.
+func SaltedKey(key multihash.Multihash, salt uint32) multihash.Multihash {
+	buf := make([]byte, len(key)+4)
+	copy(buf, key)
+	binary.BigEndian.PutUint32(buf[len(key):], salt)
+	return u.Hash(buf)
+}
+
+// saltRegistry tracks the salts the keys provided with ProvideSalted are currently provided under.
+type saltRegistry struct {
+	mu    sync.Mutex
+	salts map[string]*keySalts
+}
+
+type keySalts struct {
+	active []uint32
+	// next is the next unused salt
+	next uint32
+}
+
+// get returns the salts key is currently provided under, starting with the first s.Active salts.
+func (r *saltRegistry) get(key multihash.Multihash, s SaltSchedule) []uint32 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.salts == nil {
+		r.salts = make(map[string]*keySalts)
+	}
+	ks, ok := r.salts[string(key)]
+	if !ok {
+		ks = &keySalts{}
+		for ; ks.next < uint32(s.Active); ks.next++ {
+			ks.active = append(ks.active, ks.next)
+		}
+		r.salts[string(key)] = ks
+	}
+	return append([]uint32(nil), ks.active...)
+}
+
+// rotate replaces the attacked salt of key with the next unused salt of s, returning false if all salts were used.
+func (r *saltRegistry) rotate(key multihash.Multihash, attacked uint32, s SaltSchedule) (uint32, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ks := r.salts[string(key)]
+	if ks == nil || ks.next >= uint32(s.Max) {
+		return 0, false
+	}
+	for i, salt := range ks.active {
+		if salt == attacked {
+			ks.active[i] = ks.next
+			ks.next++
+			return ks.active[i], true
+		}
+	}
+	return 0, false
+}
+
+// ProvideSalted provides key under the salted keys of the schedule rather than under key itself, see SaltedKey, and
+// returns the salts it was provided under. Clients find the providers with FindProvidersSalted.
+//
+// Salted keys the eclipse detection finds under attack, i.e. whose DetectionAggregator score reaches 0.5, are replaced
+// with the next unused salt of the schedule, for as long as there are unused salts. With AsyncEclipseDetection the
+// salts are rotated by the next call. Keys keep their salts for the lifetime of the DHT, so that reproviding them
+// doesn't spread the content over new salts.
+func (dht *IpfsDHT) ProvideSalted(ctx context.Context, key cid.Cid, s SaltSchedule) ([]uint32, error) {
+	if err := s.validate(); err != nil {
+		return nil, err
+	}
+	if !key.Defined() {
+		return nil, fmt.Errorf("invalid cid: undefined")
+	}
+	keyMH := key.Hash()
+
+	var provided []uint32
+	pending := dht.salts.get(keyMH, s)
+	for len(pending) > 0 {
+		salt := pending[0]
+		pending = pending[1:]
+		salted := SaltedKey(keyMH, salt)
+		if dht.detections.Score(string(salted)) < saltAttackScore {
+			if err := dht.Provide(ctx, cid.NewCidV1(cid.Raw, salted), true); err != nil {
+				return provided, err
+			}
+			if dht.detections.Score(string(salted)) < saltAttackScore {
+				provided = append(provided, salt)
+				continue
+			}
+		}
+		next, ok := dht.salts.rotate(keyMH, salt, s)
+		if !ok {
+			logger.Warnw("salted key under attack but no salt left", "cid", key, "salt", salt)
+			provided = append(provided, salt)
+			continue
+		}
+		logger.Infow("rotating the salt of a key under attack", "cid", key, "from", salt, "to", next)
+		pending = append(pending, next)
+	}
+	return provided, nil
+}
+
+// FindProvidersSalted finds the providers of key provided with ProvideSalted under the given schedule, searching all
+// of its salted keys concurrently.
+func (dht *IpfsDHT) FindProvidersSalted(ctx context.Context, key cid.Cid, s SaltSchedule) ([]peer.AddrInfo, error) {
+	if err := s.validate(); err != nil {
+		return nil, err
+	}
+	if !key.Defined() {
+		return nil, fmt.Errorf("invalid cid: undefined")
+	}
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		seen      = make(map[peer.ID]struct{})
+		providers []peer.AddrInfo
+		lastErr   error
+	)
+	for salt := 0; salt < s.Max; salt++ {
+		wg.Add(1)
+		go func(salted multihash.Multihash) {
+			defer wg.Done()
+			found, err := dht.FindProviders(ctx, cid.NewCidV1(cid.Raw, salted))
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				lastErr = err
+			}
+			for _, p := range found {
+				if _, ok := seen[p.ID]; !ok {
+					seen[p.ID] = struct{}{}
+					providers = append(providers, p)
+				}
+			}
+		}(SaltedKey(key.Hash(), uint32(salt)))
+	}
+	wg.Wait()
+	if len(providers) == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+	return providers, nil
+}
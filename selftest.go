@@ -0,0 +1,156 @@
+package dht
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	u "github.com/ipfs/go-ipfs-util"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Names of the checks run by SelfTest.
+const (
+	SelfTestProvide          = "provide"
+	SelfTestFindProviders    = "find-providers"
+	SelfTestFindPeer         = "find-peer"
+	SelfTestNetsize          = "netsize"
+	SelfTestEclipseDetection = "eclipse-detection"
+)
+
+// SelfTestCheck is the outcome of a single SelfTest check.
+type SelfTestCheck struct {
+	Name     string
+	Passed   bool
+	Err      error
+	Duration time.Duration
+}
+
+// SelfTestReport is the outcome of SelfTest.
+type SelfTestReport struct {
+	Checks []SelfTestCheck
+}
+
+// Passed returns true if all checks passed.
+func (r SelfTestReport) Passed() bool {
+	for _, c := range r.Checks {
+		if !c.Passed {
+			return false
+		}
+	}
+	return true
+}
+
+// SelfTest exercises the DHT end to end and reports the outcome of every check: it provides a random key and
+// retrieves the provider record from the network, runs FindPeer on a bootstrap peer (or a routing table peer if no
+// bootstrap peers are configured), checks that the network size can be estimated and runs the eclipse detector on the
+// random key. It is meant as a health probe, e.g. for readiness checks.
+//
+// A failing check does not abort the self test, an error is only returned if ctx is done before all checks ran.
+func (dht *IpfsDHT) SelfTest(ctx context.Context) (SelfTestReport, error) {
+	var report SelfTestReport
+	run := func(name string, check func() error) {
+		start := time.Now()
+		err := check()
+		report.Checks = append(report.Checks, SelfTestCheck{
+			Name:     name,
+			Passed:   err == nil,
+			Err:      err,
+			Duration: time.Since(start),
+		})
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return report, err
+	}
+	key := cid.NewCidV1(cid.Raw, u.Hash(buf))
+
+	provided := false
+	run(SelfTestProvide, func() error {
+		err := dht.Provide(ctx, key, true)
+		provided = err == nil
+		return err
+	})
+	run(SelfTestFindProviders, func() error {
+		if !provided {
+			return fmt.Errorf("nothing to find, provide failed")
+		}
+		return dht.selfTestFindProviders(ctx, key)
+	})
+	run(SelfTestFindPeer, func() error {
+		return dht.selfTestFindPeer(ctx)
+	})
+	run(SelfTestNetsize, func() error {
+		_, err := dht.networkSize(ctx)
+		return err
+	})
+	run(SelfTestEclipseDetection, func() error {
+		peers, err := dht.GetClosestPeersK(ctx, string(key.Hash()), defaultEclipseDetectionK)
+		if err != nil {
+			return err
+		}
+		attack, err := dht.EclipseDetection(ctx, key.Hash(), peers)
+		if err != nil {
+			return err
+		}
+		if attack {
+			return fmt.Errorf("possible eclipse attack detected on random key")
+		}
+		return nil
+	})
+
+	return report, ctx.Err()
+}
+
+// selfTestFindProviders checks that at least one of the peers closest to key returns us as a provider. The local
+// provider store is deliberately bypassed.
+func (dht *IpfsDHT) selfTestFindProviders(ctx context.Context, key cid.Cid) error {
+	peers, err := dht.GetClosestPeers(ctx, string(key.Hash()))
+	if err != nil {
+		return err
+	}
+	for _, p := range peers {
+		provs, _, err := dht.protoMessenger.GetProviders(ctx, p, key.Hash())
+		if err != nil {
+			continue
+		}
+		for _, prov := range provs {
+			if prov.ID == dht.self {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("provider record not found on any of %d closest peers", len(peers))
+}
+
+// selfTestFindPeer runs FindPeer on a bootstrap peer, falling back to a routing table peer.
+func (dht *IpfsDHT) selfTestFindPeer(ctx context.Context) error {
+	var target peer.ID
+	if dht.bootstrapPeers != nil {
+		for _, ai := range dht.bootstrapPeers() {
+			if ai.ID != dht.self {
+				target = ai.ID
+				break
+			}
+		}
+	}
+	if target == "" {
+		rtPeers := dht.routingTable.ListPeers()
+		if len(rtPeers) == 0 {
+			return fmt.Errorf("no bootstrap or routing table peers to look up")
+		}
+		target = rtPeers[0]
+	}
+
+	pi, err := dht.FindPeer(ctx, target)
+	if err != nil {
+		return err
+	}
+	if len(pi.Addrs) == 0 {
+		return fmt.Errorf("no addresses found for %s", target)
+	}
+	return nil
+}
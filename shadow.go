@@ -0,0 +1,80 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"github.com/libp2p/go-libp2p-kad-dht/internal"
+	dhtcfg "github.com/libp2p/go-libp2p-kad-dht/internal/config"
+)
+
+// ShadowDHT is a lightweight client-only DHT running on the host of a primary DHT, with a routing table bootstrapped
+// independently of the primary's. Lookups of the shadow only rely on peers learned from its own bootstrap peers, so
+// that comparing them with lookups of the primary exposes a poisoned routing table of the primary.
+type ShadowDHT struct {
+	*IpfsDHT
+	primary *IpfsDHT
+}
+
+// NewShadowDHT creates a ShadowDHT for primary, bootstrapping from the given peers, which should be disjoint from
+// the peers the primary bootstrapped from. The shadow speaks the protocols of the primary with the same bucket size
+// and validator; opts are applied on top. Since the shadow shares the host of the primary, its routing table ignores
+// the connections of the host and only admits the bootstrap peers and the peers answering its own queries.
+//
+// The shadow must be closed independently of the primary.
+func NewShadowDHT(ctx context.Context, primary *IpfsDHT, bootstrap []peer.AddrInfo, opts ...Option) (*ShadowDHT, error) {
+	if len(bootstrap) == 0 {
+		return nil, fmt.Errorf("shadow DHT requires bootstrap peers")
+	}
+	shadowOpts := []Option{
+		ProtocolPrefix(primary.protocolPrefix),
+		BucketSize(primary.bucketSize),
+		Validator(primary.Validator),
+		BootstrapPeers(bootstrap...),
+	}
+	shadowOpts = append(shadowOpts, opts...)
+	// the shadow must remain a client of the host it shares, and independent of its connections
+	shadowOpts = append(shadowOpts, Mode(ModeClient), queriedPeersOnly())
+
+	d, err := New(ctx, primary.host, shadowOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return &ShadowDHT{IpfsDHT: d, primary: primary}, nil
+}
+
+// CrossValidateClosest looks up the closest peers to key with both the primary and the shadow. If their results
+// differ by more than the cross-check threshold of the primary, see CrossCheckThreshold, the key is reported to the
+// DetectionAggregator of the primary as possibly under attack.
+func (s *ShadowDHT) CrossValidateClosest(ctx context.Context, key string) (*CrossCheckResult, error) {
+	primary, err := s.primary.GetClosestPeers(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	shadow, err := s.IpfsDHT.GetClosestPeers(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &CrossCheckResult{
+		Primary:    primary,
+		Secondary:  shadow,
+		Difference: symmetricDifference(primary, shadow),
+	}
+	res.Suspicious = res.Difference > s.primary.crossCheckThreshold
+	if res.Suspicious {
+		logger.Warnw("lookups of the primary and the shadow DHT disagree", "key", internal.LoggableProviderRecordBytes(key), "difference", res.Difference)
+		s.primary.detections.Report(AttackSignal{Key: key, Source: SignalShadow, Score: res.Difference})
+	}
+	return res, nil
+}
+
+// queriedPeersOnly keeps the routing table independent of the connections of the host.
+func queriedPeersOnly() Option {
+	return func(c *dhtcfg.Config) error {
+		c.QueriedPeersOnly = true
+		return nil
+	}
+}
@@ -0,0 +1,106 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+)
+
+// ErrShuttingDown is returned by provides started while the DHT shuts down, see IpfsDHT.Shutdown.
+var ErrShuttingDown = errors.New("dht is shutting down")
+
+// provideDrain tracks the provides in flight so that Shutdown can wait for them.
+type provideDrain struct {
+	mu       sync.Mutex
+	draining bool
+	inflight map[cid.Cid]int
+	// idle is closed once no provide is in flight while draining
+	idle chan struct{}
+}
+
+// track registers a provide of key in flight, to be ended with the returned function. It fails with ErrShuttingDown
+// once the DHT is draining.
+func (d *provideDrain) track(key cid.Cid) (func(), error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.draining {
+		return nil, ErrShuttingDown
+	}
+	if d.inflight == nil {
+		d.inflight = make(map[cid.Cid]int)
+	}
+	d.inflight[key]++
+	return func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if d.inflight[key]--; d.inflight[key] == 0 {
+			delete(d.inflight, key)
+		}
+		if d.draining && len(d.inflight) == 0 {
+			close(d.idle)
+		}
+	}, nil
+}
+
+// drain refuses new provides and returns a channel closed once the provides in flight finished.
+func (d *provideDrain) drain() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.draining {
+		d.draining = true
+		d.idle = make(chan struct{})
+		if len(d.inflight) == 0 {
+			close(d.idle)
+		}
+	}
+	return d.idle
+}
+
+// unfinished returns the keys of the provides still in flight.
+func (d *provideDrain) unfinished() []cid.Cid {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	keys := make([]cid.Cid, 0, len(d.inflight))
+	for k := range d.inflight {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// Shutdown closes the DHT gracefully: new provides fail with ErrShuttingDown, and the provides in flight, including
+// those of the provide queue, get until ctx is done to finish before the DHT is closed. If the provide queue is
+// enabled, the provides still unfinished by then are persisted in the queue and resumed at the next start, see
+// EnableProvideQueue; otherwise they are abandoned like with Close.
+func (dht *IpfsDHT) Shutdown(ctx context.Context) error {
+	idle := dht.provideDrain.drain()
+	queueStopped := make(chan struct{})
+	if q := dht.provideQueue; q != nil {
+		q.stopDispatch()
+		queueStopped = q.stopped
+	} else {
+		close(queueStopped)
+	}
+
+	for _, ch := range []<-chan struct{}{idle, queueStopped} {
+		select {
+		case <-ch:
+		case <-ctx.Done():
+		}
+	}
+
+	unfinished := dht.provideDrain.unfinished()
+	switch {
+	case len(unfinished) == 0:
+	case dht.provideQueue == nil:
+		logger.Warnw("abandoning unfinished provides", "provides", len(unfinished))
+	default:
+		for _, key := range unfinished {
+			if err := dht.EnqueueProvide(dht.ctx, key, ProvidePriorityRoutine); err != nil {
+				logger.Warnw("failed to persist unfinished provide", "cid", key, "error", err)
+			}
+		}
+	}
+	return dht.Close()
+}
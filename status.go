@@ -0,0 +1,144 @@
+package dht
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multihash"
+
+	"github.com/libp2p/go-libp2p-kad-dht/internal"
+)
+
+// statusTimeout bounds the time spent collecting the status, which reads the provide queue from the datastore.
+const statusTimeout = 5 * time.Second
+
+// Status is a snapshot of the health of the DHT for operators, see IpfsDHT.Status and IpfsDHT.StatusHandler.
+type Status struct {
+	Self  peer.ID
+	Mode  string
+	State string
+	Time  time.Time
+
+	RoutingTable RoutingTableStatus
+	Netsize      NetsizeStatus
+	Queries      []QueryStatus
+	Detections   DetectionSummary
+	Provides     ProvideStatus
+}
+
+// RoutingTableStatus is the health of the routing table.
+type RoutingTableStatus struct {
+	Peers int
+	// Buckets is the number of peers per common prefix length with our ID, up to the longest non-empty one.
+	Buckets []int
+}
+
+// NetsizeStatus is the network size estimate, Error being set instead if there is none.
+type NetsizeStatus struct {
+	Estimate float64 `json:",omitempty"`
+	Error    string  `json:",omitempty"`
+}
+
+// QueryStatus is a running query, see QueryInfo, with its key formatted for display.
+type QueryStatus struct {
+	QueryInfo
+	Key string
+}
+
+// ProvideStatus is the depth of the provide queues, omitted if disabled: the provide queue, see EnableProvideQueue,
+// and the provides deferred until the DHT is ready, see DeferProvidesUntilReady.
+type ProvideStatus struct {
+	Queued   *int `json:",omitempty"`
+	Deferred *int `json:",omitempty"`
+}
+
+// Status returns a snapshot of the health of the DHT: routing table, network size estimate, running queries, attack
+// signals and provide queues. It doesn't gather netsize data if there is no estimate yet.
+func (dht *IpfsDHT) Status(ctx context.Context) Status {
+	s := Status{
+		Self:  dht.self,
+		Mode:  dht.modeString(),
+		State: dht.State().String(),
+		Time:  time.Now(),
+	}
+
+	s.RoutingTable.Peers = dht.routingTable.Size()
+	for cpl := 0; cpl < 256; cpl++ {
+		n := dht.routingTable.NPeersForCpl(uint(cpl))
+		s.RoutingTable.Buckets = append(s.RoutingTable.Buckets, n)
+	}
+	last := len(s.RoutingTable.Buckets)
+	for last > 0 && s.RoutingTable.Buckets[last-1] == 0 {
+		last--
+	}
+	s.RoutingTable.Buckets = s.RoutingTable.Buckets[:last]
+
+	if netsize, err := dht.nsEstimator.NetworkSize(); err != nil {
+		s.Netsize.Error = err.Error()
+	} else {
+		s.Netsize.Estimate = netsize
+	}
+
+	for _, q := range dht.ActiveQueries() {
+		s.Queries = append(s.Queries, QueryStatus{QueryInfo: q, Key: statusKey(q.Key)})
+	}
+	s.Detections = dht.detections.Summary()
+
+	if n, err := dht.PendingProvides(ctx); err == nil {
+		s.Provides.Queued = &n
+	}
+	if dht.provideDeferral != nil {
+		n := dht.DeferredProvides()
+		s.Provides.Deferred = &n
+	}
+	return s
+}
+
+func (dht *IpfsDHT) modeString() string {
+	if dht.getMode() == modeServer {
+		return "server"
+	}
+	return "client"
+}
+
+// statusKey formats a key for display: multihashes, including peer IDs, in base32 and record keys by namespace.
+func statusKey(key string) string {
+	if _, err := multihash.Cast([]byte(key)); err == nil {
+		return internal.LoggableProviderRecordBytes(key).String()
+	}
+	return internal.LoggableRecordKeyString(key).String()
+}
+
+// StatusHandler returns an http.Handler serving the Status of the DHT as JSON, to be mounted on an existing HTTP
+// server of the operator, e.g. under /debug/dht. It doesn't authenticate requests.
+func (dht *IpfsDHT) StatusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), statusTimeout)
+		defer cancel()
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(dht.Status(ctx)); err != nil {
+			logger.Debugw("failed to write status", "error", err)
+		}
+	})
+}
+
+// StatusVar returns the Status of the DHT as an expvar.Var, to be published with expvar.Publish under a name unique
+// to the DHT, e.g. "dht-wan", and served by the expvar handler at /debug/vars.
+func (dht *IpfsDHT) StatusVar() expvar.Var {
+	return expvar.Func(func() interface{} {
+		ctx, cancel := context.WithTimeout(dht.ctx, statusTimeout)
+		defer cancel()
+		return dht.Status(ctx)
+	})
+}
@@ -0,0 +1,60 @@
+package dht
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusHandler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 3)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+	connect(t, ctx, dhts[0], dhts[1])
+	connect(t, ctx, dhts[0], dhts[2])
+
+	dhts[0].detections.Report(AttackSignal{Key: "a", Source: SignalCrossCheck, Score: 0.5})
+	dhts[0].detections.Report(AttackSignal{Key: "a", Source: SignalEclipseDetection, Score: 0.5})
+
+	srv := httptest.NewServer(dhts[0].StatusHandler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+	var s Status
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&s))
+	require.Equal(t, dhts[0].self, s.Self)
+	require.Equal(t, "server", s.Mode)
+	require.Equal(t, 2, s.RoutingTable.Peers)
+	sum := 0
+	for _, n := range s.RoutingTable.Buckets {
+		sum += n
+	}
+	require.Equal(t, 2, sum)
+	require.NotEmpty(t, s.Netsize.Error)
+	require.Equal(t, 1, s.Detections.Keys)
+	require.Equal(t, 2, s.Detections.Signals)
+	require.Equal(t, map[string]int{SignalCrossCheck: 1, SignalEclipseDetection: 1}, s.Detections.Sources)
+	require.InDelta(t, 0.75, s.Detections.MaxScore, 1e-9)
+	require.Nil(t, s.Provides.Queued)
+
+	resp, err = http.Post(srv.URL, "application/json", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
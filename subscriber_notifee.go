@@ -38,8 +38,9 @@ func newSubscriberNotifiee(dht *IpfsDHT) (*subscriberNotifee, error) {
 	}
 
 	// register for event bus local routability changes in order to trigger switching between client and server modes
-	// only register for events if the DHT is operating in ModeAuto
-	if dht.auto == ModeAuto || dht.auto == ModeAutoServer {
+	// only register for events if the DHT is operating in ModeAuto, or selects the addresses of its provider records by
+	// reachability
+	if dht.auto == ModeAuto || dht.auto == ModeAutoServer || dht.providerAddrPolicy == ProviderAddrsReachability {
 		evts = append(evts, new(event.EvtLocalReachabilityChanged))
 	}
 
@@ -86,9 +87,10 @@ func (nn *subscriberNotifee) subscribe(proc goprocess.Process) {
 			case event.EvtPeerIdentificationCompleted:
 				handlePeerChangeEvent(dht, evt.Peer)
 			case event.EvtLocalReachabilityChanged:
+				dht.setReachability(evt.Reachability)
 				if dht.auto == ModeAuto || dht.auto == ModeAutoServer {
 					handleLocalReachabilityChangedEvent(dht, evt)
-				} else {
+				} else if dht.providerAddrPolicy != ProviderAddrsReachability {
 					// something has gone really wrong if we get an event we did not subscribe to
 					logger.Errorf("received LocalReachabilityChanged event that was not subscribed to")
 				}
@@ -146,6 +148,10 @@ func handleLocalReachabilityChangedEvent(dht *IpfsDHT, e event.EvtLocalReachabil
 // supporting the primary protocols, we do not want to add peers that are speaking obsolete secondary protocols to our
 // routing table
 func (dht *IpfsDHT) validRTPeer(p peer.ID) (bool, error) {
+	if !dht.peerAllowed(p) {
+		return false, nil
+	}
+
 	b, err := dht.peerstore.FirstSupportedProtocol(p, dht.protocolsStrs...)
 	if len(b) == 0 || err != nil {
 		return false, err
@@ -162,7 +168,7 @@ func (nn *subscriberNotifee) Disconnected(n network.Network, v network.Conn) {
 	dht := nn.dht
 
 	ms, ok := dht.msgSender.(disconnector)
-	if !ok {
+	if !ok && dht.providerAddrBook == nil {
 		return
 	}
 
@@ -183,10 +189,16 @@ func (nn *subscriberNotifee) Disconnected(n network.Network, v network.Conn) {
 		return
 	}
 
-	ms.OnDisconnect(dht.Context(), p)
+	dht.providerDisconnected(p)
+	if ok {
+		ms.OnDisconnect(dht.Context(), p)
+	}
+}
+
+func (nn *subscriberNotifee) Connected(n network.Network, v network.Conn) {
+	nn.dht.providerConnected(v.RemotePeer())
 }
 
-func (nn *subscriberNotifee) Connected(network.Network, network.Conn)      {}
 func (nn *subscriberNotifee) OpenedStream(network.Network, network.Stream) {}
 func (nn *subscriberNotifee) ClosedStream(network.Network, network.Stream) {}
 func (nn *subscriberNotifee) Listen(network.Network, ma.Multiaddr)         {}
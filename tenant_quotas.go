@@ -0,0 +1,144 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+)
+
+const (
+	quotaOpProvide = "provide"
+	quotaOpLookup  = "lookup"
+)
+
+// maxTenantQuotaEntries bounds the number of tenants the quotas keep track of.
+const maxTenantQuotaEntries = 10_000
+
+type tenantKey struct{}
+
+// quotaChargedKey marks contexts whose operation was charged to the quota of its tenant, so that the lookups run by a
+// provide aren't charged again.
+type quotaChargedKey struct{}
+
+// WithTenant labels the operations run with ctx as operations of tenant, see TenantQuotas.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// TenantFromContext returns the tenant ctx is labeled with by WithTenant.
+func TenantFromContext(ctx context.Context) (string, bool) {
+	tenant, ok := ctx.Value(tenantKey{}).(string)
+	return tenant, ok
+}
+
+// QuotaExceededError is returned by operations exceeding the quota of their tenant, see TenantQuotas.
+type QuotaExceededError struct {
+	Tenant string
+	// Operation is "provide" or "lookup".
+	Operation string
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("%s quota of tenant %q exceeded", e.Operation, e.Tenant)
+}
+
+type tenantOp struct {
+	tenant, op string
+}
+
+// tenantQuotas rate limits the operations of every tenant with a token bucket per tenant and operation.
+type tenantQuotas struct {
+	quotas map[string]TenantQuota
+	def    TenantQuota
+
+	mu      sync.Mutex
+	buckets map[tenantOp]*tokenBucket
+}
+
+func newTenantQuotas(quotas map[string]TenantQuota, def TenantQuota) *tenantQuotas {
+	return &tenantQuotas{
+		quotas:  quotas,
+		def:     def,
+		buckets: make(map[tenantOp]*tokenBucket),
+	}
+}
+
+// limit returns the rate and burst of op for tenant, a zero rate being unlimited.
+func (q *tenantQuotas) limit(tenant, op string) (float64, int) {
+	quota, ok := q.quotas[tenant]
+	if !ok {
+		quota = q.def
+	}
+	if op == quotaOpProvide {
+		return quota.ProvideRate, quota.ProvideBurst
+	}
+	return quota.LookupRate, quota.LookupBurst
+}
+
+// take returns false if tenant exceeded its quota of op.
+func (q *tenantQuotas) take(tenant, op string) bool {
+	rate, burst := q.limit(tenant, op)
+	if rate <= 0 {
+		return true
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	k := tenantOp{tenant, op}
+	b, ok := q.buckets[k]
+	if !ok {
+		if len(q.buckets) >= maxTenantQuotaEntries {
+			q.prune(now)
+		}
+		b = newTokenBucket(burst, now)
+		q.buckets[k] = b
+	}
+	return b.take(rate, burst, now)
+}
+
+// prune drops the buckets that have refilled, or all of them if that isn't enough to make room.
+func (q *tenantQuotas) prune(now time.Time) {
+	for k, b := range q.buckets {
+		if rate, burst := q.limit(k.tenant, k.op); b.full(rate, burst, now) {
+			delete(q.buckets, k)
+		}
+	}
+	if len(q.buckets) >= maxTenantQuotaEntries {
+		q.buckets = make(map[tenantOp]*tokenBucket)
+	}
+}
+
+// chargeQuota charges op to the quota of the tenant of ctx, returning a *QuotaExceededError if it is exceeded, and
+// otherwise ctx marked so that the operations op runs aren't charged again.
+func (dht *IpfsDHT) chargeQuota(ctx context.Context, op string) (context.Context, error) {
+	if dht.tenantQuotas == nil || ctx.Value(quotaChargedKey{}) != nil {
+		return ctx, nil
+	}
+	tenant, ok := TenantFromContext(ctx)
+	if !ok {
+		return ctx, nil
+	}
+
+	allowed := dht.tenantQuotas.take(tenant, op)
+	outcome := "accepted"
+	if !allowed {
+		outcome = "rejected"
+	}
+	stats.Record(dht.newContextWithLocalTags(ctx,
+		tag.Upsert(metrics.KeyTenant, tenant),
+		tag.Upsert(metrics.KeyTenantOperation, op),
+		tag.Upsert(metrics.KeyTenantOutcome, outcome),
+	), metrics.TenantRequests.M(1))
+	if !allowed {
+		logger.Debugw("tenant quota exceeded", "tenant", tenant, "operation", op)
+		return ctx, &QuotaExceededError{Tenant: tenant, Operation: op}
+	}
+	return context.WithValue(ctx, quotaChargedKey{}, struct{}{}), nil
+}
@@ -0,0 +1,88 @@
+package dht
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/libp2p/go-libp2p-kad-dht/internal"
+)
+
+// maxValidatorCalls bounds the number of validator calls running at once if ValidatorTimeout is set, including the
+// timed out calls left running in the background.
+const maxValidatorCalls = 128
+
+var (
+	// ErrValidatorTimeout is returned when the Validator takes longer than the timeout set with ValidatorTimeout to
+	// validate or select a record, the record being treated as invalid.
+	ErrValidatorTimeout = errors.New("validator timed out")
+	// ErrValidatorBusy is returned when too many validator calls are already running, the record being treated as
+	// invalid.
+	ErrValidatorBusy = errors.New("too many validator calls running")
+	// ErrValidatorPanic is returned when the Validator panics on a record, the record being treated as invalid.
+	ErrValidatorPanic = errors.New("validator panicked")
+)
+
+// validate runs Validator.Validate on the record of key, isolating the DHT from a Validator hanging or panicking on
+// malformed records.
+func (dht *IpfsDHT) validate(key string, value []byte) error {
+	_, err := dht.guardValidator(key, "validate", func() (int, error) {
+		return 0, dht.Validator.Validate(key, value)
+	})
+	return err
+}
+
+// selectValue runs Validator.Select on the records of key, isolating the DHT from a Validator hanging or panicking on
+// malformed records.
+func (dht *IpfsDHT) selectValue(key string, values [][]byte) (int, error) {
+	return dht.guardValidator(key, "select", func() (int, error) {
+		return dht.Validator.Select(key, values)
+	})
+}
+
+type validatorResult struct {
+	i   int
+	err error
+}
+
+// guardValidator runs the validator call f, turning a panic into ErrValidatorPanic and, if ValidatorTimeout is set,
+// giving up with ErrValidatorTimeout once it expires. A timed out call is left running in the background and keeps its
+// slot among the maxValidatorCalls calls allowed to run at once, calls finding no free slot fail with ErrValidatorBusy.
+func (dht *IpfsDHT) guardValidator(key, op string, f func() (int, error)) (int, error) {
+	run := func() (i int, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				logger.Errorw("validator panicked", "op", op, "key", internal.LoggableRecordKeyString(key), "panic", r,
+					"stack", string(debug.Stack()))
+				err = fmt.Errorf("%w: %v", ErrValidatorPanic, r)
+			}
+		}()
+		return f()
+	}
+	if dht.validatorTimeout <= 0 {
+		return run()
+	}
+
+	select {
+	case dht.validatorCalls <- struct{}{}:
+	default:
+		logger.Warnw("too many validator calls running", "op", op, "key", internal.LoggableRecordKeyString(key))
+		return 0, ErrValidatorBusy
+	}
+	done := make(chan validatorResult, 1)
+	go func() {
+		i, err := run()
+		<-dht.validatorCalls
+		done <- validatorResult{i: i, err: err}
+	}()
+	timer := time.NewTimer(dht.validatorTimeout)
+	defer timer.Stop()
+	select {
+	case res := <-done:
+		return res.i, res.err
+	case <-timer.C:
+		logger.Warnw("validator timed out", "op", op, "key", internal.LoggableRecordKeyString(key), "timeout", dht.validatorTimeout)
+		return 0, ErrValidatorTimeout
+	}
+}
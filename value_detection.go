@@ -0,0 +1,135 @@
+package dht
+
+import (
+	"context"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/routing"
+	"github.com/multiformats/go-multihash"
+
+	internalConfig "github.com/libp2p/go-libp2p-kad-dht/internal/config"
+)
+
+const (
+	// DetectionReasonQuorumNotMet is the reason of a ValueDetection run because the lookup ended before the quorum
+	// was met.
+	DetectionReasonQuorumNotMet = "quorum-not-met"
+	// DetectionReasonConflictingValues is the reason of a ValueDetection run because peers returned different values.
+	DetectionReasonConflictingValues = "conflicting-values"
+)
+
+// ValueDetection is the verdict of the eclipse detector on the closest peers to a key found by a value lookup.
+type ValueDetection struct {
+	// Reason is why the detector ran, DetectionReasonQuorumNotMet or DetectionReasonConflictingValues.
+	Reason string
+	// Eclipsed is true if the detector found the closest peers suspicious.
+	Eclipsed bool
+	// Err is set if the detector could not reach a verdict, e.g. for lack of peers.
+	Err error
+}
+
+// SearchValueResult is a result of SearchValueExtended: a better value and the peer it was received from, or, as the
+// last result, the verdict of the eclipse detector.
+type SearchValueResult struct {
+	Value []byte
+	From  peer.ID
+	// Detection is only set on the last result, if the detector ran.
+	Detection *ValueDetection
+}
+
+// SearchValueExtended is SearchValue also streaming the peers values were received from. Records such as names need
+// the same protection as provider records: when the lookup ends before the quorum is met, or peers return conflicting
+// values, the eclipse detector runs on the closest peers to the key the lookup found, and its verdict is streamed as
+// the last result. Suspicious verdicts are also reported to the DetectionAggregator.
+func (dht *IpfsDHT) SearchValueExtended(ctx context.Context, key string, opts ...routing.Option) (<-chan SearchValueResult, error) {
+	if !dht.valuesEnabled(key) {
+		return nil, routing.ErrNotSupported
+	}
+
+	var cfg routing.Options
+	if err := cfg.Apply(opts...); err != nil {
+		return nil, err
+	}
+	ctx, err := dht.chargeQuota(ctx, quotaOpLookup)
+	if err != nil {
+		return nil, err
+	}
+	ctx = withFollowupOption(ctx, &cfg)
+
+	responsesNeeded := 0
+	if !cfg.Offline {
+		responsesNeeded = internalConfig.GetQuorum(&cfg)
+	}
+
+	stopCh := make(chan struct{})
+	valCh, lookupRes := dht.getValues(ctx, key, stopCh)
+
+	out := make(chan SearchValueResult)
+	go func() {
+		defer close(out)
+
+		numResponses := 0
+		distinct := make(map[string]struct{})
+		best, peersWithBest, quorumMet := dht.processValues(ctx, key, valCh,
+			func(ctx context.Context, v recvdVal, better bool) bool {
+				numResponses++
+				distinct[string(v.Val)] = struct{}{}
+				if better {
+					select {
+					case out <- SearchValueResult{Value: v.Val, From: v.From}:
+					case <-ctx.Done():
+						return false
+					}
+				}
+
+				if responsesNeeded > 0 && numResponses > responsesNeeded {
+					close(stopCh)
+					return true
+				}
+				return false
+			})
+
+		var reason string
+		switch {
+		case len(distinct) > 1:
+			reason = DetectionReasonConflictingValues
+		case responsesNeeded > 0 && !quorumMet:
+			reason = DetectionReasonQuorumNotMet
+		}
+		if ctx.Err() != nil || (reason == "" && (best == nil || quorumMet)) {
+			return
+		}
+
+		var l *lookupWithFollowupResult
+		select {
+		case l = <-lookupRes:
+		case <-ctx.Done():
+			return
+		}
+		if l == nil {
+			return
+		}
+
+		if best != nil && !quorumMet {
+			updatePeers := make([]peer.ID, 0, dht.bucketSize)
+			for _, p := range l.peers {
+				if _, ok := peersWithBest[p]; !ok {
+					updatePeers = append(updatePeers, p)
+				}
+			}
+			dht.updatePeerValues(dht.Context(), key, best, updatePeers)
+		}
+
+		if reason == "" {
+			return
+		}
+		eclipsed, err := dht.eclipseDetectionWithSampling(ctx, multihash.Multihash(key), l.peers)
+		logger.Debugw("value lookup detection", "reason", reason, "eclipsed", eclipsed, "error", err)
+		select {
+		case out <- SearchValueResult{Detection: &ValueDetection{Reason: reason, Eclipsed: eclipsed, Err: err}}:
+		case <-ctx.Done():
+		}
+	}()
+
+	return out, nil
+}
@@ -0,0 +1,196 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/jbenet/goprocess"
+	recpb "github.com/libp2p/go-libp2p-record/pb"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/routing"
+	"github.com/multiformats/go-multihash"
+
+	"github.com/libp2p/go-libp2p-kad-dht/internal"
+)
+
+// maxMirrorLimiterEntries bounds the number of peers the value mirroring rate limiter keeps track of.
+const maxMirrorLimiterEntries = 10_000
+
+// Bounds of the values mirrored in the background, see ValueMirroring.
+const (
+	// mirrorWorkers is the number of values mirrored concurrently.
+	mirrorWorkers = 4
+	// mirrorBacklog is the number of values waiting for a worker, further ones aren't mirrored.
+	mirrorBacklog = 256
+)
+
+// errMirrorBacklog is logged when a value isn't mirrored because too many values are waiting to be mirrored.
+var errMirrorBacklog = errors.New("too many values waiting to be mirrored")
+
+// pendingMirror is a value waiting to be mirrored in the background.
+type pendingMirror struct {
+	key     string
+	rec     *recpb.Record
+	closest []peer.ID
+}
+
+// tokenBucket is a token bucket refilled at rate tokens per second up to burst tokens.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(burst int, now time.Time) *tokenBucket {
+	return &tokenBucket{tokens: float64(burst), last: now}
+}
+
+// take takes a token, returning false if the bucket is empty.
+func (b *tokenBucket) take(rate float64, burst int, now time.Time) bool {
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// full returns true if the bucket is full, i.e. it can be forgotten.
+func (b *tokenBucket) full(rate float64, burst int, now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*rate >= float64(burst)
+}
+
+// mirrorLimiter rate limits the records mirrored to every single peer with a token bucket per peer, so that mirroring
+// many keys doesn't flood the peers of a region.
+type mirrorLimiter struct {
+	rate  float64
+	burst int
+
+	mu    sync.Mutex
+	peers map[peer.ID]*tokenBucket
+}
+
+func newMirrorLimiter(rate float64, burst int) *mirrorLimiter {
+	return &mirrorLimiter{
+		rate:  rate,
+		burst: burst,
+		peers: make(map[peer.ID]*tokenBucket),
+	}
+}
+
+// allow takes a token from the bucket of p, returning false if it is empty.
+func (l *mirrorLimiter) allow(p peer.ID) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	b, ok := l.peers[p]
+	if !ok {
+		if len(l.peers) >= maxMirrorLimiterEntries {
+			l.prune(now)
+		}
+		b = newTokenBucket(l.burst, now)
+		l.peers[p] = b
+	}
+	return b.take(l.rate, l.burst, now)
+}
+
+// prune drops the peers whose buckets have refilled, or all of them if that isn't enough to make room.
+func (l *mirrorLimiter) prune(now time.Time) {
+	for p, b := range l.peers {
+		if b.full(l.rate, l.burst, now) {
+			delete(l.peers, p)
+		}
+	}
+	if len(l.peers) >= maxMirrorLimiterEntries {
+		l.peers = make(map[peer.ID]*tokenBucket)
+	}
+}
+
+// enqueueMirror hands rec, just put to the closest peers to key, to the workers mirroring values in the background,
+// see runMirrors, so that PutValue doesn't wait for the eclipse detection and the region lookup. The value isn't
+// mirrored if too many values are waiting already.
+func (dht *IpfsDHT) enqueueMirror(key string, rec *recpb.Record, closest []peer.ID) {
+	select {
+	case dht.mirrors <- pendingMirror{key: key, rec: rec, closest: closest}:
+	default:
+		logger.Warnw("not mirroring value", "key", internal.LoggableRecordKeyString(key), "error", errMirrorBacklog)
+	}
+}
+
+// runMirrors mirrors the values put with PutValue in the background until the DHT is closed, see ValueMirroring.
+func (dht *IpfsDHT) runMirrors(proc goprocess.Process) {
+	for {
+		select {
+		case m := <-dht.mirrors:
+			dht.mirrorValue(dht.ctx, m.key, m.rec, m.closest)
+		case <-proc.Closing():
+			return
+		}
+	}
+}
+
+// mirrorValue replicates rec, just put to the closest peers to key, to all peers in the keyspace region around key
+// expected to contain specialProvideNumber peers, as special provides do for provider records, if the eclipse detector
+// finds the closest peers suspicious. Peers whose mirroring rate limit is exhausted are skipped. It returns the peers
+// the record was mirrored to.
+func (dht *IpfsDHT) mirrorValue(ctx context.Context, key string, rec *recpb.Record, closest []peer.ID) []peer.ID {
+	eclipsed, err := dht.eclipseDetectionWithSampling(ctx, multihash.Multihash(key), closest)
+	if err != nil || !eclipsed {
+		logger.Debugw("not mirroring value", "key", internal.LoggableRecordKeyString(key), "eclipsed", eclipsed, "error", err)
+		return nil
+	}
+
+	netsize, err := dht.nsEstimator.NetworkSize()
+	if err != nil {
+		logger.Debugw("cannot mirror value without a network size estimate", "key", internal.LoggableRecordKeyString(key), "error", err)
+		return nil
+	}
+	minCPL := int(math.Ceil(math.Log2(netsize/float64(dht.getSpecialProvideNumber())))) - 1
+	region, _, err := dht.GetPeersWithCPLGet(ctx, key, minCPL)
+	if err != nil && err != ErrCPLBudgetExceeded {
+		logger.Debugw("failed to enumerate the region to mirror value to", "key", internal.LoggableRecordKeyString(key), "error", err)
+		return nil
+	}
+
+	sent := make(map[peer.ID]struct{}, len(closest))
+	for _, p := range closest {
+		sent[p] = struct{}{}
+	}
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		mirrored []peer.ID
+		limited  int
+	)
+	for _, p := range region {
+		if _, ok := sent[p]; ok {
+			continue
+		}
+		if !dht.valueMirror.allow(p) {
+			limited++
+			continue
+		}
+		wg.Add(1)
+		go func(p peer.ID) {
+			defer wg.Done()
+			routing.PublishQueryEvent(ctx, &routing.QueryEvent{
+				Type: routing.Value,
+				ID:   p,
+			})
+			if err := dht.protoMessenger.PutValue(ctx, p, rec); err != nil {
+				logger.Debugf("failed mirroring value to peer: %s", err)
+				return
+			}
+			mu.Lock()
+			mirrored = append(mirrored, p)
+			mu.Unlock()
+		}(p)
+	}
+	wg.Wait()
+	logger.Infow("mirrored value", "key", internal.LoggableRecordKeyString(key), "peers", len(mirrored), "rate-limited", limited)
+	return mirrored
+}
@@ -0,0 +1,199 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multihash"
+
+	"github.com/libp2p/go-libp2p-kad-dht/internal"
+	dhtcfg "github.com/libp2p/go-libp2p-kad-dht/internal/config"
+)
+
+// maxPendingVantageChecks bounds the number of provided keys waiting to be verified from the independent vantages.
+const maxPendingVantageChecks = 1024
+
+// vantageCheckTimeout bounds a scheduled verification of a provided key.
+const vantageCheckTimeout = time.Minute
+
+// ProviderVantage looks up the providers of a key from a vantage point independent of our routing table, see
+// IndependentVantages.
+type ProviderVantage = dhtcfg.ProviderVantage
+
+var (
+	_ ProviderVantage = (*ProbePeerVantage)(nil)
+	_ ProviderVantage = (*DHTVantage)(nil)
+)
+
+// ProbePeerVantage asks a remote probe peer for the providers of a key with a regular GET_PROVIDERS request over the
+// DHT protocol. The probe is expected to look the providers up with its own lookup instead of answering from its
+// provider store.
+type ProbePeerVantage struct {
+	probe peer.ID
+}
+
+// NewProbePeerVantage returns a ProbePeerVantage asking the given peer, whose addresses must be known to the peerstore.
+func NewProbePeerVantage(probe peer.ID) *ProbePeerVantage {
+	return &ProbePeerVantage{probe: probe}
+}
+
+// FindProviders implements ProviderVantage.
+func (v *ProbePeerVantage) FindProviders(ctx context.Context, dht interface{}, key multihash.Multihash) ([]peer.ID, error) {
+	d, ok := dht.(*IpfsDHT)
+	if !ok {
+		return nil, fmt.Errorf("probe peer vantage requires an IpfsDHT")
+	}
+	provs, _, err := d.protoMessenger.GetProviders(ctx, v.probe, key)
+	if err != nil {
+		return nil, err
+	}
+	peers := make([]peer.ID, 0, len(provs))
+	for _, ai := range provs {
+		peers = append(peers, ai.ID)
+	}
+	return peers, nil
+}
+
+// DHTVantage looks up the providers of a key with a second DHT instance, typically a local client-only DHT that
+// bootstraps from different peers and thus has a routing table of its own.
+type DHTVantage struct {
+	dht *IpfsDHT
+}
+
+// NewDHTVantage returns a DHTVantage looking up providers with d.
+func NewDHTVantage(d *IpfsDHT) *DHTVantage {
+	return &DHTVantage{dht: d}
+}
+
+// FindProviders implements ProviderVantage.
+func (v *DHTVantage) FindProviders(ctx context.Context, _ interface{}, key multihash.Multihash) ([]peer.ID, error) {
+	var peers []peer.ID
+	for ai := range v.dht.FindProvidersAsync(ctx, cid.NewCidV1(cid.Raw, key), 0) {
+		peers = append(peers, ai.ID)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return peers, nil
+}
+
+// VantageVerification is the outcome of VerifyFromVantages.
+type VantageVerification struct {
+	// Retrievable is the number of vantage points that found this node as a provider of the key.
+	Retrievable int
+	// Missing is the number of vantage points that didn't find this node as a provider of the key.
+	Missing int
+	// Failed is the number of vantage points whose lookup failed. They count neither as retrievable nor as missing.
+	Failed int
+}
+
+// Retrievability is the fraction of the vantage points that answered which found this node as a provider.
+func (v *VantageVerification) Retrievability() float64 {
+	n := v.Retrievable + v.Missing
+	if n == 0 {
+		return 0
+	}
+	return float64(v.Retrievable) / float64(n)
+}
+
+// VerifyFromVantages looks up the providers of key from every vantage point configured with IndependentVantages. If
+// some of them don't find this node as a provider, the key is reported to the DetectionAggregator as possibly under
+// attack, scored by the fraction of vantage points missing the record, and, if the provide queue is enabled, a
+// provide of key is queued with ProvidePriorityAttacked.
+func (dht *IpfsDHT) VerifyFromVantages(ctx context.Context, key multihash.Multihash) (*VantageVerification, error) {
+	if dht.vantages == nil {
+		return nil, fmt.Errorf("no independent vantages configured")
+	}
+
+	var (
+		wg  sync.WaitGroup
+		mu  sync.Mutex
+		res = &VantageVerification{}
+	)
+	for _, v := range dht.vantages.vantages {
+		wg.Add(1)
+		go func(v ProviderVantage) {
+			defer wg.Done()
+			provs, err := v.FindProviders(ctx, dht, key)
+			found := false
+			for _, p := range provs {
+				if p == dht.self {
+					found = true
+					break
+				}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err != nil:
+				logger.Debugw("vantage lookup failed", "key", internal.LoggableProviderRecordBytes(key), "error", err)
+				res.Failed++
+			case found:
+				res.Retrievable++
+			default:
+				res.Missing++
+			}
+		}(v)
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if res.Missing > 0 {
+		logger.Warnw("provider record not retrievable from independent vantages", "key", internal.LoggableProviderRecordBytes(key),
+			"missing", res.Missing, "retrievable", res.Retrievable)
+		dht.detections.Report(AttackSignal{Key: string(key), Source: SignalVantage, Score: 1 - res.Retrievability()})
+		dht.reprovideAttacked(ctx, string(key))
+	}
+	return res, nil
+}
+
+// vantageVerifier schedules the verification of recently provided keys from the independent vantages.
+type vantageVerifier struct {
+	vantages []ProviderVantage
+	delay    time.Duration
+
+	mu      sync.Mutex
+	pending map[string]struct{}
+}
+
+func newVantageVerifier(vantages []ProviderVantage, delay time.Duration) *vantageVerifier {
+	return &vantageVerifier{
+		vantages: vantages,
+		delay:    delay,
+		pending:  make(map[string]struct{}),
+	}
+}
+
+// schedule verifies key from the vantages after the configured delay, unless a verification of key is already
+// pending or too many are.
+func (v *vantageVerifier) schedule(dht *IpfsDHT, key multihash.Multihash) {
+	k := string(key)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if _, ok := v.pending[k]; ok || len(v.pending) >= maxPendingVantageChecks {
+		return
+	}
+	v.pending[k] = struct{}{}
+
+	dht.clock.AfterFunc(v.delay, func() {
+		defer func() {
+			v.mu.Lock()
+			delete(v.pending, k)
+			v.mu.Unlock()
+		}()
+		if dht.ctx.Err() != nil {
+			return
+		}
+		ctx, cancel := context.WithTimeout(dht.ctx, vantageCheckTimeout)
+		defer cancel()
+		if _, err := dht.VerifyFromVantages(ctx, key); err != nil {
+			logger.Debugw("failed to verify provide from vantages", "key", internal.LoggableProviderRecordBytes(key), "error", err)
+		}
+	})
+}